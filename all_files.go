@@ -26,6 +26,8 @@ func (it *filesInIterator) addRefsFrom(obj schema.Object) {
 	switch obj := obj.(type) {
 	case *schema.DirEntry:
 		it.refs = append(it.refs, obj.Ref)
+	case *schema.Commit:
+		it.refs = append(it.refs, obj.Root)
 	case *schema.List:
 		for _, ent := range obj.List {
 			it.refs = append(it.refs, ent)
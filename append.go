@@ -0,0 +1,153 @@
+package cas
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage/local"
+	"github.com/dennwc/cas/types"
+)
+
+// storeAppend stores a local file that is expected to only grow, like a log file.
+//
+// The layout of the file is recorded each time it's stored. If the file grew since then and the previously
+// stored content is still a prefix of the file, only the appended tail is stored, and the file is described
+// by the parts of the previous content followed by the tail. Otherwise, the file is stored as usual.
+func (s *Storage) storeAppend(ctx context.Context, lf *localFile, conf *StoreConfig) (types.SizedRef, bool, error) {
+	f, err := os.Open(lf.path)
+	if err != nil {
+		return types.SizedRef{}, false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return types.SizedRef{}, false, err
+	}
+	last, err := s.fileLayout(ctx, f)
+	if err != nil {
+		return types.SizedRef{}, false, err
+	}
+	var sr types.SizedRef
+	if last.Valid(fi) {
+		// not modified since it was stored
+		if _, err = s.StatBlob(ctx, last.Ref); err == nil {
+			return types.SizedRef{Ref: last.Ref, Size: last.Size}, false, nil
+		}
+	} else if !last.Ref.Zero() && last.Size != 0 && last.Size < uint64(fi.Size()) {
+		sr, err = s.storeTail(ctx, f, last, conf)
+		if err != nil {
+			return types.SizedRef{}, false, err
+		}
+	}
+	f.Close()
+	if sr.Ref.Zero() {
+		var changed bool
+		sr, changed, err = s.storeFileOnce(ctx, lf, conf)
+		if err != nil || changed {
+			return sr, changed, err
+		}
+		fi = lf.fi
+	} else if fileChanged(lf.path, fi) {
+		return sr, true, nil
+	}
+	if fi != nil {
+		_ = s.saveFileLayoutPath(ctx, lf.path, fi, sr.Ref)
+	}
+	return sr, false, nil
+}
+
+// storeTail stores the content of the file that follows the previously stored prefix, and a list of parts
+// of the whole content. It returns a zero ref if the stored content is no longer a prefix of the file.
+func (s *Storage) storeTail(ctx context.Context, f *os.File, last local.FileLayout, conf *StoreConfig) (types.SizedRef, error) {
+	parts, cref, err := s.contentParts(ctx, last.Ref)
+	if err != nil || cref.Zero() {
+		// previous content was removed or cannot be extended; store the file as usual
+		return types.SizedRef{}, nil
+	}
+	// hash the prefix and the tail in one pass
+	h := types.NewRef().Hash()
+	if _, err = io.CopyN(h, f, int64(last.Size)); err != nil {
+		return types.SizedRef{}, err
+	}
+	if types.NewRef().WithHash(h) != cref {
+		// file was rewritten
+		return types.SizedRef{}, nil
+	}
+	c := *conf
+	c.Expect = SizedRef{}
+	tail, err := s.StoreBlob(ctx, io.TeeReader(f, h), &c)
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	ref := types.NewRef().WithHash(h)
+	size := last.Size + tail.Size
+	if err = conf.checkRef(SizedRef{Ref: ref, Size: size}); err != nil {
+		return types.SizedRef{}, err
+	}
+	if tail.Size != 0 {
+		parts = append(parts, tail)
+	}
+	list := &schema.InlineList{
+		Ref:   &ref,
+		Elem:  typeSizedRef,
+		List:  make([]schema.Object, 0, len(parts)),
+		Stats: Stats{schema.StatDataSize: size},
+	}
+	for _, p := range parts {
+		p := p
+		list.List = append(list.List, &p)
+	}
+	lref, err := s.StoreSchema(ctx, list)
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	return SizedRef{Ref: lref.Ref, Size: size}, nil
+}
+
+// contentParts returns the parts of the file content stored as a given object, and the ref of the content.
+// Lists of parts are flattened, thus appending to the same file doesn't increase the nesting.
+func (s *Storage) contentParts(ctx context.Context, ref types.Ref) ([]types.SizedRef, types.Ref, error) {
+	obj, err := s.DecodeSchema(ctx, ref)
+	if err == schema.ErrNotSchema {
+		sz, err := s.StatBlob(ctx, ref)
+		if err != nil {
+			return nil, types.Ref{}, err
+		}
+		return []types.SizedRef{{Ref: ref, Size: sz}}, ref, nil
+	} else if err != nil {
+		return nil, types.Ref{}, err
+	}
+	switch obj := obj.(type) {
+	case *schema.InlineList:
+		if obj.Elem != typeSizedRef || obj.Ref == nil {
+			break
+		}
+		parts := make([]types.SizedRef, 0, len(obj.List)+1)
+		for _, e := range obj.List {
+			sr, ok := e.(*types.SizedRef)
+			if !ok {
+				return nil, types.Ref{}, nil
+			}
+			parts = append(parts, *sr)
+		}
+		return parts, *obj.Ref, nil
+	case *schema.List:
+		if obj.Elem != typeSizedRef || obj.Ref == nil {
+			break
+		}
+		return []types.SizedRef{{Ref: ref, Size: obj.Stats.Size()}}, *obj.Ref, nil
+	}
+	return nil, types.Ref{}, nil
+}
+
+// saveFileLayoutPath records the layout of a local file.
+func (s *Storage) saveFileLayoutPath(ctx context.Context, path string, fi os.FileInfo, ref types.Ref) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.saveFileLayout(ctx, f, fi, ref)
+}
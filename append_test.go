@@ -0,0 +1,96 @@
+package cas_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/local"
+	"github.com/dennwc/cas/types"
+)
+
+func TestStoreAppend(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_append_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ls, err := local.NewWithOptions(filepath.Join(dir, "store"), true, &local.Options{NoXattr: true})
+	require.NoError(t, err)
+	s, err := cas.New(ls)
+	require.NoError(t, err)
+	defer s.Close()
+
+	path := filepath.Join(dir, "app.log")
+	appendLine := func(line string) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		require.NoError(t, err)
+		_, err = f.WriteString(line + "\n")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	conf := &cas.StoreConfig{Append: true}
+	store := func() types.SizedRef {
+		sr, err := s.StoreFilePath(ctx, path, conf)
+		require.NoError(t, err)
+
+		// content is restored as is
+		dst := filepath.Join(dir, "out.log")
+		defer os.Remove(dst)
+		require.NoError(t, s.Checkout(ctx, sr.Ref, dst))
+		exp, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		got, err := ioutil.ReadFile(dst)
+		require.NoError(t, err)
+		require.Equal(t, string(exp), string(got))
+		require.Equal(t, uint64(len(exp)), sr.Size)
+		return sr
+	}
+	sized := func(s string) types.SizedRef {
+		return types.SizedRef{Ref: types.StringRef(s), Size: uint64(len(s))}
+	}
+	parts := func(ref types.Ref) []types.SizedRef {
+		obj, err := s.DecodeSchema(ctx, ref)
+		require.NoError(t, err)
+		list, ok := obj.(*schema.InlineList)
+		require.True(t, ok, "%T", obj)
+		var out []types.SizedRef
+		for _, e := range list.List {
+			out = append(out, *e.(*types.SizedRef))
+		}
+		return out
+	}
+
+	appendLine("first")
+	first := store()
+	require.Equal(t, types.StringRef("first\n"), first.Ref)
+
+	// unchanged file
+	require.Equal(t, first, store())
+
+	// only the tail is stored
+	appendLine("second")
+	sr := store()
+	require.Equal(t, []types.SizedRef{first, sized("second\n")}, parts(sr.Ref))
+	_, err = s.StatBlob(ctx, types.StringRef("first\nsecond\n"))
+	require.Equal(t, storage.ErrNotFound, err)
+
+	// parts are not nested
+	appendLine("third")
+	sr = store()
+	require.Equal(t, []types.SizedRef{
+		first, sized("second\n"), sized("third\n"),
+	}, parts(sr.Ref))
+
+	// rewritten file is stored as a whole
+	require.NoError(t, ioutil.WriteFile(path, []byte("rotated log file\n"), 0644))
+	sr = store()
+	require.Equal(t, types.StringRef("rotated log file\n"), sr.Ref)
+}
@@ -0,0 +1,320 @@
+// Package bench implements end-to-end benchmarks of CAS storage backends.
+//
+// Benchmarks generate a synthetic tree of files with pseudo-random content, store it, fetch it back
+// or copy it to another storage, and measure the throughput and the latency of individual operations.
+// The content is derived from a seed, thus runs with the same options are comparable across backends
+// and configurations.
+//
+// Generated blobs are not pinned and will be removed by the garbage collection.
+package bench
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/types"
+)
+
+// Options controls the shape of the generated tree and the benchmark execution.
+type Options struct {
+	// Files is the number of files in the tree. Default is 100.
+	Files int
+	// Dirs is the number of directories files are spread across. Files are stored in the root if it's zero.
+	Dirs int
+	// MinSize and MaxSize set the range of file sizes. Default is 64KB for both.
+	MinSize, MaxSize uint64
+	// Seed for the content of files. Trees generated with the same options and seed are identical.
+	Seed int64
+	// Parallel is the number of concurrent operations. Default is 1.
+	Parallel int
+}
+
+func (o *Options) defaults() *Options {
+	var c Options
+	if o != nil {
+		c = *o
+	}
+	if c.Files <= 0 {
+		c.Files = 100
+	}
+	if c.MinSize == 0 && c.MaxSize == 0 {
+		c.MinSize, c.MaxSize = 64*1024, 64*1024
+	} else if c.MaxSize < c.MinSize {
+		c.MaxSize = c.MinSize
+	}
+	if c.Parallel <= 0 {
+		c.Parallel = 1
+	}
+	return &c
+}
+
+// Tree is a synthetic tree stored by Ingest.
+type Tree struct {
+	Root  types.SizedRef   // ref of the root directory
+	Files []types.SizedRef // content of all files
+	Size  uint64           // total size of files
+}
+
+// Result is a report of a single benchmark.
+type Result struct {
+	Name      string          `json:"name"`
+	Ops       int             `json:"ops"`      // number of measured operations
+	Bytes     uint64          `json:"bytes"`    // total size of transferred data
+	Duration  time.Duration   `json:"duration"` // wall time of the benchmark
+	Latencies []time.Duration `json:"-"`        // latency of each operation, sorted
+}
+
+// Throughput returns the average number of bytes transferred per second.
+func (r *Result) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+// Percentile returns the latency percentile in the range [0, 100].
+func (r *Result) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.Latencies)-1) * p / 100)
+	if i < 0 {
+		i = 0
+	} else if i >= len(r.Latencies) {
+		i = len(r.Latencies) - 1
+	}
+	return r.Latencies[i]
+}
+
+// MarshalJSON encodes the result together with the throughput and latency percentiles.
+func (r *Result) MarshalJSON() ([]byte, error) {
+	type result Result
+	return json.Marshal(struct {
+		*result
+		Throughput float64       `json:"throughput"`
+		P50        time.Duration `json:"p50"`
+		P90        time.Duration `json:"p90"`
+		P99        time.Duration `json:"p99"`
+		Max        time.Duration `json:"max"`
+	}{
+		result:     (*result)(r),
+		Throughput: r.Throughput(),
+		P50:        r.Percentile(50),
+		P90:        r.Percentile(90),
+		P99:        r.Percentile(99),
+		Max:        r.Percentile(100),
+	})
+}
+
+func (r *Result) String() string {
+	lat := func(p float64) time.Duration {
+		return r.Percentile(p).Round(time.Microsecond)
+	}
+	return fmt.Sprintf("%-8s %6d ops %10s %10v %10s/s  p50 %v  p90 %v  p99 %v  max %v",
+		r.Name, r.Ops, humanize.IBytes(r.Bytes), r.Duration.Round(time.Millisecond),
+		humanize.IBytes(uint64(r.Throughput())),
+		lat(50), lat(90), lat(99), lat(100),
+	)
+}
+
+// recorder collects latencies of concurrent operations.
+type recorder struct {
+	mu    sync.Mutex
+	start time.Time
+	res   Result
+}
+
+func newRecorder(name string) *recorder {
+	return &recorder{start: time.Now(), res: Result{Name: name}}
+}
+
+func (r *recorder) add(dt time.Duration, size uint64) {
+	r.mu.Lock()
+	r.res.Ops++
+	r.res.Bytes += size
+	r.res.Latencies = append(r.res.Latencies, dt)
+	r.mu.Unlock()
+}
+
+func (r *recorder) done() *Result {
+	res := r.res
+	res.Duration = time.Since(r.start)
+	sort.Slice(res.Latencies, func(i, j int) bool {
+		return res.Latencies[i] < res.Latencies[j]
+	})
+	return &res
+}
+
+// parallel runs the function for indexes in [0, n) with a given number of workers.
+// It stops on the first error.
+func parallel(ctx context.Context, workers, n int, fnc func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	jobs := make(chan int)
+	errc := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := fnc(ctx, i); err != nil {
+					errc <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+loop:
+	for i := 0; i < n; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	select {
+	case err := <-errc:
+		return err
+	default:
+	}
+	return ctx.Err()
+}
+
+// fileSizes returns sizes of files in the generated tree.
+func fileSizes(opts *Options) []uint64 {
+	rnd := rand.New(rand.NewSource(opts.Seed))
+	sizes := make([]uint64, opts.Files)
+	for i := range sizes {
+		sz := opts.MinSize
+		if d := opts.MaxSize - opts.MinSize; d != 0 {
+			sz += uint64(rnd.Int63n(int64(d) + 1))
+		}
+		sizes[i] = sz
+	}
+	return sizes
+}
+
+// fileContent returns a reader for the content of the i-th file.
+func fileContent(opts *Options, i int, size uint64) io.Reader {
+	// each file has its own source, so files can be generated concurrently
+	rnd := rand.New(rand.NewSource(opts.Seed + int64(i) + 1))
+	return io.LimitReader(rnd, int64(size))
+}
+
+// Ingest generates a tree of files and stores it. Each file is measured as a separate operation,
+// while storing directories is included only in the total duration.
+func Ingest(ctx context.Context, s *cas.Storage, opts *Options) (*Result, *Tree, error) {
+	opts = opts.defaults()
+	sizes := fileSizes(opts)
+	files := make([]types.SizedRef, len(sizes))
+
+	rec := newRecorder("ingest")
+	err := parallel(ctx, opts.Parallel, len(sizes), func(ctx context.Context, i int) error {
+		start := time.Now()
+		sr, err := s.StoreBlob(ctx, fileContent(opts, i, sizes[i]), nil)
+		if err != nil {
+			return err
+		}
+		rec.add(time.Since(start), sr.Size)
+		files[i] = sr
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, err := storeTree(ctx, s, opts, files)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rec.done(), tree, nil
+}
+
+// storeTree stores directories of the generated tree.
+func storeTree(ctx context.Context, s *cas.Storage, opts *Options, files []types.SizedRef) (*Tree, error) {
+	tree := &Tree{Files: files}
+	dirs := opts.Dirs
+	if dirs <= 0 {
+		dirs = 1
+	}
+	ents := make([][]schema.DirEntry, dirs)
+	for i, sr := range files {
+		tree.Size += sr.Size
+		d := i % dirs
+		ents[d] = append(ents[d], schema.DirEntry{
+			Ref: sr.Ref, Name: fmt.Sprintf("file%06d", i),
+			Stats: schema.Stats{schema.StatDataSize: sr.Size},
+		})
+	}
+	if opts.Dirs <= 0 {
+		root, _, err := s.StoreDirEntries(ctx, ents[0])
+		if err != nil {
+			return nil, err
+		}
+		tree.Root = root
+		return tree, nil
+	}
+	var top []schema.DirEntry
+	for i, list := range ents {
+		sr, st, err := s.StoreDirEntries(ctx, list)
+		if err != nil {
+			return nil, err
+		}
+		top = append(top, schema.DirEntry{Ref: sr.Ref, Name: fmt.Sprintf("dir%04d", i), Stats: st})
+	}
+	root, _, err := s.StoreDirEntries(ctx, top)
+	if err != nil {
+		return nil, err
+	}
+	tree.Root = root
+	return tree, nil
+}
+
+// Fetch reads the content of all files of the tree. Each file is measured as a separate operation.
+func Fetch(ctx context.Context, s *cas.Storage, tree *Tree, opts *Options) (*Result, error) {
+	opts = opts.defaults()
+	rec := newRecorder("fetch")
+	err := parallel(ctx, opts.Parallel, len(tree.Files), func(ctx context.Context, i int) error {
+		start := time.Now()
+		rc, _, err := s.FetchBlob(ctx, tree.Files[i].Ref)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		rec.add(time.Since(start), uint64(n))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rec.done(), nil
+}
+
+// Sync copies the tree with all referenced blobs from one storage to another as a single operation.
+func Sync(ctx context.Context, dst, src *cas.Storage, tree *Tree) (*Result, error) {
+	rec := newRecorder("sync")
+	start := time.Now()
+	if err := src.Push(ctx, dst, tree.Root.Ref); err != nil {
+		return nil, err
+	}
+	rec.add(time.Since(start), tree.Size)
+	return rec.done(), nil
+}
@@ -0,0 +1,62 @@
+package bench
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage"
+)
+
+func TestBench(t *testing.T) {
+	ctx := context.Background()
+	open := func() *cas.Storage {
+		s, err := cas.New(storage.NewInMemory())
+		require.NoError(t, err)
+		return s
+	}
+	src, dst := open(), open()
+
+	opts := &Options{Files: 20, Dirs: 3, MinSize: 10, MaxSize: 1000, Seed: 1, Parallel: 4}
+	res, tree, err := Ingest(ctx, src, opts)
+	require.NoError(t, err)
+	require.Equal(t, 20, res.Ops)
+	require.Len(t, tree.Files, 20)
+	require.Equal(t, tree.Size, res.Bytes)
+	require.Len(t, res.Latencies, 20)
+	require.True(t, res.Percentile(50) <= res.Percentile(100))
+
+	// the same seed generates the same tree
+	_, tree2, err := Ingest(ctx, open(), opts)
+	require.NoError(t, err)
+	require.Equal(t, tree.Root, tree2.Root)
+
+	res, err = Fetch(ctx, src, tree, opts)
+	require.NoError(t, err)
+	require.Equal(t, 20, res.Ops)
+	require.Equal(t, tree.Size, res.Bytes)
+
+	res, err = Sync(ctx, dst, src, tree)
+	require.NoError(t, err)
+	require.Equal(t, 1, res.Ops)
+	for _, sr := range tree.Files {
+		_, err = dst.StatBlob(ctx, sr.Ref)
+		require.NoError(t, err)
+	}
+	_, err = dst.StatBlob(ctx, tree.Root.Ref)
+	require.NoError(t, err)
+}
+
+func TestPercentile(t *testing.T) {
+	r := &Result{Bytes: 1000, Duration: time.Second}
+	require.Equal(t, time.Duration(0), r.Percentile(50))
+	for i := 1; i <= 100; i++ {
+		r.Latencies = append(r.Latencies, time.Duration(i)*time.Millisecond)
+	}
+	require.Equal(t, 50*time.Millisecond, r.Percentile(50))
+	require.Equal(t, 100*time.Millisecond, r.Percentile(100))
+	require.Equal(t, 1000.0, r.Throughput())
+}
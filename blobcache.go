@@ -0,0 +1,124 @@
+package cas
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/types"
+)
+
+// MaxCachedBlob is the maximal size of a blob that is kept in the in-memory blob cache.
+// Most schema blobs are smaller than this.
+const MaxCachedBlob = 64 << 10
+
+// blobCache is a size-bounded in-memory cache of the content of small blobs.
+// Least recently used blobs are evicted first.
+type blobCache struct {
+	max uint64
+
+	mu    sync.Mutex
+	size  uint64
+	lru   *list.List // of *cachedBlob; most recent is first
+	elems map[types.Ref]*list.Element
+}
+
+type cachedBlob struct {
+	ref  types.Ref
+	data []byte
+}
+
+func newBlobCache(max uint64) *blobCache {
+	return &blobCache{
+		max:   max,
+		lru:   list.New(),
+		elems: make(map[types.Ref]*list.Element),
+	}
+}
+
+func (c *blobCache) get(ref types.Ref) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.elems[ref]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedBlob).data, true
+}
+
+func (c *blobCache) put(ref types.Ref, data []byte) {
+	if uint64(len(data)) > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.elems[ref]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.elems[ref] = c.lru.PushFront(&cachedBlob{ref: ref, data: data})
+	c.size += uint64(len(data))
+	for c.size > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *blobCache) delete(ref types.Ref) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.elems[ref]; ok {
+		c.remove(e)
+	}
+}
+
+// remove drops a cache entry. It should be called with the lock held.
+func (c *blobCache) remove(e *list.Element) {
+	b := c.lru.Remove(e).(*cachedBlob)
+	delete(c.elems, b.ref)
+	c.size -= uint64(len(b.data))
+}
+
+// EnableCache enables an in-memory cache of recently fetched blobs that are smaller than MaxCachedBlob.
+// The total size of cached blobs is limited by size. Zero size disables the cache.
+// It should be called before the storage is used.
+func (s *Storage) EnableCache(size uint64) {
+	if size == 0 {
+		s.cache = nil
+		return
+	}
+	s.cache = newBlobCache(size)
+}
+
+type fetchFunc func(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error)
+
+// fetchCached fetches the blob from the cache, if it's enabled. Small blobs that are not in the cache
+// are read from the storage and added to the cache. If only schema blobs are fetched, cached data blobs
+// are reported as schema.ErrNotSchema.
+func (s *Storage) fetchCached(ctx context.Context, ref types.Ref, onlySchema bool, fetch fetchFunc) (io.ReadCloser, uint64, error) {
+	c := s.cache
+	if c == nil {
+		return fetch(ctx, ref)
+	}
+	if data, ok := c.get(ref); ok {
+		if onlySchema && (len(data) <= schema.MagicSize || !schema.IsSchema(data)) {
+			return nil, 0, schema.ErrNotSchema
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), uint64(len(data)), nil
+	}
+	rc, sz, err := fetch(ctx, ref)
+	if err != nil || sz > MaxCachedBlob || sz > c.max {
+		return rc, sz, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.put(ref, data)
+	return ioutil.NopCloser(bytes.NewReader(data)), uint64(len(data)), nil
+}
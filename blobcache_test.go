@@ -0,0 +1,72 @@
+package cas_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// countingStorage counts blob fetches.
+type countingStorage struct {
+	storage.Storage
+	fetches map[types.Ref]int
+}
+
+func (s *countingStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	s.fetches[ref]++
+	return s.Storage.FetchBlob(ctx, ref)
+}
+
+func (s *countingStorage) DeleteBlob(ctx context.Context, ref types.Ref) error {
+	return s.Storage.(storage.BlobDeleter).DeleteBlob(ctx, ref)
+}
+
+func TestBlobCache(t *testing.T) {
+	ctx := context.Background()
+	st := &countingStorage{Storage: storage.NewInMemory(), fetches: make(map[types.Ref]int)}
+	s, err := cas.New(st)
+	require.NoError(t, err)
+	s.EnableCache(1 << 20)
+
+	small, err := s.StoreBlob(ctx, bytes.NewReader([]byte("small")), nil)
+	require.NoError(t, err)
+	large, err := s.StoreBlob(ctx, bytes.NewReader(make([]byte, cas.MaxCachedBlob+1)), nil)
+	require.NoError(t, err)
+	dir, err := s.StoreSchema(ctx, &schema.Multipart{Parts: []types.SizedRef{small, small}})
+	require.NoError(t, err)
+
+	fetch := func(ref types.Ref) {
+		rc, _, err := s.FetchBlob(ctx, ref)
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		fetch(small.Ref)
+		fetch(large.Ref)
+		_, err = s.DecodeSchema(ctx, dir.Ref)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, st.fetches[small.Ref])
+	require.Equal(t, 3, st.fetches[large.Ref])
+	require.Equal(t, 1, st.fetches[dir.Ref])
+
+	// cached data blobs are not schema blobs
+	_, _, err = s.FetchSchema(ctx, small.Ref)
+	require.Equal(t, schema.ErrNotSchema, err)
+
+	// deleted blobs are removed from the cache
+	require.NoError(t, s.DeleteBlob(ctx, small.Ref))
+	_, _, err = s.FetchBlob(ctx, small.Ref)
+	require.Equal(t, storage.ErrNotFound, err)
+}
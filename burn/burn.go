@@ -0,0 +1,571 @@
+// Package burn exports trees to size-limited volumes for write-once media, such as optical discs or tapes.
+//
+// A tree pack (see storage.WritePack) is split into data volumes of a fixed size. Each volume is a directory
+// with a slice of the pack and a manifest that lists hashes of all blocks of all volumes, thus any volume
+// can be verified on its own. Parity volumes contain XOR of data volumes of the same group, similar to RAID,
+// and allow restoring the tree if a single volume of each group is missing. Damaged blocks are repaired
+// individually, so unreadable sectors at different offsets don't prevent the restore either.
+package burn
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/types"
+)
+
+const (
+	// ManifestFile is the name of the manifest in each volume.
+	ManifestFile = "manifest.json"
+	// DataFile is the name of the file with the data of the volume.
+	DataFile = "volume.dat"
+)
+
+const (
+	// DefaultVolumeSize is the size of a single-layer Blu-ray disc.
+	DefaultVolumeSize = 25 * 1000 * 1000 * 1000
+	// DefaultBlockSize is the default size of blocks that are verified and repaired individually.
+	DefaultBlockSize = 1 << 20
+)
+
+// Options controls how volumes are written.
+type Options struct {
+	// VolumeSize is the size of the data in each volume, rounded down to the block size. Default is 25GB.
+	// The manifest adds about 80 bytes for each block of the set.
+	VolumeSize uint64
+	// BlockSize is the size of blocks that are verified and repaired individually. Default is 1MiB.
+	BlockSize uint64
+	// Parity is the number of parity volumes. Data volumes are assigned to parity groups in turns,
+	// and a single volume in each group can be restored. Default is 1, negative value disables parity.
+	Parity int
+}
+
+func (o *Options) defaults() *Options {
+	var c Options
+	if o != nil {
+		c = *o
+	}
+	if c.BlockSize == 0 {
+		c.BlockSize = DefaultBlockSize
+	}
+	if c.VolumeSize == 0 {
+		c.VolumeSize = DefaultVolumeSize
+	}
+	c.VolumeSize -= c.VolumeSize % c.BlockSize
+	if c.VolumeSize == 0 {
+		c.VolumeSize = c.BlockSize
+	}
+	if c.Parity == 0 {
+		c.Parity = 1
+	} else if c.Parity < 0 {
+		c.Parity = 0
+	}
+	return &c
+}
+
+// Manifest describes a set of volumes. A copy of the manifest is written to each volume.
+type Manifest struct {
+	Root      types.Ref `json:"root"`       // root of the tree
+	Size      uint64    `json:"size"`       // size of the tree pack
+	BlockSize uint64    `json:"block_size"` // size of blocks
+	Volumes   []Volume  `json:"volumes"`    // data volumes, followed by parity volumes
+	Volume    int       `json:"volume"`     // index of the volume that contains the manifest
+}
+
+// Volume describes the data file of a single volume.
+type Volume struct {
+	Parity bool        `json:"parity,omitempty"` // parity volume
+	Group  int         `json:"group"`            // parity group
+	Size   uint64      `json:"size"`             // size of the data file
+	Blocks []types.Ref `json:"blocks"`           // hashes of blocks of the data file
+}
+
+// VolumeName returns the name of the volume directory with a given index.
+func VolumeName(i int) string {
+	return fmt.Sprintf("vol%03d", i+1)
+}
+
+// blockLen returns the size of the i-th block of the volume.
+func (m *Manifest) blockLen(v *Volume, i int) uint64 {
+	off := uint64(i) * m.BlockSize
+	if n := v.Size - off; n < m.BlockSize {
+		return n
+	}
+	return m.BlockSize
+}
+
+// Write writes all blobs reachable from the root to volumes in a given directory.
+func Write(ctx context.Context, s *cas.Storage, root types.Ref, dir string, opts *Options) (*Manifest, error) {
+	opts = opts.defaults()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &volumeWriter{
+		dir: dir, opts: opts,
+		m:      &Manifest{Root: root, BlockSize: opts.BlockSize},
+		buf:    make([]byte, 0, opts.BlockSize),
+		parity: make([]*os.File, opts.Parity),
+	}
+	defer w.close()
+	if err := s.WritePack(ctx, w, root); err != nil {
+		return nil, err
+	}
+	if err := w.finish(); err != nil {
+		return nil, err
+	}
+	return w.m, nil
+}
+
+// volumeWriter splits a stream into data volumes and accumulates parity of each group.
+type volumeWriter struct {
+	dir  string
+	opts *Options
+	m    *Manifest
+
+	buf    []byte     // current block
+	cur    *os.File   // data file of the last volume
+	parity []*os.File // temporary parity files for each group
+	tmp    []byte     // buffer for parity blocks
+}
+
+func (w *volumeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flushBlock(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	w.m.Size += uint64(n)
+	return n, nil
+}
+
+// flushBlock writes the current block to the last data volume, starting a new volume if necessary.
+func (w *volumeWriter) flushBlock() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	vols := w.m.Volumes
+	if len(vols) == 0 || vols[len(vols)-1].Size >= w.opts.VolumeSize {
+		if err := w.startVolume(); err != nil {
+			return err
+		}
+	}
+	i := len(w.m.Volumes) - 1
+	v := &w.m.Volumes[i]
+	if _, err := w.cur.Write(w.buf); err != nil {
+		return err
+	}
+	if w.opts.Parity != 0 {
+		if err := w.addParity(v.Group, v.Size, w.buf); err != nil {
+			return err
+		}
+	}
+	v.Blocks = append(v.Blocks, types.BytesRef(w.buf))
+	v.Size += uint64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+func (w *volumeWriter) startVolume() error {
+	if err := w.closeVolume(); err != nil {
+		return err
+	}
+	i := len(w.m.Volumes)
+	vdir := filepath.Join(w.dir, VolumeName(i))
+	if err := os.Mkdir(vdir, 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(vdir, DataFile))
+	if err != nil {
+		return err
+	}
+	w.cur = f
+	v := Volume{}
+	if w.opts.Parity != 0 {
+		v.Group = i % w.opts.Parity
+	}
+	w.m.Volumes = append(w.m.Volumes, v)
+	return nil
+}
+
+func (w *volumeWriter) closeVolume() error {
+	if w.cur == nil {
+		return nil
+	}
+	err := w.cur.Sync()
+	if err2 := w.cur.Close(); err == nil {
+		err = err2
+	}
+	w.cur = nil
+	return err
+}
+
+// addParity adds the block to the parity of the group. Parity blocks are always of the full size,
+// shorter blocks are padded with zeros.
+func (w *volumeWriter) addParity(g int, off uint64, p []byte) error {
+	f := w.parity[g]
+	if f == nil {
+		var err error
+		f, err = ioutil.TempFile(w.dir, ".parity_")
+		if err != nil {
+			return err
+		}
+		w.parity[g] = f
+	}
+	if w.tmp == nil {
+		w.tmp = make([]byte, w.opts.BlockSize)
+	}
+	pb := w.tmp
+	n, err := f.ReadAt(pb, int64(off))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for i := n; i < len(pb); i++ {
+		pb[i] = 0
+	}
+	xor(pb, p)
+	_, err = f.WriteAt(pb, int64(off))
+	return err
+}
+
+// xor applies XOR of src to dst. The source may be shorter than the destination.
+func xor(dst, src []byte) {
+	for i, b := range src {
+		dst[i] ^= b
+	}
+}
+
+// finish writes the last block, parity volumes and manifests of all volumes.
+func (w *volumeWriter) finish() error {
+	if err := w.flushBlock(); err != nil {
+		return err
+	}
+	if err := w.closeVolume(); err != nil {
+		return err
+	}
+	for g, f := range w.parity {
+		if f == nil {
+			continue
+		}
+		v, err := w.hashParity(g, f)
+		if err != nil {
+			return err
+		}
+		i := len(w.m.Volumes)
+		vdir := filepath.Join(w.dir, VolumeName(i))
+		if err = os.Mkdir(vdir, 0755); err != nil {
+			return err
+		}
+		err = f.Sync()
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		w.parity[g] = nil
+		if err == nil {
+			err = os.Rename(f.Name(), filepath.Join(vdir, DataFile))
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		w.m.Volumes = append(w.m.Volumes, *v)
+	}
+	for i := range w.m.Volumes {
+		m := *w.m
+		m.Volume = i
+		data, err := json.Marshal(&m)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(filepath.Join(w.dir, VolumeName(i), ManifestFile), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashParity calculates hashes of blocks of a parity file.
+func (w *volumeWriter) hashParity(g int, f *os.File) (*Volume, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	v := &Volume{Parity: true, Group: g, Size: uint64(fi.Size())}
+	buf := make([]byte, w.opts.BlockSize)
+	for off := int64(0); off < fi.Size(); off += int64(len(buf)) {
+		n, err := f.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		v.Blocks = append(v.Blocks, types.BytesRef(buf[:n]))
+	}
+	return v, nil
+}
+
+// close releases all files; temporary parity files are removed.
+func (w *volumeWriter) close() {
+	if w.cur != nil {
+		w.cur.Close()
+	}
+	for _, f := range w.parity {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+}
+
+// Damage describes an unreadable or corrupted block.
+type Damage struct {
+	Volume int // index of the volume
+	Block  int // index of the block; -1 if the volume is missing
+}
+
+// Report is the result of the volume set verification.
+type Report struct {
+	Manifest    *Manifest
+	Missing     []int    // indexes of missing volumes
+	Damaged     []Damage // damaged blocks of available volumes
+	Recoverable bool     // all data can be restored
+}
+
+// OK checks if all volumes are present and intact.
+func (r *Report) OK() bool {
+	return len(r.Missing) == 0 && len(r.Damaged) == 0
+}
+
+// volumeSet is a set of volumes opened for reading.
+type volumeSet struct {
+	m     *Manifest
+	files []*os.File // nil for missing volumes
+	bad   map[Damage]struct{}
+}
+
+// openVolumes opens volumes from given directories. Directories that don't contain a manifest are checked for
+// volume subdirectories, thus the output directory of Write can be passed as well.
+func openVolumes(dirs []string) (*volumeSet, error) {
+	var (
+		set  *volumeSet
+		vdir []string
+	)
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, ManifestFile)); err == nil {
+			vdir = append(vdir, dir)
+			continue
+		}
+		sub, err := filepath.Glob(filepath.Join(dir, "vol[0-9]*", ManifestFile))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(sub)
+		for _, p := range sub {
+			vdir = append(vdir, filepath.Dir(p))
+		}
+	}
+	for _, dir := range vdir {
+		data, err := ioutil.ReadFile(filepath.Join(dir, ManifestFile))
+		if err != nil {
+			set.close()
+			return nil, err
+		}
+		var m Manifest
+		if err = json.Unmarshal(data, &m); err != nil {
+			set.close()
+			return nil, fmt.Errorf("%s: invalid manifest: %v", dir, err)
+		}
+		if m.Volume < 0 || m.Volume >= len(m.Volumes) || m.BlockSize == 0 {
+			set.close()
+			return nil, fmt.Errorf("%s: invalid manifest", dir)
+		}
+		if set == nil {
+			set = &volumeSet{m: &m, files: make([]*os.File, len(m.Volumes)), bad: make(map[Damage]struct{})}
+		} else if m.Root != set.m.Root || m.Size != set.m.Size || len(m.Volumes) != len(set.m.Volumes) {
+			set.close()
+			return nil, fmt.Errorf("%s: volume belongs to a different set", dir)
+		}
+		if set.files[m.Volume] != nil {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, DataFile))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			set.close()
+			return nil, err
+		}
+		set.files[m.Volume] = f
+	}
+	if set == nil {
+		return nil, fmt.Errorf("no volumes found")
+	}
+	return set, nil
+}
+
+func (set *volumeSet) close() {
+	if set == nil {
+		return
+	}
+	for _, f := range set.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// readVerified reads the block of the volume and verifies its hash. It returns false if the block
+// is missing or damaged.
+func (set *volumeSet) readVerified(vi, bi int, buf []byte) ([]byte, bool) {
+	v := &set.m.Volumes[vi]
+	if bi >= len(v.Blocks) {
+		// parity is calculated with zero padding
+		return buf[:0], true
+	}
+	f := set.files[vi]
+	if f == nil {
+		return nil, false
+	}
+	if _, ok := set.bad[Damage{Volume: vi, Block: bi}]; ok {
+		return nil, false
+	}
+	buf = buf[:set.m.blockLen(v, bi)]
+	n, err := f.ReadAt(buf, int64(bi)*int64(set.m.BlockSize))
+	if (err != nil && err != io.EOF) || n != len(buf) || types.BytesRef(buf) != v.Blocks[bi] {
+		set.bad[Damage{Volume: vi, Block: bi}] = struct{}{}
+		return nil, false
+	}
+	return buf, true
+}
+
+// readBlock reads the block of the volume, restoring it from the parity group if necessary.
+func (set *volumeSet) readBlock(vi, bi int, buf []byte) ([]byte, error) {
+	if p, ok := set.readVerified(vi, bi, buf); ok {
+		return p, nil
+	}
+	v := &set.m.Volumes[vi]
+	hasParity := false
+	out := buf[:set.m.BlockSize]
+	for i := range out {
+		out[i] = 0
+	}
+	tmp := make([]byte, set.m.BlockSize)
+	for i := range set.m.Volumes {
+		o := &set.m.Volumes[i]
+		if i == vi || o.Group != v.Group {
+			continue
+		}
+		if o.Parity {
+			hasParity = true
+		}
+		p, ok := set.readVerified(i, bi, tmp)
+		if !ok {
+			return nil, fmt.Errorf("cannot restore block %d of %s: %s is damaged too", bi, VolumeName(vi), VolumeName(i))
+		}
+		xor(out, p)
+	}
+	if !hasParity {
+		return nil, fmt.Errorf("cannot restore block %d of %s: no parity", bi, VolumeName(vi))
+	}
+	out = out[:set.m.blockLen(v, bi)]
+	if types.BytesRef(out) != v.Blocks[bi] {
+		return nil, fmt.Errorf("cannot restore block %d of %s: parity doesn't match", bi, VolumeName(vi))
+	}
+	return out, nil
+}
+
+// Verify checks all blocks of volumes in given directories and reports if the data can be restored.
+func Verify(dirs []string) (*Report, error) {
+	set, err := openVolumes(dirs)
+	if err != nil {
+		return nil, err
+	}
+	defer set.close()
+	r := &Report{Manifest: set.m, Recoverable: true}
+	buf := make([]byte, set.m.BlockSize)
+	for vi, v := range set.m.Volumes {
+		if set.files[vi] == nil {
+			r.Missing = append(r.Missing, vi)
+			continue
+		}
+		for bi := range v.Blocks {
+			if _, ok := set.readVerified(vi, bi, buf); !ok {
+				r.Damaged = append(r.Damaged, Damage{Volume: vi, Block: bi})
+			}
+		}
+	}
+	// check if damaged data blocks can be restored
+	lost := append([]Damage{}, r.Damaged...)
+	for _, vi := range r.Missing {
+		for bi := range set.m.Volumes[vi].Blocks {
+			lost = append(lost, Damage{Volume: vi, Block: bi})
+		}
+	}
+	for _, d := range lost {
+		if set.m.Volumes[d.Volume].Parity {
+			continue
+		}
+		if _, err := set.readBlock(d.Volume, d.Block, buf); err != nil {
+			r.Recoverable = false
+			break
+		}
+	}
+	return r, nil
+}
+
+// Restore stores all blobs from volumes in given directories and returns the root of the tree.
+// Missing and damaged blocks are restored from parity volumes.
+func Restore(ctx context.Context, s *cas.Storage, dirs []string) (types.SizedRef, error) {
+	set, err := openVolumes(dirs)
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	defer set.close()
+	sr, err := s.ReadPack(ctx, &setReader{set: set, buf: make([]byte, set.m.BlockSize)})
+	if err != nil {
+		return types.SizedRef{}, err
+	} else if sr.Ref != set.m.Root {
+		return types.SizedRef{}, fmt.Errorf("unexpected root: %v vs %v", sr.Ref, set.m.Root)
+	}
+	return sr, nil
+}
+
+// setReader reads the content of data volumes in order.
+type setReader struct {
+	set    *volumeSet
+	vi, bi int
+	buf    []byte
+	cur    []byte
+}
+
+func (r *setReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		vols := r.set.m.Volumes
+		if r.vi >= len(vols) || vols[r.vi].Parity {
+			return 0, io.EOF
+		}
+		if r.bi >= len(vols[r.vi].Blocks) {
+			r.vi, r.bi = r.vi+1, 0
+			continue
+		}
+		b, err := r.set.readBlock(r.vi, r.bi, r.buf)
+		if err != nil {
+			return 0, err
+		}
+		r.cur = b
+		r.bi++
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
@@ -0,0 +1,95 @@
+package burn
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/bench"
+	"github.com/dennwc/cas/storage"
+)
+
+func TestBurn(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_burn_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	open := func() *cas.Storage {
+		s, err := cas.New(storage.NewInMemory())
+		require.NoError(t, err)
+		return s
+	}
+	src := open()
+	_, tree, err := bench.Ingest(ctx, src, &bench.Options{Files: 20, MinSize: 100, MaxSize: 2000, Seed: 1})
+	require.NoError(t, err)
+
+	m, err := Write(ctx, src, tree.Root.Ref, dir, &Options{VolumeSize: 4000, BlockSize: 1024, Parity: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3072), m.Volumes[0].Size, "volume size is rounded to blocks")
+	require.True(t, len(m.Volumes) > 4)
+	npar := 0
+	for _, v := range m.Volumes {
+		if v.Parity {
+			npar++
+		}
+	}
+	require.Equal(t, 2, npar)
+
+	restore := func() error {
+		dst := open()
+		sr, err := Restore(ctx, dst, []string{dir})
+		if err != nil {
+			return err
+		}
+		require.Equal(t, tree.Root.Ref, sr.Ref)
+		for _, f := range tree.Files {
+			_, err = dst.StatBlob(ctx, f.Ref)
+			require.NoError(t, err)
+		}
+		return nil
+	}
+
+	rep, err := Verify([]string{dir})
+	require.NoError(t, err)
+	require.True(t, rep.OK())
+	require.True(t, rep.Recoverable)
+	require.NoError(t, restore())
+
+	// a missing volume is restored from parity
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, VolumeName(0))))
+	// a damaged block of a volume from another group is restored as well
+	path := filepath.Join(dir, VolumeName(1), DataFile)
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	data[1500] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, data, 0644))
+
+	rep, err = Verify([]string{dir})
+	require.NoError(t, err)
+	require.False(t, rep.OK())
+	require.Equal(t, []int{0}, rep.Missing)
+	require.Equal(t, []Damage{{Volume: 1, Block: 1}}, rep.Damaged)
+	require.True(t, rep.Recoverable)
+	require.NoError(t, restore())
+
+	// volumes can be passed one by one
+	var vols []string
+	for i := 1; i < len(m.Volumes); i++ {
+		vols = append(vols, filepath.Join(dir, VolumeName(i)))
+	}
+	_, err = Restore(ctx, open(), vols)
+	require.NoError(t, err)
+
+	// two volumes of the same group cannot be restored
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, VolumeName(2))))
+	rep, err = Verify([]string{dir})
+	require.NoError(t, err)
+	require.False(t, rep.Recoverable)
+	require.Error(t, restore())
+}
@@ -3,10 +3,13 @@ package cas
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/dennwc/cas/config"
 	"github.com/dennwc/cas/storage"
@@ -60,22 +63,57 @@ func Init(dir string, conf *config.Config) error {
 	if path == "" || !filepath.IsAbs(path) {
 		path = filepath.Join(dir, path)
 	}
-	s, err := local.New(path, true)
+	opts := &local.Options{Layout: c.Layout, NoXattr: c.NoXattr, NoSync: c.NoSync, MaxSize: c.MaxSize}
+	if c.Perms != nil {
+		opts.Perms = *c.Perms
+	}
+	s, err := local.NewWithOptions(path, true, opts)
 	if err != nil {
 		return err
 	}
-	_ = s // nothing to close
-	return nil
+	return s.Close()
 }
 
 type OpenOptions struct {
 	Dir     string
 	Storage storage.Storage
+	// ReadOnly opens a local storage in read-only mode. It has no effect on other storage types.
+	ReadOnly bool
+	// CacheSize is the size of an in-memory cache of small blobs. See Storage.EnableCache.
+	CacheSize uint64
+	// SigningKey is used to sign pins. See Storage.SetSigningKey.
+	SigningKey ed25519.PrivateKey
+	// TrustedKeys are used to verify pins. See Storage.SetTrustedKeys.
+	TrustedKeys []ed25519.PublicKey
 }
 
 func Open(opt OpenOptions) (*Storage, error) {
+	return OpenContext(context.Background(), opt)
+}
+
+// OpenContext is like Open, but the context is used to open the storage. It allows to cancel
+// or limit the time spent connecting to remote storages.
+func OpenContext(ctx context.Context, opt OpenOptions) (*Storage, error) {
+	st, err := openStorage(ctx, opt)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newStorage(ctx, st)
+	if err != nil {
+		if opt.Storage == nil {
+			st.Close()
+		}
+		return nil, err
+	}
+	s.EnableCache(opt.CacheSize)
+	s.SetSigningKey(opt.SigningKey)
+	s.SetTrustedKeys(opt.TrustedKeys...)
+	return s, nil
+}
+
+func openStorage(ctx context.Context, opt OpenOptions) (storage.Storage, error) {
 	if opt.Storage != nil {
-		return New(opt.Storage)
+		return opt.Storage, nil
 	}
 	if opt.Dir == "" {
 		opt.Dir = DefaultDir
@@ -99,15 +137,23 @@ func Open(opt OpenOptions) (*Storage, error) {
 		if c.Dir == "" || !filepath.IsAbs(c.Dir) {
 			c.Dir = filepath.Join(opt.Dir, c.Dir)
 		}
+		if opt.ReadOnly {
+			c.ReadOnly = true
+		}
 	}
-	s, err := conf.Storage.OpenStorage(context.TODO())
-	if err != nil {
-		return nil, err
-	}
-	return New(s)
+	return conf.Storage.OpenStorage(ctx)
 }
 
+// New creates a CAS over a given storage. It refuses to open a storage that requires codecs,
+// unless the storage is wrapped with them.
 func New(st storage.Storage) (*Storage, error) {
+	return newStorage(context.Background(), st)
+}
+
+func newStorage(ctx context.Context, st storage.Storage) (*Storage, error) {
+	if err := storage.CheckCodecs(ctx, st); err != nil {
+		return nil, err
+	}
 	return &Storage{
 		st:    st,
 		index: storage.NewBlobIndexer(st),
@@ -115,24 +161,59 @@ func New(st storage.Storage) (*Storage, error) {
 }
 
 var (
-	_ storage.Storage     = (*Storage)(nil)
-	_ storage.BlobIndexer = (*Storage)(nil)
+	_ storage.Storage        = (*Storage)(nil)
+	_ storage.BlobIndexer    = (*Storage)(nil)
+	_ storage.BlobSigner     = (*Storage)(nil)
+	_ storage.BlobDeleter    = (*Storage)(nil)
+	_ storage.BulkFetcher    = (*Storage)(nil)
+	_ storage.BulkStater     = (*Storage)(nil)
+	_ storage.BlobOpener     = (*Storage)(nil)
+	_ storage.PrefixIterator = (*Storage)(nil)
+	_ storage.BlobResumer    = (*Storage)(nil)
+	_ storage.PinSwapper     = (*Storage)(nil)
+	_ storage.PinHistorian   = (*Storage)(nil)
+	_ storage.PinMetaStorage = (*Storage)(nil)
+
+	_ storage.BlobRangeFetcher = (*Storage)(nil)
 )
 
 type Storage struct {
 	st    storage.Storage
 	index storage.BlobIndexer
+	cache *blobCache // optional; see EnableCache
+
+	signKey ed25519.PrivateKey  // optional; see SetSigningKey
+	trusted []ed25519.PublicKey // optional; see SetTrustedKeys
+
+	pinMu    sync.Mutex
+	pinTimes map[string]time.Time // time of the last seen signature of each pin; see resolvePin
 }
 
 func (s *Storage) Close() error {
 	return s.st.Close()
 }
 
+// Underlying returns the storage wrapped by CAS. It can be used to access optional features of the storage.
+func (s *Storage) Underlying() storage.Storage {
+	return s.st
+}
+
 func (s *Storage) SetPin(ctx context.Context, name string, ref types.Ref) error {
 	if name == "" {
 		name = DefaultPin
 	}
-	return s.st.SetPin(ctx, name, ref)
+	expired, err := s.pinExpired(ctx, name)
+	if err != nil {
+		return err
+	}
+	ref, err = s.signPin(ctx, name, ref)
+	if err != nil {
+		return err
+	}
+	if err = s.st.SetPin(ctx, name, ref); err != nil || !expired {
+		return err
+	}
+	return s.dropExpiredMeta(ctx, name, ref)
 }
 
 func (s *Storage) DeletePin(ctx context.Context, name string) error {
@@ -146,7 +227,150 @@ func (s *Storage) GetPin(ctx context.Context, name string) (types.Ref, error) {
 	if name == "" {
 		name = DefaultPin
 	}
-	return s.st.GetPin(ctx, name)
+	ref, err := s.st.GetPin(ctx, name)
+	if err != nil {
+		return Ref{}, err
+	}
+	if expired, err := s.pinExpired(ctx, name); err != nil {
+		return Ref{}, err
+	} else if expired {
+		return Ref{}, storage.ErrNotFound
+	}
+	return s.resolvePin(ctx, name, ref)
+}
+
+// SetPinCAS implements storage.PinSwapper. It returns storage.ErrNotSupported if the underlying storage
+// cannot update pins atomically.
+func (s *Storage) SetPinCAS(ctx context.Context, name string, old, new types.Ref) error {
+	if name == "" {
+		name = DefaultPin
+	}
+	ps, ok := s.st.(storage.PinSwapper)
+	if !ok {
+		return storage.ErrNotSupported
+	}
+	// the pin might be signed, thus compare the resolved value, but swap the stored one
+	raw, err := s.st.GetPin(ctx, name)
+	if err == storage.ErrNotFound {
+		raw = Ref{}
+	} else if err != nil {
+		return err
+	}
+	expired, err := s.pinExpired(ctx, name)
+	if err != nil {
+		return err
+	}
+	var cur Ref
+	if !expired {
+		cur, err = s.resolvePin(ctx, name, raw)
+		if err != nil {
+			return err
+		}
+	}
+	if cur != old {
+		return storage.ErrPinConflict
+	}
+	new, err = s.signPin(ctx, name, new)
+	if err != nil {
+		return err
+	}
+	if err = ps.SetPinCAS(ctx, name, raw, new); err != nil || !expired {
+		return err
+	}
+	return s.dropExpiredMeta(ctx, name, new)
+}
+
+// pinExpired checks if the pin exists, but has expired. See types.PinMeta.Expires.
+func (s *Storage) pinExpired(ctx context.Context, name string) (bool, error) {
+	return storage.PinExpired(ctx, s.st, name, time.Now())
+}
+
+// dropExpiredMeta removes the metadata of an expired pin that was set again. Expired pins are considered deleted,
+// thus the new value shouldn't inherit the expiration time.
+func (s *Storage) dropExpiredMeta(ctx context.Context, name string, ref Ref) error {
+	if ref.Zero() {
+		return nil // pin was removed together with its metadata
+	}
+	return s.st.(storage.PinMetaStorage).SetPinMeta(ctx, name, nil)
+}
+
+// SetPinMeta implements storage.PinMetaStorage. The creation time is preserved from the current metadata, unless
+// it's set explicitly, and the update time is set to the current time. It returns storage.ErrNotSupported if
+// the underlying storage cannot store metadata of pins.
+func (s *Storage) SetPinMeta(ctx context.Context, name string, meta *types.PinMeta) error {
+	if name == "" {
+		name = DefaultPin
+	}
+	ms, ok := s.st.(storage.PinMetaStorage)
+	if !ok {
+		return storage.ErrNotSupported
+	}
+	if meta != nil {
+		m := *meta
+		m.Updated = time.Now().UTC()
+		if m.Created.IsZero() {
+			cur, err := ms.GetPinMeta(ctx, name)
+			if err != nil {
+				return err
+			} else if cur != nil && !cur.Created.IsZero() {
+				m.Created = cur.Created
+			} else {
+				m.Created = m.Updated
+			}
+		}
+		meta = &m
+	}
+	return ms.SetPinMeta(ctx, name, meta)
+}
+
+// GetPinMeta implements storage.PinMetaStorage. It returns storage.ErrNotSupported if the underlying storage
+// cannot store metadata of pins.
+func (s *Storage) GetPinMeta(ctx context.Context, name string) (*types.PinMeta, error) {
+	if name == "" {
+		name = DefaultPin
+	}
+	ms, ok := s.st.(storage.PinMetaStorage)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	return ms.GetPinMeta(ctx, name)
+}
+
+// PinHistory implements storage.PinHistorian. It returns storage.ErrNotSupported if the underlying storage
+// doesn't keep the history of pins. Refs of signed pins are returned without verifying signatures.
+func (s *Storage) PinHistory(ctx context.Context, name string) ([]storage.PinRecord, error) {
+	if name == "" {
+		name = DefaultPin
+	}
+	ph, ok := s.st.(storage.PinHistorian)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	recs, err := ph.PinHistory(ctx, name)
+	for i, r := range recs {
+		if p, err := s.decodeSignedPin(ctx, r.Ref); err == nil && p != nil {
+			recs[i].Ref = p.Ref
+		}
+	}
+	return recs, err
+}
+
+// RollbackPin restores the value the pin had n changes ago. See storage.RollbackPin for details.
+//
+// If signing is enabled, the old value is signed again, since restoring the old signature would be rejected
+// by verification as a rollback. Otherwise, the old signature is restored as-is.
+func (s *Storage) RollbackPin(ctx context.Context, name string, n int) (Ref, error) {
+	if name == "" {
+		name = DefaultPin
+	}
+	if s.signKey != nil {
+		return storage.RollbackPin(ctx, s, name, n)
+	}
+	ref, err := storage.RollbackPin(ctx, s.st, name, n)
+	if err != nil {
+		return Ref{}, err
+	}
+	return s.resolvePin(ctx, name, ref)
 }
 
 func (s *Storage) GetPinOrRef(ctx context.Context, name string) (types.Ref, error) {
@@ -157,6 +381,12 @@ func (s *Storage) GetPinOrRef(ctx context.Context, name string) (types.Ref, erro
 }
 
 func (s *Storage) IteratePins(ctx context.Context) storage.PinIterator {
+	return &pinIterator{PinIterator: s.st.IteratePins(ctx), ctx: ctx, s: s}
+}
+
+// IterateRawPins implements gc.RawPinIterator. Pins are listed as they are stored, thus signed pins point to
+// schema.SignedPin objects, and expired pins are not skipped.
+func (s *Storage) IterateRawPins(ctx context.Context) storage.PinIterator {
 	return s.st.IteratePins(ctx)
 }
 
@@ -165,6 +395,10 @@ func (s *Storage) FetchBlob(ctx context.Context, ref Ref) (io.ReadCloser, uint64
 		// generate empty blobs
 		return ioutil.NopCloser(bytes.NewReader(nil)), 0, nil
 	}
+	return s.fetchCached(ctx, ref, false, s.fetchBlob)
+}
+
+func (s *Storage) fetchBlob(ctx context.Context, ref Ref) (io.ReadCloser, uint64, error) {
 	rc, sz, err := s.st.FetchBlob(ctx, ref)
 	if err == nil {
 		rc = storage.VerifyReader(rc, ref)
@@ -172,10 +406,114 @@ func (s *Storage) FetchBlob(ctx context.Context, ref Ref) (io.ReadCloser, uint64
 	return rc, sz, err
 }
 
+// FetchBlobs implements storage.BulkFetcher. Blobs are fetched in a single request if the underlying
+// storage supports it.
+func (s *Storage) FetchBlobs(ctx context.Context, refs []Ref) (storage.MultiReader, error) {
+	return storage.FetchBlobs(ctx, s.st, refs)
+}
+
+// StatBlobs implements storage.BulkStater. Blobs are checked in a single request if the underlying
+// storage supports it.
+func (s *Storage) StatBlobs(ctx context.Context, refs []Ref) ([]SizedRef, error) {
+	return storage.StatBlobs(ctx, s.st, refs)
+}
+
+// OpenBlob implements storage.BlobOpener. Unlike FetchBlob, the content is not verified.
+func (s *Storage) OpenBlob(ctx context.Context, ref Ref) (storage.BlobReader, uint64, error) {
+	if ref.Empty() {
+		return emptyBlob{bytes.NewReader(nil)}, 0, nil
+	}
+	return storage.OpenBlob(ctx, s.st, ref)
+}
+
+// FetchBlobRange implements storage.BlobRangeFetcher. Unlike FetchBlob, the content is not verified.
+func (s *Storage) FetchBlobRange(ctx context.Context, ref Ref, off, length uint64) (io.ReadCloser, uint64, error) {
+	if ref.Empty() {
+		return emptyBlob{bytes.NewReader(nil)}, 0, nil
+	}
+	return storage.FetchBlobRange(ctx, s.st, ref, off, length)
+}
+
+// emptyBlob is a reader for an empty blob.
+type emptyBlob struct {
+	*bytes.Reader
+}
+
+func (emptyBlob) Close() error { return nil }
+
+// SignBlobURL implements storage.BlobSigner. It returns storage.ErrNotSupported if the underlying storage
+// cannot generate signed URLs.
+func (s *Storage) SignBlobURL(ctx context.Context, ref Ref, ttl time.Duration) (string, error) {
+	sg, ok := s.st.(storage.BlobSigner)
+	if !ok {
+		return "", storage.ErrNotSupported
+	}
+	return sg.SignBlobURL(ctx, ref, ttl)
+}
+
+// DeleteBlob implements storage.BlobDeleter. It returns storage.ErrNotSupported if the underlying storage
+// cannot delete blobs.
+func (s *Storage) DeleteBlob(ctx context.Context, ref Ref) error {
+	del, ok := s.st.(storage.BlobDeleter)
+	if !ok {
+		return storage.ErrNotSupported
+	}
+	if s.cache != nil {
+		s.cache.delete(ref)
+	}
+	return del.DeleteBlob(ctx, ref)
+}
+
+// BeginResumableBlob implements storage.BlobResumer. It returns storage.ErrNotSupported if the underlying storage
+// cannot resume writes.
+func (s *Storage) BeginResumableBlob(ctx context.Context) (storage.ResumableWriter, error) {
+	br, ok := s.st.(storage.BlobResumer)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	return br.BeginResumableBlob(ctx)
+}
+
+// ResumeBlob implements storage.BlobResumer. It returns storage.ErrNotSupported if the underlying storage
+// cannot resume writes.
+func (s *Storage) ResumeBlob(ctx context.Context, token string) (storage.ResumableWriter, error) {
+	br, ok := s.st.(storage.BlobResumer)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	return br.ResumeBlob(ctx, token)
+}
+
+// Referrers implements storage.RefIndexer. It returns storage.ErrNotSupported if the underlying storage
+// has no reverse index of references.
+func (s *Storage) Referrers(ctx context.Context, ref Ref) ([]Ref, error) {
+	ri, ok := s.st.(storage.RefIndexer)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	return ri.Referrers(ctx, ref)
+}
+
+// RefCount implements storage.RefIndexer. It returns storage.ErrNotSupported if the underlying storage
+// has no reverse index of references.
+func (s *Storage) RefCount(ctx context.Context, ref Ref) (int, error) {
+	ri, ok := s.st.(storage.RefIndexer)
+	if !ok {
+		return 0, storage.ErrNotSupported
+	}
+	return ri.RefCount(ctx, ref)
+}
+
 func (s *Storage) IterateBlobs(ctx context.Context) storage.Iterator {
 	return s.st.IterateBlobs(ctx)
 }
 
+// IterateBlobsPrefix implements storage.PrefixIterator. If the underlying storage cannot list blobs by prefix,
+// all blobs are listed and filtered.
+func (s *Storage) IterateBlobsPrefix(ctx context.Context, prefix string) storage.Iterator {
+	return storage.IterateBlobsPrefix(ctx, s.st, prefix)
+}
+
 func (s *Storage) StatBlob(ctx context.Context, ref Ref) (uint64, error) {
 	if ref.Empty() {
 		return 0, nil
@@ -1,12 +1,17 @@
 package cas
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/dennwc/cas/schema"
 	"github.com/dennwc/cas/storage"
@@ -15,16 +20,232 @@ import (
 
 // Checkout restores content of ref into the dst.
 func (s *Storage) Checkout(ctx context.Context, ref Ref, dst string) error {
+	_, err := s.CheckoutWithOptions(ctx, ref, dst, nil)
+	return err
+}
+
+// defaultCheckoutWorkers is the default number of files restored concurrently. See CheckoutOptions.Workers.
+const defaultCheckoutWorkers = 8
+
+// CheckoutOptions are optional parameters of a checkout.
+type CheckoutOptions struct {
+	// Include is a list of glob patterns for slash-separated paths relative to the root. If set, only files
+	// matching any of the patterns are restored. Patterns without a slash are matched against the names of entries
+	// at any depth, "**" matches any number of directories. Directories that match a pattern are restored with
+	// all their content.
+	Include []string
+	// Exclude is a list of glob patterns for paths that are not restored, in the same format as Include.
+	// Excluded directories are skipped with all their content.
+	Exclude []string
+	// LargerThan restricts restored files to the ones that are larger than this size.
+	LargerThan uint64
+	// SmallerThan restricts restored files to the ones that are smaller than this size, if not zero.
+	SmallerThan uint64
+
+	// Mode applies POSIX modes recorded in directory entries to restored files (see StoreConfig.Mode).
+	// Default permissions are used otherwise.
+	Mode bool
+	// Owner changes owners and groups of restored files to the ones recorded in directory entries,
+	// if they exist on this system. It usually requires superuser privileges.
+	Owner bool
+
+	// Workers is the maximal number of files restored concurrently. Default is 8.
+	Workers int
+}
+
+// CheckoutReport is a summary of a checkout.
+type CheckoutReport struct {
+	Files int // number of restored files
+	Dirs  int // number of created directories
+	Links int // number of restored symbolic links
+	// Verified is the total size of restored files. The content is verified while it's written, either
+	// against the ref of the whole file, or against refs of its parts if the ref of the file is not recorded.
+	Verified uint64
+}
+
+// CheckoutWithOptions is like Checkout, but accepts additional options and returns a summary of restored files.
+//
+// Directories are walked sequentially, while files are fetched and written concurrently. Modes and owners
+// are applied after all the content is restored.
+//
+// If the content is filtered, the ref must point to a directory or a commit. Only directories that may contain
+// matching files are read, and only matching files are fetched. Directories are created only if they contain
+// restored files or match one of the Include patterns.
+func (s *Storage) CheckoutWithOptions(ctx context.Context, ref Ref, dst string, opt *CheckoutOptions) (*CheckoutReport, error) {
+	if opt == nil {
+		opt = &CheckoutOptions{}
+	}
+	if err := opt.validate(); err != nil {
+		return nil, err
+	}
+	ctx, sp := storage.StartSpan(ctx, "cas.Checkout",
+		storage.Attribute{Key: storage.AttrRef, Value: ref.String()},
+		storage.Attribute{Key: attrPath, Value: dst},
+	)
+	ctx, co := newCheckouter(ctx, opt)
+	var err error
+	if opt.filtered() {
+		err = s.checkoutFiltered(ctx, ref, dst, co)
+	} else {
+		err = s.checkout(ctx, ref, dst, co)
+	}
+	err = co.wait(err)
+	storage.EndSpan(sp, err)
+	if err != nil {
+		return nil, err
+	}
+	return &co.rep, nil
+}
+
+// checkouter keeps the state of a single checkout. Files are restored by a pool of workers,
+// while directories are walked by the caller.
+type checkouter struct {
+	opt    *CheckoutOptions
+	jobs   chan func() error
+	wg     sync.WaitGroup
+	cancel func()
+
+	mu   sync.Mutex
+	err  error           // first error of workers
+	meta []restoredEntry // entries with modes and owners to apply after the content is restored
+	rep  CheckoutReport
+}
+
+// restoredEntry is a restored directory entry with a given path.
+type restoredEntry struct {
+	path string
+	ent  *schema.DirEntry
+}
+
+func newCheckouter(ctx context.Context, opt *CheckoutOptions) (context.Context, *checkouter) {
+	ctx, cancel := context.WithCancel(ctx)
+	co := &checkouter{opt: opt, jobs: make(chan func() error), cancel: cancel}
+	n := opt.Workers
+	if n <= 0 {
+		n = defaultCheckoutWorkers
+	}
+	// the caller restores files as well when all workers are busy
+	for i := 0; i < n-1; i++ {
+		co.wg.Add(1)
+		go func() {
+			defer co.wg.Done()
+			for job := range co.jobs {
+				co.setErr(job())
+			}
+		}()
+	}
+	return ctx, co
+}
+
+func (co *checkouter) setErr(err error) {
+	if err == nil {
+		return
+	}
+	co.mu.Lock()
+	if co.err == nil {
+		co.err = err
+		co.cancel()
+	}
+	co.mu.Unlock()
+}
+
+// Err returns the first error of workers.
+func (co *checkouter) Err() error {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+	return co.err
+}
+
+// submit passes a job to an idle worker. If all workers are busy, the job is run by the caller.
+func (co *checkouter) submit(job func() error) error {
+	if err := co.Err(); err != nil {
+		return err
+	}
+	select {
+	case co.jobs <- job:
+		return nil
+	default:
+		return job()
+	}
+}
+
+// wait waits for all workers to finish and applies modes and owners of restored entries.
+func (co *checkouter) wait(err error) error {
+	close(co.jobs)
+	co.wg.Wait()
+	co.cancel()
+	if err == nil {
+		err = co.Err()
+	}
+	if err != nil {
+		return err
+	}
+	// entries of each directory are added after the content of its subdirectories
+	for _, e := range co.meta {
+		if err = applyEntryMeta(e.path, e.ent, co.opt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restored records an entry to apply its mode and owner after the content is restored.
+func (co *checkouter) restored(path string, ent *schema.DirEntry) {
+	if !co.opt.Mode && !co.opt.Owner {
+		return
+	}
+	co.mu.Lock()
+	co.meta = append(co.meta, restoredEntry{path: path, ent: ent})
+	co.mu.Unlock()
+}
+
+// mkdir creates a directory and counts it, unless it already exists. Links and files in its place are not followed,
+// since they might be restored from a malformed directory with duplicate names.
+func (co *checkouter) mkdir(dir string) error {
+	if fi, err := os.Lstat(dir); err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("not a directory: %q", dir)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	co.mu.Lock()
+	co.rep.Dirs++
+	co.mu.Unlock()
+	return nil
+}
+
+// symlink restores a symbolic link.
+func (co *checkouter) symlink(ent *schema.DirEntry, path string) error {
+	if err := os.Symlink(ent.Link, path); err != nil {
+		return err
+	}
+	co.mu.Lock()
+	co.rep.Links++
+	co.mu.Unlock()
+	return nil
+}
+
+func (co *checkouter) addFile(size uint64) {
+	co.mu.Lock()
+	co.rep.Files++
+	co.rep.Verified += size
+	co.mu.Unlock()
+}
+
+func (s *Storage) checkout(ctx context.Context, ref Ref, dst string, co *checkouter) error {
 	if _, err := os.Stat(dst); err == nil {
 		return fmt.Errorf("path already exists")
 	} else if !os.IsNotExist(err) {
 		return err
 	}
-	return s.checkoutFileOrDir(ctx, ref, dst)
+	return s.checkoutFileOrDir(ctx, ref, dst, co)
 }
 
-func (s *Storage) checkoutBlobData(ctx context.Context, r io.Reader, sr SizedRef, dst string) error {
-	f, err := os.Create(dst)
+func (s *Storage) checkoutBlobData(ctx context.Context, r io.Reader, sr SizedRef, dst string, co *checkouter) error {
+	f, err := createFile(dst)
 	if err != nil {
 		return err
 	}
@@ -34,10 +255,19 @@ func (s *Storage) checkoutBlobData(ctx context.Context, r io.Reader, sr SizedRef
 		h = sr.Ref.Hash()
 		r = io.TeeReader(r, h)
 	}
+	var n int64
 	if sr.Size != 0 {
-		_, err = io.CopyN(f, r, int64(sr.Size))
+		n, err = io.CopyN(f, r, int64(sr.Size))
+		if err == nil {
+			// read to the end, since fetched blobs are only verified on EOF; it matters for the last part of the file
+			var extra int64
+			extra, err = io.Copy(ioutil.Discard, r)
+			if err == nil && extra != 0 {
+				err = storage.ErrSizeMissmatch{Exp: sr.Size, Got: sr.Size + uint64(extra)}
+			}
+		}
 	} else {
-		_, err = io.Copy(f, r)
+		n, err = io.Copy(f, r)
 	}
 	if err != nil {
 		return err
@@ -54,7 +284,7 @@ func (s *Storage) checkoutBlobData(ctx context.Context, r io.Reader, sr SizedRef
 	if err != nil {
 		return err
 	}
-	err = SaveRefFile(ctx, f, fi, sr.Ref)
+	err = s.saveRefFile(ctx, f, fi, sr.Ref)
 	if err != nil {
 		return err
 	}
@@ -62,17 +292,18 @@ func (s *Storage) checkoutBlobData(ctx context.Context, r io.Reader, sr SizedRef
 	if err != nil {
 		return err
 	}
+	co.addFile(uint64(n))
 	return nil
 }
 
-func (s *Storage) checkoutBlob(ctx context.Context, ref Ref, dst string) error {
+func (s *Storage) checkoutBlob(ctx context.Context, ref Ref, dst string, co *checkouter) error {
 	rc, sz, err := s.FetchBlob(ctx, ref)
 	if err != nil {
 		return err
 	}
 	defer rc.Close()
 
-	return s.checkoutBlobData(ctx, rc, SizedRef{Ref: ref, Size: sz}, dst)
+	return s.checkoutBlobData(ctx, rc, SizedRef{Ref: ref, Size: sz}, dst, co)
 }
 
 type multipartReader struct {
@@ -106,6 +337,11 @@ func (r *multipartReader) addPartsFrom(obj schema.Object) error {
 			r.parts = append(r.parts, obj.List[i])
 		}
 		return nil
+	case *schema.Multipart:
+		for i := len(obj.Parts) - 1; i >= 0; i-- {
+			r.parts = append(r.parts, obj.Parts[i].Ref)
+		}
+		return nil
 	case schema.BlobWrapper:
 		r.parts = append(r.parts, obj.DataBlob())
 		return nil
@@ -188,49 +424,87 @@ func (s *Storage) openMultipart(ctx context.Context, _ Ref, obj schema.Object) (
 			sr.Ref = *obj.Ref
 		}
 		sr.Size = obj.Stats.Size()
+	case *schema.Multipart:
+		sr.Ref = obj.Ref
+		for _, p := range obj.Parts {
+			sr.Size += p.Size
+		}
 	}
-	r.addPartsFrom(obj)
-	if r.err != nil {
+	if err := r.addPartsFrom(obj); err != nil {
 		r.Close()
-		return nil, SizedRef{}, r.err
+		return nil, SizedRef{}, err
 	}
 	return r, sr, nil
 }
 
-func (s *Storage) checkoutMultipart(ctx context.Context, ref Ref, obj schema.Object, dst string) error {
+func (s *Storage) checkoutMultipart(ctx context.Context, ref Ref, obj schema.Object, dst string, co *checkouter) error {
 	rc, sr, err := s.openMultipart(ctx, ref, obj)
 	if err != nil {
 		return err
 	}
 	defer rc.Close()
 
-	return s.checkoutBlobData(ctx, rc, sr, dst)
+	return s.checkoutBlobData(ctx, rc, sr, dst, co)
 }
 
-func (s *Storage) checkoutDir(ctx context.Context, ref Ref, obj schema.Object, dst string) error {
-	if err := os.MkdirAll(dst, 0755); err != nil {
+func (s *Storage) checkoutDir(ctx context.Context, ref Ref, obj schema.Object, dst string, co *checkouter) error {
+	if err := co.mkdir(dst); err != nil {
 		return err
 	}
 	switch obj := obj.(type) {
 	case *schema.InlineList:
+		ents := make([]*schema.DirEntry, 0, len(obj.List))
 		for _, e := range obj.List {
 			ent, ok := e.(*schema.DirEntry)
 			if !ok {
 				return fmt.Errorf("expected dir entry, got: %T", e)
 			}
+			ents = append(ents, ent)
+		}
+		if err := checkEntryNames(ents); err != nil {
+			return err
+		}
+		done, err := s.checkoutBatch(ctx, ents, dst, co)
+		if err != nil {
+			return err
+		}
+		for i, ent := range ents {
+			if done[i] {
+				continue
+			}
 			spath := filepath.Join(dst, ent.Name)
+			if ent.Link != "" {
+				if err := co.symlink(ent, spath); err != nil {
+					return err
+				}
+				continue
+			} else if isFileEntry(ent) {
+				// files are restored by workers
+				ref := ent.Ref
+				err = co.submit(func() error {
+					return s.checkoutFileOrDir(ctx, ref, spath, co)
+				})
+				if err != nil {
+					return err
+				}
+				continue
+			}
 			sub, err := s.DecodeSchema(ctx, ent.Ref)
 			if err == nil {
 				// schema object - sub directory, or schema blob
-				err = s.checkoutObject(ctx, ent.Ref, sub, spath)
+				err = s.checkoutObject(ctx, ent.Ref, sub, spath, co)
 			} else if err == schema.ErrNotSchema {
 				// file blob
-				err = s.checkoutBlob(ctx, ent.Ref, spath)
+				err = s.checkoutBlob(ctx, ent.Ref, spath, co)
 			}
 			if err != nil {
 				return err
 			}
 		}
+		// modes are applied after the content is restored, since directories might not be writable
+		for _, ent := range ents {
+			co.restored(filepath.Join(dst, ent.Name), ent)
+		}
 		return nil
 	case *schema.List:
 		for _, ref := range obj.List {
@@ -243,7 +517,7 @@ func (s *Storage) checkoutDir(ctx context.Context, ref Ref, obj schema.Object, d
 			switch sub := sub.(type) {
 			case *schema.List, *schema.InlineList:
 				// continue checking up this directory
-				if err := s.checkoutObject(ctx, ref, sub, dst); err != nil {
+				if err := s.checkoutObject(ctx, ref, sub, dst, co); err != nil {
 					return err
 				}
 			default:
@@ -256,42 +530,142 @@ func (s *Storage) checkoutDir(ctx context.Context, ref Ref, obj schema.Object, d
 	}
 }
 
-func (s *Storage) checkoutFileOrDir(ctx context.Context, ref Ref, dst string) error {
+// maxBatchedBlob is the maximal size of a directory entry that is fetched in a batch. See checkoutBatch.
+const maxBatchedBlob = 1 << 20
+
+// checkoutBatch restores small entries of a directory by fetching them in a single request, if the underlying
+// storage supports bulk fetches. It returns a set of restored entries; other entries are restored one by one.
+func (s *Storage) checkoutBatch(ctx context.Context, ents []*schema.DirEntry, dst string, co *checkouter) (map[int]bool, error) {
+	if _, ok := s.st.(storage.BulkFetcher); !ok {
+		return nil, nil
+	}
+	first := make(map[Ref]int) // duplicate entries are restored one by one
+	var refs []Ref
+	for i, ent := range ents {
+		if ent.Ref.Zero() || ent.Ref.Empty() || ent.Link != "" || ent.Size() > maxBatchedBlob {
+			continue
+		} else if _, ok := first[ent.Ref]; ok {
+			continue
+		}
+		first[ent.Ref] = i
+		refs = append(refs, ent.Ref)
+	}
+	if len(refs) < 2 {
+		return nil, nil
+	}
+	mr, err := s.FetchBlobs(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
+	defer mr.Close()
+	done := make(map[int]bool, len(refs))
+	objs := make(map[int]schema.Object)
+	for mr.Next() {
+		sr := mr.SizedRef()
+		i, ok := first[sr.Ref]
+		if !ok {
+			continue
+		}
+		br := bufio.NewReader(mr)
+		if p, _ := br.Peek(schema.MagicSize); !schema.IsSchema(p) {
+			if err = s.checkoutBlobData(ctx, br, sr, filepath.Join(dst, ents[i].Name), co); err != nil {
+				return nil, err
+			}
+			done[i] = true
+			continue
+		}
+		// sub-directories and other schema objects are restored after the batch is read
+		data, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+		h := sr.Ref.Hash()
+		h.Write(data)
+		if got := sr.Ref.WithHash(h); got != sr.Ref {
+			return nil, storage.ErrRefMissmatch{Exp: sr.Ref, Got: got}
+		}
+		obj, err := schema.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		objs[i] = obj
+	}
+	if err = mr.Err(); err != nil {
+		return nil, err
+	}
+	mr.Close()
+	for i, ent := range ents {
+		if obj, ok := objs[i]; ok {
+			if err = s.checkoutObject(ctx, ent.Ref, obj, filepath.Join(dst, ent.Name), co); err != nil {
+				return nil, err
+			}
+			done[i] = true
+		}
+	}
+	return done, nil
+}
+
+// checkEntryNames verifies that entries of a directory cannot be restored outside of it. Backslashes are only
+// rejected on Windows, since they are valid in file names on other systems.
+func checkEntryNames(ents []*schema.DirEntry) error {
+	for _, ent := range ents {
+		switch name := ent.Name; {
+		case name == "", name == ".", name == "..", strings.ContainsRune(name, '/'), strings.ContainsRune(name, filepath.Separator):
+			return fmt.Errorf("invalid entry name: %q", name)
+		}
+	}
+	return nil
+}
+
+// isFileEntry checks if the entry is a file without fetching it. Stats of files only record the size,
+// while stats of directories record the number of entries as well.
+func isFileEntry(ent *schema.DirEntry) bool {
+	_, hasSize := ent.Stats[schema.StatDataSize]
+	_, hasCount := ent.Stats[schema.StatDataCount]
+	return ent.Link == "" && hasSize && !hasCount
+}
+
+func (s *Storage) checkoutFileOrDir(ctx context.Context, ref Ref, dst string, co *checkouter) error {
 	obj, err := s.DecodeSchema(ctx, ref)
 	if err == schema.ErrNotSchema {
-		return s.checkoutBlob(ctx, ref, dst)
+		return s.checkoutBlob(ctx, ref, dst, co)
 	} else if err != nil {
 		return err
 	}
-	return s.checkoutObject(ctx, ref, obj, dst)
+	return s.checkoutObject(ctx, ref, obj, dst, co)
 }
 
-func (s *Storage) checkoutObject(ctx context.Context, oref Ref, obj schema.Object, dst string) error {
+func (s *Storage) checkoutObject(ctx context.Context, oref Ref, obj schema.Object, dst string, co *checkouter) error {
 	switch obj := obj.(type) {
 	case *schema.InlineList:
 		switch obj.Elem {
 		case typeDirEnt:
-			return s.checkoutDir(ctx, oref, obj, dst)
+			return s.checkoutDir(ctx, oref, obj, dst, co)
 		case typeSizedRef:
-			return s.checkoutMultipart(ctx, oref, obj, dst)
+			return s.checkoutMultipart(ctx, oref, obj, dst, co)
 		default:
 			return fmt.Errorf("unsupported list element: %q", obj.Elem)
 		}
 	case *schema.List:
 		switch obj.Elem {
 		case typeDirEnt:
-			return s.checkoutDir(ctx, oref, obj, dst)
+			return s.checkoutDir(ctx, oref, obj, dst, co)
 		case typeSizedRef:
-			return s.checkoutMultipart(ctx, oref, obj, dst)
+			return s.checkoutMultipart(ctx, oref, obj, dst, co)
 		default:
 			return fmt.Errorf("unsupported list element: %q", obj.Elem)
 		}
+	case *schema.Multipart:
+		return s.checkoutMultipart(ctx, oref, obj, dst, co)
+	case *schema.Commit:
+		// checkout the snapshot
+		return s.checkoutFileOrDir(ctx, obj.Root, dst, co)
 	case schema.BlobWrapper:
 		// unwrap blob
 		// TODO: might require recursion
-		return s.checkoutBlob(ctx, obj.DataBlob(), dst)
+		return s.checkoutBlob(ctx, obj.DataBlob(), dst, co)
 	default:
 		// unknown schema blob - store as json
-		return s.checkoutBlob(ctx, oref, dst)
+		return s.checkoutBlob(ctx, oref, dst, co)
 	}
 }
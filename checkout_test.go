@@ -0,0 +1,449 @@
+package cas_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	httpstor "github.com/dennwc/cas/storage/http"
+	"github.com/dennwc/cas/types"
+)
+
+func TestCheckoutBatched(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_checkout_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	files := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("file%d.txt", i)] = fmt.Sprintf("data %d", i)
+		files[fmt.Sprintf("sub/file%d.txt", i)] = fmt.Sprintf("sub data %d", i)
+	}
+	files["dup.txt"] = files["file0.txt"]
+	for name, data := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+
+	mem := storage.NewInMemory()
+	s, err := cas.New(mem)
+	require.NoError(t, err)
+	root, err := s.StoreFilePath(ctx, src, nil)
+	require.NoError(t, err)
+
+	srv := httpstor.NewServer(mem, "")
+	var reqs int32
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reqs, 1)
+		srv.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+	cli := httpstor.NewClient(hs.URL)
+	cli.SetHTTPClient(hs.Client())
+	rs, err := cas.New(cli)
+	require.NoError(t, err)
+
+	dst := filepath.Join(dir, "dst")
+	require.NoError(t, rs.Checkout(ctx, root.Ref, dst))
+	for name, data := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		require.NoError(t, err)
+		require.Equal(t, data, string(got), name)
+	}
+	// codecs pin, root, one batch per directory, and two requests for the duplicate file
+	require.Equal(t, int32(6), atomic.LoadInt32(&reqs))
+}
+
+func TestCheckoutFiltered(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_checkout_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	files := map[string]string{
+		"a.docx":            "doc a",
+		"a.txt":             "text a",
+		"docs/b.docx":       "doc b",
+		"docs/old/c.docx":   "doc c",
+		"docs/large.docx":   "large document",
+		"media/video.mp4":   "unrelated video",
+		"media/notes.txt":   "unrelated notes",
+		"tmp/d.docx":        "temporary doc",
+		"keep/raw/data.bin": "raw data",
+	}
+	for name, data := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "keep", "empty"), 0755))
+
+	mem := storage.NewInMemory()
+	s, err := cas.New(mem)
+	require.NoError(t, err)
+	root, err := s.StoreFilePath(ctx, src, nil)
+	require.NoError(t, err)
+
+	// unrelated files must not be fetched
+	for _, name := range []string{"media/video.mp4", "media/notes.txt", "a.txt"} {
+		require.NoError(t, mem.(storage.BlobDeleter).DeleteBlob(ctx, types.BytesRef([]byte(files[name]))))
+	}
+
+	dst := filepath.Join(dir, "dst")
+	rep, err := s.CheckoutWithOptions(ctx, root.Ref, dst, &cas.CheckoutOptions{
+		Include:     []string{"**/*.docx", "keep"},
+		Exclude:     []string{"tmp", "docs/old/**"},
+		SmallerThan: 10,
+	})
+	require.NoError(t, err)
+	require.Equal(t, &cas.CheckoutReport{
+		Files: 3, Dirs: 5,
+		Verified: uint64(len(files["a.docx"]) + len(files["docs/b.docx"]) + len(files["keep/raw/data.bin"])),
+	}, rep)
+
+	var got []string
+	err = filepath.Walk(dst, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || path == dst {
+			return err
+		}
+		rel, err := filepath.Rel(dst, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if fi.IsDir() {
+			got = append(got, rel+"/")
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, files[rel], string(data), rel)
+		got = append(got, rel)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"a.docx",
+		"docs/",
+		"docs/b.docx",
+		"keep/",
+		"keep/empty/",
+		"keep/raw/",
+		"keep/raw/data.bin",
+	}, got)
+
+	_, err = s.CheckoutWithOptions(ctx, root.Ref, filepath.Join(dir, "dst2"), &cas.CheckoutOptions{
+		Include: []string{"docs/[z"},
+	})
+	require.Error(t, err)
+}
+
+func TestCheckoutSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_checkout_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "sub", "file.txt"), []byte("data"), 0644))
+	links := map[string]string{
+		"file":   "sub/file.txt",
+		"dir":    "sub",
+		"broken": "missing",
+		"abs":    "/etc",
+	}
+	for name, target := range links {
+		require.NoError(t, os.Symlink(target, filepath.Join(src, name)))
+	}
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	root, err := s.StoreFilePath(ctx, src, nil)
+	require.NoError(t, err)
+
+	ents, err := s.ReadDir(ctx, root.Ref)
+	require.NoError(t, err)
+	got := make(map[string]string)
+	for _, ent := range ents {
+		if ent.Link != "" {
+			got[ent.Name] = ent.Link
+		}
+	}
+	require.Equal(t, links, got)
+
+	err = s.Status(ctx, root.Ref, src, func(c *cas.Change) error {
+		return fmt.Errorf("unexpected change: %s %s", c.Kind, c.Path)
+	})
+	require.NoError(t, err)
+
+	dst := filepath.Join(dir, "dst")
+	require.NoError(t, s.Checkout(ctx, root.Ref, dst))
+	for name, target := range links {
+		got, err := os.Readlink(filepath.Join(dst, name))
+		require.NoError(t, err, name)
+		require.Equal(t, target, got, name)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dst, "sub", "file.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+
+	// links are followed if requested
+	require.NoError(t, os.Remove(filepath.Join(src, "broken")))
+	require.NoError(t, os.Remove(filepath.Join(src, "abs")))
+	root, err = s.StoreFilePath(ctx, src, &cas.StoreConfig{FollowLinks: true})
+	require.NoError(t, err)
+	dst = filepath.Join(dir, "dst2")
+	require.NoError(t, s.Checkout(ctx, root.Ref, dst))
+	for _, name := range []string{"file", "dir/file.txt"} {
+		fi, err := os.Lstat(filepath.Join(dst, filepath.FromSlash(name)))
+		require.NoError(t, err, name)
+		require.True(t, fi.Mode().IsRegular(), name)
+	}
+}
+
+func TestCheckoutMalicious(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_checkout_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	outside := filepath.Join(dir, "outside")
+	require.NoError(t, os.Mkdir(outside, 0755))
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	file, err := storage.WriteBytes(ctx, s, []byte("data"))
+	require.NoError(t, err)
+	fileEnt := func(name string) *schema.DirEntry {
+		return &schema.DirEntry{Ref: file.Ref, Name: name, Stats: schema.Stats{schema.StatDataSize: file.Size}}
+	}
+	sub, _, err := s.StoreDirEntries(ctx, []schema.DirEntry{*fileEnt("x")})
+	require.NoError(t, err)
+	typ := schema.MustTypeOf(&schema.DirEntry{})
+	// dirOf stores each list as a separate page of a directory
+	dirOf := func(lists ...[]*schema.DirEntry) types.Ref {
+		var pages []types.Ref
+		for _, ents := range lists {
+			page := &schema.InlineList{Elem: typ}
+			for _, ent := range ents {
+				page.List = append(page.List, ent)
+			}
+			sr, err := s.StoreSchema(ctx, page)
+			require.NoError(t, err)
+			pages = append(pages, sr.Ref)
+		}
+		sr, err := s.StoreSchema(ctx, &schema.List{Elem: typ, List: pages})
+		require.NoError(t, err)
+		return sr.Ref
+	}
+	link := &schema.DirEntry{Ref: file.Ref, Name: "a", Link: outside}
+
+	for name, root := range map[string]types.Ref{
+		"parent":    dirOf([]*schema.DirEntry{fileEnt("../x")}),
+		"dot":       dirOf([]*schema.DirEntry{{Ref: sub.Ref, Name: "."}}),
+		"empty":     dirOf([]*schema.DirEntry{fileEnt("")}),
+		"link dir":  dirOf([]*schema.DirEntry{link}, []*schema.DirEntry{{Ref: sub.Ref, Name: "a"}}),
+		"link file": dirOf([]*schema.DirEntry{link, fileEnt("a")}),
+		"dup file":  dirOf([]*schema.DirEntry{fileEnt("x")}, []*schema.DirEntry{{Ref: sub.Ref, Name: "x"}}),
+	} {
+		for i, opt := range []*cas.CheckoutOptions{nil, {Exclude: []string{"none"}}} {
+			dst := filepath.Join(dir, fmt.Sprint(name, i))
+			_, err = s.CheckoutWithOptions(ctx, root, dst, opt)
+			require.Error(t, err, name)
+			names, err := ioutil.ReadDir(outside)
+			require.NoError(t, err)
+			require.Empty(t, names, name)
+			_, err = os.Lstat(filepath.Join(dir, "x"))
+			require.True(t, os.IsNotExist(err), name)
+		}
+	}
+
+	// backslashes are not separators on this system
+	dst := filepath.Join(dir, "backslash")
+	require.NoError(t, s.Checkout(ctx, dirOf([]*schema.DirEntry{fileEnt(`..\x`)}), dst))
+	data, err := ioutil.ReadFile(filepath.Join(dst, `..\x`))
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+}
+
+func TestCheckoutMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("POSIX modes are not supported on Windows")
+	}
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_checkout_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	modes := map[string]os.FileMode{
+		"private.txt":     0600,
+		"run.sh":          0755,
+		"ro":              0555,
+		"ro/file.txt":     0444,
+		"shared":          0775 | os.ModeSetgid,
+		"shared/file.txt": 0664,
+	}
+	for _, name := range []string{"ro", "shared"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(src, name), 0755))
+	}
+	for name := range modes {
+		if name != "ro" && name != "shared" {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(src, filepath.FromSlash(name)), []byte(name), 0644))
+		}
+	}
+	// directories are chmoded last, since they might not be writable
+	for _, name := range []string{"private.txt", "run.sh", "ro/file.txt", "shared/file.txt", "ro", "shared"} {
+		require.NoError(t, os.Chmod(filepath.Join(src, filepath.FromSlash(name)), modes[name]))
+	}
+	defer os.Chmod(filepath.Join(src, "ro"), 0755)
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	plain, err := s.StoreFilePath(ctx, src, nil)
+	require.NoError(t, err)
+	root, err := s.StoreFilePath(ctx, src, &cas.StoreConfig{Mode: true, Owner: true})
+	require.NoError(t, err)
+	require.NotEqual(t, plain.Ref, root.Ref)
+
+	ents, err := s.ReadDir(ctx, root.Ref)
+	require.NoError(t, err)
+	got := make(map[string]uint32)
+	for _, ent := range ents {
+		got[ent.Name] = ent.Mode
+		require.NotEmpty(t, ent.User, ent.Name)
+		require.NotEmpty(t, ent.Group, ent.Name)
+	}
+	require.Equal(t, map[string]uint32{
+		"private.txt": 0100600,
+		"run.sh":      0100755,
+		"ro":          0040555,
+		"shared":      0042775,
+	}, got)
+
+	perms := func(dst string) map[string]os.FileMode {
+		out := make(map[string]os.FileMode)
+		for name := range modes {
+			fi, err := os.Stat(filepath.Join(dst, filepath.FromSlash(name)))
+			require.NoError(t, err)
+			out[name] = fi.Mode() &^ os.ModeDir
+		}
+		return out
+	}
+
+	dst := filepath.Join(dir, "dst")
+	_, err = s.CheckoutWithOptions(ctx, root.Ref, dst, &cas.CheckoutOptions{Mode: true, Owner: true})
+	require.NoError(t, err)
+	defer os.Chmod(filepath.Join(dst, "ro"), 0755)
+	require.Equal(t, modes, perms(dst))
+
+	// modes are ignored unless requested
+	dst = filepath.Join(dir, "dst2")
+	require.NoError(t, s.Checkout(ctx, root.Ref, dst))
+	require.NotEqual(t, modes, perms(dst))
+	fi, err := os.Stat(filepath.Join(dst, "ro"))
+	require.NoError(t, err)
+	require.NotZero(t, fi.Mode()&0200, "directory should be writable")
+}
+
+// corruptStorage flips the first byte of a blob when it's fetched.
+type corruptStorage struct {
+	storage.Storage
+	ref types.Ref
+}
+
+func (s *corruptStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	rc, sz, err := s.Storage.FetchBlob(ctx, ref)
+	if err != nil || ref != s.ref {
+		return rc, sz, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, 0, err
+	}
+	data[0] ^= 0xff
+	return ioutil.NopCloser(bytes.NewReader(data)), sz, nil
+}
+
+func TestCheckoutParallel(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_checkout_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mem := storage.NewInMemory()
+	s, err := cas.New(mem)
+	require.NoError(t, err)
+
+	var (
+		ents  []schema.DirEntry
+		files = make(map[string]string)
+		total uint64
+	)
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("file%03d.txt", i)
+		data := strings.Repeat(fmt.Sprintf("data %d\n", i), i+1)
+		sr, err := storage.WriteBytes(ctx, mem, []byte(data))
+		require.NoError(t, err)
+		ents = append(ents, schema.DirEntry{Ref: sr.Ref, Name: name, Stats: schema.Stats{schema.StatDataSize: sr.Size}})
+		files[name] = data
+		total += sr.Size
+	}
+	// the ref of the whole content is not recorded, thus parts are verified
+	var parts []types.SizedRef
+	for _, p := range []string{"first part, ", "second part"} {
+		sr, err := storage.WriteBytes(ctx, mem, []byte(p))
+		require.NoError(t, err)
+		parts = append(parts, sr)
+		files["multi.txt"] += p
+		total += sr.Size
+	}
+	msr, err := s.StoreSchema(ctx, &schema.Multipart{Parts: parts})
+	require.NoError(t, err)
+	ents = append(ents, schema.DirEntry{Ref: msr.Ref, Name: "multi.txt", Stats: schema.Stats{schema.StatDataSize: uint64(len(files["multi.txt"]))}})
+	root, _, err := s.StoreDirEntries(ctx, ents)
+	require.NoError(t, err)
+
+	dst := filepath.Join(dir, "dst")
+	rep, err := s.CheckoutWithOptions(ctx, root.Ref, dst, &cas.CheckoutOptions{Workers: 4})
+	require.NoError(t, err)
+	require.Equal(t, &cas.CheckoutReport{Files: len(files), Dirs: 1, Verified: total}, rep)
+	for name, data := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dst, name))
+		require.NoError(t, err)
+		require.Equal(t, data, string(got), name)
+	}
+
+	for i, ref := range []types.Ref{ents[50].Ref, parts[1].Ref} {
+		cs, err := cas.New(&corruptStorage{Storage: mem, ref: ref})
+		require.NoError(t, err)
+		_, err = cs.CheckoutWithOptions(ctx, root.Ref, filepath.Join(dir, fmt.Sprint("corrupt", i)), nil)
+		require.IsType(t, storage.ErrRefMissmatch{}, err)
+	}
+}
@@ -0,0 +1,177 @@
+package cas
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// ExportChecksums writes SHA-256 checksums of all files in a directory (or a commit of a directory) to w.
+// The output is compatible with sha256sum, thus restored files can be checked with "sha256sum -c".
+//
+// Checksums of files stored as a single blob (or only indexed) are taken from refs, other files are read
+// and hashed, unless the ref of their content is known.
+func (s *Storage) ExportChecksums(ctx context.Context, root Ref, w io.Writer) error {
+	ents, err := s.TreeManifest(ctx, root)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for _, e := range ents {
+		if e.Dir {
+			continue
+		}
+		sum, err := s.fileChecksum(ctx, e.Ref)
+		if err != nil {
+			return fmt.Errorf("%s: %v", e.Path, err)
+		}
+		writeChecksum(bw, sum, e.Path)
+	}
+	return bw.Flush()
+}
+
+// fileChecksum returns the SHA-256 hash of the content of the file.
+func (s *Storage) fileChecksum(ctx context.Context, ref Ref) ([]byte, error) {
+	if ref.Empty() {
+		return ref.Digest(), nil
+	}
+	rc, sr, err := s.openFile(ctx, ref)
+	if err == storage.ErrNotFound && ref.Name() == types.DefaultHash {
+		// content was only indexed, the ref is the hash of the content
+		return ref.Digest(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if !sr.Ref.Zero() && sr.Ref.Name() == types.DefaultHash {
+		return sr.Ref.Digest(), nil
+	}
+	h := sha256.New()
+	if _, err = io.Copy(h, rc); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// writeChecksum writes a line in the format of sha256sum. Paths with backslashes or newlines are escaped
+// and the line is prefixed with a backslash, as sha256sum does.
+func writeChecksum(w *bufio.Writer, sum []byte, path string) {
+	if strings.ContainsAny(path, "\\\n") {
+		path = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(path)
+		w.WriteByte('\\')
+	}
+	w.WriteString(hex.EncodeToString(sum))
+	w.WriteString("  ")
+	w.WriteString(path)
+	w.WriteByte('\n')
+}
+
+// parseChecksum parses a line in the format of sha256sum. Both text and binary mode lines are accepted.
+func parseChecksum(line string) ([]byte, string, error) {
+	escaped := strings.HasPrefix(line, "\\")
+	if escaped {
+		line = line[1:]
+	}
+	i := strings.IndexByte(line, ' ')
+	if i < 0 || i+1 >= len(line) || (line[i+1] != ' ' && line[i+1] != '*') {
+		return nil, "", fmt.Errorf("invalid checksum line: %q", line)
+	}
+	sum, err := hex.DecodeString(line[:i])
+	if err != nil || len(sum) != sha256.Size {
+		return nil, "", fmt.Errorf("invalid checksum: %q", line[:i])
+	}
+	path := line[i+2:]
+	if escaped {
+		path = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(path)
+	}
+	return sum, path, nil
+}
+
+// ReadChecksums reads SHA-256 checksums in the format of sha256sum and returns refs by a slash-separated path.
+// The result can be used as StoreConfig.Checksums to index files with known hashes without reading them.
+func ReadChecksums(r io.Reader) (map[string]Ref, error) {
+	out := make(map[string]Ref)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		sum, name, err := parseChecksum(line)
+		if err != nil {
+			return nil, err
+		}
+		ref, err := types.RefFromDigest(types.DefaultHash, sum)
+		if err != nil {
+			return nil, err
+		}
+		out[path.Clean(filepath.ToSlash(name))] = ref
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ChecksumsResult summarizes the result of VerifyAgainstChecksums.
+type ChecksumsResult struct {
+	OK      []string // files that match the checksum
+	Failed  []string // files with different content
+	Missing []string // files that don't exist
+}
+
+// VerifyAgainstChecksums checks files in a local directory against SHA-256 checksums read from r,
+// for example written by ExportChecksums or sha256sum. Paths are relative to the directory.
+// An error is returned only if checksums cannot be read; mismatches are reported in the result.
+func VerifyAgainstChecksums(ctx context.Context, dir string, r io.Reader) (*ChecksumsResult, error) {
+	res := &ChecksumsResult{}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		exp, path, err := parseChecksum(line)
+		if err != nil {
+			return res, err
+		}
+		sum, err := localChecksum(filepath.Join(dir, filepath.FromSlash(path)))
+		switch {
+		case os.IsNotExist(err):
+			res.Missing = append(res.Missing, path)
+		case err != nil:
+			return res, err
+		case string(sum) != string(exp):
+			res.Failed = append(res.Failed, path)
+		default:
+			res.OK = append(res.OK, path)
+		}
+	}
+	return res, sc.Err()
+}
+
+func localChecksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,121 @@
+package cas_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+func TestChecksums(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_sums_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	large := bytes.Repeat([]byte("0123456789"), 1000)
+	files := map[string][]byte{
+		"a.txt":       []byte("a"),
+		"sub/b.txt":   []byte("b"),
+		"sub/large":   large,
+		"back\\slash": []byte("c"),
+	}
+	for name, data := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, data, 0644))
+	}
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	// large files are split, thus their checksums are computed from the content
+	root, err := s.StoreFilePath(ctx, src, &cas.StoreConfig{Split: &cas.SplitConfig{Min: 1024, Max: 4096}})
+	require.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, s.ExportChecksums(ctx, root.Ref, buf))
+
+	sum := func(data []byte) string {
+		h := sha256.Sum256(data)
+		return hex.EncodeToString(h[:])
+	}
+	exp := sum(files["a.txt"]) + "  a.txt\n" +
+		"\\" + sum(files["back\\slash"]) + "  back\\\\slash\n" +
+		sum(files["sub/b.txt"]) + "  sub/b.txt\n" +
+		sum(large) + "  sub/large\n"
+	require.Equal(t, exp, buf.String())
+
+	dst := filepath.Join(dir, "dst")
+	require.NoError(t, s.Checkout(ctx, root.Ref, dst))
+	res, err := cas.VerifyAgainstChecksums(ctx, dst, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, res.OK, len(files))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dst, "a.txt"), []byte("x"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(dst, "sub", "b.txt")))
+	res, err = cas.VerifyAgainstChecksums(ctx, dst, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.txt"}, res.Failed)
+	require.Equal(t, []string{"sub/b.txt"}, res.Missing)
+	require.Len(t, res.OK, len(files)-2)
+}
+
+func TestStoreWithChecksums(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_sums_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("b"), 0644))
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	sum := func(data string) string {
+		h := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(h[:])
+	}
+	sums, err := cas.ReadChecksums(strings.NewReader(
+		sum("a") + "  ./a.txt\n" + sum("c") + " *sub/b.txt\n",
+	))
+	require.NoError(t, err)
+	require.Equal(t, map[string]cas.Ref{
+		"a.txt":     types.BytesRef([]byte("a")),
+		"sub/b.txt": types.BytesRef([]byte("c")),
+	}, sums)
+
+	// files are not read when indexing, thus known hashes are trusted
+	sr, err := s.StoreFilePath(ctx, dir, &cas.StoreConfig{IndexOnly: true, Checksums: sums})
+	require.NoError(t, err)
+	buf := new(bytes.Buffer)
+	require.NoError(t, s.ExportChecksums(ctx, sr.Ref, buf))
+	require.Equal(t, sum("a")+"  a.txt\n"+sum("c")+"  sub/b.txt\n", buf.String())
+
+	// but the content is checked when it's stored
+	_, err = s.StoreFilePath(ctx, dir, &cas.StoreConfig{Checksums: sums})
+	require.IsType(t, storage.ErrRefMissmatch{}, err)
+
+	sums["sub/b.txt"] = types.BytesRef([]byte("b"))
+	sr, err = s.StoreFilePath(ctx, dir, &cas.StoreConfig{IndexOnly: true, Checksums: sums})
+	require.NoError(t, err)
+	exp, err := s.StoreFilePath(ctx, dir, nil)
+	require.NoError(t, err)
+	require.Equal(t, exp.Ref, sr.Ref)
+}
@@ -0,0 +1,112 @@
+package chunker
+
+func init() {
+	Register("fixed", func(c Config) (Chunker, error) {
+		return Fixed(c.Avg), nil
+	})
+	Register("rolling", func(c Config) (Chunker, error) {
+		return Rolling(c.Min, c.Avg, c.Max), nil
+	})
+	Register("lines", func(c Config) (Chunker, error) {
+		return Delimited('\n', c.Min, c.Avg, c.Max), nil
+	})
+}
+
+// Fixed returns a chunker that splits data into chunks of a given size. Only the last chunk can be smaller.
+//
+// It's registered as "fixed" and uses the average size from the config.
+func Fixed(size uint64) Chunker {
+	if size == 0 {
+		size = DefaultAvg
+	}
+	return &fixed{size: size}
+}
+
+type fixed struct {
+	size uint64
+	cur  uint64 // size of the current chunk
+}
+
+func (c *fixed) Next(p []byte) int {
+	if n := c.size - c.cur; n <= uint64(len(p)) {
+		c.cur = 0
+		return int(n)
+	}
+	c.cur += uint64(len(p))
+	return -1
+}
+
+// Rolling returns a content-defined chunker that uses a gear rolling hash. Boundaries depend only on the last
+// 64 bytes of data, thus insertions and deletions only affect chunks around the change.
+//
+// Chunks are at least min bytes and at most max bytes long, and approximately avg bytes on average.
+// It's registered as "rolling".
+func Rolling(min, avg, max uint64) Chunker {
+	return newGear(min, avg, max, -1)
+}
+
+// Delimited returns a content-defined chunker that only splits data after a delimiter, unless the chunk
+// reaches the max size. It keeps records of formats such as logs, CSV or JSON lines intact in chunks.
+//
+// Like Rolling, the rolling hash decides where the chunk ends, but the boundary is moved to the next delimiter.
+// It's registered as "lines", with '\n' as a delimiter.
+func Delimited(delim byte, min, avg, max uint64) Chunker {
+	return newGear(min, avg, max, int(delim))
+}
+
+func newGear(min, avg, max uint64, delim int) *gear {
+	if max == 0 {
+		max = ^uint64(0)
+	}
+	// expected distance to the boundary after the min size is 2^bits
+	bits := uint(0)
+	for avg > min && uint64(1)<<(bits+1) <= avg-min {
+		bits++
+	}
+	return &gear{
+		min: min, max: max,
+		mask:  (uint64(1)<<bits - 1) << (64 - bits),
+		delim: delim,
+	}
+}
+
+// gear implements content-defined chunking with a gear hash, optionally moving boundaries to a delimiter.
+type gear struct {
+	min, max uint64
+	mask     uint64
+	delim    int // -1 to split at any byte
+
+	cur   uint64 // size of the current chunk
+	h     uint64 // rolling hash
+	armed bool   // the hash matched; split at the next delimiter
+}
+
+func (c *gear) Next(p []byte) int {
+	for i, b := range p {
+		c.cur++
+		c.h = c.h<<1 + gearTable[b]
+		if !c.armed && c.cur >= c.min && c.h&c.mask == 0 {
+			c.armed = true
+		}
+		if c.cur >= c.max || (c.armed && (c.delim < 0 || int(b) == c.delim)) {
+			c.cur, c.h, c.armed = 0, 0, false
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// gearTable maps bytes to random values for the gear hash.
+// It's generated with a fixed seed, and must never change, since it defines boundaries of chunks.
+var gearTable = func() (t [256]uint64) {
+	// splitmix64
+	x := uint64(0x6361732d67656172) // "cas-gear"
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
@@ -0,0 +1,189 @@
+// Package chunker implements algorithms that split a stream of data into chunks.
+//
+// The choice of the algorithm affects deduplication. Fixed-size chunks work well for disk and VM images,
+// where data is modified in place. Content-defined chunks (rolling) survive insertions and deletions,
+// and line-aligned chunks (lines) work well for logs and other text files that are appended to.
+//
+// Chunk boundaries must be stable across versions, otherwise the same content would be stored twice.
+// Registered algorithms must never change the way they split data; a new name must be registered instead.
+package chunker
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Chunker finds chunk boundaries in a stream of data.
+//
+// Chunkers are stateful: data must be passed to Next in order, and a chunker cannot be shared between streams.
+type Chunker interface {
+	// Next scans the next part of the stream and returns the number of bytes from p that complete
+	// the current chunk, or -1 if all of p belongs to the current chunk. After a boundary is returned,
+	// the remaining part of p must be passed to Next again, and it starts a new chunk.
+	Next(p []byte) int
+}
+
+// Func creates a chunker for the config. See Register.
+type Func func(c Config) (Chunker, error)
+
+var (
+	mu    sync.RWMutex
+	algos = make(map[string]Func)
+)
+
+// Register adds a new chunking algorithm. It's not safe to register algorithms after chunkers were created.
+func Register(name string, fnc Func) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := algos[name]; ok {
+		panic(fmt.Errorf("chunker %q is already registered", name))
+	}
+	algos[name] = fnc
+}
+
+// Algorithms lists names of all registered algorithms.
+func Algorithms() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(algos))
+	for name := range algos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+const (
+	// DefaultAlgo is used when the algorithm is not set in the config.
+	DefaultAlgo = "rolling"
+	// DefaultAvg is the default average size of chunks.
+	DefaultAvg = 1024 * 1024
+)
+
+// Config selects a chunking algorithm and sizes of chunks. Zero sizes are set to defaults, derived from
+// the average size: Min is Avg/4 and Max is Avg*8. Algorithms may interpret or ignore the sizes differently.
+type Config struct {
+	Algo string `json:"algo,omitempty"` // name of a registered algorithm; DefaultAlgo if not set
+	Min  uint64 `json:"min,omitempty"`  // min size of chunks, in bytes
+	Avg  uint64 `json:"avg,omitempty"`  // average size of chunks, in bytes
+	Max  uint64 `json:"max,omitempty"`  // max size of chunks, in bytes
+}
+
+// withDefaults returns a copy of the config with all fields set.
+func (c Config) withDefaults() Config {
+	if c.Algo == "" {
+		c.Algo = DefaultAlgo
+	}
+	if c.Avg == 0 {
+		switch {
+		case c.Min != 0 && c.Max != 0:
+			c.Avg = (c.Min + c.Max) / 2
+		case c.Max != 0 && c.Max < DefaultAvg:
+			c.Avg = c.Max
+		case c.Min > DefaultAvg:
+			c.Avg = c.Min
+		default:
+			c.Avg = DefaultAvg
+		}
+	}
+	if c.Min == 0 {
+		c.Min = c.Avg / 4
+	}
+	if c.Max == 0 {
+		c.Max = c.Avg * 8
+	}
+	return c
+}
+
+// New creates a new chunker for a single stream.
+func (c Config) New() (Chunker, error) {
+	c = c.withDefaults()
+	if c.Min > c.Avg || c.Avg > c.Max {
+		return nil, fmt.Errorf("chunker: invalid sizes: min=%d avg=%d max=%d", c.Min, c.Avg, c.Max)
+	}
+	mu.RLock()
+	fnc := algos[c.Algo]
+	mu.RUnlock()
+	if fnc == nil {
+		return nil, fmt.Errorf("chunker: unknown algorithm: %q", c.Algo)
+	}
+	return fnc(c)
+}
+
+// String returns the config in the format accepted by Parse.
+func (c Config) String() string {
+	algo := c.Algo
+	if algo == "" {
+		algo = DefaultAlgo
+	}
+	var opts []string
+	for _, o := range []struct {
+		name string
+		v    uint64
+	}{
+		{"min", c.Min}, {"avg", c.Avg}, {"max", c.Max},
+	} {
+		if o.v != 0 {
+			opts = append(opts, o.name+"="+formatSize(o.v))
+		}
+	}
+	if len(opts) == 0 {
+		return algo
+	}
+	return algo + ":" + strings.Join(opts, ",")
+}
+
+// formatSize prints the size exactly, using the largest binary unit possible.
+func formatSize(v uint64) string {
+	for _, u := range []struct {
+		name string
+		size uint64
+	}{
+		{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10},
+	} {
+		if v%u.size == 0 {
+			return strconv.FormatUint(v/u.size, 10) + u.name
+		}
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+// Parse parses the config in the form of "algo[:min=N,avg=N,max=N]", for example "rolling:avg=4MiB".
+// Sizes may have units. An empty algorithm selects the default one.
+func Parse(s string) (Config, error) {
+	var c Config
+	c.Algo = s
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		c.Algo = s[:i]
+		for _, opt := range strings.Split(s[i+1:], ",") {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) != 2 {
+				return Config{}, fmt.Errorf("chunker: expected key=value, got: %q", opt)
+			}
+			v, err := humanize.ParseBytes(kv[1])
+			if err != nil {
+				return Config{}, fmt.Errorf("chunker: invalid size: %v", err)
+			}
+			switch kv[0] {
+			case "min":
+				c.Min = v
+			case "avg":
+				c.Avg = v
+			case "max":
+				c.Max = v
+			default:
+				return Config{}, fmt.Errorf("chunker: unknown option: %q", kv[0])
+			}
+		}
+	}
+	// check that the algorithm and sizes are valid
+	if _, err := c.New(); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
@@ -0,0 +1,126 @@
+package chunker
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// split returns sizes of chunks of the data, passing it to the chunker in parts of a given size.
+func split(t testing.TB, c Chunker, data []byte, part int) []int {
+	var (
+		sizes []int
+		cur   int
+	)
+	for len(data) > 0 {
+		p := data
+		if len(p) > part {
+			p = p[:part]
+		}
+		data = data[len(p):]
+		for len(p) > 0 {
+			n := c.Next(p)
+			if n < 0 {
+				cur += len(p)
+				break
+			}
+			require.True(t, n <= len(p))
+			cur += n
+			sizes = append(sizes, cur)
+			cur = 0
+			p = p[n:]
+		}
+	}
+	if cur != 0 {
+		sizes = append(sizes, cur)
+	}
+	return sizes
+}
+
+func randData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestFixed(t *testing.T) {
+	data := randData(1, 10000)
+	for _, part := range []int{1, 7, 1000, 4096, 20000} {
+		require.Equal(t, []int{4096, 4096, 1808}, split(t, Fixed(4096), data, part), "part=%d", part)
+	}
+}
+
+func TestRolling(t *testing.T) {
+	const min, avg, max = 1024, 4096, 16 * 1024
+	data := randData(1, 1024*1024)
+	sizes := split(t, Rolling(min, avg, max), data, 1000)
+	for _, sz := range sizes[:len(sizes)-1] {
+		require.True(t, sz >= min && sz <= max, "size: %d", sz)
+	}
+	mean := len(data) / len(sizes)
+	require.True(t, mean > avg/2 && mean < avg*2, "mean: %d", mean)
+
+	// boundaries don't depend on how data is passed to the chunker
+	require.Equal(t, sizes, split(t, Rolling(min, avg, max), data, 64*1024))
+
+	// insertion only affects chunks around it
+	mod := append(append(append([]byte{}, data[:500000]...), "inserted"...), data[500000:]...)
+	chunks := func(data []byte) map[string]struct{} {
+		m := make(map[string]struct{})
+		for _, sz := range split(t, Rolling(min, avg, max), data, len(data)) {
+			m[string(data[:sz])] = struct{}{}
+			data = data[sz:]
+		}
+		return m
+	}
+	a, b := chunks(data), chunks(mod)
+	diff := 0
+	for c := range b {
+		if _, ok := a[c]; !ok {
+			diff++
+		}
+	}
+	require.True(t, diff <= 2, "changed chunks: %d", diff)
+}
+
+func TestDelimited(t *testing.T) {
+	var buf bytes.Buffer
+	r := rand.New(rand.NewSource(1))
+	for buf.Len() < 256*1024 {
+		line := make([]byte, 10+r.Intn(100))
+		for i := range line {
+			line[i] = 'a' + byte(r.Intn(26))
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	data := buf.Bytes()
+	for _, sz := range split(t, Delimited('\n', 1024, 4096, 16*1024), data, 1000) {
+		require.Equal(t, byte('\n'), data[sz-1])
+		data = data[sz:]
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct {
+		in  string
+		exp Config
+		str string
+	}{
+		{in: "", exp: Config{}, str: "rolling"},
+		{in: "fixed", exp: Config{Algo: "fixed"}, str: "fixed"},
+		{in: "rolling:avg=4MiB", exp: Config{Algo: "rolling", Avg: 4 << 20}, str: "rolling:avg=4MiB"},
+		{in: "lines:min=1000,max=1MB", exp: Config{Algo: "lines", Min: 1000, Max: 1000000}, str: "lines:min=1000,max=1000000"},
+	} {
+		got, err := Parse(c.in)
+		require.NoError(t, err, c.in)
+		require.Equal(t, c.exp, got, c.in)
+		require.Equal(t, c.str, got.String())
+	}
+	for _, s := range []string{"unknown", "rolling:avg", "rolling:size=1", "rolling:min=2MiB,max=1MiB"} {
+		_, err := Parse(s)
+		require.Error(t, err, s)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/bench"
+	"github.com/dennwc/cas/storage/local"
+)
+
+func benchOptions(flags *pflag.FlagSet) (*bench.Options, error) {
+	opts := &bench.Options{}
+	opts.Files, _ = flags.GetInt("files")
+	opts.Dirs, _ = flags.GetInt("dirs")
+	opts.Seed, _ = flags.GetInt64("seed")
+	opts.Parallel, _ = flags.GetInt("parallel")
+	for _, f := range []struct {
+		name string
+		dst  *uint64
+	}{
+		{"min-size", &opts.MinSize},
+		{"max-size", &opts.MaxSize},
+	} {
+		v, _ := flags.GetString(f.name)
+		sz, err := humanize.ParseBytes(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", f.name, err)
+		}
+		*f.dst = sz
+	}
+	return opts, nil
+}
+
+func printBenchResults(flags *pflag.FlagSet, results ...*bench.Result) error {
+	if asJSON, _ := flags.GetBool("json"); asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, r := range results {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, r := range results {
+		fmt.Println(r)
+	}
+	return nil
+}
+
+// openBenchTarget opens the destination for the sync benchmark. If no address is given, a temporary
+// local storage is created and removed when the storage is closed.
+func openBenchTarget(addr string) (*cas.Storage, func(), error) {
+	if addr != "" {
+		s, err := openRemote(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, func() { s.Close() }, nil
+	}
+	dir, err := ioutil.TempDir("", "cas_bench_")
+	if err != nil {
+		return nil, nil, err
+	}
+	ls, err := local.New(dir, true)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	s, err := cas.New(ls)
+	if err != nil {
+		ls.Close()
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "bench",
+		Short: "run end-to-end benchmarks of the storage",
+		Long: `Run end-to-end benchmarks of the storage.
+
+Benchmarks generate a synthetic tree of files with pseudo-random content and measure the throughput
+and latency percentiles of storage operations. Runs with the same options and seed use the same content,
+thus reports are comparable across backends and configurations.
+
+Generated blobs are not pinned; run "cas gc" to remove them.`,
+	}
+	flags := cmd.PersistentFlags()
+	flags.Int("files", 100, "number of files in the generated tree")
+	flags.Int("dirs", 0, "number of directories to spread files across")
+	flags.String("min-size", "64KiB", "minimal size of generated files")
+	flags.String("max-size", "64KiB", "maximal size of generated files")
+	flags.Int64("seed", 0, "seed for the content of generated files")
+	flags.IntP("parallel", "j", 1, "number of concurrent operations")
+	flags.Bool("json", false, "print results as JSON")
+	Root.AddCommand(cmd)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "ingest",
+		Short: "measure how fast files are stored",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			opts, err := benchOptions(flags)
+			if err != nil {
+				return err
+			}
+			res, _, err := bench.Ingest(ctx, s, opts)
+			if err != nil {
+				return err
+			}
+			return printBenchResults(flags, res)
+		}),
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "fetch",
+		Short: "measure how fast stored files are read",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			opts, err := benchOptions(flags)
+			if err != nil {
+				return err
+			}
+			ires, tree, err := bench.Ingest(ctx, s, opts)
+			if err != nil {
+				return err
+			}
+			res, err := bench.Fetch(ctx, s, tree, opts)
+			if err != nil {
+				return err
+			}
+			return printBenchResults(flags, ires, res)
+		}),
+	})
+
+	syncCmd := &cobra.Command{
+		Use:   "sync",
+		Short: "measure how fast a tree is copied to another storage",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			opts, err := benchOptions(flags)
+			if err != nil {
+				return err
+			}
+			addr, _ := flags.GetString("to")
+			dst, closeDst, err := openBenchTarget(addr)
+			if err != nil {
+				return err
+			}
+			defer closeDst()
+			ires, tree, err := bench.Ingest(ctx, s, opts)
+			if err != nil {
+				return err
+			}
+			res, err := bench.Sync(ctx, dst, s, tree)
+			if err != nil {
+				return err
+			}
+			return printBenchResults(flags, ires, res)
+		}),
+	}
+	syncCmd.Flags().String("to", "", "destination storage (URL or directory); a temporary local store is used by default")
+	cmd.AddCommand(syncCmd)
+}
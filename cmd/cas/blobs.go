@@ -46,8 +46,9 @@ func init() {
 		Short:   "list blob(s) stored in CAS",
 		RunE: casOpenCmd(func(ctx context.Context, st *cas.Storage, flags *pflag.FlagSet, args []string) error {
 			short, _ := flags.GetBool("short")
+			prefix, _ := flags.GetString("prefix")
 
-			it := st.IterateBlobs(ctx)
+			it := st.IterateBlobsPrefix(ctx, prefix)
 			defer it.Close()
 			for it.Next() {
 				sr := it.SizedRef()
@@ -61,7 +62,41 @@ func init() {
 		}),
 	}
 	listCmd.Flags().BoolP("short", "s", false, "only print refs")
+	listCmd.Flags().String("prefix", "", "only list blobs with refs that start with a prefix (e.g. sha256:ab)")
 	cmd.AddCommand(listCmd)
+
+	refsCmd := &cobra.Command{
+		Use:     "refs <pin|ref>",
+		Aliases: []string{"referrers"},
+		Short:   "list schema blobs that reference a blob",
+		RunE: casOpenCmd(func(ctx context.Context, st *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected a pin or a ref")
+			}
+			ref, err := st.GetPinOrRef(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			if count, _ := flags.GetBool("count"); count {
+				n, err := st.RefCount(ctx, ref)
+				if err != nil {
+					return err
+				}
+				fmt.Println(n)
+				return nil
+			}
+			refs, err := st.Referrers(ctx, ref)
+			if err != nil {
+				return err
+			}
+			for _, r := range refs {
+				fmt.Println(r)
+			}
+			return nil
+		}),
+	}
+	refsCmd.Flags().BoolP("count", "c", false, "only print the number of referrers")
+	cmd.AddCommand(refsCmd)
 }
 
 func dumpFile(ctx context.Context, w io.Writer, st *cas.Storage, ref cas.Ref) error {
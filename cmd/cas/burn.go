@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/burn"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "burn <pin|ref> <dir>",
+		Short: "write a tree to size-limited volumes for write-once media",
+		Long: `Write a tree to size-limited volumes for write-once media, such as Blu-ray discs or tapes.
+
+Each volume is a directory with a slice of the tree pack and a manifest with hashes of all blocks,
+thus each volume can be verified on its own. Parity volumes allow restoring the tree if a single
+volume of each parity group is missing or damaged.`,
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("expected a pin or a ref and a directory")
+			}
+			ref, err := s.GetPinOrRef(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			opts := &burn.Options{}
+			opts.Parity, _ = flags.GetInt("parity")
+			for _, f := range []struct {
+				name string
+				dst  *uint64
+			}{
+				{"volume-size", &opts.VolumeSize},
+				{"block-size", &opts.BlockSize},
+			} {
+				v, _ := flags.GetString(f.name)
+				if *f.dst, err = humanize.ParseBytes(v); err != nil {
+					return fmt.Errorf("invalid %s: %v", f.name, err)
+				}
+			}
+			m, err := burn.Write(ctx, s, ref, args[1], opts)
+			if err != nil {
+				return err
+			}
+			for i, v := range m.Volumes {
+				kind := "data"
+				if v.Parity {
+					kind = "parity"
+				}
+				fmt.Printf("%s\t%s\t%s\tgroup %d\n", burn.VolumeName(i), kind, humanize.IBytes(v.Size), v.Group)
+			}
+			return nil
+		}),
+	}
+	cmd.Flags().String("volume-size", "25GB", "size of the data in each volume")
+	cmd.Flags().String("block-size", "1MiB", "size of blocks that are verified and repaired individually")
+	cmd.Flags().Int("parity", 1, "number of parity volumes (-1 to disable)")
+	Root.AddCommand(cmd)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "verify <dir>...",
+		Short: "verify volumes and report if the tree can be restored",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("expected volume directories")
+			}
+			rep, err := burn.Verify(args)
+			if err != nil {
+				return err
+			}
+			for _, vi := range rep.Missing {
+				fmt.Println(burn.VolumeName(vi), "missing")
+			}
+			for _, d := range rep.Damaged {
+				fmt.Printf("%s block %d damaged\n", burn.VolumeName(d.Volume), d.Block)
+			}
+			if rep.OK() {
+				fmt.Println("all volumes are intact")
+			} else if !rep.Recoverable {
+				return fmt.Errorf("the tree cannot be restored")
+			} else {
+				fmt.Println("the tree can be restored from parity")
+			}
+			return nil
+		},
+	})
+
+	restoreCmd := &cobra.Command{
+		Use:   "restore <dir>...",
+		Short: "store the tree from volumes, restoring missing and damaged blocks from parity",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("expected volume directories")
+			}
+			sr, err := burn.Restore(ctx, s, args)
+			if err != nil {
+				return err
+			}
+			if pin, _ := flags.GetString("pin"); pin != "" {
+				if err = s.SetPin(ctx, pin, sr.Ref); err != nil {
+					return err
+				}
+				fmt.Println(pin, "=", sr.Ref)
+				return nil
+			}
+			fmt.Println(sr.Ref)
+			return nil
+		}),
+	}
+	restoreCmd.Flags().String("pin", "", "set a pin to the root of the tree")
+	cmd.AddCommand(restoreCmd)
+}
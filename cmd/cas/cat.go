@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+)
+
+// splitPinPath splits the argument in the form of "<pin|ref>[/path]" and resolves the pin or the ref.
+func splitPinPath(ctx context.Context, s *cas.Storage, arg string) (cas.Ref, string, error) {
+	name, path := arg, ""
+	if i := strings.IndexByte(arg, '/'); i >= 0 {
+		name, path = arg[:i], arg[i+1:]
+	}
+	root, err := s.GetPinOrRef(ctx, name)
+	if err != nil {
+		return cas.Ref{}, "", err
+	}
+	return root, path, nil
+}
+
+// resolvePinPath resolves the argument in the form of "<pin|ref>[/path]" to a ref of the file or directory.
+func resolvePinPath(ctx context.Context, s *cas.Storage, arg string) (cas.Ref, error) {
+	root, path, err := splitPinPath(ctx, s, arg)
+	if err != nil {
+		return cas.Ref{}, err
+	}
+	ent, err := s.Lookup(ctx, root, path)
+	if os.IsNotExist(err) {
+		return cas.Ref{}, fmt.Errorf("%s: no such file or directory", arg)
+	} else if err != nil {
+		return cas.Ref{}, err
+	} else if ent == nil {
+		return root, nil
+	}
+	return ent.Ref, nil
+}
+
+// catFile writes the content of a stored file, resolving trees, commits and files split into parts.
+func catFile(ctx context.Context, w io.Writer, s *cas.Storage, arg string) error {
+	ref, err := resolvePinPath(ctx, s, arg)
+	if err != nil {
+		return err
+	}
+	rc, _, err := s.OpenFile(ctx, ref)
+	if err == cas.ErrIsDir {
+		return fmt.Errorf("%s: is a directory", arg)
+	} else if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+// catArg writes the content of a stored file, the exact content of its blob (raw) or the decoded schema object.
+func catArg(ctx context.Context, w io.Writer, s *cas.Storage, arg string, raw, asSchema bool) error {
+	if !raw && !asSchema {
+		return catFile(ctx, w, s, arg)
+	}
+	ref, err := resolvePinPath(ctx, s, arg)
+	if err != nil {
+		return err
+	}
+	if raw {
+		return dumpFile(ctx, w, s, ref)
+	}
+	obj, err := s.DecodeSchema(ctx, ref)
+	if err == schema.ErrNotSchema {
+		return fmt.Errorf("%s: not a schema blob", arg)
+	} else if err != nil {
+		return err
+	}
+	return schema.Encode(w, obj)
+}
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "cat <pin|ref>[/path] ...",
+		Short: "print the content of stored files",
+		Long: `Print the content of stored files.
+
+Files are resolved by a path relative to a pin or a ref of a directory or a commit. Files split into
+multiple parts are joined. With --raw, the exact content of the blob is printed instead, and with --schema,
+the decoded schema object.`,
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("expected at least one file")
+			}
+			raw, _ := flags.GetBool("raw")
+			asSchema, _ := flags.GetBool("schema")
+			if raw && asSchema {
+				return fmt.Errorf("--raw and --schema cannot be used together")
+			}
+			for _, arg := range args {
+				if err := catArg(ctx, os.Stdout, s, arg, raw, asSchema); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	}
+	cmd.Flags().Bool("raw", false, "print the exact content of the blob")
+	cmd.Flags().Bool("schema", false, "print the decoded schema object")
+	Root.AddCommand(cmd)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+)
+
+// newTestTree stores a small directory tree and pins it as "tree".
+func newTestTree(t testing.TB) (*cas.Storage, cas.Ref) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_cmd_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a", "b", "c.txt"), []byte("c"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("aa"), 0644))
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	root, err := s.StoreFilePath(ctx, dir, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.SetPin(ctx, "tree", root.Ref))
+	return s, root.Ref
+}
+
+func TestCat(t *testing.T) {
+	ctx := context.Background()
+	s, root := newTestTree(t)
+	defer s.Close()
+
+	cat := func(arg string, raw, asSchema bool) (string, error) {
+		buf := new(bytes.Buffer)
+		err := catArg(ctx, buf, s, arg, raw, asSchema)
+		return buf.String(), err
+	}
+
+	for _, arg := range []string{"tree/a.txt", "tree//a.txt", root.String() + "/a.txt"} {
+		out, err := cat(arg, false, false)
+		require.NoError(t, err, arg)
+		require.Equal(t, "aa", out, arg)
+	}
+	out, err := cat("tree/a/b/c.txt", false, false)
+	require.NoError(t, err)
+	require.Equal(t, "c", out)
+
+	ent, err := s.Lookup(ctx, root, "a/b/c.txt")
+	require.NoError(t, err)
+	out, err = cat(ent.Ref.String(), true, false)
+	require.NoError(t, err)
+	require.Equal(t, "c", out)
+
+	// directories cannot be printed, but their schema objects can
+	_, err = cat("tree/a", false, false)
+	require.EqualError(t, err, "tree/a: is a directory")
+	_, err = cat("tree", false, false)
+	require.EqualError(t, err, "tree: is a directory")
+	out, err = cat("tree/a", false, true)
+	require.NoError(t, err)
+	_, err = schema.Decode(bytes.NewReader([]byte(out)))
+	require.NoError(t, err)
+	require.Contains(t, out, `"b"`)
+
+	_, err = cat("tree/a.txt", false, true)
+	require.EqualError(t, err, "tree/a.txt: not a schema blob")
+
+	// missing paths and paths through files
+	for _, arg := range []string{"tree/missing", "tree/a/missing.txt", "tree/a.txt/b"} {
+		for _, raw := range []bool{false, true} {
+			_, err = cat(arg, raw, false)
+			require.EqualError(t, err, arg+": no such file or directory")
+		}
+	}
+	_, err = cat("missing/a.txt", false, false)
+	require.Error(t, err)
+}
@@ -3,19 +3,34 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
 	"github.com/dennwc/cas"
 )
 
+// parseTime parses a time in RFC 3339 format, or a date (local time).
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected a time in RFC 3339 format or a date: %q", s)
+	}
+	// the end of the day
+	return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+}
+
 func init() {
 	cmd := &cobra.Command{
 		Use:     "checkout [ref or pin] <dst>",
 		Aliases: []string{"co", "restore"},
 		Short:   "restore a pin or hash to a specified path",
-		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, _ *pflag.FlagSet, args []string) error {
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
 			if len(args) != 1 && len(args) != 2 {
 				return fmt.Errorf("expected 1 or 2 arguments")
 			}
@@ -25,19 +40,72 @@ func init() {
 				name = args[0]
 				path = args[1]
 			}
-
-			ref, err := s.GetPinOrRef(ctx, name)
-			if err != nil {
-				return err
+			var (
+				opts cas.CheckoutOptions
+				err  error
+			)
+			opts.Include, _ = flags.GetStringSlice("include")
+			opts.Exclude, _ = flags.GetStringSlice("exclude")
+			opts.Mode, _ = flags.GetBool("mode")
+			opts.Owner, _ = flags.GetBool("owner")
+			opts.Workers, _ = flags.GetInt("workers")
+			if v, _ := flags.GetString("larger-than"); v != "" {
+				if opts.LargerThan, err = humanize.ParseBytes(v); err != nil {
+					return err
+				}
+			}
+			if v, _ := flags.GetString("smaller-than"); v != "" {
+				if opts.SmallerThan, err = humanize.ParseBytes(v); err != nil {
+					return err
+				}
+			}
+			at, _ := flags.GetString("at")
+			sub, _ := flags.GetString("path")
+			var ref, printed cas.Ref
+			if at != "" {
+				t, err := parseTime(at)
+				if err != nil {
+					return err
+				}
+				cref, c, err := s.CommitAt(ctx, name, t)
+				if err != nil {
+					return err
+				}
+				ref, printed = c.Root, cref
+				if ent, err := s.Lookup(ctx, c.Root, sub); err != nil {
+					return err
+				} else if ent != nil {
+					ref = ent.Ref
+				}
+			} else if sub != "" {
+				return fmt.Errorf("path can only be used with a time")
+			} else {
+				if ref, err = s.GetPinOrRef(ctx, name); err != nil {
+					return err
+				}
+				printed = ref
 			}
 
-			err = s.Checkout(ctx, ref, path)
-			if err != nil {
+			rep, err := s.CheckoutWithOptions(ctx, ref, path, &opts)
+			if err == cas.ErrNotDir {
+				return fmt.Errorf("filters can only be used for directories")
+			} else if err != nil {
 				return err
 			}
-			fmt.Println(ref, "->", path)
+			fmt.Println(printed, "->", path)
+			fmt.Printf("%d files, %d directories, %d links; %s verified\n",
+				rep.Files, rep.Dirs, rep.Links, humanize.Bytes(rep.Verified))
 			return nil
 		}),
 	}
+	cmd.Flags().String("at", "", "restore the latest commit made at or before this time (RFC 3339 or a date)")
+	cmd.Flags().String("path", "", "restore only this path of the commit")
+	cmd.Flags().StringSlice("include", nil, "only restore files matching a glob pattern (e.g. '**/*.docx'); can be repeated")
+	cmd.Flags().StringSlice("exclude", nil, "do not restore files matching a glob pattern; can be repeated")
+	cmd.Flags().String("larger-than", "", "only restore files larger than a given size (e.g. 1G)")
+	cmd.Flags().String("smaller-than", "", "only restore files smaller than a given size")
+	cmd.Flags().Bool("mode", false, "apply recorded permission bits of files and directories")
+	cmd.Flags().Bool("owner", false, "apply recorded owners and groups of files and directories (usually requires root)")
+	cmd.Flags().Int("workers", 0, "number of files restored concurrently (default 8)")
 	Root.AddCommand(cmd)
 }
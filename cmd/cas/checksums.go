@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "checksums [pin|ref]",
+		Short: "print SHA-256 checksums of all files in a tree, in the format of sha256sum",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, _ *pflag.FlagSet, args []string) error {
+			name := cas.DefaultPin
+			if len(args) == 1 {
+				name = args[0]
+			} else if len(args) > 1 {
+				return fmt.Errorf("expected 0 or 1 argument")
+			}
+			ref, err := s.GetPinOrRef(ctx, name)
+			if err != nil {
+				return err
+			}
+			return s.ExportChecksums(ctx, ref, os.Stdout)
+		}),
+	}
+	Root.AddCommand(cmd)
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify <dir> [file]",
+		Short: "check files in a local directory against checksums read from a file or stdin",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 || len(args) > 2 {
+				return fmt.Errorf("expected 1 or 2 arguments")
+			}
+			var r io.Reader = os.Stdin
+			if len(args) == 2 && args[1] != "-" {
+				f, err := os.Open(args[1])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			res, err := cas.VerifyAgainstChecksums(cmdCtx, args[0], r)
+			if res != nil {
+				for _, path := range res.Failed {
+					fmt.Println(path + ": FAILED")
+				}
+				for _, path := range res.Missing {
+					fmt.Println(path + ": MISSING")
+				}
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d ok, %d failed, %d missing\n", len(res.OK), len(res.Failed), len(res.Missing))
+			if len(res.Failed) != 0 || len(res.Missing) != 0 {
+				return fmt.Errorf("checksums do not match")
+			}
+			return nil
+		},
+	}
+	cmd.AddCommand(verifyCmd)
+}
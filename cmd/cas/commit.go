@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/types"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "commit <path|ref>",
+		Short: "store a file or directory and record it as a new snapshot of a pin",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected 1 argument")
+			}
+			pin, _ := flags.GetString("pin")
+			opt := &cas.CommitOptions{}
+			opt.Message, _ = flags.GetString("message")
+			opt.Manifest, _ = flags.GetBool("manifest")
+
+			root, err := types.ParseRef(args[0])
+			if err != nil {
+				conf, err := storeConfigFromFlags(flags)
+				if err != nil {
+					return err
+				}
+				sr, err := s.StoreFilePath(ctx, args[0], conf)
+				if err != nil {
+					return err
+				}
+				root = sr.Ref
+			}
+			sr, err := s.CommitWithOptions(ctx, pin, root, opt)
+			if err != nil {
+				return err
+			}
+			logEvent(ctx, s, &schema.Event{Type: schema.EventStore, Args: args, Refs: []types.Ref{sr.Ref}})
+			fmt.Println(pin, "=", sr.Ref)
+			return nil
+		}),
+	}
+	cmd.Flags().String("pin", cas.DefaultPin, "pin to commit to")
+	cmd.Flags().StringP("message", "m", "", "commit message")
+	cmd.Flags().Bool("manifest", false, "store a flat manifest of the tree with the commit")
+	registerStoreConfFlags(cmd.Flags())
+	Root.AddCommand(cmd)
+
+	manifestCmd := &cobra.Command{
+		Use:   "manifest [pin|ref]",
+		Short: "list all files of a tree, using the manifest of the commit if it has one",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			name := cas.DefaultPin
+			if len(args) == 1 {
+				name = args[0]
+			} else if len(args) > 1 {
+				return fmt.Errorf("expected 0 or 1 argument")
+			}
+			ref, err := s.GetPinOrRef(ctx, name)
+			if err != nil {
+				return err
+			}
+			if verify, _ := flags.GetBool("verify"); verify {
+				if err = s.VerifyManifest(ctx, ref); err != nil {
+					return err
+				}
+				fmt.Println("manifest is consistent with the tree")
+				return nil
+			}
+			ents, err := s.TreeManifest(ctx, ref)
+			if err != nil {
+				return err
+			}
+			for _, e := range ents {
+				if e.Dir {
+					fmt.Println(e.Ref, "-", e.Path+"/")
+				} else {
+					fmt.Println(e.Ref, e.Size, e.Path)
+				}
+			}
+			return nil
+		}),
+	}
+	manifestCmd.Flags().Bool("verify", false, "check that the stored manifest matches the tree")
+	Root.AddCommand(manifestCmd)
+
+	snapCmd := &cobra.Command{
+		Use:   "snapshots [pin]",
+		Short: "list commits of a pin, starting from the latest",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			pin := cas.DefaultPin
+			if len(args) == 1 {
+				pin = args[0]
+			} else if len(args) > 1 {
+				return fmt.Errorf("expected 0 or 1 argument")
+			}
+			it := s.IterateCommits(ctx, pin)
+			defer it.Close()
+			for it.Next() {
+				c := it.Commit()
+				fmt.Println(it.Ref(), c.Time.UTC().Format(time.RFC3339), c.Root, c.Message)
+			}
+			return it.Err()
+		}),
+	}
+	Root.AddCommand(snapCmd)
+
+	logCmd := &cobra.Command{
+		Use:   "log [pin] -- path",
+		Short: "list all versions of a path across commits of a pin, starting from the latest",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			dash := flags.ArgsLenAtDash()
+			if dash < 0 || len(args)-dash != 1 || dash > 1 {
+				return fmt.Errorf("expected: [pin] -- path")
+			}
+			pin := cas.DefaultPin
+			if dash == 1 {
+				pin = args[0]
+			}
+			vers, err := s.PathHistory(ctx, pin, args[dash])
+			if err != nil {
+				return err
+			}
+			for _, v := range vers {
+				ts := v.Time.UTC().Format(time.RFC3339)
+				if v.Ref.Zero() {
+					fmt.Println(v.Commit, ts, "removed")
+				} else {
+					fmt.Println(v.Commit, ts, v.Ref, v.Size)
+				}
+			}
+			return nil
+		}),
+	}
+	Root.AddCommand(logCmd)
+
+	serveCmd := &cobra.Command{
+		Use:   "serve [pin]",
+		Short: "serve all snapshots of a pin over HTTP, one directory per commit",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			pin := cas.DefaultPin
+			if len(args) == 1 {
+				pin = args[0]
+			} else if len(args) > 1 {
+				return fmt.Errorf("expected 0 or 1 argument")
+			}
+			host, _ := flags.GetString("host")
+
+			fs, err := s.SnapshotFS(ctx, pin)
+			if err != nil {
+				return err
+			}
+			log.Println("listening on", host)
+			return http.ListenAndServe(host, http.FileServer(fs))
+		}),
+	}
+	serveCmd.Flags().String("host", "localhost:9080", "host to listen on")
+	snapCmd.AddCommand(serveCmd)
+}
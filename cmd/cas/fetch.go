@@ -3,27 +3,78 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
 	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/chunker"
+	"github.com/dennwc/cas/schema"
 )
 
 func registerStoreConfFlags(flags *pflag.FlagSet) {
 	flags.BoolP("index", "i", false, "index only; do not store content blobs")
 	flags.Bool("split", false, "split content blobs")
 	flags.Uint64("max", 0, "max size of chunks while splitting")
+	flags.String("chunker", "", "split content blobs with a chunking algorithm: "+strings.Join(chunker.Algorithms(), ", ")+
+		" (e.g. rolling:avg=1MiB, fixed:avg=4MiB, lines:min=64KiB,max=4MiB)")
+	flags.Int("max-dir-entries", 0, "warn about directories with more entries (default 1M)")
+	flags.Int("max-depth", 0, "warn about directories nested deeper (default 256)")
+	flags.Bool("strict", false, "fail instead of warning about large directories, deep trees and changing files")
+	flags.Int("retries", 0, "number of times a file that changed while being stored is read again (default 3, -1 to disable)")
+	flags.Bool("snapshot", false, "copy files to a temporary location before storing them")
+	flags.Bool("append", false, "store only data appended to files since the last time they were stored (logs)")
+	flags.String("checksums", "", "file with known SHA-256 checksums of files (SHA256SUMS); files are not read when indexing")
+	flags.BoolP("follow-links", "L", false, "store files that symbolic links point to, instead of the links")
+	flags.Bool("mode", false, "record permission bits of files and directories")
+	flags.Bool("owner", false, "record names of owners and groups of files and directories")
 }
 
-func storeConfigFromFlags(flags *pflag.FlagSet) *cas.StoreConfig {
+func storeConfigFromFlags(flags *pflag.FlagSet) (*cas.StoreConfig, error) {
 	conf := &cas.StoreConfig{}
 	conf.IndexOnly, _ = flags.GetBool("index")
 	if split, _ := flags.GetBool("split"); split {
 		conf.Split = &cas.SplitConfig{}
 		conf.Split.Max, _ = flags.GetUint64("max")
 	}
-	return conf
+	if v, _ := flags.GetString("chunker"); v != "" {
+		c, err := chunker.Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		if conf.Split == nil {
+			conf.Split = &cas.SplitConfig{}
+		}
+		conf.Split.Chunker = &c
+	}
+	conf.Limits = &cas.TreeLimits{}
+	conf.Limits.MaxDirEntries, _ = flags.GetInt("max-dir-entries")
+	conf.Limits.MaxDepth, _ = flags.GetInt("max-depth")
+	conf.Limits.Strict, _ = flags.GetBool("strict")
+	conf.Changes = &cas.ChangePolicy{}
+	conf.Changes.Retries, _ = flags.GetInt("retries")
+	conf.Changes.Snapshot, _ = flags.GetBool("snapshot")
+	conf.Append, _ = flags.GetBool("append")
+	conf.FollowLinks, _ = flags.GetBool("follow-links")
+	conf.Mode, _ = flags.GetBool("mode")
+	conf.Owner, _ = flags.GetBool("owner")
+	conf.OnWarning = func(w *cas.Warning) {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+	}
+	if path, _ := flags.GetString("checksums"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		conf.Checksums, err = cas.ReadChecksums(f)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read checksums: %v", err)
+		}
+	}
+	return conf, nil
 }
 
 func init() {
@@ -31,18 +82,27 @@ func init() {
 		Use:   "fetch",
 		Short: "store the URL or file in the content-addressable storage",
 		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
-			conf := storeConfigFromFlags(flags)
+			conf, err := storeConfigFromFlags(flags)
+			if err != nil {
+				return err
+			}
 
 			var last error
+			ev := &schema.Event{Type: schema.EventStore, Args: args}
 			for _, arg := range args {
 				sr, err := s.StoreAddr(ctx, arg, conf)
 				if err != nil {
 					last = err
 					fmt.Println(arg, err)
 				} else {
+					ev.Refs = append(ev.Refs, sr.Ref)
 					fmt.Println(sr.Ref, arg)
 				}
 			}
+			if last != nil {
+				ev.Error = last.Error()
+			}
+			logEvent(ctx, s, ev)
 			return last
 		}),
 	}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "find <pin|ref>[/path]",
+		Short: "find entries in a stored tree",
+		Long: `Find entries in a stored tree without checking it out.
+
+Entries are filtered by a glob pattern for names, by type and by size. Subtrees that are too small
+to contain matching files are skipped. Time filters apply to commits: with --history, all commits
+of the pin in the time range are searched, and each version of an entry is printed once.`,
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected a pin or a ref and an optional path")
+			}
+			var (
+				opts cas.FindOptions
+				err  error
+			)
+			opts.Name, _ = flags.GetString("name")
+			switch typ, _ := flags.GetString("type"); typ {
+			case "":
+			case "f":
+				opts.Files = true
+			case "d":
+				opts.Dirs = true
+			default:
+				return fmt.Errorf("unknown type: %q (expected f or d)", typ)
+			}
+			if v, _ := flags.GetString("larger-than"); v != "" {
+				if opts.LargerThan, err = humanize.ParseBytes(v); err != nil {
+					return err
+				}
+			}
+			if v, _ := flags.GetString("smaller-than"); v != "" {
+				if opts.SmallerThan, err = humanize.ParseBytes(v); err != nil {
+					return err
+				}
+			}
+			if v, _ := flags.GetString("newer-than"); v != "" {
+				if opts.NewerThan, err = parseTime(v); err != nil {
+					return err
+				}
+			}
+			if v, _ := flags.GetString("older-than"); v != "" {
+				if opts.OlderThan, err = parseTime(v); err != nil {
+					return err
+				}
+			}
+			history, _ := flags.GetBool("history")
+			long, _ := flags.GetBool("long")
+			asJSON, _ := flags.GetBool("json")
+
+			enc := json.NewEncoder(os.Stdout)
+			printEnt := func(e *cas.FoundEntry) error {
+				le := &lsEntry{Path: e.Path, Ref: e.Entry.Ref, Size: e.Entry.Size(), Dir: e.Dir, Link: e.Entry.Link, Stats: e.Entry.Stats}
+				if asJSON {
+					return enc.Encode(struct {
+						*lsEntry
+						Commit *cas.Ref `json:"commit,omitempty"`
+					}{le, refOrNil(e.Commit)})
+				}
+				name := e.Path
+				if e.Dir {
+					name += "/"
+				}
+				if history {
+					name = shortRef(e.Commit) + " " + name
+				}
+				if long {
+					fmt.Printf("%12d %s %s\n", le.Size, shortRef(le.Ref), name)
+				} else {
+					fmt.Println(name)
+				}
+				return nil
+			}
+
+			name, dir := args[0], ""
+			if i := strings.IndexByte(name, '/'); i >= 0 {
+				name, dir = name[:i], name[i+1:]
+			}
+			if history {
+				return s.FindHistory(ctx, name, dir, &opts, printEnt)
+			}
+			root, err := s.GetPinOrRef(ctx, name)
+			if err != nil {
+				return err
+			}
+			err = s.Find(ctx, root, dir, &opts, printEnt)
+			if os.IsNotExist(err) {
+				return fmt.Errorf("%s: no such file or directory", args[0])
+			} else if err == cas.ErrNotDir {
+				return fmt.Errorf("%s: not a directory", args[0])
+			} else if err == cas.ErrNoTime {
+				return fmt.Errorf("%s: not a commit; times are only known for commits", args[0])
+			}
+			return err
+		}),
+	}
+	cmd.Flags().String("name", "", "only print entries with names matching a glob pattern")
+	cmd.Flags().String("type", "", "only print entries of a given type: f for files, d for directories")
+	cmd.Flags().String("larger-than", "", "only print entries larger than a given size (e.g. 1G)")
+	cmd.Flags().String("smaller-than", "", "only print entries smaller than a given size")
+	cmd.Flags().String("newer-than", "", "only search commits made after a given time (RFC 3339 or a date)")
+	cmd.Flags().String("older-than", "", "only search commits made before a given time (RFC 3339 or a date)")
+	cmd.Flags().Bool("history", false, "search all commits of the pin")
+	cmd.Flags().BoolP("long", "l", false, "print sizes and refs of entries")
+	cmd.Flags().Bool("json", false, "print entries as JSON, one per line")
+	Root.AddCommand(cmd)
+}
+
+// refOrNil returns a pointer to the ref, or nil if it's zero.
+func refOrNil(ref cas.Ref) *cas.Ref {
+	if ref.Zero() {
+		return nil
+	}
+	return &ref
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/gc"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/types"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "remove blobs that are not reachable from pins",
+		Long: `Remove blobs that are not reachable from pins.
+
+All blobs referenced by pins are kept, including the history of commits. Additional roots can be passed
+as arguments. The store should not be modified while the collection is running.`,
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			dry, _ := flags.GetBool("dry-run")
+			verbose, _ := flags.GetBool("verbose")
+			opts := &gc.Options{DryRun: dry}
+			for _, arg := range args {
+				ref, err := s.GetPinOrRef(ctx, arg)
+				if err != nil {
+					return err
+				}
+				opts.Roots = append(opts.Roots, ref)
+			}
+			if verbose {
+				opts.OnSweep = func(sr types.SizedRef) {
+					fmt.Println(sr.Ref, sr.Size)
+				}
+			}
+			rep, err := gc.Run(ctx, s, opts)
+			if err != nil {
+				return err
+			}
+			verb := "removed"
+			if rep.DryRun {
+				verb = "would remove"
+			}
+			fmt.Printf("gc: %d pins, %d blobs, %d reachable (%d missing), %s %d blobs (%d bytes) in %v\n",
+				rep.Pins, rep.Blobs, rep.Reachable, rep.Missing, verb, rep.Swept, rep.Freed, rep.Duration)
+			if !rep.DryRun && rep.Swept != 0 {
+				logEvent(ctx, s, &schema.Event{Type: schema.EventGC, Args: args})
+			}
+			return nil
+		}),
+	}
+	cmd.Flags().BoolP("dry-run", "n", false, "only report blobs that would be removed")
+	cmd.Flags().BoolP("verbose", "v", false, "print removed blobs")
+	Root.AddCommand(cmd)
+}
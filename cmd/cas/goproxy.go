@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/goproxy"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "goproxy",
+		Short: "serve Go modules from CAS (GOPROXY protocol)",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 0 {
+				return fmt.Errorf("unexpected argument")
+			}
+			host, _ := flags.GetString("host")
+			upstream, _ := flags.GetString("upstream")
+
+			p, err := goproxy.NewProxy(ctx, s, &goproxy.Options{Upstream: upstream})
+			if err != nil {
+				return err
+			}
+			log.Println("listening on", host)
+			return http.ListenAndServe(host, p)
+		}),
+	}
+	cmd.Flags().String("host", "localhost:9080", "host to listen on")
+	cmd.Flags().String("upstream", "https://proxy.golang.org", "module proxy to fetch missing modules from (empty to serve only cached modules)")
+	Root.AddCommand(cmd)
+}
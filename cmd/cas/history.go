@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+)
+
+// logEvent records an event in the store history. Failures are reported, but not returned,
+// since the operation itself has already succeeded.
+func logEvent(ctx context.Context, s *cas.Storage, e *schema.Event) {
+	if _, err := s.LogEvent(ctx, e); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to log event:", err)
+	}
+}
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "history",
+		Short: "list operations performed on the store, starting from the latest",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 0 {
+				return fmt.Errorf("expected 0 arguments")
+			}
+			limit, _ := flags.GetInt("limit")
+			verbose, _ := flags.GetBool("verbose")
+
+			it := s.IterateEvents(ctx)
+			defer it.Close()
+			for i := 0; (limit <= 0 || i < limit) && it.Next(); i++ {
+				e := it.Event()
+				line := []string{e.TS.Local().Format(time.RFC3339), e.Type}
+				line = append(line, e.Args...)
+				if e.Error != "" {
+					line = append(line, "error:", e.Error)
+				}
+				fmt.Println(strings.Join(line, " "))
+				if verbose {
+					fmt.Println("\tevent: " + it.Ref().String())
+					for _, ref := range e.Refs {
+						fmt.Println("\t" + ref.String())
+					}
+				}
+			}
+			return it.Err()
+		}),
+	}
+	cmd.Flags().IntP("limit", "n", 0, "limit the number of events")
+	cmd.Flags().BoolP("verbose", "v", false, "print refs created by each operation")
+	Root.AddCommand(cmd)
+}
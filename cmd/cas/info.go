@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage/local"
+	"github.com/dennwc/cas/types"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "info",
+		Short: "print information about the storage and the environment",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			fmt.Printf("hash:    %s %s\n", types.DefaultHash, types.HashImplementation())
+			fmt.Printf("system:  %s/%s, %d CPUs\n", runtime.GOOS, runtime.GOARCH, runtime.NumCPU())
+			fmt.Printf("storage: %T\n", s.Underlying())
+			if l, ok := s.Underlying().(*local.Storage); ok {
+				fmt.Printf("layout:  %s\n", l.Layout())
+				var restr []string
+				caps := l.Caps()
+				if caps.NoChmod {
+					restr = append(restr, "no chmod")
+				}
+				if caps.NoRename {
+					restr = append(restr, "no rename")
+				}
+				if len(restr) == 0 {
+					restr = append(restr, "no restrictions")
+				}
+				fmt.Printf("fs:      %s\n", strings.Join(restr, ", "))
+			}
+			if withStats, _ := flags.GetBool("stats"); !withStats {
+				return nil
+			}
+			st, err := s.Stats(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("blobs:   %d (%s)\n", st.Blobs, humanize.IBytes(st.Size))
+			if st.Limit != 0 {
+				free := uint64(0)
+				if st.Size < st.Limit {
+					free = st.Limit - st.Size
+				}
+				fmt.Printf("limit:   %s (%s free)\n", humanize.IBytes(st.Limit), humanize.IBytes(free))
+			}
+			typs := make([]string, 0, len(st.Schema))
+			for typ := range st.Schema {
+				typs = append(typs, typ)
+			}
+			sort.Strings(typs)
+			for _, typ := range typs {
+				fmt.Printf("         %d %s\n", st.Schema[typ], typ)
+			}
+			fmt.Printf("pins:    %d\n", st.Pins)
+			return nil
+		}),
+	}
+	cmd.Flags().Bool("stats", false, "print the number and the size of blobs and pins")
+	Root.AddCommand(cmd)
+}
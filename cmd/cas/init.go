@@ -4,17 +4,23 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"path/filepath"
 	"strings"
 
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
 	"github.com/dennwc/cas"
 	"github.com/dennwc/cas/config"
 	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/b2"
 	"github.com/dennwc/cas/storage/gcs"
+	gitstor "github.com/dennwc/cas/storage/git"
 	"github.com/dennwc/cas/storage/http"
+	"github.com/dennwc/cas/storage/ipfs"
 	"github.com/dennwc/cas/storage/local"
+	"github.com/dennwc/cas/storage/webdav"
 )
 
 const casDir = cas.DefaultDir
@@ -35,17 +41,69 @@ func init() {
 	cmd := &cobra.Command{
 		Use:   "init",
 		Short: "init content-addressable storage in current directory",
-		RunE: casInitCmd(func(ctx context.Context, _ *pflag.FlagSet, args []string) (storage.Config, error) {
-			return &local.Config{Dir: "."}, nil
+		RunE: casInitCmd(func(ctx context.Context, flags *pflag.FlagSet, args []string) (storage.Config, error) {
+			name, _ := flags.GetString("layout")
+			layout, err := local.ParseLayout(name)
+			if err != nil {
+				return nil, err
+			}
+			noXattr, _ := flags.GetBool("no-xattr")
+			noSync, _ := flags.GetBool("no-sync")
+			var imp local.ImportMode
+			if v, _ := flags.GetString("import"); v != "" {
+				imp, err = local.ParseImportMode(v)
+				if err != nil {
+					return nil, err
+				}
+			}
+			var perms local.Perms
+			for _, f := range []struct {
+				name string
+				dst  *local.Perm
+			}{
+				{"umask", &perms.Umask},
+				{"blob-perm", &perms.Blob},
+				{"file-perm", &perms.File},
+				{"dir-perm", &perms.Dir},
+			} {
+				if v, _ := flags.GetString(f.name); v != "" {
+					if *f.dst, err = local.ParsePerm(v); err != nil {
+						return nil, err
+					}
+				}
+			}
+			perms.Group, _ = flags.GetString("group")
+			perms.Shared, _ = flags.GetBool("shared")
+			conf := &local.Config{Dir: ".", Layout: layout, NoXattr: noXattr, NoSync: noSync, Import: imp}
+			if v, _ := flags.GetString("max-size"); v != "" {
+				if conf.MaxSize, err = humanize.ParseBytes(v); err != nil {
+					return nil, fmt.Errorf("invalid max size: %v", err)
+				}
+			}
+			if !perms.IsZero() {
+				conf.Perms = &perms
+			}
+			return conf, nil
 		}),
 	}
+	cmd.Flags().String("layout", string(local.LayoutFlat), "layout of the blobs directory (flat or sharded)")
+	cmd.Flags().Bool("no-xattr", false, "never use xattrs; cache metadata in a sidecar index instead")
+	cmd.Flags().Bool("no-sync", false, "don't fsync blobs on commit (faster, but not crash-safe)")
+	cmd.Flags().String("umask", "", "umask applied to default permissions of the store files (e.g. 0077 for a private store)")
+	cmd.Flags().String("blob-perm", "", "permissions of blob files (default 0444)")
+	cmd.Flags().String("file-perm", "", "permissions of pins and metadata files (default 0644)")
+	cmd.Flags().String("dir-perm", "", "permissions of store directories (default 0755)")
+	cmd.Flags().String("group", "", "group that owns the store files (name or id)")
+	cmd.Flags().Bool("shared", false, "make the store writable by the group (files 0664, directories 02775)")
+	cmd.Flags().String("max-size", "", "maximal total size of blobs (e.g. 10GiB); not limited by default")
+	cmd.Flags().String("import", "", "comma-separated methods of importing files: clone, hardlink, copy (default: clone,copy)")
 	Root.AddCommand(cmd)
 
 	initHTTPCmd := &cobra.Command{
 		Use:     "http",
 		Aliases: []string{"remote", "client"},
 		Short:   "init a client to a remote content-addressable storage",
-		RunE: casInitCmd(func(ctx context.Context, _ *pflag.FlagSet, args []string) (storage.Config, error) {
+		RunE: casInitCmd(func(ctx context.Context, flags *pflag.FlagSet, args []string) (storage.Config, error) {
 			if len(args) != 1 {
 				return nil, fmt.Errorf("expected a URL of the server")
 			}
@@ -54,22 +112,155 @@ func init() {
 			if err != nil {
 				return nil, err
 			}
-			return &httpstor.Config{URL: addr}, nil
+			conf := &httpstor.Config{URL: addr}
+			conf.ConnConfig, err = connConfigFromFlags(flags)
+			return conf, err
 		}),
 	}
+	registerConnFlags(initHTTPCmd.Flags())
 	cmd.AddCommand(initHTTPCmd)
 
 	initGCSCmd := &cobra.Command{
 		Use:     "gcs",
 		Aliases: []string{"google", "gs"},
 		Short:   "init a client to CAS on Google Cloud Storage",
-		RunE: casInitCmd(func(ctx context.Context, _ *pflag.FlagSet, args []string) (storage.Config, error) {
+		RunE: casInitCmd(func(ctx context.Context, flags *pflag.FlagSet, args []string) (storage.Config, error) {
 			if len(args) != 1 {
 				return nil, fmt.Errorf("expected a GCS bucket")
 			}
 			bucket := strings.TrimPrefix(args[0], "gs://")
-			return &gcs.Config{Bucket: bucket}, nil
+			key, _ := flags.GetString("signer-key")
+			return &gcs.Config{Bucket: bucket, SignerKeyFile: key}, nil
 		}),
 	}
+	initGCSCmd.Flags().String("signer-key", "", "service account key used to sign blob URLs for redirects")
 	cmd.AddCommand(initGCSCmd)
+
+	initB2Cmd := &cobra.Command{
+		Use:   "b2",
+		Short: "init a client to CAS on Backblaze B2",
+		Long: `init a client to CAS on Backblaze B2
+
+If the key is not set, B2_APPLICATION_KEY_ID and B2_APPLICATION_KEY environment variables
+will be used when the storage is opened. Use --key-ref to keep the key outside of the config.`,
+		RunE: casInitCmd(func(ctx context.Context, flags *pflag.FlagSet, args []string) (storage.Config, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("expected a B2 bucket")
+			}
+			conf := &b2.Config{Bucket: strings.TrimPrefix(args[0], "b2://")}
+			conf.KeyID, _ = flags.GetString("key-id")
+			conf.PartSize, _ = flags.GetInt64("part-size")
+			var err error
+			if conf.Key, err = secretFromFlags(flags, "key"); err != nil {
+				return nil, err
+			}
+			conf.ConnConfig, err = connConfigFromFlags(flags)
+			return conf, err
+		}),
+	}
+	registerConnFlags(initB2Cmd.Flags())
+	initB2Cmd.Flags().String("key-id", "", "application key ID")
+	initB2Cmd.Flags().String("key", "", "application key (stored in the config)")
+	initB2Cmd.Flags().String("key-ref", "", "reference to the application key: env:NAME, file:PATH or keychain:SERVICE[/USER]")
+	initB2Cmd.Flags().Int64("part-size", 0, "part size for large blob uploads (default is recommended by B2)")
+	cmd.AddCommand(initB2Cmd)
+
+	initIPFSCmd := &cobra.Command{
+		Use:   "ipfs [api]",
+		Short: "init a client to CAS on top of IPFS node",
+		RunE: casInitCmd(func(ctx context.Context, flags *pflag.FlagSet, args []string) (storage.Config, error) {
+			if len(args) > 1 {
+				return nil, fmt.Errorf("expected an address of IPFS API")
+			}
+			conf := &ipfs.Config{}
+			if len(args) == 1 {
+				conf.API = args[0]
+			}
+			conf.Offline, _ = flags.GetBool("offline")
+			var err error
+			conf.ConnConfig, err = connConfigFromFlags(flags)
+			return conf, err
+		}),
+	}
+	registerConnFlags(initIPFSCmd.Flags())
+	initIPFSCmd.Flags().Bool("offline", false, "do not fetch blocks from IPFS network")
+	cmd.AddCommand(initIPFSCmd)
+
+	initGitCmd := &cobra.Command{
+		Use:   "git <repo>",
+		Short: "init a read-only CAS view of an existing git repository",
+		RunE: casInitCmd(func(ctx context.Context, flags *pflag.FlagSet, args []string) (storage.Config, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("expected a path to git repository")
+			}
+			dir, err := filepath.Abs(args[0])
+			if err != nil {
+				return nil, err
+			}
+			return &gitstor.Config{Dir: dir}, nil
+		}),
+	}
+	cmd.AddCommand(initGitCmd)
+
+	initWebDAVCmd := &cobra.Command{
+		Use:     "webdav <url>",
+		Aliases: []string{"dav"},
+		Short:   "init a client to CAS on a WebDAV server",
+		Long: `init a client to CAS on a WebDAV server
+
+If the user is not set, WEBDAV_USER and WEBDAV_PASSWORD environment variables
+will be used when the storage is opened. Use --password-ref to keep the password outside of the config.`,
+		RunE: casInitCmd(func(ctx context.Context, flags *pflag.FlagSet, args []string) (storage.Config, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("expected a URL of WebDAV collection")
+			}
+			if _, err := url.Parse(args[0]); err != nil {
+				return nil, err
+			}
+			conf := &webdav.Config{URL: args[0]}
+			conf.User, _ = flags.GetString("user")
+			var err error
+			if conf.Password, err = secretFromFlags(flags, "password"); err != nil {
+				return nil, err
+			}
+			conf.ConnConfig, err = connConfigFromFlags(flags)
+			return conf, err
+		}),
+	}
+	registerConnFlags(initWebDAVCmd.Flags())
+	initWebDAVCmd.Flags().String("user", "", "user name")
+	initWebDAVCmd.Flags().String("password", "", "password (stored in the config)")
+	initWebDAVCmd.Flags().String("password-ref", "", "reference to the password: env:NAME, file:PATH or keychain:SERVICE[/USER]")
+	cmd.AddCommand(initWebDAVCmd)
+}
+
+func registerConnFlags(flags *pflag.FlagSet) {
+	flags.Duration("dial-timeout", 0, "timeout for establishing connections")
+	flags.Duration("response-timeout", 0, "timeout for waiting for responses")
+	flags.Int("retries", 0, "number of retries of idempotent requests on network errors")
+}
+
+func connConfigFromFlags(flags *pflag.FlagSet) (storage.ConnConfig, error) {
+	var conf storage.ConnConfig
+	dial, _ := flags.GetDuration("dial-timeout")
+	resp, _ := flags.GetDuration("response-timeout")
+	conf.DialTimeout = storage.Duration(dial)
+	conf.ResponseTimeout = storage.Duration(resp)
+	conf.Retries, _ = flags.GetInt("retries")
+	if conf.DialTimeout < 0 || conf.ResponseTimeout < 0 || conf.Retries < 0 {
+		return storage.ConnConfig{}, fmt.Errorf("timeouts and retries must not be negative")
+	}
+	return conf, nil
+}
+
+// secretFromFlags returns a secret set either as a plain value by the flag, or as a reference by the "-ref" flag.
+func secretFromFlags(flags *pflag.FlagSet, name string) (*storage.Secret, error) {
+	v, _ := flags.GetString(name)
+	ref, _ := flags.GetString(name + "-ref")
+	if v != "" && ref != "" {
+		return nil, fmt.Errorf("only one of --%s and --%s-ref can be set", name, name)
+	} else if ref != "" {
+		return storage.SecretRef(ref), nil
+	}
+	return storage.PlainSecret(v), nil
 }
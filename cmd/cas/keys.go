@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	Root.PersistentFlags().String("sign-key", "", "sign pins with a private key from the file (see cas keygen)")
+	Root.PersistentFlags().StringSlice("trusted-key", nil, "only accept pins signed by the public key (hex or a file; can be repeated)")
+
+	cmd := &cobra.Command{
+		Use:   "keygen <name>",
+		Short: "generate a key pair for signing pins (<name>.key and <name>.pub)",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected a name of the key")
+			}
+			pub, priv, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				return err
+			}
+			name := args[0]
+			if err = ioutil.WriteFile(name+".key", []byte(hex.EncodeToString(priv.Seed())+"\n"), 0600); err != nil {
+				return err
+			}
+			if err = ioutil.WriteFile(name+".pub", []byte(hex.EncodeToString(pub)+"\n"), 0644); err != nil {
+				return err
+			}
+			fmt.Println(hex.EncodeToString(pub))
+			return nil
+		},
+	}
+	Root.AddCommand(cmd)
+}
+
+// keysFromFlags reads keys for signing and verifying pins.
+func keysFromFlags(flags *pflag.FlagSet) (ed25519.PrivateKey, []ed25519.PublicKey, error) {
+	var priv ed25519.PrivateKey
+	if path, _ := flags.GetString("sign-key"); path != "" {
+		seed, err := readHexKey(path, ed25519.SeedSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read signing key: %v", err)
+		}
+		priv = ed25519.NewKeyFromSeed(seed)
+	}
+	var trusted []ed25519.PublicKey
+	keys, _ := flags.GetStringSlice("trusted-key")
+	for _, k := range keys {
+		pub, err := hex.DecodeString(k)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			pub, err = readHexKey(k, ed25519.PublicKeySize)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot read trusted key: %v", err)
+			}
+		}
+		trusted = append(trusted, pub)
+	}
+	return priv, trusted, nil
+}
+
+// readHexKey reads a hex-encoded key of a given size from the file.
+func readHexKey(path string, size int) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	} else if len(key) != size {
+		return nil, fmt.Errorf("%s: expected a key of %d bytes, got %d", path, size, len(key))
+	}
+	return key, nil
+}
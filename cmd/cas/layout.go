@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/config"
+	"github.com/dennwc/cas/storage/local"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "layout [flat|sharded]",
+		Short: "print or change the layout of the local storage",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, _ *pflag.FlagSet, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("expected 0 or 1 argument")
+			}
+			l, ok := s.Underlying().(*local.Storage)
+			if !ok {
+				return fmt.Errorf("layout can only be changed for a local storage")
+			}
+			if len(args) == 0 {
+				fmt.Println(l.Layout())
+				return nil
+			}
+			layout, err := local.ParseLayout(args[0])
+			if err != nil {
+				return err
+			}
+			if err = l.Migrate(ctx, layout); err != nil {
+				return err
+			}
+			// the config must follow, otherwise the storage cannot be opened
+			if err = updateLayoutConfig(layout); err != nil {
+				return err
+			}
+			fmt.Println(l.Layout())
+			return nil
+		}),
+	}
+	Root.AddCommand(cmd)
+}
+
+// updateLayoutConfig records the layout in the config of the local storage, if the config specifies it.
+// The config is looked up the same way as when the storage is opened: in the current directory first,
+// and in the home directory if the current one has no CAS.
+func updateLayoutConfig(layout local.Layout) error {
+	dir := casDir
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		u, err := user.Current()
+		if err != nil {
+			return err
+		}
+		dir = filepath.Join(u.HomeDir, casDir)
+	}
+	path := filepath.Join(dir, config.DefaultConfig)
+	conf, err := config.ReadConfig(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	c, ok := conf.Storage.(*local.Config)
+	if !ok || c.Layout == "" || c.Layout == layout {
+		return nil
+	}
+	c.Layout = layout
+	return config.WriteConfig(path, conf)
+}
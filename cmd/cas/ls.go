@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+)
+
+// lsEntry is an entry printed by cas ls.
+type lsEntry struct {
+	Path  string       `json:"path"`
+	Ref   cas.Ref      `json:"ref"`
+	Size  uint64       `json:"size"`
+	Dir   bool         `json:"dir,omitempty"`
+	Link  string       `json:"link,omitempty"` // target of a symbolic link
+	Stats schema.Stats `json:"stats,omitempty"`
+}
+
+// shortRef abbreviates the ref for printing.
+func shortRef(ref cas.Ref) string {
+	const n = 12
+	s := ref.String()
+	if i := strings.IndexByte(s, ':'); i >= 0 && len(s) > i+1+n {
+		return s[:i+1+n]
+	}
+	return s
+}
+
+// walkDir calls fnc for each entry of the directory, descending into subdirectories if recursive is set.
+func walkDir(ctx context.Context, s *cas.Storage, ents []*schema.DirEntry, dir string, recursive bool, fnc func(e *lsEntry) error) error {
+	for _, ent := range ents {
+		e := &lsEntry{Path: path.Join(dir, ent.Name), Ref: ent.Ref, Size: ent.Size(), Link: ent.Link, Stats: ent.Stats}
+		sub, err := s.ReadDir(ctx, ent.Ref)
+		if err == nil {
+			e.Dir = true
+		} else if err != cas.ErrNotDir {
+			return err
+		}
+		if err = fnc(e); err != nil {
+			return err
+		}
+		if e.Dir && recursive {
+			if err = walkDir(ctx, s, sub, e.Path, recursive, fnc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// lsPrinter returns a function that prints entries in the format selected by the flags.
+func lsPrinter(w io.Writer, long, asJSON bool) func(e *lsEntry) error {
+	enc := json.NewEncoder(w)
+	return func(e *lsEntry) error {
+		switch {
+		case asJSON:
+			return enc.Encode(e)
+		case long:
+			typ, name := "-", e.Path
+			if e.Dir {
+				typ, name = "d", name+"/"
+			} else if e.Link != "" {
+				typ, name = "l", name+" -> "+e.Link
+			}
+			var stats []string
+			for k, v := range e.Stats {
+				if k != schema.StatDataSize {
+					stats = append(stats, fmt.Sprintf("%s=%d", k, v))
+				}
+			}
+			sort.Strings(stats)
+			line := fmt.Sprintf("%s %12d %s %s", typ, e.Size, shortRef(e.Ref), name)
+			if len(stats) != 0 {
+				line += "\t" + strings.Join(stats, " ")
+			}
+			_, err := fmt.Fprintln(w, line)
+			return err
+		case e.Dir:
+			_, err := fmt.Fprintln(w, e.Path+"/")
+			return err
+		default:
+			_, err := fmt.Fprintln(w, e.Path)
+			return err
+		}
+	}
+}
+
+// listPath resolves the argument in the form of "<pin|ref>[/path]" and calls fnc for each entry of the directory.
+// If the path points to a file, fnc is called once for the file itself, as ls does.
+func listPath(ctx context.Context, s *cas.Storage, arg string, recursive bool, fnc func(e *lsEntry) error) error {
+	root, p, err := splitPinPath(ctx, s, arg)
+	if err != nil {
+		return err
+	}
+	ref := root
+	ent, err := s.Lookup(ctx, root, p)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: no such file or directory", arg)
+	} else if err != nil {
+		return err
+	} else if ent != nil {
+		ref = ent.Ref
+	}
+	ents, err := s.ReadDir(ctx, ref)
+	if err == cas.ErrNotDir {
+		e := &lsEntry{Path: arg, Ref: ref}
+		if ent != nil {
+			e.Path, e.Size, e.Link, e.Stats = ent.Name, ent.Size(), ent.Link, ent.Stats
+		}
+		return fnc(e)
+	} else if err != nil {
+		return err
+	}
+	return walkDir(ctx, s, ents, "", recursive, fnc)
+}
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "ls <pin|ref>[/path]",
+		Short: "list entries of a stored directory",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected a pin or a ref and an optional path")
+			}
+			long, _ := flags.GetBool("long")
+			recursive, _ := flags.GetBool("recursive")
+			asJSON, _ := flags.GetBool("json")
+			return listPath(ctx, s, args[0], recursive, lsPrinter(os.Stdout, long, asJSON))
+		}),
+	}
+	cmd.Flags().BoolP("long", "l", false, "print sizes, refs and stats of entries")
+	cmd.Flags().BoolP("recursive", "R", false, "list subdirectories recursively")
+	cmd.Flags().Bool("json", false, "print entries as JSON, one per line")
+	Root.AddCommand(cmd)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLs(t *testing.T) {
+	ctx := context.Background()
+	s, root := newTestTree(t)
+	defer s.Close()
+
+	ls := func(arg string, recursive bool) ([]*lsEntry, error) {
+		var out []*lsEntry
+		err := listPath(ctx, s, arg, recursive, func(e *lsEntry) error {
+			out = append(out, e)
+			return nil
+		})
+		return out, err
+	}
+	paths := func(ents []*lsEntry) []string {
+		var out []string
+		for _, e := range ents {
+			p := e.Path
+			if e.Dir {
+				p += "/"
+			}
+			out = append(out, p)
+		}
+		return out
+	}
+
+	for _, arg := range []string{"tree", "tree/", root.String()} {
+		ents, err := ls(arg, false)
+		require.NoError(t, err, arg)
+		require.Equal(t, []string{"a/", "a.txt"}, paths(ents), arg)
+		require.Equal(t, uint64(2), ents[1].Size)
+	}
+	ents, err := ls("tree", true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/", "a/b/", "a/b/c.txt", "a.txt"}, paths(ents))
+
+	ents, err = ls("tree/a", true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"b/", "b/c.txt"}, paths(ents))
+
+	// files are listed as a single entry
+	ents, err = ls("tree/a/b/c.txt", true)
+	require.NoError(t, err)
+	require.Equal(t, []string{"c.txt"}, paths(ents))
+	require.Equal(t, uint64(1), ents[0].Size)
+
+	ref := ents[0].Ref.String()
+	ents, err = ls(ref, false)
+	require.NoError(t, err)
+	require.Equal(t, []string{ref}, paths(ents))
+
+	// missing paths and paths through files
+	for _, arg := range []string{"tree/missing", "tree/a/missing", "tree/a.txt/b", ref + "/a"} {
+		_, err = ls(arg, false)
+		require.EqualError(t, err, arg+": no such file or directory")
+	}
+	_, err = ls("missing", false)
+	require.Error(t, err)
+
+	// output formats
+	format := func(long, asJSON bool) string {
+		buf := new(bytes.Buffer)
+		require.NoError(t, listPath(ctx, s, "tree", true, lsPrinter(buf, long, asJSON)))
+		return buf.String()
+	}
+	require.Equal(t, "a/\na/b/\na/b/c.txt\na.txt\n", format(false, false))
+
+	lines := strings.Split(strings.TrimSuffix(format(true, false), "\n"), "\n")
+	require.Len(t, lines, 4)
+	require.True(t, strings.HasPrefix(lines[0], "d "), lines[0])
+	require.True(t, strings.HasPrefix(lines[3], "-            2 "), lines[3])
+	require.True(t, strings.HasSuffix(lines[3], " a.txt"), lines[3])
+
+	dec := json.NewDecoder(strings.NewReader(format(false, true)))
+	var e lsEntry
+	require.NoError(t, dec.Decode(&e))
+	require.Equal(t, "a", e.Path)
+	require.True(t, e.Dir)
+}
@@ -8,6 +8,7 @@ import (
 	"os/user"
 	"path/filepath"
 
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
@@ -24,6 +25,11 @@ var (
 
 var cmdCtx = context.Background()
 
+func init() {
+	Root.PersistentFlags().Bool("readonly", false, "open local storage in read-only mode")
+	Root.PersistentFlags().String("cache-size", "32MiB", "size of the in-memory cache of small blobs (0 to disable)")
+}
+
 func main() {
 	if err := Root.Execute(); err != nil {
 		log.Fatal(err)
@@ -35,8 +41,19 @@ type casRunE func(ctx context.Context, st *cas.Storage, flags *pflag.FlagSet, ar
 
 func casOpenCmd(fnc casRunE) cobraRunE {
 	return func(cmd *cobra.Command, args []string) error {
-		st, err := cas.Open(cas.OpenOptions{
-			Dir: casDir,
+		ro, _ := cmd.Flags().GetBool("readonly")
+		v, _ := cmd.Flags().GetString("cache-size")
+		cacheSize, err := humanize.ParseBytes(v)
+		if err != nil {
+			return fmt.Errorf("invalid cache size: %v", err)
+		}
+		signKey, trusted, err := keysFromFlags(cmd.Flags())
+		if err != nil {
+			return err
+		}
+		st, err := cas.OpenContext(cmdCtx, cas.OpenOptions{
+			Dir: casDir, ReadOnly: ro, CacheSize: cacheSize,
+			SigningKey: signKey, TrustedKeys: trusted,
 		})
 		if os.IsNotExist(err) {
 			oerr := err
@@ -46,8 +63,9 @@ func casOpenCmd(fnc casRunE) cobraRunE {
 				return err
 			}
 			dir := filepath.Join(u.HomeDir, casDir)
-			st, err = cas.Open(cas.OpenOptions{
-				Dir: dir,
+			st, err = cas.OpenContext(cmdCtx, cas.OpenOptions{
+				Dir: dir, ReadOnly: ro, CacheSize: cacheSize,
+				SigningKey: signKey, TrustedKeys: trusted,
 			})
 			if err != nil {
 				return oerr // return original error
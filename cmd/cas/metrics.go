@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "metrics",
+		Short: "commands related to store metrics",
+	}
+	Root.AddCommand(cmd)
+
+	dumpCmd := &cobra.Command{
+		Use:   "dump",
+		Short: "print store statistics in OpenMetrics text format",
+		RunE: casOpenCmd(func(ctx context.Context, st *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			stats, err := st.Stats(ctx)
+			if err != nil {
+				return err
+			}
+			out, _ := flags.GetString("output")
+			if out == "" {
+				return stats.WriteOpenMetrics(os.Stdout)
+			}
+			// collectors may read the file at any time, so replace it atomically
+			f, err := ioutil.TempFile(filepath.Dir(out), ".metrics_")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(f.Name())
+			err = stats.WriteOpenMetrics(f)
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+			if err != nil {
+				return err
+			}
+			if err = os.Chmod(f.Name(), 0644); err != nil {
+				return err
+			}
+			return os.Rename(f.Name(), out)
+		}),
+	}
+	dumpCmd.Flags().StringP("output", "o", "", "write metrics to a file (replaced atomically)")
+	cmd.AddCommand(dumpCmd)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/nix"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "nix",
+		Short: "commands related to Nix binary caches",
+	}
+	Root.AddCommand(cmd)
+
+	serveCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "serve CAS as a Nix binary cache (substituter)",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 0 {
+				return fmt.Errorf("unexpected argument")
+			}
+			host, _ := flags.GetString("host")
+			opts := &nix.Options{}
+			opts.StoreDir, _ = flags.GetString("store-dir")
+			opts.Priority, _ = flags.GetInt("priority")
+			opts.Writable, _ = flags.GetBool("writable")
+			c, err := nix.NewCache(ctx, s, opts)
+			if err != nil {
+				return err
+			}
+			log.Println("listening on", host)
+			return http.ListenAndServe(host, c)
+		}),
+	}
+	serveCmd.Flags().String("host", "localhost:5050", "host to listen on")
+	serveCmd.Flags().String("store-dir", nix.DefaultStoreDir, "location of the Nix store")
+	serveCmd.Flags().Int("priority", 0, "priority of the cache (lower values are preferred by Nix)")
+	serveCmd.Flags().Bool("writable", false, "allow uploads (nix copy --to)")
+	cmd.AddCommand(serveCmd)
+
+	packCmd := &cobra.Command{
+		Use:   "pack <ref|pin>",
+		Short: "write a file or directory as NAR",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected a ref or a pin")
+			}
+			ref, err := s.GetPinOrRef(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			out, _ := flags.GetString("out")
+			if out == "" {
+				return nix.Pack(ctx, s, ref, os.Stdout)
+			}
+			f, err := os.Create(out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if err = nix.Pack(ctx, s, ref, f); err != nil {
+				return err
+			}
+			return f.Close()
+		}),
+	}
+	packCmd.Flags().StringP("out", "o", "", "output file")
+	cmd.AddCommand(packCmd)
+
+	unpackCmd := &cobra.Command{
+		Use:   "unpack <file.nar>",
+		Short: "store the content of NAR (use - for stdin)",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected a file name")
+			}
+			var r io.Reader = os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			sr, err := nix.Unpack(ctx, s, r)
+			if err != nil {
+				return err
+			}
+			fmt.Println(sr.Ref)
+			return nil
+		}),
+	}
+	cmd.AddCommand(unpackCmd)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+)
+
+func init() {
+	packCmd := &cobra.Command{
+		Use:   "pack <pin|ref>",
+		Short: "write a tree pack with all blobs referenced by a pin",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected a pin or a ref")
+			}
+			ref, err := s.GetPinOrRef(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			var w io.Writer = os.Stdout
+			if out, _ := flags.GetString("out"); out != "" && out != "-" {
+				f, err := os.Create(out)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				if err = s.WritePack(ctx, f, ref); err != nil {
+					return err
+				}
+				return f.Close()
+			}
+			return s.WritePack(ctx, w, ref)
+		}),
+	}
+	packCmd.Flags().StringP("out", "o", "", "output file (default is stdout)")
+	Root.AddCommand(packCmd)
+
+	unpackCmd := &cobra.Command{
+		Use:   "unpack [file]",
+		Short: "store all blobs from a tree pack",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("expected at most one file")
+			}
+			var r io.Reader = os.Stdin
+			if len(args) == 1 && args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			sr, err := s.ReadPack(ctx, r)
+			if err != nil {
+				return err
+			}
+			if pin, _ := flags.GetString("pin"); pin != "" {
+				if err = s.SetPin(ctx, pin, sr.Ref); err != nil {
+					return err
+				}
+				fmt.Println(pin, "=", sr.Ref)
+				return nil
+			}
+			fmt.Println(sr.Ref)
+			return nil
+		}),
+	}
+	unpackCmd.Flags().String("pin", "", "set a pin to the root of the pack")
+	Root.AddCommand(unpackCmd)
+}
@@ -2,20 +2,28 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
 	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage"
 	"github.com/dennwc/cas/types"
 )
 
 func init() {
 	cmd := &cobra.Command{
-		Use:   "pin [name] ref",
-		Short: "set a named pin pointing to a ref",
-		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, _ *pflag.FlagSet, args []string) error {
+		Use:     "pin [name] ref",
+		Aliases: []string{"pins"},
+		Short:   "set a named pin pointing to a ref",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
 			if len(args) == 0 || len(args) > 2 {
 				return fmt.Errorf("expected 1 or 2 arguments")
 			}
@@ -30,15 +38,57 @@ func init() {
 				return err
 			}
 
+			meta, err := pinMetaFlags(flags)
+			if err != nil {
+				return err
+			}
 			if err := s.SetPin(ctx, name, ref); err != nil {
 				return err
 			}
+			if meta != nil {
+				if err := s.SetPinMeta(ctx, name, meta); err != nil {
+					return err
+				}
+			}
 			fmt.Println(name, "=", ref)
 			return nil
 		}),
 	}
+	cmd.Flags().String("author", "", "author of the snapshot")
+	cmd.Flags().StringP("message", "m", "", "description of the snapshot")
+	cmd.Flags().StringSliceP("label", "l", nil, "labels of the snapshot (key=value)")
+	cmd.Flags().Duration("ttl", 0, "expire the pin after this time; expired pins are ignored and collected by gc")
 	Root.AddCommand(cmd)
 
+	infoCmd := &cobra.Command{
+		Use:   "info [name]",
+		Short: "print the pinned reference and the metadata of the pin",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, _ *pflag.FlagSet, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("expected 0 or 1 arguments")
+			}
+			name := cas.DefaultPin
+			if len(args) != 0 {
+				name = args[0]
+			}
+
+			ref, err := s.GetPin(ctx, name)
+			if err != nil {
+				return err
+			}
+			meta, err := s.GetPinMeta(ctx, name)
+			if err == storage.ErrNotSupported {
+				meta = nil
+			} else if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "\t")
+			return enc.Encode(types.Pin{Name: name, Ref: ref, Meta: meta})
+		}),
+	}
+	cmd.AddCommand(infoCmd)
+
 	listCmd := &cobra.Command{
 		Use:     "list",
 		Aliases: []string{"l", "ls"},
@@ -97,4 +147,142 @@ func init() {
 		}),
 	}
 	cmd.AddCommand(delCmd)
+
+	historyCmd := &cobra.Command{
+		Use:   "history [name]",
+		Short: "list previous values of the pin, starting from the current one",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, _ *pflag.FlagSet, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("expected 0 or 1 arguments")
+			}
+			name := cas.DefaultPin
+			if len(args) != 0 {
+				name = args[0]
+			}
+
+			hist, err := s.PinHistory(ctx, name)
+			if err != nil {
+				return err
+			}
+			for i := len(hist) - 1; i >= 0; i-- {
+				r := hist[i]
+				ref := "deleted"
+				if !r.Ref.Zero() {
+					ref = r.Ref.String()
+				}
+				fmt.Printf("%d\t%s\t%s\n", len(hist)-1-i, r.Time.Format(time.RFC3339), ref)
+			}
+			return nil
+		}),
+	}
+	cmd.AddCommand(historyCmd)
+
+	rollbackCmd := &cobra.Command{
+		Use:   "rollback [name] [n]",
+		Short: "restore the value the pin had n changes ago (1 by default)",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, _ *pflag.FlagSet, args []string) error {
+			if len(args) > 2 {
+				return fmt.Errorf("expected 0 to 2 arguments")
+			}
+			name, n := cas.DefaultPin, 1
+			if len(args) != 0 {
+				name = args[0]
+			}
+			if len(args) == 2 {
+				var err error
+				if n, err = strconv.Atoi(args[1]); err != nil {
+					return err
+				}
+			}
+
+			ref, err := s.RollbackPin(ctx, name, n)
+			if err != nil {
+				return err
+			} else if ref.Zero() {
+				fmt.Println(name, "deleted")
+				return nil
+			}
+			fmt.Println(name, "=", ref)
+			return nil
+		}),
+	}
+	cmd.AddCommand(rollbackCmd)
+
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "export all pins to stdout in JSON format",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, _ *pflag.FlagSet, args []string) error {
+			if len(args) != 0 {
+				return fmt.Errorf("expected 0 arguments")
+			}
+			return s.ExportPins(ctx, os.Stdout)
+		}),
+	}
+	cmd.AddCommand(exportCmd)
+
+	importCmd := &cobra.Command{
+		Use:   "import [file]",
+		Short: "import pins from a file or stdin, merging them with existing pins",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("expected 0 or 1 arguments")
+			}
+			var r io.Reader = os.Stdin
+			if len(args) == 1 && args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			opt := &cas.ImportPinsOptions{}
+			opt.Overwrite, _ = flags.GetBool("overwrite")
+			opt.DryRun, _ = flags.GetBool("dry-run")
+			res, err := s.ImportPins(ctx, r, opt)
+			if res != nil {
+				for _, name := range res.Added {
+					fmt.Println("added:", name)
+				}
+				for _, name := range res.Updated {
+					fmt.Println("updated:", name)
+				}
+				for _, name := range res.Conflicts {
+					fmt.Println("conflict:", name)
+				}
+				fmt.Printf("%d added, %d updated, %d unchanged, %d conflicts\n",
+					len(res.Added), len(res.Updated), len(res.Unchanged), len(res.Conflicts))
+			}
+			return err
+		}),
+	}
+	importCmd.Flags().Bool("overwrite", false, "overwrite existing pins that point to a different ref")
+	importCmd.Flags().BoolP("dry-run", "n", false, "only print changes")
+	cmd.AddCommand(importCmd)
+}
+
+// pinMetaFlags returns the metadata of a pin set by the flags, or nil if none of them is set.
+func pinMetaFlags(flags *pflag.FlagSet) (*types.PinMeta, error) {
+	if !flags.Changed("author") && !flags.Changed("message") && !flags.Changed("label") && !flags.Changed("ttl") {
+		return nil, nil
+	}
+	meta := &types.PinMeta{}
+	if ttl, _ := flags.GetDuration("ttl"); ttl > 0 {
+		exp := time.Now().Add(ttl).UTC()
+		meta.Expires = &exp
+	}
+	meta.Author, _ = flags.GetString("author")
+	meta.Description, _ = flags.GetString("message")
+	labels, _ := flags.GetStringSlice("label")
+	for _, l := range labels {
+		i := strings.IndexByte(l, '=')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid label: %q", l)
+		}
+		if meta.Labels == nil {
+			meta.Labels = make(map[string]string)
+		}
+		meta.Labels[l[:i]] = l[i+1:]
+	}
+	return meta, nil
 }
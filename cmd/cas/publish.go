@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/publish"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "publish <ref|pin> <target>",
+		Short: "sync a directory to a website hosting (s3://bucket/prefix, http(s)://url, [user@]host:path or a local path)",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("expected a ref and a target")
+			}
+			ref, err := s.GetPinOrRef(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			t, err := publishTarget(flags, args[1])
+			if err != nil {
+				return err
+			}
+			opts := &publish.Options{}
+			opts.Pin, _ = flags.GetString("state")
+			opts.DryRun, _ = flags.GetBool("dry-run")
+			res, err := publish.Publish(ctx, s, ref, t, opts)
+			if err != nil {
+				return err
+			}
+			for _, name := range res.Uploaded {
+				fmt.Println("+", name)
+			}
+			for _, name := range res.Deleted {
+				fmt.Println("-", name)
+			}
+			fmt.Printf("uploaded: %d (%d bytes), deleted: %d\n", len(res.Uploaded), res.Size, len(res.Deleted))
+			return nil
+		}),
+	}
+	cmd.Flags().String("state", "", "pin that records the last published tree; only changes are transferred if set")
+	cmd.Flags().Bool("dry-run", false, "only print the changes")
+	cmd.Flags().String("s3-endpoint", "", "S3 endpoint URL (AWS is used by default)")
+	cmd.Flags().String("s3-region", "us-east-1", "S3 region")
+	cmd.Flags().String("token", "", "bearer token for HTTP targets")
+	Root.AddCommand(cmd)
+}
+
+func publishTarget(flags *pflag.FlagSet, target string) (publish.Target, error) {
+	if i := strings.Index(target, "://"); i > 0 {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		switch u.Scheme {
+		case "s3":
+			t := &publish.S3Target{
+				Bucket:       u.Host,
+				Prefix:       strings.TrimPrefix(u.Path, "/"),
+				AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			}
+			if t.Prefix != "" && !strings.HasSuffix(t.Prefix, "/") {
+				t.Prefix += "/"
+			}
+			t.Endpoint, _ = flags.GetString("s3-endpoint")
+			t.Region, _ = flags.GetString("s3-region")
+			return t, nil
+		case "http", "https":
+			t := &publish.HTTPTarget{URL: target}
+			if token, _ := flags.GetString("token"); token != "" {
+				t.Header = http.Header{"Authorization": {"Bearer " + token}}
+			}
+			return t, nil
+		case "file":
+			return publish.DirTarget{Path: u.Path}, nil
+		}
+		return nil, fmt.Errorf("unsupported target: %q", u.Scheme)
+	}
+	if i := strings.Index(target, ":"); i > 0 && !strings.ContainsAny(target[:i], `/\`) {
+		// same syntax as scp and rsync
+		return &publish.RsyncTarget{Dest: target}, nil
+	}
+	return publish.DirTarget{Path: target}, nil
+}
@@ -14,7 +14,19 @@ func init() {
 	cmd := &cobra.Command{
 		Use:   "pull",
 		Short: "store the URL or file in the content-addressable storage under a named pin",
+		Long: `store the URL or file in the content-addressable storage under a named pin
+
+If --from is set, arguments are pins (or refs) in a remote storage. Pins are copied together with
+all referenced blobs. If the local storage is empty, each tree is transferred as a single tree pack.`,
 		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if from, _ := flags.GetString("from"); from != "" {
+				remote, err := openRemote(from)
+				if err != nil {
+					return err
+				}
+				defer remote.Close()
+				return copyPins(ctx, s, remote, args)
+			}
 			if len(args) == 0 || len(args) > 2 {
 				return fmt.Errorf("expected 1 or 2 arguments")
 			}
@@ -25,7 +37,10 @@ func init() {
 				addr = args[1]
 			}
 
-			conf := storeConfigFromFlags(flags)
+			conf, err := storeConfigFromFlags(flags)
+			if err != nil {
+				return err
+			}
 
 			sr, err := s.StoreAddr(ctx, addr, conf)
 			if err != nil {
@@ -39,5 +54,6 @@ func init() {
 		}),
 	}
 	registerStoreConfFlags(cmd.Flags())
+	cmd.Flags().String("from", "", "pull pins from a remote storage (URL of CAS HTTP server or a path to CAS directory)")
 	Root.AddCommand(cmd)
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage/http"
+	"github.com/dennwc/cas/types"
+)
+
+// openRemote opens a remote CAS. The address is either a URL of a CAS HTTP server,
+// or a path to a CAS directory.
+func openRemote(addr string) (*cas.Storage, error) {
+	if u, err := url.Parse(addr); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		return cas.New(httpstor.NewClient(addr))
+	}
+	return cas.Open(cas.OpenOptions{Dir: addr})
+}
+
+// copyPins copies trees of pins (or refs) from one storage to another and sets the same pins in the destination.
+func copyPins(ctx context.Context, dst, src *cas.Storage, args []string) error {
+	if len(args) == 0 {
+		args = []string{cas.DefaultPin}
+	}
+	var last error
+	for _, arg := range args {
+		ref, err := src.GetPinOrRef(ctx, arg)
+		if err == nil {
+			err = src.Push(ctx, dst, ref)
+		}
+		if err == nil && !types.IsRef(arg) {
+			err = dst.SetPin(ctx, arg, ref)
+		}
+		if err != nil {
+			last = err
+			fmt.Println(arg, err)
+			continue
+		}
+		fmt.Println(arg, "=", ref)
+	}
+	return last
+}
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "push <remote> [pins...]",
+		Short: "copy pins with all referenced blobs to a remote storage",
+		Long: `copy pins with all referenced blobs to a remote storage
+
+Remote is either a URL of CAS HTTP server or a path to a CAS directory.
+If the remote storage is empty, each tree is transferred as a single tree pack.`,
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) == 0 {
+				return fmt.Errorf("expected a remote address")
+			}
+			remote, err := openRemote(args[0])
+			if err != nil {
+				return err
+			}
+			defer remote.Close()
+			return copyPins(ctx, remote, s, args[1:])
+		}),
+	}
+	Root.AddCommand(cmd)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/registry"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "registry",
+		Short: "commands related to container images",
+	}
+	Root.AddCommand(cmd)
+
+	serveCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "serve container images from CAS (Docker Registry v2 API, pull only)",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 0 {
+				return fmt.Errorf("unexpected argument")
+			}
+			host, _ := flags.GetString("host")
+			r, err := registry.New(ctx, s)
+			if err != nil {
+				return err
+			}
+			log.Println("listening on", host)
+			return http.ListenAndServe(host, r)
+		}),
+	}
+	serveCmd.Flags().String("host", "localhost:5000", "host to listen on")
+	cmd.AddCommand(serveCmd)
+
+	importCmd := &cobra.Command{
+		Use:   "import <oci-layout> <repository>",
+		Short: "import images from OCI image layout (directory or tar archive)",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("expected a path and a repository name")
+			}
+			r, err := registry.New(ctx, s)
+			if err != nil {
+				return err
+			}
+			tags, err := r.ImportOCI(ctx, args[0], args[1])
+			for _, t := range tags {
+				fmt.Println(t.Repository+":"+t.Tag, t.Manifest.Ref)
+			}
+			if err == nil && len(tags) == 0 {
+				err = fmt.Errorf("no tagged images found")
+			}
+			return err
+		}),
+	}
+	cmd.AddCommand(importCmd)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/s3gw"
+)
+
+func init() {
+	s3Cmd := &cobra.Command{
+		Use:   "s3",
+		Short: "commands related to S3-compatible API",
+	}
+	Root.AddCommand(s3Cmd)
+
+	serveCmd := &cobra.Command{
+		Use:   "serve [pin...]",
+		Short: "serve pinned trees over a read-only S3-compatible API, one bucket per pin",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			host, _ := flags.GetString("host")
+			g := s3gw.New(s, &s3gw.Options{Pins: args})
+			log.Println("listening on", host)
+			return http.ListenAndServe(host, g)
+		}),
+	}
+	serveCmd.Flags().String("host", "localhost:9000", "host to listen on")
+	s3Cmd.AddCommand(serveCmd)
+}
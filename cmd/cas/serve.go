@@ -10,7 +10,10 @@ import (
 	"github.com/spf13/pflag"
 
 	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/sched"
+	"github.com/dennwc/cas/storage"
 	"github.com/dennwc/cas/storage/http"
+	"github.com/dennwc/cas/storage/tenant"
 )
 
 func init() {
@@ -22,12 +25,84 @@ func init() {
 				return fmt.Errorf("unexpected argument")
 			}
 			host, _ := flags.GetString("host")
+			writable, _ := flags.GetBool("writable")
+			compress, _ := flags.GetBool("compress")
+			slots, _ := flags.GetInt("slots")
+			reserved, _ := flags.GetInt("reserved")
+			rate, _ := flags.GetFloat64("client-rate")
+			redirect, _ := flags.GetDuration("redirect")
 
 			log.Println("listening on", host)
-			srv := httpstor.NewServer(s, "/")
+			opts := httpstor.ServerOptions{
+				Writable:    writable,
+				Compression: compress,
+				RedirectTTL: redirect,
+			}
+			if slots > 0 {
+				opts.Scheduler = sched.New(sched.Options{
+					Slots: slots, Reserved: reserved,
+					ClientRate: rate, ClientBurst: slots,
+				})
+			}
+			var lim storage.LimitOptions
+			lim.Fetch.Concurrency, _ = flags.GetInt("max-fetches")
+			lim.Store.Concurrency, _ = flags.GetInt("max-stores")
+			lim.Fetch.BytesPerSec, _ = flags.GetFloat64("fetch-rate")
+			lim.Store.BytesPerSec, _ = flags.GetFloat64("store-rate")
+			if lim != (storage.LimitOptions{}) {
+				opts.Limits = &lim
+			}
+			var pol storage.Policy
+			pol.MaxSize, _ = flags.GetUint64("max-blob")
+			pol.DenyTypes, _ = flags.GetStringSlice("deny-type")
+			pol.ValidateSchema, _ = flags.GetBool("validate-schema")
+			if pol.MaxSize != 0 || len(pol.DenyTypes) != 0 || pol.ValidateSchema {
+				opts.Policy = &pol
+			}
+			metrics, _ := flags.GetString("metrics")
+			if metrics != "" {
+				opts.Metrics = storage.NewMetrics()
+				log.Println("serving metrics on", metrics)
+				go func() {
+					if err := http.ListenAndServe(metrics, opts.Metrics); err != nil {
+						log.Println("metrics:", err)
+					}
+				}()
+			}
+			var srv http.Handler
+			if tenants, _ := flags.GetBool("tenants"); tenants {
+				h := tenant.New(s)
+				srv = h.Handler(opts)
+				if admin, _ := flags.GetString("admin"); admin != "" {
+					log.Println("serving admin API on", admin)
+					go func() {
+						if err := http.ListenAndServe(admin, h.AdminHandler()); err != nil {
+							log.Println("admin:", err)
+						}
+					}()
+				}
+			} else {
+				srv = httpstor.NewServerWithOptions(s, "/", opts)
+			}
 			return http.ListenAndServe(host, srv)
 		}),
 	}
 	cmd.Flags().String("host", "localhost:9080", "host to listen on")
+	cmd.Flags().BoolP("writable", "w", false, "allow clients to upload blobs")
+	cmd.Flags().Bool("compress", true, "compress transfers for clients that support it")
+	cmd.Flags().Int("slots", 0, "limit the number of concurrent storage operations and share them fairly between clients")
+	cmd.Flags().Int("reserved", 1, "number of operation slots reserved for interactive requests")
+	cmd.Flags().Duration("redirect", 0, "redirect blob downloads to pre-signed backend URLs valid for a given duration")
+	cmd.Flags().Float64("client-rate", 0, "rate of operations per second after which the client yields to others")
+	cmd.Flags().Int("max-fetches", 0, "limit the number of concurrent blob downloads")
+	cmd.Flags().Int("max-stores", 0, "limit the number of concurrent blob uploads")
+	cmd.Flags().Float64("fetch-rate", 0, "limit the total download throughput (bytes per second)")
+	cmd.Flags().Float64("store-rate", 0, "limit the total upload throughput (bytes per second)")
+	cmd.Flags().Uint64("max-blob", 0, "reject uploaded blobs larger than a given size")
+	cmd.Flags().StringSlice("deny-type", nil, "reject uploaded schema blobs of a given type")
+	cmd.Flags().Bool("validate-schema", false, "reject uploaded schema blobs that cannot be decoded")
+	cmd.Flags().Bool("tenants", false, "serve a separate store for each tenant under /<tenant>/, sharing blobs between them")
+	cmd.Flags().String("admin", "", "serve the admin API of tenants (storage usage) on a given host")
+	cmd.Flags().String("metrics", "", "serve Prometheus metrics of storage operations on a given host")
 	Root.AddCommand(cmd)
 }
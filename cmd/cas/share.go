@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/share"
+)
+
+// keyringFromFlags opens the keyring for sharing trees.
+func keyringFromFlags(flags *pflag.FlagSet) (*share.Keyring, error) {
+	dir, _ := flags.GetString("keyring")
+	if dir == "" {
+		var err error
+		dir, err = share.DefaultKeyringDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return share.OpenKeyring(dir), nil
+}
+
+// parseShareKey parses a public key for sharing, either in hex or from a file.
+func parseShareKey(s string) (share.PublicKey, error) {
+	if pub, err := share.ParsePublicKey(s); err == nil {
+		return pub, nil
+	}
+	data, err := ioutil.ReadFile(s)
+	if err != nil {
+		return share.PublicKey{}, fmt.Errorf("expected a public key or a file: %v", err)
+	}
+	return share.ParsePublicKey(string(data))
+}
+
+// acceptPeers only accepts bundles from peers in the keyring, unless any sender is allowed.
+func acceptPeers(kr *share.Keyring, flags *pflag.FlagSet) func(from share.PublicKey) error {
+	return func(from share.PublicKey) error {
+		name, ok, err := kr.PeerName(from)
+		if err != nil {
+			return err
+		} else if ok {
+			fmt.Fprintln(os.Stderr, "bundle from", name)
+			return nil
+		} else if anyKey, _ := flags.GetBool("any-sender"); anyKey {
+			fmt.Fprintln(os.Stderr, "bundle from an unknown key", from)
+			return nil
+		}
+		return fmt.Errorf("bundle from an unknown key %s; add it with 'cas share add' or use --any-sender", from)
+	}
+}
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "share",
+		Short: "share trees with other users, encrypted end-to-end",
+		Long: `Share trees with other users, encrypted end-to-end.
+
+Each user generates a key pair with 'cas share keygen' and sends the public key to their peers,
+who add it to their keyrings with 'cas share add'. A tree is exported as a bundle encrypted to
+the key of the peer, either to a file or to a remote storage both users have access to. Only the
+peer can decrypt and import it, and the bundle is only accepted from known peers.`,
+	}
+	cmd.PersistentFlags().String("keyring", "", "keyring directory (default is in the user config directory)")
+	Root.AddCommand(cmd)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "keygen",
+		Short: "generate a key for sharing and print the public key",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			kr, err := keyringFromFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			key, err := kr.GenerateKey()
+			if err != nil {
+				return err
+			}
+			fmt.Println(key.Public())
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "key",
+		Short: "print the public key for sharing",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			kr, err := keyringFromFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			key, err := kr.Key()
+			if err != nil {
+				return err
+			}
+			fmt.Println(key.Public())
+			return nil
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "add <name> <key>",
+		Short: "add a public key of a peer (hex or a file)",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("expected a name and a public key")
+			}
+			kr, err := keyringFromFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			pub, err := parseShareKey(args[1])
+			if err != nil {
+				return err
+			}
+			return kr.AddPeer(args[0], pub)
+		},
+	})
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "peers",
+		Short: "list peers in the keyring",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			kr, err := keyringFromFlags(cmd.Flags())
+			if err != nil {
+				return err
+			}
+			names, err := kr.Peers()
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				pub, err := kr.Peer(name)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("%s\t%s\n", name, pub)
+			}
+			return nil
+		},
+	})
+
+	exportCmd := &cobra.Command{
+		Use:   "export <pin|ref> <peer>",
+		Short: "export a tree encrypted to the key of a peer",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("expected a pin or a ref and a peer")
+			}
+			kr, err := keyringFromFlags(flags)
+			if err != nil {
+				return err
+			}
+			key, err := kr.Key()
+			if err != nil {
+				return err
+			}
+			to, err := kr.Peer(args[1])
+			if err != nil {
+				return err
+			}
+			ref, err := s.GetPinOrRef(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			if addr, _ := flags.GetString("remote"); addr != "" {
+				remote, err := openRemote(addr)
+				if err != nil {
+					return err
+				}
+				defer remote.Close()
+				pin, _ := flags.GetString("remote-pin")
+				if pin == "" {
+					pin = args[1]
+				}
+				sr, err := share.Send(ctx, remote, pin, s, ref, key, to)
+				if err != nil {
+					return err
+				}
+				fmt.Println(pin, "=", sr.Ref)
+				return nil
+			}
+			var w io.Writer = os.Stdout
+			if out, _ := flags.GetString("out"); out != "" && out != "-" {
+				f, err := os.Create(out)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				if err = share.Export(ctx, f, s, ref, key, to); err != nil {
+					return err
+				}
+				return f.Close()
+			}
+			return share.Export(ctx, w, s, ref, key, to)
+		}),
+	}
+	exportCmd.Flags().StringP("out", "o", "", "output file (default is stdout)")
+	exportCmd.Flags().String("remote", "", "store the bundle in a remote storage instead")
+	exportCmd.Flags().String("remote-pin", "", "pin of the bundle in the remote storage (default is the name of the peer)")
+	cmd.AddCommand(exportCmd)
+
+	importCmd := &cobra.Command{
+		Use:   "import [file]",
+		Short: "decrypt a bundle and store the tree",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) > 1 {
+				return fmt.Errorf("expected at most one file")
+			}
+			kr, err := keyringFromFlags(flags)
+			if err != nil {
+				return err
+			}
+			key, err := kr.Key()
+			if err != nil {
+				return err
+			}
+			accept := acceptPeers(kr, flags)
+			var b *share.Bundle
+			if addr, _ := flags.GetString("remote"); addr != "" {
+				if len(args) != 0 {
+					return fmt.Errorf("unexpected file with a remote storage")
+				}
+				pin, _ := flags.GetString("remote-pin")
+				if pin == "" {
+					return fmt.Errorf("expected a pin of the bundle in the remote storage")
+				}
+				remote, err := openRemote(addr)
+				if err != nil {
+					return err
+				}
+				defer remote.Close()
+				b, err = share.Receive(ctx, s, remote, pin, key, accept)
+				if err != nil {
+					return err
+				}
+			} else {
+				var r io.Reader = os.Stdin
+				if len(args) == 1 && args[0] != "-" {
+					f, err := os.Open(args[0])
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+					r = f
+				}
+				b, err = share.Import(ctx, s, r, key, accept)
+				if err != nil {
+					return err
+				}
+			}
+			if pin, _ := flags.GetString("pin"); pin != "" {
+				if err = s.SetPin(ctx, pin, b.Root.Ref); err != nil {
+					return err
+				}
+				fmt.Println(pin, "=", b.Root.Ref)
+				return nil
+			}
+			fmt.Println(b.Root.Ref)
+			return nil
+		}),
+	}
+	importCmd.Flags().String("pin", "", "set a pin to the root of the tree")
+	importCmd.Flags().String("remote", "", "read the bundle from a remote storage")
+	importCmd.Flags().String("remote-pin", "", "pin of the bundle in the remote storage")
+	importCmd.Flags().Bool("any-sender", false, "accept bundles from keys that are not in the keyring")
+	cmd.AddCommand(importCmd)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "status [dir]",
+		Short: "show changes in a directory since the last snapshot",
+		Long: `Show changes in a directory since the last snapshot of a pin.
+
+Each change is printed as "<kind> <path>", where kind is A for added, M for modified and D for deleted
+entries. Added and deleted directories are printed with a trailing slash, without their content.
+Files are compared by refs cached in file metadata, thus only files modified since they were stored or
+checked out are read.
+
+With --short, only the number of changes of each kind is printed, or nothing if there are no changes,
+which is suitable for shell prompts. With -z, entries are terminated with NUL instead of a newline.`,
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			dir := "."
+			if len(args) == 1 {
+				dir = args[0]
+			} else if len(args) > 1 {
+				return fmt.Errorf("expected 0 or 1 argument")
+			}
+			pin, _ := flags.GetString("pin")
+			short, _ := flags.GetBool("short")
+			nul, _ := flags.GetBool("null")
+
+			root, err := s.GetPinOrRef(ctx, pin)
+			if err != nil {
+				return err
+			}
+			counts := make(map[cas.ChangeKind]int)
+			err = s.Status(ctx, root, dir, func(c *cas.Change) error {
+				counts[c.Kind]++
+				if short {
+					return nil
+				}
+				name := c.Path
+				if c.Dir {
+					name += "/"
+				}
+				if nul {
+					fmt.Printf("%s %s\x00", c.Kind, name)
+				} else {
+					fmt.Printf("%s %s\n", c.Kind, name)
+				}
+				return nil
+			})
+			if err == cas.ErrNotDir {
+				return fmt.Errorf("%s is not a directory", pin)
+			} else if err != nil {
+				return err
+			}
+			if short {
+				var out []string
+				for _, k := range []struct {
+					kind cas.ChangeKind
+					sign string
+				}{
+					{cas.Added, "+"}, {cas.Modified, "~"}, {cas.Deleted, "-"},
+				} {
+					if n := counts[k.kind]; n != 0 {
+						out = append(out, fmt.Sprintf("%s%d", k.sign, n))
+					}
+				}
+				if len(out) != 0 {
+					fmt.Println(strings.Join(out, " "))
+				}
+			}
+			return nil
+		}),
+	}
+	cmd.Flags().String("pin", cas.DefaultPin, "pin of the snapshot to compare with")
+	cmd.Flags().BoolP("short", "s", false, "only print the number of changes of each kind (e.g. +1 ~2 -3)")
+	cmd.Flags().BoolP("null", "z", false, "terminate entries with NUL")
+	Root.AddCommand(cmd)
+}
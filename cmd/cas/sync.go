@@ -8,6 +8,7 @@ import (
 	"github.com/spf13/pflag"
 
 	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
 	"github.com/dennwc/cas/types"
 )
 
@@ -20,6 +21,7 @@ func init() {
 				args = []string{cas.DefaultPin}
 			}
 			var last error
+			ev := &schema.Event{Type: schema.EventSync, Args: args}
 			for _, arg := range args {
 				ref, err := s.GetPinOrRef(ctx, arg)
 				if err != nil {
@@ -36,15 +38,27 @@ func init() {
 					fmt.Println(arg, err)
 					continue
 				}
+				ev.Refs = append(ev.Refs, nref)
 				if ref != nref {
 					fmt.Println(arg, "->", ref)
 				} else {
 					fmt.Println(arg, "->", ref, "(up-to-date)")
 				}
 			}
-			return last
+			if last != nil {
+				ev.Error = last.Error()
+			}
+			logEvent(ctx, s, ev)
+			if last != nil {
+				return last
+			}
+			if v, _ := flags.GetBool("verify"); v {
+				return verifyStore(ctx, s, &cas.VerifyOptions{Mode: cas.VerifyFast}, false)
+			}
+			return nil
 		}),
 	}
 	registerStoreConfFlags(cmd.Flags())
+	cmd.Flags().Bool("verify", false, "run a fast verification of the store after sync")
 	Root.AddCommand(cmd)
 }
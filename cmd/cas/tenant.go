@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/gc"
+	"github.com/dennwc/cas/storage/tenant"
+	"github.com/dennwc/cas/types"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "tenant",
+		Short: "manage tenants that share blobs of the store",
+		Long: `Manage tenants that share blobs of the store.
+
+Each tenant has its own pins and only sees blobs it has stored, while blobs stored by many tenants are kept once.
+Tenants are served with 'cas serve --tenants' and are created on the first write.`,
+	}
+	Root.AddCommand(cmd)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "list tenants",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			names, err := tenant.New(s).Tenants(ctx)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				fmt.Println(name)
+			}
+			return nil
+		}),
+	})
+
+	usageCmd := &cobra.Command{
+		Use:   "usage",
+		Short: "print storage usage of tenants",
+		Long: `Print storage usage of tenants.
+
+Size of blobs stored by many tenants is attributed to them according to the attribution mode: either split
+equally between them, or attributed to the tenant that stored the blob first.`,
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			name, _ := flags.GetString("attribution")
+			attr, err := tenant.ParseAttribution(name)
+			if err != nil {
+				return err
+			}
+			usage, err := tenant.New(s).Usage(ctx, attr)
+			if err != nil {
+				return err
+			}
+			fmt.Println("tenant\tblobs\tsize\texclusive\tattributed")
+			for _, u := range usage {
+				fmt.Printf("%s\t%d\t%d\t%d\t%d\n", u.Tenant, u.Blobs, u.Size, u.Exclusive, u.Attributed)
+			}
+			return nil
+		}),
+	}
+	usageCmd.Flags().String("attribution", tenant.Split.String(), "attribution of shared blobs (split or first-writer)")
+	cmd.AddCommand(usageCmd)
+
+	gcCmd := &cobra.Command{
+		Use:   "gc <tenant>",
+		Short: "remove blobs of the tenant that are not reachable from its pins",
+		Long: `Remove blobs of the tenant that are not reachable from its pins.
+
+Blobs are only removed from the store if they are not reachable from pins of other tenants or pins of the store.
+No tenant should modify the store while the collection is running.`,
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected a tenant name")
+			}
+			dry, _ := flags.GetBool("dry-run")
+			verbose, _ := flags.GetBool("verbose")
+			opts := &gc.Options{DryRun: dry}
+			if verbose {
+				opts.OnSweep = func(sr types.SizedRef) {
+					fmt.Println(sr.Ref, sr.Size)
+				}
+			}
+			rep, err := tenant.New(s).GC(ctx, args[0], opts)
+			if err != nil {
+				return err
+			}
+			verb := "removed"
+			if rep.DryRun {
+				verb = "would remove"
+			}
+			fmt.Printf("gc %s: %d pins, %d blobs, %d reachable (%d missing), %s %d blobs (%d bytes) in %v\n",
+				args[0], rep.Pins, rep.Blobs, rep.Reachable, rep.Missing, verb, rep.Swept, rep.Freed, rep.Duration)
+			return nil
+		}),
+	}
+	gcCmd.Flags().BoolP("dry-run", "n", false, "only report blobs that would be removed")
+	gcCmd.Flags().BoolP("verbose", "v", false, "print removed blobs")
+	cmd.AddCommand(gcCmd)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/torrent"
+	"github.com/dennwc/cas/types"
+)
+
+func readTorrent(path string) (*torrent.MetaInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return torrent.Parse(f)
+}
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "torrent",
+		Short: "commands related to BitTorrent distribution",
+	}
+	Root.AddCommand(cmd)
+
+	createCmd := &cobra.Command{
+		Use:   "create <ref|pin>",
+		Short: "create a torrent with all blobs of a tree and print its magnet link",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected a ref or a pin")
+			}
+			ref, err := s.GetPinOrRef(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			opts := &torrent.CreateOptions{}
+			opts.Announce, _ = flags.GetString("tracker")
+			opts.PieceLength, _ = flags.GetInt64("piece-size")
+			opts.Name, _ = flags.GetString("name")
+			if opts.Name == "" && !types.IsRef(args[0]) {
+				opts.Name = args[0]
+			}
+			m, err := torrent.Create(ctx, s, ref, opts)
+			if err != nil {
+				return err
+			}
+			out, _ := flags.GetString("out")
+			if out == "" {
+				out = m.Name + ".torrent"
+			}
+			f, err := os.Create(out)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if _, err = m.WriteTo(f); err != nil {
+				return err
+			} else if err = f.Close(); err != nil {
+				return err
+			}
+			fmt.Println(m.Magnet())
+			return nil
+		}),
+	}
+	createCmd.Flags().StringP("out", "o", "", "output file (default is <name>.torrent)")
+	createCmd.Flags().String("name", "", "name of the torrent (default is the pin name or the ref)")
+	createCmd.Flags().String("tracker", "", "announce URL of the tracker")
+	createCmd.Flags().Int64("piece-size", torrent.DefaultPieceSize, "size of torrent pieces")
+	cmd.AddCommand(createCmd)
+
+	seedCmd := &cobra.Command{
+		Use:   "seed <file.torrent>",
+		Short: "serve blobs of a torrent to other peers",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected a torrent file")
+			}
+			m, err := readTorrent(args[0])
+			if err != nil {
+				return err
+			}
+			host, _ := flags.GetString("host")
+			l, err := net.Listen("tcp", host)
+			if err != nil {
+				return err
+			}
+			defer l.Close()
+			if m.Announce != "" {
+				_, sport, _ := net.SplitHostPort(l.Addr().String())
+				port, _ := strconv.Atoi(sport)
+				if _, err := torrent.Announce(ctx, nil, m, torrent.NewPeerID(), port, 0); err != nil {
+					log.Println("announce failed:", err)
+				}
+			}
+			log.Println("seeding", m.Name, "on", l.Addr())
+			return torrent.NewSeeder(s, m).Serve(ctx, l)
+		}),
+	}
+	seedCmd.Flags().String("host", ":6881", "host to listen on")
+	cmd.AddCommand(seedCmd)
+
+	fetchCmd := &cobra.Command{
+		Use:   "fetch <file.torrent>",
+		Short: "download all blobs of a torrent and pin its root",
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			if len(args) != 1 {
+				return fmt.Errorf("expected a torrent file")
+			}
+			m, err := readTorrent(args[0])
+			if err != nil {
+				return err
+			}
+			opts := &torrent.Options{}
+			opts.Peers, _ = flags.GetStringSlice("peer")
+			pin, _ := flags.GetString("pin")
+			if pin == "" {
+				pin = m.Name
+			}
+			ev := &schema.Event{Type: schema.EventSync, Args: args}
+			root, err := torrent.Fetch(ctx, s, m, opts)
+			if err == nil {
+				err = s.SetPin(ctx, pin, root)
+			}
+			if err != nil {
+				ev.Error = err.Error()
+			} else {
+				ev.Refs = []types.Ref{root}
+			}
+			logEvent(ctx, s, ev)
+			if err != nil {
+				return err
+			}
+			fmt.Println(pin, "=", root)
+			return nil
+		}),
+	}
+	fetchCmd.Flags().StringSlice("peer", nil, "address of a peer (in addition to the tracker)")
+	fetchCmd.Flags().String("pin", "", "pin to set to the root (default is the name of the torrent)")
+	cmd.AddCommand(fetchCmd)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// verifyStore runs the verification and prints the report. If replicas are given, corrupt and missing blobs
+// are restored from them.
+func verifyStore(ctx context.Context, s *cas.Storage, opts *cas.VerifyOptions, verbose bool, replicas ...storage.BlobSource) error {
+	rep, err := s.Verify(ctx, opts)
+	if err != nil {
+		return err
+	}
+	for _, p := range rep.Problems {
+		fmt.Println(p)
+	}
+	if verbose {
+		for _, ref := range rep.Missing {
+			fmt.Println("missing:", ref)
+		}
+		for _, ref := range rep.Orphaned {
+			fmt.Println("orphaned:", ref)
+		}
+	}
+	fmt.Printf("%s verify: %d blobs (%d bytes), %d schema blobs, %d pins, %d problems in %v\n",
+		rep.Mode, rep.Blobs, rep.Size, rep.Schema, rep.Pins, len(rep.Problems), rep.Duration)
+	if opts.Refs {
+		fmt.Printf("%d corrupt, %d missing, %d orphaned\n", len(rep.Corrupt), len(rep.Missing), len(rep.Orphaned))
+	}
+	if len(replicas) == 0 || (rep.OK() && len(rep.Missing) == 0) {
+		if !rep.OK() {
+			return fmt.Errorf("verification failed: %d problems", len(rep.Problems))
+		}
+		return nil
+	}
+	rrep, err := s.Repair(ctx, rep, replicas...)
+	if err != nil {
+		return err
+	}
+	healed := make(map[types.Ref]struct{}, len(rrep.Healed))
+	ev := &schema.Event{Type: schema.EventRepair}
+	for _, sr := range rrep.Healed {
+		healed[sr.Ref] = struct{}{}
+		ev.Refs = append(ev.Refs, sr.Ref)
+		fmt.Println("healed:", sr.Ref)
+	}
+	if len(rrep.Healed) != 0 {
+		logEvent(ctx, s, ev)
+	}
+	left := 0
+	for _, p := range rep.Problems {
+		if _, ok := healed[p.Ref]; !ok {
+			left++
+		}
+	}
+	fmt.Printf("repair: %d blobs healed, %d problems left\n", len(rrep.Healed), left)
+	if left != 0 {
+		return fmt.Errorf("verification failed: %d problems", left)
+	}
+	return nil
+}
+
+// repairSources opens replicas used to repair the store. Replicas of a mirror storage are always used.
+func repairSources(s *cas.Storage, flags *pflag.FlagSet) ([]storage.BlobSource, error) {
+	var out []storage.BlobSource
+	if m, ok := s.Underlying().(*storage.MirrorStorage); ok {
+		for _, r := range m.Replicas() {
+			out = append(out, r)
+		}
+	}
+	addrs, _ := flags.GetStringSlice("repair-from")
+	for _, addr := range addrs {
+		r, err := openRemote(addr)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+func init() {
+	cmd := &cobra.Command{
+		Use:     "verify",
+		Aliases: []string{"scrub"},
+		Short:   "check the consistency of the store",
+		Long: `Check the consistency of the store.
+
+By default, only sizes of blobs, the schema index and pins are checked, which is cheap enough to run after
+every sync. A deep verification re-hashes the content of all blobs and is intended for scheduled scrubs.
+
+With --repair, corrupt and missing blobs are restored from replicas of a mirror storage and from remotes
+passed with --repair-from.`,
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			opts := &cas.VerifyOptions{Mode: cas.VerifyFast}
+			if deep, _ := flags.GetBool("deep"); deep {
+				opts.Mode = cas.VerifyDeep
+			}
+			return verifyRepair(ctx, s, flags, opts, false)
+		}),
+	}
+	cmd.Flags().Bool("deep", false, "re-hash the content of all blobs")
+	addRepairFlags(cmd.Flags())
+	Root.AddCommand(cmd)
+
+	fsckCmd := &cobra.Command{
+		Use:   "fsck",
+		Short: "perform a full verification of the store",
+		Long: `Perform a full verification of the store.
+
+All blobs are re-hashed and checked against their names, schema blobs are decoded, and references
+of schema blobs are checked. Blobs that are referenced but not stored are reported as missing, and blobs
+that are not reachable from any pin are reported as orphaned. Only corrupted blobs and broken pins
+are considered errors.
+
+With --repair, corrupt and missing blobs are restored from replicas of a mirror storage and from remotes
+passed with --repair-from.`,
+		RunE: casOpenCmd(func(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, args []string) error {
+			opts := &cas.VerifyOptions{Mode: cas.VerifyDeep, Refs: true}
+			if fast, _ := flags.GetBool("fast"); fast {
+				opts.Mode = cas.VerifyFast
+			}
+			verbose, _ := flags.GetBool("verbose")
+			return verifyRepair(ctx, s, flags, opts, verbose)
+		}),
+	}
+	fsckCmd.Flags().Bool("fast", false, "don't re-hash the content of blobs")
+	fsckCmd.Flags().BoolP("verbose", "v", false, "list missing and orphaned blobs")
+	addRepairFlags(fsckCmd.Flags())
+	Root.AddCommand(fsckCmd)
+}
+
+func addRepairFlags(flags *pflag.FlagSet) {
+	flags.Bool("repair", false, "restore corrupt and missing blobs from replicas")
+	flags.StringSlice("repair-from", nil, "remote storage (URL or directory) to restore blobs from; implies --repair")
+}
+
+// verifyRepair runs the verification with an optional repair, depending on flags.
+func verifyRepair(ctx context.Context, s *cas.Storage, flags *pflag.FlagSet, opts *cas.VerifyOptions, verbose bool) error {
+	repair, _ := flags.GetBool("repair")
+	if addrs, _ := flags.GetStringSlice("repair-from"); len(addrs) != 0 {
+		repair = true
+	}
+	if !repair {
+		return verifyStore(ctx, s, opts, verbose)
+	}
+	replicas, err := repairSources(s, flags)
+	if err != nil {
+		return err
+	} else if len(replicas) == 0 {
+		return fmt.Errorf("no replicas to repair from; use --repair-from")
+	}
+	defer func() {
+		for _, r := range replicas {
+			if c, ok := r.(*cas.Storage); ok {
+				c.Close()
+			}
+		}
+	}()
+	return verifyStore(ctx, s, opts, verbose, replicas...)
+}
@@ -0,0 +1,435 @@
+// Command git-remote-cas is a git remote helper that stores git repositories in CAS.
+//
+// The remote address has a form of cas::[dir#]pin, where dir is a path to CAS directory and pin
+// is the name of a pin that points to the repository state. If dir is not set, CAS_DIR environment
+// variable is used, or a default CAS in the current or the home directory.
+//
+// Example:
+//
+//	git push cas::myrepo master
+//	git clone cas::myrepo
+//
+// Repository objects are stored as a chain of incremental git bundles. Each push adds a bundle
+// with the objects that were not pushed before.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	_ "github.com/dennwc/cas/storage/all"
+)
+
+const envDir = "CAS_DIR"
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("git-remote-cas: ")
+	if len(os.Args) < 3 {
+		log.Fatal("expected a remote name and an address")
+	}
+	dir, pin := parseAddr(os.Args[2])
+	st, err := openCAS(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer st.Close()
+	h := &helper{
+		ctx: context.Background(),
+		s:   st, pin: pin,
+		out: bufio.NewWriter(os.Stdout),
+	}
+	if err = h.run(bufio.NewReader(os.Stdin)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseAddr splits the remote address into CAS directory and the pin name.
+func parseAddr(addr string) (dir, pin string) {
+	addr = strings.TrimPrefix(addr, "cas://")
+	if i := strings.LastIndex(addr, "#"); i >= 0 {
+		dir, pin = addr[:i], addr[i+1:]
+	} else {
+		pin = addr
+	}
+	if pin == "" {
+		pin = cas.DefaultPin
+	}
+	return dir, pin
+}
+
+func openCAS(dir string) (*cas.Storage, error) {
+	if dir == "" {
+		dir = os.Getenv(envDir)
+	}
+	if dir != "" {
+		return cas.Open(cas.OpenOptions{Dir: dir})
+	}
+	st, err := cas.Open(cas.OpenOptions{})
+	if !os.IsNotExist(err) {
+		return st, err
+	}
+	u, uerr := user.Current()
+	if uerr != nil {
+		return nil, err
+	}
+	st, gerr := cas.Open(cas.OpenOptions{Dir: filepath.Join(u.HomeDir, cas.DefaultDir)})
+	if gerr != nil {
+		return nil, err // return original error
+	}
+	return st, nil
+}
+
+// helper serves commands of the remote helper protocol for a single remote.
+type helper struct {
+	ctx context.Context
+	s   *cas.Storage
+	pin string
+	dir string // local repository; the current directory is used if empty
+	out *bufio.Writer
+}
+
+func (h *helper) run(r *bufio.Reader) error {
+	for {
+		line, err := readLine(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch {
+		case line == "":
+			return nil
+		case line == "capabilities":
+			h.capabilities()
+		case line == "list" || line == "list for-push":
+			err = h.list()
+		case strings.HasPrefix(line, "fetch "):
+			var batch []string
+			batch, err = readBatch(r, line)
+			if err == nil {
+				err = h.fetch(batch)
+			}
+		case strings.HasPrefix(line, "push "):
+			var batch []string
+			batch, err = readBatch(r, line)
+			if err == nil {
+				err = h.push(batch)
+			}
+		default:
+			err = fmt.Errorf("unsupported command: %q", line)
+		}
+		if err != nil {
+			return err
+		}
+		if err = h.out.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\n"), err
+}
+
+// readBatch reads a batch of commands terminated by an empty line.
+func readBatch(r *bufio.Reader, first string) ([]string, error) {
+	batch := []string{first}
+	for {
+		line, err := readLine(r)
+		if err == io.EOF || (err == nil && line == "") {
+			return batch, nil
+		} else if err != nil {
+			return nil, err
+		}
+		batch = append(batch, line)
+	}
+}
+
+func (h *helper) capabilities() {
+	fmt.Fprint(h.out, "fetch\npush\n\n")
+}
+
+// state loads the current state of the repository from CAS.
+func (h *helper) state() (*schema.GitRemote, error) {
+	ref, err := h.s.GetPin(h.ctx, h.pin)
+	if err == storage.ErrNotFound {
+		return &schema.GitRemote{Refs: make(map[string]string)}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	obj, err := h.s.DecodeSchema(h.ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	st, ok := obj.(*schema.GitRemote)
+	if !ok {
+		return nil, fmt.Errorf("pin %q is not a git repository: %T", h.pin, obj)
+	}
+	if st.Refs == nil {
+		st.Refs = make(map[string]string)
+	}
+	return st, nil
+}
+
+func (h *helper) list() error {
+	st, err := h.state()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(st.Refs))
+	for name := range st.Refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h.out, "%s %s\n", st.Refs[name], name)
+	}
+	if _, ok := st.Refs[st.Head]; ok {
+		fmt.Fprintf(h.out, "@%s HEAD\n", st.Head)
+	}
+	fmt.Fprint(h.out, "\n")
+	return nil
+}
+
+func (h *helper) git(stdin io.Reader, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = h.dir
+	cmd.Stdin = stdin
+	buf := new(bytes.Buffer)
+	cmd.Stderr = buf
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(buf.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// missing returns object IDs that don't exist in the local repository.
+func (h *helper) missing(ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	out, err := h.git(strings.NewReader(strings.Join(ids, "\n")+"\n"), "cat-file", "--batch-check")
+	if err != nil {
+		return nil, err
+	}
+	var miss []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == "missing" {
+			miss = append(miss, fields[0])
+		}
+	}
+	return miss, nil
+}
+
+// fetch applies all bundles that contain objects missing in the local repository.
+func (h *helper) fetch(batch []string) error {
+	st, err := h.state()
+	if err != nil {
+		return err
+	}
+	for _, b := range st.Bundles {
+		miss, err := h.missing(b.Heads)
+		if err != nil {
+			return err
+		} else if len(miss) == 0 {
+			continue
+		}
+		if err = h.unbundle(b); err != nil {
+			return err
+		}
+	}
+	fmt.Fprint(h.out, "\n")
+	return nil
+}
+
+func (h *helper) unbundle(b schema.GitBundle) error {
+	rc, _, err := h.s.FetchBlob(h.ctx, b.Ref)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := ioutil.TempFile("", "cas_bundle_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err = io.Copy(f, rc); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	_, err = h.git(nil, "bundle", "unbundle", f.Name())
+	return err
+}
+
+type pushCmd struct {
+	force bool
+	src   string
+	dst   string
+	id    string // resolved object ID of src
+	err   string
+}
+
+// push stores a new bundle with objects that were not pushed before and updates the repository state.
+func (h *helper) push(batch []string) error {
+	st, err := h.state()
+	if err != nil {
+		return err
+	}
+	var cmds []*pushCmd
+	for _, line := range batch {
+		spec := strings.TrimPrefix(line, "push ")
+		c := &pushCmd{}
+		if strings.HasPrefix(spec, "+") {
+			c.force, spec = true, spec[1:]
+		}
+		i := strings.Index(spec, ":")
+		if i < 0 {
+			return fmt.Errorf("invalid push command: %q", line)
+		}
+		c.src, c.dst = spec[:i], spec[i+1:]
+		cmds = append(cmds, c)
+	}
+	// objects reachable from the current refs are already stored in bundles
+	var old []string
+	for _, id := range st.Refs {
+		old = append(old, id)
+	}
+	miss, err := h.missing(old)
+	if err != nil {
+		return err
+	}
+	isMissing := make(map[string]bool)
+	for _, id := range miss {
+		isMissing[id] = true
+	}
+	var (
+		revs  []string
+		heads []string
+	)
+	for i, c := range cmds {
+		if c.src == "" {
+			continue
+		}
+		c.id, err = h.git(nil, "rev-parse", c.src)
+		if err != nil {
+			return err
+		}
+		if prev, ok := st.Refs[c.dst]; ok && prev != c.id && !c.force {
+			if isMissing[prev] {
+				c.err = "fetch first"
+				continue
+			}
+			if _, err = h.git(nil, "merge-base", "--is-ancestor", prev, c.id); err != nil {
+				c.err = "non-fast-forward"
+				continue
+			}
+		}
+		// bundles can only include named refs
+		tmp := fmt.Sprintf("refs/cas-push/%d", i)
+		if _, err = h.git(nil, "update-ref", tmp, c.id); err != nil {
+			return err
+		}
+		defer h.git(nil, "update-ref", "-d", tmp)
+		revs = append(revs, tmp)
+		heads = append(heads, c.id)
+	}
+	if len(revs) != 0 {
+		args := append([]string{}, revs...)
+		for _, id := range old {
+			if !isMissing[id] {
+				args = append(args, "^"+id)
+			}
+		}
+		b, err := h.storeBundle(args)
+		if err != nil {
+			return err
+		} else if b != nil {
+			b.Heads = heads
+			st.Bundles = append(st.Bundles, *b)
+		}
+	}
+	for _, c := range cmds {
+		if c.err != "" {
+			continue
+		}
+		if c.src == "" {
+			delete(st.Refs, c.dst)
+			continue
+		}
+		st.Refs[c.dst] = c.id
+		if _, ok := st.Refs[st.Head]; !ok && strings.HasPrefix(c.dst, "refs/heads/") {
+			st.Head = c.dst
+		}
+	}
+	sr, err := h.s.StoreSchema(h.ctx, st)
+	if err != nil {
+		return err
+	}
+	if err = h.s.SetPin(h.ctx, h.pin, sr.Ref); err != nil {
+		return err
+	}
+	for _, c := range cmds {
+		if c.err != "" {
+			fmt.Fprintf(h.out, "error %s %s\n", c.dst, c.err)
+		} else {
+			fmt.Fprintf(h.out, "ok %s\n", c.dst)
+		}
+	}
+	fmt.Fprint(h.out, "\n")
+	return nil
+}
+
+// storeBundle creates a bundle with given revisions and stores it in CAS.
+// It returns nil if there are no new objects to store.
+func (h *helper) storeBundle(revs []string) (*schema.GitBundle, error) {
+	objs, err := h.git(strings.NewReader(strings.Join(revs, "\n")+"\n"), "rev-list", "--objects", "--stdin")
+	if err != nil {
+		return nil, err
+	} else if objs == "" {
+		return nil, nil
+	}
+	f, err := ioutil.TempFile("", "cas_bundle_")
+	if err != nil {
+		return nil, err
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+	if _, err = h.git(strings.NewReader(strings.Join(revs, "\n")+"\n"), "bundle", "create", name, "--stdin"); err != nil {
+		return nil, err
+	}
+	f, err = os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sr, err := h.s.StoreBlob(h.ctx, f, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &schema.GitBundle{SizedRef: sr}, nil
+}
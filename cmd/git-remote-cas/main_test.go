@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage"
+)
+
+func TestParseAddr(t *testing.T) {
+	for _, c := range []struct {
+		addr, dir, pin string
+	}{
+		{"repo", "", "repo"},
+		{"/path/to/cas#repo", "/path/to/cas", "repo"},
+		{"cas:///path/to/cas#repo", "/path/to/cas", "repo"},
+		{"/path#to/cas#repo", "/path#to/cas", "repo"},
+		{"", "", cas.DefaultPin},
+		{"/path/to/cas#", "/path/to/cas", cas.DefaultPin},
+	} {
+		dir, pin := parseAddr(c.addr)
+		require.Equal(t, c.dir, dir, c.addr)
+		require.Equal(t, c.pin, pin, c.addr)
+	}
+}
+
+func TestPushClone(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_git_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	// run sends commands to the helper for a given local repository and returns its responses
+	run := func(repo, cmds string) string {
+		buf := new(bytes.Buffer)
+		h := &helper{ctx: ctx, s: s, pin: "repo", dir: repo, out: bufio.NewWriter(buf)}
+		require.NoError(t, h.run(bufio.NewReader(strings.NewReader(cmds))))
+		return buf.String()
+	}
+	newRepo := func(name string) *helper {
+		h := &helper{dir: filepath.Join(dir, name)}
+		require.NoError(t, os.Mkdir(h.dir, 0755))
+		for _, args := range [][]string{
+			{"init", "-q"},
+			{"symbolic-ref", "HEAD", "refs/heads/master"},
+			{"config", "user.name", "test"},
+			{"config", "user.email", "test@example.com"},
+		} {
+			_, err := h.git(nil, args...)
+			require.NoError(t, err)
+		}
+		return h
+	}
+	commit := func(h *helper, data string) string {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(h.dir, "file.txt"), []byte(data), 0644))
+		_, err := h.git(nil, "add", "file.txt")
+		require.NoError(t, err)
+		_, err = h.git(nil, "commit", "-q", "-m", data)
+		require.NoError(t, err)
+		id, err := h.git(nil, "rev-parse", "HEAD")
+		require.NoError(t, err)
+		return id
+	}
+	show := func(h *helper, id string) string {
+		out, err := h.git(nil, "show", id+":file.txt")
+		require.NoError(t, err)
+		return out
+	}
+
+	src := newRepo("src")
+	require.Equal(t, "fetch\npush\n\n", run(src.dir, "capabilities\n\n"))
+	require.Equal(t, "\n", run(src.dir, "list for-push\n"))
+
+	id1 := commit(src, "first")
+	require.Equal(t, "ok refs/heads/master\n\n", run(src.dir, "push refs/heads/master:refs/heads/master\n\n"))
+	require.Equal(t, id1+" refs/heads/master\n@refs/heads/master HEAD\n\n", run(src.dir, "list\n"))
+
+	// clone
+	dst := newRepo("dst")
+	require.Equal(t, "\n", run(dst.dir, "fetch "+id1+" refs/heads/master\n\n"))
+	require.Equal(t, "first", show(dst, id1))
+
+	// incremental push and fetch
+	id2 := commit(src, "second")
+	require.Equal(t, "ok refs/heads/master\n\n", run(src.dir, "push refs/heads/master:refs/heads/master\n\n"))
+	st, err := (&helper{ctx: ctx, s: s, pin: "repo"}).state()
+	require.NoError(t, err)
+	require.Len(t, st.Bundles, 2)
+	require.Equal(t, "\n", run(dst.dir, "fetch "+id2+" refs/heads/master\n\n"))
+	require.Equal(t, "second", show(dst, id2))
+
+	// history is not rewritten, unless forced
+	_, err = src.git(nil, "reset", "-q", "--hard", id1)
+	require.NoError(t, err)
+	id3 := commit(src, "third")
+	require.Equal(t, "error refs/heads/master non-fast-forward\n\n", run(src.dir, "push refs/heads/master:refs/heads/master\n\n"))
+	require.Equal(t, id2+" refs/heads/master\n@refs/heads/master HEAD\n\n", run(src.dir, "list\n"))
+	require.Equal(t, "ok refs/heads/master\n\n", run(src.dir, "push +refs/heads/master:refs/heads/master\n\n"))
+	require.Equal(t, "\n", run(dst.dir, "fetch "+id3+" refs/heads/master\n\n"))
+	require.Equal(t, "third", show(dst, id3))
+
+	require.Equal(t, "ok refs/heads/master\n\n", run(src.dir, "push :refs/heads/master\n\n"))
+	require.Equal(t, "\n", run(src.dir, "list\n"))
+}
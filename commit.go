@@ -0,0 +1,150 @@
+package cas
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+)
+
+// Commit records a new snapshot of root in the pin history and updates the pin to point to it.
+//
+// If the pin points to a commit, it becomes the parent of the new commit. If the root is the same
+// as in the current commit, no commit is created and the current one is returned.
+// Commits can be used in place of the file or directory they point to.
+func (s *Storage) Commit(ctx context.Context, pin string, root Ref, msg string) (SizedRef, error) {
+	return s.CommitWithOptions(ctx, pin, root, &CommitOptions{Message: msg})
+}
+
+// CommitOptions are optional parameters of a commit.
+type CommitOptions struct {
+	Message string
+	// Manifest stores a flat manifest of the root directory with the commit. See StoreManifest.
+	Manifest bool
+}
+
+// CommitWithOptions is like Commit, but accepts additional options.
+func (s *Storage) CommitWithOptions(ctx context.Context, pin string, root Ref, opt *CommitOptions) (SizedRef, error) {
+	if opt == nil {
+		opt = &CommitOptions{}
+	}
+	c := &schema.Commit{Root: root, Time: time.Now().UTC(), Message: opt.Message}
+	head, err := s.GetPin(ctx, pin)
+	if err == nil {
+		if prev, err := s.decodeCommit(ctx, head); err == nil {
+			if prev.Root == root {
+				sz, err := s.StatBlob(ctx, head)
+				return SizedRef{Ref: head, Size: sz}, err
+			}
+			c.Parent = &head
+		} else if err != errNotCommit {
+			return SizedRef{}, err
+		}
+	} else if err != storage.ErrNotFound {
+		return SizedRef{}, err
+	}
+	if opt.Manifest {
+		msr, err := s.StoreManifest(ctx, root)
+		if err != nil {
+			return SizedRef{}, err
+		}
+		c.Manifest = &msr.Ref
+	}
+	sr, err := s.StoreSchema(ctx, c)
+	if err != nil {
+		return SizedRef{}, err
+	}
+	if err = s.SetPin(ctx, pin, sr.Ref); err != nil {
+		return SizedRef{}, err
+	}
+	return sr, nil
+}
+
+var errNotCommit = fmt.Errorf("not a commit")
+
+func (s *Storage) decodeCommit(ctx context.Context, ref Ref) (*schema.Commit, error) {
+	obj, err := s.DecodeSchema(ctx, ref)
+	if err == schema.ErrNotSchema {
+		return nil, errNotCommit
+	} else if err != nil {
+		return nil, err
+	}
+	c, ok := obj.(*schema.Commit)
+	if !ok {
+		return nil, errNotCommit
+	}
+	return c, nil
+}
+
+// IterateCommits lists commits of a pin (or a commit ref), starting from the latest one.
+// Nothing is listed if the pin points to a file or directory instead of a commit.
+func (s *Storage) IterateCommits(ctx context.Context, pin string) *CommitIterator {
+	return &CommitIterator{s: s, ctx: ctx, pin: pin}
+}
+
+// CommitIterator iterates over the commit history.
+type CommitIterator struct {
+	s   *Storage
+	ctx context.Context
+	pin string
+
+	started bool
+	next    Ref
+	ref     Ref
+	cur     *schema.Commit
+	err     error
+}
+
+// Next advances the iterator to the parent commit.
+func (it *CommitIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		it.next, it.err = it.s.GetPinOrRef(it.ctx, it.pin)
+		if it.err != nil {
+			return false
+		}
+	}
+	if it.next.Zero() {
+		return false
+	}
+	c, err := it.s.decodeCommit(it.ctx, it.next)
+	if err == errNotCommit {
+		if it.cur != nil {
+			it.err = fmt.Errorf("expected commit, got: %v", it.next)
+		}
+		return false
+	} else if err != nil {
+		it.err = err
+		return false
+	}
+	it.ref, it.cur = it.next, c
+	it.next = Ref{}
+	if c.Parent != nil {
+		it.next = *c.Parent
+	}
+	return true
+}
+
+// Ref returns the ref of the current commit.
+func (it *CommitIterator) Ref() Ref {
+	return it.ref
+}
+
+// Commit returns the current commit.
+func (it *CommitIterator) Commit() *schema.Commit {
+	return it.cur
+}
+
+func (it *CommitIterator) Err() error {
+	return it.err
+}
+
+func (it *CommitIterator) Close() error {
+	it.next = Ref{}
+	return nil
+}
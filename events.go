@@ -0,0 +1,110 @@
+package cas
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+)
+
+// EventsPin is a reserved pin that points to the latest event in the store history.
+const EventsPin = "cas.events"
+
+// LogEvent stores an event in the store history and returns its ref.
+//
+// The event is linked to the previous one and the events pin is updated to point to it.
+// Events logged concurrently by different processes might be lost.
+func (s *Storage) LogEvent(ctx context.Context, e *schema.Event) (SizedRef, error) {
+	ev := *e
+	if ev.TS.IsZero() {
+		ev.TS = time.Now().UTC()
+	}
+	prev, err := s.GetPin(ctx, EventsPin)
+	if err == nil {
+		ev.Prev = &prev
+	} else if err != storage.ErrNotFound {
+		return SizedRef{}, err
+	}
+	sr, err := s.StoreSchema(ctx, &ev)
+	if err != nil {
+		return SizedRef{}, err
+	}
+	if err = s.SetPin(ctx, EventsPin, sr.Ref); err != nil {
+		return SizedRef{}, err
+	}
+	return sr, nil
+}
+
+// IterateEvents lists events in the store history, starting from the latest one.
+func (s *Storage) IterateEvents(ctx context.Context) *EventIterator {
+	return &EventIterator{s: s, ctx: ctx}
+}
+
+// EventIterator iterates over the store history.
+type EventIterator struct {
+	s   *Storage
+	ctx context.Context
+
+	started bool
+	next    Ref
+	ref     Ref
+	cur     *schema.Event
+	err     error
+}
+
+// Next advances the iterator to the previous event.
+func (it *EventIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		it.next, it.err = it.s.GetPin(it.ctx, EventsPin)
+		if it.err == storage.ErrNotFound {
+			it.err = nil
+			return false
+		} else if it.err != nil {
+			return false
+		}
+	}
+	if it.next.Zero() {
+		return false
+	}
+	obj, err := it.s.DecodeSchema(it.ctx, it.next)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	e, ok := obj.(*schema.Event)
+	if !ok {
+		it.err = fmt.Errorf("expected event, got: %T", obj)
+		return false
+	}
+	it.ref, it.cur = it.next, e
+	it.next = Ref{}
+	if e.Prev != nil {
+		it.next = *e.Prev
+	}
+	return true
+}
+
+// Ref returns the ref of the current event.
+func (it *EventIterator) Ref() Ref {
+	return it.ref
+}
+
+// Event returns the current event.
+func (it *EventIterator) Event() *schema.Event {
+	return it.cur
+}
+
+func (it *EventIterator) Err() error {
+	return it.err
+}
+
+func (it *EventIterator) Close() error {
+	it.next = Ref{}
+	return nil
+}
@@ -0,0 +1,44 @@
+package cas_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/gc"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+func TestEventsGC(t *testing.T) {
+	ctx := context.Background()
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	sr, err := s.StoreBlob(ctx, strings.NewReader("logged"), nil)
+	require.NoError(t, err)
+	e1, err := s.LogEvent(ctx, &schema.Event{Type: schema.EventStore, Refs: []types.Ref{sr.Ref}})
+	require.NoError(t, err)
+	e2, err := s.LogEvent(ctx, &schema.Event{Type: schema.EventStore, Refs: []types.Ref{sr.Ref}})
+	require.NoError(t, err)
+
+	// the history is kept, but objects mentioned in it are not
+	rep, err := gc.Run(ctx, s, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), rep.Swept)
+	_, err = s.StatBlob(ctx, sr.Ref)
+	require.Equal(t, storage.ErrNotFound, err)
+
+	var refs []types.Ref
+	it := s.IterateEvents(ctx)
+	for it.Next() {
+		refs = append(refs, it.Ref())
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []types.Ref{e2.Ref, e1.Ref}, refs)
+}
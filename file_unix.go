@@ -0,0 +1,13 @@
+//+build !windows
+
+package cas
+
+import (
+	"os"
+	"syscall"
+)
+
+// createFile creates a new file for writing. It fails if the file already exists, even if it's a dangling link.
+func createFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0666)
+}
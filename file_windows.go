@@ -0,0 +1,9 @@
+package cas
+
+import "os"
+
+// createFile creates a new file for writing. It fails if the file already exists. There is no O_NOFOLLOW
+// on Windows, but exclusive creation fails for existing links as well.
+func createFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+}
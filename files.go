@@ -4,12 +4,15 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
+	"strings"
 
 	"github.com/dennwc/cas/schema"
-	"github.com/dennwc/cas/storage/local"
+	"github.com/dennwc/cas/storage"
 	"github.com/dennwc/cas/types"
 )
 
@@ -17,6 +20,12 @@ const (
 	maxDirEntries = 1024
 )
 
+// Span attributes recorded by storage helpers.
+const (
+	attrPath = "cas.path"
+	attrURL  = "cas.url"
+)
+
 type FileDesc interface {
 	Name() string
 	Open() (io.ReadCloser, SizedRef, error)
@@ -24,7 +33,23 @@ type FileDesc interface {
 }
 
 func LocalFile(path string) FileDesc {
-	return &localFile{path: path}
+	return localFileCtx(context.Background(), path)
+}
+
+// localFileCtx is like LocalFile, but uses the context for file metadata operations.
+func localFileCtx(ctx context.Context, path string) FileDesc {
+	return &localFile{ctx: ctx, path: path}
+}
+
+// localFile is like localFileCtx, but caches file refs the same way as the storage.
+func (s *Storage) localFile(ctx context.Context, path string) FileDesc {
+	return &localFile{s: s, ctx: ctx, path: path}
+}
+
+// knownFile is like localFile, but uses a known ref of the content if the ref is not cached yet.
+// The content is still checked against the ref when it is read.
+func (s *Storage) knownFile(ctx context.Context, path, rel string, conf *StoreConfig) FileDesc {
+	return &localFile{s: s, ctx: ctx, path: path, known: conf.Checksums[rel]}
 }
 
 func (s *Storage) storeAsFile(ctx context.Context, fd FileDesc, conf *StoreConfig) (*schema.DirEntry, error) {
@@ -42,17 +67,104 @@ func (s *Storage) storeAsFile(ctx context.Context, fd FileDesc, conf *StoreConfi
 }
 
 func (s *Storage) storeFileContent(ctx context.Context, fd FileDesc, conf *StoreConfig) (types.SizedRef, error) {
+	lf, ok := fd.(*localFile)
+	if !ok {
+		sr, _, err := s.storeFileOnce(ctx, fd, conf)
+		return sr, err
+	}
+	if conf.Changes != nil && conf.Changes.Snapshot {
+		return s.storeSnapshot(ctx, lf, conf)
+	}
+	retries := conf.Changes.retries()
+	store := s.storeFileOnce
+	if conf.Append && !conf.IndexOnly {
+		store = func(ctx context.Context, _ FileDesc, conf *StoreConfig) (types.SizedRef, bool, error) {
+			return s.storeAppend(ctx, lf, conf)
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		c := *conf
+		sr, changed, err := store(ctx, fd, &c)
+		if !changed {
+			return sr, err
+		} else if attempt <= retries {
+			continue
+		} else if err != nil {
+			// nothing was stored
+			return types.SizedRef{}, &ErrFileChanged{Path: lf.path, Attempts: attempt}
+		}
+		return sr, conf.fileChanged(lf.path, attempt)
+	}
+}
+
+// storeSnapshot copies a local file to a temporary file and stores the copy. Only the copy is retried
+// if the file changes, thus the file is read at most once after the last retry.
+func (s *Storage) storeSnapshot(ctx context.Context, lf *localFile, conf *StoreConfig) (types.SizedRef, error) {
+	retries := conf.Changes.retries()
+	for attempt := 1; ; attempt++ {
+		tmp, changed, err := snapshotFile(lf.path)
+		if err != nil {
+			return types.SizedRef{}, err
+		}
+		if changed && attempt <= retries {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			continue
+		}
+		defer func() {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}()
+		if changed {
+			if err = conf.fileChanged(lf.path, attempt); err != nil {
+				return types.SizedRef{}, err
+			}
+		}
+		c := *conf
+		return s.StoreBlob(ctx, tmp, &c)
+	}
+}
+
+// snapshotFile copies the file to a temporary file. It reports if the file was modified while it was copied.
+func snapshotFile(path string) (*os.File, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	tmp, err := ioutil.TempFile("", "cas_snapshot_")
+	if err != nil {
+		return nil, false, err
+	}
+	_, err = io.Copy(tmp, f)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, false, err
+	}
+	return tmp, fileChanged(path, fi), nil
+}
+
+// storeFileOnce stores the content of the file. It reports if a local file was modified while it was stored.
+func (s *Storage) storeFileOnce(ctx context.Context, fd FileDesc, conf *StoreConfig) (types.SizedRef, bool, error) {
 	// open the file, snapshot metadata
 	rc, xr, err := fd.Open()
 	if err != nil {
-		return types.SizedRef{}, err
+		return types.SizedRef{}, false, err
 	}
 	defer rc.Close()
 
 	// if we know the ref - check if we expect it, and if not - set as expected
 	if !xr.Ref.Zero() {
 		if err = conf.checkRef(xr); err != nil {
-			return types.SizedRef{}, fmt.Errorf("file %q: %v", fd.Name(), err)
+			return types.SizedRef{}, false, fmt.Errorf("file %q: %v", fd.Name(), err)
 		}
 		conf.Expect = xr
 	}
@@ -64,26 +176,26 @@ func (s *Storage) storeFileContent(ctx context.Context, fd FileDesc, conf *Store
 		if !xr.Ref.Zero() {
 			if conf.IndexOnly {
 				// if only indexing - return the response directly
-				return xr, nil
+				return xr, false, nil
 			}
 			// if storing, check if a blob store has this ref already
 			_, err := s.StatBlob(ctx, xr.Ref)
 			if err == nil {
-				return xr, nil
+				return xr, false, nil
 			}
 			// if not, continue as usual
 		}
 
 		if !conf.IndexOnly {
 			// if we are not indexing, storing a local file and the backend
-			// is a local FS, then try to import the file directly without copying it
+			// can import files, then try to import the file directly without copying it
 			if lf, ok := fd.(*localFile); ok {
-				if l, ok := s.st.(*local.Storage); ok {
+				if l, ok := s.st.(storage.FileImporter); ok {
 					// clone file, if possible
 					if sr, err := l.ImportFile(ctx, lf.path); err == nil {
 						// write resulting ref to source file, so we know it next time
 						fd.SetRef(sr)
-						return sr, nil
+						return sr, false, nil
 					}
 				}
 			}
@@ -91,13 +203,20 @@ func (s *Storage) storeFileContent(ctx context.Context, fd FileDesc, conf *Store
 	}
 
 	sr, err := s.StoreBlob(ctx, rc, conf)
-	if err != nil {
-		return types.SizedRef{}, err
+	if lf, ok := fd.(*localFile); ok && lf.fi != nil && fileChanged(lf.path, lf.fi) {
+		// the content might not match the cached ref or the size of the file
+		if err != nil {
+			return types.SizedRef{}, true, err
+		}
+		// don't cache the ref - it might not match the content of the file
+		return sr, true, nil
+	} else if err != nil {
+		return types.SizedRef{}, false, err
 	}
 	if conf.Split == nil {
 		fd.SetRef(sr)
 	}
-	return sr, nil
+	return sr, false, nil
 }
 
 func (s *Storage) storeDirList(ctx context.Context, list []schema.DirEntry) (SizedRef, Stats, error) {
@@ -140,14 +259,25 @@ func (s *Storage) storeDirJoin(ctx context.Context, refs []Ref, list []schema.Li
 	return sr, m, nil
 }
 
-func (s *Storage) storeDir(ctx context.Context, dir string, conf *StoreConfig) (SizedRef, Stats, error) {
+// storeDir stores a local directory. Rel is a slash-separated path of the directory relative to the stored root.
+func (s *Storage) storeDir(ctx context.Context, dir, rel string, depth int, conf *StoreConfig) (SizedRef, Stats, error) {
+	if depth == conf.Limits.maxDepth()+1 {
+		// only reported once for each deep subtree
+		if err := conf.warn(WarnDeepTree, dir, "directory is nested more than %d levels deep", depth-1); err != nil {
+			return SizedRef{}, nil, err
+		}
+	}
 	d, err := os.Open(dir)
 	if err != nil {
 		return SizedRef{}, nil, err
 	}
 	defer d.Close()
 
-	var base []schema.DirEntry
+	var (
+		base  []schema.DirEntry
+		seen  int
+		large = conf.Limits.maxDirEntries()
+	)
 	for {
 		buf, err := d.Readdir(maxDirEntries)
 		if err == io.EOF {
@@ -156,31 +286,80 @@ func (s *Storage) storeDir(ctx context.Context, dir string, conf *StoreConfig) (
 		} else if err != nil {
 			return SizedRef{}, nil, err
 		}
+		seen += len(buf)
+		if seen > large && seen-len(buf) <= large {
+			if err = conf.warn(WarnLargeDir, dir, "directory has more than %d entries", large); err != nil {
+				return SizedRef{}, nil, err
+			}
+		}
 		for _, fi := range buf {
 			if fi.Name() == DefaultDir {
 				continue
 			}
 			fpath := filepath.Join(dir, fi.Name())
+			frel := path.Join(rel, fi.Name())
+			if fi.Mode()&os.ModeSymlink != 0 && !conf.FollowLinks {
+				ent, err := s.storeLink(ctx, fpath, conf)
+				if err != nil {
+					return SizedRef{}, nil, err
+				}
+				setEntryMeta(ent, fi, conf)
+				base = append(base, *ent)
+				continue
+			} else if fi.Mode()&os.ModeSymlink != 0 {
+				if fi, err = os.Stat(fpath); err != nil {
+					return SizedRef{}, nil, err
+				}
+			}
 			if fi.IsDir() {
-				sr, st, err := s.storeDir(ctx, fpath, conf)
+				sr, st, err := s.storeDir(ctx, fpath, frel, depth+1, conf)
 				if err != nil {
 					return SizedRef{}, nil, err
 				}
-				base = append(base, schema.DirEntry{
+				ent := schema.DirEntry{
 					Ref: sr.Ref, Name: fi.Name(),
 					Stats: st,
-				})
+				}
+				setEntryMeta(&ent, fi, conf)
+				base = append(base, ent)
 			} else {
 				c := *conf
 				c.Expect = SizedRef{}
-				ent, err := s.storeAsFile(ctx, LocalFile(fpath), &c)
+				ent, err := s.storeAsFile(ctx, s.knownFile(ctx, fpath, frel, conf), &c)
 				if err != nil {
 					return SizedRef{}, nil, err
 				}
+				setEntryMeta(ent, fi, conf)
 				base = append(base, *ent)
 			}
 		}
 	}
+	return s.StoreDirEntries(ctx, base)
+}
+
+// storeLink stores a symbolic link without following it. The target is stored as a blob.
+func (s *Storage) storeLink(ctx context.Context, fpath string, conf *StoreConfig) (*schema.DirEntry, error) {
+	target, err := os.Readlink(fpath)
+	if err != nil {
+		return nil, err
+	}
+	sr, err := s.StoreBlob(ctx, strings.NewReader(target), &StoreConfig{IndexOnly: conf.IndexOnly})
+	if err != nil {
+		return nil, err
+	}
+	return &schema.DirEntry{
+		Ref:  sr.Ref,
+		Name: filepath.Base(fpath),
+		Stats: Stats{
+			schema.StatDataSize: sr.Size,
+		},
+		Link: target,
+	}, nil
+}
+
+// StoreDirEntries stores a directory with given entries. Entries are sorted by name.
+// It returns the ref of the directory and aggregated stats of its content.
+func (s *Storage) StoreDirEntries(ctx context.Context, base []schema.DirEntry) (SizedRef, Stats, error) {
 	sort.Slice(base, func(i, j int) bool {
 		return base[i].Name < base[j].Name
 	})
@@ -262,16 +441,26 @@ func (s *Storage) StoreAsFile(ctx context.Context, fd FileDesc, conf *StoreConfi
 }
 
 func (s *Storage) StoreFilePath(ctx context.Context, path string, conf *StoreConfig) (SizedRef, error) {
+	ctx, sp := storage.StartSpan(ctx, "cas.StoreFilePath", storage.Attribute{Key: attrPath, Value: path})
+	sr, err := s.storeFilePath(ctx, path, conf)
+	if err == nil {
+		sp.SetAttributes(storage.Attribute{Key: storage.AttrRef, Value: sr.Ref.String()})
+	}
+	storage.EndSpan(sp, err)
+	return sr, err
+}
+
+func (s *Storage) storeFilePath(ctx context.Context, path string, conf *StoreConfig) (SizedRef, error) {
 	conf = checkConfig(conf)
 	fi, err := os.Stat(path)
 	if err != nil {
 		return SizedRef{}, err
 	}
 	if fi.IsDir() {
-		sr, _, err := s.storeDir(ctx, path, conf)
+		sr, _, err := s.storeDir(ctx, path, "", 0, conf)
 		return sr, err
 	}
-	ent, err := s.storeAsFile(ctx, LocalFile(path), conf)
+	ent, err := s.storeAsFile(ctx, s.knownFile(ctx, path, filepath.Base(path), conf), conf)
 	if err != nil {
 		return SizedRef{}, err
 	}
@@ -279,8 +468,11 @@ func (s *Storage) StoreFilePath(ctx context.Context, path string, conf *StoreCon
 }
 
 type localFile struct {
-	path string
-	fi   os.FileInfo
+	s     *Storage // optional
+	ctx   context.Context
+	path  string
+	fi    os.FileInfo
+	known types.Ref // ref of the content from a checksum file; optional
 }
 
 func (f *localFile) Name() string {
@@ -299,9 +491,12 @@ func (f *localFile) Open() (io.ReadCloser, SizedRef, error) {
 	}
 	f.fi = st
 	sr := SizedRef{Size: uint64(st.Size())}
-	if xr, err := StatFile(context.Background(), fd); err == nil && xr.Size == sr.Size {
+	if xr, err := f.s.statFile(f.ctx, fd); err == nil && xr.Size == sr.Size {
 		sr.Ref = xr.Ref
 	}
+	if sr.Ref.Zero() {
+		sr.Ref = f.known
+	}
 	return fd, sr, nil
 }
 
@@ -311,5 +506,10 @@ func (f *localFile) SetRef(ref types.SizedRef) {
 		// all other checks happen at read time
 		return
 	}
-	_ = SaveRef(context.Background(), f.path, f.fi, ref.Ref)
+	fd, err := os.Open(f.path)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	_ = f.s.saveRefFile(f.ctx, fd, f.fi, ref.Ref)
 }
@@ -0,0 +1,185 @@
+package cas
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"time"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/types"
+)
+
+// ErrNoTime is returned when entries are filtered by time, but the tree was not stored as a commit.
+var ErrNoTime = errors.New("times are only known for commits")
+
+// FindOptions filters entries reported by Find.
+type FindOptions struct {
+	Name        string    // glob pattern that names of entries must match, see path.Match
+	Files, Dirs bool      // types of entries to report; all entries are reported if neither is set
+	LargerThan  uint64    // only report entries larger than this size
+	SmallerThan uint64    // only report entries smaller than this size, if not zero
+	NewerThan   time.Time // only search commits made after this time
+	OlderThan   time.Time // only search commits made before this time
+}
+
+// FoundEntry is an entry reported by Find.
+type FoundEntry struct {
+	Path   string           // slash-separated path relative to the root
+	Entry  *schema.DirEntry // entry of the parent directory
+	Dir    bool             // entry is a directory
+	Commit types.Ref        // commit that contains the entry; zero if the root is not a commit
+	Time   time.Time        // time of the commit
+}
+
+func (o *FindOptions) checkTime(t time.Time) bool {
+	if !o.NewerThan.IsZero() && !t.After(o.NewerThan) {
+		return false
+	}
+	if !o.OlderThan.IsZero() && !t.Before(o.OlderThan) {
+		return false
+	}
+	return true
+}
+
+type finder struct {
+	opts   FindOptions
+	fnc    func(e *FoundEntry) error
+	seen   map[string]struct{} // entries seen in previous commits, by path and ref; nil if not searching history
+	commit types.Ref
+	time   time.Time
+}
+
+func newFinder(opts *FindOptions, fnc func(e *FoundEntry) error) (*finder, error) {
+	f := &finder{fnc: fnc}
+	if opts != nil {
+		f.opts = *opts
+	}
+	if f.opts.Name != "" {
+		if _, err := path.Match(f.opts.Name, ""); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Find walks a tree (a directory or a commit) and calls fnc for all entries under dir that match the options.
+// Dir is a slash-separated path relative to the root; the whole tree is searched if it's empty.
+//
+// Subtrees are not read if their stats show that no file in them can be larger than LargerThan. Time filters
+// are applied to the time of the commit, thus Find returns ErrNoTime for trees that are not commits.
+func (s *Storage) Find(ctx context.Context, root types.Ref, dir string, opts *FindOptions, fnc func(e *FoundEntry) error) error {
+	f, err := newFinder(opts, fnc)
+	if err != nil {
+		return err
+	}
+	c, err := s.decodeCommit(ctx, root)
+	if err == errNotCommit {
+		if !f.opts.NewerThan.IsZero() || !f.opts.OlderThan.IsZero() {
+			return ErrNoTime
+		}
+	} else if err != nil {
+		return err
+	} else if !f.opts.checkTime(c.Time) {
+		return nil
+	} else {
+		f.commit, f.time = root, c.Time
+	}
+	return s.findIn(ctx, f, root, dir)
+}
+
+// FindHistory is like Find, but searches all commits of a pin, starting from the latest one. Commits outside
+// of the time range are skipped. Each version of an entry is reported once, for the latest commit that contains it,
+// and subtrees that did not change between commits are not searched again.
+func (s *Storage) FindHistory(ctx context.Context, pin string, dir string, opts *FindOptions, fnc func(e *FoundEntry) error) error {
+	f, err := newFinder(opts, fnc)
+	if err != nil {
+		return err
+	}
+	f.seen = make(map[string]struct{})
+	it := s.IterateCommits(ctx, pin)
+	defer it.Close()
+	for it.Next() {
+		c := it.Commit()
+		if !f.opts.checkTime(c.Time) {
+			continue
+		}
+		f.commit, f.time = it.Ref(), c.Time
+		if err = s.findIn(ctx, f, c.Root, dir); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// findIn searches the directory with a given path relative to the root.
+func (s *Storage) findIn(ctx context.Context, f *finder, root types.Ref, dir string) error {
+	ref := root
+	ent, err := s.Lookup(ctx, root, dir)
+	if err != nil {
+		return err
+	} else if ent != nil {
+		ref = ent.Ref
+	}
+	ents, err := s.ReadDir(ctx, ref)
+	if err != nil {
+		return err
+	}
+	return s.findDir(ctx, f, ents, path.Clean("/" + dir)[1:])
+}
+
+func (s *Storage) findDir(ctx context.Context, f *finder, ents []*schema.DirEntry, dir string) error {
+	for _, ent := range ents {
+		e := &FoundEntry{Path: path.Join(dir, ent.Name), Entry: ent, Commit: f.commit, Time: f.time}
+		if f.seen != nil {
+			key := e.Path + "\x00" + ent.Ref.String()
+			if _, ok := f.seen[key]; ok {
+				continue
+			}
+			f.seen[key] = struct{}{}
+		}
+		if sz, ok := ent.Stats[schema.StatDataSize]; ok && f.opts.LargerThan != 0 && sz <= f.opts.LargerThan {
+			// neither the entry nor any file in the subtree can be larger than its total size
+			continue
+		}
+		sub, err := s.ReadDir(ctx, ent.Ref)
+		if err == nil {
+			e.Dir = true
+		} else if err != ErrNotDir {
+			return err
+		}
+		if f.match(e) {
+			if err = f.fnc(e); err != nil {
+				return err
+			}
+		}
+		if !e.Dir {
+			continue
+		}
+		if err = s.findDir(ctx, f, sub, e.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *finder) match(e *FoundEntry) bool {
+	o := &f.opts
+	if o.Files != o.Dirs && e.Dir != o.Dirs {
+		return false
+	}
+	if o.Name != "" {
+		if ok, _ := path.Match(o.Name, e.Entry.Name); !ok {
+			return false
+		}
+	}
+	sz := e.Entry.Size()
+	if o.LargerThan != 0 && sz <= o.LargerThan {
+		return false
+	}
+	if o.SmallerThan != 0 && sz >= o.SmallerThan {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package cas_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+)
+
+func TestFind(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_find_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	files := map[string]string{
+		"a.iso":           strings.Repeat("a", 100),
+		"b.txt":           "b",
+		"small/c.iso":     "c",
+		"small/d.txt":     "d",
+		"large/e.iso":     strings.Repeat("e", 200),
+		"large/sub/f.iso": strings.Repeat("f", 50),
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+	sr, err := s.StoreFilePath(ctx, dir, nil)
+	require.NoError(t, err)
+
+	find := func(root cas.Ref, sub string, opts *cas.FindOptions) []string {
+		var out []string
+		err := s.Find(ctx, root, sub, opts, func(e *cas.FoundEntry) error {
+			out = append(out, e.Path)
+			return nil
+		})
+		require.NoError(t, err)
+		return out
+	}
+	require.Equal(t, []string{"a.iso", "large/e.iso", "large/sub/f.iso", "small/c.iso"},
+		find(sr.Ref, "", &cas.FindOptions{Name: "*.iso"}))
+	require.Equal(t, []string{"a.iso", "large", "large/e.iso", "large/sub", "large/sub/f.iso"},
+		find(sr.Ref, "", &cas.FindOptions{LargerThan: 10}))
+	require.Equal(t, []string{"large/e.iso"},
+		find(sr.Ref, "", &cas.FindOptions{LargerThan: 100, Files: true}))
+	require.Equal(t, []string{"large", "large/sub", "small"},
+		find(sr.Ref, "", &cas.FindOptions{Dirs: true}))
+	require.Equal(t, []string{"large/sub/f.iso"},
+		find(sr.Ref, "large/sub", &cas.FindOptions{SmallerThan: 100}))
+
+	err = s.Find(ctx, sr.Ref, "", &cas.FindOptions{NewerThan: time.Now()}, nil)
+	require.Equal(t, cas.ErrNoTime, err)
+
+	// search the history, reporting each version once
+	const pin = "root"
+	c1, err := s.Commit(ctx, pin, sr.Ref, "")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "large", "e.iso"), []byte("e2"), 0644))
+	sr, err = s.StoreFilePath(ctx, dir, nil)
+	require.NoError(t, err)
+	c2, err := s.Commit(ctx, pin, sr.Ref, "")
+	require.NoError(t, err)
+
+	findHist := func(opts *cas.FindOptions) []string {
+		var out []string
+		err := s.FindHistory(ctx, pin, "", opts, func(e *cas.FoundEntry) error {
+			id := "c1"
+			if e.Commit == c2.Ref {
+				id = "c2"
+			} else {
+				require.Equal(t, c1.Ref, e.Commit)
+			}
+			out = append(out, id+":"+e.Path)
+			return nil
+		})
+		require.NoError(t, err)
+		return out
+	}
+	require.Equal(t, []string{"c2:a.iso", "c2:large/e.iso", "c2:large/sub/f.iso", "c2:small/c.iso", "c1:large/e.iso"},
+		findHist(&cas.FindOptions{Name: "*.iso"}))
+	require.Equal(t, []string{"c1:large/e.iso"},
+		findHist(&cas.FindOptions{Name: "*.iso", LargerThan: 100}))
+
+	obj, err := s.DecodeSchema(ctx, c1.Ref)
+	require.NoError(t, err)
+	require.Equal(t, []string{"c2:a.iso", "c2:large/e.iso", "c2:large/sub/f.iso", "c2:small/c.iso"},
+		findHist(&cas.FindOptions{Name: "*.iso", NewerThan: obj.(*schema.Commit).Time}))
+}
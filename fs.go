@@ -0,0 +1,297 @@
+package cas
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+)
+
+// SnapshotLatest is the name of the directory that contains the latest snapshot in SnapshotFS.
+const SnapshotLatest = "latest"
+
+// FileSystem returns a read-only view of a stored file or directory. It can be served with http.FileServer.
+func (s *Storage) FileSystem(ctx context.Context, root Ref) http.FileSystem {
+	return &treeFS{s: s, ctx: ctx, root: root}
+}
+
+// SnapshotFS returns a read-only view of all commits of a pin.
+//
+// Each commit is exposed as a top-level directory named after the commit time (RFC 3339, UTC), thus any past
+// snapshot can be browsed at "/2018-06-01T12:00:00Z/path". The latest commit is also available as "latest".
+// The list of commits is loaded when the file system is created.
+func (s *Storage) SnapshotFS(ctx context.Context, pin string) (http.FileSystem, error) {
+	fs := &snapshotFS{s: s, ctx: ctx, byName: make(map[string]*snapshot)}
+	it := s.IterateCommits(ctx, pin)
+	defer it.Close()
+	for it.Next() {
+		c := it.Commit()
+		name := c.Time.UTC().Format(time.RFC3339)
+		if _, ok := fs.byName[name]; ok {
+			// multiple commits in the same second
+			for i := 1; ; i++ {
+				alt := name + "." + strconv.Itoa(i)
+				if _, ok := fs.byName[alt]; !ok {
+					name = alt
+					break
+				}
+			}
+		}
+		snap := &snapshot{name: name, ref: it.Ref(), commit: c}
+		if len(fs.list) == 0 {
+			fs.byName[SnapshotLatest] = snap
+		}
+		fs.list = append(fs.list, snap)
+		fs.byName[name] = snap
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+type snapshot struct {
+	name   string
+	ref    Ref
+	commit *schema.Commit
+}
+
+type snapshotFS struct {
+	s      *Storage
+	ctx    context.Context
+	list   []*snapshot // latest first
+	byName map[string]*snapshot
+}
+
+func (fs *snapshotFS) Open(name string) (http.File, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		var ents []os.FileInfo
+		if len(fs.list) != 0 {
+			ents = append(ents, &fileInfo{name: SnapshotLatest, dir: true, mtime: fs.list[0].commit.Time})
+		}
+		for _, snap := range fs.list {
+			ents = append(ents, &fileInfo{name: snap.name, dir: true, mtime: snap.commit.Time})
+		}
+		sort.Slice(ents, func(i, j int) bool {
+			return ents[i].Name() < ents[j].Name()
+		})
+		return &virtualDir{fileInfo: fileInfo{name: "/", dir: true}, ents: ents}, nil
+	}
+	i := strings.IndexByte(name, '/')
+	sname, sub := name, ""
+	if i >= 0 {
+		sname, sub = name[:i], name[i:]
+	}
+	snap, ok := fs.byName[sname]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	tfs := &treeFS{s: fs.s, ctx: fs.ctx, root: snap.commit.Root, mtime: snap.commit.Time}
+	f, err := tfs.Open(sub)
+	if err == nil && sub == "" {
+		if d, ok := f.(*treeDir); ok {
+			d.fi.name = sname
+		}
+	}
+	return f, err
+}
+
+// treeFS implements http.FileSystem for a stored file or directory.
+type treeFS struct {
+	s     *Storage
+	ctx   context.Context
+	root  Ref
+	mtime time.Time // reported for all files
+}
+
+func (fs *treeFS) Open(name string) (http.File, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	ref, size := fs.root, uint64(0)
+	base := "/"
+	if name != "" {
+		ent, err := fs.s.Lookup(fs.ctx, fs.root, name)
+		if err != nil {
+			return nil, err
+		}
+		ref, size = ent.Ref, ent.Size()
+		base = path.Base(name)
+	}
+	ents, err := fs.s.ReadDir(fs.ctx, ref)
+	if err == nil {
+		return &treeDir{fs: fs, fi: fileInfo{name: base, dir: true, mtime: fs.mtime}, ents: ents}, nil
+	} else if err != ErrNotDir {
+		return nil, err
+	}
+	if size == 0 && name == "" {
+		// size of the root is unknown
+		br, sz, err := fs.s.OpenFile(fs.ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		return &treeFile{fs: fs, ref: ref, br: br, fi: fileInfo{name: base, size: int64(sz), mtime: fs.mtime}}, nil
+	}
+	return &treeFile{fs: fs, ref: ref, fi: fileInfo{name: base, size: int64(size), mtime: fs.mtime}}, nil
+}
+
+// fileInfo implements os.FileInfo for stored files.
+type fileInfo struct {
+	name  string
+	size  int64
+	dir   bool
+	mtime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+// virtualDir is a directory with a fixed list of entries.
+type virtualDir struct {
+	fileInfo
+	ents []os.FileInfo
+	off  int
+}
+
+func (d *virtualDir) Close() error                   { return nil }
+func (d *virtualDir) Read(p []byte) (int, error)     { return 0, os.ErrInvalid }
+func (d *virtualDir) Seek(int64, int) (int64, error) { return 0, os.ErrInvalid }
+func (d *virtualDir) Stat() (os.FileInfo, error)     { return &d.fileInfo, nil }
+func (d *virtualDir) Readdir(n int) ([]os.FileInfo, error) {
+	return readdir(d.ents, &d.off, n)
+}
+
+// readdir implements os.File.Readdir semantics for a list of entries.
+func readdir(ents []os.FileInfo, off *int, n int) ([]os.FileInfo, error) {
+	rest := ents[*off:]
+	if n <= 0 {
+		*off = len(ents)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	*off += n
+	return rest[:n], nil
+}
+
+// treeDir is a stored directory.
+type treeDir struct {
+	fs   *treeFS
+	fi   fileInfo
+	ents []*schema.DirEntry
+	off  int
+}
+
+func (d *treeDir) Close() error                   { return nil }
+func (d *treeDir) Read(p []byte) (int, error)     { return 0, os.ErrInvalid }
+func (d *treeDir) Seek(int64, int) (int64, error) { return 0, os.ErrInvalid }
+func (d *treeDir) Stat() (os.FileInfo, error)     { return &d.fi, nil }
+
+func (d *treeDir) Readdir(n int) ([]os.FileInfo, error) {
+	rest := d.ents[d.off:]
+	if n > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		} else if n < len(rest) {
+			rest = rest[:n]
+		}
+	}
+	out := make([]os.FileInfo, 0, len(rest))
+	for _, e := range rest {
+		fi := &fileInfo{name: e.Name, size: int64(e.Size()), mtime: d.fs.mtime}
+		if _, err := d.fs.s.ReadDir(d.fs.ctx, e.Ref); err == nil {
+			fi.dir, fi.size = true, 0
+		} else if err != ErrNotDir {
+			return out, err
+		}
+		out = append(out, fi)
+		d.off++
+	}
+	return out, nil
+}
+
+// treeFile is a stored file. It's opened for random access on the first read.
+type treeFile struct {
+	fs  *treeFS
+	ref Ref
+	fi  fileInfo
+
+	br  storage.BlobReader
+	pos int64 // offset requested by Seek
+}
+
+func (f *treeFile) Stat() (os.FileInfo, error) { return &f.fi, nil }
+
+func (f *treeFile) Readdir(n int) ([]os.FileInfo, error) {
+	return nil, ErrNotDir
+}
+
+func (f *treeFile) Seek(off int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		off += f.pos
+	case io.SeekEnd:
+		off += f.fi.size
+	default:
+		return f.pos, os.ErrInvalid
+	}
+	if off < 0 {
+		return f.pos, os.ErrInvalid
+	}
+	f.pos = off
+	return off, nil
+}
+
+func (f *treeFile) Read(p []byte) (int, error) {
+	if f.pos >= f.fi.size {
+		return 0, io.EOF
+	}
+	if f.br == nil {
+		br, _, err := f.fs.s.OpenFile(f.fs.ctx, f.ref)
+		if err != nil {
+			return 0, err
+		}
+		f.br = br
+	}
+	if rest := f.fi.size - f.pos; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := f.br.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n != 0 {
+		err = nil
+	} else if err == io.EOF && f.pos < f.fi.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (f *treeFile) Close() error {
+	if f.br != nil {
+		f.br.Close()
+		f.br = nil
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package cas_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage"
+)
+
+func readFS(t testing.TB, fs http.FileSystem, name string) string {
+	f, err := fs.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestSnapshotFS(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_snap_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	const pin = "site"
+	var roots []cas.Ref
+	for _, data := range []string{"v1", "v2", "v3"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub", "a.txt"), []byte(data), 0644))
+		sr, err := s.StoreFilePath(ctx, dir, nil)
+		require.NoError(t, err)
+		roots = append(roots, sr.Ref)
+		_, err = s.Commit(ctx, pin, sr.Ref, data)
+		require.NoError(t, err)
+	}
+	// same root - no new commit
+	head, err := s.GetPin(ctx, pin)
+	require.NoError(t, err)
+	sr, err := s.Commit(ctx, pin, roots[2], "again")
+	require.NoError(t, err)
+	require.Equal(t, head, sr.Ref)
+
+	var got []cas.Ref
+	it := s.IterateCommits(ctx, pin)
+	for it.Next() {
+		got = append(got, it.Commit().Root)
+	}
+	require.NoError(t, it.Err())
+	it.Close()
+	require.Equal(t, []cas.Ref{roots[2], roots[1], roots[0]}, got)
+
+	fs, err := s.SnapshotFS(ctx, pin)
+	require.NoError(t, err)
+
+	d, err := fs.Open("/")
+	require.NoError(t, err)
+	ents, err := d.Readdir(-1)
+	require.NoError(t, err)
+	d.Close()
+	// commits may happen in the same second, so names can have a suffix
+	var names []string
+	for _, e := range ents {
+		require.True(t, e.IsDir())
+		names = append(names, e.Name())
+	}
+	require.Len(t, names, 4)
+	require.Equal(t, cas.SnapshotLatest, names[3])
+	require.Equal(t, "v3", readFS(t, fs, "/latest/sub/a.txt"))
+	var contents []string
+	for _, name := range names[:3] {
+		contents = append(contents, readFS(t, fs, "/"+name+"/sub/a.txt"))
+	}
+	require.ElementsMatch(t, []string{"v1", "v2", "v3"}, contents)
+
+	_, err = fs.Open("/latest/sub/missing")
+	require.True(t, os.IsNotExist(err))
+
+	f, err := fs.Open("/latest/sub/a.txt")
+	require.NoError(t, err)
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), fi.Size())
+	_, err = f.Seek(1, 0)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "3", string(data))
+	f.Close()
+}
@@ -0,0 +1,307 @@
+// Package gc implements mark-and-sweep garbage collection of blobs.
+//
+// All blobs reachable from pins (and optional extra roots) are marked by following references of schema blobs,
+// including the history of commits. All other blobs are removed from the storage. Expired pins are not used as roots.
+//
+// If the storage maintains a reverse index of references (see storage.RefIndexer), the collection doesn't
+// need to read all reachable schema blobs. Instead, blobs that are neither referenced nor used as roots
+// are removed, together with blobs that are only referenced by removed blobs.
+//
+// The collection is not safe to run concurrently with writes: a blob that was stored, but not yet pinned
+// or referenced by a pinned object, will be removed.
+package gc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// ErrNoDelete is returned when the storage doesn't support blob deletion.
+var ErrNoDelete = errors.New("gc: storage does not support blob deletion")
+
+// Options controls the garbage collection.
+type Options struct {
+	// DryRun only reports blobs that would be removed.
+	DryRun bool
+	// Roots is an optional set of additional blobs that are considered reachable, together with all blobs
+	// referenced by them.
+	Roots []types.Ref
+	// OnSweep is called for each unreachable blob, before it's removed.
+	OnSweep func(sr types.SizedRef)
+	// NoIndex disables the use of the reverse index of references, thus all reachable blobs are marked
+	// by reading schema blobs.
+	NoIndex bool
+}
+
+// RawPinIterator is an optional interface for storages that resolve values of pins, for example to verify signed pins.
+// Such storages must list pins as they are stored, since objects that pins point to would be removed otherwise.
+type RawPinIterator interface {
+	// IterateRawPins lists pins without resolving their values.
+	IterateRawPins(ctx context.Context) storage.PinIterator
+}
+
+// Report is the result of the garbage collection.
+type Report struct {
+	DryRun    bool
+	Pins      uint64 // number of pins used as roots
+	Reachable uint64 // number of reachable blobs that exist in the storage
+	Missing   uint64 // number of reachable blobs that are missing in the storage; only counted without the index
+	Blobs     uint64 // total number of blobs in the storage
+	Swept     uint64 // number of removed blobs (or blobs that would be removed in dry-run mode)
+	Freed     uint64 // total size of removed blobs
+	Indexed   bool   // the reverse index of references was used
+	Time      time.Time
+	Duration  time.Duration
+}
+
+// Run removes all blobs that are not reachable from pins. In dry-run mode the storage is not modified,
+// but the report still includes the number and the size of blobs that would be removed.
+//
+// The storage must implement storage.BlobDeleter, unless the dry-run mode is used.
+func Run(ctx context.Context, s storage.Storage, opts *Options) (*Report, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	rep := &Report{DryRun: opts.DryRun, Time: time.Now()}
+	del, ok := s.(storage.BlobDeleter)
+	if !ok && !opts.DryRun {
+		return nil, ErrNoDelete
+	}
+	roots := make(map[types.Ref]struct{})
+	var pit storage.PinIterator
+	if rp, ok := s.(RawPinIterator); ok {
+		pit = rp.IterateRawPins(ctx)
+	} else {
+		pit = s.IteratePins(ctx)
+	}
+	for pit.Next() {
+		p := pit.Pin()
+		if expired, err := storage.PinExpired(ctx, s, p.Name, rep.Time); err != nil {
+			pit.Close()
+			return nil, err
+		} else if expired {
+			continue
+		}
+		rep.Pins++
+		roots[p.Ref] = struct{}{}
+	}
+	err := pit.Err()
+	pit.Close()
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range opts.Roots {
+		roots[ref] = struct{}{}
+	}
+	// collect all blobs first, since not all storages allow removal while listing
+	var blobs []types.SizedRef
+	it := s.IterateBlobs(ctx)
+	for it.Next() {
+		blobs = append(blobs, it.SizedRef())
+	}
+	err = it.Err()
+	it.Close()
+	if err != nil {
+		return nil, err
+	}
+	rep.Blobs = uint64(len(blobs))
+
+	var sweep []types.SizedRef
+	if ri, ok := s.(storage.RefIndexer); ok && !opts.NoIndex {
+		sweep, err = sweepIndexed(ctx, s, ri, roots, blobs)
+		if err == nil {
+			rep.Indexed = true
+		} else if err != storage.ErrNotSupported {
+			return nil, err
+		}
+	}
+	if !rep.Indexed {
+		m := NewMarker(s)
+		for ref := range roots {
+			if err = m.Mark(ctx, ref); err != nil {
+				return nil, err
+			}
+		}
+		rep.Missing = m.Missing()
+		for _, sr := range blobs {
+			if !m.Marked(sr.Ref) {
+				sweep = append(sweep, sr)
+			}
+		}
+	}
+	rep.Reachable = rep.Blobs - uint64(len(sweep))
+	for _, sr := range sweep {
+		if opts.OnSweep != nil {
+			opts.OnSweep(sr)
+		}
+		if !opts.DryRun {
+			err = del.DeleteBlob(ctx, sr.Ref)
+			if err == storage.ErrNotFound {
+				continue
+			} else if err == storage.ErrNotSupported {
+				return nil, ErrNoDelete
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		rep.Swept++
+		rep.Freed += sr.Size
+	}
+	rep.Duration = time.Since(rep.Time)
+	return rep, nil
+}
+
+// sweepIndexed finds unreachable blobs using the reverse index of references.
+//
+// Blobs that are not roots and have no referrers are unreachable. When a schema blob is removed,
+// blobs referenced by it become unreachable as well, if all their referrers were removed.
+func sweepIndexed(ctx context.Context, s storage.BlobSource, ri storage.RefIndexer, roots map[types.Ref]struct{}, blobs []types.SizedRef) ([]types.SizedRef, error) {
+	sizes := make(map[types.Ref]uint64, len(blobs))
+	for _, sr := range blobs {
+		sizes[sr.Ref] = sr.Size
+	}
+	var (
+		sweep []types.SizedRef
+		queue []types.Ref
+	)
+	swept := make(map[types.Ref]struct{})
+	add := func(ref types.Ref) {
+		swept[ref] = struct{}{}
+		sweep = append(sweep, types.SizedRef{Ref: ref, Size: sizes[ref]})
+		queue = append(queue, ref)
+	}
+	for _, sr := range blobs {
+		if _, ok := roots[sr.Ref]; ok {
+			continue
+		}
+		n, err := ri.RefCount(ctx, sr.Ref)
+		if err != nil {
+			return nil, err
+		} else if n == 0 {
+			add(sr.Ref)
+		}
+	}
+	m := NewMarker(s)
+	for len(queue) != 0 {
+		ref := queue[0]
+		queue = queue[1:]
+		obj, err := m.decode(ctx, ref)
+		if err == storage.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if obj == nil {
+			continue
+		}
+	refs:
+		for _, r := range obj.References() {
+			if _, ok := sizes[r]; !ok {
+				continue // missing
+			} else if _, ok = roots[r]; ok {
+				continue
+			} else if _, ok = swept[r]; ok {
+				continue
+			}
+			referrers, err := ri.Referrers(ctx, r)
+			if err != nil {
+				return nil, err
+			}
+			for _, r2 := range referrers {
+				if _, ok := swept[r2]; !ok {
+					continue refs
+				}
+			}
+			add(r)
+		}
+	}
+	return sweep, nil
+}
+
+// Marker computes a set of reachable blobs by walking references of schema blobs.
+type Marker struct {
+	s       storage.BlobSource
+	idx     storage.BlobIndexer // optional
+	marked  map[types.Ref]struct{}
+	missing uint64
+}
+
+// NewMarker creates a new marker for the storage. If the storage implements storage.BlobIndexer,
+// it will be used to skip data blobs without reading them.
+func NewMarker(s storage.BlobSource) *Marker {
+	idx, _ := s.(storage.BlobIndexer)
+	return &Marker{s: s, idx: idx, marked: make(map[types.Ref]struct{})}
+}
+
+// Marked checks if the blob is reachable from any of the marked roots.
+func (m *Marker) Marked(ref types.Ref) bool {
+	_, ok := m.marked[ref]
+	return ok
+}
+
+// Missing returns the number of reachable blobs that don't exist in the storage.
+func (m *Marker) Missing() uint64 {
+	return m.missing
+}
+
+// Mark marks the blob and all blobs referenced by it as reachable.
+func (m *Marker) Mark(ctx context.Context, ref types.Ref) error {
+	stack := []types.Ref{ref}
+	for len(stack) != 0 {
+		ref := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if ref.Zero() || m.Marked(ref) {
+			continue
+		}
+		m.marked[ref] = struct{}{}
+		obj, err := m.decode(ctx, ref)
+		if err == storage.ErrNotFound {
+			m.missing++
+			continue
+		} else if err != nil {
+			return err
+		} else if obj == nil {
+			continue
+		}
+		stack = append(stack, obj.References()...)
+	}
+	return nil
+}
+
+// decode reads a schema blob. It returns a nil object for data blobs.
+func (m *Marker) decode(ctx context.Context, ref types.Ref) (schema.Object, error) {
+	var (
+		rc  io.ReadCloser
+		err error
+	)
+	if m.idx != nil {
+		rc, _, err = m.idx.FetchSchema(ctx, ref)
+	} else {
+		rc, _, err = m.s.FetchBlob(ctx, ref)
+	}
+	if err == schema.ErrNotSchema {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	br := bufio.NewReader(rc)
+	if p, _ := br.Peek(schema.MagicSize); !schema.IsSchema(p) {
+		return nil, nil
+	}
+	obj, err := schema.Decode(br)
+	if err == schema.ErrNotSchema {
+		return nil, nil
+	} else if err != nil {
+		// references of this blob are unknown, thus it's not safe to continue
+		return nil, fmt.Errorf("gc: cannot decode schema blob %v: %v", ref, err)
+	}
+	return obj, nil
+}
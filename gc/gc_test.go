@@ -0,0 +1,129 @@
+package gc
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/local"
+	"github.com/dennwc/cas/types"
+)
+
+func TestGC(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewInMemory()
+
+	write := func(data string) types.SizedRef {
+		sr, err := storage.WriteBytes(ctx, s, []byte(data))
+		require.NoError(t, err)
+		return sr
+	}
+	writeSchema := func(obj schema.Object) types.SizedRef {
+		buf := new(bytes.Buffer)
+		require.NoError(t, schema.Encode(buf, obj))
+		return write(buf.String())
+	}
+	v1, v2 := write("v1"), write("v2")
+	c1 := writeSchema(&schema.Commit{Root: v1.Ref, Time: time.Unix(1, 0).UTC()})
+	c2 := writeSchema(&schema.Commit{Root: v2.Ref, Parent: &c1.Ref, Time: time.Unix(2, 0).UTC()})
+	require.NoError(t, s.SetPin(ctx, "root", c2.Ref))
+
+	root := write("root")
+	garbage1, garbage2 := write("garbage"), write("more garbage")
+	exp := garbage1.Size + garbage2.Size
+
+	var swept []types.SizedRef
+	rep, err := Run(ctx, s, &Options{
+		DryRun: true, Roots: []types.Ref{root.Ref},
+		OnSweep: func(sr types.SizedRef) {
+			swept = append(swept, sr)
+		},
+	})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []types.SizedRef{garbage1, garbage2}, swept)
+	require.Equal(t, uint64(1), rep.Pins)
+	require.Equal(t, uint64(7), rep.Blobs)
+	require.Equal(t, uint64(5), rep.Reachable)
+	require.Equal(t, uint64(2), rep.Swept)
+	require.Equal(t, exp, rep.Freed)
+	_, err = s.StatBlob(ctx, garbage1.Ref)
+	require.NoError(t, err, "dry run should not remove blobs")
+
+	rep, err = Run(ctx, s, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), rep.Swept)
+	require.Equal(t, exp+root.Size, rep.Freed)
+	for _, sr := range []types.SizedRef{garbage1, garbage2, root} {
+		_, err = s.StatBlob(ctx, sr.Ref)
+		require.Equal(t, storage.ErrNotFound, err)
+	}
+	// history is kept
+	for _, sr := range []types.SizedRef{v1, v2, c1, c2} {
+		_, err = s.StatBlob(ctx, sr.Ref)
+		require.NoError(t, err)
+	}
+}
+
+func TestGCIndexed(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_gc_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := local.New(dir, true)
+	require.NoError(t, err)
+	defer s.Close()
+
+	write := func(data string) types.SizedRef {
+		sr, err := storage.WriteBytes(ctx, s, []byte(data))
+		require.NoError(t, err)
+		return sr
+	}
+	writeSchema := func(obj schema.Object) types.SizedRef {
+		buf := new(bytes.Buffer)
+		require.NoError(t, schema.Encode(buf, obj))
+		return write(buf.String())
+	}
+	v1, v2 := write("v1"), write("v2")
+	c1 := writeSchema(&schema.Commit{Root: v1.Ref, Time: time.Unix(1, 0).UTC()})
+	c2 := writeSchema(&schema.Commit{Root: v2.Ref, Parent: &c1.Ref, Time: time.Unix(2, 0).UTC()})
+	require.NoError(t, s.SetPin(ctx, "root", c2.Ref))
+
+	// garbage tree, including a blob that is shared with the pinned one
+	g1 := write("garbage")
+	gm := writeSchema(&schema.Multipart{Parts: []types.SizedRef{g1, v1}})
+	gcom := writeSchema(&schema.Commit{Root: gm.Ref, Time: time.Unix(3, 0).UTC()})
+
+	sweep := func(opts *Options) []types.SizedRef {
+		var swept []types.SizedRef
+		opts.DryRun = true
+		opts.OnSweep = func(sr types.SizedRef) {
+			swept = append(swept, sr)
+		}
+		_, err := Run(ctx, s, opts)
+		require.NoError(t, err)
+		return swept
+	}
+	exp := []types.SizedRef{g1, gm, gcom}
+	require.ElementsMatch(t, exp, sweep(&Options{NoIndex: true}))
+	require.ElementsMatch(t, exp, sweep(&Options{}))
+
+	rep, err := Run(ctx, s, nil)
+	require.NoError(t, err)
+	require.True(t, rep.Indexed)
+	require.Equal(t, uint64(3), rep.Swept)
+	require.Equal(t, uint64(4), rep.Reachable)
+	for _, sr := range exp {
+		_, err = s.StatBlob(ctx, sr.Ref)
+		require.Equal(t, storage.ErrNotFound, err)
+	}
+	refs, err := s.Referrers(ctx, v1.Ref)
+	require.NoError(t, err)
+	require.Equal(t, []types.Ref{c1.Ref}, refs)
+}
@@ -1,16 +1,31 @@
 module github.com/dennwc/cas
 
-go 1.12
+go 1.20
 
 require (
 	cloud.google.com/go v0.37.4
 	github.com/dennwc/ioctl v1.0.0
 	github.com/dustin/go-humanize v1.0.0
-	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/pkg/xattr v0.4.1
 	github.com/spf13/cobra v0.0.3
 	github.com/spf13/pflag v1.0.3
 	github.com/stretchr/testify v1.3.0
+	golang.org/x/net v0.0.0-20190311183353-d8887717615a
 	golang.org/x/sys v0.0.0-20190426135247-a129542de9ae
 	google.golang.org/api v0.4.0
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/golang/protobuf v1.2.0 // indirect
+	github.com/googleapis/gax-go/v2 v2.0.4 // indirect
+	github.com/hashicorp/golang-lru v0.5.0 // indirect
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	go.opencensus.io v0.21.0 // indirect
+	golang.org/x/oauth2 v0.0.0-20190226205417-e64efc72b421 // indirect
+	golang.org/x/text v0.3.1-0.20180807135948-17ff2d5776d2 // indirect
+	google.golang.org/genproto v0.0.0-20190404172233-64821d5d2107 // indirect
+	google.golang.org/grpc v1.19.0 // indirect
+)
@@ -0,0 +1,428 @@
+// Package goproxy implements Go module proxy protocol (GOPROXY) backed by CAS.
+//
+// Module zips and go.mod files are stored as regular blobs, thus identical files are deduplicated
+// and verified by CAS. Each module version is described by a schema object that also records
+// the go.sum hashes of the module.
+package goproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+func init() {
+	schema.RegisterName(versionType, &Version{})
+}
+
+const versionType = "go:ModuleVersion"
+
+// Version is a stored version of a Go module.
+type Version struct {
+	Module  string         `json:"module"`
+	Version string         `json:"version"`
+	Time    time.Time      `json:"time"`
+	Mod     types.SizedRef `json:"mod"`
+	Zip     types.SizedRef `json:"zip"`
+	ModSum  string         `json:"mod_sum,omitempty"` // go.sum hash of go.mod file
+	ZipSum  string         `json:"zip_sum,omitempty"` // go.sum hash of module content
+}
+
+func (v *Version) References() []types.Ref {
+	return []types.Ref{v.Mod.Ref, v.Zip.Ref}
+}
+
+// info is a version info returned by the proxy.
+type info struct {
+	Version string
+	Time    time.Time
+}
+
+// Options for the module proxy.
+type Options struct {
+	// Upstream is the URL of the proxy used to fetch modules that are not in CAS.
+	// If not set, only modules already stored in CAS are served.
+	Upstream string
+	// Client is the HTTP client used to access the upstream. http.DefaultClient is used if not set.
+	Client *http.Client
+}
+
+// NewProxy creates a Go module proxy backed by CAS. It loads an index of stored modules.
+func NewProxy(ctx context.Context, s *cas.Storage, opts *Options) (*Proxy, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	p := &Proxy{
+		s:        s,
+		upstream: strings.TrimSuffix(opts.Upstream, "/"),
+		cli:      opts.Client,
+		mods:     make(map[string]map[string]types.Ref),
+	}
+	if p.cli == nil {
+		p.cli = http.DefaultClient
+	}
+	it := s.IterateSchema(ctx, versionType)
+	defer it.Close()
+	for it.Next() {
+		obj, err := it.Decode()
+		if err != nil {
+			return nil, err
+		}
+		v, ok := obj.(*Version)
+		if !ok {
+			return nil, fmt.Errorf("unexpected schema type: %T", obj)
+		}
+		p.addVersion(it.SchemaRef().Ref, v)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+var _ http.Handler = (*Proxy)(nil)
+
+// Proxy serves Go modules stored in CAS.
+type Proxy struct {
+	s        *cas.Storage
+	upstream string
+	cli      *http.Client
+
+	mu   sync.RWMutex
+	mods map[string]map[string]types.Ref // module -> version -> ref
+}
+
+func (p *Proxy) addVersion(ref types.Ref, v *Version) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	m := p.mods[v.Module]
+	if m == nil {
+		m = make(map[string]types.Ref)
+		p.mods[v.Module] = m
+	}
+	m[v.Version] = ref
+}
+
+// Versions returns all stored versions of a module.
+func (p *Proxy) Versions(module string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	m := p.mods[module]
+	out := make([]string, 0, len(m))
+	for v := range m {
+		out = append(out, v)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Lookup finds a stored module version. It returns storage.ErrNotFound if the version is not in CAS.
+func (p *Proxy) Lookup(ctx context.Context, module, version string) (*Version, error) {
+	p.mu.RLock()
+	ref, ok := p.mods[module][version]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	obj, err := p.s.DecodeSchema(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := obj.(*Version)
+	if !ok {
+		return nil, fmt.Errorf("unexpected schema type: %T", obj)
+	}
+	return v, nil
+}
+
+// Store adds a module version to CAS. The zip file must be a valid module zip.
+func (p *Proxy) Store(ctx context.Context, module, version string, ts time.Time, mod []byte, zip io.Reader) (*Version, error) {
+	v := &Version{Module: module, Version: version, Time: ts.UTC()}
+	var err error
+	v.ModSum, err = hashMod(mod)
+	if err != nil {
+		return nil, err
+	}
+	v.Mod, err = p.s.StoreBlob(ctx, bytes.NewReader(mod), nil)
+	if err != nil {
+		return nil, err
+	}
+	// zip needs random access to compute the hash
+	f, err := ioutil.TempFile("", "cas_gomod_")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	size, err := io.Copy(f, zip)
+	if err != nil {
+		return nil, err
+	}
+	v.ZipSum, err = hashZip(f, size, module+"@"+version+"/")
+	if err != nil {
+		return nil, fmt.Errorf("invalid module zip for %s@%s: %v", module, version, err)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	v.Zip, err = p.s.StoreBlob(ctx, f, nil)
+	if err != nil {
+		return nil, err
+	}
+	sr, err := p.s.StoreSchema(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	p.addVersion(sr.Ref, v)
+	return v, nil
+}
+
+// errNotFound is returned when the module doesn't exist upstream.
+type errNotFound struct {
+	msg string
+}
+
+func (e *errNotFound) Error() string {
+	return e.msg
+}
+
+// fetchUpstream sends a GET request to the upstream proxy.
+func (p *Proxy) fetchUpstream(ctx context.Context, path string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", p.upstream+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	resp, err := p.cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound, http.StatusGone:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, &errNotFound{msg: string(msg)}
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("upstream: unexpected status: %v", resp.Status)
+}
+
+func (p *Proxy) fetchUpstreamBytes(ctx context.Context, path string) ([]byte, error) {
+	rc, err := p.fetchUpstream(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// Fetch returns a stored module version, or fetches it from the upstream proxy and stores it in CAS.
+func (p *Proxy) Fetch(ctx context.Context, module, version string) (*Version, error) {
+	v, err := p.Lookup(ctx, module, version)
+	if err != storage.ErrNotFound || p.upstream == "" {
+		return v, err
+	}
+	emod, err := EscapePath(module)
+	if err != nil {
+		return nil, err
+	}
+	evers, err := EscapeVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	pref := "/" + emod + "/@v/" + evers
+	data, err := p.fetchUpstreamBytes(ctx, pref+".info")
+	if err != nil {
+		return nil, err
+	}
+	var inf info
+	if err = json.Unmarshal(data, &inf); err != nil {
+		return nil, err
+	} else if inf.Version != version {
+		// TODO: resolve queries like branch names
+		return nil, &errNotFound{msg: fmt.Sprintf("%s@%s: not a canonical version", module, version)}
+	}
+	mod, err := p.fetchUpstreamBytes(ctx, pref+".mod")
+	if err != nil {
+		return nil, err
+	}
+	zip, err := p.fetchUpstream(ctx, pref+".zip")
+	if err != nil {
+		return nil, err
+	}
+	defer zip.Close()
+	return p.Store(ctx, module, version, inf.Time, mod, zip)
+}
+
+// ServeHTTP implements GOPROXY protocol.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	i := strings.Index(path, "/@")
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	module, err := UnescapePath(path[:i])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	ctx := r.Context()
+	rest := path[i+1:]
+	if rest == "@latest" {
+		p.serveLatest(w, r, module)
+		return
+	}
+	if !strings.HasPrefix(rest, "@v/") {
+		http.NotFound(w, r)
+		return
+	}
+	rest = strings.TrimPrefix(rest, "@v/")
+	if rest == "list" {
+		p.serveList(w, r, module)
+		return
+	}
+	j := strings.LastIndex(rest, ".")
+	if j < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	version, err := UnescapeVersion(rest[:j])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	ext := rest[j+1:]
+	if ext != "info" && ext != "mod" && ext != "zip" {
+		http.NotFound(w, r)
+		return
+	}
+	v, err := p.Fetch(ctx, module, version)
+	if err != nil {
+		p.serveError(w, err)
+		return
+	}
+	switch ext {
+	case "info":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info{Version: v.Version, Time: v.Time})
+	case "mod":
+		p.serveBlob(w, r, v.Mod, "text/plain; charset=UTF-8")
+	case "zip":
+		p.serveBlob(w, r, v.Zip, "application/zip")
+	}
+}
+
+func (p *Proxy) serveError(w http.ResponseWriter, err error) {
+	switch err := err.(type) {
+	case *errNotFound:
+		http.Error(w, err.msg, http.StatusNotFound)
+		return
+	}
+	if err == storage.ErrNotFound {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+func (p *Proxy) serveBlob(w http.ResponseWriter, r *http.Request, sr types.SizedRef, ctype string) {
+	rc, _, err := p.s.FetchBlob(r.Context(), sr.Ref)
+	if err != nil {
+		p.serveError(w, err)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Length", fmt.Sprint(sr.Size))
+	// content is immutable
+	w.Header().Set("ETag", `"`+sr.Ref.String()+`"`)
+	if r.Method == "HEAD" {
+		return
+	}
+	_, _ = io.Copy(w, rc)
+}
+
+func (p *Proxy) serveList(w http.ResponseWriter, r *http.Request, module string) {
+	vers := p.Versions(module)
+	if p.upstream != "" {
+		emod, err := EscapePath(module)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		// merge with the upstream list; failures are ignored so the cache works offline
+		if data, err := p.fetchUpstreamBytes(r.Context(), "/"+emod+"/@v/list"); err == nil {
+			seen := make(map[string]bool)
+			for _, v := range vers {
+				seen[v] = true
+			}
+			for _, v := range strings.Fields(string(data)) {
+				if !seen[v] {
+					seen[v] = true
+					vers = append(vers, v)
+				}
+			}
+			sort.Strings(vers)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	for _, v := range vers {
+		fmt.Fprintln(w, v)
+	}
+}
+
+func (p *Proxy) serveLatest(w http.ResponseWriter, r *http.Request, module string) {
+	if p.upstream != "" {
+		emod, err := EscapePath(module)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if data, err := p.fetchUpstreamBytes(r.Context(), "/"+emod+"/@latest"); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+			return
+		}
+	}
+	// fallback to the latest stored version
+	var last *Version
+	for _, vers := range p.Versions(module) {
+		v, err := p.Lookup(r.Context(), module, vers)
+		if err != nil {
+			p.serveError(w, err)
+			return
+		}
+		if last == nil || v.Time.After(last.Time) {
+			last = v
+		}
+	}
+	if last == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info{Version: last.Version, Time: last.Time})
+}
@@ -0,0 +1,134 @@
+package goproxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage"
+)
+
+const (
+	testModule  = "example.com/Foo"
+	testVersion = "v1.0.0"
+	testMod     = "module example.com/Foo\n"
+)
+
+func testZip(t testing.TB) []byte {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, name := range []string{"go.mod", "foo.go"} {
+		w, err := zw.Create(testModule + "@" + testVersion + "/" + name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte("// " + name + "\n"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestEscape(t *testing.T) {
+	esc, err := EscapePath(testModule)
+	require.NoError(t, err)
+	require.Equal(t, "example.com/!foo", esc)
+	path, err := UnescapePath(esc)
+	require.NoError(t, err)
+	require.Equal(t, testModule, path)
+
+	_, err = UnescapePath("example.com/Foo")
+	require.NotNil(t, err)
+	_, err = UnescapePath("example.com/foo!")
+	require.NotNil(t, err)
+}
+
+func TestProxy(t *testing.T) {
+	ctx := context.Background()
+	zdata := testZip(t)
+	ts := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var fetches int
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const pref = "/example.com/!foo/"
+		if !strings.HasPrefix(r.URL.Path, pref) {
+			http.NotFound(w, r)
+			return
+		}
+		fetches++
+		switch strings.TrimPrefix(r.URL.Path, pref) {
+		case "@v/list":
+			w.Write([]byte(testVersion + "\nv1.1.0\n"))
+		case "@v/" + testVersion + ".info":
+			json.NewEncoder(w).Encode(info{Version: testVersion, Time: ts})
+		case "@v/" + testVersion + ".mod":
+			w.Write([]byte(testMod))
+		case "@v/" + testVersion + ".zip":
+			w.Write(zdata)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer up.Close()
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	p, err := NewProxy(ctx, s, &Options{Upstream: up.URL})
+	require.NoError(t, err)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	get := func(path string) (int, []byte) {
+		resp, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, data
+	}
+	expect := func(path string, exp []byte) {
+		code, data := get(path)
+		require.Equal(t, http.StatusOK, code, "%s: %s", path, data)
+		require.Equal(t, string(exp), string(data), path)
+	}
+
+	expect("/example.com/!foo/@v/"+testVersion+".zip", zdata)
+	expect("/example.com/!foo/@v/"+testVersion+".mod", []byte(testMod))
+	expect("/example.com/!foo/@v/list", []byte(testVersion+"\nv1.1.0\n"))
+	// info, mod and zip + list
+	require.Equal(t, 4, fetches)
+
+	code, _ := get("/example.com/!bar/@v/" + testVersion + ".zip")
+	require.Equal(t, http.StatusNotFound, code)
+
+	v, err := p.Lookup(ctx, testModule, testVersion)
+	require.NoError(t, err)
+	require.Equal(t, ts, v.Time)
+	require.True(t, strings.HasPrefix(v.ModSum, "h1:"))
+	require.True(t, strings.HasPrefix(v.ZipSum, "h1:"))
+
+	// reload the index without the upstream
+	p, err = NewProxy(ctx, s, nil)
+	require.NoError(t, err)
+	srv.Config.Handler = p
+
+	expect("/example.com/!foo/@v/"+testVersion+".zip", zdata)
+	expect("/example.com/!foo/@v/list", []byte(testVersion+"\n"))
+	exp, err := json.Marshal(info{Version: testVersion, Time: ts})
+	require.NoError(t, err)
+	expect("/example.com/!foo/@latest", append(exp, '\n'))
+	require.Equal(t, 4, fetches)
+
+	_, err = p.Store(ctx, "example.com/bar", testVersion, ts, []byte(testMod), bytes.NewReader(zdata))
+	require.NotNil(t, err, "files with a wrong prefix")
+}
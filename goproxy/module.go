@@ -0,0 +1,142 @@
+package goproxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// EscapePath escapes a module path for use in the proxy URL.
+// Upper-case letters are replaced with '!' followed by a lower-case letter.
+func EscapePath(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("empty module path")
+	}
+	return escapeString(path)
+}
+
+// EscapeVersion escapes a module version for use in the proxy URL.
+func EscapeVersion(vers string) (string, error) {
+	if vers == "" {
+		return "", fmt.Errorf("empty version")
+	}
+	return escapeString(vers)
+}
+
+func escapeString(s string) (string, error) {
+	if !utf8.ValidString(s) || strings.Contains(s, "!") {
+		return "", fmt.Errorf("invalid escaped string: %q", s)
+	}
+	var buf strings.Builder
+	for _, r := range s {
+		if 'A' <= r && r <= 'Z' {
+			buf.WriteByte('!')
+			buf.WriteRune(r + 'a' - 'A')
+		} else {
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String(), nil
+}
+
+// UnescapePath decodes a module path escaped with EscapePath.
+func UnescapePath(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("empty module path")
+	}
+	return unescapeString(path)
+}
+
+// UnescapeVersion decodes a module version escaped with EscapeVersion.
+func UnescapeVersion(vers string) (string, error) {
+	if vers == "" {
+		return "", fmt.Errorf("empty version")
+	}
+	return unescapeString(vers)
+}
+
+func unescapeString(s string) (string, error) {
+	var buf strings.Builder
+	bang := false
+	for _, r := range s {
+		if 'A' <= r && r <= 'Z' {
+			return "", fmt.Errorf("invalid escaped string: %q", s)
+		}
+		if bang {
+			bang = false
+			if r < 'a' || r > 'z' {
+				return "", fmt.Errorf("invalid escaped string: %q", s)
+			}
+			r += 'A' - 'a'
+		} else if r == '!' {
+			bang = true
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	if bang {
+		return "", fmt.Errorf("invalid escaped string: %q", s)
+	}
+	return buf.String(), nil
+}
+
+// hashFiles computes a "h1:" hash of a set of files, as used in go.sum.
+func hashFiles(names []string, open func(name string) (io.ReadCloser, error)) (string, error) {
+	names = append([]string{}, names...)
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		if strings.Contains(name, "\n") {
+			return "", fmt.Errorf("file names with new lines are not supported")
+		}
+		rc, err := open(name)
+		if err != nil {
+			return "", err
+		}
+		fh := sha256.New()
+		_, err = io.Copy(fh, rc)
+		rc.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%x  %s\n", fh.Sum(nil), name)
+	}
+	return "h1:" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashMod computes a go.sum hash of the go.mod file.
+func hashMod(data []byte) (string, error) {
+	return hashFiles([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	})
+}
+
+// hashZip computes a go.sum hash of the module zip. All files in the zip must have a given prefix.
+func hashZip(r io.ReaderAt, size int64, prefix string) (string, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	files := make(map[string]*zip.File)
+	for _, f := range z.File {
+		if !strings.HasPrefix(f.Name, prefix) {
+			return "", fmt.Errorf("unexpected file in module zip: %q", f.Name)
+		}
+		if _, ok := files[f.Name]; ok {
+			return "", fmt.Errorf("duplicate file in module zip: %q", f.Name)
+		}
+		names = append(names, f.Name)
+		files[f.Name] = f
+	}
+	return hashFiles(names, func(name string) (io.ReadCloser, error) {
+		return files[name].Open()
+	})
+}
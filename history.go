@@ -0,0 +1,100 @@
+package cas
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dennwc/cas/types"
+)
+
+// PathVersion is a single version of a path in the commit history.
+type PathVersion struct {
+	Ref    types.Ref // zero if the path was removed
+	Size   uint64
+	Time   time.Time // time of the commit that introduced this version
+	Commit types.Ref // commit that introduced this version
+}
+
+// PathHistory lists all versions of a path (relative to the root of a commit) across commits of a pin,
+// starting from the latest one. A version is reported each time the path changes its content, including
+// removals, which are reported as versions with a zero ref.
+func (s *Storage) PathHistory(ctx context.Context, pin string, path string) ([]PathVersion, error) {
+	var elems []string
+	if path = strings.Trim(path, "/"); path != "" {
+		elems = strings.Split(path, "/")
+	}
+	var (
+		out  []PathVersion
+		prev []types.Ref // refs of path elements in the previous commit
+		cur  *PathVersion
+	)
+	it := s.IterateCommits(ctx, pin)
+	defer it.Close()
+	for it.Next() {
+		c := it.Commit()
+		refs, v, err := s.resolvePath(ctx, c.Root, elems, prev, cur)
+		if err != nil {
+			return nil, err
+		}
+		if cur == nil || v.Ref != cur.Ref {
+			out = append(out, v)
+		}
+		cur = &out[len(out)-1]
+		cur.Time, cur.Commit = c.Time, it.Ref()
+		prev = refs
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	if len(out) != 0 && out[len(out)-1].Ref.Zero() {
+		// path did not exist in the first commit
+		out = out[:len(out)-1]
+	}
+	return out, nil
+}
+
+// resolvePath finds a path in the tree. It returns refs of all path elements, starting from the root.
+//
+// If a subtree ref matches the one from the previous commit, the path is not resolved further
+// and the previous version is returned instead.
+func (s *Storage) resolvePath(ctx context.Context, root types.Ref, elems []string, prev []types.Ref, last *PathVersion) ([]types.Ref, PathVersion, error) {
+	refs := make([]types.Ref, 0, len(elems)+1)
+	ref := root
+	size := uint64(0)
+	for i := 0; ; i++ {
+		refs = append(refs, ref)
+		if last != nil && i < len(prev) && prev[i] == ref {
+			return prev, PathVersion{Ref: last.Ref, Size: last.Size}, nil
+		}
+		if i == len(elems) {
+			break
+		}
+		ents, err := s.ReadDir(ctx, ref)
+		if err == ErrNotDir {
+			return refs, PathVersion{}, nil
+		} else if err != nil {
+			return nil, PathVersion{}, err
+		}
+		j := sort.Search(len(ents), func(j int) bool {
+			return ents[j].Name >= elems[i]
+		})
+		if j >= len(ents) || ents[j].Name != elems[i] {
+			return refs, PathVersion{}, nil
+		}
+		ref, size = ents[j].Ref, ents[j].Size()
+	}
+	if len(elems) == 0 {
+		if _, err := s.ReadDir(ctx, ref); err == ErrNotDir {
+			// size of a root file is not recorded anywhere
+			rc, sr, err := s.openFile(ctx, ref)
+			if err != nil {
+				return nil, PathVersion{}, err
+			}
+			rc.Close()
+			size = sr.Size
+		}
+	}
+	return refs, PathVersion{Ref: ref, Size: size}, nil
+}
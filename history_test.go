@@ -0,0 +1,116 @@
+package cas_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+)
+
+func TestPathHistory(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_hist_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	fpath := filepath.Join(dir, "sub", "a.txt")
+	require.NoError(t, os.MkdirAll(filepath.Dir(fpath), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("b"), 0644))
+
+	const pin = "root"
+	commit := func() {
+		sr, err := s.StoreFilePath(ctx, dir, nil)
+		require.NoError(t, err)
+		_, err = s.Commit(ctx, pin, sr.Ref, "")
+		require.NoError(t, err)
+	}
+	commit() // no file
+	require.NoError(t, ioutil.WriteFile(fpath, []byte("v1"), 0644))
+	commit()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("b2"), 0644))
+	commit() // file is unchanged
+	require.NoError(t, ioutil.WriteFile(fpath, []byte("v22"), 0644))
+	commit()
+	require.NoError(t, os.Remove(fpath))
+	commit()
+	require.NoError(t, ioutil.WriteFile(fpath, []byte("v1"), 0644))
+	commit()
+
+	vers, err := s.PathHistory(ctx, pin, "/sub/a.txt")
+	require.NoError(t, err)
+	require.Len(t, vers, 4)
+	require.Equal(t, uint64(2), vers[0].Size)
+	require.True(t, vers[1].Ref.Zero())
+	require.Equal(t, uint64(3), vers[2].Size)
+	require.Equal(t, uint64(2), vers[3].Size)
+	require.Equal(t, vers[0].Ref, vers[3].Ref)
+	for _, v := range vers {
+		require.False(t, v.Commit.Zero())
+	}
+
+	vers, err = s.PathHistory(ctx, pin, "b.txt")
+	require.NoError(t, err)
+	require.Len(t, vers, 2)
+	require.Equal(t, uint64(2), vers[0].Size)
+	require.Equal(t, uint64(1), vers[1].Size)
+}
+
+func TestRestoreAt(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_restore_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	const pin = "root"
+	t0 := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	var parent *cas.Ref
+	for i, data := range []string{"v1", "v2"} {
+		src := filepath.Join(dir, "src"+data)
+		require.NoError(t, os.MkdirAll(filepath.Join(src, "sub"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(src, "sub", "a.txt"), []byte(data), 0644))
+		sr, err := s.StoreFilePath(ctx, src, nil)
+		require.NoError(t, err)
+		c := &schema.Commit{Root: sr.Ref, Parent: parent, Time: t0.AddDate(0, 0, i)}
+		csr, err := s.StoreSchema(ctx, c)
+		require.NoError(t, err)
+		parent = &csr.Ref
+	}
+	require.NoError(t, s.SetPin(ctx, pin, *parent))
+
+	_, err = s.RestoreAt(ctx, pin, t0.Add(-time.Second), filepath.Join(dir, "none"))
+	require.Equal(t, cas.ErrNoSnapshot, err)
+
+	out := filepath.Join(dir, "out1")
+	_, err = s.RestoreAt(ctx, pin, t0.Add(time.Hour), out)
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(out, "sub", "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(data))
+
+	out = filepath.Join(dir, "out2")
+	ref, err := s.RestorePathAt(ctx, pin, t0.AddDate(0, 0, 1), "sub/a.txt", out)
+	require.NoError(t, err)
+	require.Equal(t, *parent, ref)
+	data, err = ioutil.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(data))
+
+	_, err = s.RestorePathAt(ctx, pin, t0, "missing", filepath.Join(dir, "out3"))
+	require.True(t, os.IsNotExist(err))
+}
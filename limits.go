@@ -0,0 +1,123 @@
+package cas
+
+import (
+	"fmt"
+	"os"
+)
+
+// WarningKind is a kind of a pattern that hurts the performance or the consistency of stored trees.
+type WarningKind string
+
+const (
+	// WarnLargeDir is reported for directories with more entries than TreeLimits.MaxDirEntries.
+	WarnLargeDir = WarningKind("large-dir")
+	// WarnDeepTree is reported for directories nested deeper than TreeLimits.MaxDepth.
+	WarnDeepTree = WarningKind("deep-tree")
+	// WarnFileChanged is reported for files that were modified while being stored.
+	// The stored content might not match any version of the file.
+	WarnFileChanged = WarningKind("file-changed")
+)
+
+const (
+	defMaxDirEntries = 1000000
+	defMaxDepth      = 256
+)
+
+// TreeLimits are soft limits for trees stored from the file system. Patterns that exceed the limits
+// are reported as warnings, or fail the operation if the limits are strict.
+type TreeLimits struct {
+	// MaxDirEntries is the number of entries in a single directory. Default is 1M.
+	MaxDirEntries int
+	// MaxDepth is the nesting depth of directories. Default is 256.
+	MaxDepth int
+	// Strict returns warnings as errors instead of reporting them.
+	Strict bool
+}
+
+func (l *TreeLimits) maxDirEntries() int {
+	if l == nil || l.MaxDirEntries <= 0 {
+		return defMaxDirEntries
+	}
+	return l.MaxDirEntries
+}
+
+func (l *TreeLimits) maxDepth() int {
+	if l == nil || l.MaxDepth <= 0 {
+		return defMaxDepth
+	}
+	return l.MaxDepth
+}
+
+// Warning describes a pathological pattern found while storing a tree.
+// It's also returned as an error if TreeLimits are strict.
+type Warning struct {
+	Kind WarningKind
+	Path string
+	Msg  string
+}
+
+func (w *Warning) Error() string {
+	return fmt.Sprintf("%s: %s", w.Path, w.Msg)
+}
+
+// ErrFileChanged is returned if a file was modified each time it was stored, and the limits are strict
+// or the content could not be stored at all.
+type ErrFileChanged struct {
+	Path     string
+	Attempts int
+}
+
+func (e *ErrFileChanged) Error() string {
+	return fmt.Sprintf("%s: file changed while being stored (%d attempts)", e.Path, e.Attempts)
+}
+
+const defChangeRetries = 3
+
+// ChangePolicy controls how files that change while being stored are handled.
+type ChangePolicy struct {
+	// Retries is the number of times the file is opened and stored again after it was modified. Default is 3.
+	// Negative value disables retries.
+	Retries int
+	// Snapshot copies the file to a temporary file first, and stores the copy. Only the copy is retried.
+	Snapshot bool
+}
+
+func (p *ChangePolicy) retries() int {
+	if p == nil || p.Retries == 0 {
+		return defChangeRetries
+	} else if p.Retries < 0 {
+		return 0
+	}
+	return p.Retries
+}
+
+// fileChanged reports a file that was changed on each attempt to store it.
+func (c *StoreConfig) fileChanged(path string, attempts int) error {
+	err := &ErrFileChanged{Path: path, Attempts: attempts}
+	if c.Limits != nil && c.Limits.Strict {
+		return err
+	}
+	return c.warn(WarnFileChanged, path, "file changed while being stored (%d attempts)", attempts)
+}
+
+// warn reports a warning to the callback, or returns it as an error if limits are strict.
+func (c *StoreConfig) warn(kind WarningKind, path string, format string, args ...interface{}) error {
+	w := &Warning{Kind: kind, Path: path, Msg: fmt.Sprintf(format, args...)}
+	if c.Limits != nil && c.Limits.Strict {
+		return w
+	}
+	if c.OnWarning != nil {
+		c.OnWarning(w)
+	}
+	return nil
+}
+
+// fileChanged checks if the file was modified since it was opened.
+func fileChanged(path string, old os.FileInfo) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		// removed or renamed
+		return true
+	}
+	return fi.Size() != old.Size() || !fi.ModTime().Equal(old.ModTime())
+}
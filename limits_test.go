@@ -0,0 +1,141 @@
+package cas_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage"
+)
+
+func TestTreeLimits(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_limits_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), []byte{byte(i)}, 0644))
+	}
+	deep := filepath.Join(dir, "a", "b", "c")
+	require.NoError(t, os.MkdirAll(deep, 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(deep, "file"), []byte("deep"), 0644))
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+
+	var warns []cas.Warning
+	conf := &cas.StoreConfig{
+		Limits: &cas.TreeLimits{MaxDirEntries: 3, MaxDepth: 2},
+		OnWarning: func(w *cas.Warning) {
+			warns = append(warns, *w)
+		},
+	}
+	sr, err := s.StoreFilePath(ctx, dir, conf)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []cas.Warning{
+		{Kind: cas.WarnLargeDir, Path: dir, Msg: "directory has more than 3 entries"},
+		{Kind: cas.WarnDeepTree, Path: deep, Msg: "directory is nested more than 2 levels deep"},
+	}, warns)
+
+	// default limits are not exceeded
+	warns = nil
+	conf.Limits = nil
+	sr2, err := s.StoreFilePath(ctx, dir, conf)
+	require.NoError(t, err)
+	require.Empty(t, warns)
+	require.Equal(t, sr, sr2)
+
+	conf.Limits = &cas.TreeLimits{MaxDepth: 2, Strict: true}
+	_, err = s.StoreFilePath(ctx, dir, conf)
+	require.Equal(t, &cas.Warning{Kind: cas.WarnDeepTree, Path: deep, Msg: "directory is nested more than 2 levels deep"}, err)
+	require.Empty(t, warns)
+}
+
+// changingStorage modifies a file each time a blob is written, as long as the counter is positive.
+type changingStorage struct {
+	storage.Storage
+	path    string
+	changes int
+}
+
+func (s *changingStorage) BeginBlob(ctx context.Context) (storage.BlobWriter, error) {
+	w, err := s.Storage.BeginBlob(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s.changes > 0 {
+		s.changes--
+		f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		_, err = f.Write([]byte("!"))
+		f.Close()
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func TestFileChanged(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_limits_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log")
+	st := &changingStorage{Storage: storage.NewInMemory(), path: path}
+	s, err := cas.New(st)
+	require.NoError(t, err)
+
+	var warns []cas.Warning
+	conf := &cas.StoreConfig{
+		Changes: &cas.ChangePolicy{Retries: 2},
+		OnWarning: func(w *cas.Warning) {
+			warns = append(warns, *w)
+		},
+	}
+	reset := func(changes int) {
+		require.NoError(t, ioutil.WriteFile(path, []byte("log"), 0644))
+		st.changes = changes
+		warns = nil
+	}
+
+	// the file stops changing after 2 attempts
+	reset(2)
+	sr, err := s.StoreFilePath(ctx, path, conf)
+	require.NoError(t, err)
+	require.Empty(t, warns)
+	require.Equal(t, uint64(len("log!!")), sr.Size)
+
+	// the file changes on each attempt
+	reset(10)
+	_, err = s.StoreFilePath(ctx, path, conf)
+	require.NoError(t, err)
+	require.Equal(t, []cas.Warning{
+		{Kind: cas.WarnFileChanged, Path: path, Msg: "file changed while being stored (3 attempts)"},
+	}, warns)
+
+	reset(10)
+	conf.Limits = &cas.TreeLimits{Strict: true}
+	_, err = s.StoreFilePath(ctx, path, conf)
+	require.Equal(t, &cas.ErrFileChanged{Path: path, Attempts: 3}, err)
+
+	// snapshot is not affected by changes of the file
+	reset(10)
+	conf.Changes.Snapshot = true
+	sr, err = s.StoreFilePath(ctx, path, conf)
+	require.NoError(t, err)
+	require.Empty(t, warns)
+	require.Equal(t, uint64(len("log")), sr.Size)
+}
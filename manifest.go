@@ -0,0 +1,180 @@
+package cas
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+)
+
+// ErrNoManifest is returned when a commit has no manifest.
+var ErrNoManifest = errors.New("no manifest")
+
+// ErrManifestMismatch is returned when the manifest doesn't describe the tree it points to.
+type ErrManifestMismatch struct {
+	Manifest Ref
+	Path     string // first path that differs; empty if the number of entries differs
+}
+
+func (e *ErrManifestMismatch) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("manifest %v doesn't match the tree", e.Manifest)
+	}
+	return fmt.Sprintf("manifest %v doesn't match the tree: %q", e.Manifest, e.Path)
+}
+
+// BuildManifest walks the directory (or a commit of a directory) and returns a flat list of all entries.
+// See schema.Manifest for the order of entries.
+func (s *Storage) BuildManifest(ctx context.Context, root Ref) ([]schema.ManifestEntry, error) {
+	var out []schema.ManifestEntry
+	if err := s.buildManifest(ctx, root, "", &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *Storage) buildManifest(ctx context.Context, dir Ref, prefix string, out *[]schema.ManifestEntry) error {
+	ents, err := s.ReadDir(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		p := path.Join(prefix, ent.Name)
+		i := len(*out)
+		*out = append(*out, schema.ManifestEntry{Path: p, Ref: ent.Ref, Size: ent.Size(), Link: ent.Link})
+		if err = ctx.Err(); err != nil {
+			return err
+		} else if ent.Link != "" {
+			continue
+		}
+		err = s.buildManifest(ctx, ent.Ref, p, out)
+		if err == ErrNotDir || err == storage.ErrNotFound {
+			// schema blobs are always stored, thus a missing blob is the content of an indexed file
+			continue
+		} else if err != nil {
+			return err
+		}
+		(*out)[i].Dir = true
+	}
+	return nil
+}
+
+// StoreManifest builds and stores a manifest of the directory (or a commit of a directory).
+func (s *Storage) StoreManifest(ctx context.Context, root Ref) (SizedRef, error) {
+	if c, err := s.decodeCommit(ctx, root); err == nil {
+		root = c.Root
+	} else if err != errNotCommit {
+		return SizedRef{}, err
+	}
+	ents, err := s.BuildManifest(ctx, root)
+	if err != nil {
+		return SizedRef{}, err
+	}
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	enc := json.NewEncoder(zw)
+	for _, e := range ents {
+		if err = enc.Encode(e); err != nil {
+			return SizedRef{}, err
+		}
+	}
+	if err = zw.Close(); err != nil {
+		return SizedRef{}, err
+	}
+	sr, err := s.StoreBlob(ctx, buf, nil)
+	if err != nil {
+		return SizedRef{}, err
+	}
+	return s.StoreSchema(ctx, &schema.Manifest{Root: root, Count: len(ents), Entries: sr})
+}
+
+// LoadManifest reads a manifest or a manifest of a commit. It returns ErrNoManifest if the commit has no manifest.
+func (s *Storage) LoadManifest(ctx context.Context, ref Ref) (*schema.Manifest, []schema.ManifestEntry, error) {
+	obj, err := s.DecodeSchema(ctx, ref)
+	if err == schema.ErrNotSchema {
+		return nil, nil, ErrNoManifest
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if c, ok := obj.(*schema.Commit); ok {
+		if c.Manifest == nil {
+			return nil, nil, ErrNoManifest
+		}
+		m, ents, err := s.LoadManifest(ctx, *c.Manifest)
+		if err == nil && m.Root != c.Root {
+			return nil, nil, &ErrManifestMismatch{Manifest: *c.Manifest}
+		}
+		return m, ents, err
+	}
+	m, ok := obj.(*schema.Manifest)
+	if !ok {
+		return nil, nil, ErrNoManifest
+	}
+	rc, _, err := s.FetchBlob(ctx, m.Entries.Ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zr.Close()
+	ents := make([]schema.ManifestEntry, 0, m.Count)
+	dec := json.NewDecoder(bufio.NewReader(zr))
+	for {
+		var e schema.ManifestEntry
+		if err = dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("cannot decode manifest %v: %v", ref, err)
+		}
+		ents = append(ents, e)
+	}
+	if len(ents) != m.Count {
+		return nil, nil, &ErrManifestMismatch{Manifest: ref}
+	}
+	return m, ents, nil
+}
+
+// TreeManifest returns a flat list of all entries of the directory or a commit. The manifest of the commit is used,
+// if it has one, and the tree is walked otherwise.
+func (s *Storage) TreeManifest(ctx context.Context, ref Ref) ([]schema.ManifestEntry, error) {
+	_, ents, err := s.LoadManifest(ctx, ref)
+	if err == ErrNoManifest {
+		return s.BuildManifest(ctx, ref)
+	}
+	return ents, err
+}
+
+// VerifyManifest checks that the manifest (or a manifest of a commit) matches the tree it describes.
+// It returns ErrManifestMismatch if it doesn't.
+func (s *Storage) VerifyManifest(ctx context.Context, ref Ref) error {
+	m, ents, err := s.LoadManifest(ctx, ref)
+	if err != nil {
+		return err
+	}
+	exp, err := s.BuildManifest(ctx, m.Root)
+	if err != nil {
+		return err
+	}
+	for i := range exp {
+		if i >= len(ents) {
+			return &ErrManifestMismatch{Manifest: ref, Path: exp[i].Path}
+		} else if ents[i] != exp[i] {
+			return &ErrManifestMismatch{Manifest: ref, Path: ents[i].Path}
+		}
+	}
+	if len(ents) != len(exp) {
+		return &ErrManifestMismatch{Manifest: ref, Path: ents[len(exp)].Path}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package cas_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+)
+
+func TestManifest(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_manifest_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "empty"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a", "b", "c.txt"), []byte("c"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("aa"), 0644))
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	root, err := s.StoreFilePath(ctx, dir, nil)
+	require.NoError(t, err)
+
+	// commits without manifests are walked
+	c1, err := s.Commit(ctx, "root", root.Ref, "")
+	require.NoError(t, err)
+	_, _, err = s.LoadManifest(ctx, c1.Ref)
+	require.Equal(t, cas.ErrNoManifest, err)
+	exp, err := s.TreeManifest(ctx, c1.Ref)
+	require.NoError(t, err)
+
+	var paths []string
+	for _, e := range exp {
+		paths = append(paths, e.Path)
+		require.Equal(t, e.Path != "a.txt" && e.Path != "a/b/c.txt", e.Dir, e.Path)
+	}
+	require.Equal(t, []string{"a", "a/b", "a/b/c.txt", "a.txt", "empty"}, paths)
+	require.Equal(t, uint64(1), exp[2].Size)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("aaa"), 0644))
+	root2, err := s.StoreFilePath(ctx, dir, nil)
+	require.NoError(t, err)
+	c2, err := s.CommitWithOptions(ctx, "root", root2.Ref, &cas.CommitOptions{Manifest: true})
+	require.NoError(t, err)
+
+	m, ents, err := s.LoadManifest(ctx, c2.Ref)
+	require.NoError(t, err)
+	require.Equal(t, root2.Ref, m.Root)
+	require.Equal(t, 5, m.Count)
+	exp[3].Ref, exp[3].Size = ents[3].Ref, 3
+	require.Equal(t, exp, ents)
+	require.NoError(t, s.VerifyManifest(ctx, c2.Ref))
+
+	// manifest of a different tree is detected
+	bad, err := s.StoreSchema(ctx, &schema.Manifest{Root: root.Ref, Count: m.Count, Entries: m.Entries})
+	require.NoError(t, err)
+	err = s.VerifyManifest(ctx, bad.Ref)
+	require.IsType(t, &cas.ErrManifestMismatch{}, err)
+	require.Equal(t, "a.txt", err.(*cas.ErrManifestMismatch).Path)
+}
@@ -0,0 +1,55 @@
+package nix
+
+import (
+	"fmt"
+	"strings"
+)
+
+// base32Chars is the alphabet of the Nix flavor of base32 encoding.
+const base32Chars = "0123456789abcdfghijklmnpqrsvwxyz"
+
+// base32Len returns the length of the encoded string for n bytes.
+func base32Len(n int) int {
+	return (n*8-1)/5 + 1
+}
+
+// EncodeBase32 encodes bytes using Nix base32 encoding.
+func EncodeBase32(p []byte) string {
+	n := base32Len(len(p))
+	var buf strings.Builder
+	buf.Grow(n)
+	for i := n - 1; i >= 0; i-- {
+		b := uint(i * 5)
+		j, k := b/8, b%8
+		c := p[j] >> k
+		if int(j)+1 < len(p) {
+			c |= p[j+1] << (8 - k)
+		}
+		buf.WriteByte(base32Chars[c&0x1f])
+	}
+	return buf.String()
+}
+
+// DecodeBase32 decodes a string in Nix base32 encoding. The size of the output must be known in advance.
+func DecodeBase32(s string, size int) ([]byte, error) {
+	if len(s) != base32Len(size) {
+		return nil, fmt.Errorf("invalid base32 string length: %d", len(s))
+	}
+	p := make([]byte, size)
+	for n := 0; n < len(s); n++ {
+		c := s[len(s)-n-1]
+		d := strings.IndexByte(base32Chars, c)
+		if d < 0 {
+			return nil, fmt.Errorf("invalid base32 character: %q", c)
+		}
+		b := uint(n * 5)
+		i, j := b/8, b%8
+		p[i] |= byte(d << j)
+		if carry := byte(d >> (8 - j)); int(i)+1 < size {
+			p[i+1] |= carry
+		} else if carry != 0 {
+			return nil, fmt.Errorf("invalid base32 string")
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,401 @@
+// Package nix implements Nix binary cache protocol backed by CAS, as well as packing and unpacking
+// of Nix archives (NAR).
+//
+// The cache can act as a substituter for Nix and Guix:
+//
+//	nix-store -r /nix/store/... --option substituters http://localhost:8080
+//
+// NAR files are stored as regular blobs and store path metadata (narinfo) is stored as schema objects.
+package nix
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+func init() {
+	schema.RegisterName(narInfoType, &NarInfo{})
+}
+
+const narInfoType = "nix:NarInfo"
+
+// DefaultStoreDir is the default location of the Nix store.
+const DefaultStoreDir = "/nix/store"
+
+// hashLen is the length of the hash part of the store path.
+const hashLen = 32
+
+// NarInfo describes a store path in the binary cache.
+type NarInfo struct {
+	StorePath   string         `json:"store_path"`
+	File        types.SizedRef `json:"file"` // NAR file, possibly compressed
+	Compression string         `json:"compression,omitempty"`
+	NarHash     string         `json:"nar_hash"`
+	NarSize     uint64         `json:"nar_size"`
+	Refs        []string       `json:"references,omitempty"` // base names of referenced store paths
+	Deriver     string         `json:"deriver,omitempty"`
+	Sigs        []string       `json:"sigs,omitempty"`
+	CA          string         `json:"ca,omitempty"`
+}
+
+func (n *NarInfo) References() []types.Ref {
+	return []types.Ref{n.File.Ref}
+}
+
+// HashPart returns the hash part of the store path.
+func (n *NarInfo) HashPart() string {
+	return hashPart(n.StorePath)
+}
+
+func hashPart(storePath string) string {
+	base := path.Base(storePath)
+	if len(base) < hashLen {
+		return ""
+	}
+	return base[:hashLen]
+}
+
+// fileExt returns the file extension for a given compression method.
+func fileExt(compression string) string {
+	switch compression {
+	case "", "none":
+		return ""
+	case "xz":
+		return ".xz"
+	case "bzip2":
+		return ".bz2"
+	case "zstd":
+		return ".zst"
+	}
+	return "." + compression
+}
+
+// URL returns a path of the NAR file relative to the cache root.
+func (n *NarInfo) URL() string {
+	hex := strings.TrimPrefix(n.File.Ref.String(), n.File.Ref.Name()+":")
+	return "nar/" + hex + ".nar" + fileExt(n.Compression)
+}
+
+// WriteTo writes narinfo in a text format.
+func (n *NarInfo) WriteTo(w io.Writer) (int64, error) {
+	var buf strings.Builder
+	kv := func(k, v string) {
+		buf.WriteString(k + ": " + v + "\n")
+	}
+	comp := n.Compression
+	if comp == "" {
+		comp = "none"
+	}
+	kv("StorePath", n.StorePath)
+	kv("URL", n.URL())
+	kv("Compression", comp)
+	kv("FileHash", "sha256:"+EncodeBase32(n.File.Ref.Digest()))
+	kv("FileSize", strconv.FormatUint(n.File.Size, 10))
+	kv("NarHash", n.NarHash)
+	kv("NarSize", strconv.FormatUint(n.NarSize, 10))
+	kv("References", strings.Join(n.Refs, " "))
+	if n.Deriver != "" {
+		kv("Deriver", n.Deriver)
+	}
+	for _, s := range n.Sigs {
+		kv("Sig", s)
+	}
+	if n.CA != "" {
+		kv("CA", n.CA)
+	}
+	m, err := io.WriteString(w, buf.String())
+	return int64(m), err
+}
+
+// ParseNarInfo parses narinfo in a text format. The file is identified by the FileHash field.
+func ParseNarInfo(r io.Reader) (*NarInfo, error) {
+	n := &NarInfo{}
+	var fileHash string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid narinfo line: %q", line)
+		}
+		k, v := line[:i], line[i+2:]
+		var err error
+		switch k {
+		case "StorePath":
+			n.StorePath = v
+		case "Compression":
+			n.Compression = v
+		case "FileHash":
+			fileHash = v
+		case "FileSize":
+			n.File.Size, err = strconv.ParseUint(v, 10, 64)
+		case "NarHash":
+			n.NarHash = v
+		case "NarSize":
+			n.NarSize, err = strconv.ParseUint(v, 10, 64)
+		case "References":
+			n.Refs = strings.Fields(v)
+		case "Deriver":
+			n.Deriver = v
+		case "Sig":
+			n.Sigs = append(n.Sigs, v)
+		case "CA":
+			n.CA = v
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid narinfo field %s: %v", k, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if hashPart(n.StorePath) == "" {
+		return nil, fmt.Errorf("invalid store path: %q", n.StorePath)
+	}
+	if n.Compression == "none" {
+		n.Compression = ""
+	}
+	if fileHash == "" && n.Compression == "" {
+		// uncompressed file is the NAR itself
+		fileHash = n.NarHash
+	}
+	ref, err := parseHash(fileHash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file hash: %v", err)
+	}
+	n.File.Ref = ref
+	return n, nil
+}
+
+// parseHash converts a Nix SHA256 hash to a ref. Both base32 and base16 forms are supported.
+func parseHash(s string) (types.Ref, error) {
+	if !strings.HasPrefix(s, "sha256:") {
+		return types.Ref{}, fmt.Errorf("unsupported hash: %q", s)
+	}
+	s = strings.TrimPrefix(s, "sha256:")
+	if len(s) == 2*sha256.Size {
+		return types.ParseRef("sha256:" + s)
+	}
+	p, err := DecodeBase32(s, sha256.Size)
+	if err != nil {
+		return types.Ref{}, err
+	}
+	return types.RefFromDigest("sha256", p)
+}
+
+// Options for the binary cache.
+type Options struct {
+	// StoreDir is a location of the Nix store. DefaultStoreDir is used if not set.
+	StoreDir string
+	// Priority of the cache. Nix prefers caches with lower values.
+	Priority int
+	// Writable allows uploading NAR files and narinfo (for example, with "nix copy --to").
+	Writable bool
+}
+
+// NewCache creates a binary cache backed by CAS. It loads an index of store paths.
+func NewCache(ctx context.Context, s *cas.Storage, opts *Options) (*Cache, error) {
+	c := &Cache{s: s, paths: make(map[string]types.Ref)}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if c.opts.StoreDir == "" {
+		c.opts.StoreDir = DefaultStoreDir
+	}
+	it := s.IterateSchema(ctx, narInfoType)
+	defer it.Close()
+	for it.Next() {
+		obj, err := it.Decode()
+		if err != nil {
+			return nil, err
+		}
+		n, ok := obj.(*NarInfo)
+		if !ok {
+			return nil, fmt.Errorf("unexpected schema type: %T", obj)
+		}
+		c.paths[n.HashPart()] = it.SchemaRef().Ref
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+var _ http.Handler = (*Cache)(nil)
+
+// Cache serves Nix store paths from CAS.
+type Cache struct {
+	s    *cas.Storage
+	opts Options
+
+	mu    sync.RWMutex
+	paths map[string]types.Ref // hash part -> narinfo
+}
+
+// Lookup finds narinfo by the hash part of the store path. It returns storage.ErrNotFound if the path is not in the cache.
+func (c *Cache) Lookup(ctx context.Context, hash string) (*NarInfo, error) {
+	c.mu.RLock()
+	ref, ok := c.paths[hash]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	obj, err := c.s.DecodeSchema(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := obj.(*NarInfo)
+	if !ok {
+		return nil, fmt.Errorf("unexpected schema type: %T", obj)
+	}
+	return n, nil
+}
+
+// Add adds a store path to the cache. The NAR file must be already stored in CAS.
+func (c *Cache) Add(ctx context.Context, n *NarInfo) error {
+	if !strings.HasPrefix(n.StorePath, c.opts.StoreDir+"/") {
+		return fmt.Errorf("store path is not in %s: %q", c.opts.StoreDir, n.StorePath)
+	}
+	sz, err := c.s.StatBlob(ctx, n.File.Ref)
+	if err != nil {
+		return fmt.Errorf("nar file: %v", err)
+	} else if n.File.Size != 0 && n.File.Size != sz {
+		return storage.ErrSizeMissmatch{Exp: n.File.Size, Got: sz}
+	}
+	n.File.Size = sz
+	sr, err := c.s.StoreSchema(ctx, n)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.paths[n.HashPart()] = sr.Ref
+	c.mu.Unlock()
+	return nil
+}
+
+// AddNar stores an uncompressed NAR file of a given store path in the cache.
+func (c *Cache) AddNar(ctx context.Context, storePath string, r io.Reader, refs []string) (*NarInfo, error) {
+	sr, err := c.s.StoreBlob(ctx, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	n := &NarInfo{
+		StorePath: storePath,
+		File:      sr,
+		NarHash:   "sha256:" + EncodeBase32(sr.Ref.Digest()),
+		NarSize:   sr.Size,
+		Refs:      refs,
+	}
+	if err = c.Add(ctx, n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ServeHTTP implements Nix binary cache protocol.
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET", "HEAD":
+	case "PUT":
+		if c.opts.Writable {
+			c.servePut(w, r)
+			return
+		}
+		fallthrough
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case p == "nix-cache-info":
+		w.Header().Set("Content-Type", "text/x-nix-cache-info")
+		fmt.Fprintf(w, "StoreDir: %s\nWantMassQuery: 1\nPriority: %d\n", c.opts.StoreDir, c.opts.Priority)
+	case strings.HasSuffix(p, ".narinfo") && !strings.Contains(p, "/"):
+		n, err := c.Lookup(r.Context(), strings.TrimSuffix(p, ".narinfo"))
+		if err == storage.ErrNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/x-nix-narinfo")
+		n.WriteTo(w)
+	case strings.HasPrefix(p, "nar/"):
+		name := strings.TrimPrefix(p, "nar/")
+		if i := strings.Index(name, "."); i > 0 {
+			name = name[:i]
+		}
+		ref, err := types.ParseRef("sha256:" + name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		c.serveBlob(w, r, ref)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (c *Cache) serveBlob(w http.ResponseWriter, r *http.Request, ref types.Ref) {
+	rc, sz, err := c.s.FetchBlob(r.Context(), ref)
+	if err == storage.ErrNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/x-nix-nar")
+	w.Header().Set("Content-Length", strconv.FormatUint(sz, 10))
+	if r.Method == "HEAD" {
+		return
+	}
+	_, _ = io.Copy(w, rc)
+}
+
+// servePut accepts uploads from "nix copy". NAR files are stored first, and narinfo refers to them by FileHash.
+func (c *Cache) servePut(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case strings.HasPrefix(p, "nar/"):
+		if _, err := c.s.StoreBlob(ctx, r.Body, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case strings.HasSuffix(p, ".narinfo"):
+		n, err := ParseNarInfo(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = c.Add(ctx, n); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case p == "nix-cache-info":
+		// cache info is generated
+	default:
+		// logs, listings and debug info are not stored
+	}
+	w.WriteHeader(http.StatusOK)
+}
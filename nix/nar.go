@@ -0,0 +1,387 @@
+package nix
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/types"
+)
+
+// NAR (Nix ARchive) is a deterministic serialization of a file system tree.
+//
+// The archive is a sequence of strings, each prefixed with a 64 bit length and padded to 8 bytes.
+//
+//	nar  = "nix-archive-1" node
+//	node = "(" "type" ( "regular" [ "executable" "" ] "contents" data
+//	                  | "symlink" "target" target
+//	                  | "directory" { "entry" "(" "name" name "node" node ")" } ) ")"
+const narMagic = "nix-archive-1"
+
+// maxNarString is the maximal length of NAR tokens and names (but not file contents).
+const maxNarString = 4096
+
+var errNarFormat = errors.New("invalid nar format")
+
+// narWriter writes NAR tokens.
+type narWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (w *narWriter) writeLen(n uint64) {
+	if w.err != nil {
+		return
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], n)
+	_, w.err = w.w.Write(buf[:])
+}
+
+func (w *narWriter) pad(n uint64) {
+	if w.err != nil {
+		return
+	}
+	var zeros [8]byte
+	if r := n % 8; r != 0 {
+		_, w.err = w.w.Write(zeros[:8-r])
+	}
+}
+
+func (w *narWriter) str(toks ...string) {
+	for _, s := range toks {
+		w.writeLen(uint64(len(s)))
+		if w.err != nil {
+			return
+		}
+		_, w.err = w.w.WriteString(s)
+		w.pad(uint64(len(s)))
+	}
+}
+
+// contents writes file contents of a given size.
+func (w *narWriter) contents(r io.Reader, size uint64) {
+	w.writeLen(size)
+	if w.err != nil {
+		return
+	}
+	n, err := io.Copy(w.w, io.LimitReader(r, int64(size)))
+	if err != nil {
+		w.err = err
+		return
+	} else if uint64(n) != size {
+		w.err = io.ErrUnexpectedEOF
+		return
+	}
+	w.pad(size)
+}
+
+// Pack writes a file or directory stored in CAS as NAR.
+//
+// CAS trees do not record the executable bit and symlinks, thus all files are packed as regular
+// non-executable files.
+func Pack(ctx context.Context, s *cas.Storage, ref types.Ref, w io.Writer) error {
+	nw := &narWriter{w: bufio.NewWriter(w)}
+	nw.str(narMagic)
+	if err := packNode(ctx, s, nw, ref); err != nil {
+		return err
+	}
+	if nw.err != nil {
+		return nw.err
+	}
+	return nw.w.Flush()
+}
+
+func packNode(ctx context.Context, s *cas.Storage, w *narWriter, ref types.Ref) error {
+	if ref.Zero() || ref.Empty() {
+		// empty files are not stored
+		w.str("(", "type", "regular", "contents")
+		w.contents(strings.NewReader(""), 0)
+		w.str(")")
+		return w.err
+	}
+	obj, err := s.DecodeSchema(ctx, ref)
+	if err == schema.ErrNotSchema {
+		return packFile(ctx, s, w, ref, nil)
+	} else if err != nil {
+		return err
+	}
+	switch obj := obj.(type) {
+	case *schema.Commit:
+		return packNode(ctx, s, w, obj.Root)
+	case *schema.List:
+		if obj.Elem == typeDirEnt {
+			return packDir(ctx, s, w, ref)
+		}
+	case *schema.InlineList:
+		if obj.Elem == typeDirEnt {
+			return packDir(ctx, s, w, ref)
+		}
+	}
+	return packFile(ctx, s, w, ref, obj)
+}
+
+func packFile(ctx context.Context, s *cas.Storage, w *narWriter, ref types.Ref, obj schema.Object) error {
+	rc, size, err := openFile(ctx, s, ref, obj)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	w.str("(", "type", "regular", "contents")
+	w.contents(rc, size)
+	w.str(")")
+	return w.err
+}
+
+func packDir(ctx context.Context, s *cas.Storage, w *narWriter, ref types.Ref) error {
+	ents, err := s.ReadDir(ctx, ref)
+	if err != nil {
+		return err
+	}
+	w.str("(", "type", "directory")
+	for i, e := range ents {
+		if e.Name == "" || e.Name == "." || e.Name == ".." || strings.ContainsAny(e.Name, "/\x00") {
+			return fmt.Errorf("invalid file name: %q", e.Name)
+		} else if i > 0 && ents[i-1].Name == e.Name {
+			return fmt.Errorf("duplicate file name: %q", e.Name)
+		}
+		w.str("entry", "(", "name", e.Name, "node")
+		if err := packNode(ctx, s, w, e.Ref); err != nil {
+			return err
+		}
+		w.str(")")
+	}
+	w.str(")")
+	return w.err
+}
+
+var (
+	typeDirEnt   = schema.MustTypeOf(&schema.DirEntry{})
+	typeSizedRef = schema.MustTypeOf(&types.SizedRef{})
+)
+
+// openFile opens the content of a file. It supports raw blobs and files split into multiple parts.
+func openFile(ctx context.Context, s *cas.Storage, ref types.Ref, obj schema.Object) (io.ReadCloser, uint64, error) {
+	var (
+		parts []types.Ref
+		size  uint64
+	)
+	switch obj := obj.(type) {
+	case nil:
+		return s.FetchBlob(ctx, ref)
+	case schema.BlobWrapper:
+		return s.FetchBlob(ctx, obj.DataBlob())
+	case *schema.List:
+		if obj.Elem != typeSizedRef {
+			return nil, 0, fmt.Errorf("unsupported file object: %q", obj.Elem)
+		}
+		parts, size = obj.List, obj.Stats.Size()
+	case *schema.InlineList:
+		if obj.Elem != typeSizedRef {
+			return nil, 0, fmt.Errorf("unsupported file object: %q", obj.Elem)
+		}
+		for _, e := range obj.List {
+			sub, ok := e.(schema.BlobWrapper)
+			if !ok {
+				return nil, 0, fmt.Errorf("expected sized ref, got: %T", e)
+			}
+			parts = append(parts, sub.DataBlob())
+		}
+		size = obj.Stats.Size()
+	default:
+		return nil, 0, fmt.Errorf("unsupported file object: %T", obj)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(copyParts(ctx, s, pw, parts))
+	}()
+	return pr, size, nil
+}
+
+func copyParts(ctx context.Context, s *cas.Storage, w io.Writer, parts []types.Ref) error {
+	for _, ref := range parts {
+		obj, err := s.DecodeSchema(ctx, ref)
+		if err == schema.ErrNotSchema {
+			obj = nil
+		} else if err != nil {
+			return err
+		}
+		rc, _, err := openFile(ctx, s, ref, obj)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// narReader reads NAR tokens.
+type narReader struct {
+	r *bufio.Reader
+}
+
+func (r *narReader) readLen() (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r.r, buf[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+func (r *narReader) skipPad(n uint64) error {
+	if m := n % 8; m != 0 {
+		var buf [8]byte
+		if _, err := io.ReadFull(r.r, buf[:8-m]); err != nil {
+			return err
+		}
+		for _, b := range buf[:8-m] {
+			if b != 0 {
+				return errNarFormat
+			}
+		}
+	}
+	return nil
+}
+
+func (r *narReader) str() (string, error) {
+	n, err := r.readLen()
+	if err != nil {
+		return "", err
+	} else if n > maxNarString {
+		return "", errNarFormat
+	}
+	buf := make([]byte, n)
+	if _, err = io.ReadFull(r.r, buf); err != nil {
+		return "", err
+	}
+	if err = r.skipPad(n); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// expect reads tokens and checks that they match.
+func (r *narReader) expect(toks ...string) error {
+	for _, exp := range toks {
+		s, err := r.str()
+		if err != nil {
+			return err
+		} else if s != exp {
+			return fmt.Errorf("%v: expected %q, got %q", errNarFormat, exp, s)
+		}
+	}
+	return nil
+}
+
+// Unpack reads NAR and stores its content in CAS as a file or a directory.
+//
+// CAS trees do not support symlinks and the executable bit yet, thus the executable bit is ignored
+// and an error is returned for symlinks.
+func Unpack(ctx context.Context, s *cas.Storage, r io.Reader) (types.SizedRef, error) {
+	nr := &narReader{r: bufio.NewReader(r)}
+	if err := nr.expect(narMagic); err != nil {
+		return types.SizedRef{}, err
+	}
+	ent, err := unpackNode(ctx, s, nr, "")
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	return types.SizedRef{Ref: ent.Ref, Size: ent.Size()}, nil
+}
+
+func unpackNode(ctx context.Context, s *cas.Storage, r *narReader, name string) (*schema.DirEntry, error) {
+	if err := r.expect("(", "type"); err != nil {
+		return nil, err
+	}
+	typ, err := r.str()
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case "regular":
+		tok, err := r.str()
+		if err != nil {
+			return nil, err
+		}
+		if tok == "executable" {
+			if err = r.expect("", "contents"); err != nil {
+				return nil, err
+			}
+		} else if tok != "contents" {
+			return nil, fmt.Errorf("%v: unexpected token %q", errNarFormat, tok)
+		}
+		size, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		sr, err := s.StoreBlob(ctx, io.LimitReader(r.r, int64(size)), &cas.StoreConfig{Expect: types.SizedRef{Size: size}})
+		if err != nil {
+			return nil, err
+		}
+		if err = r.skipPad(size); err != nil {
+			return nil, err
+		}
+		if err = r.expect(")"); err != nil {
+			return nil, err
+		}
+		return &schema.DirEntry{
+			Ref: sr.Ref, Name: name,
+			Stats: schema.Stats{schema.StatDataSize: sr.Size},
+		}, nil
+	case "symlink":
+		return nil, fmt.Errorf("symlinks are not supported: %q", name)
+	case "directory":
+		var ents []schema.DirEntry
+		for {
+			tok, err := r.str()
+			if err != nil {
+				return nil, err
+			} else if tok == ")" {
+				break
+			} else if tok != "entry" {
+				return nil, fmt.Errorf("%v: unexpected token %q", errNarFormat, tok)
+			}
+			if err = r.expect("(", "name"); err != nil {
+				return nil, err
+			}
+			sub, err := r.str()
+			if err != nil {
+				return nil, err
+			} else if sub == "" || sub == "." || sub == ".." || strings.ContainsAny(sub, "/\x00") {
+				return nil, fmt.Errorf("%v: invalid file name %q", errNarFormat, sub)
+			} else if n := len(ents); n > 0 && ents[n-1].Name >= sub {
+				return nil, fmt.Errorf("%v: entries are not sorted", errNarFormat)
+			}
+			if err = r.expect("node"); err != nil {
+				return nil, err
+			}
+			ent, err := unpackNode(ctx, s, r, sub)
+			if err != nil {
+				return nil, err
+			}
+			ents = append(ents, *ent)
+			if err = r.expect(")"); err != nil {
+				return nil, err
+			}
+		}
+		sr, stats, err := s.StoreDirEntries(ctx, ents)
+		if err != nil {
+			return nil, err
+		}
+		return &schema.DirEntry{Ref: sr.Ref, Name: name, Stats: stats}, nil
+	}
+	return nil, fmt.Errorf("%v: unsupported node type %q", errNarFormat, typ)
+}
@@ -0,0 +1,162 @@
+package nix
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+func TestBase32(t *testing.T) {
+	// sha256 of an empty string
+	h := sha256.Sum256(nil)
+	const exp = "0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73"
+	require.Equal(t, exp, EncodeBase32(h[:]))
+	p, err := DecodeBase32(exp, sha256.Size)
+	require.NoError(t, err)
+	require.Equal(t, h[:], p)
+
+	_, err = DecodeBase32("e"+exp[1:], sha256.Size)
+	require.NotNil(t, err)
+}
+
+func newTestStorage(t testing.TB) *cas.Storage {
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	return s
+}
+
+func TestNar(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_nar_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.txt":     "file a",
+		"b/c.txt":   "file c",
+		"b/d/e.txt": strings.Repeat("e", 1000),
+		"empty":     "",
+	}
+	for name, data := range files {
+		fpath := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(fpath), 0755))
+		require.NoError(t, ioutil.WriteFile(fpath, []byte(data), 0644))
+	}
+
+	s := newTestStorage(t)
+	defer s.Close()
+
+	sr, err := s.StoreFilePath(ctx, dir, nil)
+	require.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	err = Pack(ctx, s, sr.Ref, buf)
+	require.NoError(t, err)
+	nar := buf.Bytes()
+	require.True(t, bytes.HasPrefix(nar, []byte("\x0d\x00\x00\x00\x00\x00\x00\x00nix-archive-1\x00\x00\x00")))
+	for _, data := range files {
+		require.True(t, bytes.Contains(nar, []byte(data)))
+	}
+
+	// unpacking creates the same tree
+	sr2, err := Unpack(ctx, s, bytes.NewReader(nar))
+	require.NoError(t, err)
+	require.Equal(t, sr.Ref, sr2.Ref)
+
+	// the same for a single file
+	fref, err := s.StoreFilePath(ctx, filepath.Join(dir, "a.txt"), nil)
+	require.NoError(t, err)
+	buf = new(bytes.Buffer)
+	err = Pack(ctx, s, fref.Ref, buf)
+	require.NoError(t, err)
+	sr2, err = Unpack(ctx, s, bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, fref, sr2)
+
+	_, err = Unpack(ctx, s, bytes.NewReader(nar[:len(nar)-8]))
+	require.NotNil(t, err)
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t)
+	defer s.Close()
+
+	c, err := NewCache(ctx, s, &Options{Writable: true})
+	require.NoError(t, err)
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	const (
+		hash      = "0123456789abcdfghijklmnpqrsvwxyz"
+		storePath = DefaultStoreDir + "/" + hash + "-hello"
+	)
+	nar := []byte("nar data")
+	narHash := "sha256:" + EncodeBase32(types.BytesRef(nar).Digest())
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+	put := func(path string, data []byte) int {
+		req, err := http.NewRequest("PUT", srv.URL+path, bytes.NewReader(data))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	code, info := get("/nix-cache-info")
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, info, "StoreDir: /nix/store\n")
+
+	code, _ = get("/" + hash + ".narinfo")
+	require.Equal(t, http.StatusNotFound, code)
+
+	// upload like "nix copy" does
+	require.Equal(t, http.StatusOK, put("/nar/"+strings.TrimPrefix(narHash, "sha256:")+".nar", nar))
+	require.Equal(t, http.StatusOK, put("/"+hash+".narinfo", []byte(
+		"StorePath: "+storePath+"\nURL: nar/x.nar\nCompression: none\n"+
+			"NarHash: "+narHash+"\nNarSize: 8\nReferences: "+hash+"-hello\n",
+	)))
+
+	// reload the index
+	c, err = NewCache(ctx, s, nil)
+	require.NoError(t, err)
+	srv.Config.Handler = c
+
+	code, info = get("/" + hash + ".narinfo")
+	require.Equal(t, http.StatusOK, code)
+	n, err := ParseNarInfo(strings.NewReader(info))
+	require.NoError(t, err)
+	require.Equal(t, storePath, n.StorePath)
+	require.Equal(t, narHash, n.NarHash)
+	require.Equal(t, uint64(len(nar)), n.File.Size)
+	require.Equal(t, []string{hash + "-hello"}, n.Refs)
+	require.Contains(t, info, "FileHash: "+narHash+"\n")
+
+	code, data := get("/" + n.URL())
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, string(nar), data)
+
+	// read-only cache
+	require.Equal(t, http.StatusMethodNotAllowed, put("/"+hash+".narinfo", nil))
+}
@@ -0,0 +1,242 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// OpenFile opens the content of a stored file for random access and returns its size. Files split into
+// multiple parts are joined transparently, and commits of files are resolved to their root. It returns
+// ErrIsDir for directories.
+//
+// Offsets of parts are taken from sizes recorded in the schema, thus seeking only opens parts that are read.
+// Like OpenBlob, the content is not verified, since only a part of the file might be read.
+func (s *Storage) OpenFile(ctx context.Context, ref Ref) (storage.BlobReader, uint64, error) {
+	if ref.Empty() {
+		return emptyBlob{bytes.NewReader(nil)}, 0, nil
+	}
+	obj, err := s.DecodeSchema(ctx, ref)
+	if err == schema.ErrNotSchema {
+		return s.OpenBlob(ctx, ref)
+	} else if err != nil {
+		return nil, 0, err
+	}
+	switch obj := obj.(type) {
+	case *schema.Commit:
+		return s.OpenFile(ctx, obj.Root)
+	case *schema.InlineList, *schema.List, *schema.Multipart:
+		if isDirObject(obj) {
+			return nil, 0, ErrIsDir
+		}
+		r, err := s.openParts(ctx, obj)
+		if err != nil {
+			return nil, 0, err
+		}
+		return r, uint64(r.size), nil
+	case schema.BlobWrapper:
+		return s.OpenBlob(ctx, obj.DataBlob())
+	}
+	return nil, 0, fmt.Errorf("unsupported file object: %T", obj)
+}
+
+// filePart is a part of a file at a given offset.
+type filePart struct {
+	off int64
+	sr  types.SizedRef
+}
+
+// openParts opens a file split into parts. Nested lists of parts are only resolved when they are read.
+func (s *Storage) openParts(ctx context.Context, obj schema.Object) (*partsReader, error) {
+	r := &partsReader{s: s, ctx: ctx, cur: -1}
+	add := func(sr types.SizedRef) {
+		r.parts = append(r.parts, filePart{off: r.size, sr: sr})
+		r.size += int64(sr.Size)
+	}
+	switch obj := obj.(type) {
+	case *schema.InlineList:
+		if obj.Elem != typeSizedRef {
+			return nil, fmt.Errorf("expected sized ref, got: %q", obj.Elem)
+		}
+		for _, e := range obj.List {
+			sr, ok := e.(*types.SizedRef)
+			if !ok {
+				return nil, fmt.Errorf("expected sized ref, got: %T", e)
+			}
+			add(*sr)
+		}
+	case *schema.List:
+		if obj.Elem != typeSizedRef {
+			return nil, fmt.Errorf("expected sized ref, got: %q", obj.Elem)
+		}
+		// sizes of sub-lists are not recorded in the list, read them from stats
+		for _, ref := range obj.List {
+			sz, err := s.partSize(ctx, ref)
+			if err != nil {
+				return nil, err
+			}
+			add(types.SizedRef{Ref: ref, Size: sz})
+		}
+	case *schema.Multipart:
+		for _, sr := range obj.Parts {
+			add(sr)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported file part: %T", obj)
+	}
+	return r, nil
+}
+
+// partSize returns the size of the content of a part.
+func (s *Storage) partSize(ctx context.Context, ref Ref) (uint64, error) {
+	obj, err := s.DecodeSchema(ctx, ref)
+	if err == schema.ErrNotSchema {
+		return s.StatBlob(ctx, ref)
+	} else if err != nil {
+		return 0, err
+	}
+	switch obj := obj.(type) {
+	case *schema.InlineList:
+		return obj.Stats.Size(), nil
+	case *schema.List:
+		return obj.Stats.Size(), nil
+	}
+	r, err := s.openParts(ctx, obj)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(r.size), nil
+}
+
+// partsReader implements random access to a file split into parts. Only one part is kept open at a time.
+type partsReader struct {
+	s     *Storage
+	ctx   context.Context
+	parts []filePart
+	size  int64
+
+	mu  sync.Mutex
+	cur int                // index of the open part, or -1
+	br  storage.BlobReader // reader of the open part
+	pos int64              // offset for Read, as set by Seek
+}
+
+// part opens a part with a given index, closing the previous one.
+func (r *partsReader) part(i int) (storage.BlobReader, error) {
+	if r.cur == i {
+		return r.br, nil
+	}
+	if r.br != nil {
+		r.br.Close()
+		r.br, r.cur = nil, -1
+	}
+	br, _, err := r.s.OpenFile(r.ctx, r.parts[i].sr.Ref)
+	if err != nil {
+		return nil, err
+	}
+	r.br, r.cur = br, i
+	return br, nil
+}
+
+func (r *partsReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.readAt(p, off)
+}
+
+func (r *partsReader) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	} else if off >= r.size {
+		return 0, io.EOF
+	}
+	// first part that ends after the offset
+	i := sort.Search(len(r.parts), func(i int) bool {
+		pt := r.parts[i]
+		return pt.off+int64(pt.sr.Size) > off
+	})
+	var total int
+	for ; len(p) > 0 && i < len(r.parts); i++ {
+		pt := r.parts[i]
+		if pt.sr.Size == 0 {
+			continue
+		}
+		buf := p
+		if rest := pt.off + int64(pt.sr.Size) - off; int64(len(buf)) > rest {
+			buf = buf[:rest]
+		}
+		br, err := r.part(i)
+		if err != nil {
+			return total, err
+		}
+		n, err := br.ReadAt(buf, off-pt.off)
+		total += n
+		off += int64(n)
+		p = p[n:]
+		if err == io.EOF && n == len(buf) {
+			err = nil
+		} else if err == io.EOF {
+			// part is smaller than recorded in the schema
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	if len(p) != 0 {
+		return total, io.EOF
+	}
+	return total, nil
+}
+
+func (r *partsReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := r.readAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n != 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *partsReader) Seek(off int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		off += r.pos
+	case io.SeekEnd:
+		off += r.size
+	default:
+		return r.pos, os.ErrInvalid
+	}
+	if off < 0 {
+		return r.pos, os.ErrInvalid
+	}
+	r.pos = off
+	return off, nil
+}
+
+func (r *partsReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.br == nil {
+		return nil
+	}
+	err := r.br.Close()
+	r.br, r.cur = nil, -1
+	return err
+}
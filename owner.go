@@ -0,0 +1,173 @@
+package cas
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+
+	"github.com/dennwc/cas/schema"
+)
+
+// POSIX file type and mode bits, as recorded in schema.DirEntry.
+const (
+	posixTypeMask = 0170000
+	posixDir      = 0040000
+	posixFile     = 0100000
+	posixLink     = 0120000
+	posixSetuid   = 04000
+	posixSetgid   = 02000
+	posixSticky   = 01000
+)
+
+// posixMode converts a file mode to a POSIX mode. It returns zero for types other than files, directories and links.
+func posixMode(m os.FileMode) uint32 {
+	var v uint32
+	switch {
+	case m.IsDir():
+		v = posixDir
+	case m.IsRegular():
+		v = posixFile
+	case m&os.ModeSymlink != 0:
+		v = posixLink
+	default:
+		return 0
+	}
+	v |= uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		v |= posixSetuid
+	}
+	if m&os.ModeSetgid != 0 {
+		v |= posixSetgid
+	}
+	if m&os.ModeSticky != 0 {
+		v |= posixSticky
+	}
+	return v
+}
+
+// fileMode returns permission bits of a POSIX mode, as accepted by os.Chmod.
+func fileMode(v uint32) os.FileMode {
+	m := os.FileMode(v).Perm()
+	if v&posixSetuid != 0 {
+		m |= os.ModeSetuid
+	}
+	if v&posixSetgid != 0 {
+		m |= os.ModeSetgid
+	}
+	if v&posixSticky != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// ownerNames caches names of users and groups, since they are looked up for each file.
+type ownerNames struct {
+	mu     sync.Mutex
+	users  map[string]string // by ID
+	groups map[string]string // by ID
+	uids   map[string]int    // by name, -1 if unknown
+	gids   map[string]int    // by name, -1 if unknown
+}
+
+var owners = &ownerNames{
+	users:  make(map[string]string),
+	groups: make(map[string]string),
+	uids:   make(map[string]int),
+	gids:   make(map[string]int),
+}
+
+// names returns names of a user and a group with given IDs. Numeric IDs are returned if names are not known.
+func (o *ownerNames) names(uid, gid int) (string, string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	us, gs := strconv.Itoa(uid), strconv.Itoa(gid)
+	un, ok := o.users[us]
+	if !ok {
+		un = us
+		if u, err := user.LookupId(us); err == nil {
+			un = u.Username
+		}
+		o.users[us] = un
+	}
+	gn, ok := o.groups[gs]
+	if !ok {
+		gn = gs
+		if g, err := user.LookupGroupId(gs); err == nil {
+			gn = g.Name
+		}
+		o.groups[gs] = gn
+	}
+	return un, gn
+}
+
+// ids returns IDs of a user and a group with given names, or -1 if the name is empty or unknown on this system.
+func (o *ownerNames) ids(uname, gname string) (int, int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	uid := lookupID(o.uids, uname, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+	gid := lookupID(o.gids, gname, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+	return uid, gid
+}
+
+// lookupID finds an ID by name and caches it. Numeric names are used as IDs if the name is not known.
+func lookupID(cache map[string]int, name string, lookup func(name string) (string, error)) int {
+	if name == "" {
+		return -1
+	} else if id, ok := cache[name]; ok {
+		return id
+	}
+	id := -1
+	if v, err := lookup(name); err == nil {
+		if n, err := strconv.Atoi(v); err == nil {
+			id = n
+		}
+	} else if n, err := strconv.Atoi(name); err == nil {
+		id = n
+	}
+	cache[name] = id
+	return id
+}
+
+// setEntryMeta records the mode and the owner of a local file in the entry, as requested by the config.
+func setEntryMeta(ent *schema.DirEntry, fi os.FileInfo, conf *StoreConfig) {
+	if conf.Mode {
+		ent.Mode = posixMode(fi.Mode())
+	}
+	if conf.Owner {
+		if uid, gid, ok := fileOwner(fi); ok {
+			ent.User, ent.Group = owners.names(uid, gid)
+		}
+	}
+}
+
+// applyEntryMeta applies the mode and the owner recorded in the entry to a restored file, as requested by options.
+// The owner is changed first, since it may reset setuid and setgid bits.
+func applyEntryMeta(fpath string, ent *schema.DirEntry, opt *CheckoutOptions) error {
+	if opt.Owner && (ent.User != "" || ent.Group != "") {
+		uid, gid := owners.ids(ent.User, ent.Group)
+		if uid != -1 || gid != -1 {
+			if err := os.Lchown(fpath, uid, gid); err != nil {
+				return err
+			}
+		}
+	}
+	if opt.Mode && ent.Mode != 0 && ent.Mode&posixTypeMask != posixLink {
+		if err := os.Chmod(fpath, fileMode(ent.Mode)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//+build !windows
+
+package cas
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns IDs of the owner and the group of a file.
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
@@ -0,0 +1,8 @@
+package cas
+
+import "os"
+
+// fileOwner is not implemented on Windows; owners are not recorded.
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,27 @@
+package cas
+
+import (
+	"context"
+	"io"
+
+	"github.com/dennwc/cas/storage"
+)
+
+// WritePack writes a tree pack with all blobs reachable from the ref. See storage.WritePack.
+func (s *Storage) WritePack(ctx context.Context, w io.Writer, ref Ref) error {
+	return storage.WritePack(ctx, w, s.st, ref)
+}
+
+// ReadPack stores all blobs from a tree pack and returns the root blob. See storage.ReadPack.
+func (s *Storage) ReadPack(ctx context.Context, r io.Reader) (SizedRef, error) {
+	if ps, ok := s.st.(storage.PackStorer); ok {
+		return ps.StorePack(ctx, r)
+	}
+	return storage.ReadPack(ctx, s.st, r)
+}
+
+// Push copies all blobs reachable from the ref to another storage. If the destination is empty,
+// blobs are transferred as a single tree pack, if either storage supports it. See storage.CopyTree.
+func (s *Storage) Push(ctx context.Context, dst *Storage, ref Ref) error {
+	return storage.CopyTree(ctx, dst.st, s.st, ref)
+}
@@ -0,0 +1,198 @@
+package cas
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dennwc/cas/schema"
+)
+
+func (o *CheckoutOptions) filtered() bool {
+	return len(o.Include) != 0 || len(o.Exclude) != 0 || o.LargerThan != 0 || o.SmallerThan != 0
+}
+
+func (o *CheckoutOptions) validate() error {
+	for _, list := range [][]string{o.Include, o.Exclude} {
+		for _, p := range list {
+			for _, seg := range strings.Split(strings.TrimPrefix(p, "/"), "/") {
+				if _, err := path.Match(seg, ""); err != nil {
+					return fmt.Errorf("invalid pattern %q: %v", p, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Storage) checkoutFiltered(ctx context.Context, ref Ref, dst string, co *checkouter) error {
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("path already exists")
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	ents, err := s.ReadDir(ctx, ref)
+	if err != nil {
+		return err
+	}
+	if err = co.mkdir(dst); err != nil {
+		return err
+	}
+	return s.checkoutFilteredDir(ctx, ents, dst, "", len(co.opt.Include) == 0, co)
+}
+
+// checkoutFilteredDir restores entries of a directory that pass the filter. The all flag is set if the directory
+// matches one of the Include patterns, or if there are no such patterns.
+func (s *Storage) checkoutFilteredDir(ctx context.Context, ents []*schema.DirEntry, dst, rel string, all bool, co *checkouter) error {
+	if err := checkEntryNames(ents); err != nil {
+		return err
+	}
+	opt := co.opt
+	var files []*schema.DirEntry
+	for _, ent := range ents {
+		name := path.Join(rel, ent.Name)
+		if matchAny(opt.Exclude, name) {
+			continue
+		}
+		sz, hasSize := ent.Stats[schema.StatDataSize]
+		if hasSize && opt.LargerThan != 0 && sz <= opt.LargerThan {
+			// neither the entry nor any file in the subtree can be larger than its total size
+			continue
+		}
+		// files can be skipped without fetching the blob
+		isFile := ent.Link != "" || isFileEntry(ent)
+		tooLarge := opt.SmallerThan != 0 && sz >= opt.SmallerThan
+		included := all || matchAny(opt.Include, name)
+		if isFile {
+			if included && !tooLarge {
+				files = append(files, ent)
+			}
+			continue
+		} else if !included && !matchAnyUnder(opt.Include, name) {
+			// no file under this path can match, thus it doesn't matter if it's a directory
+			continue
+		}
+		sub, err := s.ReadDir(ctx, ent.Ref)
+		if err == ErrNotDir {
+			if included && !tooLarge {
+				files = append(files, ent)
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		spath := filepath.Join(dst, ent.Name)
+		if included && len(opt.Include) != 0 {
+			if err = co.mkdir(spath); err != nil {
+				return err
+			}
+		}
+		if err = s.checkoutFilteredDir(ctx, sub, spath, name, included, co); err != nil {
+			return err
+		}
+		if _, err = os.Stat(spath); err == nil {
+			co.restored(spath, ent)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	if err := co.mkdir(dst); err != nil {
+		return err
+	}
+	done, err := s.checkoutBatch(ctx, files, dst, co)
+	if err != nil {
+		return err
+	}
+	for i, ent := range files {
+		spath := filepath.Join(dst, ent.Name)
+		co.restored(spath, ent)
+		if done[i] {
+			continue
+		} else if ent.Link != "" {
+			err = co.symlink(ent, spath)
+		} else {
+			ref := ent.Ref
+			err = co.submit(func() error {
+				return s.checkoutFileOrDir(ctx, ref, spath, co)
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchAny checks if a slash-separated path matches any of the patterns. See CheckoutOptions.Include.
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if !strings.Contains(p, "/") {
+			if ok, _ := path.Match(p, path.Base(name)); ok {
+				return true
+			}
+			continue
+		}
+		if matchSegments(strings.Split(strings.TrimPrefix(p, "/"), "/"), strings.Split(name, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAnyUnder checks if any path inside of a directory may match one of the patterns.
+func matchAnyUnder(patterns []string, dir string) bool {
+	for _, p := range patterns {
+		if !strings.Contains(p, "/") {
+			// names are matched at any depth
+			return true
+		}
+		if matchPrefix(strings.Split(strings.TrimPrefix(p, "/"), "/"), strings.Split(dir, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments matches path segments against pattern segments, where "**" matches zero or more segments.
+func matchSegments(pat, segs []string) bool {
+	for len(pat) != 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(pat[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], segs[0]); !ok {
+			return false
+		}
+		pat, segs = pat[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// matchPrefix checks if the pattern may match any path that starts with the given directory segments.
+func matchPrefix(pat, dir []string) bool {
+	for len(dir) != 0 {
+		if len(pat) == 0 {
+			return false
+		} else if pat[0] == "**" {
+			return true
+		}
+		if ok, _ := path.Match(pat[0], dir[0]); !ok {
+			return false
+		}
+		pat, dir = pat[1:], dir[1:]
+	}
+	return len(pat) != 0
+}
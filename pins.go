@@ -0,0 +1,198 @@
+package cas
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// PinsExport is a serialized form of all pins in the store.
+type PinsExport struct {
+	Pins []ExportedPin `json:"pins"`
+}
+
+// ExportedPin is a single pin in the export.
+type ExportedPin struct {
+	types.Pin
+	// History of the pin, from the oldest to the most recent value, if the store keeps it.
+	History []ExportedPinRecord `json:"history,omitempty"`
+}
+
+// ExportedPinRecord is a single change in the history of an exported pin.
+type ExportedPinRecord struct {
+	Ref  types.Ref `json:"ref"` // zero if the pin was deleted
+	Time time.Time `json:"time"`
+}
+
+// ExportPins writes all pins in the store to w in JSON format.
+func (s *Storage) ExportPins(ctx context.Context, w io.Writer) error {
+	exp := PinsExport{Pins: []ExportedPin{}}
+	// signed pins are exported as is
+	it := s.st.IteratePins(ctx)
+	defer it.Close()
+	for it.Next() {
+		exp.Pins = append(exp.Pins, ExportedPin{Pin: it.Pin()})
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if ms, ok := s.st.(storage.PinMetaStorage); ok {
+		for i := range exp.Pins {
+			p := &exp.Pins[i]
+			if p.Meta != nil {
+				continue
+			}
+			meta, err := ms.GetPinMeta(ctx, p.Name)
+			if err != nil {
+				return err
+			}
+			p.Meta = meta
+		}
+	}
+	if ph, ok := s.st.(storage.PinHistorian); ok {
+		for i := range exp.Pins {
+			p := &exp.Pins[i]
+			recs, err := ph.PinHistory(ctx, p.Name)
+			if err == storage.ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			for _, r := range recs {
+				p.History = append(p.History, ExportedPinRecord{Ref: r.Ref, Time: r.Time.UTC()})
+			}
+		}
+	}
+	sort.Slice(exp.Pins, func(i, j int) bool {
+		return exp.Pins[i].Name < exp.Pins[j].Name
+	})
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(exp)
+}
+
+// ImportPinsOptions controls how the pins are merged with existing ones.
+type ImportPinsOptions struct {
+	// Overwrite existing pins that point to a different ref.
+	// By default, such pins are kept and reported as conflicts.
+	Overwrite bool
+	// DryRun only reports the changes without applying them.
+	DryRun bool
+}
+
+// ImportPinsResult summarizes changes made by ImportPins.
+type ImportPinsResult struct {
+	Added     []string // pins that didn't exist
+	Updated   []string // pins that were overwritten
+	Unchanged []string // pins that already pointed to the same ref
+	Conflicts []string // pins that point to a different ref and were kept
+}
+
+// ImportPins reads pins exported by ExportPins and merges them with pins in the store.
+// Referenced blobs are not required to exist in the store. All pins are checked before any of them are changed.
+//
+// Values that are signed pins are stored as is, since the signature cannot be reproduced. Other values are signed
+// if a signing key is set (see SetSigningKey). Overwritten pins get the metadata of imported pins, and lose their
+// own metadata if imported pins have none.
+func (s *Storage) ImportPins(ctx context.Context, r io.Reader, opt *ImportPinsOptions) (*ImportPinsResult, error) {
+	if opt == nil {
+		opt = &ImportPinsOptions{}
+	}
+	var exp PinsExport
+	if err := json.NewDecoder(r).Decode(&exp); err != nil {
+		return nil, fmt.Errorf("cannot decode pins: %v", err)
+	}
+	seen := make(map[string]bool, len(exp.Pins))
+	for _, p := range exp.Pins {
+		if p.Name == "" || p.Ref.Zero() {
+			return nil, fmt.Errorf("invalid pin: %q = %q", p.Name, p.Ref)
+		} else if seen[p.Name] {
+			return nil, fmt.Errorf("duplicate pin: %q", p.Name)
+		}
+		seen[p.Name] = true
+	}
+	res := &ImportPinsResult{}
+	for _, p := range exp.Pins {
+		val, signed, err := s.pinValue(ctx, p.Ref)
+		if err != nil {
+			return res, err
+		}
+		cur, err := s.st.GetPin(ctx, p.Name)
+		if err == nil && cur != p.Ref {
+			// the same value might be signed differently
+			cur, _, err = s.pinValue(ctx, cur)
+		}
+		updated := false
+		switch {
+		case err == storage.ErrNotFound:
+			res.Added = append(res.Added, p.Name)
+		case err != nil:
+			return res, err
+		case cur == val:
+			res.Unchanged = append(res.Unchanged, p.Name)
+			continue
+		case !opt.Overwrite:
+			res.Conflicts = append(res.Conflicts, p.Name)
+			continue
+		default:
+			res.Updated = append(res.Updated, p.Name)
+			updated = true
+		}
+		if opt.DryRun {
+			continue
+		}
+		if err = s.importPinHistory(ctx, p); err != nil {
+			return res, err
+		}
+		if signed {
+			err = s.st.SetPin(ctx, p.Name, p.Ref)
+		} else {
+			err = s.SetPin(ctx, p.Name, p.Ref)
+		}
+		if err != nil {
+			return res, err
+		}
+		if p.Meta == nil && !updated {
+			continue
+		}
+		// metadata is imported as is, if the store supports it
+		if ms, ok := s.st.(storage.PinMetaStorage); ok {
+			if err = ms.SetPinMeta(ctx, p.Name, p.Meta); err != nil {
+				return res, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// pinValue returns the ref a stored value of a pin points to, and reports if the value is a signed pin.
+// Values that are not in the store are considered unsigned.
+func (s *Storage) pinValue(ctx context.Context, ref Ref) (Ref, bool, error) {
+	p, err := s.decodeSignedPin(ctx, ref)
+	if err == storage.ErrNotFound || (err == nil && p == nil) {
+		return ref, false, nil
+	} else if err != nil {
+		return Ref{}, false, err
+	}
+	return p.Ref, true, nil
+}
+
+// importPinHistory appends the history of an exported pin to the history of the pin in the store, if the store
+// supports it. The last record is not imported, since setting the pin records its current value.
+func (s *Storage) importPinHistory(ctx context.Context, p ExportedPin) error {
+	ha, ok := s.st.(storage.PinHistoryAppender)
+	if !ok || len(p.History) < 2 {
+		return nil
+	}
+	recs := make([]storage.PinRecord, 0, len(p.History)-1)
+	for _, r := range p.History[:len(p.History)-1] {
+		recs = append(recs, storage.PinRecord{Ref: r.Ref, Time: r.Time})
+	}
+	return ha.AppendPinHistory(ctx, p.Name, recs)
+}
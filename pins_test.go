@@ -0,0 +1,180 @@
+package cas_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/gc"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+func TestPinExpiry(t *testing.T) {
+	ctx := context.Background()
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+
+	keep, err := s.StoreBlob(ctx, strings.NewReader("keep"), nil)
+	require.NoError(t, err)
+	tmp, err := s.StoreBlob(ctx, strings.NewReader("temporary"), nil)
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetPin(ctx, "keep", keep.Ref))
+	require.NoError(t, s.SetPin(ctx, "tmp", tmp.Ref))
+	past := time.Now().Add(-time.Minute)
+	require.NoError(t, s.SetPinMeta(ctx, "tmp", &types.PinMeta{Expires: &past}))
+
+	_, err = s.GetPin(ctx, "tmp")
+	require.Equal(t, storage.ErrNotFound, err)
+
+	it := s.IteratePins(ctx)
+	require.True(t, it.Next())
+	require.Equal(t, "keep", it.Pin().Name)
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+	require.NoError(t, it.Close())
+
+	// blobs of expired pins are collected
+	rep, err := gc.Run(ctx, s.Underlying(), nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), rep.Pins)
+	require.Equal(t, uint64(1), rep.Swept)
+	_, err = s.StatBlob(ctx, tmp.Ref)
+	require.Equal(t, storage.ErrNotFound, err)
+	_, err = s.StatBlob(ctx, keep.Ref)
+	require.NoError(t, err)
+
+	// expired pins are considered deleted, thus setting them again removes the expiration time
+	require.NoError(t, s.SetPinCAS(ctx, "tmp", types.Ref{}, keep.Ref))
+	ref, err := s.GetPin(ctx, "tmp")
+	require.NoError(t, err)
+	require.Equal(t, keep.Ref, ref)
+	meta, err := s.GetPinMeta(ctx, "tmp")
+	require.NoError(t, err)
+	require.Nil(t, meta)
+
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, s.SetPinMeta(ctx, "tmp", &types.PinMeta{Expires: &future}))
+	ref, err = s.GetPin(ctx, "tmp")
+	require.NoError(t, err)
+	require.Equal(t, keep.Ref, ref)
+}
+
+func TestExportPinsHistory(t *testing.T) {
+	ctx := context.Background()
+	src, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	r1, r2 := types.StringRef("a"), types.StringRef("b")
+	require.NoError(t, src.SetPin(ctx, "a", r1))
+	require.NoError(t, src.SetPin(ctx, "a", r2))
+	hist, err := src.PinHistory(ctx, "a")
+	require.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, src.ExportPins(ctx, buf))
+
+	dst, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	res, err := dst.ImportPins(ctx, buf, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, res.Added)
+
+	got, err := dst.PinHistory(ctx, "a")
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	require.Equal(t, r1, got[0].Ref)
+	require.True(t, hist[0].Time.Equal(got[0].Time))
+	require.Equal(t, r2, got[1].Ref)
+	ref, err := dst.GetPin(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, r2, ref)
+}
+
+func TestImportPins(t *testing.T) {
+	ctx := context.Background()
+	r1, r2, r3 := types.StringRef("a"), types.StringRef("b"), types.StringRef("c")
+
+	src, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	for name, ref := range map[string]types.Ref{"same": r1, "conflict": r2, "meta": r1, "new": r3} {
+		require.NoError(t, src.SetPin(ctx, name, ref))
+	}
+	require.NoError(t, src.SetPinMeta(ctx, "meta", &types.PinMeta{Author: "src"}))
+	buf := new(bytes.Buffer)
+	require.NoError(t, src.ExportPins(ctx, buf))
+	data := buf.Bytes()
+
+	dst, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	for name, ref := range map[string]types.Ref{"same": r1, "conflict": r1, "meta": r2} {
+		require.NoError(t, dst.SetPin(ctx, name, ref))
+	}
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, dst.SetPinMeta(ctx, "conflict", &types.PinMeta{Author: "dst", Expires: &future}))
+
+	pins := func() map[string]types.Ref {
+		m := make(map[string]types.Ref)
+		for _, name := range []string{"same", "conflict", "meta", "new"} {
+			if ref, err := dst.GetPin(ctx, name); err == nil {
+				m[name] = ref
+			}
+		}
+		return m
+	}
+	before := pins()
+	exp := &cas.ImportPinsResult{
+		Added:     []string{"new"},
+		Unchanged: []string{"same"},
+		Conflicts: []string{"conflict", "meta"},
+	}
+	res, err := dst.ImportPins(ctx, bytes.NewReader(data), &cas.ImportPinsOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, exp, res)
+	require.Equal(t, before, pins())
+
+	// conflicting pins are kept by default
+	res, err = dst.ImportPins(ctx, bytes.NewReader(data), nil)
+	require.NoError(t, err)
+	require.Equal(t, exp, res)
+	require.Equal(t, map[string]types.Ref{"same": r1, "conflict": r1, "meta": r2, "new": r3}, pins())
+	meta, err := dst.GetPinMeta(ctx, "conflict")
+	require.NoError(t, err)
+	require.Equal(t, "dst", meta.Author)
+
+	res, err = dst.ImportPins(ctx, bytes.NewReader(data), &cas.ImportPinsOptions{Overwrite: true, DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{"conflict", "meta"}, res.Updated)
+	require.Equal(t, map[string]types.Ref{"same": r1, "conflict": r1, "meta": r2, "new": r3}, pins())
+
+	res, err = dst.ImportPins(ctx, bytes.NewReader(data), &cas.ImportPinsOptions{Overwrite: true})
+	require.NoError(t, err)
+	require.Equal(t, &cas.ImportPinsResult{
+		Updated:   []string{"conflict", "meta"},
+		Unchanged: []string{"new", "same"},
+	}, res)
+	require.Equal(t, map[string]types.Ref{"same": r1, "conflict": r2, "meta": r1, "new": r3}, pins())
+	// metadata of the old value is not kept
+	meta, err = dst.GetPinMeta(ctx, "conflict")
+	require.NoError(t, err)
+	require.Nil(t, meta)
+	meta, err = dst.GetPinMeta(ctx, "meta")
+	require.NoError(t, err)
+	require.Equal(t, "src", meta.Author)
+
+	// pins are checked before any of them are changed
+	for _, data := range []string{
+		`{"pins": [{"name": "x", "ref": "` + r1.String() + `"}, {"name": "", "ref": "` + r1.String() + `"}]}`,
+		`{"pins": [{"name": "x", "ref": "` + r1.String() + `"}, {"name": "x", "ref": "` + r2.String() + `"}]}`,
+	} {
+		_, err = dst.ImportPins(ctx, strings.NewReader(data), nil)
+		require.Error(t, err)
+		_, err = dst.GetPin(ctx, "x")
+		require.Equal(t, storage.ErrNotFound, err)
+	}
+}
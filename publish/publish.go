@@ -0,0 +1,258 @@
+// Package publish syncs trees stored in CAS to external targets, such as static website hosting.
+//
+// The last published tree is recorded in a pin, thus only files with changed refs are transferred
+// on the next publish, and files removed from the tree are deleted from the target.
+package publish
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// Target is an external location that hosts published files.
+//
+// All paths are slash-separated and relative to the root of the published tree.
+type Target interface {
+	// Upload copies files from a local directory to the target, overwriting existing files.
+	Upload(ctx context.Context, dir string, files []string) error
+	// Delete removes files from the target. Files that do not exist on the target are ignored.
+	Delete(ctx context.Context, files []string) error
+}
+
+// Options for publishing a tree.
+type Options struct {
+	// Pin records the last published tree. If set, only the difference with the tree in this pin
+	// is transferred, and the pin is updated after a successful publish.
+	// If not set, or the pin does not exist, all files are uploaded and nothing is deleted.
+	Pin string
+	// DryRun only computes the changes without transferring any files.
+	DryRun bool
+}
+
+// Result describes changes made by Publish.
+type Result struct {
+	Uploaded []string // uploaded files
+	Deleted  []string // deleted files
+	Size     uint64   // total size of uploaded files
+}
+
+// Publish syncs a directory stored in CAS to the target.
+//
+// Changed files are uploaded before deleting files that were removed from the tree, thus the target
+// never misses the files referenced by the new version of the content.
+func Publish(ctx context.Context, s *cas.Storage, ref types.Ref, t Target, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	var last types.Ref
+	if opts.Pin != "" {
+		var err error
+		last, err = s.GetPin(ctx, opts.Pin)
+		if err == storage.ErrNotFound {
+			last = types.Ref{}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	d := &differ{s: s}
+	if err := d.diff(ctx, "", last, ref); err != nil {
+		return nil, err
+	}
+	res := &Result{Deleted: append(d.replace, d.del...), Size: d.size}
+	for _, f := range d.put {
+		res.Uploaded = append(res.Uploaded, f.path)
+	}
+	if opts.DryRun {
+		return res, nil
+	}
+	// checkout files first, so the target is not modified if it fails
+	var dir string
+	if len(d.put) != 0 {
+		var err error
+		dir, err = stage(ctx, s, d.put)
+		if dir != "" {
+			defer os.RemoveAll(dir)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// files replaced by directories (or vice versa) must be removed first
+	if len(d.replace) != 0 {
+		if err := t.Delete(ctx, d.replace); err != nil {
+			return nil, err
+		}
+	}
+	if len(d.put) != 0 {
+		if err := t.Upload(ctx, dir, res.Uploaded); err != nil {
+			return nil, err
+		}
+	}
+	if len(d.del) != 0 {
+		if err := t.Delete(ctx, d.del); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Pin != "" && last != ref {
+		if err := s.SetPin(ctx, opts.Pin, ref); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// stage checks out files to a temporary directory.
+func stage(ctx context.Context, s *cas.Storage, files []file) (string, error) {
+	dir, err := ioutil.TempDir("", "cas_publish_")
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		fpath := filepath.Join(dir, filepath.FromSlash(f.path))
+		if err = os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			return dir, err
+		}
+		if err = s.Checkout(ctx, f.ref, fpath); err != nil {
+			return dir, err
+		}
+	}
+	return dir, nil
+}
+
+type file struct {
+	path string
+	ref  types.Ref
+}
+
+// differ computes a list of changes between two trees.
+type differ struct {
+	s       *cas.Storage
+	put     []file
+	size    uint64
+	replace []string // deleted before the upload
+	del     []string // deleted after the upload
+}
+
+// readDir lists the directory. It returns false if the ref points to a file.
+func (d *differ) readDir(ctx context.Context, ref types.Ref) ([]*schema.DirEntry, bool, error) {
+	ents, err := d.s.ReadDir(ctx, ref)
+	if err == cas.ErrNotDir {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return ents, true, nil
+}
+
+// diff compares two directories. Subtrees with the same ref are skipped.
+func (d *differ) diff(ctx context.Context, dir string, old, cur types.Ref) error {
+	if old == cur {
+		return nil
+	}
+	cents, ok, err := d.readDir(ctx, cur)
+	if err != nil {
+		return err
+	} else if !ok {
+		return cas.ErrNotDir
+	}
+	var oents []*schema.DirEntry
+	if !old.Zero() {
+		oents, ok, err = d.readDir(ctx, old)
+		if err != nil {
+			return err
+		} else if !ok {
+			oents = nil
+		}
+	}
+	for len(oents) != 0 || len(cents) != 0 {
+		switch {
+		case len(cents) == 0 || (len(oents) != 0 && oents[0].Name < cents[0].Name):
+			if err = d.remove(ctx, path.Join(dir, oents[0].Name), oents[0], &d.del); err != nil {
+				return err
+			}
+			oents = oents[1:]
+		case len(oents) == 0 || cents[0].Name < oents[0].Name:
+			if err = d.add(ctx, path.Join(dir, cents[0].Name), cents[0]); err != nil {
+				return err
+			}
+			cents = cents[1:]
+		default:
+			o, c := oents[0], cents[0]
+			oents, cents = oents[1:], cents[1:]
+			if o.Ref == c.Ref {
+				continue
+			}
+			if err = d.change(ctx, path.Join(dir, c.Name), o, c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// change handles an entry that exists in both trees, but has a different ref.
+func (d *differ) change(ctx context.Context, name string, o, c *schema.DirEntry) error {
+	_, odir, err := d.readDir(ctx, o.Ref)
+	if err != nil {
+		return err
+	}
+	_, cdir, err := d.readDir(ctx, c.Ref)
+	if err != nil {
+		return err
+	}
+	switch {
+	case odir && cdir:
+		return d.diff(ctx, name, o.Ref, c.Ref)
+	case !odir && !cdir:
+		d.put = append(d.put, file{path: name, ref: c.Ref})
+		d.size += c.Size()
+		return nil
+	}
+	if err = d.remove(ctx, name, o, &d.replace); err != nil {
+		return err
+	}
+	return d.add(ctx, name, c)
+}
+
+// add records all files of an entry as uploaded.
+func (d *differ) add(ctx context.Context, name string, e *schema.DirEntry) error {
+	ents, dir, err := d.readDir(ctx, e.Ref)
+	if err != nil {
+		return err
+	} else if !dir {
+		d.put = append(d.put, file{path: name, ref: e.Ref})
+		d.size += e.Size()
+		return nil
+	}
+	for _, sub := range ents {
+		if err = d.add(ctx, path.Join(name, sub.Name), sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove records all files of an entry as deleted.
+func (d *differ) remove(ctx context.Context, name string, e *schema.DirEntry, out *[]string) error {
+	ents, dir, err := d.readDir(ctx, e.Ref)
+	if err != nil {
+		return err
+	} else if !dir {
+		*out = append(*out, name)
+		return nil
+	}
+	for _, sub := range ents {
+		if err = d.remove(ctx, path.Join(name, sub.Name), sub, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
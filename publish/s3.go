@@ -0,0 +1,181 @@
+package publish
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var _ Target = (*S3Target)(nil)
+
+// S3Target publishes files to an S3 bucket, for example the one configured for static website hosting.
+//
+// Requests are signed with AWS Signature Version 4, thus it works with other S3-compatible services as well.
+type S3Target struct {
+	// Endpoint is the URL of S3 service. Objects are addressed as Endpoint/Bucket/Key.
+	// If not set, AWS endpoint for the region is used.
+	Endpoint string
+	// Region of the bucket. Defaults to us-east-1.
+	Region string
+	Bucket string
+	// Prefix is prepended to the file path to get the object key.
+	Prefix string
+
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// Client is the HTTP client. http.DefaultClient is used if not set.
+	Client *http.Client
+}
+
+func (t *S3Target) region() string {
+	if t.Region == "" {
+		return "us-east-1"
+	}
+	return t.Region
+}
+
+func (t *S3Target) objectURL(name string) string {
+	endpoint := t.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + t.region() + ".amazonaws.com"
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/" + escapeString(t.Bucket) + "/" + escapePath(t.Prefix+name)
+}
+
+func (t *S3Target) do(ctx context.Context, method, name string, body io.ReadSeeker, size int64) error {
+	var sum string
+	if body != nil {
+		h := sha256.New()
+		if _, err := io.Copy(h, body); err != nil {
+			return err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+	} else {
+		sum = emptySHA256
+	}
+	var r io.Reader
+	if body != nil {
+		r = body
+	}
+	req, err := http.NewRequest(method, t.objectURL(name), r)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType(name))
+	}
+	if t.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", t.SessionToken)
+	}
+	signV4(req, sum, t.region(), "s3", t.AccessKey, t.SecretKey, time.Now())
+
+	cli := t.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	resp, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s %q: unexpected status: %v: %s", method, name, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (t *S3Target) Upload(ctx context.Context, dir string, files []string) error {
+	for _, name := range files {
+		if err := uploadFile(dir, name, func(f *os.File, size int64) error {
+			return t.do(ctx, "PUT", name, f, size)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete implements Target. S3 doesn't report an error when deleting missing objects.
+func (t *S3Target) Delete(ctx context.Context, files []string) error {
+	for _, name := range files {
+		if err := t.do(ctx, "DELETE", name, nil, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signV4 signs the request with AWS Signature Version 4. All headers of the request are signed.
+func signV4(req *http.Request, payloadHash, region, service, accessKey, secretKey string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canon strings.Builder
+	for _, k := range names {
+		canon.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	creq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canon.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	creqHash := sha256.Sum256([]byte(creq))
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(creqHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signed+", Signature="+sig)
+}
@@ -0,0 +1,229 @@
+package publish
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	_ Target = DirTarget{}
+	_ Target = (*RsyncTarget)(nil)
+	_ Target = (*HTTPTarget)(nil)
+)
+
+// DirTarget publishes files to a local directory.
+type DirTarget struct {
+	Path string
+}
+
+func (t DirTarget) Upload(ctx context.Context, dir string, files []string) error {
+	for _, name := range files {
+		dst := filepath.Join(t.Path, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(dst, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(dst, src string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if _, err = io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (t DirTarget) Delete(ctx context.Context, files []string) error {
+	root := filepath.Clean(t.Path)
+	for _, name := range files {
+		fpath := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.Remove(fpath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// remove empty parent directories
+		for dir := filepath.Dir(fpath); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// RsyncTarget publishes files with rsync, usually over SSH.
+//
+// Deletion requires rsync 3.1 or later on both sides.
+type RsyncTarget struct {
+	// Dest is the rsync destination, for example "user@host:/var/www/site".
+	Dest string
+	// Args are additional arguments for rsync, for example "-e", "ssh -p 2222".
+	Args []string
+}
+
+func (t *RsyncTarget) run(ctx context.Context, dir string, files []string, args ...string) error {
+	var list bytes.Buffer
+	for _, name := range files {
+		list.WriteString(name)
+		list.WriteByte(0)
+	}
+	args = append([]string{"-rt", "--from0", "--files-from=-"}, args...)
+	args = append(args, t.Args...)
+	args = append(args, dir+string(filepath.Separator), t.Dest)
+
+	cmd := exec.CommandContext(ctx, "rsync", args...)
+	cmd.Stdin = &list
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("rsync: %v", err)
+	}
+	return nil
+}
+
+func (t *RsyncTarget) Upload(ctx context.Context, dir string, files []string) error {
+	return t.run(ctx, dir, files)
+}
+
+func (t *RsyncTarget) Delete(ctx context.Context, files []string) error {
+	// rsync deletes files from the list that are missing in the source directory
+	dir, err := ioutil.TempDir("", "cas_publish_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	return t.run(ctx, dir, files, "--delete-missing-args")
+}
+
+// HTTPTarget publishes files to an HTTP server that accepts PUT and DELETE requests for files,
+// for example a WebDAV server or a deploy API of a hosting provider.
+type HTTPTarget struct {
+	// URL is the base URL. File paths are appended to it.
+	URL string
+	// Header is added to all requests, for example to set an authorization token.
+	Header http.Header
+	// Client is the HTTP client. http.DefaultClient is used if not set.
+	Client *http.Client
+}
+
+func (t *HTTPTarget) do(ctx context.Context, method, name string, body io.Reader, size int64) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(t.URL, "/")+"/"+escapePath(name), body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range t.Header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", contentType(name))
+	}
+	cli := t.Client
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	resp, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case method == "DELETE" && resp.StatusCode == http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("%s %q: unexpected status: %v", method, name, resp.Status)
+}
+
+func (t *HTTPTarget) Upload(ctx context.Context, dir string, files []string) error {
+	for _, name := range files {
+		if err := uploadFile(dir, name, func(f *os.File, size int64) error {
+			return t.do(ctx, "PUT", name, f, size)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *HTTPTarget) Delete(ctx context.Context, files []string) error {
+	for _, name := range files {
+		if err := t.do(ctx, "DELETE", name, nil, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadFile opens a staged file and passes it to the upload function.
+func uploadFile(dir, name string, upload func(f *os.File, size int64) error) error {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return upload(f, fi.Size())
+}
+
+// contentType detects the content type of a file by its extension.
+func contentType(name string) string {
+	if typ := mime.TypeByExtension(path.Ext(name)); typ != "" {
+		return typ
+	}
+	return "application/octet-stream"
+}
+
+// escapePath escapes each element of a slash-separated path.
+func escapePath(name string) string {
+	parts := strings.Split(name, "/")
+	for i, p := range parts {
+		parts[i] = escapeString(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// escapeString escapes all bytes except unreserved characters (RFC 3986).
+func escapeString(s string) string {
+	const hex = "0123456789ABCDEF"
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+			continue
+		}
+		buf.WriteByte('%')
+		buf.WriteByte(hex[c>>4])
+		buf.WriteByte(hex[c&0xf])
+	}
+	return buf.String()
+}
@@ -0,0 +1,164 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/types"
+)
+
+// Annotations used to find image tags in OCI layout.
+const (
+	annotationRefName   = "org.opencontainers.image.ref.name"
+	annotationContainer = "io.containerd.image.name"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// tagName returns the tag of the image described by the descriptor, or an empty string.
+func (d *ociDescriptor) tagName() string {
+	if name := d.Annotations[annotationRefName]; validTag(name) {
+		return name
+	}
+	name := d.Annotations[annotationContainer]
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// ImportOCI imports all images from an OCI image layout into the repository and returns created tags.
+// The path may point to a layout directory or to a tar archive of it (as created by "docker save").
+//
+// Images are tagged according to the annotations in the layout index. If the layout contains a single
+// untagged image, it is tagged as "latest".
+func (r *Registry) ImportOCI(ctx context.Context, fpath, repo string) ([]*Tag, error) {
+	if !validRepo(repo) {
+		return nil, fmt.Errorf("invalid repository name: %q", repo)
+	}
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return nil, err
+	}
+	var index []byte
+	if fi.IsDir() {
+		index, err = r.importOCIDir(ctx, fpath)
+	} else {
+		index, err = r.importOCITar(ctx, fpath)
+	}
+	if err != nil {
+		return nil, err
+	} else if index == nil {
+		return nil, fmt.Errorf("index.json not found in %q", fpath)
+	}
+	var idx ociIndex
+	if err = json.Unmarshal(index, &idx); err != nil {
+		return nil, fmt.Errorf("cannot decode OCI index: %v", err)
+	}
+	var tags []*Tag
+	for _, d := range idx.Manifests {
+		name := d.tagName()
+		if name == "" && len(idx.Manifests) == 1 {
+			name = "latest"
+		} else if name == "" {
+			continue
+		}
+		ref, err := types.ParseRef(d.Digest)
+		if err != nil {
+			return tags, fmt.Errorf("invalid digest %q: %v", d.Digest, err)
+		}
+		t, err := r.SetTag(ctx, repo, name, ref, d.MediaType)
+		if err != nil {
+			return tags, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+// storeOCIBlob stores a blob from OCI layout. The blob is verified against the digest in the file name.
+func (r *Registry) storeOCIBlob(ctx context.Context, name string, rd io.Reader) error {
+	ref, err := types.ParseRef(path.Base(path.Dir(name)) + ":" + path.Base(name))
+	if err != nil {
+		return fmt.Errorf("unsupported blob %q: %v", name, err)
+	}
+	_, err = r.s.StoreBlob(ctx, rd, &cas.StoreConfig{Expect: types.SizedRef{Ref: ref}})
+	return err
+}
+
+func (r *Registry) importOCIDir(ctx context.Context, dir string) ([]byte, error) {
+	bdir := filepath.Join(dir, "blobs")
+	err := filepath.Walk(bdir, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		f, err := os.Open(fpath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return r.storeOCIBlob(ctx, filepath.ToSlash(fpath), f)
+	})
+	if err != nil {
+		return nil, err
+	}
+	index, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return index, err
+}
+
+func (r *Registry) importOCITar(ctx context.Context, fpath string) ([]byte, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var index []byte
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(h.Name, "./"))
+		switch {
+		case name == "index.json":
+			buf := new(bytes.Buffer)
+			if _, err = io.Copy(buf, io.LimitReader(tr, maxManifestSize)); err != nil {
+				return nil, err
+			}
+			index = buf.Bytes()
+		case strings.HasPrefix(name, "blobs/"):
+			if err = r.storeOCIBlob(ctx, name, tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return index, nil
+}
@@ -0,0 +1,350 @@
+// Package registry implements a read-only container registry (Docker Registry HTTP API v2) backed by CAS.
+//
+// Image manifests and layers are stored as regular blobs. Since both OCI digests and CAS refs are
+// SHA256 hashes, digests map directly to refs. Image tags are stored as schema objects.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+func init() {
+	schema.RegisterName(tagType, &Tag{})
+}
+
+const tagType = "registry:Tag"
+
+// Media types of image manifests.
+const (
+	MediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// Tag associates a name of an image in the repository with a manifest.
+// If there are multiple tags with the same name, the latest one is used.
+type Tag struct {
+	Repository string         `json:"repository"`
+	Tag        string         `json:"tag"`
+	Time       time.Time      `json:"time"`
+	Manifest   types.SizedRef `json:"manifest"`
+	MediaType  string         `json:"media_type,omitempty"`
+}
+
+func (t *Tag) References() []types.Ref {
+	return []types.Ref{t.Manifest.Ref}
+}
+
+// New creates a container registry backed by CAS. It loads an index of image tags.
+func New(ctx context.Context, s *cas.Storage) (*Registry, error) {
+	r := &Registry{s: s, repos: make(map[string]map[string]*Tag)}
+	it := s.IterateSchema(ctx, tagType)
+	defer it.Close()
+	for it.Next() {
+		obj, err := it.Decode()
+		if err != nil {
+			return nil, err
+		}
+		t, ok := obj.(*Tag)
+		if !ok {
+			return nil, fmt.Errorf("unexpected schema type: %T", obj)
+		}
+		r.addTag(t)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+var _ http.Handler = (*Registry)(nil)
+
+// Registry serves container images stored in CAS.
+type Registry struct {
+	s *cas.Storage
+
+	mu    sync.RWMutex
+	repos map[string]map[string]*Tag // repository -> tag -> manifest
+}
+
+func (r *Registry) addTag(t *Tag) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := r.repos[t.Repository]
+	if m == nil {
+		m = make(map[string]*Tag)
+		r.repos[t.Repository] = m
+	}
+	if cur := m[t.Tag]; cur == nil || !cur.Time.After(t.Time) {
+		m[t.Tag] = t
+	}
+}
+
+// Repositories lists names of all repositories.
+func (r *Registry) Repositories() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]string, 0, len(r.repos))
+	for name := range r.repos {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Tags lists all tags in the repository.
+func (r *Registry) Tags(repo string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m := r.repos[repo]
+	out := make([]string, 0, len(m))
+	for tag := range m {
+		out = append(out, tag)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Lookup finds a tag in the repository. It returns storage.ErrNotFound if the tag does not exist.
+func (r *Registry) Lookup(repo, tag string) (*Tag, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.repos[repo][tag]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return t, nil
+}
+
+// SetTag points a tag in the repository to a given manifest. The manifest must be already stored in CAS.
+// If media type is not set, it is detected from the manifest.
+func (r *Registry) SetTag(ctx context.Context, repo, tag string, manifest types.Ref, mediaType string) (*Tag, error) {
+	if !validRepo(repo) {
+		return nil, fmt.Errorf("invalid repository name: %q", repo)
+	} else if !validTag(tag) {
+		return nil, fmt.Errorf("invalid tag: %q", tag)
+	}
+	sz, err := r.s.StatBlob(ctx, manifest)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType == "" {
+		mediaType, err = r.detectMediaType(ctx, manifest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	t := &Tag{
+		Repository: repo, Tag: tag, Time: time.Now().UTC(),
+		Manifest:  types.SizedRef{Ref: manifest, Size: sz},
+		MediaType: mediaType,
+	}
+	if _, err = r.s.StoreSchema(ctx, t); err != nil {
+		return nil, err
+	}
+	r.addTag(t)
+	return t, nil
+}
+
+// maxManifestSize is the maximal size of the manifest that the registry accepts.
+const maxManifestSize = 4 << 20
+
+// detectMediaType reads the manifest and returns its media type.
+func (r *Registry) detectMediaType(ctx context.Context, ref types.Ref) (string, error) {
+	rc, _, err := r.s.FetchBlob(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	var m struct {
+		MediaType string            `json:"mediaType"`
+		Config    json.RawMessage   `json:"config"`
+		Layers    []json.RawMessage `json:"layers"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err = json.NewDecoder(io.LimitReader(rc, maxManifestSize)).Decode(&m); err != nil {
+		return "", fmt.Errorf("not a manifest: %v", err)
+	}
+	switch {
+	case m.MediaType != "":
+		return m.MediaType, nil
+	case m.Manifests != nil:
+		return MediaTypeOCIIndex, nil
+	case m.Config != nil:
+		return MediaTypeOCIManifest, nil
+	}
+	return "", fmt.Errorf("not a manifest")
+}
+
+// validRepo checks if the repository name is valid.
+func validRepo(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, comp := range strings.Split(name, "/") {
+		if comp == "" {
+			return false
+		}
+		for _, c := range comp {
+			if !('a' <= c && c <= 'z') && !('0' <= c && c <= '9') && c != '.' && c != '_' && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validTag checks if the tag is valid.
+func validTag(tag string) bool {
+	if tag == "" || len(tag) > 128 || tag[0] == '.' || tag[0] == '-' {
+		return false
+	}
+	for _, c := range tag {
+		if !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !('0' <= c && c <= '9') && c != '.' && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// Error codes defined by the registry API.
+const (
+	codeNameUnknown     = "NAME_UNKNOWN"
+	codeManifestUnknown = "MANIFEST_UNKNOWN"
+	codeBlobUnknown     = "BLOB_UNKNOWN"
+	codeDigestInvalid   = "DIGEST_INVALID"
+	codeUnsupported     = "UNSUPPORTED"
+)
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	type apiError struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Errors []apiError `json:"errors"`
+	}{
+		Errors: []apiError{{Code: code, Message: msg}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// ServeHTTP implements the pull part of Docker Registry HTTP API v2.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if req.Method != "GET" && req.Method != "HEAD" {
+		writeError(w, http.StatusMethodNotAllowed, codeUnsupported, "registry is read-only")
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2")
+	if path == "" || path == "/" {
+		writeJSON(w, struct{}{})
+		return
+	}
+	path = strings.TrimPrefix(path, "/")
+	if path == "_catalog" {
+		writeJSON(w, struct {
+			Repositories []string `json:"repositories"`
+		}{r.Repositories()})
+		return
+	}
+	if strings.HasSuffix(path, "/tags/list") {
+		repo := strings.TrimSuffix(path, "/tags/list")
+		tags := r.Tags(repo)
+		if len(tags) == 0 {
+			writeError(w, http.StatusNotFound, codeNameUnknown, "repository not found")
+			return
+		}
+		writeJSON(w, struct {
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		}{repo, tags})
+		return
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i > 0 {
+		r.serveManifest(w, req, path[:i], path[i+len("/manifests/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i > 0 {
+		ref, err := types.ParseRef(path[i+len("/blobs/"):])
+		if err != nil || ref.Zero() {
+			writeError(w, http.StatusBadRequest, codeDigestInvalid, "invalid digest")
+			return
+		}
+		r.serveBlob(w, req, ref, "application/octet-stream", codeBlobUnknown)
+		return
+	}
+	writeError(w, http.StatusNotFound, codeNameUnknown, "not found")
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repo, name string) {
+	var (
+		ref   types.Ref
+		mtype string
+	)
+	if types.IsRef(name) {
+		var err error
+		ref, err = types.ParseRef(name)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeDigestInvalid, "invalid digest")
+			return
+		}
+		mtype, err = r.detectMediaType(req.Context(), ref)
+		if err == storage.ErrNotFound {
+			writeError(w, http.StatusNotFound, codeManifestUnknown, "manifest not found")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusNotFound, codeManifestUnknown, err.Error())
+			return
+		}
+	} else {
+		t, err := r.Lookup(repo, name)
+		if err != nil {
+			writeError(w, http.StatusNotFound, codeManifestUnknown, "manifest not found")
+			return
+		}
+		ref, mtype = t.Manifest.Ref, t.MediaType
+	}
+	r.serveBlob(w, req, ref, mtype, codeManifestUnknown)
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, ref types.Ref, ctype, notFound string) {
+	rc, sz, err := r.s.FetchBlob(req.Context(), ref)
+	if err == storage.ErrNotFound {
+		writeError(w, http.StatusNotFound, notFound, "not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, codeUnsupported, err.Error())
+		return
+	}
+	defer rc.Close()
+	h := w.Header()
+	h.Set("Content-Type", ctype)
+	h.Set("Content-Length", fmt.Sprint(sz))
+	h.Set("Docker-Content-Digest", ref.String())
+	h.Set("ETag", `"`+ref.String()+`"`)
+	if req.Method == "HEAD" {
+		return
+	}
+	_, _ = io.Copy(w, rc)
+}
@@ -0,0 +1,113 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// writeBlob writes a blob to the OCI layout and returns its descriptor.
+func writeBlob(t testing.TB, dir, mtype string, data []byte) ociDescriptor {
+	ref := types.BytesRef(data)
+	name := filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(ref.String(), "sha256:"))
+	require.NoError(t, os.MkdirAll(filepath.Dir(name), 0755))
+	require.NoError(t, ioutil.WriteFile(name, data, 0644))
+	return ociDescriptor{MediaType: mtype, Digest: ref.String(), Size: int64(len(data))}
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_oci_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	layer := []byte("layer data")
+	config := writeBlob(t, dir, "application/vnd.oci.image.config.v1+json", []byte(`{"architecture":"amd64","os":"linux"}`))
+	ldesc := writeBlob(t, dir, "application/vnd.oci.image.layer.v1.tar", layer)
+	mdata, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"config":        config,
+		"layers":        []ociDescriptor{ldesc},
+	})
+	require.NoError(t, err)
+	mdesc := writeBlob(t, dir, MediaTypeOCIManifest, mdata)
+	mdesc.Annotations = map[string]string{annotationRefName: "v1"}
+	idata, err := json.Marshal(ociIndex{Manifests: []ociDescriptor{mdesc}})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.json"), idata, 0644))
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	r, err := New(ctx, s)
+	require.NoError(t, err)
+	tags, err := r.ImportOCI(ctx, dir, "library/test")
+	require.NoError(t, err)
+	require.Len(t, tags, 1)
+	require.Equal(t, "v1", tags[0].Tag)
+
+	// reload the index
+	r, err = New(ctx, s)
+	require.NoError(t, err)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(path string) (*http.Response, []byte) {
+		resp, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, data
+	}
+
+	resp, _ := get("/v2/")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "registry/2.0", resp.Header.Get("Docker-Distribution-API-Version"))
+
+	resp, data := get("/v2/library/test/tags/list")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.JSONEq(t, `{"name":"library/test","tags":["v1"]}`, string(data))
+
+	resp, data = get("/v2/_catalog")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.JSONEq(t, `{"repositories":["library/test"]}`, string(data))
+
+	for _, name := range []string{"v1", mdesc.Digest} {
+		resp, data = get("/v2/library/test/manifests/" + name)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, MediaTypeOCIManifest, resp.Header.Get("Content-Type"))
+		require.Equal(t, mdesc.Digest, resp.Header.Get("Docker-Content-Digest"))
+		require.Equal(t, mdata, data)
+	}
+
+	resp, data = get("/v2/library/test/blobs/" + ldesc.Digest)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, layer, data)
+
+	resp, _ = get("/v2/library/test/manifests/v2")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = get("/v2/library/test/blobs/" + types.BytesRef([]byte("missing")).String())
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = get("/v2/library/test/blobs/sha256:xyz")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// corrupted blobs are rejected
+	bad := types.BytesRef([]byte("other layer")).String()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(bad, "sha256:")), []byte("bad"), 0644))
+	_, err = r.ImportOCI(ctx, dir, "library/test")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,120 @@
+package cas
+
+import (
+	"context"
+	"io"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// RepairReport is a result of the store repair.
+type RepairReport struct {
+	Healed []types.SizedRef // blobs that were restored from replicas
+	Failed []VerifyProblem  // corrupt blobs and targets of pins that could not be restored
+}
+
+// OK checks if all problems were repaired.
+func (r *RepairReport) OK() bool {
+	return len(r.Failed) == 0
+}
+
+// Repair restores corrupt and missing blobs found by Verify from one or more replicas. Replicas are tried
+// in order, and the content of each blob is verified before it's stored.
+//
+// Corrupt blobs are only removed once a valid copy is fetched, thus the storage must support blob deletion.
+// Blobs that are referenced by schema blobs, but are not available in any of the replicas, are skipped,
+// since some objects reference content that is not stored on purpose.
+func (s *Storage) Repair(ctx context.Context, rep *VerifyReport, replicas ...storage.BlobSource) (*RepairReport, error) {
+	out := &RepairReport{}
+	seen := make(map[types.Ref]struct{})
+	heal := func(ref types.Ref, corrupt bool) (bool, error) {
+		if _, ok := seen[ref]; ok {
+			return true, nil
+		}
+		seen[ref] = struct{}{}
+		sr, err := s.repairBlob(ctx, ref, corrupt, replicas)
+		if err == nil {
+			out.Healed = append(out.Healed, sr)
+			return true, nil
+		} else if err == ctx.Err() {
+			return false, err
+		}
+		return false, nil
+	}
+	corrupt := make(map[types.Ref]struct{}, len(rep.Corrupt))
+	for _, ref := range rep.Corrupt {
+		corrupt[ref] = struct{}{}
+	}
+	for _, p := range rep.Problems {
+		_, isCorrupt := corrupt[p.Ref]
+		if !isCorrupt && p.Err != storage.ErrNotFound {
+			// not related to the content of the blob
+			continue
+		}
+		ok, err := heal(p.Ref, isCorrupt)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			out.Failed = append(out.Failed, p)
+		}
+	}
+	for _, ref := range rep.Missing {
+		if _, err := heal(ref, false); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// repairBlob fetches a valid copy of the blob from one of the replicas and stores it.
+func (s *Storage) repairBlob(ctx context.Context, ref types.Ref, corrupt bool, replicas []storage.BlobSource) (types.SizedRef, error) {
+	last := storage.ErrNotFound
+	for _, src := range replicas {
+		rc, _, err := src.FetchBlob(ctx, ref)
+		if err == storage.ErrNotFound {
+			continue
+		} else if err != nil {
+			last = err
+			continue
+		}
+		sr, err := s.restoreBlob(ctx, ref, corrupt, rc)
+		rc.Close()
+		if err == nil {
+			return sr, nil
+		} else if cerr := ctx.Err(); cerr != nil {
+			return types.SizedRef{}, cerr
+		}
+		// replica might be corrupted as well; try the next one
+		last = err
+	}
+	return types.SizedRef{}, last
+}
+
+// restoreBlob writes a copy of the blob, replacing the corrupted blob, if necessary.
+func (s *Storage) restoreBlob(ctx context.Context, ref types.Ref, corrupt bool, r io.Reader) (types.SizedRef, error) {
+	w, err := s.st.BeginBlob(ctx)
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	defer w.Close()
+	if _, err = io.Copy(w, r); err != nil {
+		return types.SizedRef{}, err
+	}
+	sr, err := w.Complete()
+	if err != nil {
+		return types.SizedRef{}, err
+	} else if sr.Ref != ref {
+		return types.SizedRef{}, storage.ErrRefMissmatch{Exp: ref, Got: sr.Ref}
+	}
+	if corrupt {
+		// only remove the blob when a valid copy is ready
+		if err = s.DeleteBlob(ctx, ref); err != nil && err != storage.ErrNotFound {
+			return types.SizedRef{}, err
+		}
+	}
+	if err = w.Commit(); err != nil {
+		return types.SizedRef{}, err
+	}
+	return sr, nil
+}
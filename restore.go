@@ -0,0 +1,52 @@
+package cas
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dennwc/cas/schema"
+)
+
+// ErrNoSnapshot is returned when there are no commits made before the requested time.
+var ErrNoSnapshot = errors.New("no snapshot at this time")
+
+// CommitAt finds the latest commit of a pin made at or before a given time.
+func (s *Storage) CommitAt(ctx context.Context, pin string, t time.Time) (Ref, *schema.Commit, error) {
+	it := s.IterateCommits(ctx, pin)
+	defer it.Close()
+	for it.Next() {
+		if c := it.Commit(); !c.Time.After(t) {
+			return it.Ref(), c, nil
+		}
+	}
+	if err := it.Err(); err != nil {
+		return Ref{}, nil, err
+	}
+	return Ref{}, nil, ErrNoSnapshot
+}
+
+// RestoreAt checks out the latest commit of a pin made at or before a given time into dst.
+func (s *Storage) RestoreAt(ctx context.Context, pin string, t time.Time, dst string) (Ref, error) {
+	return s.RestorePathAt(ctx, pin, t, "", dst)
+}
+
+// RestorePathAt is the same as RestoreAt, but only checks out a single file or directory with
+// a given path relative to the root of the commit. It returns the ref of the commit.
+func (s *Storage) RestorePathAt(ctx context.Context, pin string, t time.Time, path string, dst string) (Ref, error) {
+	cref, c, err := s.CommitAt(ctx, pin, t)
+	if err != nil {
+		return Ref{}, err
+	}
+	ref := c.Root
+	ent, err := s.Lookup(ctx, c.Root, path)
+	if err != nil {
+		return Ref{}, err
+	} else if ent != nil {
+		ref = ent.Ref
+	}
+	if err = s.Checkout(ctx, ref, dst); err != nil {
+		return Ref{}, err
+	}
+	return cref, nil
+}
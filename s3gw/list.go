@@ -0,0 +1,143 @@
+package s3gw
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+)
+
+// errStop is returned by the lister when the max number of keys is reached.
+var errStop = errors.New("stop listing")
+
+// lister lists objects in the tree in lexicographic order of keys.
+type lister struct {
+	s     *cas.Storage
+	ctx   context.Context
+	res   *listResult
+	after string // list keys after this one
+	mtime string
+
+	last     string // last key or common prefix added to the result
+	lastPref string // last common prefix added to the result
+}
+
+func (l *lister) list(root cas.Ref) error {
+	err := l.walk(root, "")
+	if err == cas.ErrNotDir {
+		// pin points to a file
+		return nil
+	}
+	return err
+}
+
+type listItem struct {
+	key   string // directory keys end with "/"
+	ent   *schema.DirEntry
+	isDir bool
+	empty bool // empty directory
+}
+
+func (l *lister) add(key string, fnc func()) error {
+	if len(l.res.Contents)+len(l.res.CommonPrefixes) >= l.res.MaxKeys {
+		l.res.IsTruncated = true
+		return errStop
+	}
+	fnc()
+	l.last = key
+	return nil
+}
+
+func (l *lister) addPrefix(pref string) error {
+	if pref == l.lastPref || pref <= l.after {
+		return nil
+	}
+	return l.add(pref, func() {
+		l.res.CommonPrefixes = append(l.res.CommonPrefixes, commonPrefix{Prefix: pref})
+		l.lastPref = pref
+	})
+}
+
+// skipped checks if a key was already listed in previous pages.
+func (l *lister) skipped(key string) bool {
+	if key <= l.after {
+		return true
+	}
+	// marker can be a common prefix returned previously
+	d := l.res.Delimiter
+	return d != "" && strings.HasSuffix(l.after, d) && strings.HasPrefix(key, l.after)
+}
+
+func (l *lister) walk(ref cas.Ref, dir string) error {
+	ents, err := l.s.ReadDir(l.ctx, ref)
+	if err != nil {
+		return err
+	}
+	items := make([]listItem, 0, len(ents))
+	for _, e := range ents {
+		it := listItem{key: dir + e.Name, ent: e}
+		sub, err := l.s.ReadDir(l.ctx, e.Ref)
+		if err == nil {
+			it.isDir, it.empty = true, len(sub) == 0
+			it.key += "/"
+		} else if err != cas.ErrNotDir {
+			return err
+		}
+		items = append(items, it)
+	}
+	// keys of directories have a trailing slash, thus the order may differ from the order of names
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].key < items[j].key
+	})
+	prefix, delim := l.res.Prefix, l.res.Delimiter
+	for _, it := range items {
+		if !it.isDir {
+			if !strings.HasPrefix(it.key, prefix) || l.skipped(it.key) {
+				continue
+			}
+			if delim != "" {
+				if i := strings.Index(it.key[len(prefix):], delim); i >= 0 {
+					if err := l.addPrefix(it.key[:len(prefix)+i+len(delim)]); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			err := l.add(it.key, func() {
+				l.res.Contents = append(l.res.Contents, object{
+					Key: it.key, LastModified: l.mtime, ETag: etag(it.ent.Ref),
+					Size: it.ent.Size(), StorageClass: "STANDARD",
+				})
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		k := it.key
+		if it.empty || (!strings.HasPrefix(k, prefix) && !strings.HasPrefix(prefix, k)) {
+			continue
+		}
+		if k <= l.after && !strings.HasPrefix(l.after, k) {
+			// all keys in this directory were listed
+			continue
+		}
+		if delim == "/" && k != prefix && strings.HasPrefix(k, prefix) {
+			// the whole directory is a common prefix
+			if l.skipped(k) {
+				continue
+			}
+			if err := l.addPrefix(k); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := l.walk(it.ent.Ref, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+// Package s3gw implements a read-only S3-compatible gateway for pinned CAS trees.
+//
+// Each pin is exposed as a bucket and files of the tree as objects, thus existing S3 tools can read data
+// directly from CAS (path-style requests only):
+//
+//	aws s3 ls --no-sign-request --endpoint-url http://localhost:9000 s3://root/
+//
+// Requests are not authenticated and all write operations are rejected.
+package s3gw
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+const (
+	xmlns = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+	// maxKeys is the default and the max number of keys returned by a single list request.
+	maxKeys = 1000
+)
+
+// Options for the gateway.
+type Options struct {
+	// Pins limits the list of pins exposed as buckets. All pins are exposed if not set.
+	Pins []string
+}
+
+// New creates an S3 gateway for pins in the storage.
+func New(s *cas.Storage, opts *Options) *Gateway {
+	if opts == nil {
+		opts = &Options{}
+	}
+	g := &Gateway{s: s}
+	if len(opts.Pins) != 0 {
+		g.pins = make(map[string]struct{}, len(opts.Pins))
+		for _, p := range opts.Pins {
+			g.pins[p] = struct{}{}
+		}
+	}
+	return g
+}
+
+var _ http.Handler = (*Gateway)(nil)
+
+// Gateway serves pinned trees over S3 API.
+type Gateway struct {
+	s    *cas.Storage
+	pins map[string]struct{} // allowed pins; nil means all
+}
+
+type apiError struct {
+	XMLName  xml.Name `xml:"Error"`
+	Status   int      `xml:"-"`
+	Code     string
+	Message  string
+	Resource string `xml:",omitempty"`
+}
+
+var (
+	errNoSuchBucket = &apiError{Status: http.StatusNotFound, Code: "NoSuchBucket", Message: "The specified bucket does not exist."}
+	errNoSuchKey    = &apiError{Status: http.StatusNotFound, Code: "NoSuchKey", Message: "The specified key does not exist."}
+	errReadOnly     = &apiError{Status: http.StatusForbidden, Code: "AccessDenied", Message: "The storage is read-only."}
+	errInternal     = &apiError{Status: http.StatusInternalServerError, Code: "InternalError", Message: "We encountered an internal error. Please try again."}
+)
+
+func invalidArgument(msg string) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: "InvalidArgument", Message: msg}
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (g *Gateway) fail(w http.ResponseWriter, r *http.Request, e *apiError) {
+	if r.Method == "HEAD" {
+		w.WriteHeader(e.Status)
+		return
+	}
+	e2 := *e
+	e2.Resource = r.URL.Path
+	writeXML(w, e.Status, &e2)
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		g.fail(w, r, errReadOnly)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if path == "" {
+		g.serveBuckets(w, r)
+		return
+	}
+	bucket, key := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		bucket, key = path[:i], path[i+1:]
+	}
+	root, mtime, err := g.bucket(r.Context(), bucket)
+	if err == storage.ErrNotFound {
+		g.fail(w, r, errNoSuchBucket)
+		return
+	} else if err != nil {
+		g.fail(w, r, errInternal)
+		return
+	}
+	if key == "" {
+		q := r.URL.Query()
+		if _, ok := q["location"]; ok {
+			writeXML(w, http.StatusOK, &struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: xmlns})
+			return
+		}
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		g.serveList(w, r, bucket, root, mtime)
+		return
+	}
+	g.serveObject(w, r, root, key, mtime)
+}
+
+// bucket resolves a pin. If the pin points to a commit, the commit time is returned as well.
+func (g *Gateway) bucket(ctx context.Context, name string) (types.Ref, time.Time, error) {
+	if g.pins != nil {
+		if _, ok := g.pins[name]; !ok {
+			return types.Ref{}, time.Time{}, storage.ErrNotFound
+		}
+	}
+	ref, err := g.s.GetPin(ctx, name)
+	if err != nil {
+		return types.Ref{}, time.Time{}, err
+	}
+	obj, err := g.s.DecodeSchema(ctx, ref)
+	if err == nil {
+		if c, ok := obj.(*schema.Commit); ok {
+			return c.Root, c.Time, nil
+		}
+	} else if err != schema.ErrNotSchema {
+		return types.Ref{}, time.Time{}, err
+	}
+	return ref, time.Unix(0, 0), nil
+}
+
+type bucketInfo struct {
+	Name         string
+	CreationDate string
+}
+
+func (g *Gateway) serveBuckets(w http.ResponseWriter, r *http.Request) {
+	var out struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   struct{ ID string }
+		Buckets []bucketInfo `xml:"Buckets>Bucket"`
+	}
+	out.Xmlns = xmlns
+	out.Owner.ID = "cas"
+	it := g.s.IteratePins(r.Context())
+	defer it.Close()
+	for it.Next() {
+		p := it.Pin()
+		if g.pins != nil {
+			if _, ok := g.pins[p.Name]; !ok {
+				continue
+			}
+		}
+		out.Buckets = append(out.Buckets, bucketInfo{
+			Name: p.Name, CreationDate: time.Unix(0, 0).UTC().Format(time.RFC3339),
+		})
+	}
+	if err := it.Err(); err != nil {
+		g.fail(w, r, errInternal)
+		return
+	}
+	sort.Slice(out.Buckets, func(i, j int) bool {
+		return out.Buckets[i].Name < out.Buckets[j].Name
+	})
+	writeXML(w, http.StatusOK, &out)
+}
+
+func etag(ref types.Ref) string {
+	return `"` + hex.EncodeToString(ref.Digest()) + `"`
+}
+
+func (g *Gateway) serveObject(w http.ResponseWriter, r *http.Request, root types.Ref, key string, mtime time.Time) {
+	f, err := g.s.FileSystem(r.Context(), root).Open(key)
+	if err != nil {
+		if os.IsNotExist(err) {
+			g.fail(w, r, errNoSuchKey)
+		} else {
+			g.fail(w, r, errInternal)
+		}
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		g.fail(w, r, errInternal)
+		return
+	} else if fi.IsDir() {
+		g.fail(w, r, errNoSuchKey)
+		return
+	}
+	if ent, err := g.s.Lookup(r.Context(), root, key); err == nil && ent != nil {
+		w.Header().Set("ETag", etag(ent.Ref))
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", mtime, f)
+}
+
+type object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         uint64
+	StorageClass string
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+type listResult struct {
+	XMLName   xml.Name `xml:"ListBucketResult"`
+	Xmlns     string   `xml:"xmlns,attr"`
+	Name      string
+	Prefix    string
+	Delimiter string `xml:",omitempty"`
+	MaxKeys   int
+	// V1
+	Marker     *string `xml:",omitempty"`
+	NextMarker string  `xml:",omitempty"`
+	// V2
+	KeyCount              *int   `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	IsTruncated           bool
+	Contents              []object
+	CommonPrefixes        []commonPrefix
+}
+
+func (g *Gateway) serveList(w http.ResponseWriter, r *http.Request, bucket string, root types.Ref, mtime time.Time) {
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	if q.Get("encoding-type") != "" && q.Get("encoding-type") != "url" {
+		g.fail(w, r, invalidArgument("Invalid Encoding Method specified in Request"))
+		return
+	}
+	res := &listResult{
+		Xmlns: xmlns, Name: bucket,
+		Prefix: q.Get("prefix"), Delimiter: q.Get("delimiter"),
+		MaxKeys: maxKeys,
+	}
+	if s := q.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			g.fail(w, r, invalidArgument("Provided max-keys not an integer or within integer range"))
+			return
+		} else if n < maxKeys {
+			res.MaxKeys = n
+		}
+	}
+	var after string
+	if v2 {
+		res.StartAfter = q.Get("start-after")
+		res.ContinuationToken = q.Get("continuation-token")
+		after = res.StartAfter
+		if res.ContinuationToken != "" {
+			after = res.ContinuationToken
+		}
+	} else {
+		marker := q.Get("marker")
+		res.Marker = &marker
+		after = marker
+	}
+	l := &lister{
+		s: g.s, ctx: r.Context(), res: res, after: after,
+		mtime: mtime.UTC().Format(time.RFC3339),
+	}
+	err := l.list(root)
+	if err != nil && err != errStop {
+		g.fail(w, r, errInternal)
+		return
+	}
+	if v2 {
+		n := len(res.Contents) + len(res.CommonPrefixes)
+		res.KeyCount = &n
+		if res.IsTruncated {
+			res.NextContinuationToken = l.last
+		}
+	} else if res.IsTruncated && res.Delimiter != "" {
+		res.NextMarker = l.last
+	}
+	writeXML(w, http.StatusOK, res)
+}
@@ -0,0 +1,140 @@
+package s3gw
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage"
+)
+
+func TestGateway(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_s3gw_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.txt":       "aaa",
+		"b/c.txt":     "ccc",
+		"b/d/e.txt":   "eee",
+		"b-f.txt":     "fff",
+		"g/h/i/j.txt": "jjj",
+	}
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, []byte(data), 0644))
+	}
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	sr, err := s.StoreFilePath(ctx, dir, nil)
+	require.NoError(t, err)
+	_, err = s.Commit(ctx, "data", sr.Ref, "")
+	require.NoError(t, err)
+	require.NoError(t, s.SetPin(ctx, "other", sr.Ref))
+
+	srv := httptest.NewServer(New(s, &Options{Pins: []string{"data"}}))
+	defer srv.Close()
+
+	get := func(path string, out interface{}) *http.Response {
+		resp, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if out != nil {
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.NoError(t, xml.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp
+	}
+
+	var buckets struct {
+		Buckets []bucketInfo `xml:"Buckets>Bucket"`
+	}
+	get("/", &buckets)
+	require.Len(t, buckets.Buckets, 1)
+	require.Equal(t, "data", buckets.Buckets[0].Name)
+
+	resp := get("/other/", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	keys := func(res *listResult) []string {
+		var out []string
+		for _, o := range res.Contents {
+			out = append(out, o.Key)
+		}
+		for _, p := range res.CommonPrefixes {
+			out = append(out, p.Prefix+"*")
+		}
+		return out
+	}
+
+	var res listResult
+	get("/data?list-type=2", &res)
+	require.Equal(t, []string{
+		"a.txt", "b-f.txt", "b/c.txt", "b/d/e.txt", "g/h/i/j.txt",
+	}, keys(&res))
+	require.False(t, res.IsTruncated)
+	require.Equal(t, uint64(3), res.Contents[0].Size)
+
+	res = listResult{}
+	get("/data?list-type=2&delimiter=/", &res)
+	require.Equal(t, []string{"a.txt", "b-f.txt", "b/*", "g/*"}, keys(&res))
+
+	res = listResult{}
+	get("/data?list-type=2&delimiter=/&prefix=b/", &res)
+	require.Equal(t, []string{"b/c.txt", "b/d/*"}, keys(&res))
+
+	res = listResult{}
+	get("/data?list-type=2&delimiter=-&prefix=b", &res)
+	require.Equal(t, []string{"b/c.txt", "b/d/e.txt", "b-*"}, keys(&res))
+
+	// pagination
+	var all []string
+	token := ""
+	for {
+		res = listResult{}
+		get("/data?list-type=2&delimiter=/&max-keys=1&continuation-token="+token, &res)
+		all = append(all, keys(&res)...)
+		if !res.IsTruncated {
+			break
+		}
+		token = res.NextContinuationToken
+	}
+	require.Equal(t, []string{"a.txt", "b-f.txt", "b/*", "g/*"}, all)
+
+	req, err := http.NewRequest("GET", srv.URL+"/data/b/d/e.txt", nil)
+	require.NoError(t, err)
+	req.Header.Set("Range", "bytes=1-")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, "ee", string(data))
+	require.NotEmpty(t, resp.Header.Get("ETag"))
+
+	resp = get("/data/b/none.txt", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = get("/data/b", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	req, err = http.NewRequest("PUT", srv.URL+"/data/x.txt", nil)
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
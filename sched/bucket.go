@@ -0,0 +1,107 @@
+package sched
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// NewTokenBucket creates a token bucket that is refilled at a given rate (tokens per second)
+// and holds at most burst tokens. The bucket is full initially.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate: rate, burst: float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+}
+
+// TokenBucket is a classic token bucket rate limiter.
+//
+// Requests for more tokens than the bucket can hold are allowed when the bucket is full,
+// leaving the bucket in debt that has to be repaid before any other requests are allowed.
+type TokenBucket struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// refill adds tokens accumulated since the last call. It should be called with the lock held.
+func (b *TokenBucket) refill() time.Time {
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	return now
+}
+
+// take tries to take n tokens from the bucket. If there are not enough tokens,
+// it returns the time to wait before the next attempt.
+func (b *TokenBucket) take(n int) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	need := float64(n)
+	if need > b.burst {
+		need = b.burst
+	}
+	if b.tokens >= need {
+		b.tokens -= float64(n)
+		return 0, true
+	}
+	if b.rate <= 0 {
+		return time.Second, false
+	}
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second)), false
+}
+
+// Allow takes n tokens from the bucket, if they are available. It never blocks.
+func (b *TokenBucket) Allow(n int) bool {
+	_, ok := b.take(n)
+	return ok
+}
+
+// Wait blocks until n tokens are available and takes them from the bucket.
+func (b *TokenBucket) Wait(ctx context.Context, n int) error {
+	for {
+		dt, ok := b.take(n)
+		if ok {
+			return nil
+		}
+		t := time.NewTimer(dt)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Tokens returns the number of tokens currently available in the bucket.
+// It's negative if the bucket is in debt.
+func (b *TokenBucket) Tokens() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.tokens
+}
+
+// Full checks if the bucket is full.
+func (b *TokenBucket) Full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.tokens >= b.burst
+}
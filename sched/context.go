@@ -0,0 +1,83 @@
+package sched
+
+import (
+	"context"
+	"fmt"
+)
+
+// Priority of an operation.
+type Priority int
+
+const (
+	// Background operations are long-running maintenance tasks like scrubs, verification or GC.
+	Background = Priority(-1)
+	// Normal is the default priority.
+	Normal = Priority(0)
+	// Interactive operations are waited on by the user, for example file reads from a mounted filesystem.
+	Interactive = Priority(1)
+)
+
+const numPriorities = 3
+
+func (p Priority) index() int {
+	switch {
+	case p < Normal:
+		return 0
+	case p > Normal:
+		return 2
+	}
+	return 1
+}
+
+func (p Priority) String() string {
+	switch p.index() {
+	case 0:
+		return "background"
+	case 2:
+		return "interactive"
+	}
+	return "normal"
+}
+
+// ParsePriority parses the name of a priority.
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "background":
+		return Background, nil
+	case "normal", "":
+		return Normal, nil
+	case "interactive":
+		return Interactive, nil
+	}
+	return Normal, fmt.Errorf("unknown priority: %q", s)
+}
+
+type (
+	priorityKey struct{}
+	clientKey   struct{}
+)
+
+// WithPriority sets the priority of all operations started with this context.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFrom returns the priority of operations started with the context.
+func PriorityFrom(ctx context.Context) Priority {
+	p, ok := ctx.Value(priorityKey{}).(Priority)
+	if !ok {
+		return Normal
+	}
+	return p
+}
+
+// WithClient sets the client ID for all operations started with this context.
+func WithClient(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, clientKey{}, id)
+}
+
+// ClientFrom returns the client ID associated with the context.
+func ClientFrom(ctx context.Context) string {
+	id, _ := ctx.Value(clientKey{}).(string)
+	return id
+}
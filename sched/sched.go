@@ -0,0 +1,244 @@
+// Package sched implements a scheduler that shares a limited number of concurrent operations
+// between multiple clients, while keeping interactive operations responsive.
+package sched
+
+import (
+	"context"
+	"sync"
+)
+
+// Options for the scheduler.
+type Options struct {
+	// Slots is the maximal number of concurrent operations.
+	Slots int
+	// Reserved is the number of slots reserved for interactive operations.
+	// Normal and background operations cannot use those slots.
+	Reserved int
+	// ClientRate is the number of operations per second each client can start before it's considered greedy.
+	// Operations of greedy clients are only started when there are no waiting operations of other clients
+	// with the same priority. Zero value disables the rate tracking.
+	ClientRate float64
+	// ClientBurst is the number of operations a client can start at once without being considered greedy.
+	ClientBurst int
+}
+
+// New creates a new scheduler.
+func New(opts Options) *Scheduler {
+	if opts.Slots <= 0 {
+		opts.Slots = 1
+	}
+	if opts.Reserved >= opts.Slots {
+		opts.Reserved = opts.Slots - 1
+	} else if opts.Reserved < 0 {
+		opts.Reserved = 0
+	}
+	if opts.ClientBurst <= 0 {
+		opts.ClientBurst = 1
+	}
+	return &Scheduler{
+		opts:    opts,
+		clients: make(map[string]*client),
+	}
+}
+
+// Scheduler limits the number of concurrent operations.
+//
+// Waiting operations are started in the priority order. Clients with the same priority are served
+// in the round-robin order, thus a single client cannot starve others by sending many requests.
+type Scheduler struct {
+	opts Options
+
+	mu      sync.Mutex
+	busy    int
+	waiting int
+	clients map[string]*client
+	ring    [numPriorities][]*client // clients with waiting operations, in the round-robin order
+}
+
+type client struct {
+	id      string
+	bucket  *TokenBucket
+	active  int
+	waiting [numPriorities][]*waiter
+}
+
+func (c *client) idle() bool {
+	if c.active != 0 {
+		return false
+	}
+	for _, q := range c.waiting {
+		if len(q) != 0 {
+			return false
+		}
+	}
+	return c.bucket == nil || c.bucket.Full()
+}
+
+type waiter struct {
+	c       *client
+	ready   chan struct{}
+	granted bool
+}
+
+// getClient returns the state of the client. It should be called with the lock held.
+func (s *Scheduler) getClient(id string) *client {
+	c := s.clients[id]
+	if c == nil {
+		c = &client{id: id}
+		if s.opts.ClientRate > 0 {
+			c.bucket = NewTokenBucket(s.opts.ClientRate, s.opts.ClientBurst)
+		}
+		s.clients[id] = c
+	}
+	return c
+}
+
+// limit returns the number of slots available for a given priority level.
+func (s *Scheduler) limit(lvl int) int {
+	if lvl == Interactive.index() {
+		return s.opts.Slots
+	}
+	return s.opts.Slots - s.opts.Reserved
+}
+
+// Acquire waits for a free slot and starts an operation. Client ID and the priority of the operation are taken
+// from the context (see WithClient and WithPriority).
+//
+// The caller must call the returned function when the operation completes.
+func (s *Scheduler) Acquire(ctx context.Context) (func(), error) {
+	lvl := PriorityFrom(ctx).index()
+
+	s.mu.Lock()
+	c := s.getClient(ClientFrom(ctx))
+	if s.waiting == 0 && s.busy < s.limit(lvl) {
+		s.start(c)
+		s.mu.Unlock()
+		return s.releaseFunc(c), nil
+	}
+	w := &waiter{c: c, ready: make(chan struct{})}
+	if len(c.waiting[lvl]) == 0 {
+		s.ring[lvl] = append(s.ring[lvl], c)
+	}
+	c.waiting[lvl] = append(c.waiting[lvl], w)
+	s.waiting++
+	// operations with higher priority may still use reserved slots
+	s.dispatch()
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return s.releaseFunc(c), nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	if w.granted {
+		// slot was given to us concurrently - pass it to someone else
+		s.mu.Unlock()
+		s.releaseFunc(c)()
+		return nil, ctx.Err()
+	}
+	s.dequeue(lvl, w)
+	s.gc(c)
+	s.mu.Unlock()
+	return nil, ctx.Err()
+}
+
+// start marks the operation as started. It should be called with the lock held.
+func (s *Scheduler) start(c *client) {
+	s.busy++
+	c.active++
+	if c.bucket != nil {
+		c.bucket.Allow(1)
+	}
+}
+
+func (s *Scheduler) releaseFunc(c *client) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.busy--
+			c.active--
+			s.dispatch()
+			s.gc(c)
+		})
+	}
+}
+
+// gc removes the state of an idle client. It should be called with the lock held.
+func (s *Scheduler) gc(c *client) {
+	if c.idle() {
+		delete(s.clients, c.id)
+	}
+}
+
+// dequeue removes a waiter from the queue. It should be called with the lock held.
+func (s *Scheduler) dequeue(lvl int, w *waiter) {
+	c := w.c
+	q := c.waiting[lvl]
+	for i, w2 := range q {
+		if w2 == w {
+			c.waiting[lvl] = append(q[:i:i], q[i+1:]...)
+			s.waiting--
+			break
+		}
+	}
+	if len(c.waiting[lvl]) != 0 {
+		return
+	}
+	ring := s.ring[lvl]
+	for i, c2 := range ring {
+		if c2 == c {
+			s.ring[lvl] = append(ring[:i:i], ring[i+1:]...)
+			break
+		}
+	}
+}
+
+// dispatch starts waiting operations while there are free slots. It should be called with the lock held.
+func (s *Scheduler) dispatch() {
+	for s.waiting > 0 {
+		w := s.next()
+		if w == nil {
+			return
+		}
+		s.start(w.c)
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+// next selects the next waiting operation and removes it from the queue. It should be called with the lock held.
+func (s *Scheduler) next() *waiter {
+	for lvl := numPriorities - 1; lvl >= 0; lvl-- {
+		ring := s.ring[lvl]
+		if len(ring) == 0 {
+			continue
+		}
+		if s.busy >= s.limit(lvl) {
+			// lower priorities have less slots available
+			return nil
+		}
+		// prefer clients that are within their rate
+		i := 0
+		for j, c := range ring {
+			if c.bucket == nil || c.bucket.Tokens() >= 1 {
+				i = j
+				break
+			}
+		}
+		c := ring[i]
+		w := c.waiting[lvl][0]
+		c.waiting[lvl] = c.waiting[lvl][1:]
+		s.waiting--
+		// move the client to the end of the ring
+		ring = append(ring[:i:i], ring[i+1:]...)
+		if len(c.waiting[lvl]) != 0 {
+			ring = append(ring, c)
+		}
+		s.ring[lvl] = ring
+		return w
+	}
+	return nil
+}
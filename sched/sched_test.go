@@ -0,0 +1,109 @@
+package sched
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewTokenBucket(10, 5)
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		require.True(t, b.Allow(1))
+	}
+	require.False(t, b.Allow(1))
+
+	now = now.Add(100 * time.Millisecond)
+	require.True(t, b.Allow(1))
+	require.False(t, b.Allow(1))
+
+	// large requests are allowed on a full bucket and leave it in debt
+	now = now.Add(time.Second)
+	require.True(t, b.Full())
+	require.True(t, b.Allow(15))
+	require.Equal(t, -10.0, b.Tokens())
+	now = now.Add(time.Second)
+	require.False(t, b.Allow(1))
+	now = now.Add(100 * time.Millisecond)
+	require.True(t, b.Allow(1))
+}
+
+// order acquires a slot for each context while the only slot is busy,
+// and returns the order in which waiting operations were started.
+func order(t *testing.T, s *Scheduler, ctxs []context.Context) []int {
+	release, err := s.Acquire(context.Background())
+	require.NoError(t, err)
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		out []int
+	)
+	for i, ctx := range ctxs {
+		i, ctx := i, ctx
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rel, err := s.Acquire(ctx)
+			require.NoError(t, err)
+			mu.Lock()
+			out = append(out, i)
+			mu.Unlock()
+			rel()
+		}()
+		// wait for the operation to be queued
+		for {
+			s.mu.Lock()
+			n := s.waiting
+			s.mu.Unlock()
+			if n == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	release()
+	wg.Wait()
+	return out
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s := New(Options{Slots: 1})
+	bg := WithPriority(context.Background(), Background)
+	ia := WithPriority(context.Background(), Interactive)
+	got := order(t, s, []context.Context{bg, bg, context.Background(), ia})
+	require.Equal(t, []int{3, 2, 0, 1}, got)
+}
+
+func TestSchedulerFairness(t *testing.T) {
+	s := New(Options{Slots: 1})
+	a := WithClient(context.Background(), "a")
+	b := WithClient(context.Background(), "b")
+	got := order(t, s, []context.Context{a, a, a, b, b})
+	require.Equal(t, []int{0, 3, 1, 4, 2}, got)
+}
+
+func TestSchedulerReserved(t *testing.T) {
+	ctx := context.Background()
+	s := New(Options{Slots: 2, Reserved: 1})
+
+	rel, err := s.Acquire(ctx)
+	require.NoError(t, err)
+	defer rel()
+
+	// the second slot is reserved for interactive operations
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = s.Acquire(tctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+
+	rel2, err := s.Acquire(WithPriority(ctx, Interactive))
+	require.NoError(t, err)
+	rel2()
+}
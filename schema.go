@@ -29,11 +29,20 @@ func (s *Storage) StoreSchema(ctx context.Context, o schema.Object) (SizedRef, e
 }
 
 func (s *Storage) FetchSchema(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
-	return s.index.FetchSchema(ctx, ref)
+	return s.fetchCached(ctx, ref, true, s.fetchSchema)
+}
+
+func (s *Storage) fetchSchema(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	rc, sz, err := s.index.FetchSchema(ctx, ref)
+	if err == nil && s.cache != nil {
+		// content is cached, thus it must be verified
+		rc = storage.VerifyReader(rc, ref)
+	}
+	return rc, sz, err
 }
 
 func (s *Storage) DecodeSchema(ctx context.Context, ref types.Ref) (schema.Object, error) {
-	rc, _, err := s.index.FetchSchema(ctx, ref)
+	rc, _, err := s.FetchSchema(ctx, ref)
 	if err != nil {
 		return nil, err
 	}
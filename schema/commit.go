@@ -0,0 +1,32 @@
+package schema
+
+import (
+	"time"
+
+	"github.com/dennwc/cas/types"
+)
+
+func init() {
+	registerCAS(&Commit{})
+}
+
+// Commit is a snapshot of a file or directory with a link to the previous snapshot.
+type Commit struct {
+	Root    types.Ref  `json:"root"`
+	Parent  *types.Ref `json:"parent,omitempty"` // previous commit
+	Time    time.Time  `json:"time"`
+	Message string     `json:"message,omitempty"`
+
+	Manifest *types.Ref `json:"manifest,omitempty"` // optional manifest of the root directory
+}
+
+func (c *Commit) References() []types.Ref {
+	refs := []types.Ref{c.Root}
+	if c.Parent != nil && !c.Parent.Zero() {
+		refs = append(refs, *c.Parent)
+	}
+	if c.Manifest != nil && !c.Manifest.Zero() {
+		refs = append(refs, *c.Manifest)
+	}
+	return refs
+}
@@ -0,0 +1,40 @@
+package schema
+
+import (
+	"time"
+
+	"github.com/dennwc/cas/types"
+)
+
+func init() {
+	registerCAS(&Event{})
+}
+
+// Event types recorded by CAS.
+const (
+	EventStore  = "store"  // content was stored
+	EventSync   = "sync"   // remote content was synced
+	EventGC     = "gc"     // unreferenced blobs were removed
+	EventRepair = "repair" // corrupt or missing blobs were restored from replicas
+)
+
+// Event records a single mutation of the store.
+// Events are chained in the order they happened, starting from the latest one.
+type Event struct {
+	Type  string      `json:"type"`
+	TS    time.Time   `json:"ts"`
+	Prev  *types.Ref  `json:"prev,omitempty"`  // previous event
+	Args  []string    `json:"args,omitempty"`  // arguments of the operation
+	Refs  []types.Ref `json:"refs,omitempty"`  // objects created by the operation; not kept alive by the event
+	Stats Stats       `json:"stats,omitempty"` // optional stats
+	Error string      `json:"error,omitempty"`
+}
+
+// References returns only the previous event. Refs are informational, since the history is reachable from
+// the events pin and would otherwise prevent logged objects from being collected.
+func (e *Event) References() []types.Ref {
+	if e.Prev == nil || e.Prev.Zero() {
+		return nil
+	}
+	return []types.Ref{*e.Prev}
+}
@@ -12,6 +12,17 @@ type DirEntry struct {
 	Ref   types.Ref `json:"ref"`
 	Name  string    `json:"name"`
 	Stats Stats     `json:"stats"`
+	// Link is a target of a symbolic link. The target is also stored as a blob referenced by Ref,
+	// thus the link can be read as a regular file by clients that don't support links.
+	Link string `json:"link,omitempty"`
+
+	// Mode is a POSIX mode of the entry, including the file type bits (for example, 0100644).
+	// It's zero if the mode was not recorded.
+	Mode uint32 `json:"mode,omitempty"`
+	// User and Group are names of the owner and the group of the entry, if recorded. Numeric IDs
+	// are recorded instead of names if the IDs have no names on the system.
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
 }
 
 func (d *DirEntry) Size() uint64 {
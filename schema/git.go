@@ -0,0 +1,32 @@
+package schema
+
+import (
+	"github.com/dennwc/cas/types"
+)
+
+func init() {
+	registerCAS(&GitRemote{})
+}
+
+// GitRemote is a state of a git repository pushed to CAS with git-remote-cas.
+type GitRemote struct {
+	Refs map[string]string `json:"refs"`           // git ref name -> git object ID
+	Head string            `json:"head,omitempty"` // ref name that HEAD points to
+	// Bundles are git bundles with the objects of the repository.
+	// Each bundle may depend on objects in the previous bundles, thus they must be applied in order.
+	Bundles []GitBundle `json:"bundles"`
+}
+
+// GitBundle is a git bundle file stored in CAS.
+type GitBundle struct {
+	types.SizedRef
+	Heads []string `json:"heads"` // git object IDs of bundle tips
+}
+
+func (r *GitRemote) References() []types.Ref {
+	refs := make([]types.Ref, 0, len(r.Bundles))
+	for _, b := range r.Bundles {
+		refs = append(refs, b.Ref)
+	}
+	return refs
+}
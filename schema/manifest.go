@@ -0,0 +1,31 @@
+package schema
+
+import "github.com/dennwc/cas/types"
+
+func init() {
+	registerCAS(&Manifest{})
+}
+
+// Manifest is a flat list of all entries of a directory tree. It allows to plan restores and syncs
+// without walking the tree.
+//
+// Entries are stored in a separate gzip-compressed blob, one JSON-encoded ManifestEntry per line,
+// in the order of a depth-first walk of the tree, with entries of each directory sorted by name.
+type Manifest struct {
+	Root    types.Ref      `json:"root"`    // directory described by the manifest
+	Count   int            `json:"count"`   // number of entries
+	Entries types.SizedRef `json:"entries"` // compressed list of entries
+}
+
+func (m *Manifest) References() []types.Ref {
+	return []types.Ref{m.Root, m.Entries.Ref}
+}
+
+// ManifestEntry is a single file or directory in the Manifest.
+type ManifestEntry struct {
+	Path string    `json:"path"` // slash-separated path relative to the root
+	Ref  types.Ref `json:"ref"`
+	Size uint64    `json:"size,omitempty"`
+	Dir  bool      `json:"dir,omitempty"`
+	Link string    `json:"link,omitempty"` // target of a symbolic link
+}
@@ -149,6 +149,21 @@ func IsSchema(p []byte) bool {
 	return string(p[:MagicSize]) == magic
 }
 
+// TypeHeaderSize returns the size of the header of schema blobs of a given type. See IsType.
+func TypeHeaderSize(typ string) int {
+	return MagicSize + len(typ) + 4
+}
+
+// IsType checks if the buffer starts with a header of a schema object of a given type, as written by Encode.
+// Unlike DecodeType, it only needs the first TypeHeaderSize bytes of the blob.
+func IsType(p []byte, typ string) bool {
+	n := TypeHeaderSize(typ)
+	if len(p) < n || !IsSchema(p) {
+		return false
+	}
+	return string(p[MagicSize:n]) == ` "`+typ+`",`
+}
+
 func checkSchema(r io.Reader) (io.Reader, error) {
 	m := make([]byte, MagicSize)
 	_, err := io.ReadFull(r, m)
@@ -3,6 +3,7 @@ package schema
 import (
 	"bytes"
 	"testing"
+	"time"
 
 	"github.com/dennwc/cas/types"
 	"github.com/stretchr/testify/require"
@@ -31,6 +32,42 @@ func TestEncode(t *testing.T) {
   "size": 127
  }
 }
+`,
+		},
+		{
+			name: "event",
+			obj: &Event{
+				Type: EventStore,
+				TS:   time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC),
+				Args: []string{"file.dat"},
+				Refs: []types.Ref{types.StringRef("abc")},
+			},
+			exp: `{
+ "@type": "cas:Event",
+ "type": "store",
+ "ts": "2018-06-01T12:00:00Z",
+ "args": [
+  "file.dat"
+ ],
+ "refs": [
+  "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+ ]
+}
+`,
+		},
+		{
+			name: "commit",
+			obj: &Commit{
+				Root:    types.StringRef("abc"),
+				Time:    time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC),
+				Message: "initial",
+			},
+			exp: `{
+ "@type": "cas:Commit",
+ "root": "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+ "time": "2018-06-01T12:00:00Z",
+ "message": "initial"
+}
 `,
 		},
 	}
@@ -41,6 +78,10 @@ func TestEncode(t *testing.T) {
 			err := Encode(buf, c.obj)
 			require.NoError(t, err)
 			require.Equal(t, c.exp, buf.String())
+
+			typ := MustTypeOf(c.obj)
+			require.True(t, IsType(buf.Bytes()[:TypeHeaderSize(typ)], typ))
+			require.False(t, IsType(buf.Bytes(), typ+"x"))
 		})
 	}
 }
@@ -0,0 +1,38 @@
+package schema
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/dennwc/cas/types"
+)
+
+func init() {
+	registerCAS(&SignedPin{})
+}
+
+// SignedPin is a value of a pin signed with an ed25519 key. Signed pins point to this object instead of the ref
+// directly, thus signatures are replicated together with pins.
+type SignedPin struct {
+	Name string    `json:"name"`
+	Ref  types.Ref `json:"ref"`
+	Time time.Time `json:"time"`
+	Key  []byte    `json:"key"` // ed25519 public key
+	Sig  []byte    `json:"sig"` // signature of SignedData
+}
+
+func (p *SignedPin) References() []types.Ref {
+	return []types.Ref{p.Ref}
+}
+
+// SignedData returns the message that is signed: the name of the pin, the ref and the time of signing.
+func (p *SignedPin) SignedData() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("cas-pin\x00")
+	buf.WriteString(p.Name)
+	buf.WriteByte(0)
+	buf.WriteString(p.Ref.String())
+	buf.WriteByte(0)
+	buf.WriteString(p.Time.UTC().Format(time.RFC3339Nano))
+	return buf.Bytes()
+}
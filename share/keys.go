@@ -0,0 +1,248 @@
+package share
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// KeySize is the size of public and private keys.
+const KeySize = 32
+
+// PublicKey is an X25519 public key. Bundles are encrypted to the public key of the recipient.
+type PublicKey [KeySize]byte
+
+// String returns a hex representation of the key.
+func (k PublicKey) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+// ParsePublicKey parses a hex representation of the key.
+func ParsePublicKey(s string) (PublicKey, error) {
+	var k PublicKey
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return k, fmt.Errorf("invalid public key: %v", err)
+	} else if len(b) != KeySize {
+		return k, fmt.Errorf("invalid public key: expected %d bytes, got %d", KeySize, len(b))
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// PrivateKey is an X25519 private key.
+type PrivateKey struct {
+	k *ecdh.PrivateKey
+}
+
+// GenerateKey generates a new private key.
+func GenerateKey() (*PrivateKey, error) {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{k: k}, nil
+}
+
+// NewPrivateKey creates a private key from its binary representation.
+func NewPrivateKey(b []byte) (*PrivateKey, error) {
+	k, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{k: k}, nil
+}
+
+// Bytes returns a binary representation of the key.
+func (k *PrivateKey) Bytes() []byte {
+	return k.k.Bytes()
+}
+
+// Public returns the public key that corresponds to the private key.
+func (k *PrivateKey) Public() PublicKey {
+	var p PublicKey
+	copy(p[:], k.k.PublicKey().Bytes())
+	return p
+}
+
+// exchange computes a shared secret with the owner of the public key.
+func (k *PrivateKey) exchange(pub PublicKey) ([]byte, error) {
+	p, err := ecdh.X25519().NewPublicKey(pub[:])
+	if err != nil {
+		return nil, err
+	}
+	// fails for low-order points
+	return k.k.ECDH(p)
+}
+
+// ErrNoKey is returned by Keyring.Key if the key was not generated yet.
+var ErrNoKey = errors.New("share: no key in the keyring, see GenerateKey")
+
+// ErrUnknownPeer is returned by Keyring.Peer if there is no peer with a given name.
+type ErrUnknownPeer struct {
+	Name string
+}
+
+func (e *ErrUnknownPeer) Error() string {
+	return fmt.Sprintf("share: unknown peer: %q", e.Name)
+}
+
+const (
+	keyFile  = "share.key"
+	peersDir = "peers"
+	pubExt   = ".pub"
+)
+
+// DefaultKeyringDir returns the default location of the keyring in the config directory of the user.
+func DefaultKeyringDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cas", "keyring"), nil
+}
+
+// Keyring stores a private key of the user and public keys of peers the user shares trees with.
+//
+// Keys are exchanged out of band: users send their public keys to each other and add them to their keyrings
+// under a name. The keyring is a directory with hex-encoded keys:
+//
+//	<dir>/share.key          private key of the user
+//	<dir>/peers/<name>.pub   public keys of peers
+type Keyring struct {
+	dir string
+}
+
+// OpenKeyring opens a keyring in a given directory. The directory is created when the first key is added.
+func OpenKeyring(dir string) *Keyring {
+	return &Keyring{dir: dir}
+}
+
+// Key returns the private key of the user. It returns ErrNoKey if the key was not generated yet.
+func (k *Keyring) Key() (*PrivateKey, error) {
+	data, err := ioutil.ReadFile(filepath.Join(k.dir, keyFile))
+	if os.IsNotExist(err) {
+		return nil, ErrNoKey
+	} else if err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key: %v", err)
+	}
+	return NewPrivateKey(b)
+}
+
+// GenerateKey generates a private key of the user. It fails if the key already exists, since all
+// bundles encrypted to the old key would become unreadable.
+func (k *Keyring) GenerateKey() (*PrivateKey, error) {
+	if err := os.MkdirAll(k.dir, 0700); err != nil {
+		return nil, err
+	}
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(k.dir, keyFile), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return nil, errors.New("share: the keyring already has a key")
+	} else if err != nil {
+		return nil, err
+	}
+	_, err = f.Write([]byte(hex.EncodeToString(key.Bytes()) + "\n"))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// checkPeerName checks that the name can be used as a file name.
+func checkPeerName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("share: invalid peer name: %q", name)
+	}
+	return nil
+}
+
+// AddPeer adds or replaces a public key of the peer.
+func (k *Keyring) AddPeer(name string, pub PublicKey) error {
+	if err := checkPeerName(name); err != nil {
+		return err
+	}
+	dir := filepath.Join(k.dir, peersDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name+pubExt), []byte(pub.String()+"\n"), 0644)
+}
+
+// RemovePeer removes a public key of the peer.
+func (k *Keyring) RemovePeer(name string) error {
+	if err := checkPeerName(name); err != nil {
+		return err
+	}
+	err := os.Remove(filepath.Join(k.dir, peersDir, name+pubExt))
+	if os.IsNotExist(err) {
+		return &ErrUnknownPeer{Name: name}
+	}
+	return err
+}
+
+// Peer returns a public key of the peer. It returns ErrUnknownPeer if there is no such peer.
+func (k *Keyring) Peer(name string) (PublicKey, error) {
+	if err := checkPeerName(name); err != nil {
+		return PublicKey{}, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(k.dir, peersDir, name+pubExt))
+	if os.IsNotExist(err) {
+		return PublicKey{}, &ErrUnknownPeer{Name: name}
+	} else if err != nil {
+		return PublicKey{}, err
+	}
+	return ParsePublicKey(string(data))
+}
+
+// Peers returns names of all peers, sorted.
+func (k *Keyring) Peers() ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(k.dir, peersDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range infos {
+		if name := fi.Name(); !fi.IsDir() && strings.HasSuffix(name, pubExt) {
+			names = append(names, strings.TrimSuffix(name, pubExt))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// PeerName returns the name of the peer with a given public key.
+func (k *Keyring) PeerName(pub PublicKey) (string, bool, error) {
+	names, err := k.Peers()
+	if err != nil {
+		return "", false, err
+	}
+	for _, name := range names {
+		p, err := k.Peer(name)
+		if err != nil {
+			return "", false, err
+		} else if p == pub {
+			return name, true, nil
+		}
+	}
+	return "", false, nil
+}
@@ -0,0 +1,304 @@
+// Package share implements end-to-end encrypted sharing of trees between stores of different users.
+//
+// A tree is exported as a bundle: a tree pack (see storage.WritePack) encrypted to the X25519 public key of
+// the recipient. The bundle can be sent as a file, or stored in a remote both users have access to (see Send
+// and Receive). The remote only sees an opaque blob, while the recipient imports the tree into their own store.
+//
+// The encryption key is derived from two key exchanges: one with an ephemeral key of the bundle, and one with
+// the key of the sender. Thus only the recipient can decrypt the bundle, and only the sender could have
+// created it. Public keys of peers are stored in a Keyring.
+//
+// The bundle starts with a header:
+//
+//	"cas-share/v1\n" | ephemeral public key (32 bytes) | public key of the sender (32 bytes)
+//
+// followed by the pack encrypted with AES-256-GCM in chunks of 64KB. Each chunk is sealed with a nonce that
+// contains the index of the chunk and a flag for the last chunk, thus reordered, truncated or extended
+// bundles fail to decrypt. The last chunk is always shorter than 64KB, and may be empty.
+package share
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/types"
+)
+
+const (
+	magic     = "cas-share/v1\n"
+	chunkSize = 64 * 1024
+)
+
+var (
+	// ErrNotBundle is returned when the data is not a bundle.
+	ErrNotBundle = errors.New("share: not a bundle")
+	// ErrDecrypt is returned when the bundle cannot be decrypted. It happens if the bundle was encrypted
+	// to a different key, or it was modified.
+	ErrDecrypt = errors.New("share: cannot decrypt the bundle: wrong key or corrupted data")
+)
+
+// Bundle describes an imported bundle.
+type Bundle struct {
+	Root types.SizedRef // root of the tree
+	From PublicKey      // key of the sender
+}
+
+// Export writes the tree as a bundle encrypted to the public key of the recipient.
+func Export(ctx context.Context, w io.Writer, s *cas.Storage, root types.Ref, from *PrivateKey, to PublicKey) error {
+	sw, err := newSealWriter(w, from, to)
+	if err != nil {
+		return err
+	}
+	if err = s.WritePack(ctx, sw, root); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+// Import decrypts the bundle with the private key of the recipient and stores the tree.
+//
+// If accept is set, it's called with the key of the sender before any data is stored. Returning an error
+// stops the import, which allows to only accept bundles from known peers. See Keyring.PeerName.
+func Import(ctx context.Context, s *cas.Storage, r io.Reader, key *PrivateKey, accept func(from PublicKey) error) (*Bundle, error) {
+	or, err := newOpenReader(r, key)
+	if err != nil {
+		return nil, err
+	}
+	if accept != nil {
+		if err = accept(or.from); err != nil {
+			return nil, err
+		}
+	}
+	root, err := s.ReadPack(ctx, or)
+	if err != nil {
+		return nil, err
+	}
+	// the pack ends before the last chunk is checked
+	if _, err = io.Copy(ioutil.Discard, or); err != nil {
+		return nil, err
+	}
+	return &Bundle{Root: root, From: or.from}, nil
+}
+
+// Send stores the tree as a bundle in a remote storage and sets the pin to it.
+// The recipient can get the tree with Receive.
+func Send(ctx context.Context, remote *cas.Storage, pin string, s *cas.Storage, root types.Ref, from *PrivateKey, to PublicKey) (types.SizedRef, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(Export(ctx, pw, s, root, from, to))
+	}()
+	sr, err := remote.StoreBlob(ctx, pr, nil)
+	// unblocks the export if the remote fails
+	pr.CloseWithError(err)
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	if err = remote.SetPin(ctx, pin, sr.Ref); err != nil {
+		return types.SizedRef{}, err
+	}
+	return sr, nil
+}
+
+// Receive imports the bundle pinned in a remote storage by Send. See Import.
+func Receive(ctx context.Context, s *cas.Storage, remote *cas.Storage, pin string, key *PrivateKey, accept func(from PublicKey) error) (*Bundle, error) {
+	ref, err := remote.GetPinOrRef(ctx, pin)
+	if err != nil {
+		return nil, err
+	}
+	rc, _, err := remote.FetchBlob(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return Import(ctx, s, rc, key, accept)
+}
+
+// bundleKey derives the key of the bundle from the shared secrets and public keys.
+func bundleKey(ephemeral, static []byte, eph, from, to PublicKey) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, append(append([]byte{}, ephemeral...), static...))
+	mac.Write([]byte(magic))
+	mac.Write(eph[:])
+	mac.Write(from[:])
+	mac.Write(to[:])
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns a nonce for a chunk with a given index.
+func chunkNonce(aead cipher.AEAD, i uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], i)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// sealWriter encrypts the data in chunks. Close must be called to write the last chunk.
+type sealWriter struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	i    uint64
+	err  error
+}
+
+func newSealWriter(w io.Writer, from *PrivateKey, to PublicKey) (*sealWriter, error) {
+	ek, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ek.exchange(to)
+	if err != nil {
+		return nil, fmt.Errorf("share: invalid recipient key: %v", err)
+	}
+	static, err := from.exchange(to)
+	if err != nil {
+		return nil, fmt.Errorf("share: invalid recipient key: %v", err)
+	}
+	eph, pub := ek.Public(), from.Public()
+	aead, err := bundleKey(ephemeral, static, eph, pub, to)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 0, len(magic)+2*KeySize)
+	hdr = append(hdr, magic...)
+	hdr = append(hdr, eph[:]...)
+	hdr = append(hdr, pub[:]...)
+	if _, err = w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &sealWriter{w: w, aead: aead, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (w *sealWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	total := 0
+	for len(p) != 0 {
+		n := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		total += n
+		if len(w.buf) == chunkSize {
+			// full chunks are never the last ones
+			if w.err = w.flush(false); w.err != nil {
+				return total, w.err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (w *sealWriter) flush(last bool) error {
+	out := w.aead.Seal(nil, chunkNonce(w.aead, w.i, last), w.buf, nil)
+	w.i++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(out)
+	return err
+}
+
+// Close writes the last chunk. It doesn't close the underlying writer.
+func (w *sealWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.flush(true)
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errors.New("share: write after close")
+	return nil
+}
+
+// openReader decrypts the data written by sealWriter.
+type openReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	from   PublicKey
+	sealed []byte
+	buf    []byte
+	i      uint64
+	done   bool
+	err    error
+}
+
+func newOpenReader(r io.Reader, key *PrivateKey) (*openReader, error) {
+	hdr := make([]byte, len(magic)+2*KeySize)
+	if _, err := io.ReadFull(r, hdr); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrNotBundle
+	} else if err != nil {
+		return nil, err
+	}
+	if string(hdr[:len(magic)]) != magic {
+		return nil, ErrNotBundle
+	}
+	var eph, from PublicKey
+	copy(eph[:], hdr[len(magic):])
+	copy(from[:], hdr[len(magic)+KeySize:])
+	ephemeral, err := key.exchange(eph)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	static, err := key.exchange(from)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	aead, err := bundleKey(ephemeral, static, eph, from, key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &openReader{
+		r: r, aead: aead, from: from,
+		sealed: make([]byte, chunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (r *openReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		} else if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next reads and decrypts the next chunk.
+func (r *openReader) next() error {
+	n, err := io.ReadFull(r.r, r.sealed)
+	last := false
+	if err == io.EOF {
+		// the last chunk is missing
+		return ErrDecrypt
+	} else if err == io.ErrUnexpectedEOF {
+		// only the last chunk is shorter
+		last = true
+	} else if err != nil {
+		return err
+	}
+	buf, err := r.aead.Open(r.sealed[:0], chunkNonce(r.aead, r.i, last), r.sealed[:n], nil)
+	if err != nil {
+		return ErrDecrypt
+	}
+	r.i++
+	r.buf, r.done = buf, last
+	return nil
+}
@@ -0,0 +1,133 @@
+package share
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/bench"
+	"github.com/dennwc/cas/storage"
+)
+
+func newStore(t testing.TB) *cas.Storage {
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	return s
+}
+
+func TestShare(t *testing.T) {
+	ctx := context.Background()
+	alice, bob, eve := newStore(t), newStore(t), newStore(t)
+	_, tree, err := bench.Ingest(ctx, alice, &bench.Options{Files: 30, MinSize: 100, MaxSize: 100000, Seed: 1})
+	require.NoError(t, err)
+	root := tree.Root.Ref
+
+	akey, err := GenerateKey()
+	require.NoError(t, err)
+	bkey, err := GenerateKey()
+	require.NoError(t, err)
+	ekey, err := GenerateKey()
+	require.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, Export(ctx, buf, alice, root, akey, bkey.Public()))
+	bundle := buf.Bytes()
+
+	// only the recipient can decrypt it
+	_, err = Import(ctx, eve, bytes.NewReader(bundle), ekey, nil)
+	require.Equal(t, ErrDecrypt, err)
+	empty, err := storage.IsEmpty(ctx, eve)
+	require.NoError(t, err)
+	require.True(t, empty)
+
+	// modified bundles are rejected
+	for _, mod := range [][]byte{
+		append(append([]byte{}, bundle[:len(bundle)-1]...), bundle[len(bundle)-1]^1),
+		bundle[:len(bundle)-10],
+		bundle[:len(magic)+2*KeySize+chunkSize+16],
+		append(append([]byte{}, bundle...), 0),
+	} {
+		_, err = Import(ctx, newStore(t), bytes.NewReader(mod), bkey, nil)
+		require.NotNil(t, err)
+	}
+	_, err = Import(ctx, newStore(t), bytes.NewReader([]byte("not a bundle")), bkey, nil)
+	require.Equal(t, ErrNotBundle, err)
+
+	// the sender can be checked before anything is stored
+	errUnknown := errors.New("unknown sender")
+	_, err = Import(ctx, bob, bytes.NewReader(bundle), bkey, func(from PublicKey) error {
+		require.Equal(t, akey.Public(), from)
+		return errUnknown
+	})
+	require.Equal(t, errUnknown, err)
+	empty, err = storage.IsEmpty(ctx, bob)
+	require.NoError(t, err)
+	require.True(t, empty)
+
+	b, err := Import(ctx, bob, bytes.NewReader(bundle), bkey, nil)
+	require.NoError(t, err)
+	require.Equal(t, root, b.Root.Ref)
+	require.Equal(t, akey.Public(), b.From)
+	// the whole tree is copied
+	require.NoError(t, bob.Push(ctx, newStore(t), root))
+
+	// the same through a shared remote
+	remote, carol := newStore(t), newStore(t)
+	ckey, err := GenerateKey()
+	require.NoError(t, err)
+	sr, err := Send(ctx, remote, "for-carol", alice, root, akey, ckey.Public())
+	require.NoError(t, err)
+	_, err = remote.StatBlob(ctx, root)
+	require.Equal(t, storage.ErrNotFound, err, "the remote only has the bundle")
+	b, err = Receive(ctx, carol, remote, "for-carol", ckey, nil)
+	require.NoError(t, err)
+	require.Equal(t, root, b.Root.Ref)
+	require.NoError(t, carol.Push(ctx, newStore(t), root))
+	_, err = carol.StatBlob(ctx, sr.Ref)
+	require.Equal(t, storage.ErrNotFound, err, "the bundle is not stored")
+}
+
+func TestKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cas_keyring_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kr := OpenKeyring(dir)
+	_, err = kr.Key()
+	require.Equal(t, ErrNoKey, err)
+	key, err := kr.GenerateKey()
+	require.NoError(t, err)
+	_, err = kr.GenerateKey()
+	require.NotNil(t, err, "existing key is never replaced")
+	got, err := kr.Key()
+	require.NoError(t, err)
+	require.Equal(t, key.Public(), got.Public())
+
+	peer, err := GenerateKey()
+	require.NoError(t, err)
+	pub, err := ParsePublicKey(peer.Public().String())
+	require.NoError(t, err)
+	require.NoError(t, kr.AddPeer("bob", pub))
+	require.NotNil(t, kr.AddPeer("../bob", pub))
+
+	names, err := kr.Peers()
+	require.NoError(t, err)
+	require.Equal(t, []string{"bob"}, names)
+	p, err := kr.Peer("bob")
+	require.NoError(t, err)
+	require.Equal(t, pub, p)
+	name, ok, err := kr.PeerName(pub)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "bob", name)
+
+	require.NoError(t, kr.RemovePeer("bob"))
+	_, err = kr.Peer("bob")
+	require.Equal(t, &ErrUnknownPeer{Name: "bob"}, err)
+}
@@ -0,0 +1,192 @@
+package cas
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// ErrPinSignature is returned when a pin is not signed by a trusted key. See SetTrustedKeys.
+type ErrPinSignature struct {
+	Name   string
+	Reason string
+}
+
+func (e *ErrPinSignature) Error() string {
+	return fmt.Sprintf("pin %q: %s", e.Name, e.Reason)
+}
+
+// SetSigningKey enables signing of pins. All pins set after this call are signed with the key.
+// Nil key disables signing.
+//
+// Signed pins point to a schema.SignedPin instead of the ref, thus signatures are replicated with pins.
+// GetPin returns the ref of a signed pin, and verifies the signature if trusted keys are set.
+func (s *Storage) SetSigningKey(key ed25519.PrivateKey) {
+	s.signKey = key
+}
+
+// SetTrustedKeys enables verification of pins. GetPin returns ErrPinSignature for pins that are not signed by
+// one of the keys, or that were rolled back to a signature older than the last one seen by this Storage.
+// Calling it without keys disables verification.
+func (s *Storage) SetTrustedKeys(keys ...ed25519.PublicKey) {
+	s.trusted = keys
+}
+
+// signPin returns a ref the pin should be set to. If signing is enabled, it stores a signed value of the pin.
+func (s *Storage) signPin(ctx context.Context, name string, ref Ref) (Ref, error) {
+	if s.signKey == nil || ref.Zero() {
+		return ref, nil
+	}
+	p := &schema.SignedPin{
+		Name: name, Ref: ref,
+		Time: time.Now().UTC(),
+		Key:  s.signKey.Public().(ed25519.PublicKey),
+	}
+	p.Sig = ed25519.Sign(s.signKey, p.SignedData())
+	sr, err := s.StoreSchema(ctx, p)
+	if err != nil {
+		return Ref{}, err
+	}
+	s.seenPinTime(name, p.Time)
+	return sr.Ref, nil
+}
+
+var typeSignedPin = schema.MustTypeOf(&schema.SignedPin{})
+
+// decodeSignedPin reads a signed value of a pin. It returns nil if the ref points to a different object,
+// and only reads the header of the blob in this case.
+func (s *Storage) decodeSignedPin(ctx context.Context, ref Ref) (*schema.SignedPin, error) {
+	rc, _, err := s.FetchSchema(ctx, ref)
+	if err == schema.ErrNotSchema {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	buf := make([]byte, schema.TypeHeaderSize(typeSignedPin))
+	n, err := io.ReadFull(rc, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if !schema.IsType(buf[:n], typeSignedPin) {
+		return nil, nil
+	}
+	obj, err := schema.Decode(io.MultiReader(bytes.NewReader(buf[:n]), rc))
+	if err != nil {
+		return nil, err
+	}
+	p, ok := obj.(*schema.SignedPin)
+	if !ok {
+		return nil, fmt.Errorf("expected signed pin, got: %T", obj)
+	}
+	return p, nil
+}
+
+// resolvePin returns the ref a signed pin points to. If trusted keys are set, it checks that the pin is
+// signed by one of them, and that the signature is not older than the last one seen for this pin.
+//
+// Signature times are only remembered by this Storage instance, thus a pin rolled back to an older signed
+// value is only detected if a newer value was seen or set since the storage was opened.
+func (s *Storage) resolvePin(ctx context.Context, name string, ref Ref) (Ref, error) {
+	if ref.Zero() {
+		return ref, nil
+	}
+	p, err := s.decodeSignedPin(ctx, ref)
+	if len(s.trusted) == 0 {
+		if err != nil || p == nil {
+			// unsigned pin, or the value is not in the storage
+			return ref, nil
+		}
+		return p.Ref, nil
+	}
+	if err == storage.ErrNotFound {
+		// ErrNotFound would mean that the pin doesn't exist
+		return Ref{}, &ErrPinSignature{Name: name, Reason: "signed value of the pin is missing"}
+	} else if err != nil {
+		return Ref{}, err
+	} else if p == nil {
+		return Ref{}, &ErrPinSignature{Name: name, Reason: "pin is not signed"}
+	}
+	if p.Name != name {
+		return Ref{}, &ErrPinSignature{Name: name, Reason: fmt.Sprintf("signature is for a different pin: %q", p.Name)}
+	}
+	if !s.isTrusted(p.Key) {
+		return Ref{}, &ErrPinSignature{Name: name, Reason: "pin is signed by an untrusted key"}
+	}
+	if len(p.Key) != ed25519.PublicKeySize || !ed25519.Verify(p.Key, p.SignedData(), p.Sig) {
+		return Ref{}, &ErrPinSignature{Name: name, Reason: "invalid signature"}
+	}
+	if !s.seenPinTime(name, p.Time) {
+		return Ref{}, &ErrPinSignature{Name: name, Reason: "signature is older than the last seen one"}
+	}
+	return p.Ref, nil
+}
+
+// seenPinTime records the time of a pin signature. It returns false if a newer signature was seen for the pin.
+func (s *Storage) seenPinTime(name string, t time.Time) bool {
+	s.pinMu.Lock()
+	defer s.pinMu.Unlock()
+	if last, ok := s.pinTimes[name]; ok && t.Before(last) {
+		return false
+	}
+	if s.pinTimes == nil {
+		s.pinTimes = make(map[string]time.Time)
+	}
+	s.pinTimes[name] = t
+	return true
+}
+
+func (s *Storage) isTrusted(key []byte) bool {
+	for _, k := range s.trusted {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// pinIterator resolves values of signed pins and skips expired pins. See resolvePin.
+type pinIterator struct {
+	storage.PinIterator
+	ctx context.Context
+	s   *Storage
+	cur types.Pin
+	err error
+}
+
+func (it *pinIterator) Next() bool {
+	for {
+		if it.err != nil || !it.PinIterator.Next() {
+			return false
+		}
+		it.cur = it.PinIterator.Pin()
+		expired, err := it.s.pinExpired(it.ctx, it.cur.Name)
+		if err != nil {
+			it.err = err
+			return false
+		} else if expired {
+			continue
+		}
+		it.cur.Ref, it.err = it.s.resolvePin(it.ctx, it.cur.Name, it.cur.Ref)
+		return it.err == nil
+	}
+}
+
+func (it *pinIterator) Pin() types.Pin {
+	return it.cur
+}
+
+func (it *pinIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.PinIterator.Err()
+}
@@ -0,0 +1,183 @@
+package cas_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/gc"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+func TestSignedPins(t *testing.T) {
+	ctx := context.Background()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	mem := storage.NewInMemory()
+	s, err := cas.New(mem)
+	require.NoError(t, err)
+	s.SetSigningKey(priv)
+
+	ref1 := types.StringRef("a")
+	require.NoError(t, s.SetPin(ctx, "a", ref1))
+	ref, err := s.GetPin(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, ref1, ref)
+
+	// the signed value is stored in the pin
+	raw, err := mem.GetPin(ctx, "a")
+	require.NoError(t, err)
+	require.NotEqual(t, ref1, raw)
+
+	ref2 := types.StringRef("b")
+	require.NoError(t, s.SetPinCAS(ctx, "a", ref1, ref2))
+	require.Equal(t, storage.ErrPinConflict, s.SetPinCAS(ctx, "a", ref1, ref2))
+	raw2, err := mem.GetPin(ctx, "a")
+	require.NoError(t, err)
+
+	// verify on a replica
+	r, err := cas.New(mem)
+	require.NoError(t, err)
+	r.SetTrustedKeys(pub)
+	ref, err = r.GetPin(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, ref2, ref)
+
+	it := r.IteratePins(ctx)
+	require.True(t, it.Next())
+	require.Equal(t, types.Pin{Name: "a", Ref: ref2}, it.Pin())
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+	require.NoError(t, it.Close())
+
+	// older signed values are rejected
+	require.NoError(t, mem.SetPin(ctx, "a", raw))
+	_, err = r.GetPin(ctx, "a")
+	require.IsType(t, &cas.ErrPinSignature{}, err)
+	require.NoError(t, mem.SetPin(ctx, "a", raw2))
+
+	// rollback signs the old value again
+	ref, err = s.RollbackPin(ctx, "a", 1)
+	require.NoError(t, err)
+	require.Equal(t, ref1, ref)
+	ref, err = r.GetPin(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, ref1, ref)
+
+	// tampered pins are rejected
+	raw, err = mem.GetPin(ctx, "a")
+	require.NoError(t, err)
+	require.NoError(t, mem.SetPin(ctx, "b", raw))
+	_, err = r.GetPin(ctx, "b")
+	require.IsType(t, &cas.ErrPinSignature{}, err)
+
+	require.NoError(t, mem.SetPin(ctx, "a", ref1))
+	_, err = r.GetPin(ctx, "a")
+	require.IsType(t, &cas.ErrPinSignature{}, err)
+
+	r.SetTrustedKeys(other)
+	require.NoError(t, mem.SetPin(ctx, "a", raw))
+	_, err = r.GetPin(ctx, "a")
+	require.IsType(t, &cas.ErrPinSignature{}, err)
+}
+
+func TestSignedPinsGC(t *testing.T) {
+	ctx := context.Background()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	s.SetSigningKey(priv)
+
+	sr, err := s.StoreBlob(ctx, strings.NewReader("data"), nil)
+	require.NoError(t, err)
+	require.NoError(t, s.SetPin(ctx, "a", sr.Ref))
+
+	// both the signed value and the data are reachable, thus nothing is removed
+	for i := 0; i < 2; i++ {
+		rep, err := gc.Run(ctx, s, nil)
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), rep.Swept)
+	}
+	_, err = s.StatBlob(ctx, sr.Ref)
+	require.NoError(t, err)
+
+	s.SetTrustedKeys(pub)
+	ref, err := s.GetPin(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, sr.Ref, ref)
+}
+
+func TestImportSignedPins(t *testing.T) {
+	ctx := context.Background()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	pub2, priv2, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	src, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	ref1 := types.StringRef("a")
+	require.NoError(t, src.SetPin(ctx, "a", ref1))
+	buf := new(bytes.Buffer)
+	require.NoError(t, src.ExportPins(ctx, buf))
+
+	// unsigned values are signed on import
+	mem := storage.NewInMemory()
+	s, err := cas.New(mem)
+	require.NoError(t, err)
+	s.SetSigningKey(priv)
+	s.SetTrustedKeys(pub)
+	res, err := s.ImportPins(ctx, bytes.NewReader(buf.Bytes()), nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, res.Added)
+	raw, err := mem.GetPin(ctx, "a")
+	require.NoError(t, err)
+	require.NotEqual(t, ref1, raw)
+	ref, err := s.GetPin(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, ref1, ref)
+
+	// the signed value points to the same ref
+	res, err = s.ImportPins(ctx, bytes.NewReader(buf.Bytes()), nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, res.Unchanged)
+
+	// signed values are imported as is
+	buf.Reset()
+	require.NoError(t, s.ExportPins(ctx, buf))
+	rc, _, err := mem.FetchBlob(ctx, raw)
+	require.NoError(t, err)
+	signed, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+
+	mem2 := storage.NewInMemory()
+	_, err = storage.WriteBytes(ctx, mem2, signed)
+	require.NoError(t, err)
+	s2, err := cas.New(mem2)
+	require.NoError(t, err)
+	s2.SetSigningKey(priv2)
+	s2.SetTrustedKeys(pub, pub2)
+	res, err = s2.ImportPins(ctx, buf, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, res.Added)
+	raw2, err := mem2.GetPin(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, raw, raw2)
+	ref, err = s2.GetPin(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, ref1, ref)
+}
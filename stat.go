@@ -29,3 +29,54 @@ func SaveRef(ctx context.Context, path string, fi os.FileInfo, ref types.Ref) er
 func SaveRefFile(ctx context.Context, f *os.File, fi os.FileInfo, ref types.Ref) error {
 	return local.SaveRefFile(ctx, f, fi, ref)
 }
+
+// fileRefCache is an optional interface for storages that control how refs of local files are cached.
+// See local.Options.NoXattr.
+type fileRefCache interface {
+	StatFile(ctx context.Context, f *os.File) (SizedRef, error)
+	SaveRefFile(ctx context.Context, f *os.File, fi os.FileInfo, ref types.Ref) error
+}
+
+// statFile is similar to StatFile, but lets the storage decide where refs are cached.
+// It can be called on a nil storage.
+func (s *Storage) statFile(ctx context.Context, f *os.File) (SizedRef, error) {
+	if s != nil {
+		if c, ok := s.st.(fileRefCache); ok {
+			return c.StatFile(ctx, f)
+		}
+	}
+	return StatFile(ctx, f)
+}
+
+// saveRefFile is similar to SaveRefFile, but lets the storage decide where refs are cached.
+// It can be called on a nil storage.
+func (s *Storage) saveRefFile(ctx context.Context, f *os.File, fi os.FileInfo, ref types.Ref) error {
+	if s != nil {
+		if c, ok := s.st.(fileRefCache); ok {
+			return c.SaveRefFile(ctx, f, fi, ref)
+		}
+	}
+	return SaveRefFile(ctx, f, fi, ref)
+}
+
+// fileLayoutCache is an optional interface for storages that control where layouts of local files are recorded.
+type fileLayoutCache interface {
+	GetFileLayout(ctx context.Context, f *os.File) (local.FileLayout, error)
+	SaveFileLayout(ctx context.Context, f *os.File, fi os.FileInfo, ref types.Ref) error
+}
+
+// fileLayout returns the layout recorded for the file, letting the storage decide where it's stored.
+func (s *Storage) fileLayout(ctx context.Context, f *os.File) (local.FileLayout, error) {
+	if c, ok := s.st.(fileLayoutCache); ok {
+		return c.GetFileLayout(ctx, f)
+	}
+	return local.GetFileLayout(ctx, f)
+}
+
+// saveFileLayout records the layout of the file, letting the storage decide where it's stored.
+func (s *Storage) saveFileLayout(ctx context.Context, f *os.File, fi os.FileInfo, ref types.Ref) error {
+	if c, ok := s.st.(fileLayoutCache); ok {
+		return c.SaveFileLayout(ctx, f, fi, ref)
+	}
+	return local.SaveFileLayout(ctx, f, fi, ref)
+}
@@ -0,0 +1,84 @@
+package cas
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dennwc/cas/storage"
+)
+
+// StoreStats is a summary of the content of the store.
+type StoreStats struct {
+	Blobs    uint64            // number of blobs
+	Size     uint64            // total size of all blobs in bytes
+	Schema   map[string]uint64 // number of schema blobs by type
+	Pins     uint64            // number of pins
+	Limit    uint64            // maximal total size of blobs; zero if the size is not limited
+	Time     time.Time         // time when the stats were collected
+	Duration time.Duration     // time spent collecting the stats
+}
+
+// Stats collects statistics about the blobs and pins in the store.
+//
+// Storage implementations that maintain counters (see storage.StatsCounter) report them directly.
+// Otherwise, all blobs are listed, thus the call may take a while on large stores.
+func (s *Storage) Stats(ctx context.Context) (*StoreStats, error) {
+	start := time.Now()
+	st, err := storage.GetStats(ctx, s.st)
+	if err != nil {
+		return nil, err
+	}
+	return &StoreStats{
+		Blobs: st.Blobs, Size: st.Size,
+		Schema: st.Schema, Pins: st.Pins, Limit: st.Limit,
+		Time: start, Duration: time.Since(start),
+	}, nil
+}
+
+// labelEscaper escapes label values in the OpenMetrics text format. Other characters are written as is.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteOpenMetrics writes the stats in the OpenMetrics text format.
+//
+// The output is compatible with the Prometheus text format, thus it can be written to a file
+// consumed by a textfile collector in deployments that don't run a CAS server.
+func (st *StoreStats) WriteOpenMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	metric := func(name, typ, unit, help string, val interface{}) {
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, typ)
+		if unit != "" {
+			fmt.Fprintf(bw, "# UNIT %s %s\n", name, unit)
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(bw, "%s %v\n", name, val)
+	}
+	metric("cas_blobs", "gauge", "", "Number of blobs in the store.", st.Blobs)
+	metric("cas_blobs_size_bytes", "gauge", "bytes", "Total size of blobs in the store.", st.Size)
+	metric("cas_pins", "gauge", "", "Number of pins in the store.", st.Pins)
+	if st.Limit != 0 {
+		metric("cas_blobs_size_limit_bytes", "gauge", "bytes", "Maximal total size of blobs in the store.", st.Limit)
+	}
+	if len(st.Schema) != 0 {
+		typs := make([]string, 0, len(st.Schema))
+		for typ := range st.Schema {
+			typs = append(typs, typ)
+		}
+		sort.Strings(typs)
+		fmt.Fprint(bw, "# TYPE cas_schema_blobs gauge\n")
+		fmt.Fprint(bw, "# HELP cas_schema_blobs Number of schema blobs in the store by type.\n")
+		for _, typ := range typs {
+			fmt.Fprintf(bw, "cas_schema_blobs{type=\"%s\"} %v\n", labelEscaper.Replace(typ), st.Schema[typ])
+		}
+	}
+	metric("cas_stats_timestamp_seconds", "gauge", "seconds", "Time when the stats were collected.",
+		float64(st.Time.UnixNano())/1e9)
+	metric("cas_stats_duration_seconds", "gauge", "seconds", "Time spent collecting the stats.",
+		st.Duration.Seconds())
+	fmt.Fprint(bw, "# EOF\n")
+	return bw.Flush()
+}
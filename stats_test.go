@@ -0,0 +1,59 @@
+package cas_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+)
+
+func TestStatsOpenMetrics(t *testing.T) {
+	st := &cas.StoreStats{
+		Blobs: 10, Size: 1024, Pins: 2, Limit: 4096,
+		Schema: map[string]uint64{
+			"cas:Commit":  3,
+			`quote"back\`: 1,
+			"line\nbreak": 1,
+			"ünïcode":     1,
+			"tab\there":   1,
+		},
+		Time:     time.Unix(1500000000, 500000000),
+		Duration: 1500 * time.Millisecond,
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, st.WriteOpenMetrics(buf))
+	// only backslashes, quotes and line breaks are escaped in label values, other characters are written as is
+	require.Equal(t, `# TYPE cas_blobs gauge
+# HELP cas_blobs Number of blobs in the store.
+cas_blobs 10
+# TYPE cas_blobs_size_bytes gauge
+# UNIT cas_blobs_size_bytes bytes
+# HELP cas_blobs_size_bytes Total size of blobs in the store.
+cas_blobs_size_bytes 1024
+# TYPE cas_pins gauge
+# HELP cas_pins Number of pins in the store.
+cas_pins 2
+# TYPE cas_blobs_size_limit_bytes gauge
+# UNIT cas_blobs_size_limit_bytes bytes
+# HELP cas_blobs_size_limit_bytes Maximal total size of blobs in the store.
+cas_blobs_size_limit_bytes 4096
+# TYPE cas_schema_blobs gauge
+# HELP cas_schema_blobs Number of schema blobs in the store by type.
+cas_schema_blobs{type="cas:Commit"} 3
+cas_schema_blobs{type="line\nbreak"} 1
+cas_schema_blobs{type="quote\"back\\"} 1
+`+"cas_schema_blobs{type=\"tab\there\"} 1\n"+`cas_schema_blobs{type="ünïcode"} 1
+# TYPE cas_stats_timestamp_seconds gauge
+# UNIT cas_stats_timestamp_seconds seconds
+# HELP cas_stats_timestamp_seconds Time when the stats were collected.
+cas_stats_timestamp_seconds 1.5000000005e+09
+# TYPE cas_stats_duration_seconds gauge
+# UNIT cas_stats_duration_seconds seconds
+# HELP cas_stats_duration_seconds Time spent collecting the stats.
+cas_stats_duration_seconds 1.5
+# EOF
+`, buf.String())
+}
@@ -0,0 +1,213 @@
+package cas
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/types"
+)
+
+// ChangeKind is a kind of a change reported by Status.
+type ChangeKind byte
+
+const (
+	Added    ChangeKind = 'A' // entry exists only in the local directory
+	Modified ChangeKind = 'M' // content of the file differs, or a file was replaced by a directory or vice versa
+	Deleted  ChangeKind = 'D' // entry exists only in the stored tree
+)
+
+func (k ChangeKind) String() string {
+	return string(k)
+}
+
+// Change is a difference between a local directory and a stored tree.
+type Change struct {
+	Kind ChangeKind
+	Path string // slash-separated path relative to the root
+	Dir  bool   // entry is a directory; entries of added and deleted directories are not reported
+}
+
+// Status compares a local directory with a stored tree (a directory or a commit) and calls fnc for each
+// difference, in the order of paths. Files are compared by size first, and then by refs cached in file
+// metadata (see StatFile). Files without a valid cached ref are hashed and the ref is cached for the next time.
+// Symbolic links are compared by their targets.
+//
+// No blobs are written to the storage, thus it's safe to call before storing the directory.
+func (s *Storage) Status(ctx context.Context, root Ref, dir string, fnc func(c *Change) error) error {
+	ents, err := s.ReadDir(ctx, root)
+	if err != nil {
+		return err
+	}
+	return s.statusDir(ctx, dir, "", ents, fnc)
+}
+
+func (s *Storage) statusDir(ctx context.Context, dir, rel string, ents []*schema.DirEntry, fnc func(c *Change) error) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	local, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	sort.Slice(local, func(i, j int) bool {
+		return local[i].Name() < local[j].Name()
+	})
+	for len(local) != 0 || len(ents) != 0 {
+		if len(local) != 0 && local[0].Name() == DefaultDir {
+			local = local[1:]
+			continue
+		}
+		switch {
+		case len(local) == 0 || (len(ents) != 0 && ents[0].Name < local[0].Name()):
+			isDir, err := s.isDir(ctx, ents[0].Ref)
+			if err != nil {
+				return err
+			}
+			if err = fnc(&Change{Kind: Deleted, Path: path.Join(rel, ents[0].Name), Dir: isDir}); err != nil {
+				return err
+			}
+			ents = ents[1:]
+		case len(ents) == 0 || local[0].Name() < ents[0].Name:
+			if err = fnc(&Change{Kind: Added, Path: path.Join(rel, local[0].Name()), Dir: local[0].IsDir()}); err != nil {
+				return err
+			}
+			local = local[1:]
+		default:
+			fi, ent := local[0], ents[0]
+			local, ents = local[1:], ents[1:]
+			name := path.Join(rel, ent.Name)
+			if fi.Mode()&os.ModeSymlink != 0 || ent.Link != "" {
+				if same, err := sameLink(filepath.Join(dir, fi.Name()), fi, ent); err != nil {
+					return err
+				} else if !same {
+					if err = fnc(&Change{Kind: Modified, Path: name}); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			sub, err := s.ReadDir(ctx, ent.Ref)
+			isDir := err == nil
+			if err == ErrNotDir {
+				err = nil
+			} else if err != nil {
+				return err
+			}
+			if isDir != fi.IsDir() {
+				err = fnc(&Change{Kind: Modified, Path: name, Dir: fi.IsDir()})
+			} else if isDir {
+				err = s.statusDir(ctx, filepath.Join(dir, fi.Name()), name, sub, fnc)
+			} else if same, serr := s.sameFile(ctx, filepath.Join(dir, fi.Name()), fi, ent); serr != nil {
+				err = serr
+			} else if !same {
+				err = fnc(&Change{Kind: Modified, Path: name})
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isDir checks if the ref points to a directory.
+func (s *Storage) isDir(ctx context.Context, ref Ref) (bool, error) {
+	_, err := s.ReadDir(ctx, ref)
+	if err == ErrNotDir {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// sameLink checks if the local file is a symbolic link with the same target as the stored one.
+func sameLink(fpath string, fi os.FileInfo, ent *schema.DirEntry) (bool, error) {
+	if fi.Mode()&os.ModeSymlink == 0 || ent.Link == "" {
+		return false, nil
+	}
+	target, err := os.Readlink(fpath)
+	if err != nil {
+		return false, err
+	}
+	return target == ent.Link, nil
+}
+
+// sameFile checks if the local file has the same content as the stored one.
+func (s *Storage) sameFile(ctx context.Context, fpath string, fi os.FileInfo, ent *schema.DirEntry) (bool, error) {
+	if !fi.Mode().IsRegular() || uint64(fi.Size()) != ent.Size() {
+		return false, nil
+	} else if fi.Size() == 0 {
+		return true, nil
+	}
+	f, err := os.Open(fpath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var local Ref
+	if sr, err := s.statFile(ctx, f); err == nil && sr.Size == uint64(fi.Size()) {
+		local = sr.Ref
+	}
+	if !local.Zero() && local == ent.Ref {
+		return true, nil
+	}
+	// refs of files split into parts differ from refs of the content
+	stored, err := s.contentRef(ctx, ent.Ref)
+	if err != nil {
+		return false, err
+	}
+	if local.Zero() {
+		h := stored.Hash()
+		if _, err = io.Copy(h, f); err != nil {
+			return false, err
+		}
+		local = stored.WithHash(h)
+		if st, err := f.Stat(); err == nil && st.Size() == fi.Size() && st.ModTime().Equal(fi.ModTime()) {
+			_ = s.saveRefFile(ctx, f, st, local)
+		}
+	}
+	return local == stored, nil
+}
+
+// contentRef returns the ref of the content of a stored file. For files split into parts it's different from
+// the ref of the file. Content is hashed if the ref is not recorded in the schema.
+func (s *Storage) contentRef(ctx context.Context, ref Ref) (Ref, error) {
+	obj, err := s.DecodeSchema(ctx, ref)
+	if err == schema.ErrNotSchema {
+		return ref, nil
+	} else if err != nil {
+		return Ref{}, err
+	}
+	switch obj := obj.(type) {
+	case *schema.InlineList:
+		if obj.Ref != nil {
+			return *obj.Ref, nil
+		}
+	case *schema.List:
+		if obj.Ref != nil {
+			return *obj.Ref, nil
+		}
+	case *schema.Multipart:
+		if !obj.Ref.Zero() {
+			return obj.Ref, nil
+		}
+	case schema.BlobWrapper:
+		return obj.DataBlob(), nil
+	}
+	rc, _, err := s.OpenFile(ctx, ref)
+	if err != nil {
+		return Ref{}, err
+	}
+	defer rc.Close()
+	h := types.NewRef().Hash()
+	if _, err = io.Copy(h, rc); err != nil {
+		return Ref{}, err
+	}
+	return types.NewRef().WithHash(h), nil
+}
@@ -0,0 +1,75 @@
+package cas_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage"
+)
+
+func TestStatus(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_status_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	write := func(name, data string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	}
+	write("a.txt", "a")
+	write("b.txt", "b")
+	write("large.bin", strings.Repeat("large", 1000))
+	write("sub/c.txt", "c")
+	write("gone/d.txt", "d")
+	write("empty", "")
+
+	sr, err := s.StoreFilePath(ctx, dir, &cas.StoreConfig{Split: &cas.SplitConfig{Max: 1024}})
+	require.NoError(t, err)
+	root, err := s.Commit(ctx, "root", sr.Ref, "")
+	require.NoError(t, err)
+
+	status := func() []string {
+		var out []string
+		err := s.Status(ctx, root.Ref, dir, func(c *cas.Change) error {
+			name := c.Path
+			if c.Dir {
+				name += "/"
+			}
+			out = append(out, c.Kind.String()+" "+name)
+			return nil
+		})
+		require.NoError(t, err)
+		return out
+	}
+	require.Empty(t, status())
+
+	write("b.txt", "B")                               // same size
+	write("large.bin", strings.Repeat("LARGE", 1000)) // split into parts
+	write("sub/new.txt", "new")
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "gone")))
+	require.NoError(t, os.Remove(filepath.Join(dir, "a.txt")))
+	write("a.txt/e.txt", "e") // file replaced with a directory
+	write("newdir/f.txt", "f")
+
+	require.Equal(t, []string{
+		"M a.txt/",
+		"M b.txt",
+		"D gone/",
+		"M large.bin",
+		"A newdir/",
+		"A sub/new.txt",
+	}, status())
+}
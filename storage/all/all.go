@@ -1,7 +1,13 @@
 package all
 
 import (
+	_ "github.com/dennwc/cas/storage/b2"
 	_ "github.com/dennwc/cas/storage/gcs"
+	_ "github.com/dennwc/cas/storage/git"
 	_ "github.com/dennwc/cas/storage/http"
+	_ "github.com/dennwc/cas/storage/ipfs"
 	_ "github.com/dennwc/cas/storage/local"
+	_ "github.com/dennwc/cas/storage/sqlite"
+	_ "github.com/dennwc/cas/storage/tape"
+	_ "github.com/dennwc/cas/storage/webdav"
 )
@@ -0,0 +1,408 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dennwc/cas/storage"
+)
+
+const (
+	// DefaultAuthURL is the base URL used to authorize B2 accounts.
+	DefaultAuthURL = "https://api.backblazeb2.com"
+
+	apiPrefix = "/b2api/v2/"
+
+	// maxParts is the maximal number of parts in a large file.
+	maxParts = 10000
+	// maxRetries is the maximal number of attempts to upload a file or a part.
+	maxRetries = 5
+
+	contentTypeAuto = "b2/x-auto"
+
+	hdrFileName = "X-Bz-File-Name"
+	hdrSha1     = "X-Bz-Content-Sha1"
+	hdrPartNum  = "X-Bz-Part-Number"
+	hdrInfo     = "X-Bz-Info-"
+)
+
+// apiError is an error returned by B2 API.
+type apiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("b2: %s (%d): %s", e.Code, e.Status, e.Message)
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*apiError)
+	return ok && (e.Status == http.StatusNotFound || e.Code == "not_found")
+}
+
+func isExpired(err error) bool {
+	e, ok := err.(*apiError)
+	return ok && e.Status == http.StatusUnauthorized &&
+		(e.Code == "expired_auth_token" || e.Code == "bad_auth_token")
+}
+
+// isRetryable checks if a request can be retried with a new upload URL.
+func isRetryable(err error) bool {
+	e, ok := err.(*apiError)
+	if !ok {
+		// network errors
+		return true
+	}
+	return e.Status == http.StatusRequestTimeout || e.Status == http.StatusTooManyRequests ||
+		e.Status >= 500 || isExpired(err)
+}
+
+// checkResponse reads an error from the response, if any.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	e := &apiError{}
+	if resp.Request == nil || resp.Request.Method != "HEAD" {
+		_ = json.NewDecoder(resp.Body).Decode(e)
+	}
+	if e.Status == 0 {
+		e.Status = resp.StatusCode
+	}
+	if e.Code == "" {
+		e.Code = strings.ToLower(strings.Replace(http.StatusText(resp.StatusCode), " ", "_", -1))
+	}
+	return e
+}
+
+type authInfo struct {
+	AccountID   string `json:"accountId"`
+	Token       string `json:"authorizationToken"`
+	APIURL      string `json:"apiUrl"`
+	DownloadURL string `json:"downloadUrl"`
+	PartSize    int64  `json:"recommendedPartSize"`
+	MinPartSize int64  `json:"absoluteMinimumPartSize"`
+	Allowed     struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"allowed"`
+}
+
+// authorize gets a new account authorization token.
+func (s *Storage) authorize(ctx context.Context) (*authInfo, error) {
+	req, err := http.NewRequest("GET", s.authURL+apiPrefix+"b2_authorize_account", nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(s.keyID, s.key)
+	resp, err := s.cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err = checkResponse(resp); err != nil {
+		return nil, err
+	}
+	var info authInfo
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.auth = &info
+	s.mu.Unlock()
+	return &info, nil
+}
+
+func (s *Storage) getAuth(ctx context.Context) (*authInfo, error) {
+	s.mu.Lock()
+	auth := s.auth
+	s.mu.Unlock()
+	if auth != nil {
+		return auth, nil
+	}
+	return s.authorize(ctx)
+}
+
+// withAuth calls the function with the current account authorization, and repeats the call
+// with a new authorization token if the current one has expired.
+func (s *Storage) withAuth(ctx context.Context, fnc func(auth *authInfo) error) error {
+	auth, err := s.getAuth(ctx)
+	if err != nil {
+		return err
+	}
+	err = fnc(auth)
+	if !isExpired(err) {
+		return err
+	}
+	auth, err = s.authorize(ctx)
+	if err != nil {
+		return err
+	}
+	return fnc(auth)
+}
+
+// call invokes a B2 API method with JSON request and response.
+func (s *Storage) call(ctx context.Context, method string, in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return s.withAuth(ctx, func(auth *authInfo) error {
+		req, err := http.NewRequest("POST", auth.APIURL+apiPrefix+method, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", auth.Token)
+		resp, err := s.cli.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err = checkResponse(resp); err != nil {
+			return err
+		}
+		if out == nil {
+			return nil
+		}
+		return json.NewDecoder(resp.Body).Decode(out)
+	})
+}
+
+// escapeName encodes the file name as required by B2. Slashes are kept as-is.
+func escapeName(name string) string {
+	parts := strings.Split(name, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// download sends a GET or HEAD request for a file with a given name.
+// The caller must close the response body.
+func (s *Storage) download(ctx context.Context, method, name string) (*http.Response, error) {
+	var resp *http.Response
+	err := s.withAuth(ctx, func(auth *authInfo) error {
+		req, err := http.NewRequest(method, auth.DownloadURL+"/file/"+escapeName(s.bucket)+"/"+escapeName(name), nil)
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", auth.Token)
+		r, err := s.cli.Do(req)
+		if err != nil {
+			return err
+		}
+		if err = checkResponse(r); err != nil {
+			r.Body.Close()
+			return err
+		}
+		resp = r
+		return nil
+	})
+	return resp, err
+}
+
+type fileInfo struct {
+	ID     string            `json:"fileId"`
+	Name   string            `json:"fileName"`
+	Action string            `json:"action"`
+	Size   int64             `json:"contentLength"`
+	Sha1   string            `json:"contentSha1"`
+	Info   map[string]string `json:"fileInfo"`
+}
+
+type listFilesRequest struct {
+	BucketID  string `json:"bucketId"`
+	Start     string `json:"startFileName,omitempty"`
+	Count     int    `json:"maxFileCount,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	Delimiter string `json:"delimiter,omitempty"`
+}
+
+type listFilesResponse struct {
+	Files []fileInfo `json:"files"`
+	Next  *string    `json:"nextFileName"`
+}
+
+// listVersions returns all versions of a file with a given name.
+func (s *Storage) listVersions(ctx context.Context, name string) ([]fileInfo, error) {
+	var resp listFilesResponse
+	err := s.call(ctx, "b2_list_file_versions", listFilesRequest{
+		BucketID: s.bucketID, Start: name, Prefix: name, Count: 100,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	var out []fileInfo
+	for _, f := range resp.Files {
+		if f.Name == name {
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+// deleteFile removes all versions of a file. It returns ErrNotFound if there are no versions.
+func (s *Storage) deleteFile(ctx context.Context, name string) error {
+	files, err := s.listVersions(ctx, name)
+	if err != nil {
+		return err
+	} else if len(files) == 0 {
+		return storage.ErrNotFound
+	}
+	for _, f := range files {
+		err = s.call(ctx, "b2_delete_file_version", map[string]string{
+			"fileName": f.Name, "fileId": f.ID,
+		}, nil)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+type uploadURL struct {
+	URL   string `json:"uploadUrl"`
+	Token string `json:"authorizationToken"`
+}
+
+// getUploadURL returns an upload URL for a new file. URLs are reused between uploads.
+func (s *Storage) getUploadURL(ctx context.Context) (*uploadURL, error) {
+	s.mu.Lock()
+	if n := len(s.uploads); n != 0 {
+		u := s.uploads[n-1]
+		s.uploads = s.uploads[:n-1]
+		s.mu.Unlock()
+		return u, nil
+	}
+	s.mu.Unlock()
+	var u uploadURL
+	err := s.call(ctx, "b2_get_upload_url", map[string]string{"bucketId": s.bucketID}, &u)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *Storage) putUploadURL(u *uploadURL) {
+	s.mu.Lock()
+	s.uploads = append(s.uploads, u)
+	s.mu.Unlock()
+}
+
+// upload sends the content to the upload URL and verifies it with SHA-1 checksum on the server.
+// Upload is retried with a new upload URL on temporary errors. The URL is returned with putURL
+// after a successful upload, so it can be reused.
+func (s *Storage) upload(ctx context.Context, getURL func() (*uploadURL, error), putURL func(u *uploadURL), hdr http.Header, r io.ReaderAt, size int64, sha1 string) error {
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		var u *uploadURL
+		u, err = getURL()
+		if err != nil {
+			return err
+		}
+		req, err2 := http.NewRequest("POST", u.URL, io.NewSectionReader(r, 0, size))
+		if err2 != nil {
+			return err2
+		}
+		req = req.WithContext(ctx)
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		req.ContentLength = size
+		req.Header.Set("Authorization", u.Token)
+		req.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+		req.Header.Set(hdrSha1, sha1)
+		var resp *http.Response
+		resp, err = s.cli.Do(req)
+		if err == nil {
+			err = checkResponse(resp)
+			resp.Body.Close()
+		}
+		if err == nil {
+			putURL(u)
+			return nil
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		} else if !isRetryable(err) {
+			return err
+		}
+		// the URL should not be reused after an error
+	}
+	return err
+}
+
+// uploadFile uploads a file that fits into a single part.
+func (s *Storage) uploadFile(ctx context.Context, name string, info map[string]string, r io.ReaderAt, size int64, sha1 string) error {
+	hdr := make(http.Header)
+	hdr.Set(hdrFileName, escapeName(name))
+	hdr.Set("Content-Type", contentTypeAuto)
+	for k, v := range info {
+		hdr.Set(hdrInfo+k, url.PathEscape(v))
+	}
+	return s.upload(ctx, func() (*uploadURL, error) {
+		return s.getUploadURL(ctx)
+	}, s.putUploadURL, hdr, r, size, sha1)
+}
+
+// uploadLargeFile uploads a file in multiple parts with a given size.
+// Checksums of all parts must be provided.
+func (s *Storage) uploadLargeFile(ctx context.Context, name string, info map[string]string, r io.ReaderAt, size, partSize int64, sums []string) error {
+	var file fileInfo
+	err := s.call(ctx, "b2_start_large_file", map[string]interface{}{
+		"bucketId": s.bucketID, "fileName": name,
+		"contentType": contentTypeAuto, "fileInfo": info,
+	}, &file)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		var free *uploadURL
+		getURL := func() (*uploadURL, error) {
+			if u := free; u != nil {
+				free = nil
+				return u, nil
+			}
+			var u uploadURL
+			err := s.call(ctx, "b2_get_upload_part_url", map[string]string{"fileId": file.ID}, &u)
+			if err != nil {
+				return nil, err
+			}
+			return &u, nil
+		}
+		putURL := func(u *uploadURL) {
+			free = u
+		}
+		hdr := make(http.Header)
+		for i, sum := range sums {
+			off := int64(i) * partSize
+			n := partSize
+			if off+n > size {
+				n = size - off
+			}
+			hdr.Set(hdrPartNum, strconv.Itoa(i+1))
+			err := s.upload(ctx, getURL, putURL, hdr, io.NewSectionReader(r, off, n), n, sum)
+			if err != nil {
+				return err
+			}
+		}
+		return s.call(ctx, "b2_finish_large_file", map[string]interface{}{
+			"fileId": file.ID, "partSha1Array": sums,
+		}, nil)
+	}()
+	if err != nil {
+		_ = s.call(ctx, "b2_cancel_large_file", map[string]string{"fileId": file.ID}, nil)
+	}
+	return err
+}
@@ -0,0 +1,440 @@
+// Package b2 implements CAS storage on top of Backblaze B2 native API.
+//
+// Blobs are uploaded under their final names only after the ref is known, and each upload
+// is verified by B2 with a SHA-1 checksum computed while the blob is written. Blobs larger
+// than the part size are uploaded with the large file API.
+package b2
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+var (
+	_ storage.Storage     = (*Storage)(nil)
+	_ storage.BlobDeleter = (*Storage)(nil)
+)
+
+const (
+	dirBlobs = "cas/blobs/"
+	dirPins  = "cas/pins/"
+	infoRef  = "cas_ref"
+
+	// listBatch is the number of files requested in a single list call.
+	listBatch = 1000
+)
+
+const (
+	envKeyID = "B2_APPLICATION_KEY_ID"
+	envKey   = "B2_APPLICATION_KEY"
+)
+
+func init() {
+	storage.RegisterConfig("b2:ClientConfig", &Config{})
+}
+
+type Config struct {
+	Bucket string `json:"bucket"`
+	// KeyID and Key are the application key used to access the bucket. The key can reference a secret
+	// stored outside of the config, see storage.Secret.
+	// If not set, B2_APPLICATION_KEY_ID and B2_APPLICATION_KEY environment variables are used.
+	KeyID string          `json:"key_id,omitempty"`
+	Key   *storage.Secret `json:"key,omitempty"`
+	// PartSize is the size of parts for large file uploads.
+	// If not set, the size recommended by B2 is used.
+	PartSize int64 `json:"part_size,omitempty"`
+
+	storage.ConnConfig
+}
+
+func (c *Config) References() []types.Ref {
+	return nil
+}
+
+func (c *Config) OpenStorage(ctx context.Context) (storage.Storage, error) {
+	keyID, key := c.KeyID, ""
+	if keyID == "" && c.Key.IsZero() {
+		keyID, key = os.Getenv(envKeyID), os.Getenv(envKey)
+	} else {
+		var err error
+		if key, err = c.Key.Resolve(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return NewWithOptions(ctx, c.Bucket, keyID, key, &Options{PartSize: c.PartSize, Client: c.HTTPClient()})
+}
+
+// Options for B2 storage.
+type Options struct {
+	AuthURL  string       // base URL for account authorization; DefaultAuthURL is used if not set
+	Client   *http.Client // HTTP client; http.DefaultClient is used if not set
+	PartSize int64        // size of large file parts; the recommended size is used if not set
+}
+
+// New opens a B2 bucket using a given application key.
+func New(ctx context.Context, bucket, keyID, key string) (*Storage, error) {
+	return NewWithOptions(ctx, bucket, keyID, key, nil)
+}
+
+// NewWithOptions is the same as New, but allows to set additional options.
+func NewWithOptions(ctx context.Context, bucket, keyID, key string, opts *Options) (*Storage, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("b2: bucket name must be set")
+	} else if keyID == "" || key == "" {
+		return nil, fmt.Errorf("b2: application key must be set")
+	}
+	s := &Storage{
+		authURL: strings.TrimSuffix(opts.AuthURL, "/"),
+		cli:     opts.Client,
+		keyID:   keyID, key: key,
+		bucket: bucket,
+	}
+	if s.authURL == "" {
+		s.authURL = DefaultAuthURL
+	}
+	if s.cli == nil {
+		s.cli = http.DefaultClient
+	}
+	auth, err := s.authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.partSize = opts.PartSize
+	if s.partSize == 0 {
+		s.partSize = auth.PartSize
+	}
+	if s.partSize < auth.MinPartSize {
+		return nil, fmt.Errorf("b2: part size must be at least %d bytes", auth.MinPartSize)
+	}
+	if auth.Allowed.BucketID != "" && auth.Allowed.BucketName == bucket {
+		s.bucketID = auth.Allowed.BucketID
+		return s, nil
+	}
+	var resp struct {
+		Buckets []struct {
+			ID   string `json:"bucketId"`
+			Name string `json:"bucketName"`
+		} `json:"buckets"`
+	}
+	err = s.call(ctx, "b2_list_buckets", map[string]string{
+		"accountId": auth.AccountID, "bucketName": bucket,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range resp.Buckets {
+		if b.Name == bucket {
+			s.bucketID = b.ID
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("b2: bucket %q does not exist", bucket)
+}
+
+// Storage is a CAS storage that keeps blobs and pins in a B2 bucket.
+type Storage struct {
+	authURL  string
+	cli      *http.Client
+	keyID    string
+	key      string
+	bucket   string
+	bucketID string
+	partSize int64
+
+	mu      sync.Mutex
+	auth    *authInfo
+	uploads []*uploadURL // upload URLs that can be reused
+}
+
+func (s *Storage) Close() error {
+	return nil
+}
+
+func (s *Storage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	if ref.Zero() {
+		return 0, storage.ErrInvalidRef
+	}
+	resp, err := s.download(ctx, "HEAD", dirBlobs+ref.String())
+	if isNotFound(err) {
+		return 0, storage.ErrNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("b2: unknown blob size")
+	}
+	return uint64(resp.ContentLength), nil
+}
+
+func (s *Storage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	if ref.Zero() {
+		return nil, 0, storage.ErrInvalidRef
+	}
+	resp, err := s.download(ctx, "GET", dirBlobs+ref.String())
+	if isNotFound(err) {
+		return nil, 0, storage.ErrNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("b2: unknown blob size")
+	}
+	return resp.Body, uint64(resp.ContentLength), nil
+}
+
+// DeleteBlob implements storage.BlobDeleter. All versions of the blob are removed.
+func (s *Storage) DeleteBlob(ctx context.Context, ref types.Ref) error {
+	if ref.Zero() {
+		return storage.ErrInvalidRef
+	}
+	return s.deleteFile(ctx, dirBlobs+ref.String())
+}
+
+// BeginBlob starts a new blob upload. The blob is uploaded on Commit, since B2 requires the size and the checksum
+// of the content before the upload.
+func (s *Storage) BeginBlob(ctx context.Context) (storage.BlobWriter, error) {
+	h := &partHasher{partSize: s.partSize, whole: sha1.New(), part: sha1.New()}
+	return storage.Spool("cas_b2_", h, func(sr types.SizedRef, f *os.File) error {
+		return s.putBlob(ctx, sr, f, h)
+	})
+}
+
+// partHasher calculates SHA-1 checksums of the whole content and of its parts, as it's written.
+type partHasher struct {
+	partSize int64
+	whole    hash.Hash // SHA-1 of the whole blob
+	part     hash.Hash // SHA-1 of the current part
+	partN    int64     // bytes written to the current part
+	sums     []string  // SHA-1 of completed parts
+}
+
+func (h *partHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	h.whole.Write(p)
+	for len(p) != 0 {
+		if h.partN == h.partSize {
+			h.sums = append(h.sums, hex.EncodeToString(h.part.Sum(nil)))
+			h.part.Reset()
+			h.partN = 0
+		}
+		b := p
+		if rem := h.partSize - h.partN; int64(len(b)) > rem {
+			b = b[:rem]
+		}
+		h.part.Write(b)
+		h.partN += int64(len(b))
+		p = p[len(b):]
+	}
+	return n, nil
+}
+
+// putBlob uploads a spooled blob, unless it's already stored. Large blobs are uploaded in parts.
+func (s *Storage) putBlob(ctx context.Context, sr types.SizedRef, f *os.File, h *partHasher) error {
+	if _, err := s.StatBlob(ctx, sr.Ref); err == nil {
+		// already stored
+		return nil
+	} else if err != storage.ErrNotFound {
+		return err
+	}
+	name := dirBlobs + sr.Ref.String()
+	size := int64(sr.Size)
+	if size <= h.partSize {
+		return s.uploadFile(ctx, name, nil, f, size, hex.EncodeToString(h.whole.Sum(nil)))
+	}
+	sums := append(h.sums, hex.EncodeToString(h.part.Sum(nil)))
+	partSize := h.partSize
+	if len(sums) > maxParts {
+		// too many parts - use larger ones
+		partSize = (size + maxParts - 1) / maxParts
+		var err error
+		sums, err = partSums(f, size, partSize)
+		if err != nil {
+			return err
+		}
+	}
+	info := map[string]string{
+		// recommended by B2 for large files, since they have no checksum of the whole content
+		"large_file_sha1": hex.EncodeToString(h.whole.Sum(nil)),
+	}
+	return s.uploadLargeFile(ctx, name, info, f, size, partSize, sums)
+}
+
+// partSums calculates SHA-1 checksums of file parts.
+func partSums(r io.ReaderAt, size, partSize int64) ([]string, error) {
+	var sums []string
+	h := sha1.New()
+	for off := int64(0); off < size; off += partSize {
+		h.Reset()
+		if _, err := io.Copy(h, io.NewSectionReader(r, off, partSize)); err != nil {
+			return nil, err
+		}
+		sums = append(sums, hex.EncodeToString(h.Sum(nil)))
+	}
+	return sums, nil
+}
+
+func pinName(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "/?&") {
+		return "", fmt.Errorf("invalid pin name: %q", name)
+	}
+	return dirPins + name, nil
+}
+
+// SetPin stores a pin as a small file that contains the ref. The ref is also stored in file info,
+// so pins can be listed without downloading them.
+func (s *Storage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	path, err := pinName(name)
+	if err != nil {
+		return err
+	}
+	data := ref.String()
+	sum := sha1.Sum([]byte(data))
+	return s.uploadFile(ctx, path, map[string]string{infoRef: data},
+		strings.NewReader(data), int64(len(data)), hex.EncodeToString(sum[:]))
+}
+
+func (s *Storage) DeletePin(ctx context.Context, name string) error {
+	path, err := pinName(name)
+	if err != nil {
+		return err
+	}
+	return s.deleteFile(ctx, path)
+}
+
+func (s *Storage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	path, err := pinName(name)
+	if err != nil {
+		return types.Ref{}, err
+	}
+	resp, err := s.download(ctx, "HEAD", path)
+	if isNotFound(err) {
+		return types.Ref{}, storage.ErrNotFound
+	} else if err != nil {
+		return types.Ref{}, err
+	}
+	resp.Body.Close()
+	v, err := url.PathUnescape(resp.Header.Get(hdrInfo + infoRef))
+	if err != nil {
+		return types.Ref{}, err
+	}
+	return types.ParseRef(v)
+}
+
+func (s *Storage) iterate(ctx context.Context, pref string) filesIterator {
+	return filesIterator{s: s, ctx: ctx, pref: pref}
+}
+
+func (s *Storage) IterateBlobs(ctx context.Context) storage.Iterator {
+	return &blobIterator{filesIterator: s.iterate(ctx, dirBlobs)}
+}
+
+func (s *Storage) IteratePins(ctx context.Context) storage.PinIterator {
+	return &pinsIterator{filesIterator: s.iterate(ctx, dirPins)}
+}
+
+// filesIterator lists the latest versions of files with a given prefix.
+type filesIterator struct {
+	s    *Storage
+	ctx  context.Context
+	pref string
+
+	buf  []fileInfo
+	next *string
+	done bool
+
+	cur fileInfo
+	err error
+}
+
+func (it *filesIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for len(it.buf) == 0 {
+		if it.done {
+			return false
+		}
+		req := listFilesRequest{
+			BucketID: it.s.bucketID, Prefix: it.pref, Delimiter: "/", Count: listBatch,
+		}
+		if it.next != nil {
+			req.Start = *it.next
+		}
+		var resp listFilesResponse
+		if it.err = it.s.call(it.ctx, "b2_list_file_names", req, &resp); it.err != nil {
+			return false
+		}
+		it.buf, it.next = resp.Files, resp.Next
+		it.done = it.next == nil
+	}
+	it.cur = it.buf[0]
+	it.buf = it.buf[1:]
+	if it.cur.Action != "upload" {
+		// folders
+		return it.Next()
+	}
+	it.cur.Name = strings.TrimPrefix(it.cur.Name, it.pref)
+	return true
+}
+
+func (it *filesIterator) Err() error {
+	return it.err
+}
+
+func (it *filesIterator) Close() error {
+	it.buf, it.done = nil, true
+	return nil
+}
+
+type blobIterator struct {
+	filesIterator
+	sr types.SizedRef
+}
+
+func (it *blobIterator) SizedRef() types.SizedRef {
+	return it.sr
+}
+
+func (it *blobIterator) Next() bool {
+	if !it.filesIterator.Next() {
+		return false
+	}
+	it.sr.Size = uint64(it.cur.Size)
+	it.sr.Ref, it.err = types.ParseRef(it.cur.Name)
+	return it.err == nil
+}
+
+type pinsIterator struct {
+	filesIterator
+	pin types.Pin
+}
+
+func (it *pinsIterator) Pin() types.Pin {
+	return it.pin
+}
+
+func (it *pinsIterator) Next() bool {
+	if !it.filesIterator.Next() {
+		return false
+	}
+	it.pin.Name = it.cur.Name
+	it.pin.Ref, it.err = types.ParseRef(it.cur.Info[infoRef])
+	return it.err == nil
+}
@@ -0,0 +1,316 @@
+package b2
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/test"
+	"github.com/dennwc/cas/types"
+)
+
+const (
+	testBucket   = "bucket"
+	testBucketID = "bucket-id"
+)
+
+type fakeFile struct {
+	id   string
+	name string
+	info map[string]string
+	data []byte
+}
+
+// fakeB2 implements a subset of B2 native API used by the storage.
+type fakeB2 struct {
+	url string
+
+	mu     sync.Mutex
+	lastID int
+	files  []*fakeFile // all versions, sorted by name
+	large  map[string]*fakeFile
+	parts  map[string]map[int][]byte
+
+	token      string
+	failUpload int // number of uploads that should fail
+	uploads    int // number of successful single file uploads
+	partsUp    int // number of successful part uploads
+}
+
+func newFakeB2() *fakeB2 {
+	return &fakeB2{
+		large: make(map[string]*fakeFile),
+		parts: make(map[string]map[int][]byte),
+		token: "token1",
+	}
+}
+
+func (b *fakeB2) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Status: status, Code: code, Message: code})
+}
+
+func (b *fakeB2) nextID() string {
+	b.lastID++
+	return strconv.Itoa(b.lastID)
+}
+
+func (b *fakeB2) addFile(f *fakeFile) {
+	f.id = b.nextID()
+	b.files = append(b.files, f)
+	sort.SliceStable(b.files, func(i, j int) bool {
+		return b.files[i].name < b.files[j].name
+	})
+}
+
+func (b *fakeB2) latest(name string) *fakeFile {
+	var last *fakeFile
+	for _, f := range b.files {
+		if f.name == name {
+			last = f
+		}
+	}
+	return last
+}
+
+func fileJSON(f *fakeFile) map[string]interface{} {
+	sum := sha1.Sum(f.data)
+	return map[string]interface{}{
+		"fileId": f.id, "fileName": f.name, "action": "upload",
+		"contentLength": len(f.data), "contentSha1": hex.EncodeToString(sum[:]),
+		"fileInfo": f.info,
+	}
+}
+
+func (b *fakeB2) readUpload(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		panic(err)
+	}
+	if b.failUpload > 0 {
+		b.failUpload--
+		b.fail(w, http.StatusServiceUnavailable, "service_unavailable")
+		return nil, false
+	}
+	sum := sha1.Sum(data)
+	if r.Header.Get(hdrSha1) != hex.EncodeToString(sum[:]) {
+		b.fail(w, http.StatusBadRequest, "bad_request")
+		return nil, false
+	}
+	return data, true
+}
+
+func (b *fakeB2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	enc := json.NewEncoder(w)
+	if r.URL.Path == apiPrefix+"b2_authorize_account" {
+		if u, p, _ := r.BasicAuth(); u != "id" || p != "key" {
+			b.fail(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		enc.Encode(map[string]interface{}{
+			"accountId": "account", "authorizationToken": b.token,
+			"apiUrl": b.url, "downloadUrl": b.url,
+			"recommendedPartSize": 100 << 20, "absoluteMinimumPartSize": 1,
+		})
+		return
+	}
+	if r.Header.Get("Authorization") != b.token {
+		b.fail(w, http.StatusUnauthorized, "expired_auth_token")
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/file/"+testBucket+"/") {
+		name, _ := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/file/"+testBucket+"/"))
+		f := b.latest(name)
+		if f == nil {
+			b.fail(w, http.StatusNotFound, "not_found")
+			return
+		}
+		for k, v := range f.info {
+			w.Header().Set(hdrInfo+k, url.PathEscape(v))
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(f.data)))
+		if r.Method == "GET" {
+			w.Write(f.data)
+		}
+		return
+	}
+	switch r.URL.Path {
+	case "/upload":
+		data, ok := b.readUpload(w, r)
+		if !ok {
+			return
+		}
+		name, _ := url.PathUnescape(r.Header.Get(hdrFileName))
+		f := &fakeFile{name: name, data: data, info: make(map[string]string)}
+		for k := range r.Header {
+			if strings.HasPrefix(k, hdrInfo) {
+				v, _ := url.PathUnescape(r.Header.Get(k))
+				f.info[strings.ToLower(strings.TrimPrefix(k, hdrInfo))] = v
+			}
+		}
+		b.addFile(f)
+		b.uploads++
+		enc.Encode(fileJSON(f))
+		return
+	case "/upload_part":
+		data, ok := b.readUpload(w, r)
+		if !ok {
+			return
+		}
+		id := r.URL.Query().Get("id")
+		n, _ := strconv.Atoi(r.Header.Get(hdrPartNum))
+		b.parts[id][n] = data
+		b.partsUp++
+		enc.Encode(map[string]interface{}{})
+		return
+	}
+	var req map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		panic(err)
+	}
+	str := func(k string) string {
+		s, _ := req[k].(string)
+		return s
+	}
+	switch strings.TrimPrefix(r.URL.Path, apiPrefix) {
+	case "b2_list_buckets":
+		enc.Encode(map[string]interface{}{"buckets": []interface{}{
+			map[string]string{"bucketId": testBucketID, "bucketName": testBucket},
+		}})
+	case "b2_get_upload_url":
+		enc.Encode(uploadURL{URL: b.url + "/upload", Token: b.token})
+	case "b2_start_large_file":
+		f := &fakeFile{id: b.nextID(), name: str("fileName"), info: make(map[string]string)}
+		for k, v := range req["fileInfo"].(map[string]interface{}) {
+			f.info[k] = v.(string)
+		}
+		b.large[f.id] = f
+		b.parts[f.id] = make(map[int][]byte)
+		enc.Encode(map[string]string{"fileId": f.id})
+	case "b2_get_upload_part_url":
+		enc.Encode(uploadURL{URL: b.url + "/upload_part?id=" + str("fileId"), Token: b.token})
+	case "b2_finish_large_file":
+		id := str("fileId")
+		f, parts := b.large[id], b.parts[id]
+		sums := req["partSha1Array"].([]interface{})
+		for i := range sums {
+			f.data = append(f.data, parts[i+1]...)
+		}
+		sum := sha1.Sum(f.data)
+		if f.info["large_file_sha1"] != hex.EncodeToString(sum[:]) {
+			b.fail(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		delete(b.large, id)
+		b.addFile(f)
+		enc.Encode(fileJSON(f))
+	case "b2_cancel_large_file":
+		delete(b.large, str("fileId"))
+		enc.Encode(map[string]interface{}{})
+	case "b2_list_file_names", "b2_list_file_versions":
+		versions := strings.HasSuffix(r.URL.Path, "versions")
+		pref, start := str("prefix"), str("startFileName")
+		var files []interface{}
+		for i, f := range b.files {
+			if !strings.HasPrefix(f.name, pref) || f.name < start {
+				continue
+			}
+			if !versions && i+1 < len(b.files) && b.files[i+1].name == f.name {
+				continue
+			}
+			files = append(files, fileJSON(f))
+		}
+		enc.Encode(map[string]interface{}{"files": files})
+	case "b2_delete_file_version":
+		for i, f := range b.files {
+			if f.id == str("fileId") {
+				b.files = append(b.files[:i], b.files[i+1:]...)
+				enc.Encode(map[string]interface{}{})
+				return
+			}
+		}
+		b.fail(w, http.StatusNotFound, "not_found")
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestStorage(t testing.TB, opts *Options) (*Storage, *fakeB2, func()) {
+	b := newFakeB2()
+	hs := httptest.NewServer(b)
+	b.url = hs.URL
+	if opts == nil {
+		opts = &Options{}
+	}
+	opts.AuthURL = hs.URL
+	opts.Client = hs.Client()
+	s, err := NewWithOptions(context.Background(), testBucket, "id", "key", opts)
+	require.NoError(t, err)
+	return s, b, hs.Close
+}
+
+func TestB2(t *testing.T) {
+	storagetest.RunTests(t, func(t testing.TB) (storage.Storage, func()) {
+		s, _, closer := newTestStorage(t, nil)
+		return s, closer
+	})
+}
+
+func TestB2LargeFile(t *testing.T) {
+	s, b, closer := newTestStorage(t, &Options{PartSize: 10})
+	defer closer()
+
+	ctx := context.Background()
+	data := []byte("some data that doesn't fit into a single part")
+	b.failUpload = 1
+	sr, err := storage.WriteBytes(ctx, s, data)
+	require.NoError(t, err)
+	require.Equal(t, 5, b.partsUp)
+	require.Equal(t, 0, b.uploads)
+
+	// expire the token
+	b.mu.Lock()
+	b.token = "token2"
+	b.mu.Unlock()
+
+	rc, sz, err := s.FetchBlob(ctx, sr.Ref)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), sz)
+	require.Equal(t, data, got)
+
+	// blob is not uploaded again
+	_, err = storage.WriteBytes(ctx, s, data)
+	require.NoError(t, err)
+	require.Equal(t, 5, b.partsUp)
+
+	err = s.SetPin(ctx, "root", sr.Ref)
+	require.NoError(t, err)
+	err = s.SetPin(ctx, "root", types.BytesRef(nil))
+	require.NoError(t, err)
+	ref, err := s.GetPin(ctx, "root")
+	require.NoError(t, err)
+	require.Equal(t, types.BytesRef(nil), ref)
+
+	err = s.DeletePin(ctx, "root")
+	require.NoError(t, err)
+	_, err = s.GetPin(ctx, "root")
+	require.Equal(t, storage.ErrNotFound, err)
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"github.com/dennwc/cas/types"
+)
+
+// MultiReader reads multiple blobs from a single stream.
+//
+// Example:
+//		defer mr.Close()
+//		for mr.Next() {
+//			sr := mr.SizedRef()
+//			// read the content of the current blob from mr
+//		}
+//		err := mr.Err()
+type MultiReader interface {
+	BaseIterator
+	// SizedRef returns the ref and the size of the current blob.
+	SizedRef() types.SizedRef
+	// Read reads the content of the current blob. It returns io.EOF at the end of the blob.
+	// Unread content is skipped by Next.
+	Read(p []byte) (int, error)
+}
+
+// BulkFetcher is an optional interface for Storage implementations that can fetch multiple blobs at once.
+// It's intended for remote storages, where a round trip for each small blob is expensive.
+type BulkFetcher interface {
+	// FetchBlobs opens multiple blobs for reading. Blobs are returned in the same order as refs,
+	// but blobs that don't exist in the storage are skipped.
+	FetchBlobs(ctx context.Context, refs []types.Ref) (MultiReader, error)
+}
+
+// FetchBlobs fetches multiple blobs from the storage. It uses BulkFetcher if the storage implements it,
+// and fetches blobs one by one otherwise. See BulkFetcher for details.
+func FetchBlobs(ctx context.Context, s BlobSource, refs []types.Ref) (MultiReader, error) {
+	for _, ref := range refs {
+		if ref.Zero() {
+			return nil, ErrInvalidRef
+		}
+	}
+	if bf, ok := s.(BulkFetcher); ok {
+		return bf.FetchBlobs(ctx, refs)
+	}
+	return &seqReader{ctx: ctx, s: s, refs: refs}, nil
+}
+
+// seqReader fetches blobs one by one.
+type seqReader struct {
+	ctx  context.Context
+	s    BlobSource
+	refs []types.Ref
+
+	rc  io.ReadCloser
+	cur types.SizedRef
+	err error
+}
+
+func (r *seqReader) closeCur() {
+	if r.rc != nil {
+		r.rc.Close()
+		r.rc = nil
+	}
+	r.cur = types.SizedRef{}
+}
+
+func (r *seqReader) Next() bool {
+	r.closeCur()
+	if r.err != nil {
+		return false
+	}
+	for len(r.refs) > 0 {
+		ref := r.refs[0]
+		r.refs = r.refs[1:]
+		rc, sz, err := r.s.FetchBlob(r.ctx, ref)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			r.err = err
+			return false
+		}
+		r.rc = rc
+		r.cur = types.SizedRef{Ref: ref, Size: sz}
+		return true
+	}
+	return false
+}
+
+func (r *seqReader) SizedRef() types.SizedRef {
+	return r.cur
+}
+
+func (r *seqReader) Read(p []byte) (int, error) {
+	if r.rc == nil {
+		return 0, io.EOF
+	}
+	return r.rc.Read(p)
+}
+
+func (r *seqReader) Err() error {
+	return r.err
+}
+
+func (r *seqReader) Close() error {
+	r.closeCur()
+	r.refs = nil
+	return nil
+}
+
+// BulkStater is an optional interface for Storage implementations that can check multiple blobs at once.
+// It's used to find missing blobs when syncing storages, without a round trip for each blob.
+type BulkStater interface {
+	// StatBlobs returns sizes of multiple blobs. Blobs are returned in the same order as refs,
+	// but blobs that don't exist in the storage are skipped.
+	StatBlobs(ctx context.Context, refs []types.Ref) ([]types.SizedRef, error)
+}
+
+// StatBlobs returns sizes of multiple blobs. It uses BulkStater if the storage implements it,
+// and checks blobs one by one otherwise. See BulkStater for details.
+func StatBlobs(ctx context.Context, s BlobSource, refs []types.Ref) ([]types.SizedRef, error) {
+	for _, ref := range refs {
+		if ref.Zero() {
+			return nil, ErrInvalidRef
+		}
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+	if bs, ok := s.(BulkStater); ok {
+		return bs.StatBlobs(ctx, refs)
+	}
+	out := make([]types.SizedRef, 0, len(refs))
+	for _, ref := range refs {
+		sz, err := s.StatBlob(ctx, ref)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		out = append(out, types.SizedRef{Ref: ref, Size: sz})
+	}
+	return out, nil
+}
@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/dennwc/cas/types"
+)
+
+// CacheStats reports the state of a caching storage.
+type CacheStats struct {
+	Hits      uint64 // number of blob fetches served from the cache
+	Misses    uint64 // number of blob fetches served from the remote
+	Evictions uint64 // number of blobs evicted from the cache
+	Count     int    // number of blobs in the cache
+	Size      uint64 // total size of blobs in the cache
+}
+
+// NewCache creates a caching storage that fronts a slow remote storage with a bounded local cache.
+//
+// Blobs are added to the cache when they are fetched from the remote and are evicted in the LRU order
+// when the total size of cached blobs exceeds maxSize. Blobs larger than maxSize are never cached.
+// All writes go directly to the remote storage.
+//
+// Cache storage must implement BlobDeleter. Closing the caching storage closes both storages.
+func NewCache(remote, cache Storage, maxSize uint64) (*CacheStorage, error) {
+	del, ok := cache.(BlobDeleter)
+	if !ok {
+		return nil, fmt.Errorf("cache storage doesn't support deletion: %T", cache)
+	}
+	s := &CacheStorage{
+		Storage: remote,
+		cache:   cache, del: del,
+		max:   maxSize,
+		lru:   list.New(),
+		elems: make(map[types.Ref]*list.Element),
+	}
+	// blobs that are already in the cache are considered the oldest ones
+	it := cache.IterateBlobs(context.Background())
+	defer it.Close()
+	for it.Next() {
+		sr := it.SizedRef()
+		s.elems[sr.Ref] = s.lru.PushBack(sr)
+		s.stats.Count++
+		s.stats.Size += sr.Size
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.evict(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// CacheStorage is a caching proxy for a remote storage. See NewCache for details.
+type CacheStorage struct {
+	Storage // remote
+
+	cache Storage
+	del   BlobDeleter
+	max   uint64
+
+	mu    sync.Mutex
+	lru   *list.List // of types.SizedRef; most recent is first
+	elems map[types.Ref]*list.Element
+	stats CacheStats
+}
+
+// Stats returns the cache statistics.
+func (s *CacheStorage) Stats() CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Close closes both the remote and the cache storage.
+func (s *CacheStorage) Close() error {
+	err := s.Storage.Close()
+	if err2 := s.cache.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// touch marks the blob as recently used and reports if the blob is in the cache.
+func (s *CacheStorage) touch(ref types.Ref) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.elems[ref]
+	if ok {
+		s.lru.MoveToFront(e)
+	}
+	return ok
+}
+
+// forget removes the blob from the LRU list without deleting it from the cache.
+func (s *CacheStorage) forget(ref types.Ref) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.elems[ref]; ok {
+		s.remove(e)
+	}
+}
+
+func (s *CacheStorage) remove(e *list.Element) {
+	sr := s.lru.Remove(e).(types.SizedRef)
+	delete(s.elems, sr.Ref)
+	s.stats.Count--
+	s.stats.Size -= sr.Size
+}
+
+// add records a blob that was written to the cache and evicts old blobs, if necessary.
+func (s *CacheStorage) add(ctx context.Context, sr types.SizedRef) error {
+	s.mu.Lock()
+	if e, ok := s.elems[sr.Ref]; ok {
+		s.lru.MoveToFront(e)
+		s.mu.Unlock()
+		return nil
+	}
+	s.elems[sr.Ref] = s.lru.PushFront(sr)
+	s.stats.Count++
+	s.stats.Size += sr.Size
+	s.mu.Unlock()
+	return s.evict(ctx)
+}
+
+// evict removes least recently used blobs until the cache size is within the limit.
+// It should be called without the lock held, since deleting blobs from the cache may be slow.
+//
+// A blob may be added back to the cache concurrently, before it's deleted. In this case the cache lookup
+// fails and the blob is forgotten and fetched from the remote again.
+func (s *CacheStorage) evict(ctx context.Context) error {
+	var refs []types.Ref
+	s.mu.Lock()
+	for s.stats.Size > s.max {
+		e := s.lru.Back()
+		if e == nil {
+			break
+		}
+		refs = append(refs, e.Value.(types.SizedRef).Ref)
+		s.remove(e)
+		s.stats.Evictions++
+	}
+	s.mu.Unlock()
+	var last error
+	for _, ref := range refs {
+		if err := s.del.DeleteBlob(ctx, ref); err != nil && err != ErrNotFound {
+			last = err
+		}
+	}
+	return last
+}
+
+func (s *CacheStorage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	if s.touch(ref) {
+		sz, err := s.cache.StatBlob(ctx, ref)
+		if err == nil {
+			return sz, nil
+		}
+		s.forget(ref)
+	}
+	return s.Storage.StatBlob(ctx, ref)
+}
+
+// FetchBlob serves the blob from the cache, if possible. Otherwise it fetches the blob from the remote
+// and populates the cache while the caller reads the content.
+func (s *CacheStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	if ref.Zero() {
+		return nil, 0, ErrInvalidRef
+	}
+	if s.touch(ref) {
+		rc, sz, err := s.cache.FetchBlob(ctx, ref)
+		if err == nil {
+			s.mu.Lock()
+			s.stats.Hits++
+			s.mu.Unlock()
+			return rc, sz, nil
+		}
+		// blob was removed from the cache externally
+		s.forget(ref)
+	}
+	s.mu.Lock()
+	s.stats.Misses++
+	s.mu.Unlock()
+
+	rc, sz, err := s.Storage.FetchBlob(ctx, ref)
+	if err != nil || sz > s.max {
+		return rc, sz, err
+	}
+	w, err := s.cache.BeginBlob(ctx)
+	if err != nil {
+		// cache is not writable; serve from the remote
+		return rc, sz, nil
+	}
+	return &cacheReader{s: s, ctx: ctx, ref: ref, rc: rc, w: w}, sz, nil
+}
+
+// cacheReader reads the content from the remote and writes it to the cache at the same time.
+// Blob is committed to the cache only if it was read completely and matches the expected ref.
+type cacheReader struct {
+	s   *CacheStorage
+	ctx context.Context
+	ref types.Ref
+	rc  io.ReadCloser
+	w   BlobWriter
+}
+
+func (r *cacheReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	if n > 0 && r.w != nil {
+		if _, werr := r.w.Write(p[:n]); werr != nil {
+			r.discard()
+		}
+	}
+	if err == io.EOF && r.w != nil {
+		r.commit()
+	}
+	return n, err
+}
+
+func (r *cacheReader) discard() {
+	r.w.Close()
+	r.w = nil
+}
+
+func (r *cacheReader) commit() {
+	defer r.discard()
+	sr, err := r.w.Complete()
+	if err != nil || sr.Ref != r.ref {
+		return
+	}
+	if err = r.w.Commit(); err != nil {
+		return
+	}
+	// errors are not critical for the reader; blob is still available in the remote
+	_ = r.s.add(r.ctx, sr)
+}
+
+func (r *cacheReader) Close() error {
+	if r.w != nil {
+		r.discard()
+	}
+	return r.rc.Close()
+}
@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// CodecKind is a class of the blob transformation. It defines the position of a codec in the stack.
+type CodecKind int
+
+const (
+	// CodecCompress is a kind of codecs that reduce the size of the data.
+	CodecCompress CodecKind = iota
+	// CodecEncrypt is a kind of codecs that encrypt the data.
+	CodecEncrypt
+)
+
+func (k CodecKind) String() string {
+	switch k {
+	case CodecCompress:
+		return "compress"
+	case CodecEncrypt:
+		return "encrypt"
+	}
+	return fmt.Sprintf("CodecKind(%d)", int(k))
+}
+
+// Codec is a reversible transformation of the blob content, for example compression or encryption.
+type Codec interface {
+	// Name returns a unique name of the codec. It must include all parameters that affect the encoded format,
+	// thus two codecs with the same name can decode each others data.
+	Name() string
+	// Kind returns the kind of the codec.
+	Kind() CodecKind
+	// Encode wraps a writer to encode the data. Caller must close the encoder to flush the data.
+	// Closing the encoder must not close the underlying writer.
+	Encode(w io.Writer) (io.WriteCloser, error)
+	// Decode wraps a reader to decode the data.
+	Decode(r io.Reader) (io.ReadCloser, error)
+}
+
+// Gzip returns a codec that compresses blobs with gzip using a given compression level.
+func Gzip(level int) Codec {
+	return gzipCodec{level: level}
+}
+
+type gzipCodec struct {
+	level int
+}
+
+// Name implements Codec. Compression level doesn't affect the format, thus it's not included.
+func (gzipCodec) Name() string    { return "gzip" }
+func (gzipCodec) Kind() CodecKind { return CodecCompress }
+
+func (c gzipCodec) Encode(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.level)
+}
+
+func (gzipCodec) Decode(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+const (
+	// aesChunk is the size of the plaintext chunk sealed by AES-GCM codec.
+	aesChunk = 64 * 1024
+	// aesNoncePrefix is the size of the random nonce prefix of each encrypted blob.
+	// The rest of the nonce is the chunk index.
+	aesNoncePrefix = 8
+)
+
+var (
+	errCodecTruncated = errors.New("codec: encrypted data is truncated")
+	errCodecTooLong   = errors.New("codec: encrypted data is too long")
+)
+
+// AESGCM returns a codec that encrypts blobs with AES-GCM. The key must be 16, 24 or 32 bytes long.
+//
+// Blobs are split into chunks that are sealed independently, thus the codec never buffers the whole blob.
+// Each blob uses a random nonce prefix and the last chunk is authenticated as such, thus reordered,
+// truncated or extended blobs fail to decode.
+func AESGCM(key []byte) (Codec, error) {
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		return nil, err
+	}
+	// fingerprint allows to detect clients configured with a different key without revealing it
+	h := sha256.New()
+	h.Write([]byte("cas codec key\x00"))
+	h.Write(key)
+	return &aesCodec{aead: aead, id: hex.EncodeToString(h.Sum(nil)[:8])}, nil
+}
+
+type aesCodec struct {
+	aead cipher.AEAD
+	id   string
+}
+
+func (c *aesCodec) Name() string    { return "aes-gcm:" + c.id }
+func (c *aesCodec) Kind() CodecKind { return CodecEncrypt }
+
+func (c *aesCodec) Encode(w io.Writer) (io.WriteCloser, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce[:aesNoncePrefix]); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(nonce[:aesNoncePrefix]); err != nil {
+		return nil, err
+	}
+	return &aesWriter{c: c, w: w, nonce: nonce, buf: make([]byte, 0, aesChunk)}, nil
+}
+
+func (c *aesCodec) Decode(r io.Reader) (io.ReadCloser, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(r, nonce[:aesNoncePrefix]); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errCodecTruncated
+	} else if err != nil {
+		return nil, err
+	}
+	return &aesReader{
+		c: c, r: bufio.NewReader(r), nonce: nonce,
+		buf: make([]byte, aesChunk+c.aead.Overhead()),
+	}, nil
+}
+
+// chunkNonce sets the chunk index in the nonce.
+func chunkNonce(nonce []byte, i uint32) {
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], i)
+}
+
+// chunkData returns additional data for the chunk that marks the last chunk of the blob.
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+type aesWriter struct {
+	c     *aesCodec
+	w     io.Writer
+	nonce []byte
+	n     uint32
+	buf   []byte
+	err   error
+}
+
+func (w *aesWriter) seal(last bool) error {
+	chunkNonce(w.nonce, w.n)
+	w.n++
+	if w.n == 0 {
+		return errCodecTooLong
+	}
+	out := w.c.aead.Seal(nil, w.nonce, w.buf, chunkData(last))
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(out)
+	return err
+}
+
+func (w *aesWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for len(p) > 0 {
+		if len(w.buf) == aesChunk {
+			// only seal a full chunk when more data arrives; the last chunk is sealed on Close
+			if w.err = w.seal(false); w.err != nil {
+				return n, w.err
+			}
+		}
+		i := copy(w.buf[len(w.buf):aesChunk], p)
+		w.buf = w.buf[:len(w.buf)+i]
+		p = p[i:]
+		n += i
+	}
+	return n, nil
+}
+
+func (w *aesWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.seal(true)
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errors.New("codec: writer is closed")
+	return nil
+}
+
+type aesReader struct {
+	c     *aesCodec
+	r     *bufio.Reader
+	nonce []byte
+	n     uint32
+	buf   []byte
+	cur   []byte
+	last  bool
+}
+
+func (r *aesReader) open() error {
+	n, err := io.ReadFull(r.r, r.buf)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		r.last = true
+	} else if err != nil {
+		return err
+	} else if _, err = r.r.Peek(1); err == io.EOF {
+		r.last = true
+	} else if err != nil {
+		return err
+	}
+	chunkNonce(r.nonce, r.n)
+	r.n++
+	if r.n == 0 {
+		return errCodecTooLong
+	}
+	r.cur, err = r.c.aead.Open(r.buf[:0], r.nonce, r.buf[:n], chunkData(r.last))
+	if err != nil {
+		return fmt.Errorf("codec: cannot decrypt blob: %v", err)
+	}
+	return nil
+}
+
+func (r *aesReader) Read(p []byte) (int, error) {
+	for len(r.cur) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+func (r *aesReader) Close() error {
+	return nil
+}
+
+// encodeChain wraps a writer with all codecs in the stack. Data written to the returned writer
+// is passed through the first codec, then through the second one and so on.
+func encodeChain(w io.Writer, codecs []Codec) (io.WriteCloser, error) {
+	ws := make([]io.WriteCloser, 0, len(codecs))
+	for i := len(codecs) - 1; i >= 0; i-- {
+		cw, err := codecs[i].Encode(w)
+		if err != nil {
+			return nil, err
+		}
+		ws = append(ws, cw)
+		w = cw
+	}
+	// reverse, so the outer writer is closed first
+	for i, j := 0, len(ws)-1; i < j; i, j = i+1, j-1 {
+		ws[i], ws[j] = ws[j], ws[i]
+	}
+	return &chainWriter{Writer: w, ws: ws}, nil
+}
+
+type chainWriter struct {
+	io.Writer
+	ws []io.WriteCloser
+}
+
+func (w *chainWriter) Close() error {
+	for _, cw := range w.ws {
+		if err := cw.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeChain wraps a reader with all codecs in the stack in reverse order.
+func decodeChain(r io.ReadCloser, codecs []Codec) (io.ReadCloser, error) {
+	rs := []io.Closer{r}
+	var cur io.Reader = r
+	for i := len(codecs) - 1; i >= 0; i-- {
+		cr, err := codecs[i].Decode(cur)
+		if err != nil {
+			closeAll(rs)
+			return nil, err
+		}
+		rs = append(rs, cr)
+		cur = cr
+	}
+	return &chainReader{Reader: cur, rs: rs}, nil
+}
+
+type chainReader struct {
+	io.Reader
+	rs []io.Closer
+}
+
+func (r *chainReader) Close() error {
+	return closeAll(r.rs)
+}
+
+func closeAll(cs []io.Closer) error {
+	var last error
+	for i := len(cs) - 1; i >= 0; i-- {
+		if err := cs[i].Close(); err != nil {
+			last = err
+		}
+	}
+	return last
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"github.com/dennwc/cas/types"
+)
+
+// Combine creates a storage from separate sources of blobs and pins. It allows partial backends, like read-only
+// mirrors or caches without pins, to be used as a Storage without implementing methods they don't support.
+//
+// Blobs can only be written if the blob source implements BlobSink, and pins can only be changed if the pin source
+// implements PinStore. ErrReadOnly is returned otherwise. If pins are nil, the storage has no pins.
+//
+// Closing the storage closes both sources if they implement io.Closer.
+// Optional interfaces of the sources are not exposed by the combined storage.
+func Combine(blobs BlobSource, pins PinSource) Storage {
+	return &combinedStorage{blobs: blobs, pins: pins}
+}
+
+type combinedStorage struct {
+	blobs BlobSource
+	pins  PinSource // optional
+}
+
+func (s *combinedStorage) Close() error {
+	var last error
+	if c, ok := s.blobs.(io.Closer); ok {
+		last = c.Close()
+	}
+	// the same backend might serve both blobs and pins
+	if c, ok := s.pins.(io.Closer); ok && interface{}(s.pins) != interface{}(s.blobs) {
+		if err := c.Close(); err != nil {
+			last = err
+		}
+	}
+	return last
+}
+
+func (s *combinedStorage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	return s.blobs.StatBlob(ctx, ref)
+}
+
+func (s *combinedStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	return s.blobs.FetchBlob(ctx, ref)
+}
+
+func (s *combinedStorage) IterateBlobs(ctx context.Context) Iterator {
+	return s.blobs.IterateBlobs(ctx)
+}
+
+func (s *combinedStorage) BeginBlob(ctx context.Context) (BlobWriter, error) {
+	if w, ok := s.blobs.(BlobSink); ok {
+		return w.BeginBlob(ctx)
+	}
+	return nil, ErrReadOnly
+}
+
+func (s *combinedStorage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	if p, ok := s.pins.(PinStore); ok {
+		return p.SetPin(ctx, name, ref)
+	}
+	return ErrReadOnly
+}
+
+func (s *combinedStorage) DeletePin(ctx context.Context, name string) error {
+	if p, ok := s.pins.(PinStore); ok {
+		return p.DeletePin(ctx, name)
+	}
+	return ErrReadOnly
+}
+
+func (s *combinedStorage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	if s.pins == nil {
+		return types.Ref{}, ErrNotFound
+	}
+	return s.pins.GetPin(ctx, name)
+}
+
+func (s *combinedStorage) IteratePins(ctx context.Context) PinIterator {
+	if s.pins == nil {
+		return &emptyPinIterator{}
+	}
+	return s.pins.IteratePins(ctx)
+}
+
+type emptyPinIterator struct{}
+
+func (*emptyPinIterator) Next() bool     { return false }
+func (*emptyPinIterator) Err() error     { return nil }
+func (*emptyPinIterator) Close() error   { return nil }
+func (*emptyPinIterator) Pin() types.Pin { return types.Pin{} }
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Duration is a time.Duration that is encoded as a string in configs, for example "30s".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(p []byte) error {
+	v, err := time.ParseDuration(string(p))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ConnConfig contains connection settings of remote storages. It's embedded into configs of storages.
+// Zero values keep defaults of the HTTP client.
+type ConnConfig struct {
+	// DialTimeout limits the time spent establishing a connection.
+	DialTimeout Duration `json:"dial_timeout,omitempty"`
+	// ResponseTimeout limits the time spent waiting for response headers. It doesn't limit reading the response.
+	ResponseTimeout Duration `json:"response_timeout,omitempty"`
+	// Retries is the number of times idempotent requests are retried on network errors
+	// and when the server is temporarily unavailable.
+	Retries int `json:"retries,omitempty"`
+}
+
+// isZero checks if no connection settings are set.
+func (c *ConnConfig) isZero() bool {
+	return c == nil || *c == ConnConfig{}
+}
+
+// HTTPClient returns an HTTP client with the connection settings. It returns http.DefaultClient if no settings are set.
+func (c *ConnConfig) HTTPClient() *http.Client {
+	if c.isZero() {
+		return http.DefaultClient
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if c.DialTimeout > 0 {
+		tr.DialContext = (&net.Dialer{
+			Timeout:   time.Duration(c.DialTimeout),
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		tr.TLSHandshakeTimeout = time.Duration(c.DialTimeout)
+	}
+	if c.ResponseTimeout > 0 {
+		tr.ResponseHeaderTimeout = time.Duration(c.ResponseTimeout)
+	}
+	var rt http.RoundTripper = tr
+	if c.Retries > 0 {
+		rt = &retryTransport{rt: tr, retries: c.Retries}
+	}
+	return &http.Client{Transport: rt}
+}
+
+// retryTransport retries idempotent requests without a body.
+type retryTransport struct {
+	rt      http.RoundTripper
+	retries int
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isIdempotent(req) {
+		return t.rt.RoundTrip(req)
+	}
+	wait := 100 * time.Millisecond
+	for i := 0; ; i++ {
+		resp, err := t.rt.RoundTrip(req)
+		if i >= t.retries || req.Context().Err() != nil {
+			return resp, err
+		}
+		if err == nil {
+			switch resp.StatusCode {
+			case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				resp.Body.Close()
+			default:
+				return resp, nil
+			}
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func isIdempotent(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+	switch req.Method {
+	case "", "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,481 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/dennwc/cas/types"
+)
+
+const (
+	// CodecManifestPin is the name of the pin that points to a manifest of codecs active in the store.
+	// The manifest is stored as a raw blob, thus any client can read it.
+	CodecManifestPin = "cas.codecs"
+	// codecPinPrefix is a prefix for pins that map refs of blobs to refs of encoded blobs.
+	codecPinPrefix = "cas.codec."
+
+	codecManifestHeader = "cas-codecs v1\n"
+	// encodedMagic is written before the size of the original blob in each encoded blob.
+	encodedMagic = "CASE"
+)
+
+var errCodecPin = errors.New("pin name is reserved for codecs")
+
+// ErrCodecOrder is returned when the codec stack applies compression after encryption.
+// Encrypted data cannot be compressed, and compressing it only leaks information about the content.
+type ErrCodecOrder struct {
+	Compress, Encrypt string
+}
+
+func (e ErrCodecOrder) Error() string {
+	return fmt.Sprintf("codec %q must be applied before %q: compress-then-encrypt is required", e.Compress, e.Encrypt)
+}
+
+// ErrCodecMismatch is returned when the codec stack recorded in the store doesn't match the configured one.
+// Opening such store would corrupt the data or make it unreadable for other clients.
+type ErrCodecMismatch struct {
+	Store, Config []string
+}
+
+func (e ErrCodecMismatch) Error() string {
+	str := func(s []string) string {
+		if len(s) == 0 {
+			return "none"
+		}
+		return strings.Join(s, ", ")
+	}
+	return fmt.Sprintf("store codecs don't match the config: store: [%s], config: [%s]", str(e.Store), str(e.Config))
+}
+
+// CheckCodecs checks that the store can be accessed without any codecs.
+// It returns ErrCodecMismatch if a codec manifest is recorded in the store.
+func CheckCodecs(ctx context.Context, s Storage) error {
+	codecs, err := readCodecManifest(ctx, s)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return ErrCodecMismatch{Store: codecs}
+}
+
+func codecNames(codecs []Codec) []string {
+	names := make([]string, 0, len(codecs))
+	for _, c := range codecs {
+		names = append(names, c.Name())
+	}
+	return names
+}
+
+func readCodecManifest(ctx context.Context, s Storage) ([]string, error) {
+	ref, err := s.GetPin(ctx, CodecManifestPin)
+	if err != nil {
+		return nil, err
+	}
+	rc, _, err := s.FetchBlob(ctx, ref)
+	if err == ErrNotFound {
+		return nil, fmt.Errorf("codec manifest %v is missing", ref)
+	} else if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(codecManifestHeader)) {
+		return nil, fmt.Errorf("unsupported codec manifest format")
+	}
+	var names []string
+	for _, line := range strings.Split(string(data[len(codecManifestHeader):]), "\n") {
+		if line != "" {
+			names = append(names, line)
+		}
+	}
+	return names, nil
+}
+
+func writeCodecManifest(ctx context.Context, s Storage, names []string) error {
+	buf := bytes.NewBufferString(codecManifestHeader)
+	for _, name := range names {
+		buf.WriteString(name)
+		buf.WriteByte('\n')
+	}
+	sr, err := WriteBytes(ctx, s, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return s.SetPin(ctx, CodecManifestPin, sr.Ref)
+}
+
+// isEmpty checks if the storage has no blobs and pins.
+func isEmpty(ctx context.Context, s Storage) (bool, error) {
+	it := s.IterateBlobs(ctx)
+	defer it.Close()
+	if it.Next() {
+		return false, nil
+	} else if err := it.Err(); err != nil {
+		return false, err
+	}
+	pit := s.IteratePins(ctx)
+	defer pit.Close()
+	if pit.Next() {
+		return false, nil
+	}
+	return true, pit.Err()
+}
+
+// NewEncoded creates a storage that transforms blobs with a stack of codecs before storing them
+// in the underlying storage.
+//
+// Codecs are applied in the order they are listed when storing blobs, and in reverse order when fetching them.
+// All compression codecs must precede encryption codecs, otherwise ErrCodecOrder is returned.
+//
+// The list of codecs is recorded in a manifest in the underlying storage when it's empty. An existing storage
+// can only be opened with exactly the same codecs, otherwise ErrCodecMismatch is returned. A storage with a codec
+// manifest is also refused by CheckCodecs, thus clients without codecs won't write plain blobs to it.
+//
+// Blobs are addressed by refs of their original content. Encoded blobs are stored under their own refs and are mapped
+// to the original refs with pins that are hidden by the encoded storage.
+func NewEncoded(ctx context.Context, s Storage, codecs ...Codec) (*EncodedStorage, error) {
+	if len(codecs) == 0 {
+		return nil, errors.New("no codecs specified")
+	}
+	var enc Codec
+	for _, c := range codecs {
+		switch c.Kind() {
+		case CodecEncrypt:
+			if enc == nil {
+				enc = c
+			}
+		case CodecCompress:
+			if enc != nil {
+				return nil, ErrCodecOrder{Compress: c.Name(), Encrypt: enc.Name()}
+			}
+		default:
+			return nil, fmt.Errorf("unsupported codec kind: %v", c.Kind())
+		}
+	}
+	names := codecNames(codecs)
+	got, err := readCodecManifest(ctx, s)
+	if err == ErrNotFound {
+		empty, err := isEmpty(ctx, s)
+		if err != nil {
+			return nil, err
+		} else if !empty {
+			return nil, ErrCodecMismatch{Config: names}
+		}
+		if err = writeCodecManifest(ctx, s, names); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if strings.Join(got, "\n") != strings.Join(names, "\n") {
+		return nil, ErrCodecMismatch{Store: got, Config: names}
+	}
+	return &EncodedStorage{s: s, codecs: codecs}, nil
+}
+
+var _ Storage = (*EncodedStorage)(nil)
+
+// EncodedStorage encodes blobs with a stack of codecs. See NewEncoded for details.
+type EncodedStorage struct {
+	s      Storage
+	codecs []Codec
+}
+
+// Codecs returns names of active codecs in the order they are applied.
+func (s *EncodedStorage) Codecs() []string {
+	return codecNames(s.codecs)
+}
+
+func (s *EncodedStorage) Close() error {
+	return s.s.Close()
+}
+
+func codecPin(ref types.Ref) string {
+	return codecPinPrefix + ref.String()
+}
+
+func isCodecPin(name string) bool {
+	return name == CodecManifestPin || strings.HasPrefix(name, codecPinPrefix)
+}
+
+// openEncoded opens an encoded blob and returns the reader positioned after the header and the original size.
+func (s *EncodedStorage) openEncoded(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	if ref.Zero() {
+		return nil, 0, ErrInvalidRef
+	}
+	eref, err := s.s.GetPin(ctx, codecPin(ref))
+	if err != nil {
+		return nil, 0, err
+	}
+	rc, _, err := s.s.FetchBlob(ctx, eref)
+	if err == ErrNotFound {
+		return nil, 0, fmt.Errorf("encoded blob %v of %v is missing", eref, ref)
+	} else if err != nil {
+		return nil, 0, err
+	}
+	br := bufio.NewReader(rc)
+	magic := make([]byte, len(encodedMagic))
+	if _, err = io.ReadFull(br, magic); err != nil || string(magic) != encodedMagic {
+		rc.Close()
+		return nil, 0, fmt.Errorf("blob %v is not encoded", eref)
+	}
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		rc.Close()
+		return nil, 0, fmt.Errorf("blob %v is not encoded: %v", eref, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, rc}, size, nil
+}
+
+func (s *EncodedStorage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	rc, size, err := s.openEncoded(ctx, ref)
+	if err != nil {
+		return 0, err
+	}
+	rc.Close()
+	return size, nil
+}
+
+// FetchBlob fetches an encoded blob and decodes it. The decoded content is verified against the ref.
+func (s *EncodedStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	rc, size, err := s.openEncoded(ctx, ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	dr, err := decodeChain(rc, s.codecs)
+	if err != nil {
+		return nil, 0, err
+	}
+	return VerifyReader(dr, ref), size, nil
+}
+
+// IterateBlobs lists the original refs of all blobs. It reads a header of each encoded blob to get the size.
+func (s *EncodedStorage) IterateBlobs(ctx context.Context) Iterator {
+	return &encodedIterator{s: s, ctx: ctx, it: s.s.IteratePins(ctx)}
+}
+
+type encodedIterator struct {
+	s   *EncodedStorage
+	ctx context.Context
+	it  PinIterator
+	cur types.SizedRef
+	err error
+}
+
+func (it *encodedIterator) Next() bool {
+	it.cur = types.SizedRef{}
+	if it.err != nil {
+		return false
+	}
+	for it.it.Next() {
+		p := it.it.Pin()
+		if !strings.HasPrefix(p.Name, codecPinPrefix) {
+			continue
+		}
+		ref, err := types.ParseRef(strings.TrimPrefix(p.Name, codecPinPrefix))
+		if err != nil {
+			it.err = err
+			return false
+		}
+		sz, err := it.s.StatBlob(it.ctx, ref)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.cur = types.SizedRef{Ref: ref, Size: sz}
+		return true
+	}
+	it.err = it.it.Err()
+	return false
+}
+
+func (it *encodedIterator) Err() error {
+	return it.err
+}
+
+func (it *encodedIterator) Close() error {
+	return it.it.Close()
+}
+
+func (it *encodedIterator) SizedRef() types.SizedRef {
+	return it.cur
+}
+
+// BeginBlob starts a new blob. Encoded data is spooled to a temporary file until the blob is committed,
+// since the header of the encoded blob includes the size of the original content.
+func (s *EncodedStorage) BeginBlob(ctx context.Context) (BlobWriter, error) {
+	f, err := ioutil.TempFile("", "cas_enc_")
+	if err != nil {
+		return nil, err
+	}
+	enc, err := encodeChain(f, s.codecs)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &encodedWriter{s: s, ctx: ctx, f: f, enc: enc, h: Hash()}, nil
+}
+
+type encodedWriter struct {
+	s   *EncodedStorage
+	ctx context.Context
+	f   *os.File
+	enc io.WriteCloser
+	h   BlobWriter
+
+	sr        types.SizedRef
+	done      bool
+	committed bool
+}
+
+func (w *encodedWriter) Write(p []byte) (int, error) {
+	if w.f == nil {
+		return 0, ErrBlobDiscarded
+	} else if w.done {
+		return 0, ErrBlobCompleted
+	}
+	n, err := w.enc.Write(p)
+	if n != 0 {
+		w.h.Write(p[:n])
+	}
+	return n, err
+}
+
+func (w *encodedWriter) Size() uint64 {
+	return w.h.Size()
+}
+
+func (w *encodedWriter) Complete() (types.SizedRef, error) {
+	if w.f == nil {
+		return types.SizedRef{}, ErrBlobDiscarded
+	} else if w.done {
+		return w.sr, nil
+	}
+	if err := w.enc.Close(); err != nil {
+		return types.SizedRef{}, err
+	}
+	sr, err := w.h.Complete()
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	w.sr, w.done = sr, true
+	return sr, nil
+}
+
+// discard removes the spooled data.
+func (w *encodedWriter) discard() error {
+	if w.f == nil {
+		return nil
+	}
+	w.f.Close()
+	err := os.Remove(w.f.Name())
+	w.f = nil
+	return err
+}
+
+func (w *encodedWriter) Close() error {
+	if w.committed {
+		return ErrBlobCompleted
+	}
+	return w.discard()
+}
+
+func (w *encodedWriter) Commit() error {
+	if _, err := w.Complete(); err != nil {
+		return err
+	}
+	defer w.discard()
+	if err := w.commit(); err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
+
+func (w *encodedWriter) commit() error {
+	if _, err := w.s.s.GetPin(w.ctx, codecPin(w.sr.Ref)); err == nil {
+		// already stored
+		return nil
+	} else if err != ErrNotFound {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	bw, err := w.s.s.BeginBlob(w.ctx)
+	if err != nil {
+		return err
+	}
+	defer bw.Close()
+	hdr := make([]byte, len(encodedMagic)+binary.MaxVarintLen64)
+	n := copy(hdr, encodedMagic)
+	n += binary.PutUvarint(hdr[n:], w.sr.Size)
+	if _, err = bw.Write(hdr[:n]); err != nil {
+		return err
+	}
+	if _, err = io.Copy(bw, w.f); err != nil {
+		return err
+	}
+	esr, err := bw.Complete()
+	if err != nil {
+		return err
+	}
+	if err = bw.Commit(); err != nil {
+		return err
+	}
+	return w.s.s.SetPin(w.ctx, codecPin(w.sr.Ref), esr.Ref)
+}
+
+func (s *EncodedStorage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	if isCodecPin(name) {
+		return errCodecPin
+	}
+	return s.s.SetPin(ctx, name, ref)
+}
+
+func (s *EncodedStorage) DeletePin(ctx context.Context, name string) error {
+	if isCodecPin(name) {
+		return errCodecPin
+	}
+	return s.s.DeletePin(ctx, name)
+}
+
+func (s *EncodedStorage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	if isCodecPin(name) {
+		return types.Ref{}, ErrNotFound
+	}
+	return s.s.GetPin(ctx, name)
+}
+
+// IteratePins lists all pins except the ones used by codecs.
+func (s *EncodedStorage) IteratePins(ctx context.Context) PinIterator {
+	return &userPinIterator{PinIterator: s.s.IteratePins(ctx)}
+}
+
+type userPinIterator struct {
+	PinIterator
+}
+
+func (it *userPinIterator) Next() bool {
+	for it.PinIterator.Next() {
+		if !isCodecPin(it.Pin().Name) {
+			return true
+		}
+	}
+	return false
+}
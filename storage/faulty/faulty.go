@@ -0,0 +1,182 @@
+// Package faulty implements storage wrappers that inject failures. It's used in tests to check
+// that storages and code that uses them don't lose or corrupt data when operations fail.
+//
+// Storage injects failures into blob reads and writes of any storage. FS injects failures into
+// file system operations of the local storage (see local.Options.FS), and can simulate a crash
+// that loses all data that was not flushed to disk.
+//
+// Failures are random, but reproducible for a given seed and a sequence of operations.
+package faulty
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// ErrInjected is returned by operations that failed because of an injected failure.
+var ErrInjected = errors.New("faulty: injected failure")
+
+// Config sets probabilities of injected failures. Zero values disable the failure, and one makes
+// the operation fail each time.
+type Config struct {
+	Seed int64 // seed for the random source
+
+	ReadErrors  float64 // probability that a read fails
+	ShortWrites float64 // probability that a write stores only a part of the data
+	TornRenames float64 // probability that a rename loses the content of the file; FS only
+
+	SyncDelay time.Duration // delay of each fsync; FS only
+}
+
+// faults is a random source of failures shared by wrappers.
+type faults struct {
+	mu   sync.Mutex
+	conf Config
+	rnd  *rand.Rand
+}
+
+func (f *faults) init(conf Config) {
+	f.conf = conf
+	f.rnd = rand.New(rand.NewSource(conf.Seed))
+}
+
+// SetConfig replaces the configuration of injected failures. The random source is reset with the new seed.
+func (f *faults) SetConfig(conf Config) {
+	f.mu.Lock()
+	f.init(conf)
+	f.mu.Unlock()
+}
+
+// Config returns the current configuration of injected failures.
+func (f *faults) Config() Config {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conf
+}
+
+// fail randomly decides if an operation should fail, given a probability selected from the config.
+func (f *faults) fail(prob func(c *Config) float64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := prob(&f.conf)
+	if p <= 0 {
+		return false
+	} else if p >= 1 {
+		return true
+	}
+	return f.rnd.Float64() < p
+}
+
+// cut randomly selects how many bytes of n will be written by a short write.
+func (f *faults) cut(n int) int {
+	if n <= 1 {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rnd.Intn(n)
+}
+
+func readErrors(c *Config) float64  { return c.ReadErrors }
+func shortWrites(c *Config) float64 { return c.ShortWrites }
+func tornRenames(c *Config) float64 { return c.TornRenames }
+
+// New wraps the storage and injects failures into blob reads and writes.
+//
+// Blob readers fail with ErrInjected, and writers store only a part of the data and return
+// ErrInjected along with the short count. Other operations are passed through as-is.
+//
+// Only methods of storage.Storage are exposed, thus callers never bypass injected failures
+// by using optional interfaces of the underlying storage.
+func New(s storage.Storage, conf Config) *Storage {
+	fs := &Storage{s: s}
+	fs.init(conf)
+	return fs
+}
+
+// Storage is a storage wrapper that injects failures. See New.
+type Storage struct {
+	faults
+	s storage.Storage
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+func (s *Storage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	return s.s.StatBlob(ctx, ref)
+}
+
+func (s *Storage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	rc, sz, err := s.s.FetchBlob(ctx, ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &reader{ReadCloser: rc, f: &s.faults}, sz, nil
+}
+
+func (s *Storage) IterateBlobs(ctx context.Context) storage.Iterator {
+	return s.s.IterateBlobs(ctx)
+}
+
+func (s *Storage) BeginBlob(ctx context.Context) (storage.BlobWriter, error) {
+	w, err := s.s.BeginBlob(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{BlobWriter: w, f: &s.faults}, nil
+}
+
+func (s *Storage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	return s.s.SetPin(ctx, name, ref)
+}
+
+func (s *Storage) DeletePin(ctx context.Context, name string) error {
+	return s.s.DeletePin(ctx, name)
+}
+
+func (s *Storage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	return s.s.GetPin(ctx, name)
+}
+
+func (s *Storage) IteratePins(ctx context.Context) storage.PinIterator {
+	return s.s.IteratePins(ctx)
+}
+
+func (s *Storage) Close() error {
+	return s.s.Close()
+}
+
+type reader struct {
+	io.ReadCloser
+	f *faults
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.f.fail(readErrors) {
+		return 0, ErrInjected
+	}
+	return r.ReadCloser.Read(p)
+}
+
+type writer struct {
+	storage.BlobWriter
+	f *faults
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if !w.f.fail(shortWrites) {
+		return w.BlobWriter.Write(p)
+	}
+	n, err := w.BlobWriter.Write(p[:w.f.cut(len(p))])
+	if err == nil {
+		err = ErrInjected
+	}
+	return n, err
+}
@@ -0,0 +1,210 @@
+package faulty
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// FileSystem is a set of file system operations. It has the same methods as local.FS,
+// thus local.OSFS can be wrapped by NewFS, and FS can be passed to local.Options.
+type FileSystem interface {
+	Open(name string) (*os.File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (*os.File, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	TempFile(dir, pattern string) (*os.File, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	Link(oldname, newname string) error
+	Mkdir(name string, perm os.FileMode) error
+	Chmod(name string, mode os.FileMode) error
+	Sync(f *os.File) error
+	SyncDir(path string) error
+}
+
+// NewFS wraps the file system and injects failures into its operations:
+//
+//	ReadErrors   ReadFile fails with ErrInjected
+//	TornRenames  the file is renamed, but its content is lost, as if the system crashed right after the rename
+//	SyncDelay    each fsync is delayed
+//
+// The file system also tracks files that were written, but not yet flushed with Sync. Crash simulates
+// a system crash by truncating all such files, which is the worst case for file systems that don't
+// order data and metadata writes.
+func NewFS(fs FileSystem, conf Config) *FS {
+	f := &FS{fs: fs, dirty: make(map[string]struct{})}
+	f.init(conf)
+	return f
+}
+
+// FS is a file system wrapper that injects failures. See NewFS.
+type FS struct {
+	faults
+	fs FileSystem
+
+	mu    sync.Mutex
+	dirty map[string]struct{} // files that were not flushed to disk
+}
+
+var _ FileSystem = (*FS)(nil)
+
+func (f *FS) setDirty(name string, dirty bool) {
+	f.mu.Lock()
+	if dirty {
+		f.dirty[name] = struct{}{}
+	} else {
+		delete(f.dirty, name)
+	}
+	f.mu.Unlock()
+}
+
+// moveDirty moves the dirty state of the file to a new path. If link is set, the old path keeps the state.
+func (f *FS) moveDirty(oldpath, newpath string, link bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.dirty[oldpath]; !ok {
+		return
+	}
+	f.dirty[newpath] = struct{}{}
+	if !link {
+		delete(f.dirty, oldpath)
+	}
+}
+
+// Unsynced returns the number of files that will lose their content on Crash.
+func (f *FS) Unsynced() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.dirty)
+}
+
+// Crash simulates a system crash by truncating all files that were written, but not flushed to disk.
+// Files must be closed before the call. The file system can still be used afterwards, as if the system
+// was restarted.
+func (f *FS) Crash() error {
+	f.mu.Lock()
+	dirty := f.dirty
+	f.dirty = make(map[string]struct{})
+	f.mu.Unlock()
+	for name := range dirty {
+		if err := f.truncate(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncate removes the content of the file. Read-only files are truncated as well, since it's
+// what happens to blobs after a crash.
+func (f *FS) truncate(name string) error {
+	fi, err := f.fs.Lstat(name)
+	if err != nil {
+		return err
+	}
+	mode := fi.Mode().Perm()
+	if mode&0200 == 0 {
+		if err = f.fs.Chmod(name, mode|0200); err != nil {
+			return err
+		}
+		defer f.fs.Chmod(name, mode)
+	}
+	file, err := f.fs.OpenFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func (f *FS) Open(name string) (*os.File, error) {
+	return f.fs.Open(name)
+}
+
+func (f *FS) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	file, err := f.fs.OpenFile(name, flag, perm)
+	if err == nil && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		f.setDirty(name, true)
+	}
+	return file, err
+}
+
+func (f *FS) Stat(name string) (os.FileInfo, error) {
+	return f.fs.Stat(name)
+}
+
+func (f *FS) Lstat(name string) (os.FileInfo, error) {
+	return f.fs.Lstat(name)
+}
+
+func (f *FS) ReadFile(name string) ([]byte, error) {
+	if f.fail(readErrors) {
+		return nil, ErrInjected
+	}
+	return f.fs.ReadFile(name)
+}
+
+func (f *FS) TempFile(dir, pattern string) (*os.File, error) {
+	file, err := f.fs.TempFile(dir, pattern)
+	if err == nil {
+		f.setDirty(file.Name(), true)
+	}
+	return file, err
+}
+
+func (f *FS) Rename(oldpath, newpath string) error {
+	if err := f.fs.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	f.moveDirty(oldpath, newpath, false)
+	if !f.fail(tornRenames) {
+		return nil
+	}
+	f.setDirty(newpath, false)
+	if err := f.truncate(newpath); err != nil {
+		return err
+	}
+	return ErrInjected
+}
+
+func (f *FS) Remove(name string) error {
+	err := f.fs.Remove(name)
+	if err == nil {
+		f.setDirty(name, false)
+	}
+	return err
+}
+
+func (f *FS) Link(oldname, newname string) error {
+	err := f.fs.Link(oldname, newname)
+	if err == nil {
+		f.moveDirty(oldname, newname, true)
+	}
+	return err
+}
+
+func (f *FS) Mkdir(name string, perm os.FileMode) error {
+	return f.fs.Mkdir(name, perm)
+}
+
+func (f *FS) Chmod(name string, mode os.FileMode) error {
+	return f.fs.Chmod(name, mode)
+}
+
+func (f *FS) Sync(file *os.File) error {
+	if d := f.Config().SyncDelay; d > 0 {
+		time.Sleep(d)
+	}
+	if err := f.fs.Sync(file); err != nil {
+		return err
+	}
+	f.setDirty(file.Name(), false)
+	return nil
+}
+
+func (f *FS) SyncDir(path string) error {
+	if d := f.Config().SyncDelay; d > 0 {
+		time.Sleep(d)
+	}
+	return f.fs.SyncDir(path)
+}
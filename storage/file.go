@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"io"
+	"os"
+)
+
+// Filer is an optional interface for blob readers that are backed by a local file. It allows servers to send
+// blobs with zero-copy system calls, like sendfile, instead of copying the content in user space.
+type Filer interface {
+	// File returns the file with the content of the blob, or nil if the reader is not backed by a file.
+	// The file is positioned at the same offset as the reader, and it's owned by the reader,
+	// thus it must not be closed by the caller.
+	File() *os.File
+}
+
+// BlobFile returns the local file that backs the blob reader. Files are returned as-is, and other readers
+// are checked for the Filer interface. Reading the file directly bypasses the reader, see Filer for details.
+func BlobFile(r io.Reader) (*os.File, bool) {
+	switch r := r.(type) {
+	case *os.File:
+		return r, true
+	case Filer:
+		f := r.File()
+		return f, f != nil
+	}
+	return nil, false
+}
@@ -2,14 +2,18 @@ package gcs
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	gcs "cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 
@@ -18,7 +22,10 @@ import (
 )
 
 var (
-	_ storage.Storage = (*Storage)(nil)
+	_ storage.Storage    = (*Storage)(nil)
+	_ storage.BlobSigner = (*Storage)(nil)
+
+	_ storage.BlobRangeFetcher = (*Storage)(nil)
 )
 
 const (
@@ -36,6 +43,9 @@ func init() {
 
 type Config struct {
 	Bucket string `json:"bucket"`
+	// SignerKeyFile is a path to the JSON key of the service account used to sign blob URLs.
+	// If not set, signed URLs are not supported.
+	SignerKeyFile string `json:"signer_key_file,omitempty"`
 }
 
 func (c *Config) References() []types.Ref {
@@ -47,6 +57,16 @@ func (c *Config) OpenStorage(ctx context.Context) (storage.Storage, error) {
 	if err != nil {
 		return nil, err
 	}
+	if c.SignerKeyFile != "" {
+		data, err := ioutil.ReadFile(c.SignerKeyFile)
+		if err == nil {
+			err = cli.SetSignerKey(data)
+		}
+		if err != nil {
+			cli.Close()
+			return nil, err
+		}
+	}
 	return cli, nil
 }
 
@@ -56,12 +76,47 @@ func New(ctx context.Context, bucket string, opts ...option.ClientOption) (*Stor
 		return nil, err
 	}
 	b := cli.Bucket(bucket)
-	return &Storage{cli: cli, b: b}, nil
+	return &Storage{cli: cli, b: b, bucket: bucket}, nil
 }
 
 type Storage struct {
-	cli *gcs.Client
-	b   *gcs.BucketHandle
+	cli    *gcs.Client
+	b      *gcs.BucketHandle
+	bucket string
+
+	signer *signerKey
+}
+
+type signerKey struct {
+	Email string `json:"client_email"`
+	Key   string `json:"private_key"`
+}
+
+// SetSignerKey sets the JSON key of the service account used to sign blob URLs.
+func (s *Storage) SetSignerKey(data []byte) error {
+	var key signerKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return err
+	} else if key.Email == "" || key.Key == "" {
+		return fmt.Errorf("gcs: service account key must contain an email and a private key")
+	}
+	s.signer = &key
+	return nil
+}
+
+// SignBlobURL implements storage.BlobSigner.
+func (s *Storage) SignBlobURL(ctx context.Context, ref types.Ref, ttl time.Duration) (string, error) {
+	if ref.Zero() {
+		return "", storage.ErrInvalidRef
+	} else if s.signer == nil {
+		return "", storage.ErrNotSupported
+	}
+	return gcs.SignedURL(s.bucket, dirBlobs+ref.String(), &gcs.SignedURLOptions{
+		GoogleAccessID: s.signer.Email,
+		PrivateKey:     []byte(s.signer.Key),
+		Method:         "GET",
+		Expires:        time.Now().Add(ttl),
+	})
 }
 
 func (s *Storage) Close() error {
@@ -102,6 +157,31 @@ func (s *Storage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser,
 	return r, uint64(r.Attrs.Size), nil
 }
 
+// FetchBlobRange implements storage.BlobRangeFetcher.
+func (s *Storage) FetchBlobRange(ctx context.Context, ref types.Ref, off, length uint64) (io.ReadCloser, uint64, error) {
+	if ref.Zero() {
+		return nil, 0, storage.ErrInvalidRef
+	}
+	n := int64(length)
+	if length == 0 {
+		n = -1
+	}
+	r, err := s.blobObject(ref).NewRangeReader(ctx, int64(off), n)
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusRequestedRangeNotSatisfiable {
+		// the range starts past the end of the blob
+		sz, err := s.StatBlob(ctx, ref)
+		if err != nil {
+			return nil, 0, err
+		}
+		return ioutil.NopCloser(strings.NewReader("")), sz, nil
+	} else if err == gcs.ErrObjectNotExist {
+		return nil, 0, storage.ErrNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	return r, uint64(r.Attrs.Size), nil
+}
+
 func (s *Storage) iterate(ctx context.Context, pref string) objectsIterator {
 	it := s.b.Objects(ctx, &gcs.Query{Delimiter: "/", Prefix: pref})
 	return objectsIterator{
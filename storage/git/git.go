@@ -0,0 +1,373 @@
+// Package gitstor exposes an object database of an existing git repository as a read-only CAS storage.
+//
+// Git addresses objects by the SHA-1 hash of the object header and the content, while CAS uses
+// the hash of the content only. The storage maintains an equivalence index that maps CAS refs
+// of git blobs to git object IDs, thus files already stored in git can be referenced by CAS
+// without duplicating the data.
+package gitstor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+var (
+	_ storage.BlobSource = (*Storage)(nil)
+)
+
+const (
+	// indexFile is the path of the equivalence index, relative to the git directory.
+	indexFile = "cas/index"
+)
+
+func init() {
+	storage.RegisterConfig("git:RepoConfig", &Config{})
+}
+
+type Config struct {
+	// Dir is the path of the git repository (either the work tree or the git directory).
+	Dir string `json:"dir"`
+}
+
+func (c *Config) References() []types.Ref {
+	return nil
+}
+
+// OpenStorage opens the repository as a read-only storage without pins.
+func (c *Config) OpenStorage(ctx context.Context) (storage.Storage, error) {
+	s, err := New(ctx, c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return storage.Combine(s, nil), nil
+}
+
+// New opens a git repository in a given directory and updates the equivalence index
+// for git blobs that were not indexed yet.
+func New(ctx context.Context, dir string) (*Storage, error) {
+	out, err := gitOutput(ctx, dir, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return nil, err
+	}
+	s := &Storage{
+		dir:    dir,
+		gitDir: strings.TrimSpace(string(out)),
+		byRef:  make(map[types.Ref]object),
+		byID:   make(map[string]types.Ref),
+	}
+	if err = s.loadIndex(); err != nil {
+		return nil, err
+	}
+	if err = s.Reindex(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// object describes a git blob in the equivalence index.
+type object struct {
+	id   string // git object ID
+	size uint64
+}
+
+// Storage is a read-only CAS storage that serves blobs from a git repository.
+// Only git blobs (file contents) are exposed. Storage has no pins, see Config.OpenStorage.
+type Storage struct {
+	dir    string
+	gitDir string
+
+	mu    sync.RWMutex
+	byRef map[types.Ref]object
+	byID  map[string]types.Ref
+}
+
+func (s *Storage) Close() error {
+	return nil
+}
+
+func gitOutput(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	buf := new(bytes.Buffer)
+	cmd.Stderr = buf
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(buf.String()); msg != "" {
+			return nil, fmt.Errorf("git: %v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("git: %v", err)
+	}
+	return out, nil
+}
+
+func (s *Storage) indexPath() string {
+	return filepath.Join(s.gitDir, filepath.FromSlash(indexFile))
+}
+
+// loadIndex reads the equivalence index from the git directory.
+func (s *Storage) loadIndex() error {
+	f, err := os.Open(s.indexPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			continue
+		}
+		// sha256:<hex> <git id> <size>
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return fmt.Errorf("invalid git index entry: %q", line)
+		}
+		ref, err := types.ParseRef(fields[0])
+		if err != nil {
+			return err
+		}
+		size, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		s.byRef[ref] = object{id: fields[1], size: size}
+		s.byID[fields[1]] = ref
+	}
+	return sc.Err()
+}
+
+// Reindex adds all git blobs that are not yet in the equivalence index.
+// It's called automatically when the storage is opened.
+func (s *Storage) Reindex(ctx context.Context) error {
+	out, err := gitOutput(ctx, s.dir, "cat-file", "--batch-all-objects", "--batch-check=%(objectname) %(objecttype)")
+	if err != nil {
+		return err
+	}
+	var ids []string
+	s.mu.RLock()
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[1] != "blob" {
+			continue
+		}
+		if _, ok := s.byID[fields[0]]; !ok {
+			ids = append(ids, fields[0])
+		}
+	}
+	s.mu.RUnlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	if err = os.MkdirAll(filepath.Dir(s.indexPath()), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.indexPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	err = s.hashObjects(ctx, ids, func(id string, sr types.SizedRef) error {
+		s.mu.Lock()
+		s.byRef[sr.Ref] = object{id: id, size: sr.Size}
+		s.byID[id] = sr.Ref
+		s.mu.Unlock()
+		_, err := fmt.Fprintf(w, "%s %s %d\n", sr.Ref, id, sr.Size)
+		return err
+	})
+	if err2 := w.Flush(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// hashObjects reads git objects with a single git process and computes CAS refs of their content.
+func (s *Storage) hashObjects(ctx context.Context, ids []string, fnc func(id string, sr types.SizedRef) error) error {
+	cmd := exec.CommandContext(ctx, "git", "-C", s.dir, "cat-file", "--batch")
+	cmd.Stdin = strings.NewReader(strings.Join(ids, "\n") + "\n")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	err = func() error {
+		r := bufio.NewReader(stdout)
+		for _, id := range ids {
+			// <id> <type> <size>\n<content>\n
+			hdr, err := r.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			fields := strings.Fields(hdr)
+			if len(fields) == 2 && fields[1] == "missing" {
+				continue
+			} else if len(fields) != 3 || fields[0] != id {
+				return fmt.Errorf("git: unexpected object header: %q", hdr)
+			}
+			size, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return err
+			}
+			sr, err := types.Hash(io.LimitReader(r, size))
+			if err != nil {
+				return err
+			} else if sr.Size != uint64(size) {
+				return io.ErrUnexpectedEOF
+			}
+			if _, err = r.Discard(1); err != nil {
+				return err
+			}
+			if err = fnc(id, sr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return cmd.Wait()
+}
+
+// GitID returns the git object ID for a given CAS ref.
+func (s *Storage) GitID(ref types.Ref) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o, ok := s.byRef[ref]
+	return o.id, ok
+}
+
+// RefOf returns the CAS ref for a given git blob ID.
+func (s *Storage) RefOf(id string) (types.Ref, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ref, ok := s.byID[id]
+	return ref, ok
+}
+
+func (s *Storage) lookup(ref types.Ref) (object, error) {
+	if ref.Zero() {
+		return object{}, storage.ErrInvalidRef
+	}
+	s.mu.RLock()
+	o, ok := s.byRef[ref]
+	s.mu.RUnlock()
+	if !ok {
+		return object{}, storage.ErrNotFound
+	}
+	return o, nil
+}
+
+func (s *Storage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	o, err := s.lookup(ref)
+	if err != nil {
+		return 0, err
+	}
+	return o.size, nil
+}
+
+func (s *Storage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	o, err := s.lookup(ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	cmd := exec.CommandContext(ctx, "git", "-C", s.dir, "cat-file", "blob", o.id)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, 0, err
+	}
+	// objects might be removed by git gc, so verify the content
+	rc := storage.VerifyReader(&cmdReader{cmd: cmd, r: stdout}, ref)
+	return rc, o.size, nil
+}
+
+// cmdReader reads the output of the command and waits for it to exit on Close.
+type cmdReader struct {
+	cmd *exec.Cmd
+	r   io.ReadCloser
+	err error
+}
+
+func (r *cmdReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		if r.err = r.cmd.Wait(); r.err != nil {
+			return n, fmt.Errorf("git: %v", r.err)
+		}
+		r.cmd = nil
+	}
+	return n, err
+}
+
+func (r *cmdReader) Close() error {
+	if r.cmd == nil {
+		return nil
+	}
+	r.r.Close()
+	r.cmd.Process.Kill()
+	r.cmd.Wait()
+	r.cmd = nil
+	return nil
+}
+
+func (s *Storage) IterateBlobs(ctx context.Context) storage.Iterator {
+	s.mu.RLock()
+	refs := make([]types.SizedRef, 0, len(s.byRef))
+	for ref, o := range s.byRef {
+		refs = append(refs, types.SizedRef{Ref: ref, Size: o.size})
+	}
+	s.mu.RUnlock()
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Ref.String() < refs[j].Ref.String()
+	})
+	return &blobIterator{refs: refs}
+}
+
+type blobIterator struct {
+	refs []types.SizedRef
+	cur  types.SizedRef
+}
+
+func (it *blobIterator) Next() bool {
+	if len(it.refs) == 0 {
+		return false
+	}
+	it.cur = it.refs[0]
+	it.refs = it.refs[1:]
+	return true
+}
+
+func (it *blobIterator) Err() error {
+	return nil
+}
+
+func (it *blobIterator) Close() error {
+	it.refs = nil
+	return nil
+}
+
+func (it *blobIterator) SizedRef() types.SizedRef {
+	return it.cur
+}
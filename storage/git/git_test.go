@@ -0,0 +1,94 @@
+package gitstor
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+func hashObject(t testing.TB, dir string, data []byte) string {
+	cmd := exec.Command("git", "-C", dir, "hash-object", "-w", "--stdin")
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	require.NoError(t, err)
+	return strings.TrimSpace(string(out))
+}
+
+func TestGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "cas_git_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	out, err := exec.Command("git", "init", "-q", dir).CombinedOutput()
+	require.NoError(t, err, "%s", out)
+
+	data1 := []byte("useful data")
+	id1 := hashObject(t, dir, data1)
+
+	ctx := context.Background()
+	s, err := New(ctx, dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	ref1 := types.BytesRef(data1)
+	ref, ok := s.RefOf(id1)
+	require.True(t, ok)
+	require.Equal(t, ref1, ref)
+	id, ok := s.GitID(ref1)
+	require.True(t, ok)
+	require.Equal(t, id1, id)
+
+	sz, err := s.StatBlob(ctx, ref1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data1)), sz)
+
+	rc, sz, err := s.FetchBlob(ctx, ref1)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data1)), sz)
+	require.Equal(t, data1, got)
+
+	_, err = s.StatBlob(ctx, types.StringRef("missing"))
+	require.Equal(t, storage.ErrNotFound, err)
+
+	_, err = storage.Combine(s, nil).BeginBlob(ctx)
+	require.Equal(t, storage.ErrReadOnly, err)
+
+	// new objects are indexed on reopen, existing ones are read from the index
+	data2 := []byte("more data")
+	id2 := hashObject(t, dir, data2)
+
+	s, err = New(ctx, dir)
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, ok = s.RefOf(id2)
+	require.True(t, ok)
+
+	var refs []types.SizedRef
+	it := s.IterateBlobs(ctx)
+	for it.Next() {
+		refs = append(refs, it.SizedRef())
+	}
+	require.NoError(t, it.Err())
+	it.Close()
+	require.Len(t, refs, 2)
+
+	index, err := ioutil.ReadFile(s.indexPath())
+	require.NoError(t, err)
+	require.Equal(t, 2, bytes.Count(index, []byte("\n")))
+}
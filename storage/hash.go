@@ -1,15 +1,56 @@
 package storage
 
 import (
+	"encoding"
+	"encoding/binary"
+	"errors"
 	"hash"
 
 	"github.com/dennwc/cas/types"
 )
 
+// Hash returns a BlobWriter that only calculates the ref and the size of the content.
 func Hash() BlobWriter {
 	return &hashWriter{h: types.NewRef().Hash()}
 }
 
+// HashState returns the state of a writer created with Hash. The writer can be restored with ResumeHash.
+func HashState(w BlobWriter) ([]byte, error) {
+	hw, ok := w.(*hashWriter)
+	if !ok {
+		return nil, ErrNotSupported
+	} else if hw.h == nil {
+		return nil, ErrBlobCompleted
+	}
+	m, ok := hw.h.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	state, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 8, 8+len(state))
+	binary.BigEndian.PutUint64(buf, hw.size)
+	return append(buf, state...), nil
+}
+
+// ResumeHash restores a writer from the state returned by HashState.
+func ResumeHash(state []byte) (BlobWriter, error) {
+	if len(state) < 8 {
+		return nil, errors.New("invalid hash state")
+	}
+	h := types.NewRef().Hash()
+	u, ok := h.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if err := u.UnmarshalBinary(state[8:]); err != nil {
+		return nil, err
+	}
+	return &hashWriter{h: h, size: binary.BigEndian.Uint64(state)}, nil
+}
+
 type hashWriter struct {
 	h    hash.Hash
 	size uint64
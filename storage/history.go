@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dennwc/cas/types"
+)
+
+// RollbackPin restores the value a named pin had n changes ago and returns it. For example, n = 1 undoes the last
+// change. The rollback is recorded in the history as well, thus it can be undone the same way.
+// If the value was a deleted pin, the pin is deleted and a zero ref is returned.
+//
+// The pin is updated with SetPinCAS if the storage implements PinSwapper, thus it fails with ErrPinConflict
+// if the pin is changed concurrently. Storages that return ErrNotSupported from SetPinCAS are updated with SetPin.
+// It returns ErrNotSupported if the storage doesn't implement PinHistorian.
+func RollbackPin(ctx context.Context, s PinStorage, name string, n int) (types.Ref, error) {
+	ph, ok := s.(PinHistorian)
+	if !ok {
+		return types.Ref{}, ErrNotSupported
+	}
+	hist, err := ph.PinHistory(ctx, name)
+	if err != nil {
+		return types.Ref{}, err
+	}
+	if n < 1 || n >= len(hist) {
+		return types.Ref{}, fmt.Errorf("pin %q has %d previous values, cannot roll back %d changes", name, len(hist)-1, n)
+	}
+	cur, ref := hist[len(hist)-1].Ref, hist[len(hist)-1-n].Ref
+	if cur == ref {
+		return ref, nil
+	}
+	err = ErrNotSupported
+	if ps, ok := s.(PinSwapper); ok {
+		err = ps.SetPinCAS(ctx, name, cur, ref)
+	}
+	if err == ErrNotSupported {
+		if ref.Zero() {
+			err = s.DeletePin(ctx, name)
+		} else {
+			err = s.SetPin(ctx, name, ref)
+		}
+	}
+	if err != nil {
+		return types.Ref{}, err
+	}
+	return ref, nil
+}
@@ -0,0 +1,364 @@
+package httpstor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// Bulk fetch protocol.
+//
+// Client sends a POST request to the blobs endpoint with a list of refs, one per line.
+// Server responds with a stream of frames, one for each existing blob, in the same order:
+//
+//	<ref> <size>\n<content>
+//
+// Missing blobs are skipped. The stream is terminated with a line containing a single dot,
+// or with an error line that starts with '!'. Thus, a truncated response is always detected.
+//
+// Bulk stat protocol uses the same request, sent to the stat endpoint. Server responds with a line for each existing
+// blob, in the same order, terminated the same way:
+//
+//	<ref> <size>\n
+const (
+	ctBulkRefs  = "text/plain"
+	ctBulkBlobs = "application/x-cas-blobs"
+	ctBulkSizes = "application/x-cas-sizes"
+
+	// maxBulkRefs is the maximal number of refs in a single bulk request.
+	maxBulkRefs = 10000
+	// maxBulkLine is the maximal size of a single line in the bulk request or a frame header.
+	maxBulkLine = 1024
+)
+
+var errBulkTruncated = errors.New("bulk fetch: response is truncated")
+
+// readBulkRefs reads the list of refs from the bulk request. It writes an error response and returns false
+// if the request is invalid.
+func readBulkRefs(w http.ResponseWriter, r *http.Request) ([]types.Ref, bool) {
+	var refs []types.Ref
+	sc := bufio.NewScanner(io.LimitReader(r.Body, maxBulkRefs*maxBulkLine))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		ref, err := types.ParseRef(line)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return nil, false
+		}
+		refs = append(refs, ref)
+		if len(refs) > maxBulkRefs {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprintf(w, "too many refs: at most %d allowed", maxBulkRefs)
+			return nil, false
+		}
+	}
+	if err := sc.Err(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return nil, false
+	}
+	return refs, true
+}
+
+// serveBulk streams multiple blobs in a single response.
+func (s *server) serveBulk(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	refs, ok := readBulkRefs(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	mr, err := storage.FetchBlobs(ctx, s.s, refs)
+	if err == storage.ErrInvalidRef {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer mr.Close()
+
+	w.Header().Set("Content-Type", ctBulkBlobs)
+	var out io.Writer = w
+	if enc := pickEncoding(r.Header); s.opts.Compression && enc != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		w.Header().Set("Content-Encoding", enc)
+		zw := newEncoder(w, enc)
+		defer zw.Close()
+		out = zw
+	}
+	bw := bufio.NewWriter(out)
+	defer bw.Flush()
+	for mr.Next() {
+		sr := mr.SizedRef()
+		fmt.Fprintf(bw, "%s %d\n", sr.Ref, sr.Size)
+		n, err := io.Copy(bw, mr)
+		if err == nil && uint64(n) != sr.Size {
+			err = storage.ErrSizeMissmatch{Exp: sr.Size, Got: uint64(n)}
+		}
+		if err != nil {
+			// status code was already sent; report the error in the stream
+			log.Println("http: bulk fetch:", err)
+			fmt.Fprintf(bw, "!%s\n", strings.Replace(err.Error(), "\n", " ", -1))
+			return
+		}
+	}
+	if err := mr.Err(); err != nil {
+		log.Println("http: bulk fetch:", err)
+		fmt.Fprintf(bw, "!%s\n", strings.Replace(err.Error(), "\n", " ", -1))
+		return
+	}
+	bw.WriteString(".\n")
+}
+
+// serveStat returns sizes of multiple blobs in a single response.
+func (s *server) serveStat(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	refs, ok := readBulkRefs(w, r)
+	if !ok {
+		return
+	}
+	srs, err := storage.StatBlobs(r.Context(), s.s, refs)
+	if err == storage.ErrInvalidRef {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", ctBulkSizes)
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	for _, sr := range srs {
+		fmt.Fprintf(bw, "%s %d\n", sr.Ref, sr.Size)
+	}
+	bw.WriteString(".\n")
+}
+
+var _ storage.BulkFetcher = (*Client)(nil)
+
+// FetchBlobs fetches multiple blobs in a single request. If the server doesn't support bulk fetches,
+// blobs are fetched one by one.
+func (c *Client) FetchBlobs(ctx context.Context, refs []types.Ref) (storage.MultiReader, error) {
+	buf := new(bytes.Buffer)
+	for _, ref := range refs {
+		if ref.Zero() {
+			return nil, storage.ErrInvalidRef
+		}
+		buf.WriteString(ref.String())
+		buf.WriteByte('\n')
+	}
+	req, err := http.NewRequest("POST", c.blobsURL(), buf)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", ctBulkRefs)
+	if c.compress {
+		// setting it explicitly disables transparent decompression in the transport
+		req.Header.Set("Accept-Encoding", encodingsList)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusMethodNotAllowed, http.StatusNotFound:
+		// older server
+		resp.Body.Close()
+		return storage.FetchBlobs(ctx, noBulk{c}, refs)
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code on bulk fetch: %v", resp.Status)
+	}
+	body := resp.Body
+	switch enc := resp.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+	case encGzip, encZstd:
+		body, err = newDecodedBody(body, enc)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		body.Close()
+		return nil, fmt.Errorf("unsupported content encoding: %q", enc)
+	}
+	return &bulkReader{body: body, r: bufio.NewReader(body)}, nil
+}
+
+// noBulk hides the BulkFetcher implementation of the client.
+type noBulk struct {
+	storage.BlobSource
+}
+
+// bulkReader decodes the bulk fetch response.
+type bulkReader struct {
+	body io.Closer
+	r    *bufio.Reader
+	cur  types.SizedRef
+	left uint64
+	err  error
+	done bool
+}
+
+var _ storage.BulkStater = (*Client)(nil)
+
+// StatBlobs returns sizes of multiple blobs in a single request. If the server doesn't support bulk stats,
+// blobs are checked one by one.
+func (c *Client) StatBlobs(ctx context.Context, refs []types.Ref) ([]types.SizedRef, error) {
+	if len(refs) > maxBulkRefs {
+		// split large requests, so they are not rejected by the server
+		out, err := c.StatBlobs(ctx, refs[:maxBulkRefs])
+		if err != nil {
+			return nil, err
+		}
+		rest, err := c.StatBlobs(ctx, refs[maxBulkRefs:])
+		if err != nil {
+			return nil, err
+		}
+		return append(out, rest...), nil
+	}
+	buf := new(bytes.Buffer)
+	for _, ref := range refs {
+		if ref.Zero() {
+			return nil, storage.ErrInvalidRef
+		}
+		buf.WriteString(ref.String())
+		buf.WriteByte('\n')
+	}
+	req, err := http.NewRequest("POST", c.base+"/stat/", buf)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", ctBulkRefs)
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusMethodNotAllowed, http.StatusNotFound, http.StatusForbidden:
+		// older server
+		return storage.StatBlobs(ctx, noBulk{c}, refs)
+	default:
+		return nil, fmt.Errorf("unexpected status code on bulk stat: %v", resp.Status)
+	}
+	out := make([]types.SizedRef, 0, len(refs))
+	br := &bulkReader{body: resp.Body, r: bufio.NewReader(resp.Body)}
+	for br.Next() {
+		out = append(out, br.cur)
+		br.left = 0 // no content follows the header
+	}
+	if err = br.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *bulkReader) Next() bool {
+	if r.err != nil || r.done {
+		return false
+	}
+	if r.left != 0 {
+		// skip the rest of the current blob
+		if _, err := io.CopyN(ioutil.Discard, r.r, int64(r.left)); err != nil {
+			r.setErr(err)
+			return false
+		}
+		r.left = 0
+	}
+	r.cur = types.SizedRef{}
+	line, err := r.r.ReadString('\n')
+	if err != nil {
+		r.setErr(err)
+		return false
+	} else if len(line) > maxBulkLine {
+		r.err = errors.New("bulk fetch: frame header is too long")
+		return false
+	}
+	line = strings.TrimSuffix(line, "\n")
+	switch {
+	case line == ".":
+		r.done = true
+		return false
+	case strings.HasPrefix(line, "!"):
+		r.err = fmt.Errorf("bulk fetch: %s", line[1:])
+		return false
+	}
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		r.err = fmt.Errorf("bulk fetch: invalid frame header: %q", line)
+		return false
+	}
+	ref, err := types.ParseRef(line[:i])
+	if err != nil {
+		r.err = err
+		return false
+	}
+	size, err := strconv.ParseUint(line[i+1:], 10, 64)
+	if err != nil {
+		r.err = err
+		return false
+	}
+	r.cur = types.SizedRef{Ref: ref, Size: size}
+	r.left = size
+	return true
+}
+
+func (r *bulkReader) setErr(err error) {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errBulkTruncated
+	}
+	r.err = err
+}
+
+func (r *bulkReader) SizedRef() types.SizedRef {
+	return r.cur
+}
+
+func (r *bulkReader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.r.Read(p)
+	r.left -= uint64(n)
+	if err == io.EOF {
+		err = errBulkTruncated
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *bulkReader) Err() error {
+	return r.err
+}
+
+func (r *bulkReader) Close() error {
+	r.done = true
+	return r.body.Close()
+}
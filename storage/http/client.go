@@ -3,18 +3,25 @@ package httpstor
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
+	"github.com/dennwc/cas/sched"
 	"github.com/dennwc/cas/storage"
 	"github.com/dennwc/cas/types"
 )
 
 var (
-	_ storage.Storage = (*Client)(nil)
+	_ storage.Storage        = (*Client)(nil)
+	_ storage.PrefixIterator = (*Client)(nil)
 )
 
 func init() {
@@ -23,6 +30,14 @@ func init() {
 
 type Config struct {
 	URL string `json:"url"`
+	// Compression enables transfer compression, if the server supports it.
+	Compression bool `json:"compression,omitempty"`
+	// Connections is the number of concurrent connections used to download large blobs.
+	Connections int `json:"connections,omitempty"`
+	// PartSize is the size of a single ranged request for parallel downloads.
+	PartSize uint64 `json:"part_size,omitempty"`
+
+	storage.ConnConfig
 }
 
 func (c *Config) References() []types.Ref {
@@ -34,7 +49,11 @@ func (c *Config) OpenStorage(ctx context.Context) (storage.Storage, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(c.URL), nil
+	cli := NewClient(c.URL)
+	cli.SetHTTPClient(c.HTTPClient())
+	cli.SetCompression(c.Compression)
+	cli.SetParallel(c.Connections, c.PartSize)
+	return cli, nil
 }
 
 // NewClient creates a CAS HTTP client with a given base address.
@@ -49,10 +68,22 @@ func NewClient(addr string) *Client {
 	}
 }
 
+const (
+	packYes = 1
+	packNo  = 2
+)
+
 // Client is a HTTP client for CAS.
 type Client struct {
 	cli  *http.Client
 	base string
+
+	compress bool
+	putEnc   atomic.Value // the preferred encoding that server accepts for uploads
+	pack     int32        // packYes or packNo if server support of tree packs is known
+
+	conns    int
+	partSize uint64
 }
 
 func (c *Client) Close() error { return nil }
@@ -62,6 +93,44 @@ func (c *Client) SetHTTPClient(cli *http.Client) {
 	c.cli = cli
 }
 
+// SetCompression enables or disables transfer compression. Compression is negotiated with the server
+// for each request, and is skipped for content that is already compressed. Zstd is preferred over gzip.
+func (c *Client) SetCompression(on bool) {
+	c.compress = on
+}
+
+// do sends the request. Priority of the operation is taken from the request context.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if p := sched.PriorityFrom(req.Context()); p != sched.Normal {
+		req.Header.Set(hdrPriority, p.String())
+	}
+	return c.cli.Do(req)
+}
+
+// checkEncodings records encodings that server accepts for uploads.
+func (c *Client) checkEncodings(resp *http.Response) {
+	if enc := pickEncoding(resp.Header); enc != "" {
+		c.putEnc.Store(enc)
+	}
+}
+
+// respSize returns the size of the blob described by the response.
+func respSize(resp *http.Response) (uint64, error) {
+	if v := resp.Header.Get(hdrSize); v != "" {
+		return strconv.ParseUint(v, 10, 64)
+	}
+	// server may redirect us to the backend; the size is still set in the redirect response
+	if req := resp.Request; req != nil && req.Response != nil {
+		if v := req.Response.Header.Get(hdrSize); v != "" {
+			return strconv.ParseUint(v, 10, 64)
+		}
+	}
+	if resp.ContentLength < 0 {
+		return 0, errors.New("unknown blob size")
+	}
+	return uint64(resp.ContentLength), nil
+}
+
 func (c *Client) blobsURL() string {
 	return c.base + "/blobs/"
 }
@@ -71,7 +140,7 @@ func (c *Client) blobURL(ref types.Ref) string {
 }
 
 func (c *Client) pinsURL() string {
-	return c.blobsURL() + "/pins/"
+	return c.base + "/pins/"
 }
 
 func (c *Client) pinURL(name string) string {
@@ -88,7 +157,7 @@ func (c *Client) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
 	}
 	req = req.WithContext(ctx)
 
-	resp, err := c.cli.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return 0, err
 	}
@@ -96,7 +165,8 @@ func (c *Client) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
 
 	switch resp.StatusCode {
 	case http.StatusOK:
-		return uint64(resp.ContentLength), nil
+		c.checkEncodings(resp)
+		return respSize(resp)
 	case http.StatusNotFound:
 		return 0, storage.ErrNotFound
 	default:
@@ -113,15 +183,43 @@ func (c *Client) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, u
 		return nil, 0, err
 	}
 	req = req.WithContext(ctx)
+	if c.parallel() {
+		// ask for the first part only; the rest is fetched concurrently, if server supports ranges
+		req.Header.Set("Range", storage.HTTPRange(0, c.partSize))
+	}
+	if c.compress {
+		// setting it explicitly disables transparent decompression in the transport
+		req.Header.Set("Accept-Encoding", encodingsList)
+	}
 
-	resp, err := c.cli.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, 0, err
 	}
 
 	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return c.fetchParallel(ctx, ref, resp)
 	case http.StatusOK:
-		return resp.Body, uint64(resp.ContentLength), nil
+		c.checkEncodings(resp)
+		sz, err := respSize(resp)
+		if err != nil {
+			resp.Body.Close()
+			return nil, 0, err
+		}
+		switch enc := resp.Header.Get("Content-Encoding"); enc {
+		case "", "identity":
+			return resp.Body, sz, nil
+		case encGzip, encZstd:
+			body, err := newDecodedBody(resp.Body, enc)
+			if err != nil {
+				return nil, 0, err
+			}
+			return body, sz, nil
+		default:
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("unsupported content encoding: %q", enc)
+		}
 	case http.StatusNotFound:
 		resp.Body.Close()
 		return nil, 0, storage.ErrNotFound
@@ -131,8 +229,89 @@ func (c *Client) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, u
 	}
 }
 
+// BeginBlob starts a new blob upload. The content is only sent on Commit, since the server expects the ref
+// of the blob to be known before the upload starts.
 func (c *Client) BeginBlob(ctx context.Context) (storage.BlobWriter, error) {
-	return nil, storage.ErrReadOnly // TODO
+	return storage.Spool("cas_upload_", nil, func(sr types.SizedRef, f *os.File) error {
+		return c.putBlob(ctx, sr, f)
+	})
+}
+
+// putBlob uploads the blob content with a known ref and size.
+func (c *Client) putBlob(ctx context.Context, sr types.SizedRef, r io.Reader) error {
+	size := int64(sr.Size)
+	enc := ""
+	if penc, _ := c.putEnc.Load().(string); c.compress && sr.Size >= minCompressSize && penc != "" {
+		var compress bool
+		r, compress = sniffReader(r)
+		if compress {
+			zr := compressPipe(r, penc)
+			defer zr.Close()
+			r, size, enc = zr, -1, penc
+		}
+	}
+	req, err := http.NewRequest("PUT", c.blobURL(sr.Ref), r)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+	req.Header.Set(hdrSize, strconv.FormatUint(sr.Size, 10))
+	if enc != "" {
+		req.Header.Set("Content-Encoding", enc)
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return nil
+	case http.StatusConflict:
+		return mismatchError(resp)
+	case http.StatusMethodNotAllowed:
+		return storage.ErrReadOnly
+	case http.StatusInsufficientStorage:
+		return storage.ErrStoreFull
+	case http.StatusForbidden:
+		if resp.Header.Get(hdrError) == errPolicy {
+			reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+			return storage.ErrPolicy{Ref: sr.Ref, Reason: string(reason)}
+		}
+		return fmt.Errorf("unexpected status code on put: %v", resp.Status)
+	default:
+		return fmt.Errorf("unexpected status code on put: %v", resp.Status)
+	}
+}
+
+// mismatchError decodes a typed mismatch error sent by the server.
+func mismatchError(resp *http.Response) error {
+	switch resp.Header.Get(hdrError) {
+	case errRefMiss:
+		exp, err := types.ParseRef(resp.Header.Get(hdrExpRef))
+		if err != nil {
+			return err
+		}
+		got, err := types.ParseRef(resp.Header.Get(hdrRef))
+		if err != nil {
+			return err
+		}
+		return storage.ErrRefMissmatch{Exp: exp, Got: got}
+	case errSizeMiss:
+		exp, err := strconv.ParseUint(resp.Header.Get(hdrExpSize), 10, 64)
+		if err != nil {
+			return err
+		}
+		got, err := strconv.ParseUint(resp.Header.Get(hdrSize), 10, 64)
+		if err != nil {
+			return err
+		}
+		return storage.ErrSizeMissmatch{Exp: exp, Got: got}
+	}
+	return fmt.Errorf("unexpected status code on put: %v", resp.Status)
 }
 
 func (c *Client) IterateBlobs(ctx context.Context) storage.Iterator {
@@ -145,6 +324,18 @@ func (c *Client) IterateBlobs(ctx context.Context) storage.Iterator {
 	return it
 }
 
+// IterateBlobsPrefix implements storage.PrefixIterator. The prefix is matched by the server.
+func (c *Client) IterateBlobsPrefix(ctx context.Context, prefix string) storage.Iterator {
+	it := &blobsIterator{
+		jsonIterator: jsonIterator{
+			c: c, ctx: ctx, url: c.blobsURL() + "?prefix=" + url.QueryEscape(prefix),
+		},
+	}
+	it.dst = &it.cur
+	// older servers ignore the prefix
+	return storage.FilterPrefix(it, prefix)
+}
+
 func (c *Client) SetPin(ctx context.Context, name string, ref types.Ref) error {
 	return storage.ErrReadOnly // TODO
 }
@@ -163,7 +354,7 @@ func (c *Client) GetPin(ctx context.Context, name string) (types.Ref, error) {
 	}
 	req = req.WithContext(ctx)
 
-	resp, err := c.cli.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return types.Ref{}, err
 	}
@@ -171,7 +362,7 @@ func (c *Client) GetPin(ctx context.Context, name string) (types.Ref, error) {
 
 	switch resp.StatusCode {
 	case http.StatusOK:
-		return types.ParseRef(resp.Header.Get("X-CAS-Ref"))
+		return types.ParseRef(resp.Header.Get(hdrRef))
 	case http.StatusNotFound:
 		return types.Ref{}, storage.ErrNotFound
 	default:
@@ -212,7 +403,7 @@ func (it *jsonIterator) Next() bool {
 		}
 		req = req.WithContext(it.ctx)
 
-		resp, err := it.c.cli.Do(req)
+		resp, err := it.c.do(req)
 		if err != nil {
 			it.err = err
 			return false
@@ -0,0 +1,175 @@
+package httpstor
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/dennwc/cas/zstd"
+)
+
+const (
+	encGzip = "gzip"
+	encZstd = "zstd"
+	// encodingsList lists supported transfer encodings for Accept-Encoding, in the order of preference.
+	encodingsList = encZstd + ", " + encGzip
+
+	// minCompressSize is the minimal size of the blob that will be compressed for transfer.
+	minCompressSize = 1024
+	// sniffSize is the size of the prefix used to detect already compressed content.
+	sniffSize = 512
+)
+
+// compressedMagic lists prefixes of well-known compressed formats.
+// There is no gain in compressing those for transfer.
+var compressedMagic = [][]byte{
+	[]byte("\x1f\x8b"),             // gzip
+	[]byte("\x28\xb5\x2f\xfd"),     // zstd
+	[]byte("\xfd7zXZ\x00"),         // xz
+	[]byte("BZh"),                  // bzip2
+	[]byte("\x04\x22\x4d\x18"),     // lz4
+	[]byte("PK\x03\x04"),           // zip, jar, docx, etc
+	[]byte("7z\xbc\xaf\x27\x1c"),   // 7z
+	[]byte("Rar!\x1a\x07"),         // rar
+	[]byte("\x89PNG\r\n\x1a\n"),    // png
+	[]byte("\xff\xd8\xff"),         // jpeg
+	[]byte("GIF8"),                 // gif
+	[]byte("OggS"),                 // ogg
+	[]byte("fLaC"),                 // flac
+	[]byte("ID3"),                  // mp3
+	[]byte("\x1a\x45\xdf\xa3"),     // mkv, webm
+	[]byte("%PDF"),                 // pdf; usually compressed inside
+	[]byte("\x00\x00\x00\x0cjP  "), // jpeg 2000
+}
+
+// isCompressed checks if the content prefix describes an already compressed format.
+func isCompressed(p []byte) bool {
+	for _, m := range compressedMagic {
+		if bytes.HasPrefix(p, m) {
+			return true
+		}
+	}
+	// RIFF containers: webp, avi, wav
+	if len(p) >= 12 && string(p[:4]) == "RIFF" {
+		switch string(p[8:12]) {
+		case "WEBP", "AVI ":
+			return true
+		}
+	}
+	// ISO base media: mp4, mov, heic
+	if len(p) >= 8 && string(p[4:8]) == "ftyp" {
+		return true
+	}
+	switch http.DetectContentType(p) {
+	case "application/x-gzip", "application/zip", "application/x-rar-compressed",
+		"application/wasm", "font/woff", "font/woff2":
+		return true
+	}
+	return false
+}
+
+// encodings lists supported transfer encodings in the order of preference.
+var encodings = []string{encZstd, encGzip}
+
+// pickEncoding returns the preferred supported encoding listed in the Accept-Encoding header,
+// or an empty string if there is none.
+func pickEncoding(h http.Header) string {
+	for _, enc := range encodings {
+		if acceptsEncoding(h, enc) {
+			return enc
+		}
+	}
+	return ""
+}
+
+// acceptsEncoding checks if the header lists a given content encoding.
+func acceptsEncoding(h http.Header, enc string) bool {
+	for _, v := range h["Accept-Encoding"] {
+		for _, e := range strings.Split(v, ",") {
+			e = strings.TrimSpace(e)
+			if i := strings.IndexByte(e, ';'); i >= 0 {
+				if strings.TrimSpace(e[i+1:]) == "q=0" {
+					continue
+				}
+				e = strings.TrimSpace(e[:i])
+			}
+			if e == enc {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sniffReader peeks the content prefix and reports if it's worth compressing.
+// It returns a new reader that should be used instead of r.
+func sniffReader(r io.Reader) (io.Reader, bool) {
+	br := bufio.NewReaderSize(r, sniffSize)
+	p, _ := br.Peek(sniffSize)
+	return br, !isCompressed(p)
+}
+
+// sniffFile is like sniffReader, but it reads the prefix of the file without changing its offset.
+func sniffFile(f *os.File) bool {
+	p := make([]byte, sniffSize)
+	n, _ := f.ReadAt(p, 0)
+	return !isCompressed(p[:n])
+}
+
+// newEncoder returns a writer that compresses the content with a given encoding.
+func newEncoder(w io.Writer, enc string) io.WriteCloser {
+	if enc == encZstd {
+		return zstd.NewWriter(w)
+	}
+	return gzip.NewWriter(w)
+}
+
+// newDecoder returns a reader that decompresses the content with a given encoding.
+func newDecoder(r io.Reader, enc string) (io.ReadCloser, error) {
+	if enc == encZstd {
+		return zstd.NewReader(r)
+	}
+	return gzip.NewReader(r)
+}
+
+// compressPipe compresses the content of r in the background.
+func compressPipe(r io.Reader, enc string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := newEncoder(pw, enc)
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// decodedBody wraps the body of the response, decompressing it.
+type decodedBody struct {
+	zr   io.ReadCloser
+	body io.Closer
+}
+
+func newDecodedBody(body io.ReadCloser, enc string) (io.ReadCloser, error) {
+	zr, err := newDecoder(body, enc)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return &decodedBody{zr: zr, body: body}, nil
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	return b.zr.Read(p)
+}
+
+func (b *decodedBody) Close() error {
+	b.zr.Close()
+	return b.body.Close()
+}
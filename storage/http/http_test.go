@@ -1,15 +1,29 @@
 package httpstor
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/dennwc/cas/types"
 	"github.com/stretchr/testify/require"
 
+	"github.com/dennwc/cas/schema"
 	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/local"
 )
 
 func TestHTTP(t *testing.T) {
@@ -68,3 +82,780 @@ func testHTTP(t *testing.T, pref string) {
 	require.False(t, it.Next())
 	require.NoError(t, it.Err())
 }
+
+func TestHTTPUpload(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewInMemory()
+
+	hs := httptest.NewServer(NewServerWithOptions(mem, "", ServerOptions{Writable: true}))
+	defer hs.Close()
+
+	cli := NewClient(hs.URL)
+	cli.SetHTTPClient(hs.Client())
+
+	data := []byte("some data")
+	sr, err := storage.WriteBytes(ctx, cli, data)
+	require.NoError(t, err)
+	require.Equal(t, types.BytesRef(data), sr.Ref)
+
+	sz, err := mem.StatBlob(ctx, sr.Ref)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), sz)
+
+	// upload the content with a wrong ref
+	exp := types.StringRef("other data")
+	err = cli.putBlob(ctx, types.SizedRef{Ref: exp, Size: uint64(len(data))}, bytes.NewReader(data))
+	require.Equal(t, storage.ErrRefMissmatch{Exp: exp, Got: sr.Ref}, err)
+
+	_, err = mem.StatBlob(ctx, exp)
+	require.Equal(t, storage.ErrNotFound, err)
+
+	// declared size doesn't match the size of the existing blob
+	err = cli.putBlob(ctx, types.SizedRef{Ref: sr.Ref, Size: 3}, bytes.NewReader(data[:3]))
+	require.Equal(t, storage.ErrSizeMissmatch{Exp: uint64(len(data)), Got: 3}, err)
+}
+
+func TestHTTPUploadRejected(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_http_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	st, err := local.New(dir, true)
+	require.NoError(t, err)
+	defer st.Close()
+
+	hs := httptest.NewServer(NewServerWithOptions(st, "", ServerOptions{
+		Writable: true, Policy: &storage.Policy{MaxSize: 1024},
+	}))
+	defer hs.Close()
+
+	cli := NewClient(hs.URL)
+	cli.SetHTTPClient(hs.Client())
+
+	data := []byte("some data")
+	big := bytes.Repeat([]byte{1}, 2048)
+	reject := func() {
+		exp := types.StringRef("other data")
+		err := cli.putBlob(ctx, types.SizedRef{Ref: exp, Size: uint64(len(data))}, bytes.NewReader(data))
+		require.IsType(t, storage.ErrRefMissmatch{}, err)
+		_, err = storage.WriteBytes(ctx, cli, big)
+		require.IsType(t, storage.ErrPolicy{}, err)
+	}
+	// open files are only counted on Linux
+	openFiles := func() int {
+		fds, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			return 0
+		}
+		return len(fds)
+	}
+	reject() // the first request opens connections
+	n := openFiles()
+	for i := 0; i < 20; i++ {
+		reject()
+	}
+	require.Equal(t, n, openFiles())
+
+	infos, err := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+	require.NoError(t, err)
+	for _, fi := range infos {
+		require.True(t, fi.IsDir(), "temporary file is not removed: %s", fi.Name())
+	}
+}
+
+func TestHTTPPolicy(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewInMemory()
+
+	hs := httptest.NewServer(NewServerWithOptions(mem, "", ServerOptions{
+		Writable: true,
+		Policy: &storage.Policy{
+			MaxSize: 1024, DenyTypes: []string{schema.MustTypeOf(&schema.Commit{})},
+		},
+	}))
+	defer hs.Close()
+
+	cli := NewClient(hs.URL)
+	cli.SetHTTPClient(hs.Client())
+
+	_, err := storage.WriteBytes(ctx, cli, []byte("some data"))
+	require.NoError(t, err)
+
+	big := bytes.Repeat([]byte{1}, 2048)
+	_, err = storage.WriteBytes(ctx, cli, big)
+	require.IsType(t, storage.ErrPolicy{}, err)
+	_, err = mem.StatBlob(ctx, types.BytesRef(big))
+	require.Equal(t, storage.ErrNotFound, err)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, schema.Encode(buf, &schema.Commit{Root: types.StringRef("root")}))
+	_, err = storage.WriteBytes(ctx, cli, buf.Bytes())
+	require.Equal(t, storage.ErrPolicy{
+		Ref:    types.BytesRef(buf.Bytes()),
+		Reason: fmt.Sprintf("schema type %q is not allowed", schema.MustTypeOf(&schema.Commit{})),
+	}, err)
+}
+
+func TestHTTPBulk(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewInMemory()
+
+	srv := NewServerWithOptions(mem, "", ServerOptions{Compression: true})
+	var reqs int32
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reqs, 1)
+		srv.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+
+	cli := NewClient(hs.URL)
+	cli.SetHTTPClient(hs.Client())
+	cli.SetCompression(true)
+
+	var (
+		refs []types.Ref
+		exp  []string
+	)
+	for i := 0; i < 10; i++ {
+		data := fmt.Sprintf("blob %d", i)
+		sr, err := storage.WriteBytes(ctx, mem, []byte(data))
+		require.NoError(t, err)
+		refs = append(refs, sr.Ref)
+		exp = append(exp, data)
+	}
+	// missing blobs are skipped
+	refs = append(refs[:5:5], append([]types.Ref{types.StringRef("missing")}, refs[5:]...)...)
+
+	mr, err := storage.FetchBlobs(ctx, cli, refs)
+	require.NoError(t, err)
+	defer mr.Close()
+	var got []string
+	for i := 0; mr.Next(); i++ {
+		sr := mr.SizedRef()
+		if i%2 == 1 {
+			// unread content is skipped
+			got = append(got, exp[i])
+			continue
+		}
+		data, err := ioutil.ReadAll(mr)
+		require.NoError(t, err)
+		require.Equal(t, types.SizedRef{Ref: types.BytesRef(data), Size: uint64(len(data))}, sr)
+		got = append(got, string(data))
+	}
+	require.NoError(t, mr.Err())
+	require.Equal(t, exp, got)
+	require.Equal(t, int32(1), atomic.LoadInt32(&reqs))
+}
+
+func TestHTTPStat(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewInMemory()
+
+	srv := NewServer(mem, "")
+	var (
+		reqs  int32
+		noNew bool // emulate an older server
+	)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&reqs, 1)
+		if noNew && strings.HasPrefix(r.URL.Path, "/stat") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+
+	cli := NewClient(hs.URL)
+	cli.SetHTTPClient(hs.Client())
+
+	var (
+		refs []types.Ref
+		exp  []types.SizedRef
+	)
+	for i := 0; i < 10; i++ {
+		sr, err := storage.WriteBytes(ctx, mem, []byte(fmt.Sprintf("blob %d", i)))
+		require.NoError(t, err)
+		refs = append(refs, sr.Ref)
+		exp = append(exp, sr)
+	}
+	refs = append(refs, types.StringRef("missing"))
+
+	got, err := storage.StatBlobs(ctx, cli, refs)
+	require.NoError(t, err)
+	require.Equal(t, exp, got)
+	require.Equal(t, int32(1), atomic.LoadInt32(&reqs))
+
+	noNew = true
+	atomic.StoreInt32(&reqs, 0)
+	got, err = storage.StatBlobs(ctx, cli, refs)
+	require.NoError(t, err)
+	require.Equal(t, exp, got)
+	require.Equal(t, int32(1+len(refs)), atomic.LoadInt32(&reqs))
+}
+
+func TestHTTPPack(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewInMemory()
+
+	writeSchema := func(obj schema.Object) types.SizedRef {
+		buf := new(bytes.Buffer)
+		require.NoError(t, schema.Encode(buf, obj))
+		sr, err := storage.WriteBytes(ctx, mem, buf.Bytes())
+		require.NoError(t, err)
+		return sr
+	}
+	var parts []types.SizedRef
+	for i := 0; i < 3; i++ {
+		sr, err := storage.WriteBytes(ctx, mem, []byte(fmt.Sprintf("part %d", i)))
+		require.NoError(t, err)
+		parts = append(parts, sr)
+	}
+	file := writeSchema(&schema.Multipart{Parts: parts})
+	old := writeSchema(&schema.Commit{Root: parts[0].Ref})
+	commit := writeSchema(&schema.Commit{Root: file.Ref, Parent: &old.Ref})
+	// history is not included in the pack
+	exp := append([]types.SizedRef{commit, file}, parts...)
+
+	newServer := func(st storage.Storage) (*Client, *int32, func()) {
+		srv := NewServerWithOptions(st, "", ServerOptions{Writable: true})
+		var reqs int32
+		hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&reqs, 1)
+			srv.ServeHTTP(w, r)
+		}))
+		cli := NewClient(hs.URL)
+		cli.SetHTTPClient(hs.Client())
+		return cli, &reqs, hs.Close
+	}
+	listBlobs := func(st storage.Storage) []types.SizedRef {
+		var got []types.SizedRef
+		it := st.IterateBlobs(ctx)
+		defer it.Close()
+		for it.Next() {
+			got = append(got, it.SizedRef())
+		}
+		require.NoError(t, it.Err())
+		return got
+	}
+
+	t.Run("fetch", func(t *testing.T) {
+		cli, reqs, closer := newServer(mem)
+		defer closer()
+
+		dst := storage.NewInMemory()
+		require.NoError(t, storage.CopyTree(ctx, dst, cli, commit.Ref))
+		require.Equal(t, int32(1), atomic.LoadInt32(reqs))
+		require.ElementsMatch(t, exp, listBlobs(dst))
+	})
+	t.Run("store", func(t *testing.T) {
+		dst := storage.NewInMemory()
+		cli, reqs, closer := newServer(dst)
+		defer closer()
+
+		require.NoError(t, storage.CopyTree(ctx, cli, mem, commit.Ref))
+		// emptiness check, pack support probe and the upload
+		require.Equal(t, int32(3), atomic.LoadInt32(reqs))
+		require.ElementsMatch(t, exp, listBlobs(dst))
+
+		// storage is not empty anymore, so only missing blobs are uploaded
+		require.NoError(t, storage.CopyTree(ctx, cli, mem, old.Ref))
+		require.ElementsMatch(t, append(exp, old), listBlobs(dst))
+	})
+	t.Run("order", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		require.NoError(t, storage.WritePack(ctx, buf, mem, commit.Ref))
+		var got []types.SizedRef
+		tr := tar.NewReader(buf)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			got = append(got, types.SizedRef{Ref: types.MustParseRef(h.Name), Size: uint64(h.Size)})
+		}
+		require.Equal(t, exp, got)
+	})
+}
+
+func TestHTTPReadOnly(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewInMemory()
+
+	hs := httptest.NewServer(NewServer(mem, ""))
+	defer hs.Close()
+
+	cli := NewClient(hs.URL)
+	cli.SetHTTPClient(hs.Client())
+
+	_, err := storage.WriteBytes(ctx, cli, []byte("some data"))
+	require.Equal(t, storage.ErrReadOnly, err)
+}
+
+// fullStorage is a storage that has reached its size limit.
+type fullStorage struct {
+	storage.Storage
+}
+
+func (fullStorage) BeginBlob(ctx context.Context) (storage.BlobWriter, error) {
+	return nil, storage.ErrStoreFull
+}
+
+func TestHTTPStoreFull(t *testing.T) {
+	ctx := context.Background()
+
+	hs := httptest.NewServer(NewServerWithOptions(fullStorage{storage.NewInMemory()}, "", ServerOptions{Writable: true}))
+	defer hs.Close()
+
+	cli := NewClient(hs.URL)
+	cli.SetHTTPClient(hs.Client())
+
+	_, err := storage.WriteBytes(ctx, cli, []byte("some data"))
+	require.Equal(t, storage.ErrStoreFull, err)
+}
+
+func TestHTTPPrefix(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewInMemory()
+
+	var refs []types.Ref
+	for _, s := range []string{"a", "b", "c", "d"} {
+		sr, err := storage.WriteBytes(ctx, mem, []byte(s))
+		require.NoError(t, err)
+		refs = append(refs, sr.Ref)
+	}
+	prefix := refs[0].String()[:len("sha256:")+2]
+
+	var listed int
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blobs/" {
+			require.Equal(t, prefix, r.URL.Query().Get("prefix"))
+			listed++
+		}
+		NewServer(mem, "").ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+
+	cli := NewClient(hs.URL)
+	cli.SetHTTPClient(hs.Client())
+
+	it := storage.IterateBlobsPrefix(ctx, cli, prefix)
+	defer it.Close()
+	var got []types.Ref
+	for it.Next() {
+		got = append(got, it.SizedRef().Ref)
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []types.Ref{refs[0]}, got)
+	require.Equal(t, 1, listed)
+}
+
+type encodingRecorder struct {
+	rt   http.RoundTripper
+	encs []string
+}
+
+func (r *encodingRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if enc := req.Header.Get("Content-Encoding"); enc != "" {
+		r.encs = append(r.encs, "req:"+enc)
+	}
+	resp, err := r.rt.RoundTrip(req)
+	if err == nil {
+		if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+			r.encs = append(r.encs, "resp:"+enc)
+		}
+	}
+	return resp, err
+}
+
+func TestHTTPCompression(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewInMemory()
+
+	text := bytes.Repeat([]byte("some compressible text\n"), 1024)
+	tref, err := storage.WriteBytes(ctx, mem, text)
+	require.NoError(t, err)
+
+	gz := new(bytes.Buffer)
+	zw := gzip.NewWriter(gz)
+	zw.Write(text)
+	zw.Close()
+	zref, err := storage.WriteBytes(ctx, mem, gz.Bytes())
+	require.NoError(t, err)
+
+	hs := httptest.NewServer(NewServerWithOptions(mem, "", ServerOptions{
+		Writable: true, Compression: true,
+	}))
+	defer hs.Close()
+
+	rec := &encodingRecorder{rt: hs.Client().Transport}
+	cli := NewClient(hs.URL)
+	cli.SetHTTPClient(&http.Client{Transport: rec})
+	cli.SetCompression(true)
+
+	fetch := func(exp types.SizedRef) {
+		rc, sz, err := cli.FetchBlob(ctx, exp.Ref)
+		require.NoError(t, err)
+		require.Equal(t, exp.Size, sz)
+		got, err := types.Hash(rc)
+		rc.Close()
+		require.NoError(t, err)
+		require.Equal(t, exp, got)
+	}
+	fetch(tref)
+	fetch(zref)
+	require.Equal(t, []string{"resp:zstd"}, rec.encs)
+
+	rec.encs = nil
+	text2 := bytes.Repeat([]byte("other compressible text\n"), 1024)
+	sr, err := storage.WriteBytes(ctx, cli, text2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"req:zstd"}, rec.encs)
+
+	sz, err := mem.StatBlob(ctx, sr.Ref)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(text2)), sz)
+
+	// client that only supports gzip
+	req, err := http.NewRequest("GET", hs.URL+"/blobs/"+tref.Ref.String(), nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := hs.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	gr, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(gr)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(text, got))
+
+	// server that only supports gzip
+	srv := NewServerWithOptions(mem, "", ServerOptions{Writable: true, Compression: true})
+	hs2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Accept-Encoding", strings.Replace(r.Header.Get("Accept-Encoding"), encZstd+", ", "", 1))
+		srv.ServeHTTP(gzipOnlyWriter{w}, r)
+	}))
+	defer hs2.Close()
+
+	rec = &encodingRecorder{rt: hs2.Client().Transport}
+	cli = NewClient(hs2.URL)
+	cli.SetHTTPClient(&http.Client{Transport: rec})
+	cli.SetCompression(true)
+	fetch(tref)
+	text3 := bytes.Repeat([]byte("more compressible text\n"), 1024)
+	_, err = storage.WriteBytes(ctx, cli, text3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"resp:gzip", "req:gzip"}, rec.encs)
+}
+
+// gzipOnlyWriter hides zstd support of the server.
+type gzipOnlyWriter struct {
+	http.ResponseWriter
+}
+
+func (w gzipOnlyWriter) fixHeader() {
+	if w.Header().Get("Accept-Encoding") != "" {
+		w.Header().Set("Accept-Encoding", encGzip)
+	}
+}
+
+func (w gzipOnlyWriter) WriteHeader(code int) {
+	w.fixHeader()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w gzipOnlyWriter) Write(p []byte) (int, error) {
+	w.fixHeader()
+	return w.ResponseWriter.Write(p)
+}
+
+func TestHTTPFiles(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_http_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	st, err := local.New(dir, true)
+	require.NoError(t, err)
+	defer st.Close()
+
+	text := bytes.Repeat([]byte("some compressible text\n"), 1024)
+	tref, err := storage.WriteBytes(ctx, st, text)
+	require.NoError(t, err)
+	gz := new(bytes.Buffer)
+	zw := gzip.NewWriter(gz)
+	zw.Write(bytes.Repeat(text, 100))
+	zw.Close()
+	zref, err := storage.WriteBytes(ctx, st, gz.Bytes())
+	require.NoError(t, err)
+
+	rc, _, err := st.FetchBlob(ctx, zref.Ref)
+	require.NoError(t, err)
+	_, ok := storage.BlobFile(storage.VerifyReader(rc, zref.Ref))
+	rc.Close()
+	require.True(t, ok, "local blobs should be sent from files")
+
+	hs := httptest.NewServer(NewServerWithOptions(st, "", ServerOptions{Compression: true}))
+	defer hs.Close()
+
+	rec := &encodingRecorder{rt: hs.Client().Transport}
+	cli := NewClient(hs.URL)
+	cli.SetHTTPClient(&http.Client{Transport: rec})
+	for _, compress := range []bool{false, true} {
+		rec.encs = nil
+		cli.SetCompression(compress)
+		for _, exp := range []types.SizedRef{tref, zref} {
+			rc, sz, err := cli.FetchBlob(ctx, exp.Ref)
+			require.NoError(t, err)
+			require.Equal(t, exp.Size, sz)
+			got, err := types.Hash(rc)
+			rc.Close()
+			require.NoError(t, err)
+			require.Equal(t, exp, got)
+		}
+		if compress {
+			// compressed files are still sent as-is
+			require.Equal(t, []string{"resp:zstd"}, rec.encs)
+		} else {
+			require.Empty(t, rec.encs)
+		}
+	}
+}
+
+type rangeRecorder struct {
+	rt http.RoundTripper
+
+	mu     sync.Mutex
+	ranges int
+}
+
+func (r *rangeRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.rt.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusPartialContent {
+		r.mu.Lock()
+		r.ranges++
+		r.mu.Unlock()
+	}
+	return resp, err
+}
+
+// streamStorage hides the seekable blob readers, thus disables ranged requests on the server.
+type streamStorage struct {
+	storage.Storage
+}
+
+func (s streamStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	rc, sz, err := s.Storage.FetchBlob(ctx, ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{rc, rc}, sz, nil
+}
+
+func TestHTTPParallel(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewInMemory()
+
+	data := make([]byte, 100*1024+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	big, err := storage.WriteBytes(ctx, mem, data)
+	require.NoError(t, err)
+	small, err := storage.WriteBytes(ctx, mem, data[:100])
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		name   string
+		st     storage.Storage
+		ranges int
+	}{
+		{name: "ranges", st: mem, ranges: 11 + 1}, // 11 parts of a big blob and one for a small blob
+		{name: "no ranges", st: streamStorage{mem}, ranges: 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			hs := httptest.NewServer(NewServer(c.st, ""))
+			defer hs.Close()
+
+			rec := &rangeRecorder{rt: hs.Client().Transport}
+			cli := NewClient(hs.URL)
+			cli.SetHTTPClient(&http.Client{Transport: rec})
+			cli.SetParallel(4, 10*1024)
+
+			for _, exp := range []types.SizedRef{big, small} {
+				rc, sz, err := cli.FetchBlob(ctx, exp.Ref)
+				require.NoError(t, err)
+				require.Equal(t, exp.Size, sz)
+				got, err := types.Hash(rc)
+				require.NoError(t, rc.Close())
+				require.NoError(t, err)
+				require.Equal(t, exp, got)
+			}
+			require.Equal(t, c.ranges, rec.ranges)
+		})
+	}
+}
+
+func TestHTTPOpen(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewInMemory()
+
+	data := make([]byte, 300*1024)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	big, err := storage.WriteBytes(ctx, mem, data)
+	require.NoError(t, err)
+	empty, err := storage.WriteBytes(ctx, mem, nil)
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		name   string
+		st     storage.Storage
+		ranges int
+	}{
+		{name: "ranges", st: mem, ranges: 2}, // the first part and one read at the end
+		{name: "no ranges", st: streamStorage{mem}, ranges: 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			hs := httptest.NewServer(NewServer(c.st, ""))
+			defer hs.Close()
+
+			rec := &rangeRecorder{rt: hs.Client().Transport}
+			cli := NewClient(hs.URL)
+			cli.SetHTTPClient(&http.Client{Transport: rec})
+
+			r, sz, err := cli.OpenBlob(ctx, big.Ref)
+			require.NoError(t, err)
+			defer r.Close()
+			require.Equal(t, big.Size, sz)
+
+			buf := make([]byte, 100)
+			// the last two reads are served from the same range
+			for _, off := range []int{1000, 200000, 200100} {
+				n, err := r.ReadAt(buf, int64(off))
+				require.NoError(t, err)
+				require.Equal(t, data[off:off+len(buf)], buf[:n])
+			}
+			require.Equal(t, c.ranges, rec.ranges)
+
+			rc, sz, err := cli.FetchBlobRange(ctx, big.Ref, 250000, 100)
+			require.NoError(t, err)
+			require.Equal(t, big.Size, sz)
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			require.NoError(t, err)
+			require.Equal(t, data[250000:250100], got)
+
+			r, sz, err = cli.OpenBlob(ctx, empty.Ref)
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), sz)
+			got, err = ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.Empty(t, got)
+			require.NoError(t, r.Close())
+		})
+	}
+}
+
+// signingStorage emulates a backend that can sign blob URLs.
+type signingStorage struct {
+	storage.Storage
+	base string
+}
+
+func (s signingStorage) SignBlobURL(ctx context.Context, ref types.Ref, ttl time.Duration) (string, error) {
+	return s.base + "/" + ref.String() + "?expires=" + ttl.String(), nil
+}
+
+func TestHTTPRedirect(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewInMemory()
+
+	big, err := storage.WriteBytes(ctx, mem, bytes.Repeat([]byte("0123456789"), 1000))
+	require.NoError(t, err)
+	small, err := storage.WriteBytes(ctx, mem, []byte("small"))
+	require.NoError(t, err)
+
+	var backend int32
+	bs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&backend, 1)
+		require.Equal(t, "1m0s", r.URL.Query().Get("expires"))
+		ref, err := types.ParseRef(strings.TrimPrefix(r.URL.Path, "/"))
+		require.NoError(t, err)
+		rc, _, err := mem.FetchBlob(r.Context(), ref)
+		require.NoError(t, err)
+		defer rc.Close()
+		io.Copy(w, rc)
+	}))
+	defer bs.Close()
+
+	hs := httptest.NewServer(NewServerWithOptions(signingStorage{mem, bs.URL}, "", ServerOptions{
+		RedirectTTL: time.Minute,
+	}))
+	defer hs.Close()
+
+	cli := NewClient(hs.URL)
+	cli.SetHTTPClient(hs.Client())
+
+	for _, exp := range []types.SizedRef{big, small} {
+		rc, sz, err := cli.FetchBlob(ctx, exp.Ref)
+		require.NoError(t, err)
+		require.Equal(t, exp.Size, sz)
+		got, err := types.Hash(rc)
+		rc.Close()
+		require.NoError(t, err)
+		require.Equal(t, exp, got)
+	}
+	// only the large blob is redirected
+	require.Equal(t, int32(1), atomic.LoadInt32(&backend))
+
+	_, _, err = cli.FetchBlob(ctx, types.StringRef("missing"))
+	require.Equal(t, storage.ErrNotFound, err)
+}
+
+func TestHTTPRetries(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewInMemory()
+	sr, err := storage.WriteBytes(ctx, mem, []byte("data"))
+	require.NoError(t, err)
+
+	var failures int32
+	srv := NewServer(mem, "")
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+
+	// connection settings are kept in the config
+	buf := new(bytes.Buffer)
+	err = storage.EncodeConfig(buf, &Config{URL: hs.URL, ConnConfig: storage.ConnConfig{
+		DialTimeout: storage.Duration(time.Second), Retries: 2,
+	}})
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), `"dial_timeout": "1s"`)
+	conf, err := storage.DecodeConfig(buf)
+	require.NoError(t, err)
+	require.Equal(t, 2, conf.(*Config).Retries)
+
+	st, err := conf.OpenStorage(ctx)
+	require.NoError(t, err)
+	defer st.Close()
+
+	atomic.StoreInt32(&failures, 2)
+	sz, err := st.StatBlob(ctx, sr.Ref)
+	require.NoError(t, err)
+	require.Equal(t, sr.Size, sz)
+
+	atomic.StoreInt32(&failures, 3)
+	_, err = st.StatBlob(ctx, sr.Ref)
+	require.Error(t, err)
+}
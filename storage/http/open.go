@@ -0,0 +1,247 @@
+package httpstor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// minRangeSize is the minimal size of a ranged request made by readers returned from OpenBlob.
+// Small sequential reads are served from the data of the last request.
+const minRangeSize = 64 * 1024
+
+var _ storage.BlobOpener = (*Client)(nil)
+
+// OpenBlob implements storage.BlobOpener. Reads are served with ranged requests.
+//
+// If the server doesn't support ranged requests, the whole blob is downloaded to a temporary file
+// and is verified before being returned to the caller.
+func (c *Client) OpenBlob(ctx context.Context, ref types.Ref) (storage.BlobReader, uint64, error) {
+	if ref.Zero() {
+		return nil, 0, storage.ErrInvalidRef
+	}
+	resp, err := c.fetchRange(ctx, ref, 0, minRangeSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, end, total, err := storage.ParseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, 0, err
+		} else if start != 0 {
+			return nil, 0, fmt.Errorf("unexpected range start: %d", start)
+		}
+		buf, err := readRange(resp.Body, end+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		return &rangeReader{c: c, ctx: ctx, ref: ref, size: int64(total), buf: buf}, total, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the only range that cannot be satisfied is the first byte of an empty blob
+		if cr := resp.Header.Get("Content-Range"); cr != "bytes */0" {
+			return nil, 0, fmt.Errorf("unexpected content range: %q", cr)
+		}
+		return &rangeReader{c: c, ctx: ctx, ref: ref}, 0, nil
+	case http.StatusOK:
+		sz, err := respSize(resp)
+		if err != nil {
+			return nil, 0, err
+		}
+		f, err := ioutil.TempFile("", "cas_download_")
+		if err != nil {
+			return nil, 0, err
+		}
+		tf := &tempFile{File: f}
+		_, err = io.Copy(f, resp.Body)
+		if err == nil {
+			err = verifyFile(f, types.SizedRef{Ref: ref, Size: sz})
+		}
+		if err != nil {
+			tf.Close()
+			return nil, 0, err
+		}
+		return tf, sz, nil
+	case http.StatusNotFound:
+		return nil, 0, storage.ErrNotFound
+	default:
+		return nil, 0, fmt.Errorf("unexpected status code on open: %v", resp.Status)
+	}
+}
+
+// fetchRange sends a ranged request for a part of the blob. Caller must close the response body.
+func (c *Client) fetchRange(ctx context.Context, ref types.Ref, off, size uint64) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.blobURL(ref), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", storage.HTTPRange(off, size))
+	return c.do(req)
+}
+
+// readRange reads exactly size bytes of the range from the response body.
+func readRange(r io.Reader, size uint64) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// rangeReader reads a blob with ranged requests. The data of the last request is kept to serve small reads.
+type rangeReader struct {
+	c    *Client
+	ctx  context.Context
+	ref  types.Ref
+	size int64
+
+	mu     sync.Mutex
+	buf    []byte // data of the last request
+	bufOff int64  // offset of buf
+	pos    int64  // offset for Read, as set by Seek
+}
+
+func (r *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.readAt(p, off)
+}
+
+func (r *rangeReader) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	total := 0
+	for len(p) != 0 {
+		if off >= r.size {
+			return total, io.EOF
+		}
+		if off < r.bufOff || off >= r.bufOff+int64(len(r.buf)) {
+			size := int64(len(p))
+			if size < minRangeSize {
+				size = minRangeSize
+			}
+			if rest := r.size - off; size > rest {
+				size = rest
+			}
+			if err := r.fetch(off, size); err != nil {
+				return total, err
+			}
+		}
+		n := copy(p, r.buf[off-r.bufOff:])
+		p = p[n:]
+		off += int64(n)
+		total += n
+	}
+	return total, nil
+}
+
+// fetch replaces the buffer with the given range of the blob.
+func (r *rangeReader) fetch(off, size int64) error {
+	resp, err := r.c.fetchRange(r.ctx, r.ref, uint64(off), uint64(size))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusNotFound:
+		return storage.ErrNotFound
+	default:
+		return fmt.Errorf("unexpected status code on ranged fetch: %v", resp.Status)
+	}
+	start, end, _, err := storage.ParseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	} else if int64(start) != off || int64(end)+1 != off+size {
+		return fmt.Errorf("unexpected content range: [%d-%d], expected [%d-%d]", start, end, off, off+size-1)
+	}
+	buf, err := readRange(resp.Body, uint64(size))
+	if err != nil {
+		return err
+	}
+	r.buf, r.bufOff = buf, off
+	return nil
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if rest := r.size - r.pos; rest <= 0 {
+		return 0, io.EOF
+	} else if int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := r.readAt(p, r.pos)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *rangeReader) Seek(off int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		off += r.pos
+	case io.SeekEnd:
+		off += r.size
+	default:
+		return r.pos, os.ErrInvalid
+	}
+	if off < 0 {
+		return r.pos, os.ErrInvalid
+	}
+	r.pos = off
+	return off, nil
+}
+
+func (r *rangeReader) Close() error {
+	r.mu.Lock()
+	r.buf = nil
+	r.mu.Unlock()
+	return nil
+}
+
+var _ storage.BlobRangeFetcher = (*Client)(nil)
+
+// FetchBlobRange implements storage.BlobRangeFetcher with a single ranged request.
+func (c *Client) FetchBlobRange(ctx context.Context, ref types.Ref, off, length uint64) (io.ReadCloser, uint64, error) {
+	if ref.Zero() {
+		return nil, 0, storage.ErrInvalidRef
+	}
+	resp, err := c.fetchRange(ctx, ref, off, length)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, 0, storage.ErrNotFound
+	case http.StatusOK:
+		// the server doesn't support ranges; the response might be chunked, but the size is always set
+		sz, err := respSize(resp)
+		if err != nil {
+			resp.Body.Close()
+			return nil, 0, err
+		}
+		resp.ContentLength = int64(sz)
+	}
+	return storage.HTTPRangeResponse(resp, off, length)
+}
@@ -0,0 +1,212 @@
+package httpstor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// Tree packs are served on the pack endpoint:
+//
+//	GET  /pack/<ref>  streams a tree pack of the ref
+//	HEAD /pack/       checks if the server accepts tree packs
+//	POST /pack/       stores a tree pack; responds with the root ref
+//
+// See storage.WritePack for the format.
+const ctPack = "application/x-tar"
+
+var (
+	_ storage.PackFetcher = (*Client)(nil)
+	_ storage.PackStorer  = (*Client)(nil)
+)
+
+func (s *server) servePack(w http.ResponseWriter, r *http.Request, sub []string) {
+	if len(sub) == 0 {
+		switch r.Method {
+		case "HEAD":
+			if !s.opts.Writable {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Header().Set("Accept", ctPack)
+			w.WriteHeader(http.StatusNoContent)
+		case "POST":
+			s.storePack(w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	} else if len(sub) != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ref, err := types.ParseRef(sub[0])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	ctx := r.Context()
+	if _, err = s.s.StatBlob(ctx, ref); err == storage.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", ctPack)
+	w.Header().Set(hdrRef, ref.String())
+	if err = storage.WritePack(ctx, w, s.s, ref); err != nil {
+		// status code was already sent; abort the response, so the client can detect it
+		log.Println("http: tree pack:", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (s *server) storePack(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if !s.opts.Writable {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	sr, err := storage.ReadPack(r.Context(), s.s, r.Body)
+	switch err := err.(type) {
+	case nil:
+	case storage.ErrPolicy:
+		writePolicy(w, err)
+		return
+	case storage.ErrRefMissmatch, storage.ErrSizeMissmatch:
+		writeMismatch(w, err)
+		return
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set(hdrRef, sr.Ref.String())
+	w.Header().Set(hdrSize, strconv.FormatUint(sr.Size, 10))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (c *Client) packURL() string {
+	return c.base + "/pack/"
+}
+
+// FetchPack fetches a tree pack from the server. If the server doesn't support tree packs,
+// the pack is assembled on the client by fetching blobs one by one.
+func (c *Client) FetchPack(ctx context.Context, root types.Ref) (io.ReadCloser, error) {
+	if root.Zero() {
+		return nil, storage.ErrInvalidRef
+	}
+	req, err := http.NewRequest("GET", c.packURL()+root.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound, http.StatusForbidden, http.StatusMethodNotAllowed:
+		// older server, or the root is missing; the fallback will report the latter
+		resp.Body.Close()
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code on pack fetch: %v", resp.Status)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(storage.WritePack(ctx, pw, c, root))
+	}()
+	return pr, nil
+}
+
+// packSupported checks if the server accepts tree packs. The result is cached.
+func (c *Client) packSupported(ctx context.Context) (bool, error) {
+	switch atomic.LoadInt32(&c.pack) {
+	case packYes:
+		return true, nil
+	case packNo:
+		return false, nil
+	}
+	req, err := http.NewRequest("HEAD", c.packURL(), nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	resp, err := c.do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	ok := resp.StatusCode == http.StatusNoContent
+	if ok {
+		atomic.StoreInt32(&c.pack, packYes)
+	} else {
+		atomic.StoreInt32(&c.pack, packNo)
+	}
+	return ok, nil
+}
+
+// StorePack uploads a tree pack to the server. If the server doesn't accept tree packs,
+// blobs are uploaded one by one.
+func (c *Client) StorePack(ctx context.Context, r io.Reader) (types.SizedRef, error) {
+	ok, err := c.packSupported(ctx)
+	if err != nil {
+		return types.SizedRef{}, err
+	} else if !ok {
+		return storage.ReadPack(ctx, c, r)
+	}
+	req, err := http.NewRequest("POST", c.packURL(), ioutil.NopCloser(r))
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", ctPack)
+	resp, err := c.do(req)
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated:
+	case http.StatusConflict:
+		return types.SizedRef{}, mismatchError(resp)
+	case http.StatusMethodNotAllowed:
+		return types.SizedRef{}, storage.ErrReadOnly
+	case http.StatusForbidden:
+		if resp.Header.Get(hdrError) == errPolicy {
+			reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+			return types.SizedRef{}, storage.ErrPolicy{Reason: string(reason)}
+		}
+		return types.SizedRef{}, fmt.Errorf("unexpected status code on pack upload: %v", resp.Status)
+	default:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return types.SizedRef{}, fmt.Errorf("pack upload failed: %v: %s", resp.Status, msg)
+	}
+	ref, err := types.ParseRef(resp.Header.Get(hdrRef))
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	size, err := strconv.ParseUint(resp.Header.Get(hdrSize), 10, 64)
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	return types.SizedRef{Ref: ref, Size: size}, nil
+}
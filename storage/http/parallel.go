@@ -0,0 +1,205 @@
+package httpstor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// DefaultPartSize is the default size of a single ranged request used for parallel downloads.
+const DefaultPartSize = 8 * 1024 * 1024
+
+// SetParallel enables parallel downloads of large blobs over multiple connections.
+//
+// Blobs larger than partSize are split into ranged requests of partSize bytes each, and
+// at most conns requests are sent concurrently. The assembled blob is spooled to a temporary
+// file and is verified before being returned to the caller. If the server doesn't support
+// ranged requests, the blob is downloaded as a single stream.
+//
+// Setting conns to 1 or less disables parallel downloads. Zero partSize sets it to DefaultPartSize.
+func (c *Client) SetParallel(conns int, partSize uint64) {
+	if partSize == 0 {
+		partSize = DefaultPartSize
+	}
+	c.conns = conns
+	c.partSize = partSize
+}
+
+func (c *Client) parallel() bool {
+	return c.conns > 1 && c.partSize > 0
+}
+
+// fetchParallel continues the download of the blob that was started with a ranged request for the first part.
+// It takes the ownership of the response body.
+func (c *Client) fetchParallel(ctx context.Context, ref types.Ref, resp *http.Response) (io.ReadCloser, uint64, error) {
+	start, end, total, err := storage.ParseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	} else if start != 0 {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("unexpected range start: %d", start)
+	}
+	if end+1 == total {
+		// the whole blob fits into the first part
+		return resp.Body, total, nil
+	}
+	f, err := ioutil.TempFile("", "cas_download_")
+	if err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	}
+	tf := &tempFile{File: f}
+	err = copyPart(f, resp.Body, 0, end+1)
+	resp.Body.Close()
+	if err == nil {
+		err = c.fetchParts(ctx, ref, f, end+1, total)
+	}
+	if err == nil {
+		err = verifyFile(f, types.SizedRef{Ref: ref, Size: total})
+	}
+	if err != nil {
+		tf.Close()
+		return nil, 0, err
+	}
+	return tf, total, nil
+}
+
+// fetchParts downloads the blob content in range [off, total) to the file using concurrent ranged requests.
+func (c *Client) fetchParts(ctx context.Context, ref types.Ref, f *os.File, off, total uint64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parts := make(chan uint64)
+	go func() {
+		defer close(parts)
+		for ; off < total; off += c.partSize {
+			select {
+			case parts <- off:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+	for i := 0; i < c.conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for off := range parts {
+				size := c.partSize
+				if off+size > total {
+					size = total - off
+				}
+				if err := c.fetchPart(ctx, ref, f, off, size); err != nil {
+					mu.Lock()
+					if first == nil {
+						first = err
+					}
+					mu.Unlock()
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if first == nil {
+		first = ctx.Err()
+	}
+	return first
+}
+
+// fetchPart downloads a single part of the blob and writes it to the file at a given offset.
+func (c *Client) fetchPart(ctx context.Context, ref types.Ref, f *os.File, off, size uint64) error {
+	req, err := http.NewRequest("GET", c.blobURL(ref), nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", storage.HTTPRange(off, size))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusNotFound:
+		return storage.ErrNotFound
+	default:
+		return fmt.Errorf("unexpected status code on ranged fetch: %v", resp.Status)
+	}
+	start, end, _, err := storage.ParseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	} else if start != off || end+1 != off+size {
+		return fmt.Errorf("unexpected content range: [%d-%d], expected [%d-%d]", start, end, off, off+size-1)
+	}
+	return copyPart(f, resp.Body, off, size)
+}
+
+// copyPart copies exactly size bytes from r to the file at a given offset.
+func copyPart(f *os.File, r io.Reader, off, size uint64) error {
+	n, err := io.Copy(&offsetWriter{f: f, off: int64(off)}, io.LimitReader(r, int64(size)))
+	if err != nil {
+		return err
+	} else if uint64(n) != size {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// verifyFile checks that the file content matches the expected ref and rewinds the file.
+func verifyFile(f *os.File, exp types.SizedRef) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	sr, err := types.Hash(f)
+	if err != nil {
+		return err
+	}
+	if sr.Size != exp.Size {
+		return storage.ErrSizeMissmatch{Exp: exp.Size, Got: sr.Size}
+	} else if sr.Ref != exp.Ref {
+		return storage.ErrRefMissmatch{Exp: exp.Ref, Got: sr.Ref}
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// tempFile is a temporary file that is removed on Close.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
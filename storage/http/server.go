@@ -1,33 +1,124 @@
 package httpstor
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/dennwc/cas/sched"
 	"github.com/dennwc/cas/storage"
 	"github.com/dennwc/cas/types"
 )
 
-// NewServer creates a CAS HTTP server for a given URL path.
+const (
+	hdrRef      = "X-CAS-Ref"
+	hdrExpRef   = "X-CAS-Expected-Ref"
+	hdrSize     = "X-CAS-Size"
+	hdrExpSize  = "X-CAS-Expected-Size"
+	hdrError    = "X-CAS-Error"
+	hdrPriority = "X-CAS-Priority"
+	errRefMiss  = "ref-mismatch"
+	errSizeMiss = "size-mismatch"
+	errPolicy   = "policy"
+
+	defaultBufferSize = 64 * 1024
+	// minRedirectSize is the minimal size of the blob that will be served with a redirect.
+	minRedirectSize = 4 * 1024
+)
+
+// ServerOptions configures optional features of the CAS HTTP server.
+type ServerOptions struct {
+	// Writable allows clients to upload blobs with PUT requests.
+	// Uploaded blobs are verified before they become visible in the storage.
+	Writable bool
+	// BufferSize is the size of the buffer used to stream uploads to the storage.
+	// Uploads are never buffered in memory as a whole.
+	BufferSize int
+	// Compression enables transfer compression for clients that accept it. Zstd is preferred over gzip.
+	// Blobs that are already compressed are always sent as-is.
+	Compression bool
+	// Scheduler limits the number of concurrent storage operations and shares them fairly between clients.
+	// Clients are identified by their network address. Priority of operations is set by clients.
+	Scheduler *sched.Scheduler
+	// RedirectTTL enables redirects to pre-signed backend URLs for blob downloads. Blob content is fetched
+	// directly from the backend, offloading the bandwidth from the server. Signed URLs are valid for a given
+	// duration. Redirects are only used if the storage supports signed URLs (see storage.BlobSigner).
+	RedirectTTL time.Duration
+	// Limits sets limits on concurrency and throughput of blob reads and writes (see storage.Limit).
+	Limits *storage.LimitOptions
+	// Metrics records storage operations performed by the server (see storage.Instrument).
+	// The server doesn't expose the metrics, they should be served separately.
+	Metrics *storage.Metrics
+	// Policy rejects uploaded blobs that violate the rules (see storage.WithPolicy).
+	// Rejected uploads are answered with 403 Forbidden.
+	Policy *storage.Policy
+}
+
+// NewServer creates a read-only CAS HTTP server for a given URL path.
 func NewServer(s storage.Storage, urlPref string) http.Handler {
+	return NewServerWithOptions(s, urlPref, ServerOptions{})
+}
+
+// NewServerWithOptions creates a CAS HTTP server for a given URL path.
+func NewServerWithOptions(s storage.Storage, urlPref string, opts ServerOptions) http.Handler {
 	urlPref = strings.TrimSuffix(urlPref, "/")
-	return &server{s: s, pref: urlPref}
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultBufferSize
+	}
+	sign, _ := s.(storage.BlobSigner)
+	// wrappers implement BlobOpener for any storage, thus check the original one
+	_, ranges := s.(storage.BlobOpener)
+	if opts.Metrics != nil {
+		s = storage.Instrument(s, opts.Metrics)
+	}
+	if opts.Scheduler != nil {
+		s = storage.NewScheduled(s, opts.Scheduler)
+	}
+	if opts.Limits != nil {
+		s = storage.Limit(s, *opts.Limits)
+	}
+	if opts.Policy != nil {
+		s = storage.WithPolicy(s, *opts.Policy)
+	}
+	return &server{s: s, sign: sign, ranges: ranges, pref: urlPref, opts: opts}
 }
 
 type server struct {
-	s    storage.Storage
-	pref string
+	s      storage.Storage
+	sign   storage.BlobSigner
+	ranges bool // storage implements storage.BlobOpener
+	pref   string
+	opts   ServerOptions
+}
+
+func (s *server) allowMethod(m string) bool {
+	switch m {
+	case "GET", "HEAD":
+		return true
+	case "POST":
+		// used for bulk fetches, bulk stats and tree pack uploads; the latter checks if the server is writable
+		return true
+	case "PUT":
+		return s.opts.Writable
+	}
+	return false
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" && r.Method != "HEAD" {
+	if !s.allowMethod(r.Method) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	if s.opts.Scheduler != nil {
+		r = r.WithContext(clientContext(r))
+	}
 	path := strings.TrimPrefix(r.URL.Path, s.pref)
 	path = strings.Trim(path, "/")
 	sub := strings.SplitN(path, "/", 3)
@@ -36,7 +127,10 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	sub = sub[1:]
 	switch kind {
 	case "blobs":
-		if len(sub) == 0 {
+		if len(sub) == 0 && r.Method == "POST" {
+			s.serveBulk(w, r)
+			return
+		} else if len(sub) == 0 {
 			s.serveBlobsList(w, r)
 			return
 		} else if len(sub) != 1 {
@@ -61,10 +155,34 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		s.servePin(w, r, sub[0])
 		return
+	case "pack":
+		s.servePack(w, r, sub)
+		return
+	case "stat":
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveStat(w, r)
+		return
 	}
 	w.WriteHeader(http.StatusForbidden)
 }
 
+// clientContext annotates the request context with the client ID and the priority of the request.
+func clientContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ctx = sched.WithClient(ctx, host)
+	if p, err := sched.ParsePriority(r.Header.Get(hdrPriority)); err == nil {
+		ctx = sched.WithPriority(ctx, p)
+	}
+	return ctx
+}
+
 func (s *server) serveIter(w http.ResponseWriter, r *http.Request, it storage.BaseIterator, item func(storage.BaseIterator) interface{}) {
 	defer it.Close()
 	if r.Method != "GET" {
@@ -88,7 +206,7 @@ func (s *server) serveIter(w http.ResponseWriter, r *http.Request, it storage.Ba
 }
 
 func (s *server) serveBlobsList(w http.ResponseWriter, r *http.Request) {
-	it := s.s.IterateBlobs(r.Context())
+	it := storage.IterateBlobsPrefix(r.Context(), s.s, r.URL.Query().Get("prefix"))
 	defer it.Close()
 	s.serveIter(w, r, it, func(it storage.BaseIterator) interface{} {
 		return it.(storage.Iterator).SizedRef()
@@ -96,11 +214,18 @@ func (s *server) serveBlobsList(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) serveBlob(w http.ResponseWriter, r *http.Request, ref types.Ref) {
-	if r.Method != "GET" && r.Method != "HEAD" {
+	if r.Method == "PUT" && s.opts.Writable {
+		s.putBlob(w, r, ref)
+		return
+	} else if r.Method != "GET" && r.Method != "HEAD" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 	// TODO: handle If-None-Match and write ETag for non-CAS clients
+	if s.opts.Writable && s.opts.Compression {
+		// advertise that uploads can be compressed (RFC 7694)
+		w.Header().Set("Accept-Encoding", encodingsList)
+	}
 	switch r.Method {
 	case "HEAD":
 		sz, err := s.s.StatBlob(r.Context(), ref)
@@ -113,10 +238,24 @@ func (s *server) serveBlob(w http.ResponseWriter, r *http.Request, ref types.Ref
 			return
 		}
 		w.Header().Set("Content-Length", strconv.FormatUint(sz, 10))
-		w.Header().Set("X-CAS-Ref", ref.String())
+		w.Header().Set(hdrSize, strconv.FormatUint(sz, 10))
+		w.Header().Set(hdrRef, ref.String())
 		return
 	case "GET":
-		rc, sz, err := s.s.FetchBlob(r.Context(), ref)
+		if s.opts.RedirectTTL > 0 && s.redirectBlob(w, r, ref) {
+			return
+		}
+		var (
+			rc  io.ReadCloser
+			sz  uint64
+			err error
+		)
+		// ranges of blobs from remote backends are fetched without downloading the whole blob
+		if s.ranges && r.Header.Get("Range") != "" {
+			rc, sz, err = storage.OpenBlob(r.Context(), s.s, ref)
+		} else {
+			rc, sz, err = s.s.FetchBlob(r.Context(), ref)
+		}
 		if err == storage.ErrNotFound {
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -126,14 +265,233 @@ func (s *server) serveBlob(w http.ResponseWriter, r *http.Request, ref types.Ref
 			return
 		}
 		defer rc.Close()
+		w.Header().Set(hdrSize, strconv.FormatUint(sz, 10))
+		w.Header().Set(hdrRef, ref.String())
+		if rs, ok := rc.(io.ReadSeeker); ok {
+			w.Header().Set("Accept-Ranges", "bytes")
+			if r.Header.Get("Range") != "" {
+				// blobs are immutable, so the ref is a perfect ETag for If-Range
+				w.Header().Set("ETag", `"`+ref.String()+`"`)
+				http.ServeContent(w, r, "", time.Time{}, rs)
+				return
+			}
+		}
+		var body io.Reader = rc
+		f, isFile := storage.BlobFile(rc)
+		if enc := pickEncoding(r.Header); s.opts.Compression && sz >= minCompressSize && enc != "" {
+			w.Header().Add("Vary", "Accept-Encoding")
+			var compress bool
+			if isFile {
+				// the file is only read in user space if it's compressed
+				compress = sniffFile(f)
+			} else {
+				body, compress = sniffReader(body)
+			}
+			if compress {
+				w.Header().Set("Content-Encoding", enc)
+				zw := newEncoder(w, enc)
+				if _, err = io.Copy(zw, body); err == nil {
+					zw.Close()
+				}
+				return
+			}
+		}
 		w.Header().Set("Content-Length", strconv.FormatUint(sz, 10))
-		w.Header().Set("X-CAS-Ref", ref.String())
-		_, _ = io.Copy(w, rc)
+		if rf, ok := w.(io.ReaderFrom); ok && isFile {
+			// blobs of local stores are sent with sendfile, if the connection supports it
+			_, _ = rf.ReadFrom(f)
+			return
+		}
+		_, _ = io.Copy(w, body)
 		return
 	}
 	w.WriteHeader(http.StatusMethodNotAllowed)
 }
 
+// redirectBlob answers the request with a redirect to a pre-signed URL of the blob.
+// It returns false if the blob should be served directly.
+func (s *server) redirectBlob(w http.ResponseWriter, r *http.Request, ref types.Ref) bool {
+	if s.sign == nil {
+		return false
+	}
+	ctx := r.Context()
+	sz, err := s.s.StatBlob(ctx, ref)
+	if err == storage.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return true
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return true
+	} else if sz < minRedirectSize {
+		// not worth an additional round trip
+		return false
+	}
+	u, err := s.sign.SignBlobURL(ctx, ref, s.opts.RedirectTTL)
+	if err == storage.ErrNotSupported {
+		return false
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return true
+	}
+	w.Header().Set(hdrSize, strconv.FormatUint(sz, 10))
+	w.Header().Set(hdrRef, ref.String())
+	// signed URLs expire, thus the redirect cannot be cached
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+	return true
+}
+
+// writeMismatch reports a typed mismatch error to the client.
+func writeMismatch(w http.ResponseWriter, err error) {
+	switch err := err.(type) {
+	case storage.ErrRefMissmatch:
+		w.Header().Set(hdrError, errRefMiss)
+		w.Header().Set(hdrExpRef, err.Exp.String())
+		w.Header().Set(hdrRef, err.Got.String())
+	case storage.ErrSizeMissmatch:
+		w.Header().Set(hdrError, errSizeMiss)
+		w.Header().Set(hdrExpSize, strconv.FormatUint(err.Exp, 10))
+		w.Header().Set(hdrSize, strconv.FormatUint(err.Got, 10))
+	}
+	w.WriteHeader(http.StatusConflict)
+	w.Write([]byte(err.Error()))
+}
+
+// writePolicy reports that the blob was rejected by the policy.
+func writePolicy(w http.ResponseWriter, err storage.ErrPolicy) {
+	w.Header().Set(hdrError, errPolicy)
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte(err.Reason))
+}
+
+// writeStoreFull reports that the storage has reached its size limit.
+func writeStoreFull(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusInsufficientStorage)
+	w.Write([]byte(storage.ErrStoreFull.Error()))
+}
+
+// putBlob stores a blob with an expected ref. The content is streamed to the storage,
+// and the blob is only committed if the hash of the content matches the ref.
+func (s *server) putBlob(w http.ResponseWriter, r *http.Request, ref types.Ref) {
+	ctx := r.Context()
+	defer r.Body.Close()
+
+	var body io.Reader = r.Body
+	// the client may declare the size separately from the Content-Length
+	size := r.ContentLength
+	switch enc := r.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+	case encGzip, encZstd:
+		if !s.opts.Compression {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		zr, err := newDecoder(body, enc)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		defer zr.Close()
+		body = zr
+		// Content-Length describes the compressed content
+		size = -1
+	default:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	if v := r.Header.Get(hdrSize); v != "" {
+		sz, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if size >= 0 && uint64(size) != sz {
+			writeMismatch(w, storage.ErrSizeMissmatch{Exp: sz, Got: uint64(size)})
+			return
+		}
+		size = int64(sz)
+	}
+	if p := s.opts.Policy; p != nil && p.MaxSize != 0 && size > int64(p.MaxSize) {
+		writePolicy(w, storage.ErrPolicy{Ref: ref, Reason: fmt.Sprintf("blob is larger than %d bytes", p.MaxSize)})
+		return
+	}
+
+	// blobs are immutable, so there is no need to read the content if we have it already
+	sz, err := s.s.StatBlob(ctx, ref)
+	if err == nil {
+		if size >= 0 && uint64(size) != sz {
+			writeMismatch(w, storage.ErrSizeMissmatch{Exp: sz, Got: uint64(size)})
+			return
+		}
+		w.Header().Set(hdrRef, ref.String())
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if err != storage.ErrNotFound {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	bw, err := s.s.BeginBlob(ctx)
+	if err == storage.ErrStoreFull {
+		writeStoreFull(w)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	defer bw.Close()
+
+	if size >= 0 {
+		// read one more byte to detect if the body is larger than declared
+		body = io.LimitReader(body, size+1)
+	}
+	buf := make([]byte, s.opts.BufferSize)
+	if _, err = io.CopyBuffer(bw, body, buf); err != nil {
+		if e, ok := err.(storage.ErrPolicy); ok {
+			writePolicy(w, e)
+			return
+		} else if err == storage.ErrStoreFull {
+			writeStoreFull(w)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	sr, err := bw.Complete()
+	if e, ok := err.(storage.ErrPolicy); ok {
+		writePolicy(w, e)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if size >= 0 && sr.Size != uint64(size) {
+		writeMismatch(w, storage.ErrSizeMissmatch{Exp: uint64(size), Got: sr.Size})
+		return
+	} else if sr.Ref != ref {
+		writeMismatch(w, storage.ErrRefMissmatch{Exp: ref, Got: sr.Ref})
+		return
+	}
+	if err = bw.Commit(); err == storage.ErrStoreFull {
+		writeStoreFull(w)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set(hdrRef, ref.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
 func (s *server) servePinsList(w http.ResponseWriter, r *http.Request) {
 	it := s.s.IteratePins(r.Context())
 	defer it.Close()
@@ -156,7 +514,7 @@ func (s *server) servePin(w http.ResponseWriter, r *http.Request, name string) {
 		w.Write([]byte(err.Error()))
 		return
 	}
-	w.Header().Set("X-CAS-Ref", ref.String())
+	w.Header().Set(hdrRef, ref.String())
 	// TODO: handle If-None-Match and write ETag for non-CAS clients
 	switch r.Method {
 	case "HEAD":
@@ -12,7 +12,7 @@ import (
 // NewBlobIndexer emulates a blob indexer on top of a base storage.
 // It will first try to cast the storage directly, and in case of failure it will
 // provide an "index" by iterating over all blobs and filtering them.
-func NewBlobIndexer(s BlobStorage) BlobIndexer {
+func NewBlobIndexer(s BlobSource) BlobIndexer {
 	if ind, ok := s.(BlobIndexer); ok {
 		return ind
 	}
@@ -20,7 +20,7 @@ func NewBlobIndexer(s BlobStorage) BlobIndexer {
 }
 
 type emulatedIndexer struct {
-	s BlobStorage
+	s BlobSource
 }
 
 func (s *emulatedIndexer) FetchSchema(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
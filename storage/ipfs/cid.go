@@ -0,0 +1,115 @@
+package ipfs
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/dennwc/cas/types"
+)
+
+const (
+	cidV1 = 1
+
+	codecRaw = 0x55
+
+	mhSha256 = 0x12
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// RefToCID converts a CAS ref to an IPFS content identifier.
+//
+// Blobs are stored as IPFS blocks with the raw codec, thus the CID is a CIDv1
+// with the same hash as the ref, encoded in base32.
+func RefToCID(ref types.Ref) (string, error) {
+	if ref.Name() != types.DefaultHash {
+		return "", fmt.Errorf("unsupported ref type: %q", ref.Name())
+	}
+	dig := ref.Digest()
+	buf := make([]byte, 0, 4+len(dig))
+	buf = appendUvarint(buf, cidV1)
+	buf = appendUvarint(buf, codecRaw)
+	buf = appendUvarint(buf, mhSha256)
+	buf = appendUvarint(buf, uint64(len(dig)))
+	buf = append(buf, dig...)
+	return "b" + strings.ToLower(b32.EncodeToString(buf)), nil
+}
+
+// CIDToRef converts an IPFS content identifier to a CAS ref.
+//
+// Since the hash of an IPFS block is computed over the encoded block content, the codec of
+// the CID is ignored. Only SHA-256 multihashes are supported.
+func CIDToRef(cid string) (types.Ref, error) {
+	var mh []byte
+	if len(cid) == 46 && strings.HasPrefix(cid, "Qm") {
+		// CIDv0 is a base58 encoded multihash
+		data, err := decodeBase58(cid)
+		if err != nil {
+			return types.Ref{}, err
+		}
+		mh = data
+	} else {
+		if !strings.HasPrefix(cid, "b") {
+			return types.Ref{}, fmt.Errorf("unsupported CID encoding: %q", cid)
+		}
+		data, err := b32.DecodeString(strings.ToUpper(cid[1:]))
+		if err != nil {
+			return types.Ref{}, fmt.Errorf("invalid CID: %v", err)
+		}
+		vers, n := binary.Uvarint(data)
+		if n <= 0 || vers != cidV1 {
+			return types.Ref{}, fmt.Errorf("unsupported CID version: %q", cid)
+		}
+		data = data[n:]
+		if _, n = binary.Uvarint(data); n <= 0 {
+			return types.Ref{}, fmt.Errorf("invalid CID codec: %q", cid)
+		}
+		mh = data[n:]
+	}
+	typ, n := binary.Uvarint(mh)
+	if n <= 0 {
+		return types.Ref{}, errors.New("invalid multihash")
+	} else if typ != mhSha256 {
+		return types.Ref{}, fmt.Errorf("unsupported multihash type: %x", typ)
+	}
+	mh = mh[n:]
+	sz, n := binary.Uvarint(mh)
+	if n <= 0 || uint64(len(mh)-n) != sz {
+		return types.Ref{}, errors.New("invalid multihash")
+	}
+	return types.RefFromDigest(types.DefaultHash, mh[n:])
+}
+
+func appendUvarint(p []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(p, buf[:n]...)
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func decodeBase58(s string) ([]byte, error) {
+	v := new(big.Int)
+	base := big.NewInt(58)
+	for _, c := range s {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid base58 character: %q", c)
+		}
+		v.Mul(v, base)
+		v.Add(v, big.NewInt(int64(i)))
+	}
+	out := v.Bytes()
+	// leading zeros are encoded as '1'
+	for _, c := range s {
+		if c != '1' {
+			break
+		}
+		out = append([]byte{0}, out...)
+	}
+	return out, nil
+}
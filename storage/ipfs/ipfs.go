@@ -0,0 +1,519 @@
+// Package ipfs implements a CAS storage on top of the IPFS node API.
+//
+// Blobs are stored as raw IPFS blocks, thus CAS refs map directly to IPFS CIDs (see RefToCID).
+// Content stored with this package can be announced and fetched over the IPFS network,
+// and vice versa. Pins are stored as small files in the IPFS mutable filesystem (MFS).
+//
+// Other nodes don't exchange blocks larger than MaxBlockSize, thus larger blobs are rejected.
+// Large files should be stored split into parts (see cas.SplitConfig).
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+var (
+	_ storage.Storage     = (*Storage)(nil)
+	_ storage.BlobDeleter = (*Storage)(nil)
+)
+
+// ErrBlockTooLarge is returned when a blob is larger than MaxBlockSize.
+var ErrBlockTooLarge = errors.New("ipfs: blob is larger than the maximal block size (1 MiB); store it split into parts")
+
+const (
+	// MaxBlockSize is the maximal size of a blob accepted by the storage. It's the largest block
+	// that IPFS nodes exchange over bitswap.
+	MaxBlockSize = 1 << 20
+
+	// DefaultAPI is the default address of the IPFS node API.
+	DefaultAPI = "http://127.0.0.1:5001"
+	// DefaultPinsDir is the default MFS directory for CAS pins.
+	DefaultPinsDir = "/cas/pins"
+)
+
+func init() {
+	storage.RegisterConfig("ipfs:ClientConfig", &Config{})
+}
+
+type Config struct {
+	// API is the address of the IPFS node API. DefaultAPI is used if not set.
+	API string `json:"api,omitempty"`
+	// PinsDir is the MFS directory used to store CAS pins. DefaultPinsDir is used if not set.
+	PinsDir string `json:"pins_dir,omitempty"`
+	// Offline disables fetching blocks from the IPFS network.
+	Offline bool `json:"offline,omitempty"`
+
+	storage.ConnConfig
+}
+
+func (c *Config) References() []types.Ref {
+	return nil
+}
+
+func (c *Config) OpenStorage(ctx context.Context) (storage.Storage, error) {
+	s, err := New(c.API)
+	if err != nil {
+		return nil, err
+	}
+	if c.PinsDir != "" {
+		s.pins = path.Clean(c.PinsDir)
+	}
+	s.offline = c.Offline
+	s.cli = c.HTTPClient()
+	return s, nil
+}
+
+// New creates a storage that uses the IPFS node API at a given address.
+// If the address is empty, DefaultAPI is used.
+func New(api string) (*Storage, error) {
+	if api == "" {
+		api = DefaultAPI
+	}
+	if _, err := url.Parse(api); err != nil {
+		return nil, err
+	}
+	return &Storage{
+		api:  strings.TrimSuffix(api, "/") + "/api/v0/",
+		cli:  http.DefaultClient,
+		pins: DefaultPinsDir,
+	}, nil
+}
+
+// Storage is a CAS storage backed by an IPFS node.
+type Storage struct {
+	api     string
+	cli     *http.Client
+	pins    string
+	offline bool
+}
+
+// SetHTTPClient allows to set a custom HTTP client that will be used to send requests.
+func (s *Storage) SetHTTPClient(cli *http.Client) {
+	s.cli = cli
+}
+
+func (s *Storage) Close() error { return nil }
+
+// apiError is an error returned by the IPFS node.
+type apiError struct {
+	Message string
+	Code    int
+}
+
+func (e *apiError) Error() string {
+	return "ipfs: " + e.Message
+}
+
+// isNotFound checks if the error returned by the node indicates that a block or file doesn't exist.
+func isNotFound(err error) bool {
+	e, ok := err.(*apiError)
+	if !ok {
+		return false
+	}
+	msg := strings.ToLower(e.Message)
+	return strings.Contains(msg, "not found") || strings.Contains(msg, "does not exist") ||
+		strings.Contains(msg, "no link named")
+}
+
+// call sends a request to the IPFS node API. Caller must close the response body.
+func (s *Storage) call(ctx context.Context, cmd string, args url.Values, body io.Reader, ctype string) (io.ReadCloser, error) {
+	if args == nil {
+		args = make(url.Values)
+	}
+	if s.offline {
+		args.Set("offline", "true")
+	}
+	req, err := http.NewRequest("POST", s.api+cmd+"?"+args.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if ctype != "" {
+		req.Header.Set("Content-Type", ctype)
+	}
+	resp, err := s.cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+	var e apiError
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Message == "" {
+		return nil, fmt.Errorf("ipfs: unexpected status code on %s: %v", cmd, resp.Status)
+	}
+	return nil, &e
+}
+
+// callJSON is similar to call, but decodes the response as JSON.
+func (s *Storage) callJSON(ctx context.Context, cmd string, args url.Values, out interface{}) error {
+	rc, err := s.call(ctx, cmd, args, nil, "")
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(rc).Decode(out)
+}
+
+// callFile sends the content of the reader as a multipart file.
+func (s *Storage) callFile(ctx context.Context, cmd string, args url.Values, r io.Reader, out interface{}) error {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		fw, err := mw.CreateFormFile("file", "blob")
+		if err == nil {
+			_, err = io.Copy(fw, r)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	rc, err := s.call(ctx, cmd, args, pr, mw.FormDataContentType())
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(rc).Decode(out)
+}
+
+func cidArgs(ref types.Ref) (url.Values, error) {
+	if ref.Zero() {
+		return nil, storage.ErrInvalidRef
+	}
+	cid, err := RefToCID(ref)
+	if err != nil {
+		return nil, err
+	}
+	return url.Values{"arg": {cid}}, nil
+}
+
+func (s *Storage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	args, err := cidArgs(ref)
+	if err != nil {
+		return 0, err
+	}
+	var resp struct {
+		Size uint64
+	}
+	err = s.callJSON(ctx, "block/stat", args, &resp)
+	if isNotFound(err) {
+		return 0, storage.ErrNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	return resp.Size, nil
+}
+
+func (s *Storage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	sz, err := s.StatBlob(ctx, ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	args, _ := cidArgs(ref)
+	rc, err := s.call(ctx, "block/get", args, nil, "")
+	if isNotFound(err) {
+		return nil, 0, storage.ErrNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	// node verifies blocks it receives from the network, but we still check the content, since it's cheap
+	return storage.VerifyReader(rc, ref), sz, nil
+}
+
+// DeleteBlob removes the block from the local IPFS node. The block may still be available from other nodes.
+func (s *Storage) DeleteBlob(ctx context.Context, ref types.Ref) error {
+	args, err := cidArgs(ref)
+	if err != nil {
+		return err
+	}
+	// block must be unpinned before removal
+	_ = s.callJSON(ctx, "pin/rm", args, nil)
+	var resp struct {
+		Error string
+	}
+	err = s.callJSON(ctx, "block/rm", args, &resp)
+	if err == nil && resp.Error != "" {
+		err = &apiError{Message: resp.Error}
+	}
+	if isNotFound(err) {
+		return storage.ErrNotFound
+	}
+	return err
+}
+
+// BeginBlob starts a new blob upload. The blob is only sent to the node on Commit.
+// Writes fail with ErrBlockTooLarge as soon as the blob exceeds MaxBlockSize.
+func (s *Storage) BeginBlob(ctx context.Context) (storage.BlobWriter, error) {
+	var lim blockLimit
+	return storage.Spool("cas_ipfs_", &lim, func(sr types.SizedRef, f *os.File) error {
+		return s.putBlock(ctx, sr, f)
+	})
+}
+
+// blockLimit counts bytes written to the blob and fails when it exceeds MaxBlockSize.
+type blockLimit uint64
+
+func (n *blockLimit) Write(p []byte) (int, error) {
+	*n += blockLimit(len(p))
+	if *n > MaxBlockSize {
+		return 0, ErrBlockTooLarge
+	}
+	return len(p), nil
+}
+
+// putBlock stores the blob as a raw block and pins it on the node, so it is not garbage collected.
+func (s *Storage) putBlock(ctx context.Context, sr types.SizedRef, r io.Reader) error {
+	exp, err := RefToCID(sr.Ref)
+	if err != nil {
+		return err
+	}
+	args := url.Values{
+		"cid-codec": {"raw"},
+		"mhtype":    {"sha2-256"},
+		"pin":       {"true"},
+	}
+	var resp struct {
+		Key  string
+		Size uint64
+	}
+	if err = s.callFile(ctx, "block/put", args, r, &resp); err != nil {
+		return err
+	}
+	if resp.Key != exp {
+		got, err := CIDToRef(resp.Key)
+		if err != nil {
+			return fmt.Errorf("ipfs: unexpected CID: %q", resp.Key)
+		} else if got != sr.Ref {
+			return storage.ErrRefMissmatch{Exp: sr.Ref, Got: got}
+		}
+	}
+	return nil
+}
+
+// IterateBlobs lists all blocks stored on the local IPFS node.
+// Blocks that use hashes not supported by CAS are skipped.
+func (s *Storage) IterateBlobs(ctx context.Context) storage.Iterator {
+	return &blobIterator{s: s, ctx: ctx}
+}
+
+type blobIterator struct {
+	s   *Storage
+	ctx context.Context
+
+	rc     io.ReadCloser
+	dec    *json.Decoder
+	seen   map[types.Ref]struct{}
+	cur    types.SizedRef
+	err    error
+	closed bool
+}
+
+func (it *blobIterator) Next() bool {
+	if it.err != nil || it.closed {
+		return false
+	}
+	if it.dec == nil {
+		rc, err := it.s.call(it.ctx, "refs/local", nil, nil, "")
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.rc = rc
+		it.dec = json.NewDecoder(rc)
+		it.seen = make(map[types.Ref]struct{})
+	}
+	for {
+		var e struct {
+			Ref string
+			Err string
+		}
+		if err := it.dec.Decode(&e); err == io.EOF {
+			return false
+		} else if err != nil {
+			it.err = err
+			return false
+		} else if e.Err != "" {
+			it.err = &apiError{Message: e.Err}
+			return false
+		}
+		ref, err := CIDToRef(e.Ref)
+		if err != nil {
+			continue
+		}
+		// blocks with different codecs may share the same hash
+		if _, ok := it.seen[ref]; ok {
+			continue
+		}
+		it.seen[ref] = struct{}{}
+		sz, err := it.s.StatBlob(it.ctx, ref)
+		if err == storage.ErrNotFound {
+			continue
+		} else if err != nil {
+			it.err = err
+			return false
+		}
+		it.cur = types.SizedRef{Ref: ref, Size: sz}
+		return true
+	}
+}
+
+func (it *blobIterator) Err() error {
+	return it.err
+}
+
+func (it *blobIterator) Close() error {
+	if it.rc != nil {
+		it.rc.Close()
+		it.rc = nil
+	}
+	it.closed = true
+	return nil
+}
+
+func (it *blobIterator) SizedRef() types.SizedRef {
+	return it.cur
+}
+
+func (s *Storage) pinPath(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "/\x00") || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid pin name: %q", name)
+	}
+	return path.Join(s.pins, name), nil
+}
+
+func (s *Storage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	p, err := s.pinPath(name)
+	if err != nil {
+		return err
+	}
+	args := url.Values{
+		"arg":      {p},
+		"create":   {"true"},
+		"parents":  {"true"},
+		"truncate": {"true"},
+	}
+	return s.callFile(ctx, "files/write", args, strings.NewReader(ref.String()), nil)
+}
+
+func (s *Storage) DeletePin(ctx context.Context, name string) error {
+	p, err := s.pinPath(name)
+	if err != nil {
+		return err
+	}
+	err = s.callJSON(ctx, "files/rm", url.Values{"arg": {p}}, nil)
+	if isNotFound(err) {
+		return storage.ErrNotFound
+	}
+	return err
+}
+
+func (s *Storage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	p, err := s.pinPath(name)
+	if err != nil {
+		return types.Ref{}, err
+	}
+	rc, err := s.call(ctx, "files/read", url.Values{"arg": {p}}, nil, "")
+	if isNotFound(err) {
+		return types.Ref{}, storage.ErrNotFound
+	} else if err != nil {
+		return types.Ref{}, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return types.Ref{}, err
+	}
+	return types.ParseRef(string(bytes.TrimSpace(data)))
+}
+
+func (s *Storage) IteratePins(ctx context.Context) storage.PinIterator {
+	return &pinIterator{s: s, ctx: ctx}
+}
+
+type pinIterator struct {
+	s   *Storage
+	ctx context.Context
+
+	names []string
+	cur   types.Pin
+	err   error
+}
+
+func (it *pinIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.names == nil {
+		var resp struct {
+			Entries []struct {
+				Name string
+			}
+		}
+		err := it.s.callJSON(it.ctx, "files/ls", url.Values{"arg": {it.s.pins}}, &resp)
+		if isNotFound(err) {
+			it.err = io.EOF
+			return false
+		} else if err != nil {
+			it.err = err
+			return false
+		}
+		it.names = []string{}
+		for _, e := range resp.Entries {
+			it.names = append(it.names, e.Name)
+		}
+	}
+	for len(it.names) > 0 {
+		name := it.names[0]
+		it.names = it.names[1:]
+		ref, err := it.s.GetPin(it.ctx, name)
+		if err == storage.ErrNotFound {
+			continue
+		} else if err != nil {
+			it.err = err
+			return false
+		}
+		it.cur = types.Pin{Name: name, Ref: ref}
+		return true
+	}
+	return false
+}
+
+func (it *pinIterator) Err() error {
+	if it.err == io.EOF {
+		return nil
+	}
+	return it.err
+}
+
+func (it *pinIterator) Close() error {
+	it.names = []string{}
+	return nil
+}
+
+func (it *pinIterator) Pin() types.Pin {
+	return it.cur
+}
@@ -0,0 +1,187 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/test"
+	"github.com/dennwc/cas/types"
+)
+
+func TestCID(t *testing.T) {
+	empty := types.BytesRef(nil)
+	cid, err := RefToCID(empty)
+	require.NoError(t, err)
+	require.Equal(t, "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku", cid)
+
+	ref, err := CIDToRef(cid)
+	require.NoError(t, err)
+	require.Equal(t, empty, ref)
+
+	// CIDv0 of an empty UnixFS directory
+	ref, err = CIDToRef("QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn")
+	require.NoError(t, err)
+	require.Equal(t, types.BytesRef([]byte{0x0a, 0x02, 0x08, 0x01}), ref)
+}
+
+// fakeNode implements a subset of the IPFS node API used by the storage.
+type fakeNode struct {
+	mu     sync.Mutex
+	blocks map[string][]byte
+	files  map[string][]byte
+}
+
+func newFakeNode() *fakeNode {
+	return &fakeNode{
+		blocks: make(map[string][]byte),
+		files:  make(map[string][]byte),
+	}
+}
+
+func (n *fakeNode) fail(w http.ResponseWriter, msg string) {
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(apiError{Message: msg})
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	arg := r.URL.Query().Get("arg")
+	readFile := func() []byte {
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			panic(err)
+		}
+		return data
+	}
+	enc := json.NewEncoder(w)
+	switch strings.TrimPrefix(r.URL.Path, "/api/v0/") {
+	case "block/put":
+		data := readFile()
+		if len(data) > MaxBlockSize && r.URL.Query().Get("allow-big-block") != "true" {
+			n.fail(w, "produced block is over 1MiB: big blocks can't be exchanged with other peers")
+			return
+		}
+		h := sha256.Sum256(data)
+		ref, _ := types.RefFromDigest(types.DefaultHash, h[:])
+		cid, _ := RefToCID(ref)
+		n.blocks[cid] = data
+		enc.Encode(map[string]interface{}{"Key": cid, "Size": len(data)})
+	case "block/stat":
+		data, ok := n.blocks[arg]
+		if !ok {
+			n.fail(w, "block was not found locally (offline): ipld: could not find "+arg)
+			return
+		}
+		enc.Encode(map[string]interface{}{"Key": arg, "Size": len(data)})
+	case "block/get":
+		data, ok := n.blocks[arg]
+		if !ok {
+			n.fail(w, "block was not found locally (offline): ipld: could not find "+arg)
+			return
+		}
+		w.Write(data)
+	case "block/rm":
+		if _, ok := n.blocks[arg]; !ok {
+			enc.Encode(map[string]interface{}{"Hash": arg, "Error": "ipld: could not find " + arg + ": blockstore: block not found"})
+			return
+		}
+		delete(n.blocks, arg)
+		enc.Encode(map[string]interface{}{"Hash": arg})
+	case "pin/rm":
+		enc.Encode(map[string]interface{}{"Pins": []string{arg}})
+	case "refs/local":
+		for cid := range n.blocks {
+			enc.Encode(map[string]interface{}{"Ref": cid, "Err": ""})
+		}
+	case "files/write":
+		n.files[arg] = readFile()
+	case "files/read":
+		data, ok := n.files[arg]
+		if !ok {
+			n.fail(w, "file does not exist")
+			return
+		}
+		w.Write(data)
+	case "files/rm":
+		if _, ok := n.files[arg]; !ok {
+			n.fail(w, "file does not exist")
+			return
+		}
+		delete(n.files, arg)
+	case "files/ls":
+		var names []string
+		for p := range n.files {
+			if path.Dir(p) == arg {
+				names = append(names, path.Base(p))
+			}
+		}
+		if len(names) == 0 {
+			n.fail(w, "file does not exist")
+			return
+		}
+		sort.Strings(names)
+		type entry struct {
+			Name string
+		}
+		var resp struct {
+			Entries []entry
+		}
+		for _, name := range names {
+			resp.Entries = append(resp.Entries, entry{Name: name})
+		}
+		enc.Encode(resp)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestIPFS(t *testing.T) {
+	storagetest.RunTests(t, func(t testing.TB) (storage.Storage, func()) {
+		hs := httptest.NewServer(newFakeNode())
+		s, err := New(hs.URL)
+		require.NoError(t, err)
+		s.SetHTTPClient(hs.Client())
+		return s, hs.Close
+	})
+}
+
+func TestIPFSBlockSize(t *testing.T) {
+	ctx := context.Background()
+	node := newFakeNode()
+	hs := httptest.NewServer(node)
+	defer hs.Close()
+	s, err := New(hs.URL)
+	require.NoError(t, err)
+	s.SetHTTPClient(hs.Client())
+
+	data := bytes.Repeat([]byte{1}, MaxBlockSize)
+	sr, err := storage.WriteBytes(ctx, s, data)
+	require.NoError(t, err)
+	sz, err := s.StatBlob(ctx, sr.Ref)
+	require.NoError(t, err)
+	require.Equal(t, uint64(MaxBlockSize), sz)
+
+	// blocks that cannot be exchanged with other nodes are rejected before they are sent
+	_, err = storage.WriteBytes(ctx, s, append(data, 2))
+	require.Equal(t, ErrBlockTooLarge, err)
+	require.Len(t, node.blocks, 1)
+}
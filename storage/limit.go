@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/dennwc/cas/sched"
+	"github.com/dennwc/cas/types"
+)
+
+// Limits for a single type of storage operations. Zero values mean no limit.
+type Limits struct {
+	Concurrency int     // maximal number of concurrent operations
+	BytesPerSec float64 // maximal throughput of all operations
+	Burst       int     // maximal burst in bytes; defaults to one second of throughput
+}
+
+func (l Limits) new() *limiter {
+	lim := &limiter{}
+	if l.Concurrency > 0 {
+		lim.sem = make(chan struct{}, l.Concurrency)
+	}
+	if l.BytesPerSec > 0 {
+		burst := l.Burst
+		if burst <= 0 {
+			burst = int(l.BytesPerSec)
+		}
+		lim.bucket = sched.NewTokenBucket(l.BytesPerSec, burst)
+	}
+	return lim
+}
+
+// LimitOptions sets limits for each type of storage operations.
+type LimitOptions struct {
+	Fetch Limits // blob reads
+	Store Limits // blob writes
+}
+
+// Limit wraps the storage and enforces limits on the number of concurrent blob reads and writes,
+// as well as their throughput.
+//
+// Blob readers and writers hold the concurrency slot until they are closed. Other operations
+// are not limited.
+func Limit(s Storage, opts LimitOptions) Storage {
+	return &limitStorage{
+		Storage: s,
+		fetch:   opts.Fetch.new(),
+		store:   opts.Store.new(),
+	}
+}
+
+var (
+	_ BlobOpener     = (*limitStorage)(nil)
+	_ BulkFetcher    = (*limitStorage)(nil)
+	_ BulkStater     = (*limitStorage)(nil)
+	_ PrefixIterator = (*limitStorage)(nil)
+)
+
+type limitStorage struct {
+	Storage
+	fetch *limiter
+	store *limiter
+}
+
+type limiter struct {
+	sem    chan struct{}
+	bucket *sched.TokenBucket
+}
+
+// acquire takes a concurrency slot and returns a function that releases it.
+func (l *limiter) acquire(ctx context.Context) (func(), error) {
+	if l.sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-l.sem })
+	}, nil
+}
+
+// wait blocks until n bytes can be transferred.
+func (l *limiter) wait(ctx context.Context, n int) error {
+	if l.bucket == nil || n == 0 {
+		return nil
+	}
+	return l.bucket.Wait(ctx, n)
+}
+
+func (s *limitStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	release, err := s.fetch.acquire(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	rc, sz, err := s.Storage.FetchBlob(ctx, ref)
+	if err != nil {
+		release()
+		return nil, 0, err
+	}
+	return &limitReader{ReadCloser: rc, ctx: ctx, lim: s.fetch, release: release}, sz, nil
+}
+
+func (s *limitStorage) BeginBlob(ctx context.Context) (BlobWriter, error) {
+	release, err := s.store.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.Storage.BeginBlob(ctx)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &limitWriter{BlobWriter: w, ctx: ctx, lim: s.store, release: release}, nil
+}
+
+// OpenBlob implements BlobOpener. Reads are limited the same way as for FetchBlob.
+func (s *limitStorage) OpenBlob(ctx context.Context, ref types.Ref) (BlobReader, uint64, error) {
+	release, err := s.fetch.acquire(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	br, sz, err := OpenBlob(ctx, s.Storage, ref)
+	if err != nil {
+		release()
+		return nil, 0, err
+	}
+	return &limitBlobReader{
+		limitReader: limitReader{ReadCloser: br, ctx: ctx, lim: s.fetch, release: release},
+		br:          br,
+	}, sz, nil
+}
+
+// FetchBlobs implements BulkFetcher. All blobs are read using a single concurrency slot.
+func (s *limitStorage) FetchBlobs(ctx context.Context, refs []types.Ref) (MultiReader, error) {
+	release, err := s.fetch.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mr, err := FetchBlobs(ctx, s.Storage, refs)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &limitMultiReader{MultiReader: mr, ctx: ctx, lim: s.fetch, release: release}, nil
+}
+
+// StatBlobs implements BulkStater.
+func (s *limitStorage) StatBlobs(ctx context.Context, refs []types.Ref) ([]types.SizedRef, error) {
+	return StatBlobs(ctx, s.Storage, refs)
+}
+
+// IterateBlobsPrefix implements PrefixIterator.
+func (s *limitStorage) IterateBlobsPrefix(ctx context.Context, prefix string) Iterator {
+	return IterateBlobsPrefix(ctx, s.Storage, prefix)
+}
+
+type limitReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	lim     *limiter
+	release func()
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if werr := r.lim.wait(r.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+func (r *limitReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.release()
+	return err
+}
+
+// File implements Filer. The file is not exposed if the throughput is limited, since reads from it
+// would bypass the limit.
+func (r *limitReader) File() *os.File {
+	if r.lim.bucket != nil {
+		return nil
+	}
+	f, _ := BlobFile(r.ReadCloser)
+	return f
+}
+
+type limitBlobReader struct {
+	limitReader
+	br BlobReader
+}
+
+func (r *limitBlobReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.br.ReadAt(p, off)
+	if werr := r.lim.wait(r.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+func (r *limitBlobReader) Seek(off int64, whence int) (int64, error) {
+	return r.br.Seek(off, whence)
+}
+
+type limitMultiReader struct {
+	MultiReader
+	ctx     context.Context
+	lim     *limiter
+	release func()
+}
+
+func (r *limitMultiReader) Read(p []byte) (int, error) {
+	n, err := r.MultiReader.Read(p)
+	if werr := r.lim.wait(r.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+func (r *limitMultiReader) Close() error {
+	err := r.MultiReader.Close()
+	r.release()
+	return err
+}
+
+type limitWriter struct {
+	BlobWriter
+	ctx     context.Context
+	lim     *limiter
+	release func()
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	if err := w.lim.wait(w.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	return w.BlobWriter.Write(p)
+}
+
+func (w *limitWriter) Commit() error {
+	err := w.BlobWriter.Commit()
+	w.release()
+	return err
+}
+
+func (w *limitWriter) Close() error {
+	err := w.BlobWriter.Close()
+	w.release()
+	return err
+}
@@ -0,0 +1,68 @@
+package local
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+var _ storage.BulkStater = (*Storage)(nil)
+
+// statWorkers is the number of concurrent stat calls made by StatBlobs.
+// Stats are cheap, but the latency adds up for cold caches and network file systems.
+const statWorkers = 8
+
+// StatBlobs implements storage.BulkStater. Blobs are checked concurrently.
+func (s *Storage) StatBlobs(ctx context.Context, refs []types.Ref) ([]types.SizedRef, error) {
+	for _, ref := range refs {
+		if ref.Zero() {
+			return nil, storage.ErrInvalidRef
+		}
+	}
+	var (
+		sizes = make([]uint64, len(refs))
+		found = make([]bool, len(refs))
+		errs  = make([]error, statWorkers)
+		wg    sync.WaitGroup
+	)
+	n := statWorkers
+	if len(refs) < n {
+		n = len(refs)
+	}
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// workers take every n-th ref, thus no coordination is needed
+			for i := w; i < len(refs); i += n {
+				if err := ctx.Err(); err != nil {
+					errs[w] = err
+					return
+				}
+				sz, err := s.StatBlob(ctx, refs[i])
+				if err == storage.ErrNotFound {
+					continue
+				} else if err != nil {
+					errs[w] = err
+					return
+				}
+				sizes[i], found[i] = sz, true
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	out := make([]types.SizedRef, 0, len(refs))
+	for i, ref := range refs {
+		if found[i] {
+			out = append(out, types.SizedRef{Ref: ref, Size: sizes[i]})
+		}
+	}
+	return out, nil
+}
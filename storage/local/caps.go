@@ -0,0 +1,231 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// Caps is a set of file system restrictions of the storage.
+//
+// Capabilities are probed when the storage is opened for writing for the first time, and are recorded
+// in the store metadata. Restrictions that cannot be probed (for example, SELinux policies that only
+// apply to the blobs directory) are detected during blob commits and recorded as well.
+type Caps struct {
+	// NoChmod is set if the file system rejects or ignores changes of file modes (vfat, some network mounts,
+	// restrictive SELinux policies). Blobs are not made read-only in this case.
+	NoChmod bool `json:"nochmod,omitempty"`
+	// NoRename is set if blobs cannot be renamed or linked into the blobs directory. Blobs are copied instead.
+	NoRename bool `json:"norename,omitempty"`
+	// NoTmpFile is set if the file system cannot create anonymous temporary files (O_TMPFILE on Linux).
+	// Blobs are written to named files in the temporary directory instead, which are left there after a crash.
+	NoTmpFile bool `json:"notmpfile,omitempty"`
+}
+
+// ErrBlobMode is reported for blobs that are writable, while the storage keeps blobs read-only.
+type ErrBlobMode struct {
+	Mode os.FileMode
+	Exp  os.FileMode
+}
+
+func (e ErrBlobMode) Error() string {
+	return fmt.Sprintf("blob is writable: mode %v, expected %v", e.Mode, e.Exp)
+}
+
+// isUnsupported checks if the error indicates that the operation is not allowed or not supported
+// by the file system, as opposed to a transient failure.
+func isUnsupported(err error) bool {
+	if os.IsPermission(err) {
+		return true
+	}
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.EPERM || err == syscall.ENOTSUP || err == syscall.EOPNOTSUPP
+}
+
+// Caps returns file system restrictions of the storage.
+func (s *Storage) Caps() Caps {
+	s.capsMu.RLock()
+	defer s.capsMu.RUnlock()
+	return s.caps
+}
+
+// probeCaps detects file system restrictions by changing the mode of a temporary file.
+func (s *Storage) probeCaps() error {
+	f, err := s.tmpFileRaw()
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+
+	err = os.Chmod(name, defBlobPerm)
+	if isUnsupported(err) {
+		s.caps.NoChmod = true
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// file must be writable to be removed on Windows
+	defer os.Chmod(name, defFilePerm)
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	s.caps.NoChmod = fi.Mode().Perm()&0222 != 0
+	return nil
+}
+
+// initCaps loads recorded capabilities, or probes them for stores that have no record.
+func (s *Storage) initCaps(meta *storeMeta) error {
+	if meta.Caps != nil {
+		s.caps = *meta.Caps
+		return nil
+	} else if s.readOnly {
+		return nil
+	}
+	if err := s.probeCaps(); err != nil {
+		return err
+	}
+	m := *meta
+	m.Caps = &s.caps
+	return s.writeMeta(&m)
+}
+
+// metaCaps returns capabilities to be recorded in the store metadata.
+func (s *Storage) metaCaps() *Caps {
+	c := s.Caps()
+	return &c
+}
+
+// degrade records a new restriction of the file system. Errors are ignored, since the restriction
+// will be detected again after the storage is reopened.
+func (s *Storage) degrade(fnc func(c *Caps)) {
+	s.capsMu.Lock()
+	defer s.capsMu.Unlock()
+	fnc(&s.caps)
+	if s.readOnly {
+		return
+	}
+	meta, err := s.readMeta()
+	if err != nil {
+		return
+	}
+	c := s.caps
+	meta.Caps = &c
+	_ = s.writeMeta(meta)
+}
+
+// chmodBlob makes a committed blob read-only, unless the file system doesn't allow it.
+func (s *Storage) chmodBlob(fnc func(mode os.FileMode) error) error {
+	if s.Caps().NoChmod {
+		return nil
+	}
+	err := fnc(s.perms.blob)
+	if err != nil && isUnsupported(err) {
+		s.degrade(func(c *Caps) {
+			c.NoChmod = true
+		})
+		return nil
+	}
+	return err
+}
+
+// placeBlobFile moves a temporary file to the blobs directory with a given function. If the file system
+// doesn't allow renaming or linking the file, the content is copied instead.
+func (s *Storage) placeBlobFile(name string, ref types.Ref, place func() error) error {
+	if !s.Caps().NoRename {
+		err := place()
+		if err == nil || !isUnsupported(err) {
+			return err
+		}
+		s.degrade(func(c *Caps) {
+			c.NoRename = true
+		})
+	}
+	path := s.blobPath(ref)
+	return s.placeBlob(path, func() error {
+		return s.copyFile(path, name)
+	})
+}
+
+// addNotIndexedBlob adds a committed blob to the unindexed list.
+func (s *Storage) addNotIndexedBlob(ref types.Ref) error {
+	path := s.blobPath(ref)
+	dst := filepath.Join(s.dir, dirUnindexed, ref.String())
+	err := s.fs.Link(path, dst)
+	if os.IsExist(err) {
+		return nil
+	} else if err != nil && isUnsupported(err) {
+		return s.copyFile(dst, path)
+	}
+	return err
+}
+
+// copyFile copies the content of a file to a new blob file. The destination is not overwritten if it already exists.
+func (s *Storage) copyFile(dst, src string) error {
+	r, err := s.fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := s.fs.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, s.perms.blob.Perm()|0200)
+	if os.IsExist(err) {
+		// blob is already stored
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = s.syncFile(w)
+	}
+	if err2 := w.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = s.chmodBlob(func(mode os.FileMode) error {
+			return os.Chmod(dst, mode)
+		})
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// CheckBlob checks that the mode of the blob matches the storage permissions.
+// It returns ErrBlobMode if the blob is writable, unless the file system doesn't support file modes.
+func (s *Storage) CheckBlob(ctx context.Context, ref types.Ref) error {
+	if ref.Zero() {
+		return storage.ErrInvalidRef
+	}
+	fi, err := os.Stat(s.blobPath(ref))
+	if os.IsNotExist(err) {
+		return storage.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if s.Caps().NoChmod {
+		// expected deviation
+		return nil
+	}
+	mode := fi.Mode().Perm()
+	if mode&0222&^s.perms.blob != 0 {
+		return ErrBlobMode{Mode: mode, Exp: s.perms.blob.Perm()}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package local
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// FS is a set of file system operations the storage uses to read, write, replace and remove its files.
+// It can be replaced in tests to inject failures, for example to simulate a crash between writing
+// a temporary file and renaming it. See Options.FS.
+//
+// Paths are always absolute or relative to the working directory, as for the os package.
+type FS interface {
+	Open(name string) (*os.File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (*os.File, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	// TempFile creates a new temporary file, see ioutil.TempFile.
+	TempFile(dir, pattern string) (*os.File, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	Link(oldname, newname string) error
+	Mkdir(name string, perm os.FileMode) error
+	Chmod(name string, mode os.FileMode) error
+	// Sync flushes the content of the file to disk.
+	Sync(f *os.File) error
+	// SyncDir flushes directory entries to disk.
+	SyncDir(path string) error
+}
+
+// OSFS returns the file system of the host. It's used by default.
+func OSFS() FS {
+	return osFS{}
+}
+
+type osFS struct{}
+
+func (osFS) Open(name string) (*os.File, error) {
+	return os.Open(name)
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (osFS) TempFile(dir, pattern string) (*os.File, error) {
+	return ioutil.TempFile(dir, pattern)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (osFS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+func (osFS) Sync(f *os.File) error {
+	return f.Sync()
+}
+
+func (osFS) SyncDir(path string) error {
+	return syncDir(path)
+}
+
+// now returns the current time according to the clock of the storage. See Options.Clock.
+func (s *Storage) now() time.Time {
+	if s.clock != nil {
+		return s.clock()
+	}
+	return time.Now()
+}
@@ -0,0 +1,194 @@
+package local
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// Pin history.
+//
+// Each change of a pin is appended to a file with the same name in the history directory. Each line contains
+// the time of the change (Unix time in nanoseconds) and the new ref, or "-" if the pin was deleted:
+//
+//	history/<name>
+//
+// Pins created before the history was kept get their current value recorded before the first change.
+const (
+	dirHistory = "history"
+
+	historyDeleted = "-"
+)
+
+func (s *Storage) historyPath(name string) string {
+	return filepath.Join(s.dir, dirHistory, name)
+}
+
+// updatePin sets the pin and appends the change to the history. Zero ref deletes the pin and its metadata.
+// It should be called with pinMu held.
+func (s *Storage) updatePin(name string, ref types.Ref) error {
+	path := s.historyPath(name)
+	var recs []storage.PinRecord
+	if _, err := s.fs.Stat(path); os.IsNotExist(err) {
+		if rec, err := s.currentPin(name); err == nil {
+			recs = append(recs, rec)
+		}
+	}
+	var err error
+	if ref.Zero() {
+		err = s.fs.Remove(s.pinPath(name))
+	} else {
+		err = s.writePin(name, ref)
+	}
+	if err != nil {
+		return err
+	}
+	err = s.appendHistory(path, append(recs, storage.PinRecord{Ref: ref, Time: s.now()}))
+	if err == nil && ref.Zero() {
+		err = s.deletePinMeta(name)
+	}
+	return err
+}
+
+// currentPin returns the current value of the pin as a history record.
+func (s *Storage) currentPin(name string) (storage.PinRecord, error) {
+	fi, err := s.fs.Stat(s.pinPath(name))
+	if os.IsNotExist(err) {
+		return storage.PinRecord{}, storage.ErrNotFound
+	} else if err != nil {
+		return storage.PinRecord{}, err
+	}
+	ref, err := s.GetPin(context.TODO(), name)
+	if err != nil {
+		return storage.PinRecord{}, err
+	}
+	return storage.PinRecord{Ref: ref, Time: fi.ModTime()}, nil
+}
+
+func (s *Storage) appendHistory(path string, recs []storage.PinRecord) error {
+	if err := s.mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, r := range recs {
+		ref := historyDeleted
+		if !r.Ref.Zero() {
+			ref = r.Ref.String()
+		}
+		fmt.Fprintf(&buf, "%d %s\n", r.Time.UnixNano(), ref)
+	}
+	f, err := s.fs.OpenFile(path, os.O_RDWR|os.O_CREATE, s.perms.file)
+	if err != nil {
+		return err
+	}
+	var off int64
+	if off, err = completeHistory(f); err == nil {
+		_, err = f.WriteAt(buf.Bytes(), off)
+	}
+	if err == nil {
+		err = s.syncFile(f)
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = s.chownGroup(path)
+	}
+	return err
+}
+
+// completeHistory removes an incomplete record left by a crash from the end of the history file.
+// It returns the offset new records should be written at.
+func completeHistory(f *os.File) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return 0, err
+	}
+	var last [1]byte
+	if _, err = f.ReadAt(last[:], fi.Size()-1); err != nil {
+		return 0, err
+	} else if last[0] == '\n' {
+		return fi.Size(), nil
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+	off := int64(bytes.LastIndexByte(data, '\n') + 1)
+	return off, f.Truncate(off)
+}
+
+// AppendPinHistory implements storage.PinHistoryAppender.
+func (s *Storage) AppendPinHistory(ctx context.Context, name string, recs []storage.PinRecord) error {
+	if s.readOnly {
+		return storage.ErrReadOnly
+	} else if len(recs) == 0 {
+		return nil
+	}
+	s.pinMu.Lock()
+	defer s.pinMu.Unlock()
+	path := s.historyPath(name)
+	if _, err := s.fs.Stat(path); os.IsNotExist(err) {
+		// keep the current value, as updatePin does
+		if rec, err := s.currentPin(name); err == nil {
+			recs = append([]storage.PinRecord{rec}, recs...)
+		}
+	}
+	return s.appendHistory(path, recs)
+}
+
+// PinHistory implements storage.PinHistorian.
+func (s *Storage) PinHistory(ctx context.Context, name string) ([]storage.PinRecord, error) {
+	data, err := ioutil.ReadFile(s.historyPath(name))
+	if os.IsNotExist(err) {
+		// pin was never changed since the history is kept
+		rec, err := s.currentPin(name)
+		if err != nil {
+			return nil, err
+		}
+		return []storage.PinRecord{rec}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// the last line might be incomplete after a crash
+	if i := bytes.LastIndexByte(data, '\n'); i+1 != len(data) {
+		data = data[:i+1]
+	}
+	var recs []storage.PinRecord
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Bytes()
+		i := bytes.IndexByte(line, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid history of pin %q: %q", name, line)
+		}
+		ns, err := strconv.ParseInt(string(line[:i]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid history of pin %q: %v", name, err)
+		}
+		rec := storage.PinRecord{Time: time.Unix(0, ns)}
+		if sref := line[i+1:]; string(sref) != historyDeleted {
+			rec.Ref, err = types.ParseRefBytes(sref)
+			if err != nil {
+				return nil, fmt.Errorf("invalid history of pin %q: %v", name, err)
+			}
+		}
+		recs = append(recs, rec)
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(recs) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	return recs, nil
+}
@@ -0,0 +1,256 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+var (
+	errCantImport   = errors.New("file cannot be imported")
+	errFileModified = errors.New("file was modified during import")
+)
+
+// ImportMode is a set of methods that can be used to import local files into the storage.
+type ImportMode int
+
+const (
+	// ImportClone imports files by cloning them (reflink). Blocks of the file are shared with the blob
+	// in copy-on-write mode, thus the import is fast and the blob is not affected by changes to the file.
+	// Only supported on Linux on file systems like Btrfs and XFS.
+	ImportClone ImportMode = 1 << iota
+	// ImportHardlink imports files by hard linking them into the storage. It's fast and works on most file systems,
+	// but the file and the blob share the same inode. Thus, the file is made read-only and must not be modified
+	// in place after the import. The file must be on the same file system as the storage.
+	ImportHardlink
+	// ImportCopy imports files by copying them.
+	ImportCopy
+
+	// ImportDefault is the set of import methods used by default.
+	// Hard links are not used by default, since they change permissions of the source files.
+	ImportDefault = ImportClone | ImportCopy
+)
+
+var importModes = []struct {
+	mode ImportMode
+	name string
+}{
+	{ImportClone, "clone"},
+	{ImportHardlink, "hardlink"},
+	{ImportCopy, "copy"},
+}
+
+// String returns a comma-separated list of import methods.
+func (m ImportMode) String() string {
+	var names []string
+	for _, v := range importModes {
+		if m&v.mode != 0 {
+			names = append(names, v.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseImportMode parses a comma-separated list of import methods: clone, hardlink and copy.
+func ParseImportMode(s string) (ImportMode, error) {
+	var m ImportMode
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, v := range importModes {
+			if v.name == name {
+				m |= v.mode
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown import mode: %q", name)
+		}
+	}
+	return m, nil
+}
+
+func (m ImportMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *ImportMode) UnmarshalText(p []byte) error {
+	v, err := ParseImportMode(string(p))
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// ImportFile stores a local file in the storage. Import methods are tried in the following order:
+// clone, hard link, copy; only methods enabled by Options.Import are used.
+func (s *Storage) ImportFile(ctx context.Context, path string) (types.SizedRef, error) {
+	if s.readOnly {
+		return types.SizedRef{}, storage.ErrReadOnly
+	}
+	if s.maxSize != 0 {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return types.SizedRef{}, err
+		} else if err = s.checkSpace(ctx, uint64(fi.Size())); err != nil {
+			return types.SizedRef{}, err
+		}
+	}
+	err := errCantImport
+	if s.importMode&ImportClone != 0 {
+		if !cloneSupported {
+			err = errCantClone
+		} else if sr, err2 := s.importClone(ctx, path); err2 == nil {
+			return sr, nil
+		} else {
+			err = err2
+		}
+	}
+	if s.importMode&ImportHardlink != 0 {
+		if sr, err2 := s.importLink(ctx, path); err2 == nil {
+			return sr, nil
+		} else {
+			err = err2
+		}
+	}
+	if s.importMode&ImportCopy != 0 {
+		return s.importCopy(ctx, path)
+	}
+	return types.SizedRef{}, err
+}
+
+func (s *Storage) importClone(ctx context.Context, path string) (types.SizedRef, error) {
+	inp, err := os.Open(path)
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	defer inp.Close()
+
+	dst, err := s.tmpFile(true)
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+
+	// copy the blocks directly by cloning the file
+	err = cloneFile(dst.File(), inp)
+	if err != nil {
+		dst.Close()
+		return types.SizedRef{}, err
+	}
+	// get the hash of the file by reading the clone (snapshot)
+	sr, err := types.Hash(dst)
+	if err != nil {
+		dst.Close()
+		return types.SizedRef{}, err
+	}
+
+	// store the file
+	err = dst.Commit(sr.Ref)
+	if err != nil {
+		dst.Close()
+		return types.SizedRef{}, err
+	}
+	return sr, nil
+}
+
+// importLink imports the file by hard linking it into the blobs directory.
+//
+// The file is made read-only before it's hashed, and the import fails if the file was modified while
+// it was hashed. Permissions are restored if the file cannot be linked.
+func (s *Storage) importLink(ctx context.Context, path string) (types.SizedRef, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return types.SizedRef{}, err
+	} else if !st.Mode().IsRegular() {
+		return types.SizedRef{}, errCantImport
+	}
+	perm := st.Mode().Perm()
+	if perm&0222 != 0 {
+		if err = f.Chmod(perm &^ 0222); err != nil {
+			return types.SizedRef{}, err
+		}
+	}
+	sr, linked, err := s.linkFileBlob(ctx, f, st)
+	if !linked && perm&0222 != 0 {
+		_ = f.Chmod(perm)
+	}
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	return sr, nil
+}
+
+// linkFileBlob hashes the file and links it into the blobs directory. It reports if the file was linked.
+func (s *Storage) linkFileBlob(ctx context.Context, f *os.File, st os.FileInfo) (types.SizedRef, bool, error) {
+	sr, err := types.Hash(f)
+	if err != nil {
+		return types.SizedRef{}, false, err
+	}
+	st2, err := f.Stat()
+	if err != nil {
+		return types.SizedRef{}, false, err
+	} else if st2.Size() != st.Size() || !st2.ModTime().Equal(st.ModTime()) || sr.Size != uint64(st.Size()) {
+		return types.SizedRef{}, false, errFileModified
+	}
+	if _, err = s.StatBlob(ctx, sr.Ref); err == nil {
+		// already stored; keep the file as-is
+		return sr, false, nil
+	}
+	path := s.blobPath(sr.Ref)
+	err = s.placeBlob(path, func() error {
+		return os.Link(f.Name(), path)
+	})
+	if os.IsExist(err) {
+		// stored concurrently
+		return sr, false, nil
+	} else if err != nil {
+		return types.SizedRef{}, false, err
+	}
+	s.statsBlob(int64(sr.Size), true)
+	err = os.Link(path, filepath.Join(s.dir, dirUnindexed, sr.Ref.String()))
+	if err != nil && !os.IsExist(err) {
+		return types.SizedRef{}, true, err
+	}
+	return sr, true, nil
+}
+
+func (s *Storage) importCopy(ctx context.Context, path string) (types.SizedRef, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	defer f.Close()
+	w, err := s.BeginBlob(ctx)
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	defer w.Close()
+	if _, err = io.Copy(w, f); err != nil {
+		return types.SizedRef{}, err
+	}
+	sr, err := w.Complete()
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	if err = w.Commit(); err != nil {
+		return types.SizedRef{}, err
+	}
+	return sr, nil
+}
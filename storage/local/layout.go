@@ -0,0 +1,269 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+const (
+	// fileMeta is the name of the store metadata file.
+	fileMeta = "store.json"
+
+	// shardLevels is the number of directory levels used by the sharded layout.
+	shardLevels = 2
+	// shardWidth is the number of hash characters used for a single directory level.
+	shardWidth = 2
+)
+
+// Layout is a layout of the blobs directory.
+type Layout string
+
+const (
+	// LayoutFlat stores all blobs in a single directory: blobs/<ref>.
+	//
+	// It's the default layout. It works well for small stores, but some filesystems degrade badly
+	// with hundreds of thousands of files in a single directory.
+	LayoutFlat = Layout("flat")
+	// LayoutSharded fans blobs out to subdirectories by the hash prefix: blobs/ab/cd/<ref>.
+	LayoutSharded = Layout("sharded")
+)
+
+func (l Layout) valid() bool {
+	switch l {
+	case LayoutFlat, LayoutSharded:
+		return true
+	}
+	return false
+}
+
+// levels returns the number of directory levels used by the layout.
+func (l Layout) levels() int {
+	if l == LayoutSharded {
+		return shardLevels
+	}
+	return 0
+}
+
+// blobPath returns a path of the blob relative to the blobs directory.
+func (l Layout) blobPath(ref types.Ref) string {
+	name := ref.String()
+	if l != LayoutSharded {
+		return name
+	}
+	h := name[strings.IndexByte(name, ':')+1:]
+	parts := make([]string, 0, shardLevels+1)
+	for i := 0; i < shardLevels; i++ {
+		parts = append(parts, h[i*shardWidth:(i+1)*shardWidth])
+	}
+	parts = append(parts, name)
+	return filepath.Join(parts...)
+}
+
+// ParseLayout parses the name of the blobs directory layout.
+func ParseLayout(s string) (Layout, error) {
+	l := Layout(s)
+	if !l.valid() {
+		return "", fmt.Errorf("unknown storage layout: %q", s)
+	}
+	return l, nil
+}
+
+// storeMeta is the content of the store metadata file.
+type storeMeta struct {
+	Layout Layout `json:"layout"`
+	// Migrate is set to the previous layout while the migration is in progress.
+	Migrate Layout `json:"migrate,omitempty"`
+	// Caps is a set of file system restrictions. It's not set if they were not probed yet.
+	Caps *Caps `json:"caps,omitempty"`
+}
+
+func (s *Storage) metaPath() string {
+	return filepath.Join(s.dir, fileMeta)
+}
+
+// readMeta reads the store metadata file. Stores without the metadata file use the flat layout.
+func (s *Storage) readMeta() (*storeMeta, error) {
+	data, err := ioutil.ReadFile(s.metaPath())
+	if os.IsNotExist(err) {
+		return &storeMeta{Layout: LayoutFlat}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var m storeMeta
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("cannot read store metadata: %v", err)
+	}
+	if m.Layout == "" {
+		m.Layout = LayoutFlat
+	}
+	if !m.Layout.valid() || (m.Migrate != "" && !m.Migrate.valid()) {
+		return nil, fmt.Errorf("unsupported storage layout: %q", m.Layout)
+	}
+	return &m, nil
+}
+
+// writeMeta atomically replaces the store metadata file.
+func (s *Storage) writeMeta(m *storeMeta) error {
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dir, fileMeta+"_")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = s.chownGroup(f.Name())
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), s.perms.file)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.metaPath())
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Layout returns the layout of the blobs directory.
+func (s *Storage) Layout() Layout {
+	return s.layout
+}
+
+// Migrate changes the layout of the blobs directory by moving all blobs to new locations.
+//
+// The migration can be interrupted at any point: it will be resumed the next time the storage is opened.
+// Storage must not be used by other processes during the migration.
+func (s *Storage) Migrate(ctx context.Context, layout Layout) error {
+	if !layout.valid() {
+		return fmt.Errorf("unknown storage layout: %q", layout)
+	} else if s.readOnly {
+		return storage.ErrReadOnly
+	}
+	if layout == s.layout {
+		return nil
+	}
+	from := s.layout
+	if err := s.writeMeta(&storeMeta{Layout: layout, Migrate: from, Caps: s.metaCaps()}); err != nil {
+		return err
+	}
+	s.layout = layout
+	return s.migrate(ctx, from)
+}
+
+// migrate moves all blobs from the old layout to the current one and marks the migration as completed.
+func (s *Storage) migrate(ctx context.Context, from Layout) error {
+	dir := filepath.Join(s.dir, dirBlobs)
+	// list blobs first, since moving files while reading the directory may skip some of them
+	var refs []types.Ref
+	it := &namesIterator{s: s, dir: dir, levels: from.levels(), noRemove: true}
+	for it.Next() {
+		refs = append(refs, it.SizedRef().Ref)
+	}
+	it.Close()
+	if err := it.Err(); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		src := filepath.Join(dir, from.blobPath(ref))
+		dst := s.blobPath(ref)
+		err := s.placeBlob(dst, func() error {
+			return os.Rename(src, dst)
+		})
+		if os.IsNotExist(err) {
+			if _, err2 := os.Stat(src); os.IsNotExist(err2) {
+				// already moved
+				continue
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if from.levels() > s.layout.levels() {
+		// remove shard directories; non-empty ones will be left untouched
+		if err := removeShards(dir, from.levels()); err != nil {
+			return err
+		}
+	}
+	return s.writeMeta(&storeMeta{Layout: s.layout, Caps: s.metaCaps()})
+}
+
+// placeBlob runs a function that creates a blob file in a given path. If the parent directory doesn't exist,
+// it will be created and the function will be called again. Directories are synced after the blob is placed.
+func (s *Storage) placeBlob(path string, fnc func() error) error {
+	err := fnc()
+	created := false
+	if os.IsNotExist(err) && s.layout.levels() > 0 {
+		if err = s.mkdirAll(filepath.Dir(path)); err != nil {
+			return err
+		}
+		created = true
+		err = fnc()
+	}
+	if err != nil {
+		return err
+	}
+	// new shard directories must be persisted as well
+	dirs := 1
+	if created {
+		dirs += s.layout.levels()
+	}
+	dir := filepath.Dir(path)
+	for i := 0; i < dirs; i++ {
+		if err = s.syncDir(dir); err != nil {
+			return err
+		}
+		dir = filepath.Dir(dir)
+	}
+	return nil
+}
+
+// removeShards removes empty shard directories.
+func removeShards(dir string, levels int) error {
+	if levels == 0 {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	infos, err := d.Readdir(-1)
+	d.Close()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for _, fi := range infos {
+		if !fi.IsDir() {
+			continue
+		}
+		sub := filepath.Join(dir, fi.Name())
+		if err = removeShards(sub, levels-1); err != nil {
+			return err
+		}
+		// fails for non-empty directories
+		_ = os.Remove(sub)
+	}
+	return nil
+}
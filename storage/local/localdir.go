@@ -3,17 +3,18 @@ package local
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dennwc/cas/schema"
 	"github.com/dennwc/cas/storage"
 	"github.com/dennwc/cas/types"
-	"github.com/dennwc/cas/xattr"
 )
 
 const (
@@ -23,15 +24,13 @@ const (
 	dirIndex     = "indexes"
 	dirUnindexed = "unindexed"
 
-	xattrNS         = "cas."
+	xattrNS = "cas."
+	// xattrSchemaType was used to cache schema types before the schema index database was introduced.
 	xattrSchemaType = xattrNS + "schema.type"
 
 	indexType = "@type"
 
 	readDirPage = 1024
-
-	roPerm  = 0444
-	dirPerm = 0755
 )
 
 var (
@@ -47,8 +46,18 @@ var (
 )
 
 var (
-	_ storage.Storage     = (*Storage)(nil)
-	_ storage.BlobIndexer = (*Storage)(nil)
+	_ storage.Storage        = (*Storage)(nil)
+	_ storage.BlobIndexer    = (*Storage)(nil)
+	_ storage.BlobDeleter    = (*Storage)(nil)
+	_ storage.PrefixIterator = (*Storage)(nil)
+	_ storage.BlobResumer    = (*Storage)(nil)
+	_ storage.PinSwapper     = (*Storage)(nil)
+	_ storage.FileImporter   = (*Storage)(nil)
+	_ storage.PinHistorian   = (*Storage)(nil)
+	_ storage.PinMetaStorage = (*Storage)(nil)
+	_ storage.BlobOpener     = (*Storage)(nil)
+
+	_ storage.PinHistoryAppender = (*Storage)(nil)
 )
 
 func init() {
@@ -57,6 +66,29 @@ func init() {
 
 type Config struct {
 	Dir string `json:"dir"`
+	// Layout is the layout of the blobs directory used when the storage is created.
+	// Layout of an existing storage is recorded in the storage itself, and opening it fails
+	// if the layouts are different. Storage.Migrate changes the layout of an existing storage.
+	Layout Layout `json:"layout,omitempty"`
+	// ReadOnly opens the storage in read-only mode. See Options.ReadOnly.
+	ReadOnly bool `json:"readonly,omitempty"`
+	// NoXattr disables the use of xattrs. See Options.NoXattr.
+	NoXattr bool `json:"noxattr,omitempty"`
+	// NoSync disables fsync on blob commits. See Options.NoSync.
+	NoSync bool `json:"nosync,omitempty"`
+	// Import is a set of methods used to import local files. See Options.Import.
+	Import ImportMode `json:"import,omitempty"`
+	// Perms controls permissions of created files and directories. See Options.Perms.
+	Perms *Perms `json:"perms,omitempty"`
+	// MaxSize is the maximal total size of blobs. See Options.MaxSize.
+	MaxSize uint64 `json:"maxsize,omitempty"`
+}
+
+func (c *Config) perms() Perms {
+	if c.Perms == nil {
+		return Perms{}
+	}
+	return *c.Perms
 }
 
 func (c *Config) References() []types.Ref {
@@ -64,15 +96,104 @@ func (c *Config) References() []types.Ref {
 }
 
 func (c *Config) OpenStorage(ctx context.Context) (storage.Storage, error) {
-	s, err := New(c.Dir, false)
+	s, err := NewContext(ctx, c.Dir, false, &Options{
+		Layout: c.Layout, ReadOnly: c.ReadOnly, NoXattr: c.NoXattr, NoSync: c.NoSync, Import: c.Import,
+		Perms: c.perms(), MaxSize: c.MaxSize,
+	})
 	if err != nil {
 		return nil, err
 	}
+	if c.Layout != "" && s.Layout() != c.Layout {
+		s.Close()
+		return nil, fmt.Errorf("storage layout is %q, but the config requires %q", s.Layout(), c.Layout)
+	}
 	return s, nil
 }
 
+// Options for a local storage.
+type Options struct {
+	// Layout of the blobs directory. It's only used when a new storage is created.
+	// Flat layout is used by default.
+	Layout Layout
+	// ReadOnly opens an existing storage without preparing it for writes. All mutating operations
+	// return storage.ErrReadOnly, and invalid blobs are reported as missing instead of being removed.
+	// Schema blobs are not indexed, thus listing them may be slower.
+	ReadOnly bool
+	// NoXattr disables all reads and writes of xattrs. Schema types of blobs and refs of files
+	// are cached in a sidecar index in the storage directory instead.
+	//
+	// The sidecar index is also used automatically if the file system doesn't support xattrs,
+	// or if the storage already has a sidecar index.
+	NoXattr bool
+	// NoSync disables fsync of blob files and directories when blobs are committed. It makes writes faster,
+	// but a crash may leave truncated blobs in the storage. Should only be used for throwaway stores.
+	NoSync bool
+	// Import is a set of methods used by ImportFile. ImportDefault is used if not set.
+	Import ImportMode
+	// Perms controls permissions of blobs, pins, metadata files and directories created by the storage.
+	// Existing files are not affected.
+	Perms Perms
+	// MaxSize is the maximal total size of blobs in bytes. Writes that would exceed it fail with
+	// storage.ErrStoreFull. The size is not limited if it's zero.
+	//
+	// The limit is soft: blobs that are written concurrently might exceed it by the size of those blobs.
+	MaxSize uint64
+	// FS replaces file system operations used to read and write blobs, pins and their metadata.
+	// It's intended for tests that simulate crashes and corruption. The host file system is used if not set.
+	//
+	// Platform-specific optimizations, like anonymous temporary files on Linux, are disabled if it's set.
+	// Indexes, locks, imports and clones still use the host file system directly.
+	FS FS
+	// Clock returns the current time. It's used for timestamps recorded by the storage, like the pin history.
+	// time.Now is used if not set.
+	Clock func() time.Time
+}
+
+// New opens a local storage in a given directory. If create is set, the storage will be created if it doesn't exist.
 func New(dir string, create bool) (*Storage, error) {
-	_, err := os.Stat(dir)
+	return NewWithOptions(dir, create, nil)
+}
+
+// NewWithOptions is similar to New, but allows to specify additional options.
+func NewWithOptions(dir string, create bool, opts *Options) (*Storage, error) {
+	return NewContext(context.Background(), dir, create, opts)
+}
+
+// NewContext is similar to NewWithOptions, but the context can cancel long operations performed while opening
+// the storage, like resuming an interrupted migration of the layout.
+func NewContext(ctx context.Context, dir string, create bool, opts *Options) (*Storage, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.Layout == "" {
+		opts.Layout = LayoutFlat
+	} else if !opts.Layout.valid() {
+		return nil, fmt.Errorf("unknown storage layout: %q", opts.Layout)
+	}
+	perms, err := opts.Perms.resolve()
+	if err != nil {
+		return nil, err
+	}
+	s := &Storage{
+		dir: dir, readOnly: opts.ReadOnly, noSync: opts.NoSync,
+		importMode: opts.Import,
+		perms:      perms,
+		maxSize:    opts.MaxSize,
+		fs:         opts.FS,
+		clock:      opts.Clock,
+	}
+	if s.fs == nil {
+		s.fs = osFS{}
+	} else {
+		s.customFS = true
+	}
+	if s.importMode == 0 {
+		s.importMode = ImportDefault
+	}
+	if opts.ReadOnly {
+		create = false
+	}
+	_, err = os.Stat(dir)
 	if err == nil {
 		_, err = os.Stat(filepath.Join(dir, dirBlobs))
 	}
@@ -80,22 +201,47 @@ func New(dir string, create bool) (*Storage, error) {
 		if !create {
 			return nil, err
 		}
-		err = os.MkdirAll(dir, dirPerm)
+		err = s.mkdirAll(dir)
 		if err != nil {
 			return nil, err
 		}
 		for _, name := range mkDirs {
-			err = os.Mkdir(filepath.Join(dir, name), dirPerm)
+			err = s.mkdir(filepath.Join(dir, name))
 			if err != nil {
 				return nil, err
 			}
 		}
+		err = s.writeMeta(&storeMeta{Layout: opts.Layout})
 	}
 	if err != nil {
 		return nil, err
 	}
-	s := &Storage{
-		dir: dir,
+	if err = s.lock(); err != nil {
+		return nil, err
+	}
+	meta, err := s.readMeta()
+	if err != nil {
+		s.unlock()
+		return nil, err
+	}
+	s.layout = meta.Layout
+	if s.readOnly && meta.Migrate != "" {
+		s.unlock()
+		return nil, fmt.Errorf("storage migration is in progress, cannot open in read-only mode")
+	}
+	if err = s.initCaps(meta); err != nil {
+		s.unlock()
+		return nil, err
+	}
+	if !s.readOnly {
+		if err = s.loadStats(); err != nil {
+			s.unlock()
+			return nil, err
+		}
+	}
+	if err = s.initMeta(opts.NoXattr); err != nil {
+		s.unlock()
+		return nil, err
 	}
 	if err := s.initIndexes(); err != nil {
 		s.Close()
@@ -105,13 +251,50 @@ func New(dir string, create bool) (*Storage, error) {
 		s.Close()
 		return nil, err
 	}
+	s.startRepairs()
+	if meta.Migrate != "" {
+		// resume an interrupted migration
+		if err := s.migrate(ctx, meta.Migrate); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
 	return s, nil
 }
 
 type Storage struct {
-	dir       string
-	unindexed *os.File
+	dir        string
+	layout     Layout
+	readOnly   bool
+	noSync     bool
+	maxSize    uint64 // see Options.MaxSize
+	importMode ImportMode
+	perms      filePerms
+	meta       *sidecar // set if xattrs are disabled
+	refIndex   bool     // reverse index of references is maintained; see initRefIndex
+	schemas    schemaDB // types of schema blobs; see fileSchemaDB
+	unindexed  *os.File
+	lockf      *os.File // holds the lock on the storage; see lock
 	storageImpl
+
+	fs       FS               // see Options.FS
+	customFS bool             // FS is set by the user; disables platform-specific optimizations
+	clock    func() time.Time // optional; see Options.Clock
+
+	capsMu sync.RWMutex
+	caps   Caps // file system restrictions; see Caps
+
+	statsMu sync.Mutex
+	stats   *blobStats // blob counters; nil if not calculated yet
+
+	repairMu sync.RWMutex
+	repairs  chan indexRepair // pending index repairs; nil if the worker is stopped
+	repairWG sync.WaitGroup
+
+	resumeMu sync.Mutex
+	resuming map[string]struct{} // tokens of partial blobs that are being written
+
+	pinMu sync.Mutex // serializes pin updates; see SetPinCAS
 }
 
 func (s *Storage) ensureDir(dir string) error {
@@ -122,13 +305,13 @@ func (s *Storage) ensureDir(dir string) error {
 	} else if !os.IsNotExist(err) {
 		return err
 	}
-	return os.Mkdir(path, dirPerm)
+	return s.mkdir(path)
 }
 func (s *Storage) openOrMake(dir string) (*os.File, error) {
 	path := filepath.Join(s.dir, dir)
 	d, err := os.Open(path)
 	if os.IsNotExist(err) {
-		err = os.Mkdir(path, dirPerm)
+		err = s.mkdir(path)
 		if err != nil {
 			return nil, err
 		}
@@ -140,6 +323,19 @@ func (s *Storage) ensureIndex(field string) error {
 	return s.ensureDir(filepath.Join(dirIndex, field))
 }
 func (s *Storage) initIndexes() error {
+	if s.readOnly {
+		// only open the index, if it exists
+		d, err := os.Open(filepath.Join(s.dir, dirUnindexed))
+		if err == nil {
+			s.unindexed = d
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err = s.openSchemaDB(); err != nil {
+			return err
+		}
+		return s.initRefIndex()
+	}
 	var err error
 	s.unindexed, err = s.openOrMake(dirUnindexed)
 	if err != nil {
@@ -151,19 +347,32 @@ func (s *Storage) initIndexes() error {
 	if err = s.ensureIndex(indexType); err != nil {
 		return err
 	}
-	return nil
+	if err = s.openSchemaDB(); err != nil {
+		return err
+	}
+	return s.initRefIndex()
 }
 
 func (s *Storage) Close() error {
+	s.stopRepairs()
 	s.closeIndexes()
-	return s.close()
+	err := s.close()
+	if !s.readOnly {
+		if err2 := s.saveStats(); err == nil {
+			err = err2
+		}
+	}
+	if err2 := s.unlock(); err == nil {
+		err = err2
+	}
+	return err
 }
 
 func (s *Storage) closeIndexes() error {
 	if s.unindexed != nil {
 		s.unindexed.Close()
 	}
-	return nil
+	return s.schemas.close()
 }
 
 type tempFile interface {
@@ -175,9 +384,25 @@ type tempFile interface {
 	Commit(ref types.Ref) error
 }
 
+// syncFile flushes the content of the file to disk, unless disabled for the storage.
+func (s *Storage) syncFile(f *os.File) error {
+	if s.noSync {
+		return nil
+	}
+	return s.fs.Sync(f)
+}
+
+// syncDir flushes directory entries to disk, unless disabled for the storage.
+func (s *Storage) syncDir(path string) error {
+	if s.noSync {
+		return nil
+	}
+	return s.fs.SyncDir(path)
+}
+
 func (s *Storage) tmpFileRaw() (*os.File, error) {
 	dir := filepath.Join(s.dir, dirTmp)
-	return ioutil.TempFile(dir, "blob_")
+	return s.fs.TempFile(dir, "blob_")
 }
 
 func (s *Storage) tmpFileGen() (tempFile, error) {
@@ -189,7 +414,7 @@ func (s *Storage) tmpFileGen() (tempFile, error) {
 }
 
 func (s *Storage) blobPath(ref types.Ref) string {
-	return filepath.Join(s.dir, dirBlobs, ref.String())
+	return filepath.Join(s.dir, dirBlobs, s.layout.blobPath(ref))
 }
 
 // removeIfInvalid does a quick check for an invalid blob and removes it, if necessary, returning true as the result.
@@ -200,16 +425,22 @@ func (s *Storage) removeIfInvalid(fi os.FileInfo, ref types.Ref) (bool, error) {
 	}
 	// it's definitely a corrupted blob - remove it
 	// those might be left by an instant system shutdown
+	if s.readOnly {
+		// report it as missing, but leave it as-is
+		return true, nil
+	}
 
 	// if any error happens during cleanup - ignore it and report "ref mismatch"
-	err := os.Chmod(s.blobPath(ref), 0666)
+	err := s.fs.Chmod(s.blobPath(ref), 0666)
 	if err != nil {
 		return false, storage.ErrRefMissmatch{Exp: ref, Got: types.BytesRef(nil)}
 	}
-	err = os.Remove(s.blobPath(ref))
+	err = s.fs.Remove(s.blobPath(ref))
 	if err != nil {
 		return false, storage.ErrRefMissmatch{Exp: ref, Got: types.BytesRef(nil)}
 	}
+	s.statsBlob(0, false)
+	_ = s.schemas.remove(ref)
 	return true, nil
 }
 
@@ -217,8 +448,10 @@ func (s *Storage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
 	if ref.Zero() {
 		return 0, storage.ErrInvalidRef
 	}
-	fi, err := os.Stat(s.blobPath(ref))
-	if err != nil {
+	fi, err := s.fs.Stat(s.blobPath(ref))
+	if os.IsNotExist(err) {
+		return 0, storage.ErrNotFound
+	} else if err != nil {
 		return 0, err
 	}
 	if invalid, err := s.removeIfInvalid(fi, ref); err != nil {
@@ -233,7 +466,7 @@ func (s *Storage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser,
 	if ref.Zero() {
 		return nil, 0, storage.ErrInvalidRef
 	}
-	f, err := os.Open(s.blobPath(ref))
+	f, err := s.fs.Open(s.blobPath(ref))
 	if os.IsNotExist(err) {
 		return nil, 0, storage.ErrNotFound
 	} else if err != nil {
@@ -254,48 +487,85 @@ func (s *Storage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser,
 	return f, uint64(fi.Size()), nil
 }
 
-func (s *Storage) ImportFile(ctx context.Context, path string) (types.SizedRef, error) {
-	if !cloneSupported {
-		return types.SizedRef{}, errCantClone
-	}
-	inp, err := os.Open(path)
+// OpenBlob implements storage.BlobOpener. Blobs are opened as regular files.
+func (s *Storage) OpenBlob(ctx context.Context, ref types.Ref) (storage.BlobReader, uint64, error) {
+	rc, sz, err := s.FetchBlob(ctx, ref)
 	if err != nil {
-		return types.SizedRef{}, err
+		return nil, 0, err
 	}
-	defer inp.Close()
+	return rc.(*os.File), sz, nil
+}
 
-	dst, err := s.tmpFile(true)
-	if err != nil {
-		return types.SizedRef{}, err
+// DeleteBlob removes a blob from the storage and from all indexes.
+func (s *Storage) DeleteBlob(ctx context.Context, ref types.Ref) error {
+	if ref.Zero() {
+		return storage.ErrInvalidRef
+	} else if s.readOnly {
+		return storage.ErrReadOnly
+	}
+	path := s.blobPath(ref)
+	typ, terr := s.getType(ref)
+	var refs []types.Ref
+	if s.refIndex && (terr != nil || typ != "") {
+		// references must be removed from the reverse index; it's not an error if the blob cannot be decoded
+		refs, _, _ = decodeRefs(path)
+	}
+	fi, err := s.fs.Lstat(path)
+	if os.IsNotExist(err) {
+		return storage.ErrNotFound
+	} else if err != nil {
+		return err
 	}
-
-	// copy the blocks directly by cloning the file
-	err = cloneFile(dst.File(), inp)
-	if err != nil {
-		dst.Close()
-		return types.SizedRef{}, err
+	err = s.fs.Remove(path)
+	if os.IsNotExist(err) {
+		return storage.ErrNotFound
+	} else if err != nil {
+		return err
 	}
-	// get the hash of the file by reading the clone (snapshot)
-	sr, err := types.Hash(dst)
-	if err != nil {
-		dst.Close()
-		return types.SizedRef{}, err
+	s.statsBlob(fi.Size(), false)
+	s.unindexRefs(ref, refs)
+	name := ref.String()
+	// drop the blob from indexes; they are hard links, so it's safe to ignore errors here
+	_ = os.Remove(filepath.Join(s.dir, dirUnindexed, name))
+	if err = s.schemas.remove(ref); err != nil {
+		return err
 	}
-
-	// store the file
-	err = dst.Commit(sr.Ref)
+	if terr == nil {
+		if typ != "" {
+			_ = os.Remove(filepath.Join(s.dir, dirIndex, indexType, typ, name))
+		}
+		return nil
+	}
+	// type is unknown - check all type indexes
+	tdir := filepath.Join(s.dir, dirIndex, indexType)
+	d, err := os.Open(tdir)
 	if err != nil {
-		dst.Close()
-		return types.SizedRef{}, err
+		return nil
+	}
+	defer d.Close()
+	typs, _ := d.Readdirnames(-1)
+	for _, typ := range typs {
+		_ = os.Remove(filepath.Join(tdir, typ, name))
 	}
-	return sr, nil
+	return nil
 }
 
 func (s *Storage) addNotIndexed(f *os.File, ref types.Ref) error {
-	return linkFile(s.unindexed, ref.String(), f)
+	err := linkFile(s.unindexed, ref.String(), f)
+	if os.IsExist(err) {
+		// blob was removed and stored again before it was indexed
+		return nil
+	}
+	return err
 }
 
 func (s *Storage) BeginBlob(ctx context.Context) (storage.BlobWriter, error) {
+	if s.readOnly {
+		return nil, storage.ErrReadOnly
+	}
+	if err := s.checkSpace(ctx, 0); err != nil {
+		return nil, err
+	}
 	f, err := s.tmpFile(false)
 	if err != nil {
 		return nil, err
@@ -312,6 +582,8 @@ type blobWriter struct {
 	f   tempFile
 	sr  types.SizedRef
 	hw  storage.BlobWriter
+
+	head []byte // magic prefix of the blob
 }
 
 func (w *blobWriter) Size() uint64 {
@@ -326,6 +598,15 @@ func (w *blobWriter) Write(p []byte) (int, error) {
 	if w.f == nil {
 		return 0, storage.ErrBlobCompleted
 	}
+	if err = w.s.checkSpace(w.ctx, w.hw.Size()); err != nil {
+		return 0, err
+	}
+	if n := schema.MagicSize - len(w.head); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		w.head = append(w.head, p[:n]...)
+	}
 	return w.f.Write(p)
 }
 
@@ -342,14 +623,12 @@ func (w *blobWriter) Complete() (types.SizedRef, error) {
 }
 
 func (w *blobWriter) Close() error {
-	if err := w.hw.Close(); err != nil {
-		return err
+	err := w.hw.Close()
+	if w.f != nil {
+		// blob might be completed, but not committed; the hash writer fails in this case
+		err = w.f.Close()
+		w.f = nil
 	}
-	if w.f == nil {
-		return nil
-	}
-	err := w.f.Close()
-	w.f = nil
 	return err
 }
 
@@ -365,19 +644,93 @@ func (w *blobWriter) Commit() error {
 			return err
 		}
 	}
+	if err := w.s.checkSpace(w.ctx, w.sr.Size); err != nil {
+		return err
+	}
 	// file already closed, we only need a name now
 	err := w.f.Commit(w.sr.Ref)
 	w.f = nil
+	if err == nil && schema.IsSchema(w.head) {
+		// record the type of a schema blob right away; the blob stays in the unindexed list
+		// until its references are indexed, and invalid schema blobs will be reported then
+		_ = w.s.repairIndex(indexRepair{ref: w.sr.Ref})
+	}
 	return err
 }
 
 func (s *Storage) IterateBlobs(ctx context.Context) storage.Iterator {
-	return &dirIterator{s: s, dir: filepath.Join(s.dir, dirBlobs)}
+	return &dirIterator{s: s, dir: filepath.Join(s.dir, dirBlobs), levels: s.layout.levels()}
+}
+
+// IterateBlobsPrefix implements storage.PrefixIterator. Only shard directories that match the prefix are listed.
+func (s *Storage) IterateBlobsPrefix(ctx context.Context, prefix string) storage.Iterator {
+	return &dirIterator{s: s, dir: filepath.Join(s.dir, dirBlobs), levels: s.layout.levels(), prefix: prefix}
+}
+
+// readBlobInfos lists all files in a blobs directory with a given number of shard levels.
+// Files are sorted by the name. If the prefix is set, only files with names that start with it are listed.
+func readBlobInfos(dir string, levels int, prefix string) ([]os.FileInfo, error) {
+	hash := ""
+	if i := strings.IndexByte(prefix, ':'); i >= 0 {
+		hash = prefix[i+1:]
+	}
+	return readBlobInfosHash(dir, levels, prefix, hash)
+}
+
+// readBlobInfosHash is like readBlobInfos, but skips shard directories that don't match the remaining part
+// of the hash prefix.
+func readBlobInfosHash(dir string, levels int, prefix, hash string) ([]os.FileInfo, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	if levels == 0 {
+		if prefix == "" {
+			return infos, nil
+		}
+		out := infos[:0]
+		for _, fi := range infos {
+			if strings.HasPrefix(fi.Name(), prefix) {
+				out = append(out, fi)
+			}
+		}
+		return out, nil
+	}
+	var out []os.FileInfo
+	for _, fi := range infos {
+		if !fi.IsDir() {
+			continue
+		}
+		name, sub := fi.Name(), ""
+		if strings.HasPrefix(hash, name) {
+			sub = hash[len(name):]
+		} else if !strings.HasPrefix(name, hash) {
+			continue
+		}
+		files, err := readBlobInfosHash(filepath.Join(dir, name), levels-1, prefix, sub)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		out = append(out, files...)
+	}
+	return out, nil
 }
 
 type dirIterator struct {
-	s   *Storage
-	dir string
+	s      *Storage
+	dir    string
+	levels int
+	prefix string
 
 	err   error
 	infos []os.FileInfo
@@ -390,7 +743,7 @@ func (it *dirIterator) Next() bool {
 		return false
 	}
 	if it.infos == nil {
-		d, err := os.Open(it.dir)
+		infos, err := readBlobInfos(it.dir, it.levels, it.prefix)
 		if os.IsNotExist(err) {
 			it.infos = []os.FileInfo{}
 			return false
@@ -398,15 +751,6 @@ func (it *dirIterator) Next() bool {
 			it.err = err
 			return false
 		}
-		infos, err := d.Readdir(-1)
-		d.Close()
-		if err != nil {
-			it.err = err
-			return false
-		}
-		sort.Slice(infos, func(i, j int) bool {
-			return infos[i].Name() < infos[j].Name()
-		})
 		it.infos = infos
 	}
 	for {
@@ -450,22 +794,102 @@ func (s *Storage) pinPath(name string) string {
 	return filepath.Join(s.dir, dirPins, name)
 }
 
+// SetPin atomically replaces the pin. The ref is written to a temporary file first, which is then renamed to the pin,
+// thus a crash never leaves a partially written pin.
 func (s *Storage) SetPin(ctx context.Context, name string, ref types.Ref) error {
-	return ioutil.WriteFile(s.pinPath(name), []byte(ref.String()), 0644)
+	if s.readOnly {
+		return storage.ErrReadOnly
+	}
+	s.pinMu.Lock()
+	defer s.pinMu.Unlock()
+	return s.updatePin(name, ref)
+}
+
+func (s *Storage) writePin(name string, ref types.Ref) error {
+	return s.replaceFile(s.pinPath(name), []byte(ref.String()))
+}
+
+// replaceFile atomically replaces the content of a file in the storage.
+func (s *Storage) replaceFile(path string, data []byte) error {
+	f, err := s.fs.TempFile(filepath.Join(s.dir, dirTmp), "pin_")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = s.syncFile(f)
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = s.fs.Chmod(f.Name(), s.perms.file)
+	}
+	if err == nil {
+		err = s.chownGroup(f.Name())
+	}
+	if err == nil {
+		err = s.fs.Rename(f.Name(), path)
+	}
+	if err != nil {
+		s.fs.Remove(f.Name())
+		return err
+	}
+	return s.syncDir(filepath.Dir(path))
 }
 
 func (s *Storage) DeletePin(ctx context.Context, name string) error {
-	return os.Remove(s.pinPath(name))
+	if s.readOnly {
+		return storage.ErrReadOnly
+	}
+	s.pinMu.Lock()
+	defer s.pinMu.Unlock()
+	return s.updatePin(name, types.Ref{})
+}
+
+// SetPinCAS implements storage.PinSwapper. Only a single process can open the storage for writing,
+// thus pins are only locked within the process.
+func (s *Storage) SetPinCAS(ctx context.Context, name string, old, new types.Ref) error {
+	if s.readOnly {
+		return storage.ErrReadOnly
+	}
+	s.pinMu.Lock()
+	defer s.pinMu.Unlock()
+	cur, err := s.GetPin(ctx, name)
+	if err == storage.ErrNotFound {
+		cur = types.Ref{}
+	} else if err != nil {
+		return err
+	}
+	if cur != old {
+		return storage.ErrPinConflict
+	}
+	if new.Zero() && old.Zero() {
+		return nil
+	}
+	return s.updatePin(name, new)
 }
 
 func (s *Storage) GetPin(ctx context.Context, name string) (types.Ref, error) {
-	data, err := ioutil.ReadFile(s.pinPath(name))
+	data, err := s.fs.ReadFile(s.pinPath(name))
 	if os.IsNotExist(err) {
 		return types.Ref{}, storage.ErrNotFound
 	} else if err != nil {
 		return types.Ref{}, err
 	}
-	return types.ParseRef(string(data))
+	return parsePin(name, data)
+}
+
+// parsePin parses the content of the pin file. It returns storage.ErrPinCorrupted if it's not a valid ref.
+func parsePin(name string, data []byte) (types.Ref, error) {
+	ref, err := types.ParseRefBytes(data)
+	if err == nil && ref.Zero() {
+		err = errors.New("empty ref")
+	}
+	if err != nil {
+		return types.Ref{}, storage.ErrPinCorrupted{Name: name, Err: err}
+	}
+	return ref, nil
 }
 
 func (s *Storage) IteratePins(ctx context.Context) storage.PinIterator {
@@ -487,7 +911,7 @@ func (it *pinIterator) Next() bool {
 		return false
 	}
 	if it.infos == nil {
-		d, err := os.Open(it.dir)
+		d, err := it.s.fs.Open(it.dir)
 		if os.IsNotExist(err) {
 			it.infos = []os.FileInfo{}
 			return false
@@ -512,12 +936,12 @@ func (it *pinIterator) Next() bool {
 	info := it.infos[0]
 	it.infos = it.infos[1:]
 	it.cur.Name = info.Name()
-	data, err := ioutil.ReadFile(filepath.Join(it.dir, info.Name()))
+	data, err := it.s.fs.ReadFile(filepath.Join(it.dir, info.Name()))
 	if err != nil {
 		it.err = err
 		return false
 	}
-	it.cur.Ref, it.err = types.ParseRef(string(data))
+	it.cur.Ref, it.err = parsePin(info.Name(), data)
 	if it.err != nil {
 		return false
 	}
@@ -538,20 +962,14 @@ func (it *pinIterator) Close() error {
 }
 
 func (s *Storage) IterateSchema(ctx context.Context, typs ...string) storage.SchemaIterator {
-	if len(typs) == 0 {
-		return &schemaAnyIterator{
-			s: s, ctx: ctx,
-			blobs: s.iterateNames(ctx, dirBlobs, true),
+	it := &schemaIterator{s: s, ctx: ctx}
+	if len(typs) != 0 {
+		it.filter = make(map[string]struct{})
+		for _, v := range typs {
+			it.filter[v] = struct{}{}
 		}
 	}
-	filter := make(map[string]struct{})
-	for _, v := range typs {
-		filter[v] = struct{}{}
-	}
-	return &schemaIterator{
-		s: s, ctx: ctx,
-		types: typs, filter: filter,
-	}
+	return it
 }
 
 func (s *Storage) resetIndexes() error {
@@ -568,89 +986,114 @@ func (s *Storage) resetIndexes() error {
 		return err
 	}
 	// mark every blob as unindexed
-	srcDir := filepath.Join(s.dir, dirBlobs)
-	d, err := os.Open(srcDir)
-	if err != nil {
-		return err
-	}
-	defer d.Close()
-
-	for {
-		buf, err := d.Readdirnames(readDirPage)
-		if err == io.EOF {
-			return nil
-		} else if err != nil {
+	it := s.iterateNames(context.Background(), dirBlobs, false)
+	defer it.Close()
+	for it.Next() {
+		ref := it.SizedRef().Ref
+		err := os.Link(s.blobPath(ref), filepath.Join(dstDir, ref.String()))
+		if err != nil {
 			return err
 		}
-		for _, name := range buf {
-			err = os.Link(filepath.Join(srcDir, name), filepath.Join(dstDir, name))
-			if err != nil {
-				return err
-			}
-		}
 	}
+	return it.Err()
 }
 
+// ReindexSchema indexes all blobs in the unindexed list. If force is set, indexes are rebuilt from scratch
+// by decoding all blobs in the storage.
 func (s *Storage) ReindexSchema(ctx context.Context, force bool) error {
+	if s.readOnly {
+		return storage.ErrReadOnly
+	}
 	if force {
 		if err := s.resetIndexes(); err != nil {
 			return err
 		}
 	}
-	// only restore the global index
-	it := s.IterateSchema(ctx)
-	it.(*schemaAnyIterator).force = true
-	for it.Next() {
-		_ = it.SchemaRef()
-	}
-	return it.Err()
+	return s.indexPending(ctx, nil)
 }
 
 func (s *Storage) FetchSchema(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
 	if ref.Zero() {
 		return nil, 0, storage.ErrInvalidRef
 	}
-	if typ, err := xattr.GetString(s.blobPath(ref), xattrSchemaType); err == nil && typ == "" {
+	typ, err := s.getType(ref)
+	if err == nil && typ == "" {
 		return nil, 0, schema.ErrNotSchema
 	}
-	return s.FetchBlob(ctx, ref)
+	rc, sz, err2 := s.FetchBlob(ctx, ref)
+	if err == errNotCached && err2 == nil {
+		// type is not cached - let the background worker fix it
+		s.queueRepair(indexRepair{ref: ref})
+	}
+	return rc, sz, err2
 }
 
 func (s *Storage) iterateNames(ctx context.Context, dir string, fix bool) *namesIterator {
-	return &namesIterator{
+	it := &namesIterator{
 		s: s, dir: filepath.Join(s.dir, dir),
 		noRemove: !fix,
 	}
+	if dir == dirBlobs {
+		it.levels = s.layout.levels()
+	}
+	return it
 }
 
+// namesIterator lists blobs in a directory in an unspecified order.
+// If levels is set, blobs are listed from nested shard directories.
 type namesIterator struct {
 	s      *Storage
 	dir    string
-	d      *os.File
-	buf    []os.FileInfo
+	levels int
 	filter func(path string) (bool, error)
 
+	started bool
+	pending []shardDir
+	d       *os.File
+	cur     shardDir
+	buf     []os.FileInfo
+
 	noRemove bool
 	sr       types.SizedRef
 	err      error
 }
 
+type shardDir struct {
+	path  string
+	level int
+}
+
 func (it *namesIterator) Next() bool {
-	if it.d == nil {
-		d, err := os.Open(it.dir)
-		if os.IsNotExist(err) {
-			return false
-		} else if err != nil {
-			it.err = err
-			return false
-		}
-		it.d = d
+	if !it.started {
+		it.started = true
+		it.pending = []shardDir{{path: it.dir}}
 	}
 	for {
+		if it.err != nil {
+			return false
+		}
+		if it.d == nil {
+			if len(it.pending) == 0 {
+				return false
+			}
+			last := len(it.pending) - 1
+			it.cur = it.pending[last]
+			it.pending = it.pending[:last]
+			d, err := os.Open(it.cur.path)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				it.err = err
+				return false
+			}
+			it.d = d
+		}
 		if len(it.buf) == 0 {
 			buf, err := it.d.Readdir(readDirPage)
 			if err == io.EOF {
-				return false
+				it.d.Close()
+				it.d = nil
+				continue
 			} else if err != nil {
 				it.err = err
 				return false
@@ -662,8 +1105,19 @@ func (it *namesIterator) Next() bool {
 			it.buf = it.buf[1:]
 			name := fi.Name()
 
+			if it.cur.level < it.levels {
+				if fi.IsDir() {
+					it.pending = append(it.pending, shardDir{
+						path: filepath.Join(it.cur.path, name), level: it.cur.level + 1,
+					})
+				}
+				continue
+			} else if fi.IsDir() {
+				continue
+			}
+
 			if it.filter != nil {
-				ok, err := it.filter(filepath.Join(it.dir, name))
+				ok, err := it.filter(filepath.Join(it.cur.path, name))
 				if err != nil {
 					it.err = err
 					return false
@@ -700,6 +1154,8 @@ func (it *namesIterator) Close() error {
 		it.d.Close()
 		it.d = nil
 	}
+	it.started = true
+	it.pending = nil
 	it.buf = nil
 	return it.err
 }
@@ -708,68 +1164,87 @@ func (it *namesIterator) SizedRef() types.SizedRef {
 	return it.sr
 }
 
-// schemaIterator uses indexes to iterate over blobs with a specific schema type.
-// It will automatically index blobs that are unindexed.
+// schemaIterator iterates over schema blobs using the schema index database.
+//
+// Blobs from the unindexed list are listed first, and their types are decoded if they are not in the database yet.
+// Indexed blobs are listed from a snapshot of the database, thus blob files are never accessed for them.
 type schemaIterator struct {
 	s   *Storage
 	ctx context.Context
 
-	types     []string
-	filter    map[string]struct{}
-	unindexed bool
-
-	it *namesIterator
+	filter  map[string]struct{} // nil if all types are listed
+	it      *namesIterator      // unindexed blobs
+	seen    map[types.Ref]struct{}
+	indexed []types.SchemaRef
+	started bool
+	done    bool
 
 	sr types.SchemaRef
 }
 
 func (it *schemaIterator) Next() bool {
-	for {
-		if it.it == nil {
-			it.sr.Type = ""
-			if it.unindexed {
-				// drained unindexed blobs - we are done
-				return false
-			}
-			if len(it.types) == 0 {
-				// no types left - list unindexed blobs
-				it.unindexed = true
-				it.it = it.s.iterateNames(it.ctx, dirUnindexed, false)
-				it.it.filter = it.filterUnindexed
-			} else {
-				// list types one by one
-				typ := it.types[0]
-				it.types = it.types[1:]
-				it.sr.Type = typ
-				ipath := filepath.Join(dirIndex, indexType, typ)
-				it.it = it.s.iterateNames(it.ctx, ipath, false)
-			}
-		}
+	if it.done {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		it.seen = make(map[types.Ref]struct{})
+		it.it = it.s.iterateNames(it.ctx, dirUnindexed, false)
+		it.it.filter = it.filterUnindexed
+	}
+	if it.it != nil {
 		if it.it.Next() {
 			sr := it.it.SizedRef()
 			it.sr.Ref, it.sr.Size = sr.Ref, sr.Size
+			it.seen[sr.Ref] = struct{}{}
 			return true
 		}
+		if err := it.it.Err(); err != nil {
+			return false
+		}
 		it.it.Close()
 		it.it = nil
+		// blobs might be indexed while the unindexed list is iterated; take the snapshot after it
+		it.indexed = it.s.schemas.snapshot(it.filter)
 	}
+	for len(it.indexed) > 0 {
+		it.sr = it.indexed[0]
+		it.indexed = it.indexed[1:]
+		if _, ok := it.seen[it.sr.Ref]; !ok {
+			return true
+		}
+	}
+	it.sr = types.SchemaRef{}
+	it.done = true
+	return false
 }
 
 func (it *schemaIterator) filterUnindexed(path string) (bool, error) {
-	typ, err := it.indexType(path)
+	ref, err := types.ParseRef(filepath.Base(path))
 	if err != nil {
 		return false, err
-	} else if typ == "" {
-		return false, nil
 	}
-	if _, ok := it.filter[typ]; !ok {
+	var typ string
+	if e, ok := it.s.schemas.get(ref); ok {
+		typ = e.typ
+		// the type was recorded when the blob was committed, but references are not indexed yet
+		it.s.queueRepair(indexRepair{ref: ref, typ: typ, known: true, unindexed: true})
+	} else if typ, err = it.indexType(ref, path); err != nil {
+		return false, err
+	}
+	if typ == "" {
 		return false, nil
+	} else if it.filter != nil {
+		if _, ok := it.filter[typ]; !ok {
+			return false, nil
+		}
 	}
 	it.sr.Type = typ
 	return true, nil
 }
 
-func (it *schemaIterator) indexType(path string) (string, error) {
+// indexType decodes the type of an unindexed blob and queues the blob to be indexed.
+func (it *schemaIterator) indexType(ref types.Ref, path string) (string, error) {
 	f, err := os.Open(path)
 	if os.IsNotExist(err) {
 		// blob gone
@@ -780,25 +1255,14 @@ func (it *schemaIterator) indexType(path string) (string, error) {
 	defer f.Close()
 
 	typ, err := schema.DecodeType(f)
-	if err == schema.ErrNotSchema || typ == "" {
-		// data blob - remove from unindexed list
-		err = os.Remove(path)
-		return "", err
+	if err == schema.ErrNotSchema {
+		typ, err = "", nil
 	} else if err != nil {
 		return "", err
 	}
-	// schema blob - move it to the right index folder
-	sref := filepath.Base(path)
-	ipath := filepath.Join(it.s.dir, dirIndex, indexType, typ)
-	err = os.Rename(path, filepath.Join(ipath, sref))
-	if os.IsNotExist(err) {
-		err = os.MkdirAll(ipath, dirPerm)
-		if err != nil {
-			return typ, err
-		}
-		err = os.Rename(path, filepath.Join(ipath, sref))
-	}
-	return typ, err
+	// the blob will be moved to the right index folder (or removed from the list) in background
+	it.s.queueRepair(indexRepair{ref: ref, typ: typ, known: true, unindexed: true})
+	return typ, nil
 }
 
 func (it *schemaIterator) Err() error {
@@ -813,8 +1277,8 @@ func (it *schemaIterator) Close() error {
 		it.it.Close()
 		it.it = nil
 	}
-	it.unindexed = true
-	it.types = nil
+	it.indexed = nil
+	it.done = true
 	return nil
 }
 
@@ -836,105 +1300,6 @@ func (it *schemaIterator) Decode() (schema.Object, error) {
 	return schema.Decode(rc)
 }
 
-// schemaAnyIterator iterates over all blobs and lists only schema blobs.
-// It stores an xattr that specifies the type of a blob to scan faster.
-// Force flag can be set to reindex blobs.
-type schemaAnyIterator struct {
-	s     *Storage
-	ctx   context.Context
-	force bool
-
-	blobs *namesIterator
-
-	typ string
-}
-
-func (it *schemaAnyIterator) Next() bool {
-	if it.blobs.filter == nil {
-		it.blobs.filter = it.filterType
-	}
-	if !it.blobs.Next() {
-		it.typ = ""
-		return false
-	}
-	return true
-}
-
-func (it *schemaAnyIterator) filterType(path string) (bool, error) {
-	typ, err := it.getType(path)
-	if err != nil {
-		return false, err
-	} else if typ == "" {
-		return false, nil
-	}
-	it.typ = typ
-	return true, nil
-}
-
-func (it *schemaAnyIterator) getType(path string) (string, error) {
-	if !it.force {
-		// first try to read cached xattr
-		typ, err := xattr.GetString(path, xattrSchemaType)
-		if err == nil {
-			return typ, nil
-		} else if err != nil && err != xattr.ErrNotSet {
-			return "", err
-		}
-	}
-	// not set
-	f, err := os.Open(path)
-	if os.IsNotExist(err) {
-		return "", nil
-	} else if err != nil {
-		return "", err
-	}
-	defer f.Close()
-
-	typ, err := schema.DecodeType(f)
-	if err == schema.ErrNotSchema || err == nil {
-		// files are set to RO so we need to set them to RW and then reset back
-		err = os.Chmod(path, 0644)
-		if err == nil {
-			err = xattr.SetString(path, xattrSchemaType, typ)
-			_ = os.Chmod(path, roPerm)
-		}
-	}
-	if err != nil {
-		return "", err
-	}
-	return typ, nil
-}
-
-func (it *schemaAnyIterator) Err() error {
-	return it.blobs.Err()
-}
-
-func (it *schemaAnyIterator) Close() error {
-	return it.blobs.Close()
-}
-
-func (it *schemaAnyIterator) SizedRef() types.SizedRef {
-	return it.blobs.SizedRef()
-}
-
-func (it *schemaAnyIterator) SchemaRef() types.SchemaRef {
-	sr := it.SizedRef()
-	return types.SchemaRef{
-		Ref: sr.Ref, Size: sr.Size,
-		Type: it.typ,
-	}
-}
-
-func (it *schemaAnyIterator) Decode() (schema.Object, error) {
-	rc, _, err := it.s.FetchBlob(it.ctx, it.SizedRef().Ref)
-	if err != nil {
-		return nil, err
-	}
-	defer rc.Close()
-
-	return schema.Decode(rc)
-}
-
 type genTmpFile struct {
 	s *Storage
 	f *os.File
@@ -963,7 +1328,7 @@ func (f *genTmpFile) Close() error {
 		return nil
 	}
 	f.f.Close()
-	os.Remove(f.f.Name())
+	f.s.fs.Remove(f.f.Name())
 	f.f = nil
 	return nil
 }
@@ -984,16 +1349,38 @@ func (f *genTmpFile) Commit(ref types.Ref) error {
 	defer tmp.Close()
 	name := tmp.Name()
 
-	if err := os.Chmod(name, roPerm); err != nil {
-		os.Remove(name)
+	fs := f.s.fs
+	if err := f.s.syncFile(tmp); err != nil {
+		fs.Remove(name)
+		return err
+	}
+	if err := f.s.chmodBlob(func(mode os.FileMode) error {
+		return fs.Chmod(name, mode)
+	}); err != nil {
+		fs.Remove(name)
 		return err
 	}
 	path := f.s.blobPath(ref)
-	if err := os.Rename(name, path); err != nil {
-		os.Remove(name)
+	// rename silently replaces existing blobs
+	_, err := fs.Lstat(path)
+	exists := err == nil
+	if err := f.s.placeBlobFile(name, ref, func() error {
+		return f.s.placeBlob(path, func() error {
+			return fs.Rename(name, path)
+		})
+	}); err != nil {
+		fs.Remove(name)
 		return err
 	}
-	if err := f.s.addNotIndexed(tmp, ref); err != nil {
+	// the file only exists if the blob was copied
+	_ = fs.Remove(name)
+	if !exists {
+		if fi, err := fs.Lstat(path); err == nil {
+			f.s.statsBlob(fi.Size(), true)
+		}
+	}
+	// temporary file is gone, link the blob itself
+	if err := f.s.addNotIndexedBlob(ref); err != nil {
 		return err
 	}
 	return tmp.Close()
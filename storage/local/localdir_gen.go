@@ -13,6 +13,18 @@ func (s *Storage) init() error {
 	return nil
 }
 
+// syncDir flushes directory entries to disk. Not all systems support syncing directories,
+// thus errors are ignored.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	_ = d.Sync()
+	d.Close()
+	return nil
+}
+
 func (s *Storage) close() error {
 	return nil
 }
@@ -44,6 +44,18 @@ func (s *Storage) init() error {
 	return nil
 }
 
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if err2 := d.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
 func (s *Storage) close() error {
 	if s.blobDir != nil {
 		s.blobDir.Close()
@@ -51,8 +63,25 @@ func (s *Storage) close() error {
 	return nil
 }
 
+// linkBlob links an anonymous file to the blob path.
+func (s *Storage) linkBlob(f *os.File, ref types.Ref) error {
+	if s.layout.levels() == 0 {
+		if err := linkFile(s.blobDir, ref.String(), f); err != nil {
+			return err
+		}
+		if s.noSync {
+			return nil
+		}
+		return s.blobDir.Sync()
+	}
+	path := s.blobPath(ref)
+	return s.placeBlob(path, func() error {
+		return unix.Linkat(unix.AT_FDCWD, f.Name(), unix.AT_FDCWD, path, unix.AT_SYMLINK_FOLLOW)
+	})
+}
+
 func (s *Storage) tmpFile(rw bool) (tempFile, error) {
-	if atomic.LoadInt32(&noTmpFile) != 0 {
+	if s.customFS || atomic.LoadInt32(&noTmpFile) != 0 || s.Caps().NoTmpFile {
 		return s.tmpFileGen()
 	}
 	flags := unix.O_TMPFILE | unix.O_CLOEXEC
@@ -66,8 +95,12 @@ func (s *Storage) tmpFile(rw bool) (tempFile, error) {
 	case syscall.EISDIR:
 		// system doesn't understand this flag; disable permanently
 		atomic.StoreInt32(&noTmpFile, 1)
-		fallthrough
+		return s.tmpFileGen()
 	case syscall.EOPNOTSUPP:
+		// file system doesn't support anonymous files; record it for this store
+		s.degrade(func(c *Caps) {
+			c.NoTmpFile = true
+		})
 		return s.tmpFileGen()
 	}
 	if err != nil {
@@ -127,21 +160,42 @@ func (f *linuxTmpFile) Commit(ref types.Ref) error {
 
 	fd := int(tmp.Fd())
 
-	err := SaveRefFile(context.Background(), tmp, nil, ref)
+	if f.s.meta == nil {
+		// without xattrs there is nothing to cache - blob name is the ref
+		err := SaveRefFile(context.Background(), tmp, nil, ref)
+		if err != nil {
+			return fmt.Errorf("save ref: %v", err)
+		}
+	}
+
+	err := f.s.syncFile(tmp)
 	if err != nil {
-		return fmt.Errorf("save ref: %v", err)
+		return fmt.Errorf("fsync: %v", err)
 	}
 
-	err = unix.Fchmod(fd, roPerm)
+	err = f.s.chmodBlob(func(mode os.FileMode) error {
+		return unix.Fchmod(fd, uint32(mode.Perm()))
+	})
 	if err != nil {
 		return fmt.Errorf("fchmod: %v", err)
 	}
 
-	err = linkFile(f.s.blobDir, ref.String(), tmp)
-	if err != nil {
+	err = f.s.placeBlobFile(tmp.Name(), ref, func() error {
+		return f.s.linkBlob(tmp, ref)
+	})
+	if os.IsExist(err) {
+		// the blob is already stored
+		return tmp.Close()
+	} else if err != nil {
 		return fmt.Errorf("linkat: %v", err)
 	}
+	if fi, err := tmp.Stat(); err == nil {
+		f.s.statsBlob(fi.Size(), true)
+	}
 	err = f.s.addNotIndexed(tmp, ref)
+	if err != nil && isUnsupported(err) {
+		err = f.s.addNotIndexedBlob(ref)
+	}
 	if err != nil {
 		return err
 	}
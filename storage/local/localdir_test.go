@@ -1,14 +1,28 @@
 package local
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/dennwc/cas/schema"
 	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/faulty"
 	"github.com/dennwc/cas/storage/test"
+	"github.com/dennwc/cas/types"
+	"github.com/dennwc/cas/xattr"
 )
 
 func TestLocalDir(t *testing.T) {
@@ -26,3 +40,1182 @@ func TestLocalDir(t *testing.T) {
 		return s, cleanup
 	})
 }
+
+func TestLocalDirSharded(t *testing.T) {
+	storagetest.RunTests(t, func(t testing.TB) (storage.Storage, func()) {
+		dir, err := ioutil.TempDir("", "cas_local_")
+		require.NoError(t, err)
+		cleanup := func() {
+			os.RemoveAll(dir)
+		}
+		s, err := NewWithOptions(dir, true, &Options{Layout: LayoutSharded})
+		if err != nil {
+			cleanup()
+		}
+		require.NoError(t, err)
+		return s, cleanup
+	})
+}
+
+func TestLocalDirNoSync(t *testing.T) {
+	storagetest.RunTests(t, func(t testing.TB) (storage.Storage, func()) {
+		dir, err := ioutil.TempDir("", "cas_local_")
+		require.NoError(t, err)
+		cleanup := func() {
+			os.RemoveAll(dir)
+		}
+		s, err := NewWithOptions(dir, true, &Options{Layout: LayoutSharded, NoSync: true})
+		if err != nil {
+			cleanup()
+		}
+		require.NoError(t, err)
+		return s, cleanup
+	})
+}
+
+func TestLocalDirMigrate(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir, true)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, LayoutFlat, s.Layout())
+
+	var refs []types.SizedRef
+	for i := 0; i < 10; i++ {
+		sr, err := storage.WriteBytes(ctx, s, []byte(fmt.Sprintf("blob %d", i)))
+		require.NoError(t, err)
+		refs = append(refs, sr)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Ref.String() < refs[j].Ref.String()
+	})
+
+	check := func(s *Storage, layout Layout) {
+		require.Equal(t, layout, s.Layout())
+		for _, sr := range refs {
+			_, err := os.Stat(filepath.Join(dir, dirBlobs, layout.blobPath(sr.Ref)))
+			require.NoError(t, err)
+			sz, err := s.StatBlob(ctx, sr.Ref)
+			require.NoError(t, err)
+			require.Equal(t, sr.Size, sz)
+		}
+		var got []types.SizedRef
+		it := s.IterateBlobs(ctx)
+		for it.Next() {
+			got = append(got, it.SizedRef())
+		}
+		require.NoError(t, it.Err())
+		it.Close()
+		require.Equal(t, refs, got)
+	}
+
+	require.NoError(t, s.Migrate(ctx, LayoutSharded))
+	check(s, LayoutSharded)
+	require.NoError(t, s.Close())
+
+	// layout is recorded in the store
+	s, err = New(dir, false)
+	require.NoError(t, err)
+	check(s, LayoutSharded)
+
+	// interrupted migration is resumed on open
+	require.NoError(t, s.writeMeta(&storeMeta{Layout: LayoutFlat, Migrate: LayoutSharded}))
+	require.NoError(t, s.Close())
+	s, err = New(dir, false)
+	require.NoError(t, err)
+	check(s, LayoutFlat)
+
+	d, err := os.Open(filepath.Join(dir, dirBlobs))
+	require.NoError(t, err)
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	require.NoError(t, err)
+	require.Len(t, names, len(refs), "shard directories should be removed")
+}
+
+func TestLocalDirConfigLayout(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewWithOptions(dir, true, &Options{Layout: LayoutSharded})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	for _, layout := range []Layout{"", LayoutSharded} {
+		st, err := (&Config{Dir: dir, Layout: layout}).OpenStorage(ctx)
+		require.NoError(t, err, "%q", layout)
+		require.Equal(t, LayoutSharded, st.(*Storage).Layout())
+		require.NoError(t, st.Close())
+	}
+
+	// conflicting layout is an error, and the storage is not locked afterwards
+	_, err = (&Config{Dir: dir, Layout: LayoutFlat}).OpenStorage(ctx)
+	require.Error(t, err)
+	_, err = (&Config{Dir: dir, Layout: "unknown"}).OpenStorage(ctx)
+	require.Error(t, err)
+
+	s, err = New(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+}
+
+func TestLocalDirReadOnly(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewWithOptions(dir, true, &Options{ReadOnly: true})
+	require.True(t, os.IsNotExist(err))
+
+	s, err := New(dir, true)
+	require.NoError(t, err)
+	sr, err := storage.WriteBytes(ctx, s, []byte("data"))
+	require.NoError(t, err)
+	err = s.SetPin(ctx, "root", sr.Ref)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// simulate a blob that was not written completely and drop the index
+	bad := types.BytesRef([]byte("bad"))
+	err = ioutil.WriteFile(filepath.Join(dir, dirBlobs, bad.String()), nil, defBlobPerm)
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, dirTmp)))
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, dirUnindexed)))
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, dirIndex)))
+
+	s, err = NewWithOptions(dir, false, &Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer s.Close()
+
+	sz, err := s.StatBlob(ctx, sr.Ref)
+	require.NoError(t, err)
+	require.Equal(t, sr.Size, sz)
+	ref, err := s.GetPin(ctx, "root")
+	require.NoError(t, err)
+	require.Equal(t, sr.Ref, ref)
+
+	_, err = s.StatBlob(ctx, bad)
+	require.Equal(t, storage.ErrNotFound, err)
+	_, err = os.Stat(filepath.Join(dir, dirBlobs, bad.String()))
+	require.NoError(t, err, "invalid blob should not be removed")
+
+	it := s.IterateSchema(ctx)
+	for it.Next() {
+	}
+	require.NoError(t, it.Err())
+	it.Close()
+
+	_, err = s.BeginBlob(ctx)
+	require.Equal(t, storage.ErrReadOnly, err)
+	require.Equal(t, storage.ErrReadOnly, s.SetPin(ctx, "root", bad))
+	require.Equal(t, storage.ErrReadOnly, s.DeletePin(ctx, "root"))
+	require.Equal(t, storage.ErrReadOnly, s.DeleteBlob(ctx, sr.Ref))
+	require.Equal(t, storage.ErrReadOnly, s.ReindexSchema(ctx, false))
+	require.Equal(t, storage.ErrReadOnly, s.Migrate(ctx, LayoutSharded))
+
+	for _, name := range []string{dirTmp, dirUnindexed, dirIndex} {
+		_, err = os.Stat(filepath.Join(dir, name))
+		require.True(t, os.IsNotExist(err), name)
+	}
+}
+
+func TestLocalDirLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir, true)
+	require.NoError(t, err)
+
+	// writer holds an exclusive lock
+	_, err = New(dir, false)
+	require.Equal(t, ErrStoreLocked{Dir: dir, Exclusive: true}, err)
+	_, err = NewWithOptions(dir, false, &Options{ReadOnly: true})
+	require.Equal(t, ErrStoreLocked{Dir: dir, Exclusive: false}, err)
+	require.NoError(t, s.Close())
+
+	// readers share the lock
+	r1, err := NewWithOptions(dir, false, &Options{ReadOnly: true})
+	require.NoError(t, err)
+	r2, err := NewWithOptions(dir, false, &Options{ReadOnly: true})
+	require.NoError(t, err)
+	_, err = New(dir, false)
+	require.Equal(t, ErrStoreLocked{Dir: dir, Exclusive: true}, err)
+	require.NoError(t, r1.Close())
+	require.NoError(t, r2.Close())
+
+	s, err = New(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+}
+
+func TestLocalDirIndexRepair(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir, true)
+	require.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	obj := &schema.Multipart{Parts: []types.SizedRef{{Ref: types.BytesRef([]byte("data")), Size: 4}}}
+	require.NoError(t, schema.Encode(buf, obj))
+	sr, err := storage.WriteBytes(ctx, s, buf.Bytes())
+	require.NoError(t, err)
+	data, err := storage.WriteBytes(ctx, s, []byte("data"))
+	require.NoError(t, err)
+
+	typ := schema.MustTypeOf(obj)
+	var got []types.Ref
+	it := s.IterateSchema(ctx, typ)
+	for it.Next() {
+		require.Equal(t, typ, it.SchemaRef().Type)
+		got = append(got, it.SizedRef().Ref)
+	}
+	require.NoError(t, it.Err())
+	it.Close()
+	require.Equal(t, []types.Ref{sr.Ref}, got)
+
+	// pending repairs are applied on close
+	require.NoError(t, s.Close())
+
+	_, err = os.Stat(filepath.Join(dir, dirIndex, indexType, typ, sr.Ref.String()))
+	require.NoError(t, err, "schema blob should be indexed")
+	for _, ref := range []types.Ref{sr.Ref, data.Ref} {
+		_, err = os.Stat(filepath.Join(dir, dirUnindexed, ref.String()))
+		require.True(t, os.IsNotExist(err), "blob should be removed from unindexed list")
+	}
+}
+
+func TestLocalDirNoXattr(t *testing.T) {
+	storagetest.RunTests(t, func(t testing.TB) (storage.Storage, func()) {
+		dir, err := ioutil.TempDir("", "cas_local_")
+		require.NoError(t, err)
+		cleanup := func() {
+			os.RemoveAll(dir)
+		}
+		s, err := NewWithOptions(dir, true, &Options{NoXattr: true})
+		if err != nil {
+			cleanup()
+		}
+		require.NoError(t, err)
+		return s, cleanup
+	})
+	t.Run("sidecar", func(t *testing.T) {
+		ctx := context.Background()
+		dir, err := ioutil.TempDir("", "cas_local_")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		s, err := NewWithOptions(dir, true, &Options{NoXattr: true})
+		require.NoError(t, err)
+
+		buf := new(bytes.Buffer)
+		obj := &schema.Multipart{Parts: []types.SizedRef{{Ref: types.BytesRef([]byte("data")), Size: 4}}}
+		require.NoError(t, schema.Encode(buf, obj))
+		sr, err := storage.WriteBytes(ctx, s, buf.Bytes())
+		require.NoError(t, err)
+
+		for i := 0; i < 2; i++ {
+			var got []types.SchemaRef
+			it := s.IterateSchema(ctx)
+			for it.Next() {
+				got = append(got, it.SchemaRef())
+			}
+			require.NoError(t, it.Err())
+			it.Close()
+			require.Equal(t, []types.SchemaRef{{Ref: sr.Ref, Size: sr.Size, Type: schema.MustTypeOf(obj)}}, got)
+			// wait for the type to be cached
+			s.stopRepairs()
+			s.startRepairs()
+		}
+		typ, err := s.getType(sr.Ref)
+		require.NoError(t, err)
+		require.Equal(t, schema.MustTypeOf(obj), typ)
+		_, err = xattr.GetString(s.blobPath(sr.Ref), xattrSchemaType)
+		require.NotNil(t, err, "xattr should not be set")
+
+		// refs of external files are cached in the sidecar index as well
+		path := filepath.Join(dir, "file.txt")
+		require.NoError(t, ioutil.WriteFile(path, []byte("data"), 0644))
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+		fsr, err := s.StatFile(ctx, f)
+		require.NoError(t, err)
+		require.True(t, fsr.Ref.Zero())
+		ref := types.BytesRef([]byte("data"))
+		require.NoError(t, s.SaveRefFile(ctx, f, nil, ref))
+		fsr, err = s.StatFile(ctx, f)
+		require.NoError(t, err)
+		require.Equal(t, types.SizedRef{Ref: ref, Size: 4}, fsr)
+		_, err = xattr.GetStringF(f, xattrNS+"hash")
+		require.NotNil(t, err, "xattr should not be set")
+
+		require.NoError(t, s.Close())
+
+		// existing sidecar is used even if xattrs are not disabled explicitly
+		s, err = New(dir, false)
+		require.NoError(t, err)
+		defer s.Close()
+		require.NotNil(t, s.meta)
+		typ, err = s.getType(sr.Ref)
+		require.NoError(t, err)
+		require.Equal(t, schema.MustTypeOf(obj), typ)
+	})
+}
+
+func TestLocalDirImport(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := []byte("data")
+	ref := types.BytesRef(data)
+
+	t.Run("hardlink", func(t *testing.T) {
+		s, err := NewWithOptions(filepath.Join(dir, "link"), true, &Options{Import: ImportHardlink})
+		require.NoError(t, err)
+		defer s.Close()
+
+		path := filepath.Join(dir, "link.txt")
+		require.NoError(t, ioutil.WriteFile(path, data, 0644))
+		sr, err := s.ImportFile(ctx, path)
+		require.NoError(t, err)
+		require.Equal(t, types.SizedRef{Ref: ref, Size: 4}, sr)
+
+		st1, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0444), st1.Mode().Perm(), "file should be read-only")
+		st2, err := os.Stat(s.blobPath(ref))
+		require.NoError(t, err)
+		require.True(t, os.SameFile(st1, st2), "expected a hard link")
+
+		// already stored blobs are not linked, and the file stays writable
+		path2 := filepath.Join(dir, "link2.txt")
+		require.NoError(t, ioutil.WriteFile(path2, data, 0644))
+		sr, err = s.ImportFile(ctx, path2)
+		require.NoError(t, err)
+		require.Equal(t, ref, sr.Ref)
+		st1, err = os.Stat(path2)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0644), st1.Mode().Perm())
+	})
+	t.Run("copy", func(t *testing.T) {
+		s, err := NewWithOptions(filepath.Join(dir, "copy"), true, &Options{Import: ImportCopy})
+		require.NoError(t, err)
+		defer s.Close()
+
+		path := filepath.Join(dir, "copy.txt")
+		require.NoError(t, ioutil.WriteFile(path, data, 0644))
+		sr, err := s.ImportFile(ctx, path)
+		require.NoError(t, err)
+		require.Equal(t, types.SizedRef{Ref: ref, Size: 4}, sr)
+
+		st1, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0644), st1.Mode().Perm())
+		st2, err := os.Stat(s.blobPath(ref))
+		require.NoError(t, err)
+		require.False(t, os.SameFile(st1, st2))
+	})
+	t.Run("modes", func(t *testing.T) {
+		m, err := ParseImportMode("clone, hardlink")
+		require.NoError(t, err)
+		require.Equal(t, ImportClone|ImportHardlink, m)
+		require.Equal(t, "clone,hardlink", m.String())
+		_, err = ParseImportMode("symlink")
+		require.NotNil(t, err)
+	})
+}
+
+func TestLocalDirPerms(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix permissions are not supported")
+	}
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dir = filepath.Join(dir, "store")
+	s, err := NewWithOptions(dir, true, &Options{
+		Layout: LayoutSharded,
+		Perms:  Perms{Umask: 0027, Dir: 02770},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	sr, err := storage.WriteBytes(ctx, s, []byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, s.SetPin(ctx, "root", sr.Ref))
+
+	checkMode := func(path string, exp os.FileMode) {
+		st, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, exp, st.Mode()&(os.ModePerm|os.ModeSetgid), "%s", path)
+	}
+	checkMode(s.blobPath(sr.Ref), 0440)
+	checkMode(s.pinPath("root"), 0640)
+	checkMode(dir, 0770|os.ModeSetgid)
+	checkMode(filepath.Join(dir, dirPins), 0770|os.ModeSetgid)
+	// shard directories are created on commit
+	checkMode(filepath.Dir(s.blobPath(sr.Ref)), 0770|os.ModeSetgid)
+
+	p, err := ParsePerm("02775")
+	require.NoError(t, err)
+	require.Equal(t, 0775|os.ModeSetgid, p.FileMode())
+	require.Equal(t, "02775", p.String())
+}
+
+func TestLocalDirShared(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix permissions are not supported")
+	}
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dir = filepath.Join(dir, "store")
+	gid := os.Getgid()
+	s, err := NewWithOptions(dir, true, &Options{
+		Perms: Perms{Shared: true, Group: strconv.Itoa(gid)},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	sr, err := storage.WriteBytes(ctx, s, []byte("data"))
+	require.NoError(t, err)
+	require.NoError(t, s.SetPin(ctx, "root", sr.Ref))
+
+	checkMode := func(path string, exp os.FileMode) {
+		st, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, exp, st.Mode()&(os.ModePerm|os.ModeSetgid), "%s", path)
+		if g, ok := fileGroup(st); ok {
+			require.Equal(t, gid, g, "%s", path)
+		}
+	}
+	checkMode(s.blobPath(sr.Ref), 0444)
+	checkMode(s.pinPath("root"), 0664)
+	checkMode(s.metaPath(), 0664)
+	checkMode(filepath.Join(dir, lockFile), 0664)
+	checkMode(dir, 0775|os.ModeSetgid)
+	checkMode(filepath.Join(dir, dirPins), 0775|os.ModeSetgid)
+
+	_, err = NewWithOptions(dir, true, &Options{
+		Perms: Perms{Group: "cas-no-such-group"},
+	})
+	require.Error(t, err)
+}
+
+func TestLocalDirRefs(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir, true)
+	require.NoError(t, err)
+
+	writeSchema := func(obj schema.Object) types.Ref {
+		buf := new(bytes.Buffer)
+		require.NoError(t, schema.Encode(buf, obj))
+		sr, err := storage.WriteBytes(ctx, s, buf.Bytes())
+		require.NoError(t, err)
+		return sr.Ref
+	}
+	data, err := storage.WriteBytes(ctx, s, []byte("data"))
+	require.NoError(t, err)
+	m1 := writeSchema(&schema.Multipart{Parts: []types.SizedRef{data}})
+	m2 := writeSchema(&schema.Multipart{Parts: []types.SizedRef{data, data}})
+	top := writeSchema(&schema.Multipart{Parts: []types.SizedRef{{Ref: m1, Size: 1}}})
+
+	expect := func(ref types.Ref, exp ...types.Ref) {
+		refs, err := s.Referrers(ctx, ref)
+		require.NoError(t, err)
+		sort.Slice(exp, func(i, j int) bool {
+			return exp[i].String() < exp[j].String()
+		})
+		if len(exp) == 0 {
+			exp = nil
+		}
+		require.Equal(t, exp, refs)
+		n, err := s.RefCount(ctx, ref)
+		require.NoError(t, err)
+		require.Equal(t, len(exp), n)
+	}
+	expect(data.Ref, m1, m2)
+	expect(m1, top)
+	expect(top)
+
+	// removed schema blobs no longer reference anything
+	require.NoError(t, s.DeleteBlob(ctx, m2))
+	expect(data.Ref, m1)
+	require.NoError(t, s.Close())
+
+	// stores without the reverse index are reindexed on open
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, dirIndex, indexRefs)))
+	s, err = New(dir, true)
+	require.NoError(t, err)
+	expect(data.Ref, m1)
+	require.NoError(t, s.Close())
+
+	s, err = NewWithOptions(dir, false, &Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer s.Close()
+	expect(m1, top)
+}
+
+func TestLocalDirCaps(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix permissions are not supported")
+	}
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir, true)
+	require.NoError(t, err)
+	// capabilities are probed and recorded on the first open
+	meta, err := s.readMeta()
+	require.NoError(t, err)
+	require.Equal(t, &Caps{}, meta.Caps)
+	require.NoError(t, s.Close())
+
+	// pretend the file system ignores chmod
+	meta.Caps = &Caps{NoChmod: true, NoRename: true}
+	require.NoError(t, s.writeMeta(meta))
+	s, err = New(dir, true)
+	require.NoError(t, err)
+	require.Equal(t, *meta.Caps, s.Caps())
+
+	for _, gen := range []bool{false, true} {
+		data := []byte(fmt.Sprint("data ", gen))
+		sr := types.SizedRef{Ref: types.BytesRef(data), Size: uint64(len(data))}
+		if gen {
+			// generic temp files are used on systems without O_TMPFILE
+			f, err := s.tmpFileGen()
+			require.NoError(t, err)
+			_, err = f.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, f.Commit(sr.Ref))
+		} else {
+			_, err = storage.WriteBytes(ctx, s, data)
+			require.NoError(t, err)
+		}
+
+		st, err := os.Stat(s.blobPath(sr.Ref))
+		require.NoError(t, err)
+		require.NotZero(t, st.Mode().Perm()&0200, "blob should not be chmoded")
+		require.NoError(t, s.CheckBlob(ctx, sr.Ref), "expected deviation should not be reported")
+		_, err = os.Stat(filepath.Join(dir, dirUnindexed, sr.Ref.String()))
+		require.NoError(t, err, "blob should be added to the unindexed list")
+
+		// deviation is reported once the file system supports chmod
+		s.caps = Caps{}
+		require.Equal(t, ErrBlobMode{Mode: st.Mode().Perm(), Exp: defBlobPerm}, s.CheckBlob(ctx, sr.Ref))
+		s.caps = *meta.Caps
+	}
+	require.NoError(t, s.Close())
+}
+
+func TestLocalDirTmpFile(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir, true)
+	require.NoError(t, err)
+	defer s.Close()
+
+	tmpFiles := func() int {
+		infos, err := ioutil.ReadDir(filepath.Join(dir, dirTmp))
+		require.NoError(t, err)
+		n := 0
+		for _, fi := range infos {
+			if !fi.IsDir() {
+				n++
+			}
+		}
+		return n
+	}
+	for _, named := range []bool{false, true} {
+		if named {
+			s.caps.NoTmpFile = true
+		}
+		w, err := s.BeginBlob(ctx)
+		require.NoError(t, err)
+		data := []byte(fmt.Sprint("data ", named))
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		if named || runtime.GOOS != "linux" || s.Caps().NoTmpFile {
+			require.Equal(t, 1, tmpFiles())
+		} else {
+			// anonymous files never appear in the temporary directory
+			require.Equal(t, 0, tmpFiles())
+		}
+		require.NoError(t, w.Commit())
+		require.Equal(t, 0, tmpFiles())
+		_, err = s.StatBlob(ctx, types.BytesRef(data))
+		require.NoError(t, err)
+
+		// committing a blob that already exists is not an error
+		w, err = s.BeginBlob(ctx)
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, w.Commit())
+		require.Equal(t, 0, tmpFiles())
+	}
+}
+
+func TestLocalDirStats(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir, true)
+	require.NoError(t, err)
+
+	write := func(data []byte) types.SizedRef {
+		sr, err := storage.WriteBytes(ctx, s, data)
+		require.NoError(t, err)
+		return sr
+	}
+	writeSchema := func(obj schema.Object) types.SizedRef {
+		buf := new(bytes.Buffer)
+		require.NoError(t, schema.Encode(buf, obj))
+		return write(buf.Bytes())
+	}
+	checkStats := func() *storage.Stats {
+		st, err := s.Stats(ctx)
+		require.NoError(t, err)
+		exp, err := storage.ScanStats(ctx, s)
+		require.NoError(t, err)
+		require.Equal(t, exp, st)
+		return st
+	}
+	require.Equal(t, &storage.Stats{Schema: map[string]uint64{}}, checkStats())
+
+	data := write([]byte("data"))
+	m := writeSchema(&schema.Multipart{Parts: []types.SizedRef{data}})
+	require.NoError(t, s.SetPin(ctx, "root", m.Ref))
+	st := checkStats()
+	require.Equal(t, uint64(2), st.Blobs)
+	require.Equal(t, data.Size+m.Size, st.Size)
+	require.Equal(t, uint64(1), st.SchemaBlobs())
+	require.Equal(t, uint64(1), st.Pins)
+
+	// counters are updated incrementally
+	extra := write([]byte("more data"))
+	require.NoError(t, s.DeleteBlob(ctx, data.Ref))
+	st = checkStats()
+	require.Equal(t, m.Size+extra.Size, st.Size)
+
+	// counters are saved when the storage is closed, and are discarded while it's opened for writing
+	require.NoError(t, s.Close())
+	_, err = os.Stat(filepath.Join(dir, fileStats))
+	require.NoError(t, err)
+	s, err = New(dir, true)
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = os.Stat(filepath.Join(dir, fileStats))
+	require.True(t, os.IsNotExist(err))
+	require.NotNil(t, s.stats)
+	require.Equal(t, st, checkStats())
+}
+
+func TestLocalDirMaxSize(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewWithOptions(dir, true, &Options{MaxSize: 10})
+	require.NoError(t, err)
+	defer s.Close()
+
+	headroom := func() uint64 {
+		st, err := s.Stats(ctx)
+		require.NoError(t, err)
+		require.Equal(t, uint64(10), st.Limit)
+		n, ok := st.Headroom()
+		require.True(t, ok)
+		return n
+	}
+	require.Equal(t, uint64(10), headroom())
+
+	sr, err := storage.WriteBytes(ctx, s, []byte("123456"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), headroom())
+
+	_, err = storage.WriteBytes(ctx, s, []byte("abcde"))
+	require.Equal(t, storage.ErrStoreFull, err)
+	require.Equal(t, uint64(4), headroom())
+
+	_, err = storage.WriteBytes(ctx, s, []byte("abcd"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), headroom())
+
+	// removing blobs frees the space
+	require.NoError(t, s.DeleteBlob(ctx, sr.Ref))
+	require.Equal(t, uint64(6), headroom())
+	_, err = storage.WriteBytes(ctx, s, []byte("abcde"))
+	require.NoError(t, err)
+}
+
+func TestLocalDirStatsTruncated(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir, true)
+	require.NoError(t, err)
+	keep, err := storage.WriteBytes(ctx, s, []byte("keep"))
+	require.NoError(t, err)
+	broken, err := storage.WriteBytes(ctx, s, []byte("broken"))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// counters were never calculated, thus blobs will be listed, including an empty blob that will be removed
+	_, err = os.Stat(filepath.Join(dir, fileStats))
+	require.True(t, os.IsNotExist(err))
+	path := s.blobPath(broken.Ref)
+	require.NoError(t, os.Chmod(path, 0644))
+	require.NoError(t, os.Truncate(path, 0))
+
+	s, err = NewWithOptions(dir, true, &Options{MaxSize: 100})
+	require.NoError(t, err)
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := storage.WriteBytes(ctx, s, []byte("data"))
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("deadlock")
+	}
+	st, err := s.Stats(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), st.Blobs)
+	require.Equal(t, keep.Size+4, st.Size)
+	_, err = s.StatBlob(ctx, broken.Ref)
+	require.Equal(t, storage.ErrNotFound, err)
+}
+
+func TestLocalDirSchemaDB(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir, true)
+	require.NoError(t, err)
+
+	writeSchema := func(obj schema.Object) types.SchemaRef {
+		buf := new(bytes.Buffer)
+		require.NoError(t, schema.Encode(buf, obj))
+		sr, err := storage.WriteBytes(ctx, s, buf.Bytes())
+		require.NoError(t, err)
+		return types.SchemaRef{Ref: sr.Ref, Size: sr.Size, Type: schema.MustTypeOf(obj)}
+	}
+	data, err := storage.WriteBytes(ctx, s, []byte("data"))
+	require.NoError(t, err)
+	m1 := writeSchema(&schema.Multipart{Parts: []types.SizedRef{data}})
+	m2 := writeSchema(&schema.Multipart{Parts: []types.SizedRef{data, data}})
+
+	// types of schema blobs are recorded on commit
+	typ, err := s.getType(m1.Ref)
+	require.NoError(t, err)
+	require.Equal(t, m1.Type, typ)
+	_, err = s.getType(data.Ref)
+	require.Equal(t, errNotCached, err)
+
+	list := func() []types.SchemaRef {
+		var got []types.SchemaRef
+		it := s.IterateSchema(ctx)
+		defer it.Close()
+		for it.Next() {
+			got = append(got, it.SchemaRef())
+		}
+		require.NoError(t, it.Err())
+		return got
+	}
+	require.ElementsMatch(t, []types.SchemaRef{m1, m2}, list())
+
+	require.NoError(t, s.DeleteBlob(ctx, m2.Ref))
+	require.NoError(t, s.Close())
+
+	// indexed blobs are listed from the database, blob files are not modified
+	s, err = New(dir, false)
+	require.NoError(t, err)
+	typ, err = s.getType(data.Ref)
+	require.NoError(t, err)
+	require.Equal(t, "", typ)
+	require.Equal(t, []types.SchemaRef{m1}, list())
+	fi, err := os.Stat(s.blobPath(m1.Ref))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0444), fi.Mode().Perm())
+	_, err = xattr.GetString(s.blobPath(m1.Ref), xattrSchemaType)
+	require.NotNil(t, err, "xattr should not be set")
+	require.NoError(t, s.Close())
+
+	// database is created from the type index for existing storages
+	require.NoError(t, os.Remove(filepath.Join(dir, dirIndex, fileSchemaDB)))
+	s, err = New(dir, false)
+	require.NoError(t, err)
+	require.Equal(t, []types.SchemaRef{m1}, list())
+
+	// database is rebuilt from blobs
+	require.NoError(t, s.ReindexSchema(ctx, true))
+	require.Equal(t, []types.SchemaRef{m1}, list())
+	require.NoError(t, s.Close())
+}
+
+func TestLocalDirResume(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir, true)
+	require.NoError(t, err)
+
+	w, err := s.BeginResumableBlob(ctx)
+	require.NoError(t, err)
+	token := w.Token()
+	_, err = w.Write([]byte("hello "))
+	require.NoError(t, err)
+	require.NoError(t, w.Suspend())
+	require.NoError(t, w.Close())
+
+	_, err = s.ResumeBlob(ctx, "0123456789abcdef0123456789abcdef")
+	require.Equal(t, storage.ErrNotFound, err)
+
+	// partial blob persists across restarts
+	require.NoError(t, s.Close())
+	s, err = New(dir, true)
+	require.NoError(t, err)
+	defer s.Close()
+
+	w, err = s.ResumeBlob(ctx, token)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), w.Size())
+	_, err = s.ResumeBlob(ctx, token)
+	require.Equal(t, errResumeBusy, err)
+	_, err = w.Write([]byte("wor"))
+	require.NoError(t, err)
+	require.NoError(t, w.Suspend())
+
+	// content written after the checkpoint is hashed again
+	f, err := os.OpenFile(s.resumePath(token), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("ld"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	w, err = s.ResumeBlob(ctx, token)
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), w.Size())
+	sr, err := w.Complete()
+	require.NoError(t, err)
+	require.Equal(t, types.BytesRef([]byte("hello world")), sr.Ref)
+	require.NoError(t, w.Commit())
+
+	sz, err := s.StatBlob(ctx, sr.Ref)
+	require.NoError(t, err)
+	require.Equal(t, uint64(11), sz)
+	_, err = s.ResumeBlob(ctx, token)
+	require.Equal(t, storage.ErrNotFound, err)
+
+	// state is ignored if it doesn't match the content
+	w, err = s.BeginResumableBlob(ctx)
+	require.NoError(t, err)
+	token = w.Token()
+	_, err = w.Write([]byte("schema"))
+	require.NoError(t, err)
+	require.NoError(t, w.Suspend())
+	require.NoError(t, os.Truncate(s.resumePath(token), 3))
+
+	w, err = s.ResumeBlob(ctx, token)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), w.Size())
+	sr, err = w.Complete()
+	require.NoError(t, err)
+	require.Equal(t, types.BytesRef([]byte("sch")), sr.Ref)
+
+	// discarded blobs cannot be resumed
+	require.NoError(t, w.Close())
+	_, err = s.ResumeBlob(ctx, token)
+	require.Equal(t, storage.ErrNotFound, err)
+	names, err := readDirNames(filepath.Join(dir, dirTmp, dirResume))
+	require.NoError(t, err)
+	require.Empty(t, names)
+}
+
+func TestLocalDirPinCorrupted(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir, true)
+	require.NoError(t, err)
+	defer s.Close()
+
+	ref := types.BytesRef([]byte("data"))
+	require.NoError(t, s.SetPin(ctx, "a", ref))
+	got, err := s.GetPin(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, ref, got)
+
+	// pins are written to a temporary file and renamed
+	names, err := readDirNames(filepath.Join(dir, dirTmp))
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	// pins truncated by a crash are reported as corrupted
+	for _, data := range []string{"", ref.String()[:20]} {
+		require.NoError(t, ioutil.WriteFile(s.pinPath("a"), []byte(data), 0644))
+		_, err = s.GetPin(ctx, "a")
+		require.IsType(t, storage.ErrPinCorrupted{}, err)
+		require.Equal(t, "a", err.(storage.ErrPinCorrupted).Name)
+
+		it := s.IteratePins(ctx)
+		require.False(t, it.Next())
+		require.IsType(t, storage.ErrPinCorrupted{}, it.Err())
+		it.Close()
+	}
+
+	require.NoError(t, s.SetPin(ctx, "a", ref))
+	got, err = s.GetPin(ctx, "a")
+	require.NoError(t, err)
+	require.Equal(t, ref, got)
+}
+
+func TestLocalDirPinHistory(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_local_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(dir, true)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// pin created before the history was kept
+	r1 := types.BytesRef([]byte("v1"))
+	require.NoError(t, ioutil.WriteFile(s.pinPath("a"), []byte(r1.String()), 0644))
+	hist, err := s.PinHistory(ctx, "a")
+	require.NoError(t, err)
+	require.Len(t, hist, 1)
+	require.Equal(t, r1, hist[0].Ref)
+
+	// its value is recorded before the first change
+	r2 := types.BytesRef([]byte("v2"))
+	require.NoError(t, s.SetPin(ctx, "a", r2))
+	hist, err = s.PinHistory(ctx, "a")
+	require.NoError(t, err)
+	require.Len(t, hist, 2)
+	require.Equal(t, r1, hist[0].Ref)
+	require.Equal(t, r2, hist[1].Ref)
+
+	// incomplete records are ignored
+	f, err := os.OpenFile(s.historyPath("a"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("123"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	hist, err = s.PinHistory(ctx, "a")
+	require.NoError(t, err)
+	require.Len(t, hist, 2)
+
+	// and are removed by the next change
+	require.NoError(t, s.DeletePin(ctx, "a"))
+	hist, err = s.PinHistory(ctx, "a")
+	require.NoError(t, err)
+	require.Len(t, hist, 3)
+	require.True(t, hist[2].Ref.Zero())
+}
+
+// faultyFS fails operations on paths with a given prefix.
+type faultyFS struct {
+	osFS
+	renames string // prefix of paths that cannot be renamed
+}
+
+var errInjected = errors.New("injected failure")
+
+func (fs *faultyFS) Rename(oldpath, newpath string) error {
+	if fs.renames != "" && strings.HasPrefix(newpath, fs.renames) {
+		return errInjected
+	}
+	return fs.osFS.Rename(oldpath, newpath)
+}
+
+func TestLocalDirFS(t *testing.T) {
+	storagetest.RunTests(t, func(t testing.TB) (storage.Storage, func()) {
+		dir, err := ioutil.TempDir("", "cas_local_")
+		require.NoError(t, err)
+		cleanup := func() {
+			os.RemoveAll(dir)
+		}
+		s, err := NewWithOptions(dir, true, &Options{Layout: LayoutSharded, FS: &faultyFS{}})
+		if err != nil {
+			cleanup()
+		}
+		require.NoError(t, err)
+		return s, cleanup
+	})
+	t.Run("faults", func(t *testing.T) {
+		ctx := context.Background()
+		dir, err := ioutil.TempDir("", "cas_local_")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		now := time.Unix(1000, 0)
+		fs := &faultyFS{}
+		s, err := NewWithOptions(dir, true, &Options{FS: fs, Clock: func() time.Time { return now }})
+		require.NoError(t, err)
+		defer s.Close()
+
+		r1 := types.BytesRef([]byte("v1"))
+		require.NoError(t, s.SetPin(ctx, "a", r1))
+		hist, err := s.PinHistory(ctx, "a")
+		require.NoError(t, err)
+		require.Len(t, hist, 1)
+		require.True(t, now.Equal(hist[0].Time))
+
+		// crash before the pin is replaced
+		fs.renames = filepath.Join(dir, dirPins)
+		require.Equal(t, errInjected, s.SetPin(ctx, "a", types.BytesRef([]byte("v2"))))
+		ref, err := s.GetPin(ctx, "a")
+		require.NoError(t, err)
+		require.Equal(t, r1, ref)
+
+		// crash before the blob is moved to the blobs directory
+		fs.renames = filepath.Join(dir, dirBlobs)
+		_, err = storage.WriteBytes(ctx, s, []byte("data"))
+		require.Equal(t, errInjected, err)
+		_, err = s.StatBlob(ctx, types.BytesRef([]byte("data")))
+		require.Equal(t, storage.ErrNotFound, err)
+
+		// no temporary files are left
+		names, err := readDirNames(filepath.Join(dir, dirTmp))
+		require.NoError(t, err)
+		require.Empty(t, names)
+	})
+}
+
+func TestLocalDirCrash(t *testing.T) {
+	ctx := context.Background()
+
+	// writeBlobs opens the storage on a faulty file system, writes a few blobs and a pin and simulates a crash
+	writeBlobs := func(t *testing.T, dir string, opts Options) ([]types.Ref, int) {
+		fs := faulty.NewFS(OSFS(), faulty.Config{})
+		opts.FS = fs
+		s, err := NewWithOptions(dir, true, &opts)
+		require.NoError(t, err)
+		var refs []types.Ref
+		for i := 0; i < 10; i++ {
+			sr, err := storage.WriteBytes(ctx, s, []byte("blob "+strconv.Itoa(i)))
+			require.NoError(t, err)
+			refs = append(refs, sr.Ref)
+		}
+		require.NoError(t, s.SetPin(ctx, "root", refs[0]))
+		require.NoError(t, s.Close())
+		n := fs.Unsynced()
+		require.NoError(t, fs.Crash())
+		return refs, n
+	}
+	// checkBlobs reopens the storage after a crash and returns the number of blobs that survived
+	checkBlobs := func(t *testing.T, dir string, refs []types.Ref) int {
+		s, err := New(dir, false)
+		require.NoError(t, err)
+		defer s.Close()
+		n := 0
+		for _, ref := range refs {
+			rc, _, err := s.FetchBlob(ctx, ref)
+			if err == storage.ErrNotFound {
+				continue
+			}
+			require.NoError(t, err)
+			sr, err := types.Hash(rc)
+			rc.Close()
+			require.NoError(t, err)
+			require.Equal(t, ref, sr.Ref)
+			n++
+		}
+		return n
+	}
+
+	t.Run("sync", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cas_local_")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		refs, _ := writeBlobs(t, dir, Options{})
+		require.Equal(t, len(refs), checkBlobs(t, dir, refs))
+
+		s, err := New(dir, false)
+		require.NoError(t, err)
+		defer s.Close()
+		ref, err := s.GetPin(ctx, "root")
+		require.NoError(t, err)
+		require.Equal(t, refs[0], ref)
+	})
+	t.Run("nosync", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cas_local_")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		// blobs are lost, but never reported as valid
+		refs, unsynced := writeBlobs(t, dir, Options{NoSync: true})
+		require.NotZero(t, unsynced)
+		require.True(t, checkBlobs(t, dir, refs) < len(refs))
+	})
+	t.Run("torn renames", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "cas_local_")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		fs := faulty.NewFS(OSFS(), faulty.Config{})
+		s, err := NewWithOptions(dir, true, &Options{FS: fs})
+		require.NoError(t, err)
+		defer s.Close()
+
+		r1 := types.BytesRef([]byte("v1"))
+		require.NoError(t, s.SetPin(ctx, "a", r1))
+
+		fs.SetConfig(faulty.Config{TornRenames: 1})
+		require.Equal(t, faulty.ErrInjected, s.SetPin(ctx, "a", types.BytesRef([]byte("v2"))))
+		_, err = storage.WriteBytes(ctx, s, []byte("data"))
+		require.Equal(t, faulty.ErrInjected, err)
+		fs.SetConfig(faulty.Config{})
+
+		// torn pins are reported as corrupted, and torn blobs are removed
+		_, err = s.GetPin(ctx, "a")
+		require.IsType(t, storage.ErrPinCorrupted{}, err)
+		_, err = s.StatBlob(ctx, types.BytesRef([]byte("data")))
+		require.Equal(t, storage.ErrNotFound, err)
+	})
+}
@@ -0,0 +1,75 @@
+package local
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFile is the name of the file used for cross-process locking of the storage.
+const lockFile = "lock"
+
+// ErrStoreLocked is returned when the storage is already opened by another process in a conflicting mode.
+//
+// Readers hold a shared lock and writers hold an exclusive lock on the storage, thus multiple processes
+// may read the storage at the same time, but only one process may modify it.
+type ErrStoreLocked struct {
+	Dir       string
+	Exclusive bool // exclusive lock was requested
+}
+
+func (e ErrStoreLocked) Error() string {
+	mode := "reading"
+	if e.Exclusive {
+		mode = "writing"
+	}
+	return fmt.Sprintf("storage %s is locked by another process, cannot open it for %s", e.Dir, mode)
+}
+
+// lock acquires an advisory lock on the storage directory. Read-only storage acquires a shared lock,
+// while writable storage acquires an exclusive lock.
+func (s *Storage) lock() error {
+	path := filepath.Join(s.dir, lockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, s.perms.file)
+	if err != nil && s.readOnly {
+		// storage might be on a read-only FS; lock it if the lock file exists
+		f, err = os.Open(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	excl := !s.readOnly
+	if err = flock(f, excl); err == errWouldBlock {
+		f.Close()
+		return ErrStoreLocked{Dir: s.dir, Exclusive: excl}
+	} else if err != nil {
+		f.Close()
+		return err
+	}
+	if !s.readOnly {
+		// other users of a shared storage must be able to open the lock file for writing
+		if err = s.chmodFile(path); err != nil {
+			funlock(f)
+			f.Close()
+			return err
+		}
+	}
+	s.lockf = f
+	return nil
+}
+
+// unlock releases the lock acquired by lock.
+func (s *Storage) unlock() error {
+	if s.lockf == nil {
+		return nil
+	}
+	err := funlock(s.lockf)
+	if err2 := s.lockf.Close(); err == nil {
+		err = err2
+	}
+	s.lockf = nil
+	return err
+}
@@ -0,0 +1,17 @@
+package local
+
+import (
+	"errors"
+	"os"
+)
+
+var errWouldBlock = errors.New("lock would block")
+
+// flock is not implemented on Windows; the storage is not locked.
+func flock(f *os.File, excl bool) error {
+	return nil
+}
+
+func funlock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,272 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dennwc/cas/types"
+	"github.com/dennwc/cas/xattr"
+)
+
+const (
+	dirMeta = "meta"
+
+	metaFiles   = "files"   // refs of files outside of the storage
+	metaLayouts = "layouts" // layouts of files outside of the storage
+)
+
+// errNotCached is returned when the type of a blob is not known until the blob is indexed.
+var errNotCached = errors.New("metadata is not cached")
+
+// sidecar stores the metadata of files outside of the storage in flat files under the meta directory.
+// It is used instead of xattrs when they are disabled or not supported by the file system.
+type sidecar struct {
+	s   *Storage
+	dir string
+}
+
+// initMeta decides if the sidecar index should be used instead of xattrs.
+//
+// The sidecar is used if xattrs are disabled or are not supported by the file system (Windows, FAT, exFAT, etc).
+// Once the sidecar is created, it is used regardless of the options, thus all processes agree on where
+// the metadata is stored.
+func (s *Storage) initMeta(noXattr bool) error {
+	dir := filepath.Join(s.dir, dirMeta)
+	if !noXattr {
+		if _, err := os.Stat(dir); err == nil {
+			noXattr = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if !noXattr && !s.readOnly {
+		ok, err := xattr.Supported(s.dir)
+		if err != nil {
+			return err
+		}
+		noXattr = !ok
+	}
+	if !noXattr {
+		return nil
+	}
+	s.meta = &sidecar{s: s, dir: dir}
+	if s.readOnly {
+		return nil
+	}
+	return s.mkdirAll(dir)
+}
+
+func (m *sidecar) path(kind, name string) string {
+	return filepath.Join(m.dir, kind, name)
+}
+
+func (m *sidecar) get(kind, name string) (string, error) {
+	data, err := ioutil.ReadFile(m.path(kind, name))
+	if os.IsNotExist(err) {
+		return "", errNotCached
+	} else if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// set atomically replaces the metadata record.
+func (m *sidecar) set(kind, name, val string) error {
+	dir := filepath.Join(m.dir, kind)
+	f, err := ioutil.TempFile(dir, ".meta_")
+	if os.IsNotExist(err) {
+		if err = m.s.mkdirAll(dir); err != nil {
+			return err
+		}
+		f, err = ioutil.TempFile(dir, ".meta_")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(val)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = m.s.chmodFile(f.Name())
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (m *sidecar) remove(kind, name string) error {
+	err := os.Remove(m.path(kind, name))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// getType returns the schema type of the blob from the schema index database. It returns an empty string
+// for data blobs and errNotCached if the blob is not indexed yet.
+func (s *Storage) getType(ref types.Ref) (string, error) {
+	if e, ok := s.schemas.get(ref); ok {
+		return e.typ, nil
+	}
+	if _, err := os.Lstat(filepath.Join(s.dir, dirUnindexed, ref.String())); err == nil {
+		return "", errNotCached
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if _, err := os.Lstat(s.blobPath(ref)); err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// setType records the schema type of the blob in the schema index database.
+// Data blobs are not recorded, they are known by being removed from the unindexed list.
+func (s *Storage) setType(ref types.Ref, typ string) error {
+	if typ == "" {
+		return nil
+	}
+	fi, err := os.Lstat(s.blobPath(ref))
+	if err != nil {
+		return err
+	}
+	return s.schemas.put(ref, typ, uint64(fi.Size()))
+}
+
+// fileKey returns a name of the metadata record for a file outside of the storage.
+func fileKey(f *os.File) (string, error) {
+	path, err := filepath.Abs(f.Name())
+	if err != nil {
+		return "", err
+	}
+	return types.BytesRef([]byte(path)).String(), nil
+}
+
+// StatFile is similar to the package-level StatFile, but reads the ref from the sidecar index
+// if the storage uses it instead of xattrs.
+func (s *Storage) StatFile(ctx context.Context, f *os.File) (types.SizedRef, error) {
+	if s.meta == nil {
+		return StatFile(ctx, f)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	sr := types.SizedRef{Size: uint64(st.Size())}
+	key, err := fileKey(f)
+	if err != nil {
+		return sr, nil
+	}
+	val, err := s.meta.get(metaFiles, key)
+	if err != nil {
+		// fallback to size only
+		return sr, nil
+	}
+	// record is "<ref> <size> <mtime>"
+	fields := strings.Fields(val)
+	if len(fields) != 3 {
+		return sr, nil
+	}
+	ref, err := types.ParseRef(fields[0])
+	if err != nil {
+		return sr, nil
+	}
+	size, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil || size != uint64(st.Size()) {
+		return sr, nil
+	}
+	mtime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || mtime != st.ModTime().UnixNano() {
+		return sr, nil
+	}
+	sr.Ref = ref
+	return sr, nil
+}
+
+// SaveRefFile is similar to the package-level SaveRefFile, but writes the ref to the sidecar index
+// if the storage uses it instead of xattrs.
+func (s *Storage) SaveRefFile(ctx context.Context, f *os.File, fi os.FileInfo, ref types.Ref) error {
+	if s.meta == nil {
+		return SaveRefFile(ctx, f, fi, ref)
+	} else if s.readOnly {
+		// cannot cache the ref, but it's not an error for the caller
+		return nil
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi != nil {
+		if st.Size() != fi.Size() || !st.ModTime().Equal(fi.ModTime()) {
+			// file was already modified
+			return nil
+		}
+	} else {
+		fi = st
+	}
+	key, err := fileKey(f)
+	if err != nil {
+		return err
+	}
+	val := fmt.Sprintf("%s %d %d", ref, fi.Size(), fi.ModTime().UnixNano())
+	return s.meta.set(metaFiles, key, val)
+}
+
+// GetFileLayout is similar to the package-level GetFileLayout, but reads the layout from the sidecar index
+// if the storage uses it instead of xattrs.
+func (s *Storage) GetFileLayout(ctx context.Context, f *os.File) (FileLayout, error) {
+	if s.meta == nil {
+		return GetFileLayout(ctx, f)
+	}
+	key, err := fileKey(f)
+	if err != nil {
+		return FileLayout{}, nil
+	}
+	val, err := s.meta.get(metaLayouts, key)
+	if err != nil {
+		return FileLayout{}, nil
+	}
+	l, err := parseFileLayout(val)
+	if err != nil {
+		return FileLayout{}, nil
+	}
+	return l, nil
+}
+
+// SaveFileLayout is similar to the package-level SaveFileLayout, but writes the layout to the sidecar index
+// if the storage uses it instead of xattrs.
+func (s *Storage) SaveFileLayout(ctx context.Context, f *os.File, fi os.FileInfo, ref types.Ref) error {
+	if s.meta == nil {
+		return SaveFileLayout(ctx, f, fi, ref)
+	} else if s.readOnly {
+		return nil
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi != nil {
+		if st.Size() != fi.Size() || !st.ModTime().Equal(fi.ModTime()) {
+			// file was already modified
+			return nil
+		}
+	} else {
+		fi = st
+	}
+	key, err := fileKey(f)
+	if err != nil {
+		return err
+	}
+	l := FileLayout{Ref: ref, Size: uint64(fi.Size()), ModTime: fi.ModTime()}
+	return s.meta.set(metaLayouts, key, l.String())
+}
@@ -0,0 +1,228 @@
+package local
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// Perm is a Unix file mode. It's encoded in the octal notation, for example "0664", or "02775" for
+// a directory with the setgid bit.
+type Perm uint32
+
+const (
+	permSetgid = 02000
+	permSticky = 01000
+)
+
+// ParsePerm parses a file mode in the octal notation.
+func ParsePerm(s string) (Perm, error) {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid file mode: %q", s)
+	} else if v&^03777 != 0 {
+		return 0, fmt.Errorf("unsupported file mode: %q", s)
+	}
+	return Perm(v), nil
+}
+
+func (p Perm) String() string {
+	return fmt.Sprintf("%#o", uint32(p))
+}
+
+// FileMode converts the Unix file mode to os.FileMode.
+func (p Perm) FileMode() os.FileMode {
+	m := os.FileMode(p & 0777)
+	if p&permSetgid != 0 {
+		m |= os.ModeSetgid
+	}
+	if p&permSticky != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+func (p Perm) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Perm) UnmarshalText(b []byte) error {
+	v, err := ParsePerm(string(b))
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+// Perms controls permissions of files and directories created by the storage.
+//
+// If any of the fields is set, permissions are applied explicitly after files and directories are created,
+// thus the umask of the process has no effect.
+type Perms struct {
+	// Umask is removed from default permissions. For example, 0077 makes the storage private to the owner.
+	// Permissions that are set explicitly are not affected.
+	Umask Perm `json:"umask,omitempty"`
+	// Blob is the mode of committed blobs. Default is 0444.
+	Blob Perm `json:"blob,omitempty"`
+	// File is the mode of pins, metadata and other files. Default is 0644.
+	File Perm `json:"file,omitempty"`
+	// Dir is the mode of directories. Default is 0755.
+	Dir Perm `json:"dir,omitempty"`
+	// Group is a name or an ID of the group that owns directories and files created by the storage.
+	// Directories get the setgid bit by default, so files created by other users inherit the group as well.
+	Group string `json:"group,omitempty"`
+	// Shared makes the storage writable by the group: defaults are 0664 for files and 02775 for directories.
+	// Blobs stay read-only. Explicit permissions and the umask take precedence.
+	Shared bool `json:"shared,omitempty"`
+}
+
+// IsZero checks if default permissions are used.
+func (p Perms) IsZero() bool {
+	return p == Perms{}
+}
+
+// filePerms are resolved permissions of the storage.
+type filePerms struct {
+	blob, file, dir os.FileMode
+	// explicit is set if permissions must be applied regardless of the process umask
+	explicit bool
+	// gid is the group ID of created files, or -1 if the group is not changed
+	gid int
+}
+
+const (
+	defBlobPerm = 0444
+	defFilePerm = 0644
+	defDirPerm  = 0755
+
+	sharedFilePerm = 0664
+	sharedDirPerm  = 0775 | permSetgid
+)
+
+// lookupGroup resolves a group name or a numeric group ID.
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil && gid >= 0 {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, fmt.Errorf("unsupported group id: %q", g.Gid)
+	}
+	return gid, nil
+}
+
+func (p Perms) resolve() (filePerms, error) {
+	def := func(v, d Perm) os.FileMode {
+		if v == 0 {
+			v = d &^ p.Umask
+		}
+		return v.FileMode()
+	}
+	fileDef, dirDef := Perm(defFilePerm), Perm(defDirPerm)
+	if p.Shared {
+		fileDef, dirDef = sharedFilePerm, sharedDirPerm
+	}
+	gid := -1
+	if p.Group != "" {
+		v, err := lookupGroup(p.Group)
+		if err != nil {
+			return filePerms{}, fmt.Errorf("cannot resolve storage group: %v", err)
+		}
+		gid = v
+		dirDef |= permSetgid
+	}
+	return filePerms{
+		blob:     def(p.Blob, defBlobPerm),
+		file:     def(p.File, fileDef),
+		dir:      def(p.Dir, dirDef),
+		explicit: !p.IsZero(),
+		gid:      gid,
+	}, nil
+}
+
+// mkdir creates a directory with storage permissions.
+func (s *Storage) mkdir(path string) error {
+	if err := s.fs.Mkdir(path, s.perms.dir.Perm()); err != nil {
+		return err
+	}
+	if !s.perms.explicit {
+		return nil
+	}
+	// group must be changed first, since chown clears the setgid bit
+	if err := s.chownGroup(path); err != nil {
+		return err
+	}
+	return s.fs.Chmod(path, s.perms.dir)
+}
+
+// mkdirAll is similar to os.MkdirAll, but uses storage permissions for all created directories.
+func (s *Storage) mkdirAll(path string) error {
+	st, err := s.fs.Stat(path)
+	if err == nil {
+		if !st.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: path, Err: fmt.Errorf("not a directory")}
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if parent := filepath.Dir(path); parent != path {
+		if err = s.mkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	err = s.mkdir(path)
+	if os.IsExist(err) {
+		err = nil
+	}
+	return err
+}
+
+// chmodFile applies storage permissions to a newly created file that is not a blob.
+//
+// Files such as pins might be overwritten by other users of a shared storage. Only the owner of the file
+// can change its mode, thus files that already have the right mode and group are left as-is.
+func (s *Storage) chmodFile(path string) error {
+	if !s.perms.explicit {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err = s.chownGroupInfo(path, fi); err != nil {
+		return err
+	}
+	if fi.Mode().Perm() == s.perms.file.Perm() {
+		return nil
+	}
+	return os.Chmod(path, s.perms.file)
+}
+
+// chownGroup changes the group of a file or a directory to the storage group, if it's set.
+func (s *Storage) chownGroup(path string) error {
+	if s.perms.gid < 0 {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return s.chownGroupInfo(path, fi)
+}
+
+func (s *Storage) chownGroupInfo(path string, fi os.FileInfo) error {
+	if s.perms.gid < 0 {
+		return nil
+	} else if gid, ok := fileGroup(fi); ok && gid == s.perms.gid {
+		return nil
+	}
+	return os.Chown(path, -1, s.perms.gid)
+}
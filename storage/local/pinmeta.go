@@ -0,0 +1,76 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// Metadata of pins is stored as JSON in files with the same name as the pin:
+//
+//	pinmeta/<name>
+const dirPinMeta = "pinmeta"
+
+func (s *Storage) pinMetaPath(name string) string {
+	return filepath.Join(s.dir, dirPinMeta, name)
+}
+
+// SetPinMeta implements storage.PinMetaStorage.
+func (s *Storage) SetPinMeta(ctx context.Context, name string, meta *types.PinMeta) error {
+	if s.readOnly {
+		return storage.ErrReadOnly
+	}
+	s.pinMu.Lock()
+	defer s.pinMu.Unlock()
+	if _, err := s.fs.Stat(s.pinPath(name)); os.IsNotExist(err) {
+		return storage.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if meta == nil {
+		return s.deletePinMeta(name)
+	}
+	path := s.pinMetaPath(name)
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err = s.mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return s.replaceFile(path, data)
+}
+
+// GetPinMeta implements storage.PinMetaStorage.
+func (s *Storage) GetPinMeta(ctx context.Context, name string) (*types.PinMeta, error) {
+	if _, err := s.fs.Stat(s.pinPath(name)); os.IsNotExist(err) {
+		return nil, storage.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	data, err := s.fs.ReadFile(s.pinMetaPath(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var meta types.PinMeta
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("invalid metadata of pin %q: %v", name, err)
+	}
+	return &meta, nil
+}
+
+// deletePinMeta removes the metadata of a deleted pin. It should be called with pinMu held.
+func (s *Storage) deletePinMeta(name string) error {
+	err := s.fs.Remove(s.pinMetaPath(name))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
@@ -0,0 +1,249 @@
+package local
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// Reverse index of references.
+//
+// For each blob referenced by schema blobs, the index has a directory named by the ref of the blob,
+// with an empty file for each schema blob that references it:
+//
+//	indexes/@refs/<ref>/<referrer>
+//
+// References are recorded when a schema blob is moved from the unindexed list to the type index,
+// thus the index accounts for all schema blobs, except the ones in the unindexed list. Queries index
+// pending blobs first, so the cost of each query is proportional to the number of new blobs.
+const indexRefs = "@refs"
+
+var _ storage.RefIndexer = (*Storage)(nil)
+
+func (s *Storage) refsDir() string {
+	return filepath.Join(s.dir, dirIndex, indexRefs)
+}
+
+// initRefIndex creates the reverse index, if it doesn't exist.
+//
+// Stores created before the reverse index was introduced have schema blobs in the type index without
+// their references recorded. Such blobs are returned to the unindexed list to be indexed again.
+func (s *Storage) initRefIndex() error {
+	dir := s.refsDir()
+	if _, err := os.Stat(dir); err == nil {
+		s.refIndex = true
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if s.readOnly {
+		return nil
+	}
+	tdir := filepath.Join(s.dir, dirIndex, indexType)
+	typs, err := readDirNames(tdir)
+	if err != nil {
+		return err
+	}
+	for _, typ := range typs {
+		names, err := readDirNames(filepath.Join(tdir, typ))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if _, err := types.ParseRef(name); err != nil {
+				continue
+			}
+			err = os.Link(filepath.Join(tdir, typ, name), filepath.Join(s.dir, dirUnindexed, name))
+			if err != nil && !os.IsExist(err) {
+				return err
+			}
+		}
+	}
+	if err = s.mkdir(dir); err != nil && !os.IsExist(err) {
+		return err
+	}
+	s.refIndex = true
+	return nil
+}
+
+// readDirNames lists names in the directory. It returns no names if the directory doesn't exist.
+func readDirNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(-1)
+}
+
+// decodeRefs reads references of a schema blob. It returns false for data blobs.
+func decodeRefs(path string) ([]types.Ref, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if p, _ := br.Peek(schema.MagicSize); !schema.IsSchema(p) {
+		return nil, false, nil
+	}
+	obj, err := schema.Decode(br)
+	if err == schema.ErrNotSchema {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, true, fmt.Errorf("cannot index references of %s: %v", filepath.Base(path), err)
+	}
+	return obj.References(), true, nil
+}
+
+// indexRefs records references of a schema blob in the reverse index.
+func (s *Storage) indexRefs(ref types.Ref) error {
+	if !s.refIndex {
+		return nil
+	}
+	refs, _, err := decodeRefs(s.blobPath(ref))
+	if os.IsNotExist(err) {
+		// blob was removed
+		return nil
+	} else if err != nil {
+		return err
+	}
+	name := ref.String()
+	for _, r := range refs {
+		if r.Zero() {
+			continue
+		}
+		dir := filepath.Join(s.refsDir(), r.String())
+		path := filepath.Join(dir, name)
+		err = ioutil.WriteFile(path, nil, s.perms.file)
+		if os.IsNotExist(err) {
+			if err = s.mkdir(dir); err != nil && !os.IsExist(err) {
+				return err
+			}
+			err = ioutil.WriteFile(path, nil, s.perms.file)
+		}
+		if err == nil {
+			err = s.chmodFile(path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexRefs removes references of a deleted schema blob from the reverse index.
+func (s *Storage) unindexRefs(ref types.Ref, refs []types.Ref) {
+	name := ref.String()
+	for _, r := range refs {
+		if r.Zero() {
+			continue
+		}
+		dir := filepath.Join(s.refsDir(), r.String())
+		_ = os.Remove(filepath.Join(dir, name))
+		// only succeeds if there are no other referrers
+		_ = os.Remove(dir)
+	}
+}
+
+// indexPending indexes all blobs from the unindexed list. In read-only mode the storage is not modified,
+// instead references of pending schema blobs are reported to the callback.
+func (s *Storage) indexPending(ctx context.Context, fnc func(ref types.Ref, refs []types.Ref)) error {
+	names, err := readDirNames(filepath.Join(s.dir, dirUnindexed))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		ref, err := types.ParseRef(name)
+		if err != nil {
+			continue
+		}
+		if !s.readOnly {
+			if err = s.repairIndex(indexRepair{ref: ref, unindexed: true}); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		refs, ok, err := decodeRefs(filepath.Join(s.dir, dirUnindexed, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		} else if ok {
+			fnc(ref, refs)
+		}
+	}
+	return nil
+}
+
+// Referrers implements storage.RefIndexer.
+//
+// It returns storage.ErrNotSupported if the storage is opened in read-only mode and has no reverse index.
+func (s *Storage) Referrers(ctx context.Context, ref types.Ref) ([]types.Ref, error) {
+	if ref.Zero() {
+		return nil, storage.ErrInvalidRef
+	} else if !s.refIndex {
+		return nil, storage.ErrNotSupported
+	}
+	seen := make(map[types.Ref]struct{})
+	var out []types.Ref
+	add := func(r types.Ref) {
+		if _, ok := seen[r]; !ok {
+			seen[r] = struct{}{}
+			out = append(out, r)
+		}
+	}
+	err := s.indexPending(ctx, func(r types.Ref, refs []types.Ref) {
+		for _, r2 := range refs {
+			if r2 == ref {
+				add(r)
+				return
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	names, err := readDirNames(filepath.Join(s.refsDir(), ref.String()))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		r, err := types.ParseRef(name)
+		if err != nil {
+			continue
+		}
+		// referrers might be removed without updating the index, for example if the blob was corrupted
+		if _, err = os.Stat(s.blobPath(r)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		add(r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].String() < out[j].String()
+	})
+	return out, nil
+}
+
+// RefCount implements storage.RefIndexer.
+func (s *Storage) RefCount(ctx context.Context, ref types.Ref) (int, error) {
+	refs, err := s.Referrers(ctx, ref)
+	if err != nil {
+		return 0, err
+	}
+	return len(refs), nil
+}
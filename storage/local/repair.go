@@ -0,0 +1,127 @@
+package local
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/types"
+)
+
+// repairQueue is the max number of pending index repairs. Repairs that don't fit into the queue are dropped
+// and will be queued again the next time the blob is accessed.
+const repairQueue = 1024
+
+// indexRepair is a pending update of the schema type index for a single blob.
+type indexRepair struct {
+	ref       types.Ref
+	typ       string // type of the blob; empty for data blobs
+	known     bool   // type is already known; if not set, the type will be decoded from the blob
+	unindexed bool   // blob is listed in the unindexed directory
+}
+
+// startRepairs starts a background worker that updates the schema type index.
+//
+// Read paths (FetchSchema, IterateSchema) never modify the storage. Instead, they queue index repairs
+// for blobs without a cached type, and repairs are applied by the worker.
+func (s *Storage) startRepairs() {
+	if s.readOnly {
+		return
+	}
+	ch := make(chan indexRepair, repairQueue)
+	s.repairs = ch
+	s.repairWG.Add(1)
+	go func() {
+		defer s.repairWG.Done()
+		for r := range ch {
+			// errors are ignored - the blob will be repaired next time it's accessed
+			_ = s.repairIndex(r)
+		}
+	}()
+}
+
+// stopRepairs applies all pending repairs and stops the worker.
+func (s *Storage) stopRepairs() {
+	s.repairMu.Lock()
+	ch := s.repairs
+	s.repairs = nil
+	s.repairMu.Unlock()
+	if ch != nil {
+		close(ch)
+	}
+	s.repairWG.Wait()
+}
+
+// queueRepair schedules an index repair for a blob. It never blocks and drops the repair if the queue is full.
+func (s *Storage) queueRepair(r indexRepair) {
+	s.repairMu.RLock()
+	defer s.repairMu.RUnlock()
+	if s.repairs == nil {
+		return
+	}
+	select {
+	case s.repairs <- r:
+	default:
+	}
+}
+
+func (s *Storage) repairIndex(r indexRepair) error {
+	typ, err := s.getType(r.ref)
+	if err == nil {
+		// already repaired
+		r.typ, r.known = typ, true
+	} else if err != errNotCached {
+		return err
+	} else {
+		if !r.known {
+			f, err := os.Open(s.blobPath(r.ref))
+			if err != nil {
+				return err
+			}
+			r.typ, err = schema.DecodeType(f)
+			f.Close()
+			if err != nil && err != schema.ErrNotSchema {
+				return err
+			}
+		}
+		if err = s.setType(r.ref, r.typ); err != nil {
+			return err
+		}
+	}
+	if !r.unindexed {
+		return nil
+	}
+	upath := filepath.Join(s.dir, dirUnindexed, r.ref.String())
+	if r.typ == "" {
+		// data blob - remove from unindexed list
+		err = os.Remove(upath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	// schema blob - record its references and move it to the right index folder
+	if err = s.indexRefs(r.ref); err != nil {
+		return err
+	}
+	return s.moveToIndex(upath, r.typ)
+}
+
+// moveToIndex moves a blob from the unindexed directory to the index of a given type.
+func (s *Storage) moveToIndex(path, typ string) error {
+	ipath := filepath.Join(s.dir, dirIndex, indexType, typ)
+	dst := filepath.Join(ipath, filepath.Base(path))
+	err := os.Rename(path, dst)
+	if os.IsNotExist(err) {
+		if _, err2 := os.Stat(path); os.IsNotExist(err2) {
+			// blob is already indexed or removed
+			return nil
+		}
+		err = s.mkdirAll(ipath)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(path, dst)
+	}
+	return err
+}
@@ -0,0 +1,263 @@
+package local
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+)
+
+// Resumable writes.
+//
+// Partial blobs are written to files in the resume directory, named by the token. Unlike other temporary files,
+// they are not removed when the writer is closed, unless the blob is discarded:
+//
+//	tmp/resume/<token>
+//	tmp/resume/<token>.state
+//
+// The state file contains the state of the hash and the offset it corresponds to. It's saved when the writer
+// is suspended and periodically while the blob is written, thus only the content written after the last
+// checkpoint is hashed again when the blob is resumed after a crash.
+const (
+	dirResume = "resume"
+
+	resumeStateExt = ".state"
+	// resumeCheckpoint is the number of bytes written between saving the hash state.
+	resumeCheckpoint = 64 << 20
+)
+
+var errResumeBusy = errors.New("partial blob is already being written")
+
+func (s *Storage) resumePath(token string) string {
+	return filepath.Join(s.dir, dirTmp, dirResume, token)
+}
+
+// validToken checks if the token was generated by BeginResumableBlob.
+func validToken(token string) bool {
+	if len(token) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(token)
+	return err == nil
+}
+
+// acquireToken marks a partial blob as being written. It returns false if it's already in use.
+func (s *Storage) acquireToken(token string) bool {
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+	if _, ok := s.resuming[token]; ok {
+		return false
+	}
+	if s.resuming == nil {
+		s.resuming = make(map[string]struct{})
+	}
+	s.resuming[token] = struct{}{}
+	return true
+}
+
+func (s *Storage) releaseToken(token string) {
+	s.resumeMu.Lock()
+	delete(s.resuming, token)
+	s.resumeMu.Unlock()
+}
+
+// BeginResumableBlob implements storage.BlobResumer.
+func (s *Storage) BeginResumableBlob(ctx context.Context) (storage.ResumableWriter, error) {
+	if s.readOnly {
+		return nil, storage.ErrReadOnly
+	}
+	if err := s.checkSpace(ctx, 0); err != nil {
+		return nil, err
+	}
+	if err := s.mkdirAll(filepath.Join(s.dir, dirTmp, dirResume)); err != nil {
+		return nil, err
+	}
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(buf[:])
+	if !s.acquireToken(token) {
+		return nil, errResumeBusy
+	}
+	f, err := os.OpenFile(s.resumePath(token), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		s.releaseToken(token)
+		return nil, err
+	}
+	return s.newResumeWriter(ctx, token, f, storage.Hash(), nil), nil
+}
+
+// ResumeBlob implements storage.BlobResumer.
+func (s *Storage) ResumeBlob(ctx context.Context, token string) (storage.ResumableWriter, error) {
+	if s.readOnly {
+		return nil, storage.ErrReadOnly
+	} else if !validToken(token) {
+		return nil, storage.ErrNotFound
+	}
+	if !s.acquireToken(token) {
+		return nil, errResumeBusy
+	}
+	path := s.resumePath(token)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		s.releaseToken(token)
+		return nil, storage.ErrNotFound
+	} else if err != nil {
+		s.releaseToken(token)
+		return nil, err
+	}
+	hw, err := s.resumeHash(f, path+resumeStateExt)
+	if err == nil {
+		_, err = f.Seek(int64(hw.Size()), io.SeekStart)
+	}
+	head := make([]byte, schema.MagicSize)
+	if err == nil {
+		var n int
+		n, err = f.ReadAt(head, 0)
+		head = head[:n]
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		f.Close()
+		s.releaseToken(token)
+		return nil, err
+	}
+	return s.newResumeWriter(ctx, token, f, hw, head), nil
+}
+
+// resumeHash restores the hash of the partial blob. Content written after the last checkpoint is hashed again.
+func (s *Storage) resumeHash(f *os.File, statePath string) (storage.BlobWriter, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := uint64(fi.Size())
+	var hw storage.BlobWriter
+	if state, err := ioutil.ReadFile(statePath); err == nil {
+		hw, err = storage.ResumeHash(state)
+		if err != nil || hw.Size() > size {
+			// state is corrupted or the content was lost
+			hw = nil
+		}
+	}
+	if hw == nil {
+		hw = storage.Hash()
+	}
+	off := int64(hw.Size())
+	if _, err = io.Copy(hw, io.NewSectionReader(f, off, int64(size)-off)); err != nil {
+		return nil, err
+	}
+	return hw, nil
+}
+
+func (s *Storage) newResumeWriter(ctx context.Context, token string, f *os.File, hw storage.BlobWriter, head []byte) *resumeWriter {
+	if t, ok := ctx.Deadline(); ok {
+		f.SetWriteDeadline(t)
+	}
+	return &resumeWriter{
+		blobWriter: blobWriter{s: s, ctx: ctx, f: &genTmpFile{s: s, f: f}, hw: hw, head: head},
+		token:      token,
+		saved:      hw.Size(),
+	}
+}
+
+// resumeWriter is a blob writer for partial blobs. See BeginResumableBlob.
+type resumeWriter struct {
+	blobWriter
+	token string
+	saved uint64 // offset of the last checkpoint
+	done  bool
+}
+
+func (w *resumeWriter) Token() string {
+	return w.token
+}
+
+func (w *resumeWriter) Write(p []byte) (int, error) {
+	n, err := w.blobWriter.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if w.hw.Size()-w.saved >= resumeCheckpoint {
+		if err = w.checkpoint(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// checkpoint saves the state of the hash. The content is flushed first, thus the state never
+// describes the content that might be lost.
+func (w *resumeWriter) checkpoint() error {
+	if w.f == nil {
+		return storage.ErrBlobCompleted
+	}
+	state, err := storage.HashState(w.hw)
+	if err != nil {
+		return err
+	}
+	if err = w.s.syncFile(w.f.File()); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(w.s.resumePath(w.token)+resumeStateExt, state, 0600); err != nil {
+		return err
+	}
+	w.saved = w.hw.Size()
+	return nil
+}
+
+func (w *resumeWriter) Suspend() error {
+	if w.done {
+		return nil
+	}
+	err := w.checkpoint()
+	if w.f != nil {
+		// close the file without removing it
+		if err2 := w.f.File().Close(); err == nil {
+			err = err2
+		}
+		w.f = nil
+	}
+	w.hw.Close()
+	w.release()
+	return err
+}
+
+func (w *resumeWriter) Close() error {
+	if w.done {
+		return w.blobWriter.Close()
+	}
+	err := w.blobWriter.Close()
+	path := w.s.resumePath(w.token)
+	os.Remove(path)
+	os.Remove(path + resumeStateExt)
+	w.release()
+	return err
+}
+
+func (w *resumeWriter) Commit() error {
+	err := w.blobWriter.Commit()
+	if err != nil {
+		return err
+	}
+	os.Remove(w.s.resumePath(w.token) + resumeStateExt)
+	w.release()
+	return nil
+}
+
+func (w *resumeWriter) release() {
+	if !w.done {
+		w.done = true
+		w.s.releaseToken(w.token)
+	}
+}
@@ -0,0 +1,292 @@
+package local
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dennwc/cas/types"
+)
+
+// Schema index database.
+//
+// The database records the type and the size of each schema blob. It's an append-only log of records
+// in the index directory, which is loaded into memory when the storage is opened:
+//
+//	indexes/@schema.db
+//
+// Each line either adds a schema blob ("+<ref> <type> <size>") or removes it ("-<ref>"). The log is compacted
+// when the storage is opened for writing and most of the records are obsolete.
+//
+// Schema blobs are added when they are committed or indexed, thus blobs that are neither in the database,
+// nor in the unindexed list are data blobs. The type of any blob is known without reading the blob or its
+// extended attributes.
+const fileSchemaDB = "@schema.db"
+
+// schemaEntry is a schema blob recorded in the database.
+type schemaEntry struct {
+	typ  string
+	size uint64
+}
+
+// schemaDB is an in-memory copy of the schema index database. See fileSchemaDB.
+type schemaDB struct {
+	mu      sync.RWMutex
+	f       *os.File // log opened for appending; nil if read-only
+	noSync  bool
+	blobs   map[types.Ref]schemaEntry
+	types   map[string]string // interned type names
+	records int               // number of records in the log
+}
+
+func (s *Storage) schemaDBPath() string {
+	return filepath.Join(s.dir, dirIndex, fileSchemaDB)
+}
+
+// openSchemaDB loads the schema index database. If it doesn't exist, it's created from the type index.
+func (s *Storage) openSchemaDB() error {
+	db := &s.schemas
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.blobs = make(map[types.Ref]schemaEntry)
+	db.types = make(map[string]string)
+	db.records = 0
+	db.noSync = s.noSync
+
+	path := s.schemaDBPath()
+	err := db.load(path)
+	if os.IsNotExist(err) {
+		if err = db.loadTypeIndex(filepath.Join(s.dir, dirIndex, indexType)); err != nil {
+			return err
+		}
+		// force the database to be written
+		db.records = -1
+	} else if err != nil {
+		return err
+	}
+	if s.readOnly {
+		return nil
+	}
+	if db.records < 0 || db.records > 2*len(db.blobs)+1024 {
+		if err = s.compactSchemaDB(); err != nil {
+			return err
+		}
+	}
+	db.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	return err
+}
+
+// load reads all records from the log.
+func (db *schemaDB) load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if len(line) == 0 {
+			continue
+		}
+		db.records++
+		op, fields := line[0], strings.Fields(line[1:])
+		if len(fields) == 0 {
+			continue
+		}
+		ref, err := types.ParseRef(fields[0])
+		if err != nil {
+			// the last record might be incomplete
+			continue
+		}
+		switch op {
+		case '+':
+			if len(fields) != 3 {
+				continue
+			}
+			size, err := strconv.ParseUint(fields[2], 10, 64)
+			if err != nil {
+				continue
+			}
+			db.blobs[ref] = schemaEntry{typ: db.intern(fields[1]), size: size}
+		case '-':
+			delete(db.blobs, ref)
+		}
+	}
+	return sc.Err()
+}
+
+// loadTypeIndex adds all schema blobs listed in the type index. It's used to create the database
+// for storages that were created before it was introduced.
+func (db *schemaDB) loadTypeIndex(dir string) error {
+	typs, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, typ := range typs {
+		d, err := os.Open(filepath.Join(dir, typ))
+		if err != nil {
+			return err
+		}
+		infos, err := d.Readdir(-1)
+		d.Close()
+		if err != nil {
+			return err
+		}
+		for _, fi := range infos {
+			ref, err := types.ParseRef(fi.Name())
+			if err != nil {
+				continue
+			}
+			db.blobs[ref] = schemaEntry{typ: db.intern(typ), size: uint64(fi.Size())}
+		}
+	}
+	return nil
+}
+
+func (db *schemaDB) intern(typ string) string {
+	if v, ok := db.types[typ]; ok {
+		return v
+	}
+	db.types[typ] = typ
+	return typ
+}
+
+// compactSchemaDB replaces the log with a new one that only contains current schema blobs.
+// It must be called with the database lock held.
+func (s *Storage) compactSchemaDB() error {
+	db := &s.schemas
+	dir := filepath.Join(s.dir, dirIndex)
+	f, err := ioutil.TempFile(dir, ".schema_")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, sr := range db.list(nil) {
+		fmt.Fprintf(w, "+%s %s %d\n", sr.Ref, sr.Type, sr.Size)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = s.syncFile(f)
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = s.chmodFile(f.Name())
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.schemaDBPath())
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	db.records = len(db.blobs)
+	return nil
+}
+
+// close closes the log. The database can still be queried.
+func (db *schemaDB) close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.f == nil {
+		return nil
+	}
+	err := db.f.Close()
+	db.f = nil
+	return err
+}
+
+// append writes a record to the log. It must be called with the database lock held.
+func (db *schemaDB) append(rec string) error {
+	if db.f == nil {
+		return nil
+	}
+	if _, err := db.f.WriteString(rec); err != nil {
+		return err
+	}
+	db.records++
+	if db.noSync {
+		return nil
+	}
+	return db.f.Sync()
+}
+
+// get returns the type and the size of a schema blob. It returns false if the blob is not in the database.
+func (db *schemaDB) get(ref types.Ref) (schemaEntry, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	e, ok := db.blobs[ref]
+	return e, ok
+}
+
+// put records a schema blob.
+func (db *schemaDB) put(ref types.Ref, typ string, size uint64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if e, ok := db.blobs[ref]; ok && e.typ == typ && e.size == size {
+		return nil
+	}
+	if err := db.append(fmt.Sprintf("+%s %s %d\n", ref, typ, size)); err != nil {
+		return err
+	}
+	db.blobs[ref] = schemaEntry{typ: db.intern(typ), size: size}
+	return nil
+}
+
+// remove deletes a schema blob from the database.
+func (db *schemaDB) remove(ref types.Ref) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.blobs[ref]; !ok {
+		return nil
+	}
+	if err := db.append(fmt.Sprintf("-%s\n", ref)); err != nil {
+		return err
+	}
+	delete(db.blobs, ref)
+	return nil
+}
+
+// list returns schema blobs of given types, or all schema blobs if the filter is nil.
+// Blobs are grouped by the type, in an unspecified order.
+func (db *schemaDB) list(filter map[string]struct{}) []types.SchemaRef {
+	var out []types.SchemaRef
+	for ref, e := range db.blobs {
+		if filter != nil {
+			if _, ok := filter[e.typ]; !ok {
+				continue
+			}
+		}
+		out = append(out, types.SchemaRef{Ref: ref, Size: e.size, Type: e.typ})
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Type < out[j].Type
+	})
+	return out
+}
+
+// snapshot is like list, but acquires the database lock.
+func (db *schemaDB) snapshot(filter map[string]struct{}) []types.SchemaRef {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.list(filter)
+}
+
+// counts returns the number of schema blobs of each type.
+func (db *schemaDB) counts() map[string]uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	m := make(map[string]uint64)
+	for _, e := range db.blobs {
+		m[e.typ]++
+	}
+	return m
+}
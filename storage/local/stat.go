@@ -2,7 +2,11 @@ package local
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dennwc/cas/types"
 	"github.com/dennwc/cas/xattr"
@@ -62,6 +66,8 @@ func SaveRef(ctx context.Context, path string, fi os.FileInfo, ref types.Ref) er
 
 // SaveRefFile stores the ref into file's metadata.
 // Additionally, it will write the size and mtime to know if ref is still valid.
+//
+// The ref is not saved if the file system doesn't support xattrs. It's not an error, since the ref is only a cache.
 func SaveRefFile(ctx context.Context, f *os.File, fi os.FileInfo, ref types.Ref) error {
 	st, err := f.Stat()
 	if err != nil {
@@ -76,7 +82,9 @@ func SaveRefFile(ctx context.Context, f *os.File, fi os.FileInfo, ref types.Ref)
 		fi = st
 	}
 	err = xattr.SetUintF(f, xattrNS+"size", uint64(fi.Size()))
-	if err != nil {
+	if err == xattr.ErrNotSupported {
+		return nil
+	} else if err != nil {
 		return err
 	}
 	mtime := fi.ModTime()
@@ -90,3 +98,85 @@ func SaveRefFile(ctx context.Context, f *os.File, fi os.FileInfo, ref types.Ref)
 	}
 	return fchtimes(f, mtime, mtime)
 }
+
+const xattrLayout = xattrNS + "layout"
+
+// FileLayout records the object the content of a file was stored as, and the state of the file at that time.
+// Unlike the ref of the file, the layout is still useful after the file is modified: if the file only grows,
+// the stored content is a prefix of the new content.
+type FileLayout struct {
+	Ref     types.Ref // blob or schema object the content was stored as
+	Size    uint64    // size of the file
+	ModTime time.Time // modification time of the file
+}
+
+// Valid checks if the file was not modified since the layout was recorded.
+func (l FileLayout) Valid(fi os.FileInfo) bool {
+	return !l.Ref.Zero() && l.Size == uint64(fi.Size()) && l.ModTime.Equal(fi.ModTime())
+}
+
+// String encodes the layout as "<ref> <size> <mtime>".
+func (l FileLayout) String() string {
+	return fmt.Sprintf("%s %d %d", l.Ref, l.Size, l.ModTime.UnixNano())
+}
+
+func parseFileLayout(s string) (FileLayout, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 3 {
+		return FileLayout{}, fmt.Errorf("invalid file layout: %q", s)
+	}
+	ref, err := types.ParseRef(fields[0])
+	if err != nil {
+		return FileLayout{}, err
+	}
+	size, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return FileLayout{}, err
+	}
+	mtime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return FileLayout{}, err
+	}
+	return FileLayout{Ref: ref, Size: size, ModTime: time.Unix(0, mtime)}, nil
+}
+
+// GetFileLayout returns the layout recorded for the file, or a zero layout if it's unknown.
+// The layout is returned even if the file was modified since then.
+func GetFileLayout(ctx context.Context, f *os.File) (FileLayout, error) {
+	val, err := xattr.GetStringF(f, xattrLayout)
+	if err != nil || len(val) == 0 {
+		return FileLayout{}, nil
+	}
+	l, err := parseFileLayout(val)
+	if err != nil {
+		return FileLayout{}, nil
+	}
+	return l, nil
+}
+
+// SaveFileLayout records the ref of the object the content of the file was stored as, together with its size and mtime.
+//
+// The layout is not saved if the file system doesn't support xattrs.
+func SaveFileLayout(ctx context.Context, f *os.File, fi os.FileInfo, ref types.Ref) error {
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi != nil {
+		if st.Size() != fi.Size() || !st.ModTime().Equal(fi.ModTime()) {
+			// file was already modified
+			return nil
+		}
+	} else {
+		fi = st
+	}
+	mtime := fi.ModTime()
+	l := FileLayout{Ref: ref, Size: uint64(fi.Size()), ModTime: mtime}
+	err = xattr.SetStringF(f, xattrLayout, l.String())
+	if err == xattr.ErrNotSupported {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return fchtimes(f, mtime, mtime)
+}
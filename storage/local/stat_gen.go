@@ -10,3 +10,7 @@ import (
 func fchtimes(f *os.File, atime, mtime time.Time) error {
 	return os.Chtimes(f.Name(), atime, mtime)
 }
+
+func fileGroup(fi os.FileInfo) (int, bool) {
+	return 0, false
+}
@@ -5,6 +5,7 @@ package local
 import (
 	"os"
 	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -12,3 +13,12 @@ func fchtimes(f *os.File, atime, mtime time.Time) error {
 	path := "/proc/self/fd/" + strconv.Itoa(int(f.Fd()))
 	return os.Chtimes(path, atime, mtime)
 }
+
+// fileGroup returns the group ID of the file owner.
+func fileGroup(fi os.FileInfo) (int, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(st.Gid), true
+}
@@ -0,0 +1,175 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dennwc/cas/storage"
+)
+
+// fileStats is the name of the file with blob counters. It's written when the storage is closed,
+// and removed when the storage is opened for writing, thus the counters are only reused if the storage
+// was closed properly.
+const fileStats = "stats.json"
+
+var _ storage.StatsCounter = (*Storage)(nil)
+
+// blobStats are counters of blobs maintained incrementally by the storage.
+type blobStats struct {
+	Blobs uint64 `json:"blobs"`
+	Size  uint64 `json:"size"`
+}
+
+func (s *Storage) statsPath() string {
+	return filepath.Join(s.dir, fileStats)
+}
+
+// loadStats reads blob counters saved by a previous session.
+func (s *Storage) loadStats() error {
+	path := s.statsPath()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// counters become invalid as soon as the storage is modified
+	if err = os.Remove(path); err != nil {
+		return err
+	}
+	var st blobStats
+	if err = json.Unmarshal(data, &st); err != nil {
+		// counters will be recalculated
+		return nil
+	}
+	s.stats = &st
+	return nil
+}
+
+// saveStats writes blob counters when the storage is closed.
+func (s *Storage) saveStats() error {
+	s.statsMu.Lock()
+	st := s.stats
+	s.statsMu.Unlock()
+	if st == nil {
+		return nil
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	path := s.statsPath()
+	if err = ioutil.WriteFile(path, data, s.perms.file); err != nil {
+		return err
+	}
+	return s.chmodFile(path)
+}
+
+// statsBlob updates blob counters after a blob was added or removed.
+func (s *Storage) statsBlob(size int64, added bool) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	st := s.stats
+	if st == nil {
+		// not calculated yet
+		return
+	}
+	if added {
+		st.Blobs++
+		st.Size += uint64(size)
+		return
+	}
+	if st.Blobs > 0 {
+		st.Blobs--
+	}
+	if st.Size >= uint64(size) {
+		st.Size -= uint64(size)
+	} else {
+		st.Size = 0
+	}
+}
+
+// countBlobs returns blob counters, listing all blobs if the counters were not calculated yet.
+//
+// Blobs written while the blobs are listed for the first time might be counted twice. The lock is not held
+// while listing, since the iterator updates the counters when it removes invalid blobs.
+func (s *Storage) countBlobs(ctx context.Context) (blobStats, error) {
+	s.statsMu.Lock()
+	cur := s.stats
+	if cur != nil {
+		st := *cur
+		s.statsMu.Unlock()
+		return st, nil
+	}
+	s.statsMu.Unlock()
+
+	var st blobStats
+	it := s.IterateBlobs(ctx)
+	defer it.Close()
+	for it.Next() {
+		st.Blobs++
+		st.Size += it.SizedRef().Size
+	}
+	if err := it.Err(); err != nil {
+		return blobStats{}, err
+	}
+	if s.readOnly {
+		// read-only storage cannot track changes made by the writer
+		return st, nil
+	}
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	if s.stats != nil {
+		// counted concurrently
+		return *s.stats, nil
+	}
+	s.stats = &st
+	return st, nil
+}
+
+// Stats implements storage.StatsCounter.
+//
+// Blob counters are maintained incrementally and are preserved between sessions, while schema blobs
+// are counted using the schema index database. The storage must be opened for writing to index pending
+// schema blobs, otherwise it returns storage.ErrNotSupported.
+func (s *Storage) Stats(ctx context.Context) (*storage.Stats, error) {
+	if s.readOnly {
+		return nil, storage.ErrNotSupported
+	}
+	if err := s.indexPending(ctx, nil); err != nil {
+		return nil, err
+	}
+	bst, err := s.countBlobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	st := &storage.Stats{Blobs: bst.Blobs, Size: bst.Size, Schema: s.schemas.counts(), Limit: s.maxSize}
+	pit := s.IteratePins(ctx)
+	defer pit.Close()
+	for pit.Next() {
+		st.Pins++
+	}
+	if err = pit.Err(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// checkSpace checks if a blob of a given size can be stored without exceeding the size limit.
+// Blob counters are calculated on the first call, if necessary.
+func (s *Storage) checkSpace(ctx context.Context, size uint64) error {
+	if s.maxSize == 0 {
+		return nil
+	}
+	st, err := s.countBlobs(ctx)
+	if err != nil {
+		return err
+	}
+	if st.Size+size > s.maxSize {
+		return storage.ErrStoreFull
+	}
+	return nil
+}
@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"context"
 	"io"
-	"io/ioutil"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/dennwc/cas/schema"
 	"github.com/dennwc/cas/types"
@@ -17,6 +17,9 @@ func NewInMemory() Storage {
 		blobs: make(map[types.Ref][]byte),
 		pins:  make(map[string]types.Ref),
 		types: make(map[types.Ref]string),
+
+		history: make(map[string][]PinRecord),
+		meta:    make(map[string]types.PinMeta),
 	}
 }
 
@@ -25,8 +28,21 @@ type memStorage struct {
 	blobs map[types.Ref][]byte
 	pins  map[string]types.Ref
 	types map[types.Ref]string
+
+	history map[string][]PinRecord
+	meta    map[string]types.PinMeta
 }
 
+var (
+	_ PinSwapper     = (*memStorage)(nil)
+	_ BlobOpener     = (*memStorage)(nil)
+	_ PinHistorian   = (*memStorage)(nil)
+	_ PinMetaStorage = (*memStorage)(nil)
+	_ BulkStater     = (*memStorage)(nil)
+
+	_ PinHistoryAppender = (*memStorage)(nil)
+)
+
 func (s *memStorage) Close() error { return nil }
 
 func (s *memStorage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
@@ -41,6 +57,19 @@ func (s *memStorage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error
 	return uint64(sz), nil
 }
 
+// StatBlobs implements BulkStater.
+func (s *memStorage) StatBlobs(ctx context.Context, refs []types.Ref) ([]types.SizedRef, error) {
+	out := make([]types.SizedRef, 0, len(refs))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, ref := range refs {
+		if b, ok := s.blobs[ref]; ok {
+			out = append(out, types.SizedRef{Ref: ref, Size: uint64(len(b))})
+		}
+	}
+	return out, nil
+}
+
 func (s *memStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
 	s.mu.RLock()
 	b, ok := s.blobs[ref]
@@ -48,7 +77,27 @@ func (s *memStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadClose
 	if !ok {
 		return nil, 0, ErrNotFound
 	}
-	return ioutil.NopCloser(bytes.NewReader(b)), uint64(len(b)), nil
+	return &memReader{Reader: bytes.NewReader(b)}, uint64(len(b)), nil
+}
+
+// OpenBlob implements BlobOpener.
+func (s *memStorage) OpenBlob(ctx context.Context, ref types.Ref) (BlobReader, uint64, error) {
+	s.mu.RLock()
+	b, ok := s.blobs[ref]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	return &memReader{Reader: bytes.NewReader(b)}, uint64(len(b)), nil
+}
+
+// memReader is a seekable blob reader.
+type memReader struct {
+	*bytes.Reader
+}
+
+func (r *memReader) Close() error {
+	return nil
 }
 
 func (s *memStorage) BeginBlob(ctx context.Context) (BlobWriter, error) {
@@ -91,17 +140,34 @@ func (w *memWriter) Commit() error {
 	if err != nil {
 		return err
 	}
-	buf := w.buf.Bytes()
-	w.s.mu.Lock()
-	defer w.s.mu.Unlock()
-	w.s.blobs[w.sr.Ref] = buf
+	w.s.putBlob(w.sr.Ref, w.buf.Bytes())
+	return nil
+}
+
+func (s *memStorage) putBlob(ref types.Ref, buf []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[ref] = buf
 	if !schema.IsSchema(buf) {
-		return nil
+		return
 	}
 	typ, err := schema.DecodeType(bytes.NewReader(buf))
 	if err == nil {
-		w.s.types[w.sr.Ref] = typ
+		s.types[ref] = typ
+	}
+}
+
+func (s *memStorage) DeleteBlob(ctx context.Context, ref types.Ref) error {
+	if ref.Zero() {
+		return ErrInvalidRef
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[ref]; !ok {
+		return ErrNotFound
+	}
+	delete(s.blobs, ref)
+	delete(s.types, ref)
 	return nil
 }
 
@@ -153,18 +219,102 @@ func (it *memIter) SizedRef() types.SizedRef {
 
 func (s *memStorage) SetPin(ctx context.Context, name string, ref types.Ref) error {
 	s.mu.Lock()
-	s.pins[name] = ref
+	s.setPin(name, ref)
 	s.mu.Unlock()
 	return nil
 }
 
 func (s *memStorage) DeletePin(ctx context.Context, name string) error {
 	s.mu.Lock()
-	delete(s.pins, name)
+	if _, ok := s.pins[name]; ok {
+		s.setPin(name, types.Ref{})
+	}
 	s.mu.Unlock()
 	return nil
 }
 
+func (s *memStorage) SetPinCAS(ctx context.Context, name string, old, new types.Ref) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur := s.pins[name]; cur != old {
+		return ErrPinConflict
+	}
+	if !new.Zero() || !old.Zero() {
+		s.setPin(name, new)
+	}
+	return nil
+}
+
+// setPin changes the pin and records the change in the history. Zero ref deletes the pin.
+// It should be called with the lock held.
+func (s *memStorage) setPin(name string, ref types.Ref) {
+	if ref.Zero() {
+		delete(s.pins, name)
+		delete(s.meta, name)
+	} else {
+		s.pins[name] = ref
+	}
+	s.history[name] = append(s.history[name], PinRecord{Ref: ref, Time: time.Now()})
+}
+
+func (s *memStorage) SetPinMeta(ctx context.Context, name string, meta *types.PinMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pins[name]; !ok {
+		return ErrNotFound
+	}
+	if meta == nil {
+		delete(s.meta, name)
+		return nil
+	}
+	m := *meta
+	m.Labels = copyLabels(m.Labels)
+	s.meta[name] = m
+	return nil
+}
+
+func (s *memStorage) GetPinMeta(ctx context.Context, name string) (*types.PinMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.pins[name]; !ok {
+		return nil, ErrNotFound
+	}
+	m, ok := s.meta[name]
+	if !ok {
+		return nil, nil
+	}
+	m.Labels = copyLabels(m.Labels)
+	return &m, nil
+}
+
+func copyLabels(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func (s *memStorage) PinHistory(ctx context.Context, name string) ([]PinRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hist := s.history[name]
+	if len(hist) == 0 {
+		return nil, ErrNotFound
+	}
+	return append([]PinRecord{}, hist...), nil
+}
+
+func (s *memStorage) AppendPinHistory(ctx context.Context, name string, recs []PinRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history[name] = append(s.history[name], recs...)
+	return nil
+}
+
 func (s *memStorage) GetPin(ctx context.Context, name string) (types.Ref, error) {
 	s.mu.RLock()
 	ref, ok := s.pins[name]
@@ -0,0 +1,377 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dennwc/cas/types"
+)
+
+// Storage operations recorded by Metrics.
+const (
+	opStatBlob = iota
+	opFetchBlob
+	opIterateBlobs
+	opBeginBlob
+	opCommitBlob
+	opSetPin
+	opGetPin
+	opDeletePin
+	opIteratePins
+	opOpenBlob
+	opFetchBlobs
+	opStatBlobs
+	numOps
+)
+
+var opNames = [numOps]string{
+	opStatBlob:     "StatBlob",
+	opFetchBlob:    "FetchBlob",
+	opIterateBlobs: "IterateBlobs",
+	opBeginBlob:    "BeginBlob",
+	opCommitBlob:   "Commit",
+	opSetPin:       "SetPin",
+	opGetPin:       "GetPin",
+	opDeletePin:    "DeletePin",
+	opIteratePins:  "IteratePins",
+	opOpenBlob:     "OpenBlob",
+	opFetchBlobs:   "FetchBlobs",
+	opStatBlobs:    "StatBlobs",
+}
+
+// latencyBuckets are upper bounds of latency histogram buckets, in seconds.
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// NewMetrics creates a new set of storage metrics. See Instrument.
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	for i := range m.ops {
+		m.ops[i].buckets = make([]uint64, len(latencyBuckets))
+	}
+	return m
+}
+
+// Metrics collects counts, latencies and errors of storage operations, as well as the number of bytes
+// read and written. Metrics are exposed in Prometheus text format.
+type Metrics struct {
+	ops [numOps]opMetrics
+
+	mu      sync.Mutex
+	read    uint64
+	written uint64
+}
+
+type opMetrics struct {
+	mu      sync.Mutex
+	count   uint64
+	errors  uint64
+	sum     float64 // total latency in seconds
+	buckets []uint64
+}
+
+func (m *opMetrics) observe(start time.Time, err error) {
+	dt := time.Since(start).Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.count++
+	if err != nil && err != ErrNotFound {
+		m.errors++
+	}
+	m.sum += dt
+	for i, b := range latencyBuckets {
+		if dt <= b {
+			m.buckets[i]++
+		}
+	}
+}
+
+func (m *Metrics) observe(op int, start time.Time, err error) {
+	m.ops[op].observe(start, err)
+}
+
+func (m *Metrics) addRead(n int) {
+	m.mu.Lock()
+	m.read += uint64(n)
+	m.mu.Unlock()
+}
+
+func (m *Metrics) addWritten(n int) {
+	m.mu.Lock()
+	m.written += uint64(n)
+	m.mu.Unlock()
+}
+
+// WritePrometheus writes all metrics in Prometheus text exposition format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	const (
+		ops     = "cas_storage_operations_total"
+		errs    = "cas_storage_errors_total"
+		latency = "cas_storage_operation_duration_seconds"
+	)
+	fmt.Fprintf(bw, "# HELP %s Total number of storage operations.\n# TYPE %s counter\n", ops, ops)
+	for i := range m.ops {
+		o := &m.ops[i]
+		o.mu.Lock()
+		fmt.Fprintf(bw, "%s{method=%q} %d\n", ops, opNames[i], o.count)
+		o.mu.Unlock()
+	}
+	fmt.Fprintf(bw, "# HELP %s Total number of failed storage operations (not found errors are not counted).\n# TYPE %s counter\n", errs, errs)
+	for i := range m.ops {
+		o := &m.ops[i]
+		o.mu.Lock()
+		fmt.Fprintf(bw, "%s{method=%q} %d\n", errs, opNames[i], o.errors)
+		o.mu.Unlock()
+	}
+	fmt.Fprintf(bw, "# HELP %s Latency of storage operations.\n# TYPE %s histogram\n", latency, latency)
+	for i := range m.ops {
+		o := &m.ops[i]
+		name := opNames[i]
+		o.mu.Lock()
+		for j, b := range latencyBuckets {
+			fmt.Fprintf(bw, "%s_bucket{method=%q,le=%q} %d\n", latency, name, strconv.FormatFloat(b, 'g', -1, 64), o.buckets[j])
+		}
+		fmt.Fprintf(bw, "%s_bucket{method=%q,le=\"+Inf\"} %d\n", latency, name, o.count)
+		fmt.Fprintf(bw, "%s_sum{method=%q} %s\n", latency, name, strconv.FormatFloat(o.sum, 'g', -1, 64))
+		fmt.Fprintf(bw, "%s_count{method=%q} %d\n", latency, name, o.count)
+		o.mu.Unlock()
+	}
+	m.mu.Lock()
+	read, written := m.read, m.written
+	m.mu.Unlock()
+	fmt.Fprintf(bw, "# HELP cas_storage_read_bytes_total Total number of blob bytes read.\n# TYPE cas_storage_read_bytes_total counter\n")
+	fmt.Fprintf(bw, "cas_storage_read_bytes_total %d\n", read)
+	fmt.Fprintf(bw, "# HELP cas_storage_written_bytes_total Total number of blob bytes written.\n# TYPE cas_storage_written_bytes_total counter\n")
+	fmt.Fprintf(bw, "cas_storage_written_bytes_total %d\n", written)
+	return bw.Flush()
+}
+
+// ServeHTTP serves metrics to Prometheus collectors.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = m.WritePrometheus(w)
+}
+
+// Instrument wraps the storage and records all operations to metrics.
+//
+// Latency of FetchBlob and BeginBlob only includes the time to open the blob, while iterators
+// are recorded when they are closed.
+// Bytes are counted as they are read from blob readers and written to blob writers.
+func Instrument(s Storage, m *Metrics) Storage {
+	return &metricsStorage{s: s, m: m}
+}
+
+var (
+	_ BlobOpener     = (*metricsStorage)(nil)
+	_ BulkFetcher    = (*metricsStorage)(nil)
+	_ BulkStater     = (*metricsStorage)(nil)
+	_ PrefixIterator = (*metricsStorage)(nil)
+)
+
+type metricsStorage struct {
+	s Storage
+	m *Metrics
+}
+
+func (s *metricsStorage) Close() error {
+	return s.s.Close()
+}
+
+func (s *metricsStorage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	start := time.Now()
+	sz, err := s.s.StatBlob(ctx, ref)
+	s.m.observe(opStatBlob, start, err)
+	return sz, err
+}
+
+func (s *metricsStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	start := time.Now()
+	rc, sz, err := s.s.FetchBlob(ctx, ref)
+	s.m.observe(opFetchBlob, start, err)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &metricsReader{ReadCloser: rc, m: s.m, size: sz}, sz, nil
+}
+
+func (s *metricsStorage) IterateBlobs(ctx context.Context) Iterator {
+	return &metricsIterator{Iterator: s.s.IterateBlobs(ctx), m: s.m, start: time.Now()}
+}
+
+func (s *metricsStorage) BeginBlob(ctx context.Context) (BlobWriter, error) {
+	start := time.Now()
+	w, err := s.s.BeginBlob(ctx)
+	s.m.observe(opBeginBlob, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsWriter{BlobWriter: w, m: s.m}, nil
+}
+
+func (s *metricsStorage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	start := time.Now()
+	err := s.s.SetPin(ctx, name, ref)
+	s.m.observe(opSetPin, start, err)
+	return err
+}
+
+func (s *metricsStorage) DeletePin(ctx context.Context, name string) error {
+	start := time.Now()
+	err := s.s.DeletePin(ctx, name)
+	s.m.observe(opDeletePin, start, err)
+	return err
+}
+
+func (s *metricsStorage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	start := time.Now()
+	ref, err := s.s.GetPin(ctx, name)
+	s.m.observe(opGetPin, start, err)
+	return ref, err
+}
+
+func (s *metricsStorage) IteratePins(ctx context.Context) PinIterator {
+	return &metricsPinIterator{PinIterator: s.s.IteratePins(ctx), m: s.m, start: time.Now()}
+}
+
+// OpenBlob implements BlobOpener.
+func (s *metricsStorage) OpenBlob(ctx context.Context, ref types.Ref) (BlobReader, uint64, error) {
+	start := time.Now()
+	br, sz, err := OpenBlob(ctx, s.s, ref)
+	s.m.observe(opOpenBlob, start, err)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &metricsBlobReader{BlobReader: br, m: s.m}, sz, nil
+}
+
+// FetchBlobs implements BulkFetcher.
+func (s *metricsStorage) FetchBlobs(ctx context.Context, refs []types.Ref) (MultiReader, error) {
+	start := time.Now()
+	mr, err := FetchBlobs(ctx, s.s, refs)
+	s.m.observe(opFetchBlobs, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsMultiReader{MultiReader: mr, m: s.m}, nil
+}
+
+// StatBlobs implements BulkStater.
+func (s *metricsStorage) StatBlobs(ctx context.Context, refs []types.Ref) ([]types.SizedRef, error) {
+	start := time.Now()
+	srs, err := StatBlobs(ctx, s.s, refs)
+	s.m.observe(opStatBlobs, start, err)
+	return srs, err
+}
+
+// IterateBlobsPrefix implements PrefixIterator.
+func (s *metricsStorage) IterateBlobsPrefix(ctx context.Context, prefix string) Iterator {
+	return &metricsIterator{Iterator: IterateBlobsPrefix(ctx, s.s, prefix), m: s.m, start: time.Now()}
+}
+
+type metricsReader struct {
+	io.ReadCloser
+	m    *Metrics
+	size uint64
+	read uint64
+}
+
+func (r *metricsReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += uint64(n)
+	r.m.addRead(n)
+	return n, err
+}
+
+// File implements Filer. Reads from the file are not seen by the reader, thus the rest of the blob
+// is counted when the file is returned.
+func (r *metricsReader) File() *os.File {
+	f, _ := BlobFile(r.ReadCloser)
+	if f != nil && r.size > r.read {
+		r.m.addRead(int(r.size - r.read))
+		r.read = r.size
+	}
+	return f
+}
+
+type metricsBlobReader struct {
+	BlobReader
+	m *Metrics
+}
+
+func (r *metricsBlobReader) Read(p []byte) (int, error) {
+	n, err := r.BlobReader.Read(p)
+	r.m.addRead(n)
+	return n, err
+}
+
+func (r *metricsBlobReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.BlobReader.ReadAt(p, off)
+	r.m.addRead(n)
+	return n, err
+}
+
+type metricsMultiReader struct {
+	MultiReader
+	m *Metrics
+}
+
+func (r *metricsMultiReader) Read(p []byte) (int, error) {
+	n, err := r.MultiReader.Read(p)
+	r.m.addRead(n)
+	return n, err
+}
+
+type metricsWriter struct {
+	BlobWriter
+	m *Metrics
+}
+
+func (w *metricsWriter) Write(p []byte) (int, error) {
+	n, err := w.BlobWriter.Write(p)
+	w.m.addWritten(n)
+	return n, err
+}
+
+func (w *metricsWriter) Commit() error {
+	start := time.Now()
+	err := w.BlobWriter.Commit()
+	w.m.observe(opCommitBlob, start, err)
+	return err
+}
+
+type metricsIterator struct {
+	Iterator
+	m     *Metrics
+	start time.Time
+	once  sync.Once
+}
+
+func (it *metricsIterator) Close() error {
+	err := it.Iterator.Close()
+	it.once.Do(func() {
+		it.m.observe(opIterateBlobs, it.start, it.Iterator.Err())
+	})
+	return err
+}
+
+type metricsPinIterator struct {
+	PinIterator
+	m     *Metrics
+	start time.Time
+	once  sync.Once
+}
+
+func (it *metricsPinIterator) Close() error {
+	err := it.PinIterator.Close()
+	it.once.Do(func() {
+		it.m.observe(opIteratePins, it.start, it.PinIterator.Err())
+	})
+	return err
+}
@@ -0,0 +1,451 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/dennwc/cas/types"
+)
+
+// MirrorOptions controls how the data is replicated by the mirrored storage.
+type MirrorOptions struct {
+	// Async enables asynchronous writes to replicas. Blobs and pins are written to the primary storage
+	// and are copied to replicas in background, in the same order.
+	Async bool
+	// QueueSize is the maximal number of pending asynchronous writes per replica.
+	// Writes block when the queue is full.
+	QueueSize int
+	// OnError is called when an asynchronous write to a replica fails.
+	OnError func(replica int, err error)
+	// BatchSize is the maximal number of queued small blobs that are uploaded to a replica in a single
+	// pack, if the replica supports it (see PackStorer). It's only used in async mode.
+	// Default is 256; negative value disables batching.
+	BatchSize int
+	// BatchBlobSize is the maximal size of a blob that can be batched. Default is 64KB.
+	BatchBlobSize uint64
+}
+
+// MirrorStats reports the state of the mirrored storage.
+type MirrorStats struct {
+	Pending  int    // number of queued asynchronous writes
+	Errors   uint64 // number of failed asynchronous writes
+	Failover uint64 // number of reads served from replicas
+	Batches  uint64 // number of batched blob uploads to replicas
+}
+
+// NewMirror creates a storage that writes blobs and pins to all backends synchronously,
+// and reads from the primary storage with failover to replicas. See NewMirrorWithOptions.
+func NewMirror(primary Storage, replicas ...Storage) *MirrorStorage {
+	return NewMirrorWithOptions(MirrorOptions{}, primary, replicas...)
+}
+
+// NewMirrorWithOptions creates a storage that writes blobs and pins to all backends and reads from
+// the primary storage with failover to replicas.
+//
+// In synchronous mode writes succeed only if they succeed on all backends. Note that the write may
+// still be visible on some of the backends if it fails.
+//
+// Reads fail over to replicas in order if the primary storage returns an error, or if the blob is
+// missing in the primary storage. Pins are only read from replicas if the primary storage fails.
+// Listing blobs and pins is served by the primary storage only.
+//
+// Closing the mirrored storage waits for all pending writes and closes all backends.
+func NewMirrorWithOptions(opts MirrorOptions, primary Storage, replicas ...Storage) *MirrorStorage {
+	if opts.Async {
+		if opts.QueueSize <= 0 {
+			opts.QueueSize = 1024
+		}
+		if opts.BatchSize == 0 {
+			opts.BatchSize = 256
+		}
+		if opts.BatchBlobSize == 0 {
+			opts.BatchBlobSize = 64 * 1024
+		}
+	}
+	s := &MirrorStorage{
+		primary: primary, replicas: replicas,
+		opts: opts,
+	}
+	s.done = sync.NewCond(&s.mu)
+	if opts.Async {
+		s.queues = make([]chan mirrorJob, len(replicas))
+		for i := range replicas {
+			q := make(chan mirrorJob, opts.QueueSize)
+			s.queues[i] = q
+			s.wg.Add(1)
+			go s.replicate(i, q)
+		}
+	}
+	return s
+}
+
+var _ Storage = (*MirrorStorage)(nil)
+
+// MirrorStorage is a storage that replicates all writes to multiple backends.
+type MirrorStorage struct {
+	primary  Storage
+	replicas []Storage
+	opts     MirrorOptions
+
+	queues []chan mirrorJob // per replica; only in async mode
+	wg     sync.WaitGroup   // replication workers
+
+	mu     sync.Mutex
+	done   *sync.Cond // signaled when pending writes are done
+	stats  MirrorStats
+	closed bool
+}
+
+// mirrorJob is an asynchronous write to a replica.
+type mirrorJob struct {
+	blob types.SizedRef                             // blob to copy from the primary storage
+	fnc  func(ctx context.Context, s Storage) error // set for other writes
+}
+
+// Replicas returns secondary storages of the mirror.
+func (s *MirrorStorage) Replicas() []Storage {
+	return append([]Storage{}, s.replicas...)
+}
+
+// Stats returns the state of the storage.
+func (s *MirrorStorage) Stats() MirrorStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Wait blocks until all pending asynchronous writes are done.
+func (s *MirrorStorage) Wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.stats.Pending > 0 {
+		s.done.Wait()
+	}
+}
+
+func (s *MirrorStorage) replicate(i int, q <-chan mirrorJob) {
+	defer s.wg.Done()
+	ctx := context.Background()
+	r := s.replicas[i]
+	ps, canBatch := r.(PackStorer)
+	canBatch = canBatch && s.opts.BatchSize > 1
+	var next *mirrorJob
+	for {
+		var job mirrorJob
+		if next != nil {
+			job, next = *next, nil
+		} else {
+			var ok bool
+			if job, ok = <-q; !ok {
+				return
+			}
+		}
+		if !canBatch || !s.batchable(job) {
+			s.jobsDone(i, 1, s.runJob(ctx, r, job))
+			continue
+		}
+		// collect small blobs that are already queued, but don't wait for more
+		batch := []types.Ref{job.blob.Ref}
+	collect:
+		for len(batch) < s.opts.BatchSize {
+			select {
+			case j, ok := <-q:
+				if !ok {
+					break collect
+				} else if !s.batchable(j) {
+					next = &j
+					break collect
+				}
+				batch = append(batch, j.blob.Ref)
+			default:
+				break collect
+			}
+		}
+		if len(batch) == 1 {
+			s.jobsDone(i, 1, s.runJob(ctx, r, job))
+			continue
+		}
+		s.replicateBatch(ctx, i, ps, batch)
+	}
+}
+
+func (s *MirrorStorage) batchable(job mirrorJob) bool {
+	return job.fnc == nil && job.blob.Size <= s.opts.BatchBlobSize
+}
+
+func (s *MirrorStorage) runJob(ctx context.Context, r Storage, job mirrorJob) error {
+	if job.fnc != nil {
+		return job.fnc(ctx, r)
+	}
+	return copyBlob(ctx, r, s.primary, job.blob.Ref)
+}
+
+// replicateBatch uploads multiple blobs to a replica in a single pack. If the upload fails,
+// blobs are copied one by one.
+func (s *MirrorStorage) replicateBatch(ctx context.Context, i int, ps PackStorer, refs []types.Ref) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(WriteBlobPack(ctx, pw, s.primary, refs))
+	}()
+	_, err := ps.StorePack(ctx, pr)
+	pr.Close()
+	if err == nil {
+		s.mu.Lock()
+		s.stats.Batches++
+		s.mu.Unlock()
+		s.jobsDone(i, len(refs), nil)
+		return
+	}
+	for _, ref := range refs {
+		s.jobsDone(i, 1, copyBlob(ctx, s.replicas[i], s.primary, ref))
+	}
+}
+
+// done1 marks n jobs of the replica as done.
+func (s *MirrorStorage) jobsDone(i int, n int, err error) {
+	if err != nil && s.opts.OnError != nil {
+		s.opts.OnError(i, err)
+	}
+	s.mu.Lock()
+	s.stats.Pending -= n
+	if err != nil {
+		s.stats.Errors++
+	}
+	if s.stats.Pending == 0 {
+		s.done.Broadcast()
+	}
+	s.mu.Unlock()
+}
+
+// enqueue schedules a write to all replicas.
+func (s *MirrorStorage) enqueue(job mirrorJob) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.stats.Pending += len(s.queues)
+	s.mu.Unlock()
+	for _, q := range s.queues {
+		q <- job
+	}
+}
+
+func (s *MirrorStorage) Close() error {
+	s.mu.Lock()
+	closed := s.closed
+	s.closed = true
+	s.mu.Unlock()
+	if !closed {
+		s.Wait()
+		for _, q := range s.queues {
+			close(q)
+		}
+		s.wg.Wait()
+	}
+	last := s.primary.Close()
+	for _, r := range s.replicas {
+		if err := r.Close(); err != nil {
+			last = err
+		}
+	}
+	return last
+}
+
+func (s *MirrorStorage) failover() {
+	s.mu.Lock()
+	s.stats.Failover++
+	s.mu.Unlock()
+}
+
+func (s *MirrorStorage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	sz, err := s.primary.StatBlob(ctx, ref)
+	if err == nil {
+		return sz, nil
+	}
+	for _, r := range s.replicas {
+		if sz, rerr := r.StatBlob(ctx, ref); rerr == nil {
+			s.failover()
+			return sz, nil
+		}
+	}
+	return 0, err
+}
+
+func (s *MirrorStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	rc, sz, err := s.primary.FetchBlob(ctx, ref)
+	if err == nil {
+		return rc, sz, nil
+	}
+	for _, r := range s.replicas {
+		if rc, sz, rerr := r.FetchBlob(ctx, ref); rerr == nil {
+			s.failover()
+			return rc, sz, nil
+		}
+	}
+	return nil, 0, err
+}
+
+func (s *MirrorStorage) IterateBlobs(ctx context.Context) Iterator {
+	return s.primary.IterateBlobs(ctx)
+}
+
+func (s *MirrorStorage) BeginBlob(ctx context.Context) (BlobWriter, error) {
+	w, err := s.primary.BeginBlob(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mw := &mirrorWriter{s: s, w: w}
+	if s.opts.Async {
+		return mw, nil
+	}
+	for _, r := range s.replicas {
+		rw, err := r.BeginBlob(ctx)
+		if err != nil {
+			mw.Close()
+			return nil, err
+		}
+		mw.replicas = append(mw.replicas, rw)
+	}
+	return mw, nil
+}
+
+func (s *MirrorStorage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	if err := s.primary.SetPin(ctx, name, ref); err != nil {
+		return err
+	}
+	if s.opts.Async {
+		s.enqueue(mirrorJob{fnc: func(ctx context.Context, r Storage) error {
+			return r.SetPin(ctx, name, ref)
+		}})
+		return nil
+	}
+	for i, r := range s.replicas {
+		if err := r.SetPin(ctx, name, ref); err != nil {
+			return fmt.Errorf("replica %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (s *MirrorStorage) DeletePin(ctx context.Context, name string) error {
+	if err := s.primary.DeletePin(ctx, name); err != nil {
+		return err
+	}
+	if s.opts.Async {
+		s.enqueue(mirrorJob{fnc: func(ctx context.Context, r Storage) error {
+			err := r.DeletePin(ctx, name)
+			if err == ErrNotFound {
+				err = nil
+			}
+			return err
+		}})
+		return nil
+	}
+	for i, r := range s.replicas {
+		if err := r.DeletePin(ctx, name); err != nil && err != ErrNotFound {
+			return fmt.Errorf("replica %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (s *MirrorStorage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	ref, err := s.primary.GetPin(ctx, name)
+	if err == nil || err == ErrNotFound {
+		return ref, err
+	}
+	for _, r := range s.replicas {
+		if ref, rerr := r.GetPin(ctx, name); rerr == nil || rerr == ErrNotFound {
+			s.failover()
+			return ref, rerr
+		}
+	}
+	return types.Ref{}, err
+}
+
+func (s *MirrorStorage) IteratePins(ctx context.Context) PinIterator {
+	return s.primary.IteratePins(ctx)
+}
+
+// mirrorWriter writes a blob to the primary storage and to replicas (in synchronous mode).
+type mirrorWriter struct {
+	s        *MirrorStorage
+	w        BlobWriter
+	replicas []BlobWriter
+
+	completed bool
+	sr        types.SizedRef
+}
+
+func (w *mirrorWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	for i, rw := range w.replicas {
+		if _, err = rw.Write(p[:n]); err != nil {
+			return n, fmt.Errorf("replica %d: %v", i, err)
+		}
+	}
+	return n, nil
+}
+
+func (w *mirrorWriter) Size() uint64 {
+	return w.w.Size()
+}
+
+func (w *mirrorWriter) Complete() (types.SizedRef, error) {
+	if w.completed {
+		return w.sr, nil
+	}
+	sr, err := w.w.Complete()
+	if err != nil {
+		return sr, err
+	}
+	for i, rw := range w.replicas {
+		rsr, err := rw.Complete()
+		if err != nil {
+			return types.SizedRef{}, fmt.Errorf("replica %d: %v", i, err)
+		} else if rsr != sr {
+			return types.SizedRef{}, fmt.Errorf("replica %d: %v", i, ErrRefMissmatch{Exp: sr.Ref, Got: rsr.Ref})
+		}
+	}
+	w.completed, w.sr = true, sr
+	return sr, nil
+}
+
+func (w *mirrorWriter) Close() error {
+	err := w.w.Close()
+	for _, rw := range w.replicas {
+		if rerr := rw.Close(); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+func (w *mirrorWriter) Commit() error {
+	sr, err := w.Complete()
+	if err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.w.Commit(); err != nil {
+		w.Close()
+		return err
+	}
+	if w.s.opts.Async {
+		w.s.enqueue(mirrorJob{blob: sr})
+		return nil
+	}
+	for i, rw := range w.replicas {
+		if err = rw.Commit(); err != nil {
+			w.Close()
+			return fmt.Errorf("replica %d: %v", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/dennwc/cas/types"
+)
+
+// BlobReader is a blob opened for random access.
+type BlobReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// BlobOpener is an optional interface for Storage implementations that can read arbitrary ranges of blobs
+// without reading the whole blob.
+type BlobOpener interface {
+	// OpenBlob opens a blob for random access and returns its size.
+	// It returns ErrNotFound if this blob does not exist.
+	// Calling it with a zero Ref will result in ErrInvalidRef.
+	// Caller should close a reader to free resources.
+	//
+	// The content is not verified, since only a part of the blob might be read.
+	OpenBlob(ctx context.Context, ref types.Ref) (BlobReader, uint64, error)
+}
+
+// OpenBlob opens a blob for random access. It uses BlobOpener if the storage implements it.
+//
+// Otherwise, the blob is fetched with FetchBlob. Readers that already support random access, such as files,
+// are returned as-is. For other readers random access is emulated: reading forward skips the data and
+// reading backward fetches the blob again.
+func OpenBlob(ctx context.Context, s BlobSource, ref types.Ref) (BlobReader, uint64, error) {
+	if ref.Zero() {
+		return nil, 0, ErrInvalidRef
+	}
+	if bo, ok := s.(BlobOpener); ok {
+		return bo.OpenBlob(ctx, ref)
+	}
+	rc, sz, err := s.FetchBlob(ctx, ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	if br, ok := rc.(BlobReader); ok {
+		return br, sz, nil
+	}
+	return &randReader{ctx: ctx, s: s, ref: ref, size: int64(sz), rc: rc}, sz, nil
+}
+
+// randReader emulates random access on top of sequential blob readers.
+type randReader struct {
+	ctx  context.Context
+	s    BlobSource
+	ref  types.Ref
+	size int64
+
+	mu  sync.Mutex
+	rc  io.ReadCloser
+	off int64 // offset of rc
+	pos int64 // offset for Read, as set by Seek
+}
+
+func (r *randReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.readAt(p, off)
+}
+
+func (r *randReader) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	} else if off >= r.size {
+		return 0, io.EOF
+	}
+	if r.rc != nil && r.off > off {
+		r.rc.Close()
+		r.rc = nil
+	}
+	if r.rc == nil {
+		rc, _, err := r.s.FetchBlob(r.ctx, r.ref)
+		if err != nil {
+			return 0, err
+		}
+		r.rc, r.off = rc, 0
+	}
+	if r.off < off {
+		n, err := io.CopyN(ioutil.Discard, r.rc, off-r.off)
+		r.off += n
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	var eof error
+	if rest := r.size - off; int64(len(p)) > rest {
+		p, eof = p[:rest], io.EOF
+	}
+	n, err := io.ReadFull(r.rc, p)
+	r.off += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	} else if err == nil {
+		err = eof
+	}
+	return n, err
+}
+
+func (r *randReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := r.readAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n != 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *randReader) Seek(off int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		off += r.pos
+	case io.SeekEnd:
+		off += r.size
+	default:
+		return r.pos, os.ErrInvalid
+	}
+	if off < 0 {
+		return r.pos, os.ErrInvalid
+	}
+	r.pos = off
+	return off, nil
+}
+
+func (r *randReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/types"
+)
+
+// Tree pack format.
+//
+// A tree pack is a tar stream that contains all blobs reachable from a single root blob.
+// Each blob is stored as a regular file named by its ref, and the first file is always the root.
+//
+// Blobs are written in depth-first order, and each schema blob precedes the blobs it references.
+// Thus, the pack can be restored sequentially: the structure of a directory is known before the content
+// of its files. History of commits is not included, only the tree of the commit.
+//
+// Blobs that are missing in the source storage (for example, content of files stored in index-only mode)
+// are skipped.
+
+// maxPackSchema is the maximal size of a schema blob that is decoded when the pack is written.
+const maxPackSchema = 16 * 1024 * 1024
+
+var errEmptyPack = errors.New("tree pack is empty")
+
+// PackFetcher is an optional interface for Storage implementations that can produce tree packs directly.
+// It's intended for remote storages, where fetching the tree blob by blob is expensive.
+type PackFetcher interface {
+	// FetchPack opens a tree pack with all blobs reachable from the root.
+	// It returns ErrNotFound if the root blob does not exist.
+	FetchPack(ctx context.Context, root types.Ref) (io.ReadCloser, error)
+}
+
+// PackStorer is an optional interface for Storage implementations that can store tree packs directly.
+type PackStorer interface {
+	// StorePack stores all blobs from the tree pack and returns the root blob.
+	StorePack(ctx context.Context, r io.Reader) (types.SizedRef, error)
+}
+
+// WritePack writes a tree pack with all blobs reachable from the root. See PackFetcher.
+func WritePack(ctx context.Context, w io.Writer, src BlobSource, root types.Ref) error {
+	if root.Zero() {
+		return ErrInvalidRef
+	}
+	tw := tar.NewWriter(w)
+	pw := &packWalker{
+		ctx: ctx, src: src,
+		seen: make(map[types.Ref]struct{}),
+		visit: func(ref types.Ref, size uint64, r io.Reader) error {
+			return writePackEntry(tw, ref, size, r)
+		},
+	}
+	if err := pw.walk(root, true); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// WriteBlobPack writes a pack with a given set of blobs in the same order. References of schema blobs
+// are not followed, and missing blobs are skipped. The result can be stored with ReadPack or PackStorer;
+// the first blob is reported as the root.
+//
+// It's intended for uploading many small unrelated blobs in a single request.
+func WriteBlobPack(ctx context.Context, w io.Writer, src BlobSource, refs []types.Ref) error {
+	tw := tar.NewWriter(w)
+	for _, ref := range refs {
+		if ref.Zero() {
+			return ErrInvalidRef
+		}
+		rc, size, err := src.FetchBlob(ctx, ref)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		err = writePackEntry(tw, ref, size, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writePackEntry(tw *tar.Writer, ref types.Ref, size uint64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     ref.String(),
+		Size:     int64(size),
+		Mode:     0444,
+	})
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tw, r)
+	if err != nil {
+		return err
+	} else if uint64(n) != size {
+		return ErrSizeMissmatch{Exp: size, Got: uint64(n)}
+	}
+	return nil
+}
+
+// ReadPack stores all blobs from the tree pack to the storage and returns the root blob.
+// Blobs that already exist in the storage are skipped. The content of each blob is verified.
+func ReadPack(ctx context.Context, dst BlobStorage, r io.Reader) (types.SizedRef, error) {
+	tr := tar.NewReader(r)
+	var root types.SizedRef
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return types.SizedRef{}, err
+		}
+		if h.Typeflag != tar.TypeReg {
+			return types.SizedRef{}, fmt.Errorf("unexpected entry in tree pack: %q", h.Name)
+		}
+		ref, err := types.ParseRef(h.Name)
+		if err != nil {
+			return types.SizedRef{}, err
+		}
+		sr := types.SizedRef{Ref: ref, Size: uint64(h.Size)}
+		if root.Ref.Zero() {
+			root = sr
+		}
+		if _, err = dst.StatBlob(ctx, ref); err == nil {
+			continue
+		} else if err != ErrNotFound {
+			return types.SizedRef{}, err
+		}
+		if err = storePackBlob(ctx, dst, sr, tr); err != nil {
+			return types.SizedRef{}, err
+		}
+	}
+	if root.Ref.Zero() {
+		return types.SizedRef{}, errEmptyPack
+	}
+	return root, nil
+}
+
+func storePackBlob(ctx context.Context, dst BlobStorage, exp types.SizedRef, r io.Reader) error {
+	w, err := dst.BeginBlob(ctx)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if _, err = io.Copy(w, r); err != nil {
+		return err
+	}
+	sr, err := w.Complete()
+	if err != nil {
+		return err
+	} else if sr.Size != exp.Size {
+		return ErrSizeMissmatch{Exp: exp.Size, Got: sr.Size}
+	} else if sr.Ref != exp.Ref {
+		return ErrRefMissmatch{Exp: exp.Ref, Got: sr.Ref}
+	}
+	return w.Commit()
+}
+
+// CopyTree copies all blobs reachable from the root to another storage.
+//
+// If the destination is empty, the tree is transferred as a single tree pack, given that either
+// storage supports it (see PackFetcher and PackStorer). Otherwise, only missing blobs are copied one by one.
+func CopyTree(ctx context.Context, dst BlobStorage, src BlobSource, root types.Ref) error {
+	if root.Zero() {
+		return ErrInvalidRef
+	}
+	pf, canFetch := src.(PackFetcher)
+	ps, canStore := dst.(PackStorer)
+	if canFetch || canStore {
+		empty, err := IsEmpty(ctx, dst)
+		if err != nil {
+			return err
+		}
+		if empty {
+			return copyPack(ctx, dst, src, root, pf, ps)
+		}
+	}
+	// existing blobs are checked in batches, for all references of a schema blob at once
+	exists := make(map[types.Ref]bool)
+	pw := &packWalker{
+		ctx: ctx, src: src,
+		seen: make(map[types.Ref]struct{}),
+		visit: func(ref types.Ref, size uint64, r io.Reader) error {
+			ok, checked := exists[ref]
+			if !checked {
+				if _, err := dst.StatBlob(ctx, ref); err == nil {
+					ok = true
+				} else if err != ErrNotFound {
+					return err
+				}
+			}
+			delete(exists, ref)
+			if ok {
+				return nil
+			}
+			return storePackBlob(ctx, dst, types.SizedRef{Ref: ref, Size: size}, r)
+		},
+		refs: func(refs []types.Ref) error {
+			srs, err := StatBlobs(ctx, dst, refs)
+			if err != nil {
+				return err
+			}
+			for _, ref := range refs {
+				exists[ref] = false
+			}
+			for _, sr := range srs {
+				exists[sr.Ref] = true
+			}
+			return nil
+		},
+	}
+	return pw.walk(root, true)
+}
+
+func copyPack(ctx context.Context, dst BlobStorage, src BlobSource, root types.Ref, pf PackFetcher, ps PackStorer) error {
+	var r io.Reader
+	if pf != nil {
+		rc, err := pf.FetchPack(ctx, root)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		r = rc
+	} else {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			pw.CloseWithError(WritePack(ctx, pw, src, root))
+		}()
+		r = pr
+	}
+	var (
+		sr  types.SizedRef
+		err error
+	)
+	if ps != nil {
+		sr, err = ps.StorePack(ctx, r)
+	} else {
+		sr, err = ReadPack(ctx, dst, r)
+	}
+	if err != nil {
+		return err
+	} else if sr.Ref != root {
+		return ErrRefMissmatch{Exp: root, Got: sr.Ref}
+	}
+	return nil
+}
+
+// IsEmpty checks if the storage has no blobs.
+func IsEmpty(ctx context.Context, s BlobSource) (bool, error) {
+	it := s.IterateBlobs(ctx)
+	defer it.Close()
+	if it.Next() {
+		return false, nil
+	}
+	return true, it.Err()
+}
+
+// packWalker visits all blobs reachable from the root in the order defined by the tree pack format.
+type packWalker struct {
+	ctx   context.Context
+	src   BlobSource
+	seen  map[types.Ref]struct{}
+	visit func(ref types.Ref, size uint64, r io.Reader) error
+	refs  func(refs []types.Ref) error // optional; called with unvisited references of a schema blob before visiting them
+}
+
+func (w *packWalker) walk(ref types.Ref, root bool) error {
+	if ref.Zero() {
+		return nil
+	} else if _, ok := w.seen[ref]; ok {
+		return nil
+	}
+	w.seen[ref] = struct{}{}
+	rc, size, err := w.src.FetchBlob(w.ctx, ref)
+	if err == ErrNotFound && !root {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	br := bufio.NewReader(rc)
+	if p, _ := br.Peek(schema.MagicSize); size > maxPackSchema || !schema.IsSchema(p) {
+		// data blobs are streamed directly
+		err = w.visit(ref, size, br)
+		rc.Close()
+		return err
+	}
+	// schema blobs are small; read them to memory to release the reader before descending
+	data, err := ioutil.ReadAll(br)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	if err = w.visit(ref, size, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	obj, err := schema.Decode(bytes.NewReader(data))
+	if err != nil {
+		// not a schema blob after all, or an unknown type
+		return nil
+	}
+	refs := obj.References()
+	if c, ok := obj.(*schema.Commit); ok {
+		// don't include the history
+		refs = []types.Ref{c.Root}
+		if c.Manifest != nil {
+			refs = append(refs, *c.Manifest)
+		}
+	}
+	if w.refs != nil {
+		var next []types.Ref
+		for _, r := range refs {
+			if _, ok := w.seen[r]; !ok && !r.Zero() {
+				next = append(next, r)
+			}
+		}
+		if err = w.refs(next); err != nil {
+			return err
+		}
+	}
+	for _, r := range refs {
+		if err = w.walk(r, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
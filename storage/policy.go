@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/types"
+)
+
+// maxPolicySchema is the maximal size of a schema blob that will be buffered to check the policy.
+// Larger schema blobs cannot be decoded anyway.
+const maxPolicySchema = 16 * 1024 * 1024
+
+// ErrPolicy is returned when a blob is rejected by the storage policy.
+type ErrPolicy struct {
+	Ref    types.Ref // may be zero if the blob was rejected before it was completed
+	Reason string
+}
+
+func (e ErrPolicy) Error() string {
+	if e.Ref.Zero() {
+		return fmt.Sprintf("blob rejected by policy: %s", e.Reason)
+	}
+	return fmt.Sprintf("blob %v rejected by policy: %s", e.Ref, e.Reason)
+}
+
+// BlobInfo describes a blob that is checked by the policy.
+type BlobInfo struct {
+	types.SizedRef
+	Type   string        // schema type; empty for data blobs
+	Object schema.Object // decoded schema object; only set if ValidateSchema is enabled
+}
+
+// Policy is a set of rules for blobs written to the storage.
+// It's intended for storages that accept blobs from untrusted or semi-trusted clients.
+type Policy struct {
+	// MaxSize is the maximal size of a single blob. Writes are stopped as soon as the limit is exceeded.
+	MaxSize uint64
+	// AllowTypes is a list of schema types that are allowed. If empty, all types are allowed.
+	AllowTypes []string
+	// DenyTypes is a list of schema types that are not allowed.
+	DenyTypes []string
+	// ValidateSchema requires all schema blobs to be decoded successfully, thus rejecting malformed
+	// schema blobs and blobs of unknown types.
+	ValidateSchema bool
+	// Check is an optional hook for custom rules. It's called after all other checks passed.
+	// Returning an error rejects the blob; errors other than ErrPolicy are wrapped into ErrPolicy.
+	Check func(ctx context.Context, b *BlobInfo) error
+}
+
+// needsType checks if the policy requires schema types of blobs.
+func (p *Policy) needsType() bool {
+	return len(p.AllowTypes) != 0 || len(p.DenyTypes) != 0 || p.ValidateSchema || p.Check != nil
+}
+
+func (p *Policy) checkType(typ string) string {
+	if typ == "" {
+		return ""
+	}
+	for _, t := range p.DenyTypes {
+		if t == typ {
+			return fmt.Sprintf("schema type %q is not allowed", typ)
+		}
+	}
+	if len(p.AllowTypes) == 0 {
+		return ""
+	}
+	for _, t := range p.AllowTypes {
+		if t == typ {
+			return ""
+		}
+	}
+	return fmt.Sprintf("schema type %q is not allowed", typ)
+}
+
+// WithPolicy wraps the storage and checks all blobs written to it against the policy.
+// Blobs that violate the policy are never committed, and the writer returns ErrPolicy.
+//
+// Schema blobs are buffered in memory to check their type, but only if the policy has any
+// rules related to schema.
+func WithPolicy(s Storage, p Policy) Storage {
+	return &policyStorage{Storage: s, p: p}
+}
+
+var (
+	_ BlobOpener     = (*policyStorage)(nil)
+	_ BulkFetcher    = (*policyStorage)(nil)
+	_ BulkStater     = (*policyStorage)(nil)
+	_ PrefixIterator = (*policyStorage)(nil)
+)
+
+type policyStorage struct {
+	Storage
+	p Policy
+}
+
+// OpenBlob implements BlobOpener.
+func (s *policyStorage) OpenBlob(ctx context.Context, ref types.Ref) (BlobReader, uint64, error) {
+	return OpenBlob(ctx, s.Storage, ref)
+}
+
+// FetchBlobs implements BulkFetcher.
+func (s *policyStorage) FetchBlobs(ctx context.Context, refs []types.Ref) (MultiReader, error) {
+	return FetchBlobs(ctx, s.Storage, refs)
+}
+
+// StatBlobs implements BulkStater.
+func (s *policyStorage) StatBlobs(ctx context.Context, refs []types.Ref) ([]types.SizedRef, error) {
+	return StatBlobs(ctx, s.Storage, refs)
+}
+
+// IterateBlobsPrefix implements PrefixIterator.
+func (s *policyStorage) IterateBlobsPrefix(ctx context.Context, prefix string) Iterator {
+	return IterateBlobsPrefix(ctx, s.Storage, prefix)
+}
+
+func (s *policyStorage) BeginBlob(ctx context.Context) (BlobWriter, error) {
+	w, err := s.Storage.BeginBlob(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &policyWriter{BlobWriter: w, ctx: ctx, p: &s.p, schema: s.p.needsType()}, nil
+}
+
+type policyWriter struct {
+	BlobWriter
+	ctx context.Context
+	p   *Policy
+
+	schema bool         // blob might be a schema blob; buffer the data
+	buf    bytes.Buffer // schema blob content
+	sr     types.SizedRef
+	err    error
+}
+
+func (w *policyWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if max := w.p.MaxSize; max != 0 && w.BlobWriter.Size()+uint64(len(p)) > max {
+		w.err = ErrPolicy{Reason: fmt.Sprintf("blob is larger than %d bytes", max)}
+		return 0, w.err
+	}
+	n, err := w.BlobWriter.Write(p)
+	if w.schema && n != 0 {
+		w.buf.Write(p[:n])
+		if w.buf.Len() >= schema.MagicSize && !schema.IsSchema(w.buf.Bytes()) {
+			// data blob
+			w.schema = false
+			w.buf = bytes.Buffer{}
+		} else if w.buf.Len() > maxPolicySchema {
+			w.err = ErrPolicy{Reason: fmt.Sprintf("schema blob is larger than %d bytes", maxPolicySchema)}
+			return n, w.err
+		}
+	}
+	return n, err
+}
+
+func (w *policyWriter) Complete() (types.SizedRef, error) {
+	if w.err != nil {
+		return types.SizedRef{}, w.err
+	} else if !w.sr.Ref.Zero() {
+		return w.sr, nil
+	}
+	sr, err := w.BlobWriter.Complete()
+	if err != nil {
+		return sr, err
+	}
+	if err = w.check(sr); err != nil {
+		w.err = err
+		return types.SizedRef{}, err
+	}
+	w.sr = sr
+	return sr, nil
+}
+
+func (w *policyWriter) check(sr types.SizedRef) error {
+	b := &BlobInfo{SizedRef: sr}
+	if w.schema && schema.IsSchema(w.buf.Bytes()) {
+		data := w.buf.Bytes()
+		typ, err := schema.DecodeType(bytes.NewReader(data))
+		if err != nil {
+			return ErrPolicy{Ref: sr.Ref, Reason: fmt.Sprintf("invalid schema blob: %v", err)}
+		}
+		b.Type = typ
+		if w.p.ValidateSchema {
+			b.Object, err = schema.Decode(bytes.NewReader(data))
+			if err != nil {
+				return ErrPolicy{Ref: sr.Ref, Reason: fmt.Sprintf("invalid schema blob: %v", err)}
+			}
+		}
+	}
+	if reason := w.p.checkType(b.Type); reason != "" {
+		return ErrPolicy{Ref: sr.Ref, Reason: reason}
+	}
+	if w.p.Check == nil {
+		return nil
+	}
+	err := w.p.Check(w.ctx, b)
+	if err == nil {
+		return nil
+	} else if e, ok := err.(ErrPolicy); ok {
+		if e.Ref.Zero() {
+			e.Ref = sr.Ref
+		}
+		return e
+	}
+	return ErrPolicy{Ref: sr.Ref, Reason: err.Error()}
+}
+
+func (w *policyWriter) Commit() error {
+	if _, err := w.Complete(); err != nil {
+		return err
+	}
+	return w.BlobWriter.Commit()
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"strings"
+
+	"github.com/dennwc/cas/types"
+)
+
+// PrefixIterator is an optional interface for Storage implementations that can list a slice of the keyspace
+// without listing all blobs. It allows sync protocols and sharded replication to walk the storage in
+// deterministic parts.
+type PrefixIterator interface {
+	// IterateBlobsPrefix creates an iterator that lists blobs with refs that start with a given prefix.
+	// The prefix is matched against the string form of the ref, for example "sha256:ab".
+	// Caller should close an iterator to free resources.
+	IterateBlobsPrefix(ctx context.Context, prefix string) Iterator
+}
+
+// IterateBlobsPrefix lists blobs with refs that start with a given prefix. It uses PrefixIterator if the storage
+// implements it, and filters all blobs otherwise. See PrefixIterator for details.
+func IterateBlobsPrefix(ctx context.Context, s BlobSource, prefix string) Iterator {
+	if prefix == "" {
+		return s.IterateBlobs(ctx)
+	}
+	if pi, ok := s.(PrefixIterator); ok {
+		return pi.IterateBlobsPrefix(ctx, prefix)
+	}
+	return FilterPrefix(s.IterateBlobs(ctx), prefix)
+}
+
+// FilterPrefix wraps an iterator and skips blobs with refs that don't start with a given prefix.
+func FilterPrefix(it Iterator, prefix string) Iterator {
+	return &prefixIterator{Iterator: it, prefix: prefix}
+}
+
+type prefixIterator struct {
+	Iterator
+	prefix string
+}
+
+func (it *prefixIterator) Next() bool {
+	for it.Iterator.Next() {
+		if HasRefPrefix(it.SizedRef().Ref, it.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRefPrefix checks if the string form of the ref starts with a given prefix.
+func HasRefPrefix(ref types.Ref, prefix string) bool {
+	return strings.HasPrefix(ref.String(), prefix)
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dennwc/cas/types"
+)
+
+// BlobRangeFetcher is an optional interface for Storage implementations that can read a part of the blob
+// without transferring the rest of it, for example with HTTP Range requests.
+type BlobRangeFetcher interface {
+	// FetchBlobRange opens a part of the blob for reading and returns the size of the whole blob.
+	// The part starts at off and has a given length; zero length means the rest of the blob.
+	// The range is clipped to the size of the blob, thus the reader returns less data than requested
+	// if the range ends past the end of the blob, and no data at all if it starts there.
+	// It returns ErrNotFound if this blob does not exist.
+	// Calling it with a zero Ref will result in ErrInvalidRef.
+	//
+	// The content is not verified, since only a part of the blob is read.
+	FetchBlobRange(ctx context.Context, ref types.Ref, off, length uint64) (io.ReadCloser, uint64, error)
+}
+
+// FetchBlobRange opens a part of the blob for reading. It uses BlobRangeFetcher if the storage implements it,
+// or reads the range from a blob opened with OpenBlob otherwise.
+func FetchBlobRange(ctx context.Context, s BlobSource, ref types.Ref, off, length uint64) (io.ReadCloser, uint64, error) {
+	if ref.Zero() {
+		return nil, 0, ErrInvalidRef
+	}
+	if rf, ok := s.(BlobRangeFetcher); ok {
+		return rf.FetchBlobRange(ctx, ref, off, length)
+	}
+	br, sz, err := OpenBlob(ctx, s, ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	off, length = clipRange(off, length, sz)
+	return &rangeCloser{
+		Reader: io.NewSectionReader(br, int64(off), int64(length)),
+		Closer: br,
+	}, sz, nil
+}
+
+// clipRange clips the range to the size of the blob. Zero length is replaced by the rest of the blob.
+func clipRange(off, length, size uint64) (uint64, uint64) {
+	if off >= size {
+		return size, 0
+	}
+	if rest := size - off; length == 0 || length > rest {
+		length = rest
+	}
+	return off, length
+}
+
+type rangeCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// HTTPRange returns the value of the HTTP Range header for a part of the blob. See FetchBlobRange.
+func HTTPRange(off, length uint64) string {
+	if length == 0 {
+		return fmt.Sprintf("bytes=%d-", off)
+	}
+	return fmt.Sprintf("bytes=%d-%d", off, off+length-1)
+}
+
+// ParseContentRange parses the value of the Content-Range header. It only accepts ranges with a known total size.
+func ParseContentRange(s string) (start, end, total uint64, err error) {
+	const pref = "bytes "
+	if !strings.HasPrefix(s, pref) {
+		return 0, 0, 0, fmt.Errorf("invalid content range: %q", s)
+	}
+	s = s[len(pref):]
+	i := strings.IndexByte(s, '-')
+	j := strings.IndexByte(s, '/')
+	if i < 0 || j < i {
+		return 0, 0, 0, fmt.Errorf("invalid content range: %q", s)
+	}
+	if start, err = strconv.ParseUint(s[:i], 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	if end, err = strconv.ParseUint(s[i+1:j], 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	if total, err = strconv.ParseUint(s[j+1:], 10, 64); err != nil {
+		return 0, 0, 0, err
+	}
+	if start > end || end >= total {
+		return 0, 0, 0, fmt.Errorf("invalid content range: %q", s)
+	}
+	return start, end, total, nil
+}
+
+// HTTPRangeResponse returns a part of the blob from a response to a request with the Range header (see HTTPRange),
+// and the size of the whole blob. It takes the ownership of the response body, and the caller should handle
+// other errors, such as missing blobs, before calling it.
+//
+// Servers that don't support ranges are handled as well: the data before the range is skipped.
+func HTTPRangeResponse(resp *http.Response, off, length uint64) (io.ReadCloser, uint64, error) {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, end, total, err := ParseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			resp.Body.Close()
+			return nil, 0, err
+		}
+		if off, length = clipRange(off, length, total); start != off || end+1 != off+length {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("unexpected content range: [%d-%d], expected [%d-%d]", start, end, off, off+length-1)
+		}
+		return resp.Body, total, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the range starts past the end of the blob
+		resp.Body.Close()
+		cr := resp.Header.Get("Content-Range")
+		if !strings.HasPrefix(cr, "bytes */") {
+			return nil, 0, fmt.Errorf("invalid content range: %q", cr)
+		}
+		total, err := strconv.ParseUint(strings.TrimPrefix(cr, "bytes */"), 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid content range: %q", cr)
+		} else if off < total {
+			return nil, 0, fmt.Errorf("range is not satisfiable for a blob of %d bytes", total)
+		}
+		return ioutil.NopCloser(strings.NewReader("")), total, nil
+	case http.StatusOK:
+		if resp.ContentLength < 0 {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("unknown blob size")
+		}
+		total := uint64(resp.ContentLength)
+		off, length = clipRange(off, length, total)
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, int64(off)); err != nil {
+			resp.Body.Close()
+			return nil, 0, err
+		}
+		return &rangeCloser{
+			Reader: io.LimitReader(resp.Body, int64(length)),
+			Closer: resp.Body,
+		}, total, nil
+	default:
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("unexpected status code on ranged fetch: %v", resp.Status)
+	}
+}
@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/dennwc/cas/sched"
+	"github.com/dennwc/cas/types"
+)
+
+// NewScheduled wraps the storage and runs all operations through the scheduler.
+//
+// Client ID and the priority of each operation are taken from the context (see sched.WithClient
+// and sched.WithPriority). Blob readers, writers and iterators hold the slot until they are closed.
+func NewScheduled(s Storage, sch *sched.Scheduler) Storage {
+	return &schedStorage{s: s, sch: sch}
+}
+
+var (
+	_ BlobOpener     = (*schedStorage)(nil)
+	_ BulkFetcher    = (*schedStorage)(nil)
+	_ BulkStater     = (*schedStorage)(nil)
+	_ PrefixIterator = (*schedStorage)(nil)
+)
+
+type schedStorage struct {
+	s   Storage
+	sch *sched.Scheduler
+}
+
+func (s *schedStorage) Close() error {
+	return s.s.Close()
+}
+
+func (s *schedStorage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	release, err := s.sch.Acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return s.s.StatBlob(ctx, ref)
+}
+
+func (s *schedStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	release, err := s.sch.Acquire(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	rc, sz, err := s.s.FetchBlob(ctx, ref)
+	if err != nil {
+		release()
+		return nil, 0, err
+	}
+	return &schedReader{ReadCloser: rc, release: release}, sz, nil
+}
+
+func (s *schedStorage) IterateBlobs(ctx context.Context) Iterator {
+	release, err := s.sch.Acquire(ctx)
+	if err != nil {
+		return &errIterator{err: err}
+	}
+	return &schedIterator{Iterator: s.s.IterateBlobs(ctx), release: release}
+}
+
+func (s *schedStorage) BeginBlob(ctx context.Context) (BlobWriter, error) {
+	release, err := s.sch.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.s.BeginBlob(ctx)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &schedWriter{BlobWriter: w, release: release}, nil
+}
+
+func (s *schedStorage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	release, err := s.sch.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return s.s.SetPin(ctx, name, ref)
+}
+
+func (s *schedStorage) DeletePin(ctx context.Context, name string) error {
+	release, err := s.sch.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return s.s.DeletePin(ctx, name)
+}
+
+func (s *schedStorage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	release, err := s.sch.Acquire(ctx)
+	if err != nil {
+		return types.Ref{}, err
+	}
+	defer release()
+	return s.s.GetPin(ctx, name)
+}
+
+func (s *schedStorage) IteratePins(ctx context.Context) PinIterator {
+	release, err := s.sch.Acquire(ctx)
+	if err != nil {
+		return &errPinIterator{errIterator{err: err}}
+	}
+	return &schedPinIterator{PinIterator: s.s.IteratePins(ctx), release: release}
+}
+
+// OpenBlob implements BlobOpener. The reader holds the slot until it's closed.
+func (s *schedStorage) OpenBlob(ctx context.Context, ref types.Ref) (BlobReader, uint64, error) {
+	release, err := s.sch.Acquire(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	br, sz, err := OpenBlob(ctx, s.s, ref)
+	if err != nil {
+		release()
+		return nil, 0, err
+	}
+	return &schedBlobReader{BlobReader: br, release: release}, sz, nil
+}
+
+// FetchBlobs implements BulkFetcher. All blobs are read using a single slot.
+func (s *schedStorage) FetchBlobs(ctx context.Context, refs []types.Ref) (MultiReader, error) {
+	release, err := s.sch.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mr, err := FetchBlobs(ctx, s.s, refs)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &schedMultiReader{MultiReader: mr, release: release}, nil
+}
+
+// StatBlobs implements BulkStater.
+func (s *schedStorage) StatBlobs(ctx context.Context, refs []types.Ref) ([]types.SizedRef, error) {
+	release, err := s.sch.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return StatBlobs(ctx, s.s, refs)
+}
+
+// IterateBlobsPrefix implements PrefixIterator.
+func (s *schedStorage) IterateBlobsPrefix(ctx context.Context, prefix string) Iterator {
+	release, err := s.sch.Acquire(ctx)
+	if err != nil {
+		return &errIterator{err: err}
+	}
+	return &schedIterator{Iterator: IterateBlobsPrefix(ctx, s.s, prefix), release: release}
+}
+
+type schedReader struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *schedReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// File implements Filer.
+func (r *schedReader) File() *os.File {
+	f, _ := BlobFile(r.ReadCloser)
+	return f
+}
+
+type schedBlobReader struct {
+	BlobReader
+	once    sync.Once
+	release func()
+}
+
+func (r *schedBlobReader) Close() error {
+	err := r.BlobReader.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+type schedMultiReader struct {
+	MultiReader
+	once    sync.Once
+	release func()
+}
+
+func (r *schedMultiReader) Close() error {
+	err := r.MultiReader.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+type schedWriter struct {
+	BlobWriter
+	once    sync.Once
+	release func()
+}
+
+func (w *schedWriter) Commit() error {
+	err := w.BlobWriter.Commit()
+	w.once.Do(w.release)
+	return err
+}
+
+func (w *schedWriter) Close() error {
+	err := w.BlobWriter.Close()
+	w.once.Do(w.release)
+	return err
+}
+
+type schedIterator struct {
+	Iterator
+	once    sync.Once
+	release func()
+}
+
+func (it *schedIterator) Close() error {
+	err := it.Iterator.Close()
+	it.once.Do(it.release)
+	return err
+}
+
+type schedPinIterator struct {
+	PinIterator
+	once    sync.Once
+	release func()
+}
+
+func (it *schedPinIterator) Close() error {
+	err := it.PinIterator.Close()
+	it.once.Do(it.release)
+	return err
+}
+
+// errIterator is an empty iterator that returns an error.
+type errIterator struct {
+	err error
+}
+
+func (it *errIterator) Next() bool {
+	return false
+}
+
+func (it *errIterator) Err() error {
+	return it.err
+}
+
+func (it *errIterator) Close() error {
+	return nil
+}
+
+func (it *errIterator) SizedRef() types.SizedRef {
+	return types.SizedRef{}
+}
+
+type errPinIterator struct {
+	errIterator
+}
+
+func (it *errPinIterator) Pin() types.Pin {
+	return types.Pin{}
+}
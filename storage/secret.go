@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Secret is a credential in a storage config. It's either stored in the config as a plain string,
+// or references a secret stored elsewhere:
+//
+//	{"secret_ref": "env:B2_APPLICATION_KEY"}
+//
+// References are resolved when the storage is opened, thus the secret is never written to the config.
+// See ResolveSecret for supported references.
+type Secret struct {
+	Value string // plaintext value stored in the config
+	Ref   string // reference to the secret; takes precedence over the value
+}
+
+// PlainSecret returns a secret that is stored in the config.
+func PlainSecret(v string) *Secret {
+	if v == "" {
+		return nil
+	}
+	return &Secret{Value: v}
+}
+
+// SecretRef returns a secret that is resolved by a reference. See ResolveSecret.
+func SecretRef(ref string) *Secret {
+	if ref == "" {
+		return nil
+	}
+	return &Secret{Ref: ref}
+}
+
+type secretRef struct {
+	Ref string `json:"secret_ref"`
+}
+
+func (s *Secret) MarshalJSON() ([]byte, error) {
+	if s.Ref != "" {
+		return json.Marshal(secretRef{Ref: s.Ref})
+	}
+	return json.Marshal(s.Value)
+}
+
+func (s *Secret) UnmarshalJSON(p []byte) error {
+	*s = Secret{}
+	if p = bytes.TrimSpace(p); len(p) != 0 && p[0] == '{' {
+		var r secretRef
+		if err := json.Unmarshal(p, &r); err != nil {
+			return err
+		} else if r.Ref == "" {
+			return errors.New("secret reference is not set")
+		}
+		s.Ref = r.Ref
+		return nil
+	}
+	return json.Unmarshal(p, &s.Value)
+}
+
+// IsZero checks if the secret is not set.
+func (s *Secret) IsZero() bool {
+	return s == nil || *s == Secret{}
+}
+
+// Resolve returns the value of the secret. It returns an empty string for nil secrets.
+func (s *Secret) Resolve(ctx context.Context) (string, error) {
+	if s == nil {
+		return "", nil
+	} else if s.Ref == "" {
+		return s.Value, nil
+	}
+	return ResolveSecret(ctx, s.Ref)
+}
+
+// ResolveSecret returns the value of a secret by a reference. Supported references are:
+//
+//	env:NAME                  environment variable
+//	file:PATH                 content of a file, without the trailing newline
+//	keychain:SERVICE[/USER]   password stored in the OS keychain (macOS Keychain or Secret Service on Linux)
+func ResolveSecret(ctx context.Context, ref string) (string, error) {
+	i := strings.IndexByte(ref, ':')
+	if i < 0 {
+		return "", fmt.Errorf("invalid secret reference: %q", ref)
+	}
+	kind, arg := ref[:i], ref[i+1:]
+	if arg == "" {
+		return "", fmt.Errorf("invalid secret reference: %q", ref)
+	}
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("secret %q: environment variable is not set", ref)
+		}
+		return v, nil
+	case "file":
+		data, err := ioutil.ReadFile(arg)
+		if err != nil {
+			return "", fmt.Errorf("secret %q: %v", ref, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case "keychain":
+		v, err := keychainSecret(ctx, arg)
+		if err != nil {
+			return "", fmt.Errorf("secret %q: %v", ref, err)
+		}
+		return v, nil
+	}
+	return "", fmt.Errorf("unsupported secret reference: %q", ref)
+}
+
+// keychainSecret reads a password from the OS keychain. The name is a service with an optional user name.
+func keychainSecret(ctx context.Context, name string) (string, error) {
+	service, user := name, ""
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		service, user = name[:i], name[i+1:]
+	}
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		args := []string{"find-generic-password", "-w", "-s", service}
+		if user != "" {
+			args = append(args, "-a", user)
+		}
+		cmd = exec.CommandContext(ctx, "security", args...)
+	case "linux", "freebsd", "openbsd", "netbsd":
+		// Secret Service API (GNOME Keyring, KWallet)
+		args := []string{"lookup", "service", service}
+		if user != "" {
+			args = append(args, "username", user)
+		}
+		cmd = exec.CommandContext(ctx, "secret-tool", args...)
+	default:
+		return "", fmt.Errorf("keychain is not supported on %s", runtime.GOOS)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%v: %s", err, msg)
+		}
+		return "", err
+	} else if len(out) == 0 {
+		// secret-tool exits with no output if the secret is not found
+		return "", errors.New("not found in the keychain")
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/dennwc/cas/types"
+)
+
+// shardPoints is the number of points on the hash ring for each shard.
+const shardPoints = 128
+
+// Shard is a named backend of the sharded storage.
+type Shard struct {
+	// Name identifies the shard on the hash ring. It must be unique and must not change,
+	// since it determines which blobs are stored on the shard.
+	Name    string
+	Storage Storage
+}
+
+// NewSharded creates a storage that spreads blobs over multiple backends.
+//
+// Blobs are routed to shards by the prefix of their refs using consistent hashing, thus adding
+// a new shard only moves a fraction of blobs to it. Blobs that are missing from their shard
+// are looked up on other shards, so blobs written before the shard was added remain accessible.
+// Listing blobs aggregates all shards.
+//
+// Pins are stored on the first shard only.
+//
+// Closing the sharded storage closes all shards.
+func NewSharded(shards ...Shard) (*ShardedStorage, error) {
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("no shards specified")
+	}
+	s := &ShardedStorage{
+		shards: make([]Storage, 0, len(shards)),
+		names:  make([]string, 0, len(shards)),
+	}
+	seen := make(map[string]struct{}, len(shards))
+	for i, sh := range shards {
+		if _, ok := seen[sh.Name]; ok {
+			return nil, fmt.Errorf("duplicate shard name: %q", sh.Name)
+		}
+		seen[sh.Name] = struct{}{}
+		s.shards = append(s.shards, sh.Storage)
+		s.names = append(s.names, sh.Name)
+		for j := 0; j < shardPoints; j++ {
+			h := sha256.Sum256([]byte(sh.Name + "#" + strconv.Itoa(j)))
+			s.ring = append(s.ring, shardPoint{
+				hash: binary.BigEndian.Uint64(h[:]), shard: i,
+			})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool {
+		return s.ring[i].hash < s.ring[j].hash
+	})
+	return s, nil
+}
+
+var (
+	_ Storage        = (*ShardedStorage)(nil)
+	_ PrefixIterator = (*ShardedStorage)(nil)
+)
+
+// ShardedStorage is a storage that routes blobs to multiple backends. See NewSharded for details.
+type ShardedStorage struct {
+	shards []Storage
+	names  []string
+	ring   []shardPoint // sorted by hash
+}
+
+// shardPoint is a point on the hash ring.
+type shardPoint struct {
+	hash  uint64
+	shard int
+}
+
+// shardOf returns the index of a shard that owns the blob.
+func (s *ShardedStorage) shardOf(ref types.Ref) int {
+	var key uint64
+	if d := ref.Digest(); len(d) >= 8 {
+		key = binary.BigEndian.Uint64(d)
+	}
+	i := sort.Search(len(s.ring), func(i int) bool {
+		return s.ring[i].hash >= key
+	})
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].shard
+}
+
+// Locate returns the name of a shard that owns the blob.
+func (s *ShardedStorage) Locate(ref types.Ref) string {
+	return s.names[s.shardOf(ref)]
+}
+
+func (s *ShardedStorage) pins() Storage {
+	return s.shards[0]
+}
+
+func (s *ShardedStorage) Close() error {
+	var last error
+	for _, sh := range s.shards {
+		if err := sh.Close(); err != nil {
+			last = err
+		}
+	}
+	return last
+}
+
+func (s *ShardedStorage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	if ref.Zero() {
+		return 0, ErrInvalidRef
+	}
+	i := s.shardOf(ref)
+	sz, err := s.shards[i].StatBlob(ctx, ref)
+	if err != ErrNotFound {
+		return sz, err
+	}
+	for j, sh := range s.shards {
+		if j == i {
+			continue
+		}
+		if sz, err := sh.StatBlob(ctx, ref); err != ErrNotFound {
+			return sz, err
+		}
+	}
+	return 0, ErrNotFound
+}
+
+func (s *ShardedStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	if ref.Zero() {
+		return nil, 0, ErrInvalidRef
+	}
+	i := s.shardOf(ref)
+	rc, sz, err := s.shards[i].FetchBlob(ctx, ref)
+	if err != ErrNotFound {
+		return rc, sz, err
+	}
+	for j, sh := range s.shards {
+		if j == i {
+			continue
+		}
+		if rc, sz, err := sh.FetchBlob(ctx, ref); err != ErrNotFound {
+			return rc, sz, err
+		}
+	}
+	return nil, 0, ErrNotFound
+}
+
+func (s *ShardedStorage) IterateBlobs(ctx context.Context) Iterator {
+	// blobs might be listed by multiple shards, if they were added after the blob was written
+	return &unionIterator{
+		s: &unionStorage{layers: s.shards}, ctx: ctx,
+		seen: make(map[types.Ref]struct{}),
+	}
+}
+
+// IterateBlobsPrefix implements PrefixIterator.
+func (s *ShardedStorage) IterateBlobsPrefix(ctx context.Context, prefix string) Iterator {
+	return &unionIterator{
+		s: &unionStorage{layers: s.shards}, ctx: ctx, prefix: prefix,
+		seen: make(map[types.Ref]struct{}),
+	}
+}
+
+// BeginBlob starts a new blob. The blob is spooled to a local temporary file,
+// since the shard is only known after the ref of the blob is computed.
+func (s *ShardedStorage) BeginBlob(ctx context.Context) (BlobWriter, error) {
+	f, err := ioutil.TempFile("", "cas_shard_")
+	if err != nil {
+		return nil, err
+	}
+	return &shardWriter{s: s, ctx: ctx, f: f, hw: Hash()}, nil
+}
+
+func (s *ShardedStorage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	return s.pins().SetPin(ctx, name, ref)
+}
+
+func (s *ShardedStorage) DeletePin(ctx context.Context, name string) error {
+	return s.pins().DeletePin(ctx, name)
+}
+
+func (s *ShardedStorage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	return s.pins().GetPin(ctx, name)
+}
+
+func (s *ShardedStorage) IteratePins(ctx context.Context) PinIterator {
+	return s.pins().IteratePins(ctx)
+}
+
+type shardWriter struct {
+	s   *ShardedStorage
+	ctx context.Context
+	f   *os.File
+	hw  BlobWriter
+	sr  types.SizedRef
+}
+
+func (w *shardWriter) Size() uint64 {
+	return w.hw.Size()
+}
+
+func (w *shardWriter) Write(p []byte) (int, error) {
+	if _, err := w.hw.Write(p); err != nil {
+		return 0, err
+	}
+	if w.f == nil {
+		return 0, ErrBlobDiscarded
+	}
+	return w.f.Write(p)
+}
+
+func (w *shardWriter) Complete() (types.SizedRef, error) {
+	sr, err := w.hw.Complete()
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	w.sr = sr
+	return sr, nil
+}
+
+func (w *shardWriter) discard() {
+	if w.f != nil {
+		w.f.Close()
+		os.Remove(w.f.Name())
+		w.f = nil
+	}
+}
+
+func (w *shardWriter) Close() error {
+	err := w.hw.Close()
+	w.discard()
+	return err
+}
+
+func (w *shardWriter) Commit() error {
+	if err := w.hw.Commit(); err != nil {
+		return err
+	}
+	if w.f == nil {
+		return ErrBlobDiscarded
+	}
+	defer w.discard()
+	if w.sr.Ref.Zero() {
+		if _, err := w.Complete(); err != nil {
+			return err
+		}
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	sh := w.s.shards[w.s.shardOf(w.sr.Ref)]
+	if _, err := sh.StatBlob(w.ctx, w.sr.Ref); err == nil {
+		return nil
+	}
+	bw, err := sh.BeginBlob(w.ctx)
+	if err != nil {
+		return err
+	}
+	defer bw.Close()
+	if _, err = io.Copy(bw, w.f); err != nil {
+		return err
+	}
+	sr, err := bw.Complete()
+	if err != nil {
+		return err
+	} else if sr != w.sr {
+		return ErrRefMissmatch{Exp: w.sr.Ref, Got: sr.Ref}
+	}
+	return bw.Commit()
+}
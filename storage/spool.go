@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/dennwc/cas/types"
+)
+
+// SpoolFunc stores a blob spooled by Spool. The file is positioned at the start of the content,
+// and it's removed after the call.
+type SpoolFunc func(sr types.SizedRef, f *os.File) error
+
+// Spool returns a blob writer that saves the content to a local temporary file with a given name prefix,
+// and stores it with the function on Commit. It's intended for remote storages that must know the ref or
+// the size of the blob before it's sent. The file is removed when the writer is committed or closed.
+//
+// If tee is not nil, the content is written to it as well, for example, to calculate checksums required
+// by the storage.
+func Spool(prefix string, tee io.Writer, commit SpoolFunc) (BlobWriter, error) {
+	f, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &spoolWriter{f: f, hw: Hash(), tee: tee, commit: commit}, nil
+}
+
+type spoolWriter struct {
+	f      *os.File
+	hw     BlobWriter
+	tee    io.Writer
+	commit SpoolFunc
+}
+
+func (w *spoolWriter) Size() uint64 {
+	return w.hw.Size()
+}
+
+func (w *spoolWriter) Write(p []byte) (int, error) {
+	if _, err := w.hw.Write(p); err != nil {
+		return 0, err
+	}
+	if w.f == nil {
+		return 0, ErrBlobDiscarded
+	}
+	n, err := w.f.Write(p)
+	if w.tee != nil && n != 0 {
+		if _, werr := w.tee.Write(p[:n]); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (w *spoolWriter) Complete() (types.SizedRef, error) {
+	return w.hw.Complete()
+}
+
+func (w *spoolWriter) discard() {
+	if w.f != nil {
+		w.f.Close()
+		os.Remove(w.f.Name())
+		w.f = nil
+	}
+}
+
+// Close removes the file. It's done before closing the hash writer, since it fails for completed blobs.
+func (w *spoolWriter) Close() error {
+	w.discard()
+	return w.hw.Close()
+}
+
+func (w *spoolWriter) Commit() error {
+	if err := w.hw.Commit(); err != nil {
+		return err
+	}
+	if w.f == nil {
+		return ErrBlobDiscarded
+	}
+	defer w.discard()
+	sr, err := w.hw.Complete()
+	if err != nil {
+		return err
+	}
+	if _, err = w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.commit(sr, w.f)
+}
@@ -0,0 +1,819 @@
+// Package sqlite implements a CAS storage in a single SQLite database file.
+//
+// Blobs, pins, the history of pins and the index of schema blobs are stored in one file, which makes the storage
+// easy to embed into desktop applications that cannot manage a directory tree. The database is opened in WAL mode,
+// thus readers are not blocked by the writer.
+//
+// Blobs are stored as rows. Large blobs can optionally be stored as overflow files in a separate directory,
+// since SQLite reads and writes each row as a whole.
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+var (
+	_ storage.Storage        = (*Storage)(nil)
+	_ storage.BlobIndexer    = (*Storage)(nil)
+	_ storage.BlobDeleter    = (*Storage)(nil)
+	_ storage.PrefixIterator = (*Storage)(nil)
+	_ storage.StatsCounter   = (*Storage)(nil)
+	_ storage.PinSwapper     = (*Storage)(nil)
+	_ storage.PinHistorian   = (*Storage)(nil)
+	_ storage.PinMetaStorage = (*Storage)(nil)
+	_ storage.BulkStater     = (*Storage)(nil)
+
+	_ storage.PinHistoryAppender = (*Storage)(nil)
+)
+
+// DefaultMaxInline is the default size limit of blobs stored in the database, if overflow files are enabled.
+const DefaultMaxInline = 1 << 20
+
+const dbSchema = `
+CREATE TABLE IF NOT EXISTS blobs (
+	ref  TEXT PRIMARY KEY,
+	size INTEGER NOT NULL,
+	type TEXT, -- type of schema blobs; NULL for data blobs
+	data BLOB  -- NULL if the content is stored in an overflow file
+);
+CREATE INDEX IF NOT EXISTS blobs_type ON blobs(type) WHERE type IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS pins (
+	name TEXT PRIMARY KEY,
+	ref  TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS pin_history (
+	id   INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	ref  TEXT,             -- NULL if the pin was removed
+	time INTEGER NOT NULL  -- Unix time in nanoseconds
+);
+CREATE INDEX IF NOT EXISTS pin_history_name ON pin_history(name, id);
+
+CREATE TABLE IF NOT EXISTS pin_meta (
+	name TEXT PRIMARY KEY,
+	meta TEXT NOT NULL -- JSON
+);
+CREATE TRIGGER IF NOT EXISTS pins_delete_meta AFTER DELETE ON pins BEGIN
+	DELETE FROM pin_meta WHERE name = old.name;
+END;
+`
+
+func init() {
+	storage.RegisterConfig("cas:SQLiteConfig", &Config{})
+}
+
+type Config struct {
+	// Path is the path of the database file.
+	Path string `json:"path"`
+	// Overflow is a directory for blobs larger than MaxInline. If not set, all blobs are stored in the database.
+	Overflow string `json:"overflow,omitempty"`
+	// MaxInline is the size limit of blobs stored in the database. DefaultMaxInline is used if not set.
+	MaxInline uint64 `json:"max_inline,omitempty"`
+}
+
+func (c *Config) References() []types.Ref {
+	return nil
+}
+
+func (c *Config) OpenStorage(ctx context.Context) (storage.Storage, error) {
+	return New(ctx, c.Path, &Options{Overflow: c.Overflow, MaxInline: c.MaxInline})
+}
+
+// Options for the SQLite storage. See Config for details.
+type Options struct {
+	Overflow  string
+	MaxInline uint64
+}
+
+// New opens or creates a storage in a given database file.
+func New(ctx context.Context, path string, opts *Options) (*Storage, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	s := &Storage{overflow: opts.Overflow, maxInline: opts.MaxInline}
+	if s.maxInline == 0 {
+		s.maxInline = DefaultMaxInline
+	}
+	if s.overflow != "" {
+		if err := os.MkdirAll(s.overflow, 0755); err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.ExecContext(ctx, dbSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.db = db
+	return s, nil
+}
+
+// Storage is a CAS storage in a single SQLite database. See package description for details.
+type Storage struct {
+	db        *sql.DB
+	overflow  string
+	maxInline uint64
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+func (s *Storage) overflowPath(ref types.Ref) string {
+	return filepath.Join(s.overflow, ref.String())
+}
+
+func (s *Storage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	if ref.Zero() {
+		return 0, storage.ErrInvalidRef
+	}
+	var size uint64
+	err := s.db.QueryRowContext(ctx, `SELECT size FROM blobs WHERE ref = ?`, ref.String()).Scan(&size)
+	if err == sql.ErrNoRows {
+		return 0, storage.ErrNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// maxQueryVars is the maximal number of parameters in a single query. SQLite limits it to 999 by default.
+const maxQueryVars = 500
+
+// StatBlobs implements storage.BulkStater. Blobs are checked with a single query for each batch of refs.
+func (s *Storage) StatBlobs(ctx context.Context, refs []types.Ref) ([]types.SizedRef, error) {
+	sizes := make(map[types.Ref]uint64, len(refs))
+	for i := 0; i < len(refs); i += maxQueryVars {
+		batch := refs[i:]
+		if len(batch) > maxQueryVars {
+			batch = batch[:maxQueryVars]
+		}
+		if err := s.statBatch(ctx, batch, sizes); err != nil {
+			return nil, err
+		}
+	}
+	out := make([]types.SizedRef, 0, len(sizes))
+	for _, ref := range refs {
+		if sz, ok := sizes[ref]; ok {
+			out = append(out, types.SizedRef{Ref: ref, Size: sz})
+		}
+	}
+	return out, nil
+}
+
+func (s *Storage) statBatch(ctx context.Context, refs []types.Ref, sizes map[types.Ref]uint64) error {
+	args := make([]interface{}, 0, len(refs))
+	for _, ref := range refs {
+		if ref.Zero() {
+			return storage.ErrInvalidRef
+		}
+		args = append(args, ref.String())
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT ref, size FROM blobs WHERE ref IN (?`+strings.Repeat(`, ?`, len(refs)-1)+`)`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			sref string
+			size uint64
+		)
+		if err = rows.Scan(&sref, &size); err != nil {
+			return err
+		}
+		ref, err := types.ParseRef(sref)
+		if err != nil {
+			return err
+		}
+		sizes[ref] = size
+	}
+	return rows.Err()
+}
+
+func (s *Storage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	if ref.Zero() {
+		return nil, 0, storage.ErrInvalidRef
+	}
+	var (
+		size uint64
+		data []byte
+		ext  bool
+	)
+	err := s.db.QueryRowContext(ctx, `SELECT size, data, data IS NULL FROM blobs WHERE ref = ?`, ref.String()).
+		Scan(&size, &data, &ext)
+	if err == sql.ErrNoRows {
+		return nil, 0, storage.ErrNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if !ext {
+		return ioutil.NopCloser(bytes.NewReader(data)), size, nil
+	}
+	f, err := os.Open(s.overflowPath(ref))
+	if err != nil {
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+func (s *Storage) IterateBlobs(ctx context.Context) storage.Iterator {
+	rows, err := s.db.QueryContext(ctx, `SELECT ref, size FROM blobs ORDER BY ref`)
+	return &blobIterator{rowIterator: rowIterator{rows: rows, err: err}}
+}
+
+// IterateBlobsPrefix implements storage.PrefixIterator.
+func (s *Storage) IterateBlobsPrefix(ctx context.Context, prefix string) storage.Iterator {
+	if prefix == "" {
+		return s.IterateBlobs(ctx)
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT ref, size FROM blobs WHERE ref >= ? AND ref < ? ORDER BY ref`,
+		prefix, prefixEnd(prefix))
+	return &blobIterator{rowIterator: rowIterator{rows: rows, err: err}}
+}
+
+// prefixEnd returns the smallest string that is greater than all strings with a given prefix.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	// all strings are greater than the prefix
+	return string([]byte{0xff, 0xff, 0xff, 0xff})
+}
+
+func (s *Storage) DeleteBlob(ctx context.Context, ref types.Ref) error {
+	if ref.Zero() {
+		return storage.ErrInvalidRef
+	}
+	res, err := s.db.ExecContext(ctx, `DELETE FROM blobs WHERE ref = ?`, ref.String())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return storage.ErrNotFound
+	}
+	if s.overflow != "" {
+		err = os.Remove(s.overflowPath(ref))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	return err
+}
+
+// BeginBlob starts a new blob. Blobs are buffered in memory, unless they are larger than the inline size limit
+// and overflow files are enabled.
+func (s *Storage) BeginBlob(ctx context.Context) (storage.BlobWriter, error) {
+	return &blobWriter{s: s, ctx: ctx, hw: storage.Hash()}, nil
+}
+
+type blobWriter struct {
+	s   *Storage
+	ctx context.Context
+	hw  storage.BlobWriter
+	buf bytes.Buffer
+	f   *os.File // overflow file
+	sr  types.SizedRef
+}
+
+func (w *blobWriter) Size() uint64 {
+	return w.hw.Size()
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	if _, err := w.hw.Write(p); err != nil {
+		return 0, err
+	}
+	if w.f != nil {
+		return w.f.Write(p)
+	}
+	w.buf.Write(p)
+	if w.s.overflow == "" || uint64(w.buf.Len()) <= w.s.maxInline {
+		return len(p), nil
+	}
+	f, err := ioutil.TempFile(w.s.overflow, ".blob_")
+	if err != nil {
+		return 0, err
+	}
+	w.f = f
+	if _, err = w.buf.WriteTo(f); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *blobWriter) Complete() (types.SizedRef, error) {
+	sr, err := w.hw.Complete()
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	w.sr = sr
+	return sr, nil
+}
+
+func (w *blobWriter) discard() {
+	w.buf = bytes.Buffer{}
+	if w.f != nil {
+		w.f.Close()
+		os.Remove(w.f.Name())
+		w.f = nil
+	}
+}
+
+// Close discards the content before closing the hash writer, since it fails for completed blobs.
+func (w *blobWriter) Close() error {
+	w.discard()
+	return w.hw.Close()
+}
+
+// content returns a reader for the content of the blob.
+func (w *blobWriter) content() (io.Reader, error) {
+	if w.f == nil {
+		return bytes.NewReader(w.buf.Bytes()), nil
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return w.f, nil
+}
+
+// schemaType returns the type of the schema blob, or an empty string for data blobs.
+func (w *blobWriter) schemaType() (string, error) {
+	r, err := w.content()
+	if err != nil {
+		return "", err
+	}
+	head := make([]byte, schema.MagicSize)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && !schema.IsSchema(head[:n])) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	typ, err := schema.DecodeType(io.MultiReader(bytes.NewReader(head), r))
+	if err != nil {
+		// not a valid schema blob
+		return "", nil
+	}
+	return typ, nil
+}
+
+func (w *blobWriter) Commit() error {
+	if err := w.hw.Commit(); err != nil {
+		return err
+	}
+	defer w.discard()
+	if w.sr.Ref.Zero() {
+		if _, err := w.Complete(); err != nil {
+			return err
+		}
+	}
+	s := w.s
+	if _, err := s.StatBlob(w.ctx, w.sr.Ref); err == nil {
+		return nil
+	} else if err != storage.ErrNotFound {
+		return err
+	}
+	var typ sql.NullString
+	t, err := w.schemaType()
+	if err != nil {
+		return err
+	} else if t != "" {
+		typ = sql.NullString{String: t, Valid: true}
+	}
+	var data []byte
+	if w.f == nil {
+		data = w.buf.Bytes()
+		if data == nil {
+			// empty blob must not be stored as NULL
+			data = []byte{}
+		}
+	} else {
+		// content is placed first, thus a blob row always has the content
+		if err = w.f.Sync(); err != nil {
+			return err
+		}
+		if err = w.f.Close(); err != nil {
+			return err
+		}
+		name := w.f.Name()
+		w.f = nil
+		if err = os.Chmod(name, 0444); err == nil {
+			err = os.Rename(name, s.overflowPath(w.sr.Ref))
+		}
+		if err != nil {
+			os.Remove(name)
+			return err
+		}
+	}
+	_, err = s.db.ExecContext(w.ctx, `INSERT OR IGNORE INTO blobs (ref, size, type, data) VALUES (?, ?, ?, ?)`,
+		w.sr.Ref.String(), w.sr.Size, typ, data)
+	return err
+}
+
+func (s *Storage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	return s.updatePin(ctx, name, ref.String(), `INSERT OR REPLACE INTO pins (name, ref) VALUES (?, ?)`, name, ref.String())
+}
+
+func (s *Storage) DeletePin(ctx context.Context, name string) error {
+	return s.updatePin(ctx, name, nil, `DELETE FROM pins WHERE name = ?`, name)
+}
+
+// SetPinCAS implements storage.PinSwapper. The comparison is a part of the update query,
+// thus it's safe to use by multiple processes.
+func (s *Storage) SetPinCAS(ctx context.Context, name string, old, new types.Ref) error {
+	var err error
+	switch {
+	case old.Zero() && new.Zero():
+		_, err = s.GetPin(ctx, name)
+		if err == nil {
+			return storage.ErrPinConflict
+		} else if err == storage.ErrNotFound {
+			return nil
+		}
+		return err
+	case old.Zero():
+		err = s.updatePin(ctx, name, new.String(), `INSERT OR IGNORE INTO pins (name, ref) VALUES (?, ?)`, name, new.String())
+	case new.Zero():
+		err = s.updatePin(ctx, name, nil, `DELETE FROM pins WHERE name = ? AND ref = ?`, name, old.String())
+	default:
+		err = s.updatePin(ctx, name, new.String(), `UPDATE pins SET ref = ? WHERE name = ? AND ref = ?`, new.String(), name, old.String())
+	}
+	if err == storage.ErrNotFound {
+		err = storage.ErrPinConflict
+	}
+	return err
+}
+
+// updatePin changes the pin and records the change in the history in a single transaction.
+func (s *Storage) updatePin(ctx context.Context, name string, ref interface{}, query string, args ...interface{}) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return storage.ErrNotFound
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO pin_history (name, ref, time) VALUES (?, ?, ?)`,
+		name, ref, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetPinMeta implements storage.PinMetaStorage.
+func (s *Storage) SetPinMeta(ctx context.Context, name string, meta *types.PinMeta) error {
+	var data []byte
+	if meta != nil {
+		var err error
+		data, err = json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	if err = tx.QueryRowContext(ctx, `SELECT count(*) FROM pins WHERE name = ?`, name).Scan(&n); err != nil {
+		return err
+	} else if n == 0 {
+		return storage.ErrNotFound
+	}
+	if meta == nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM pin_meta WHERE name = ?`, name)
+	} else {
+		_, err = tx.ExecContext(ctx, `INSERT OR REPLACE INTO pin_meta (name, meta) VALUES (?, ?)`, name, string(data))
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetPinMeta implements storage.PinMetaStorage.
+func (s *Storage) GetPinMeta(ctx context.Context, name string) (*types.PinMeta, error) {
+	var data sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT m.meta FROM pins p LEFT JOIN pin_meta m ON m.name = p.name WHERE p.name = ?`, name).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, storage.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	} else if !data.Valid {
+		return nil, nil
+	}
+	var meta types.PinMeta
+	if err = json.Unmarshal([]byte(data.String), &meta); err != nil {
+		return nil, fmt.Errorf("invalid metadata of pin %q: %v", name, err)
+	}
+	return &meta, nil
+}
+
+// AppendPinHistory implements storage.PinHistoryAppender.
+func (s *Storage) AppendPinHistory(ctx context.Context, name string, recs []storage.PinRecord) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range recs {
+		var ref interface{}
+		if !r.Ref.Zero() {
+			ref = r.Ref.String()
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO pin_history (name, ref, time) VALUES (?, ?, ?)`,
+			name, ref, r.Time.UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PinHistory implements storage.PinHistorian.
+func (s *Storage) PinHistory(ctx context.Context, name string) ([]storage.PinRecord, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT ref, time FROM pin_history WHERE name = ? ORDER BY id`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var recs []storage.PinRecord
+	for rows.Next() {
+		var (
+			ref sql.NullString
+			ns  int64
+		)
+		if err = rows.Scan(&ref, &ns); err != nil {
+			return nil, err
+		}
+		rec := storage.PinRecord{Time: time.Unix(0, ns)}
+		if ref.Valid {
+			rec.Ref, err = types.ParseRef(ref.String)
+			if err != nil {
+				return nil, err
+			}
+		}
+		recs = append(recs, rec)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	} else if len(recs) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	return recs, nil
+}
+
+func (s *Storage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	var ref string
+	err := s.db.QueryRowContext(ctx, `SELECT ref FROM pins WHERE name = ?`, name).Scan(&ref)
+	if err == sql.ErrNoRows {
+		return types.Ref{}, storage.ErrNotFound
+	} else if err != nil {
+		return types.Ref{}, err
+	}
+	return types.ParseRef(ref)
+}
+
+func (s *Storage) IteratePins(ctx context.Context) storage.PinIterator {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, ref FROM pins ORDER BY name`)
+	return &pinIterator{rowIterator: rowIterator{rows: rows, err: err}}
+}
+
+// FetchSchema implements storage.BlobIndexer.
+func (s *Storage) FetchSchema(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	if ref.Zero() {
+		return nil, 0, storage.ErrInvalidRef
+	}
+	var typ sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT type FROM blobs WHERE ref = ?`, ref.String()).Scan(&typ)
+	if err == sql.ErrNoRows {
+		return nil, 0, storage.ErrNotFound
+	} else if err != nil {
+		return nil, 0, err
+	} else if !typ.Valid {
+		return nil, 0, schema.ErrNotSchema
+	}
+	return s.FetchBlob(ctx, ref)
+}
+
+// IterateSchema implements storage.BlobIndexer.
+func (s *Storage) IterateSchema(ctx context.Context, typs ...string) storage.SchemaIterator {
+	query := `SELECT ref, size, type FROM blobs WHERE type IS NOT NULL`
+	var args []interface{}
+	if len(typs) != 0 {
+		query += ` AND type IN (?` + strings.Repeat(`, ?`, len(typs)-1) + `)`
+		for _, typ := range typs {
+			args = append(args, typ)
+		}
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY ref`, args...)
+	return &schemaIterator{s: s, ctx: ctx, rowIterator: rowIterator{rows: rows, err: err}}
+}
+
+// ReindexSchema implements storage.BlobIndexer. Types of schema blobs are recorded when blobs are stored,
+// thus the index is only rebuilt if force is set.
+func (s *Storage) ReindexSchema(ctx context.Context, force bool) error {
+	if !force {
+		return nil
+	}
+	it := s.IterateBlobs(ctx)
+	defer it.Close()
+	var refs []types.Ref
+	for it.Next() {
+		refs = append(refs, it.SizedRef().Ref)
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	it.Close()
+	for _, ref := range refs {
+		rc, _, err := s.FetchBlob(ctx, ref)
+		if err != nil {
+			return err
+		}
+		var typ sql.NullString
+		t, err := schema.DecodeType(rc)
+		rc.Close()
+		if err == nil {
+			typ = sql.NullString{String: t, Valid: true}
+		}
+		_, err = s.db.ExecContext(ctx, `UPDATE blobs SET type = ? WHERE ref = ?`, typ, ref.String())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats implements storage.StatsCounter.
+func (s *Storage) Stats(ctx context.Context) (*storage.Stats, error) {
+	st := &storage.Stats{Schema: make(map[string]uint64)}
+	err := s.db.QueryRowContext(ctx, `SELECT count(*), coalesce(sum(size), 0) FROM blobs`).Scan(&st.Blobs, &st.Size)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT type, count(*) FROM blobs WHERE type IS NOT NULL GROUP BY type`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			typ string
+			n   uint64
+		)
+		if err = rows.Scan(&typ, &n); err != nil {
+			return nil, err
+		}
+		st.Schema[typ] = n
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	err = s.db.QueryRowContext(ctx, `SELECT count(*) FROM pins`).Scan(&st.Pins)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// rowIterator is a base for iterators over query results.
+type rowIterator struct {
+	rows *sql.Rows
+	err  error
+}
+
+func (it *rowIterator) next(dst ...interface{}) bool {
+	if it.err != nil || it.rows == nil {
+		return false
+	}
+	if !it.rows.Next() {
+		it.err = it.rows.Err()
+		it.rows.Close()
+		it.rows = nil
+		return false
+	}
+	if it.err = it.rows.Scan(dst...); it.err != nil {
+		return false
+	}
+	return true
+}
+
+func (it *rowIterator) Err() error {
+	return it.err
+}
+
+func (it *rowIterator) Close() error {
+	if it.rows == nil {
+		return nil
+	}
+	err := it.rows.Close()
+	it.rows = nil
+	return err
+}
+
+type blobIterator struct {
+	rowIterator
+	cur types.SizedRef
+}
+
+func (it *blobIterator) Next() bool {
+	var ref string
+	if !it.next(&ref, &it.cur.Size) {
+		return false
+	}
+	it.cur.Ref, it.err = types.ParseRef(ref)
+	return it.err == nil
+}
+
+func (it *blobIterator) SizedRef() types.SizedRef {
+	return it.cur
+}
+
+type schemaIterator struct {
+	rowIterator
+	s   *Storage
+	ctx context.Context
+	cur types.SchemaRef
+}
+
+func (it *schemaIterator) Next() bool {
+	var ref string
+	if !it.next(&ref, &it.cur.Size, &it.cur.Type) {
+		return false
+	}
+	it.cur.Ref, it.err = types.ParseRef(ref)
+	return it.err == nil
+}
+
+func (it *schemaIterator) SizedRef() types.SizedRef {
+	return it.cur.SizedRef()
+}
+
+func (it *schemaIterator) SchemaRef() types.SchemaRef {
+	return it.cur
+}
+
+func (it *schemaIterator) Decode() (schema.Object, error) {
+	rc, _, err := it.s.FetchBlob(it.ctx, it.cur.Ref)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return schema.Decode(rc)
+}
+
+type pinIterator struct {
+	rowIterator
+	cur types.Pin
+}
+
+func (it *pinIterator) Next() bool {
+	var ref string
+	if !it.next(&it.cur.Name, &ref) {
+		return false
+	}
+	it.cur.Ref, it.err = types.ParseRef(ref)
+	return it.err == nil
+}
+
+func (it *pinIterator) Pin() types.Pin {
+	return it.cur
+}
@@ -0,0 +1,143 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/test"
+	"github.com/dennwc/cas/types"
+)
+
+func TestSQLite(t *testing.T) {
+	storagetest.RunTests(t, func(t testing.TB) (storage.Storage, func()) {
+		dir, err := ioutil.TempDir("", "cas_sqlite_")
+		require.NoError(t, err)
+		s, err := New(context.Background(), filepath.Join(dir, "cas.db"), nil)
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+		require.NoError(t, err)
+		return s, func() {
+			s.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func TestSQLiteOverflow(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_sqlite_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cas.db")
+	overflow := filepath.Join(dir, "blobs")
+	s, err := New(ctx, path, &Options{Overflow: overflow, MaxInline: 16})
+	require.NoError(t, err)
+
+	small, err := storage.WriteBytes(ctx, s, []byte("small"))
+	require.NoError(t, err)
+	large, err := storage.WriteBytes(ctx, s, bytes.Repeat([]byte("large"), 10))
+	require.NoError(t, err)
+	buf := new(bytes.Buffer)
+	require.NoError(t, schema.Encode(buf, &schema.Multipart{Parts: []types.SizedRef{small, large}}))
+	multi, err := storage.WriteBytes(ctx, s, buf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, s.SetPin(ctx, "root", multi.Ref))
+	require.NoError(t, s.Close())
+
+	// only large blobs are stored as files
+	names, err := ioutil.ReadDir(overflow)
+	require.NoError(t, err)
+	require.Len(t, names, 2)
+
+	s, err = New(ctx, path, &Options{Overflow: overflow, MaxInline: 16})
+	require.NoError(t, err)
+	defer s.Close()
+
+	var mode string
+	require.NoError(t, s.db.QueryRow(`PRAGMA journal_mode`).Scan(&mode))
+	require.Equal(t, "wal", mode)
+
+	for _, sr := range []types.SizedRef{small, large, multi} {
+		rc, sz, err := s.FetchBlob(ctx, sr.Ref)
+		require.NoError(t, err)
+		require.Equal(t, sr.Size, sz)
+		got, err := types.Hash(rc)
+		rc.Close()
+		require.NoError(t, err)
+		require.Equal(t, sr, got)
+	}
+	ref, err := s.GetPin(ctx, "root")
+	require.NoError(t, err)
+	require.Equal(t, multi.Ref, ref)
+
+	it := s.IterateSchema(ctx)
+	defer it.Close()
+	require.True(t, it.Next())
+	require.Equal(t, types.SchemaRef{Ref: multi.Ref, Size: multi.Size, Type: schema.MustTypeOf(&schema.Multipart{})}, it.SchemaRef())
+	obj, err := it.Decode()
+	require.NoError(t, err)
+	require.Equal(t, []types.SizedRef{small, large}, obj.(*schema.Multipart).Parts)
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+
+	st, err := s.Stats(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), st.Blobs)
+	require.Equal(t, small.Size+large.Size+multi.Size, st.Size)
+	require.Equal(t, uint64(1), st.SchemaBlobs())
+	require.Equal(t, uint64(1), st.Pins)
+
+	require.NoError(t, s.DeleteBlob(ctx, large.Ref))
+	_, err = os.Stat(filepath.Join(overflow, large.Ref.String()))
+	require.True(t, os.IsNotExist(err))
+
+	// overflow files of rejected blobs are removed
+	_, err = storage.StreamBlob(ctx, s, bytes.NewReader(bytes.Repeat([]byte("other"), 10)), large.Ref)
+	require.IsType(t, storage.ErrRefMissmatch{}, err)
+	names, err = ioutil.ReadDir(overflow)
+	require.NoError(t, err)
+	require.Len(t, names, 1)
+
+	// changes of pins are recorded
+	require.NoError(t, s.DeletePin(ctx, "root"))
+	require.Equal(t, storage.ErrNotFound, s.DeletePin(ctx, "root"))
+	var n int
+	require.NoError(t, s.db.QueryRow(`SELECT count(*) FROM pin_history WHERE name = ?`, "root").Scan(&n))
+	require.Equal(t, 2, n)
+}
+
+func TestSQLiteStream(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_sqlite_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := New(ctx, filepath.Join(dir, "cas.db"), nil)
+	require.NoError(t, err)
+	defer s.Close()
+
+	data := []byte("streamed")
+	exp := types.BytesRef(data)
+
+	_, err = storage.StreamBlob(ctx, s, bytes.NewReader(data), types.StringRef("other"))
+	require.Equal(t, storage.ErrRefMissmatch{Exp: types.StringRef("other"), Got: exp}, err)
+	_, err = s.StatBlob(ctx, exp)
+	require.Equal(t, storage.ErrNotFound, err)
+
+	sr, err := storage.StreamBlob(ctx, s, bytes.NewReader(data), exp)
+	require.NoError(t, err)
+	require.Equal(t, types.SizedRef{Ref: exp, Size: uint64(len(data))}, sr)
+	sz, err := s.StatBlob(ctx, exp)
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), sz)
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+)
+
+// Stats is a summary of the content of the storage.
+type Stats struct {
+	Blobs  uint64            // number of blobs
+	Size   uint64            // total size of all blobs in bytes
+	Schema map[string]uint64 // number of schema blobs by type
+	Pins   uint64            // number of pins
+	Limit  uint64            // maximal total size of blobs; zero if the size is not limited
+}
+
+// Headroom returns the number of bytes that can be stored until the size limit is reached.
+// It returns false if the size is not limited.
+func (st *Stats) Headroom() (uint64, bool) {
+	if st.Limit == 0 {
+		return 0, false
+	} else if st.Size >= st.Limit {
+		return 0, true
+	}
+	return st.Limit - st.Size, true
+}
+
+// SchemaBlobs returns the total number of schema blobs.
+func (st *Stats) SchemaBlobs() uint64 {
+	var n uint64
+	for _, v := range st.Schema {
+		n += v
+	}
+	return n
+}
+
+// StatsCounter is an optional interface for Storage implementations that can report stats
+// without listing all blobs.
+type StatsCounter interface {
+	// Stats returns a summary of the content of the storage.
+	Stats(ctx context.Context) (*Stats, error)
+}
+
+// GetStats returns the stats of the storage. If the storage doesn't implement StatsCounter,
+// or returns ErrNotSupported, stats are collected with ScanStats.
+func GetStats(ctx context.Context, s Storage) (*Stats, error) {
+	if sc, ok := s.(StatsCounter); ok {
+		st, err := sc.Stats(ctx)
+		if err != ErrNotSupported {
+			return st, err
+		}
+	}
+	return ScanStats(ctx, s)
+}
+
+// ScanStats collects stats by iterating over all blobs, schema blobs and pins in the storage.
+func ScanStats(ctx context.Context, s Storage) (*Stats, error) {
+	st := &Stats{Schema: make(map[string]uint64)}
+
+	it := s.IterateBlobs(ctx)
+	defer it.Close()
+	for it.Next() {
+		st.Blobs++
+		st.Size += it.SizedRef().Size
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	it.Close()
+
+	sit := NewBlobIndexer(s).IterateSchema(ctx)
+	defer sit.Close()
+	for sit.Next() {
+		st.Schema[sit.SchemaRef().Type]++
+	}
+	if err := sit.Err(); err != nil {
+		return nil, err
+	}
+	sit.Close()
+
+	pit := s.IteratePins(ctx)
+	defer pit.Close()
+	for pit.Next() {
+		st.Pins++
+	}
+	if err := pit.Err(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
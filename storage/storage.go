@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/dennwc/cas/schema"
 
@@ -22,6 +23,12 @@ var (
 	ErrBlobDiscarded = errors.New("blob was discarded")
 	// ErrBlobCompleted is returned for BlobWriter operations after the blob was completed.
 	ErrBlobCompleted = errors.New("blob was completed")
+	// ErrNotSupported is returned when an optional operation is not supported or configured for the storage.
+	ErrNotSupported = errors.New("blob: operation is not supported")
+	// ErrStoreFull is returned when storing a blob would exceed the size limit of the storage.
+	ErrStoreFull = errors.New("blob: storage is full")
+	// ErrPinConflict is returned when a pin was changed concurrently. See PinSwapper.
+	ErrPinConflict = errors.New("pin: conflicting update")
 )
 
 // ErrRefMissmatch is returned when the streamed content doesn't match an expected blob ref.
@@ -42,6 +49,17 @@ func (e ErrSizeMissmatch) Error() string {
 	return fmt.Sprintf("size missmatch: exp: %v, got: %v", e.Exp, e.Got)
 }
 
+// ErrPinCorrupted is returned when a pin exists, but doesn't contain a valid ref.
+// For example, the pin might have been truncated by a crash.
+type ErrPinCorrupted struct {
+	Name string
+	Err  error
+}
+
+func (e ErrPinCorrupted) Error() string {
+	return fmt.Sprintf("pin %q is corrupted: %v", e.Name, e.Err)
+}
+
 // BlobSource is a read-only interface for a blob storage.
 type BlobSource interface {
 	// StatBlob checks if a blob is in the storage and returns its size.
@@ -60,19 +78,74 @@ type BlobSource interface {
 	IterateBlobs(ctx context.Context) Iterator
 }
 
-// BlobStorage is a minimal interface for storing and retrieving blobs.
-type BlobStorage interface {
-	BlobSource
+// BlobSink is a write-only interface for a blob storage.
+type BlobSink interface {
 	// BeginBlob starts writing a blob to the storage.
+	// The content is buffered by the implementation until the blob is committed, for example in temporary files.
+	// Callers that have the content as a reader should use StreamBlob instead.
 	// See BlobWriter for more details.
 	BeginBlob(ctx context.Context) (BlobWriter, error)
 }
 
-// BlobIndexer is an optional interface for Storage implementations that index schema blobs by type.
-type BlobIndexer interface {
+// BlobStorage is a minimal interface for storing and retrieving blobs.
+type BlobStorage interface {
+	BlobSource
+	BlobSink
+}
+
+// BlobStreamer is an optional interface for Storage implementations that can store a blob directly from a reader.
+// It allows backends to write the content to the final location in a single step, without buffering it in
+// temporary files for BeginBlob. Backends that would buffer the whole blob anyway should not implement it.
+// See StreamBlob.
+type BlobStreamer interface {
+	// StreamBlob stores the content of the reader as a blob. If the expected ref is set, the blob is only stored
+	// if its content matches the ref, and ErrRefMissmatch is returned otherwise.
+	StreamBlob(ctx context.Context, r io.Reader, exp types.Ref) (types.SizedRef, error)
+}
+
+// FileImporter is an optional interface for Storage implementations that can store local files more efficiently
+// than by reading them, for example by cloning or hard linking the file.
+type FileImporter interface {
+	// ImportFile stores a local file in the storage.
+	ImportFile(ctx context.Context, path string) (types.SizedRef, error)
+}
+
+// BlobDeleter is an optional interface for Storage implementations that support blob deletion.
+type BlobDeleter interface {
+	// DeleteBlob removes a blob from the storage.
+	// It returns ErrNotFound if this blob does not exist.
+	// Calling it with a zero Ref will result in ErrInvalidRef.
+	DeleteBlob(ctx context.Context, ref types.Ref) error
+}
+
+// BlobSigner is an optional interface for Storage implementations that can generate short-lived URLs
+// for fetching blobs directly from the backend.
+type BlobSigner interface {
+	// SignBlobURL returns a URL that allows anyone to fetch a blob during a given time interval.
+	// It doesn't check if the blob exists. It returns ErrNotSupported if URL signing is not configured.
+	SignBlobURL(ctx context.Context, ref types.Ref, ttl time.Duration) (string, error)
+}
+
+// BlobResumer is an optional interface for Storage implementations that support resumable blob writes.
+// Partial blobs persist across process restarts until they are either committed or discarded.
+type BlobResumer interface {
+	// BeginResumableBlob is like BeginBlob, but the returned writer can be suspended and resumed later.
+	BeginResumableBlob(ctx context.Context) (ResumableWriter, error)
+	// ResumeBlob continues writing a partial blob identified by a token. Size of the returned writer reports
+	// the offset the content should be written from. It returns ErrNotFound if the partial blob does not exist.
+	ResumeBlob(ctx context.Context, token string) (ResumableWriter, error)
+}
+
+// SchemaSource is a read-only interface for storages that can tell schema blobs apart from raw data.
+type SchemaSource interface {
 	// FetchSchema fetches a schema blob from storage.
 	// It returns a schema.ErrNotSchema if a blob contains raw data or is not a CAS schema blob.
 	FetchSchema(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error)
+}
+
+// BlobIndexer is an optional interface for Storage implementations that index schema blobs by type.
+type BlobIndexer interface {
+	SchemaSource
 	// IterateSchema lists all schema blobs, optionally only with specific types.
 	IterateSchema(ctx context.Context, typs ...string) SchemaIterator
 	// ReindexSchema rebuilds an index of schema blobs.
@@ -81,6 +154,17 @@ type BlobIndexer interface {
 	ReindexSchema(ctx context.Context, force bool) error
 }
 
+// RefIndexer is an optional interface for Storage implementations that maintain a reverse index of references
+// between blobs. The index must account for all schema blobs in the storage, including the ones that were not
+// indexed by type yet.
+type RefIndexer interface {
+	// Referrers lists schema blobs that reference a given blob directly.
+	// The blob itself is not required to exist in the storage.
+	Referrers(ctx context.Context, ref types.Ref) ([]types.Ref, error)
+	// RefCount returns the number of schema blobs that reference a given blob directly.
+	RefCount(ctx context.Context, ref types.Ref) (int, error)
+}
+
 // SchemaIterator iterates over CAS schema blobs.
 type SchemaIterator interface {
 	Iterator
@@ -114,12 +198,19 @@ type BlobWriter interface {
 	Commit() error
 }
 
-// PinStorage is a minimal interface for implementing a mutable storage over immutable storage.
-type PinStorage interface {
-	// SetPin overwrites or creates a named pin with a specified blob ref.
-	SetPin(ctx context.Context, name string, ref types.Ref) error
-	// DeletePin removes a named pin.
-	DeletePin(ctx context.Context, name string) error
+// ResumableWriter is a BlobWriter that can be suspended and continued later, possibly by a different process.
+//
+// Close discards the partial blob, as usual. Suspend should be used instead to keep it.
+type ResumableWriter interface {
+	BlobWriter
+	// Token returns a token that identifies the partial blob. See BlobResumer.ResumeBlob.
+	Token() string
+	// Suspend saves the state of the writer and closes it, preserving the partial blob in the storage.
+	Suspend() error
+}
+
+// PinSource is a read-only interface for pins.
+type PinSource interface {
 	// GetPin returns a ref associated with a named pin.
 	// It returns ErrNotFound if a named pin does not exist.
 	GetPin(ctx context.Context, name string) (types.Ref, error)
@@ -127,10 +218,89 @@ type PinStorage interface {
 	IteratePins(ctx context.Context) PinIterator
 }
 
+// PinStore is a minimal interface for implementing a mutable storage over immutable storage.
+type PinStore interface {
+	PinSource
+	// SetPin overwrites or creates a named pin with a specified blob ref.
+	SetPin(ctx context.Context, name string, ref types.Ref) error
+	// DeletePin removes a named pin.
+	DeletePin(ctx context.Context, name string) error
+}
+
+// PinStorage is the same as PinStore. It's kept for compatibility.
+type PinStorage = PinStore
+
+// PinSwapper is an optional interface for Storage implementations that can update pins atomically.
+// It allows concurrent writers to update a shared pin safely.
+type PinSwapper interface {
+	// SetPinCAS sets a named pin to a new ref only if it currently points to the old ref.
+	// A zero old ref means that the pin must not exist, and a zero new ref removes the pin.
+	// It returns ErrPinConflict if the current value of the pin is different.
+	SetPinCAS(ctx context.Context, name string, old, new types.Ref) error
+}
+
+// PinMetaStorage is an optional interface for Storage implementations that can store metadata of pins.
+// Metadata is removed together with the pin.
+type PinMetaStorage interface {
+	// SetPinMeta replaces the metadata of an existing pin. Nil metadata removes it.
+	// It returns ErrNotFound if the pin does not exist.
+	SetPinMeta(ctx context.Context, name string, meta *types.PinMeta) error
+	// GetPinMeta returns the metadata of a pin, or nil if the pin has no metadata.
+	// It returns ErrNotFound if the pin does not exist.
+	GetPinMeta(ctx context.Context, name string) (*types.PinMeta, error)
+}
+
+// PinExpired checks if the metadata of a pin sets an expiration time that has passed.
+// It returns false if the storage doesn't support metadata of pins, or if the pin doesn't exist.
+func PinExpired(ctx context.Context, s PinSource, name string, now time.Time) (bool, error) {
+	ms, ok := s.(PinMetaStorage)
+	if !ok {
+		return false, nil
+	}
+	meta, err := ms.GetPinMeta(ctx, name)
+	if err == ErrNotFound || err == ErrNotSupported {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return meta.Expired(now), nil
+}
+
+// PinRecord is a single change in the history of a pin.
+type PinRecord struct {
+	Ref  types.Ref // zero if the pin was deleted
+	Time time.Time
+}
+
+// PinHistorian is an optional interface for Storage implementations that keep an append-only history of pins.
+// See RollbackPin.
+type PinHistorian interface {
+	// PinHistory returns all values of a named pin, from the oldest to the most recent one.
+	// The last record is the current value. It returns ErrNotFound if the pin has no history.
+	PinHistory(ctx context.Context, name string) ([]PinRecord, error)
+}
+
+// PinHistoryAppender is an optional interface for Storage implementations that allow importing the history of pins,
+// for example, from an export of another storage. See PinHistorian.
+type PinHistoryAppender interface {
+	// AppendPinHistory appends records to the history of a named pin, without changing the value of the pin.
+	// The caller is expected to set the pin to the value of the last record afterwards.
+	AppendPinHistory(ctx context.Context, name string, recs []PinRecord) error
+}
+
+// Source is a read-only interface for a Content Addressable Storage, for example a mirror.
+// See Combine for using it as a Storage.
+type Source interface {
+	BlobSource
+	PinSource
+	Close() error
+}
+
 // Storage is a minimal interface for a Content Addressable Storage.
+// Partial implementations can be turned into a Storage with Combine.
 type Storage interface {
 	BlobStorage
-	PinStorage
+	PinStore
 	Close() error
 }
 
@@ -0,0 +1,728 @@
+// Package tape implements a CAS storage for sequential media, such as LTO tapes formatted with LTFS.
+//
+// Blobs are appended to tar volumes in a directory on the medium. Volumes are never modified once written:
+//
+//	<dir>/000001.tar
+//	<dir>/000002.tar
+//
+// Each blob is stored as a tar entry named by its ref. Pins are stored as entries named "pin/<name>" with
+// the ref as the content, and an empty entry removes the pin; later entries override earlier ones.
+// A new volume is started each time the storage is opened for writing, or when the current volume reaches
+// the size limit. Since volumes are plain tar files, the data can be read without CAS.
+//
+// Positions of blobs are kept in memory and saved to a separate index file, usually on a local disk, when
+// the storage is closed. If the index is missing or doesn't match the volumes, it's rebuilt by scanning
+// the medium. Volumes that were not closed properly are scanned up to the last complete entry.
+package tape
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+var (
+	_ storage.Storage    = (*Storage)(nil)
+	_ storage.PinSwapper = (*Storage)(nil)
+)
+
+const (
+	volumeExt = ".tar"
+	pinPrefix = "pin/"
+
+	// DefaultVolumeSize is the default size limit of a single volume.
+	DefaultVolumeSize = 64 << 30
+)
+
+func init() {
+	storage.RegisterConfig("cas:TapeConfig", &Config{})
+}
+
+type Config struct {
+	// Dir is the directory on the medium.
+	Dir string `json:"dir"`
+	// Index is the path of the index file. If not set, the index is rebuilt each time the storage is opened.
+	Index string `json:"index,omitempty"`
+	// VolumeSize is the size limit of a single volume. DefaultVolumeSize is used if not set.
+	VolumeSize uint64 `json:"volume_size,omitempty"`
+	// ReadOnly opens the storage in read-only mode.
+	ReadOnly bool `json:"readonly,omitempty"`
+}
+
+func (c *Config) References() []types.Ref {
+	return nil
+}
+
+func (c *Config) OpenStorage(ctx context.Context) (storage.Storage, error) {
+	return New(ctx, c.Dir, &Options{Index: c.Index, VolumeSize: c.VolumeSize, ReadOnly: c.ReadOnly})
+}
+
+// Options for the tape storage. See Config for details.
+type Options struct {
+	Index      string
+	VolumeSize uint64
+	ReadOnly   bool
+}
+
+// New opens a storage in a given directory on the medium. The index is loaded from the index file,
+// or rebuilt by scanning all volumes.
+func New(ctx context.Context, dir string, opts *Options) (*Storage, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	s := &Storage{
+		dir:      dir,
+		index:    opts.Index,
+		volSize:  opts.VolumeSize,
+		readOnly: opts.ReadOnly,
+	}
+	if s.volSize == 0 {
+		s.volSize = DefaultVolumeSize
+	}
+	if !s.readOnly {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	vols, err := s.listVolumes()
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := s.loadIndex(vols); err != nil {
+		return nil, err
+	} else if !ok {
+		if err = s.rebuild(ctx, vols); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// entry is a position of the blob on the medium.
+type entry struct {
+	vol  int   // volume number
+	off  int64 // offset of the content in the volume
+	size uint64
+}
+
+// volumeInfo is a volume on the medium.
+type volumeInfo struct {
+	num  int
+	size int64
+}
+
+// Storage is a CAS storage for sequential media. See package description for details.
+type Storage struct {
+	dir      string
+	index    string
+	volSize  uint64
+	readOnly bool
+
+	mu    sync.RWMutex
+	blobs map[types.Ref]entry
+	pins  map[string]types.Ref
+	vols  []volumeInfo // volumes on the medium; the size of the current one is set when it is closed
+	cur   *volumeWriter
+}
+
+func (s *Storage) volumePath(num int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%06d", num)+volumeExt)
+}
+
+// listVolumes lists all volumes on the medium, sorted by the number.
+func (s *Storage) listVolumes() ([]volumeInfo, error) {
+	d, err := os.Open(s.dir)
+	if os.IsNotExist(err) && s.readOnly {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	infos, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+	var vols []volumeInfo
+	for _, fi := range infos {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(name, volumeExt) {
+			continue
+		}
+		num, err := strconv.Atoi(strings.TrimSuffix(name, volumeExt))
+		if err != nil || num <= 0 {
+			continue
+		}
+		vols = append(vols, volumeInfo{num: num, size: fi.Size()})
+	}
+	sort.Slice(vols, func(i, j int) bool {
+		return vols[i].num < vols[j].num
+	})
+	return vols, nil
+}
+
+// loadIndex reads the index file. It returns false if the index doesn't exist, or if it doesn't match
+// the volumes on the medium.
+func (s *Storage) loadIndex(vols []volumeInfo) (bool, error) {
+	if s.index == "" {
+		return false, nil
+	}
+	f, err := os.Open(s.index)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	blobs := make(map[types.Ref]entry)
+	pins := make(map[string]types.Ref)
+	var ivols []volumeInfo
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			continue
+		}
+		// vol <num> <size>
+		// blob <ref> <vol> <offset> <size>
+		// pin <name> <ref>
+		fields := strings.Fields(line)
+		var err error
+		switch {
+		case len(fields) == 3 && fields[0] == "vol":
+			var v volumeInfo
+			if v.num, err = strconv.Atoi(fields[1]); err == nil {
+				v.size, err = strconv.ParseInt(fields[2], 10, 64)
+			}
+			ivols = append(ivols, v)
+		case len(fields) == 5 && fields[0] == "blob":
+			var (
+				ref types.Ref
+				e   entry
+			)
+			if ref, err = types.ParseRef(fields[1]); err != nil {
+				break
+			}
+			if e.vol, err = strconv.Atoi(fields[2]); err != nil {
+				break
+			}
+			if e.off, err = strconv.ParseInt(fields[3], 10, 64); err != nil {
+				break
+			}
+			if e.size, err = strconv.ParseUint(fields[4], 10, 64); err != nil {
+				break
+			}
+			blobs[ref] = e
+		case len(fields) == 3 && fields[0] == "pin":
+			var ref types.Ref
+			if ref, err = types.ParseRef(fields[2]); err == nil {
+				pins[fields[1]] = ref
+			}
+		default:
+			err = fmt.Errorf("unexpected entry")
+		}
+		if err != nil {
+			return false, fmt.Errorf("invalid tape index entry: %q: %v", line, err)
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return false, err
+	}
+	if len(ivols) != len(vols) {
+		return false, nil
+	}
+	for i := range vols {
+		if ivols[i] != vols[i] {
+			return false, nil
+		}
+	}
+	s.blobs, s.pins, s.vols = blobs, pins, vols
+	return true, nil
+}
+
+// saveIndex atomically replaces the index file.
+func (s *Storage) saveIndex() error {
+	if s.index == "" {
+		return nil
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.index), filepath.Base(s.index)+"_")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, v := range s.vols {
+		fmt.Fprintf(w, "vol %d %d\n", v.num, v.size)
+	}
+	for ref, e := range s.blobs {
+		fmt.Fprintf(w, "blob %s %d %d %d\n", ref, e.vol, e.off, e.size)
+	}
+	for name, ref := range s.pins {
+		fmt.Fprintf(w, "pin %s %s\n", name, ref)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.index)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Rebuild rebuilds the index by scanning all volumes on the medium.
+// It's called automatically when the storage is opened and the index doesn't match the volumes.
+func (s *Storage) Rebuild(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur != nil {
+		// current volume must be complete to be scanned
+		if err := s.closeVolume(); err != nil {
+			return err
+		}
+	}
+	vols, err := s.listVolumes()
+	if err != nil {
+		return err
+	}
+	return s.rebuild(ctx, vols)
+}
+
+func (s *Storage) rebuild(ctx context.Context, vols []volumeInfo) error {
+	blobs := make(map[types.Ref]entry)
+	pins := make(map[string]types.Ref)
+	for _, v := range vols {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := s.scanVolume(v, func(h *tar.Header, off int64, r io.Reader) error {
+			if name := strings.TrimPrefix(h.Name, pinPrefix); name != h.Name {
+				data, err := ioutil.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				if len(data) == 0 {
+					delete(pins, name)
+					return nil
+				}
+				ref, err := types.ParseRef(string(data))
+				if err != nil {
+					return err
+				}
+				pins[name] = ref
+				return nil
+			}
+			ref, err := types.ParseRef(h.Name)
+			if err != nil {
+				// not a blob; skip it
+				return nil
+			}
+			if _, ok := blobs[ref]; !ok {
+				blobs[ref] = entry{vol: v.num, off: off, size: uint64(h.Size)}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("cannot scan volume %d: %v", v.num, err)
+		}
+	}
+	s.blobs, s.pins, s.vols = blobs, pins, vols
+	return nil
+}
+
+// scanVolume reads all complete entries of the volume. Content of blobs is skipped.
+func (s *Storage) scanVolume(v volumeInfo, fnc func(h *tar.Header, off int64, r io.Reader) error) error {
+	f, err := os.Open(s.volumePath(v.num))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// volume was not closed properly; keep complete entries
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		off, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if off+h.Size > v.size {
+			// incomplete entry at the end
+			return nil
+		}
+		if err = fnc(h, off, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		return nil
+	}
+	var err error
+	if s.cur != nil {
+		err = s.closeVolume()
+	}
+	if err2 := s.saveIndex(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (s *Storage) lookup(ref types.Ref) (entry, error) {
+	if ref.Zero() {
+		return entry{}, storage.ErrInvalidRef
+	}
+	s.mu.RLock()
+	e, ok := s.blobs[ref]
+	s.mu.RUnlock()
+	if !ok {
+		return entry{}, storage.ErrNotFound
+	}
+	return e, nil
+}
+
+func (s *Storage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	e, err := s.lookup(ref)
+	if err != nil {
+		return 0, err
+	}
+	return e.size, nil
+}
+
+func (s *Storage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	e, err := s.lookup(ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.mu.Lock()
+	if s.cur != nil && s.cur.num == e.vol {
+		// content might be buffered
+		err = s.cur.flush()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(s.volumePath(e.vol))
+	if err != nil {
+		return nil, 0, err
+	}
+	r := io.NewSectionReader(f, e.off, int64(e.size))
+	// the medium might be damaged, so verify the content
+	rc := storage.VerifyReader(readCloser{Reader: r, Closer: f}, ref)
+	return rc, e.size, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func (s *Storage) IterateBlobs(ctx context.Context) storage.Iterator {
+	s.mu.RLock()
+	refs := make([]types.SizedRef, 0, len(s.blobs))
+	for ref, e := range s.blobs {
+		refs = append(refs, types.SizedRef{Ref: ref, Size: e.size})
+	}
+	s.mu.RUnlock()
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].Ref.String() < refs[j].Ref.String()
+	})
+	return &blobIterator{refs: refs}
+}
+
+// BeginBlob starts a new blob. The blob is appended to the volume on Commit, since the medium is written
+// sequentially and the size must be known before the content.
+func (s *Storage) BeginBlob(ctx context.Context) (storage.BlobWriter, error) {
+	if s.readOnly {
+		return nil, storage.ErrReadOnly
+	}
+	return storage.Spool("cas_tape_", nil, func(sr types.SizedRef, f *os.File) error {
+		return s.appendBlob(sr, f)
+	})
+}
+
+func (s *Storage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	if s.readOnly {
+		return storage.ErrReadOnly
+	} else if !validPin(name) {
+		return fmt.Errorf("invalid pin name: %q", name)
+	}
+	data := ref.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, _, err := s.appendEntry(pinPrefix+name, int64(len(data)), strings.NewReader(data)); err != nil {
+		return err
+	}
+	s.pins[name] = ref
+	return nil
+}
+
+func (s *Storage) DeletePin(ctx context.Context, name string) error {
+	if s.readOnly {
+		return storage.ErrReadOnly
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pins[name]; !ok {
+		return storage.ErrNotFound
+	}
+	if _, _, err := s.appendEntry(pinPrefix+name, 0, strings.NewReader("")); err != nil {
+		return err
+	}
+	delete(s.pins, name)
+	return nil
+}
+
+// SetPinCAS implements storage.PinSwapper.
+func (s *Storage) SetPinCAS(ctx context.Context, name string, old, new types.Ref) error {
+	if s.readOnly {
+		return storage.ErrReadOnly
+	} else if !validPin(name) {
+		return fmt.Errorf("invalid pin name: %q", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pins[name] != old {
+		return storage.ErrPinConflict
+	}
+	if new.Zero() {
+		if old.Zero() {
+			return nil
+		}
+		if _, _, err := s.appendEntry(pinPrefix+name, 0, strings.NewReader("")); err != nil {
+			return err
+		}
+		delete(s.pins, name)
+		return nil
+	}
+	data := new.String()
+	if _, _, err := s.appendEntry(pinPrefix+name, int64(len(data)), strings.NewReader(data)); err != nil {
+		return err
+	}
+	s.pins[name] = new
+	return nil
+}
+
+func validPin(name string) bool {
+	return name != "" && path.Clean(name) == name && !strings.ContainsAny(name, " \t\n")
+}
+
+func (s *Storage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ref, ok := s.pins[name]
+	if !ok {
+		return types.Ref{}, storage.ErrNotFound
+	}
+	return ref, nil
+}
+
+func (s *Storage) IteratePins(ctx context.Context) storage.PinIterator {
+	s.mu.RLock()
+	pins := make([]types.Pin, 0, len(s.pins))
+	for name, ref := range s.pins {
+		pins = append(pins, types.Pin{Name: name, Ref: ref})
+	}
+	s.mu.RUnlock()
+	sort.Slice(pins, func(i, j int) bool {
+		return pins[i].Name < pins[j].Name
+	})
+	return &pinIterator{pins: pins}
+}
+
+// volumeWriter appends entries to the volume.
+type volumeWriter struct {
+	num int
+	f   *os.File
+	bw  *bufio.Writer
+	tw  *tar.Writer
+	n   int64 // number of bytes written
+}
+
+func (w *volumeWriter) Write(p []byte) (int, error) {
+	n, err := w.bw.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *volumeWriter) flush() error {
+	return w.bw.Flush()
+}
+
+// openVolume starts a new volume. It must be called with the lock held.
+func (s *Storage) openVolume() error {
+	num := 1
+	if n := len(s.vols); n != 0 {
+		num = s.vols[n-1].num + 1
+	}
+	f, err := os.OpenFile(s.volumePath(num), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	// tape drives perform better with large blocks
+	w := &volumeWriter{num: num, f: f, bw: bufio.NewWriterSize(f, 1<<20)}
+	w.tw = tar.NewWriter(w)
+	s.cur = w
+	s.vols = append(s.vols, volumeInfo{num: num})
+	return nil
+}
+
+// closeVolume completes the current volume. It must be called with the lock held.
+func (s *Storage) closeVolume() error {
+	w := s.cur
+	s.cur = nil
+	err := w.tw.Close()
+	if err == nil {
+		err = w.flush()
+	}
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if err2 := w.f.Close(); err == nil {
+		err = err2
+	}
+	fi, err2 := os.Stat(s.volumePath(w.num))
+	if err == nil {
+		err = err2
+	}
+	if err2 == nil {
+		s.vols[len(s.vols)-1].size = fi.Size()
+	}
+	return err
+}
+
+// appendEntry writes an entry to the current volume, starting a new one if necessary.
+// It returns the volume number and the offset of the content. It must be called with the lock held.
+func (s *Storage) appendEntry(name string, size int64, r io.Reader) (int, int64, error) {
+	if s.cur != nil && s.cur.n != 0 && uint64(s.cur.n+size) > s.volSize {
+		if err := s.closeVolume(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if s.cur == nil {
+		if err := s.openVolume(); err != nil {
+			return 0, 0, err
+		}
+	}
+	w := s.cur
+	err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0444,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	off := w.n
+	n, err := io.Copy(w.tw, r)
+	if err != nil {
+		return 0, 0, err
+	} else if n != size {
+		return 0, 0, storage.ErrSizeMissmatch{Exp: uint64(size), Got: uint64(n)}
+	}
+	if err = w.tw.Flush(); err != nil {
+		return 0, 0, err
+	}
+	return w.num, off, nil
+}
+
+// appendBlob writes the blob to the medium, unless it already exists.
+func (s *Storage) appendBlob(sr types.SizedRef, r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.blobs[sr.Ref]; ok {
+		return nil
+	}
+	vol, off, err := s.appendEntry(sr.Ref.String(), int64(sr.Size), r)
+	if err != nil {
+		return err
+	}
+	s.blobs[sr.Ref] = entry{vol: vol, off: off, size: sr.Size}
+	return nil
+}
+
+type blobIterator struct {
+	refs []types.SizedRef
+	cur  types.SizedRef
+}
+
+func (it *blobIterator) Next() bool {
+	if len(it.refs) == 0 {
+		return false
+	}
+	it.cur = it.refs[0]
+	it.refs = it.refs[1:]
+	return true
+}
+
+func (it *blobIterator) Err() error {
+	return nil
+}
+
+func (it *blobIterator) Close() error {
+	it.refs = nil
+	return nil
+}
+
+func (it *blobIterator) SizedRef() types.SizedRef {
+	return it.cur
+}
+
+type pinIterator struct {
+	pins []types.Pin
+	cur  types.Pin
+}
+
+func (it *pinIterator) Next() bool {
+	if len(it.pins) == 0 {
+		return false
+	}
+	it.cur = it.pins[0]
+	it.pins = it.pins[1:]
+	return true
+}
+
+func (it *pinIterator) Err() error {
+	return nil
+}
+
+func (it *pinIterator) Close() error {
+	it.pins = nil
+	return nil
+}
+
+func (it *pinIterator) Pin() types.Pin {
+	return it.cur
+}
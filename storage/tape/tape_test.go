@@ -0,0 +1,127 @@
+package tape
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/test"
+	"github.com/dennwc/cas/types"
+)
+
+func TestTape(t *testing.T) {
+	storagetest.RunTests(t, func(t testing.TB) (storage.Storage, func()) {
+		dir, err := ioutil.TempDir("", "cas_tape_")
+		require.NoError(t, err)
+		s, err := New(context.Background(), filepath.Join(dir, "tape"), &Options{
+			Index: filepath.Join(dir, "index"),
+		})
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+		require.NoError(t, err)
+		return s, func() {
+			s.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func TestTapeRecover(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_tape_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mdir := filepath.Join(dir, "tape")
+	index := filepath.Join(dir, "index")
+	open := func() *Storage {
+		s, err := New(ctx, mdir, &Options{Index: index, VolumeSize: 4096})
+		require.NoError(t, err)
+		return s
+	}
+	read := func(s *Storage, sr types.SizedRef) string {
+		rc, sz, err := s.FetchBlob(ctx, sr.Ref)
+		require.NoError(t, err)
+		defer rc.Close()
+		require.Equal(t, sr.Size, sz)
+		data, err := ioutil.ReadAll(rc)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	s := open()
+	var blobs []types.SizedRef
+	for _, data := range []string{"first", string(make([]byte, 5000)), "third"} {
+		sr, err := storage.WriteBytes(ctx, s, []byte(data))
+		require.NoError(t, err)
+		blobs = append(blobs, sr)
+	}
+	require.NoError(t, s.SetPin(ctx, "root", blobs[0].Ref))
+	require.NoError(t, s.SetPin(ctx, "tmp", blobs[1].Ref))
+	require.NoError(t, s.DeletePin(ctx, "tmp"))
+	require.Equal(t, "first", read(s, blobs[0]))
+	require.NoError(t, s.Close())
+
+	// large blobs start a new volume
+	vols, err := s.listVolumes()
+	require.NoError(t, err)
+	require.Len(t, vols, 3)
+
+	check := func(s *Storage) {
+		for _, sr := range blobs {
+			sz, err := s.StatBlob(ctx, sr.Ref)
+			require.NoError(t, err)
+			require.Equal(t, sr.Size, sz)
+		}
+		require.Equal(t, "third", read(s, blobs[2]))
+		ref, err := s.GetPin(ctx, "root")
+		require.NoError(t, err)
+		require.Equal(t, blobs[0].Ref, ref)
+		_, err = s.GetPin(ctx, "tmp")
+		require.Equal(t, storage.ErrNotFound, err)
+	}
+
+	// index is rebuilt from the medium
+	require.NoError(t, os.Remove(index))
+	s = open()
+	check(s)
+
+	// volume that was not closed properly is scanned up to the last complete entry
+	last, err := storage.WriteBytes(ctx, s, []byte("last"))
+	require.NoError(t, err)
+	require.NoError(t, s.cur.flush())
+	vol := s.volumePath(s.cur.num)
+	_, err = storage.WriteBytes(ctx, s, []byte("lost"))
+	require.NoError(t, err)
+	require.NoError(t, s.cur.flush())
+	fi, err := os.Stat(vol)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(vol, fi.Size()-2))
+
+	s2 := open()
+	check(s2)
+	require.Equal(t, "last", read(s2, last))
+	require.NoError(t, s2.Close())
+
+	// volumes are plain tar files
+	f, err := os.Open(s.volumePath(1))
+	require.NoError(t, err)
+	defer f.Close()
+	tr := tar.NewReader(f)
+	h, err := tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, blobs[0].Ref.String(), h.Name)
+	data, err := ioutil.ReadAll(tr)
+	require.NoError(t, err)
+	require.Equal(t, "first", string(data))
+	_, err = tr.Next()
+	require.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,108 @@
+package tenant
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/dennwc/cas/storage/http"
+	"github.com/dennwc/cas/types"
+)
+
+// Handler serves stores of all tenants over HTTP. Each tenant is served under its own path, "/<tenant>/",
+// which is used as an address of the store by clients. Access control is left to the caller.
+//
+// Options are applied to each tenant separately, thus limits on concurrency and throughput are per tenant,
+// while the scheduler and metrics are shared if they are set.
+func (h *Host) Handler(opts httpstor.ServerOptions) http.Handler {
+	return &handler{h: h, opts: opts, srv: make(map[string]http.Handler)}
+}
+
+type handler struct {
+	h    *Host
+	opts httpstor.ServerOptions
+
+	mu  sync.Mutex
+	srv map[string]http.Handler
+}
+
+// server returns a handler for the tenant, creating it if necessary.
+func (h *handler) server(name string) (http.Handler, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if srv, ok := h.srv[name]; ok {
+		return srv, nil
+	}
+	t, err := h.h.Tenant(name)
+	if err != nil {
+		return nil, err
+	}
+	srv := httpstor.NewServerWithOptions(t, "/"+name, h.opts)
+	h.srv[name] = srv
+	return srv, nil
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		name = name[:i]
+	}
+	srv, err := h.server(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	srv.ServeHTTP(w, r)
+}
+
+// AdminHandler serves the admin API of the host. It must not be exposed to tenants.
+//
+//	GET /usage[?attribution=split|first-writer]  storage usage of all tenants, see Host.Usage
+//	GET /owners/<ref>                            tenants that store the blob, see Host.Owners
+//
+// Responses are encoded as JSON.
+func (h *Host) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/usage", func(w http.ResponseWriter, r *http.Request) {
+		attr := Split
+		if s := r.URL.Query().Get("attribution"); s != "" {
+			var err error
+			attr, err = ParseAttribution(s)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		usage, err := h.Usage(r.Context(), attr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, usage)
+	})
+	mux.HandleFunc("/owners/", func(w http.ResponseWriter, r *http.Request) {
+		ref, err := types.ParseRef(strings.TrimPrefix(r.URL.Path, "/owners/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		owners, err := h.Owners(r.Context(), ref)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if owners == nil {
+			owners = []string{}
+		}
+		writeJSON(w, owners)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
@@ -0,0 +1,351 @@
+// Package tenant implements hosting of many logical stores in a single physical storage.
+//
+// All tenants share one pool of blobs, thus a blob stored by many tenants is only stored once. Each tenant has
+// its own pins and its own index of blobs, both kept as pins of the pool under the prefix of the tenant. A tenant
+// only sees blobs it has stored, even if the same blobs were stored by other tenants.
+//
+// Garbage collection runs for one tenant at a time (see Host.GC). Unreachable blobs are removed from the index
+// of the tenant, but they are only removed from the pool if no other tenant can reach them. Pins of the pool
+// itself are respected as well, thus the pool can be collected with gc.Run without losing blobs of any tenant.
+//
+// The pool also records which tenant stored each blob first. It allows to attribute the size of shared blobs
+// to tenants for accounting and quotas, see Host.Usage.
+package tenant
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/dennwc/cas/gc"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+const (
+	// pinPrefix is a prefix for all pins of tenants in the pool.
+	pinPrefix = "cas.tenant."
+	// userPinPrefix is a prefix for pins set by the tenant, relative to the prefix of the tenant.
+	userPinPrefix = "pin."
+	// blobPinPrefix is a prefix for pins that index blobs of the tenant, relative to the prefix of the tenant.
+	blobPinPrefix = "blob."
+	// firstPinPrefix is a prefix for pins that mark blobs first stored in the pool by the tenant.
+	firstPinPrefix = "first."
+)
+
+// ErrInvalidName is returned for tenant names that cannot be used.
+var ErrInvalidName = errors.New("tenant: invalid tenant name")
+
+// ValidName checks if the name can be used for a tenant. Names consist of letters, digits, '-' and '_'.
+func ValidName(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// New creates a host for tenants that share blobs of a given storage.
+func New(s storage.Storage) *Host {
+	return &Host{s: s}
+}
+
+// Host manages tenants that share one pool of blobs. See package documentation for details.
+type Host struct {
+	s storage.Storage
+}
+
+// Pool returns the underlying storage.
+func (h *Host) Pool() storage.Storage {
+	return h.s
+}
+
+// Close closes the underlying storage.
+func (h *Host) Close() error {
+	return h.s.Close()
+}
+
+// Tenant returns the store of a tenant. Tenants are created on the first write.
+func (h *Host) Tenant(name string) (*Storage, error) {
+	if !ValidName(name) {
+		return nil, ErrInvalidName
+	}
+	return &Storage{h: h, name: name, prefix: pinPrefix + name + "."}, nil
+}
+
+// Tenants lists names of all tenants that have pins or blobs.
+func (h *Host) Tenants(ctx context.Context) ([]string, error) {
+	seen := make(map[string]struct{})
+	it := h.s.IteratePins(ctx)
+	defer it.Close()
+	for it.Next() {
+		name := it.Pin().Name
+		if !strings.HasPrefix(name, pinPrefix) {
+			continue
+		}
+		name = strings.TrimPrefix(name, pinPrefix)
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			seen[name[:i]] = struct{}{}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// GC removes blobs of the tenant that are not reachable from its pins. See gc.Run for details.
+//
+// Blobs are removed from the index of the tenant, and the report accounts for all of them. Blobs are only removed
+// from the pool if they are not reachable from any pin outside of the tenant, including pins and blobs of other
+// tenants. The pool must implement storage.BlobDeleter, unless the dry-run mode is used.
+//
+// Blobs are marked by reading schema blobs of all tenants, thus the collection is as expensive as gc.Run
+// for the whole pool. It's not safe to run concurrently with writes of any tenant.
+func (h *Host) GC(ctx context.Context, name string, opts *gc.Options) (*gc.Report, error) {
+	if opts == nil {
+		opts = &gc.Options{}
+	}
+	t, err := h.Tenant(name)
+	if err != nil {
+		return nil, err
+	}
+	del, ok := h.s.(storage.BlobDeleter)
+	if !ok && !opts.DryRun {
+		return nil, gc.ErrNoDelete
+	}
+	shared := gc.NewMarker(h.s)
+	it := h.s.IteratePins(ctx)
+	for it.Next() {
+		p := it.Pin()
+		if strings.HasPrefix(p.Name, t.prefix) {
+			continue
+		}
+		if err = shared.Mark(ctx, p.Ref); err != nil {
+			it.Close()
+			return nil, err
+		}
+	}
+	err = it.Err()
+	it.Close()
+	if err != nil {
+		return nil, err
+	}
+	return gc.Run(ctx, &collector{Storage: t, pool: del, shared: shared}, opts)
+}
+
+// collector removes blobs from the index of the tenant, and from the pool if they are not shared.
+type collector struct {
+	*Storage
+	pool   storage.BlobDeleter
+	shared *gc.Marker
+}
+
+func (c *collector) DeleteBlob(ctx context.Context, ref types.Ref) error {
+	if ref.Zero() {
+		return storage.ErrInvalidRef
+	}
+	if err := c.h.s.DeletePin(ctx, c.blobPin(ref)); err != nil {
+		return err
+	}
+	if err := c.h.s.DeletePin(ctx, c.firstPin(ref)); err != nil && err != storage.ErrNotFound {
+		return err
+	}
+	if c.shared.Marked(ref) {
+		return nil
+	}
+	err := c.pool.DeleteBlob(ctx, ref)
+	if err == storage.ErrNotFound {
+		err = nil
+	}
+	return err
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+// Storage is a store of a single tenant. See Host.Tenant.
+type Storage struct {
+	h      *Host
+	name   string
+	prefix string
+}
+
+// Name returns the name of the tenant.
+func (s *Storage) Name() string {
+	return s.name
+}
+
+func (s *Storage) blobPin(ref types.Ref) string {
+	return s.prefix + blobPinPrefix + ref.String()
+}
+
+func (s *Storage) firstPin(ref types.Ref) string {
+	return s.prefix + firstPinPrefix + ref.String()
+}
+
+func (s *Storage) userPin(name string) string {
+	return s.prefix + userPinPrefix + name
+}
+
+// Close does nothing. The pool is closed by the Host.
+func (s *Storage) Close() error {
+	return nil
+}
+
+// hasBlob checks if the blob is in the index of the tenant.
+func (s *Storage) hasBlob(ctx context.Context, ref types.Ref) error {
+	if ref.Zero() {
+		return storage.ErrInvalidRef
+	}
+	_, err := s.h.s.GetPin(ctx, s.blobPin(ref))
+	return err
+}
+
+func (s *Storage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	if err := s.hasBlob(ctx, ref); err != nil {
+		return 0, err
+	}
+	return s.h.s.StatBlob(ctx, ref)
+}
+
+func (s *Storage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	if err := s.hasBlob(ctx, ref); err != nil {
+		return nil, 0, err
+	}
+	return s.h.s.FetchBlob(ctx, ref)
+}
+
+// IterateBlobs lists blobs in the index of the tenant. Sizes of blobs are read from the pool.
+func (s *Storage) IterateBlobs(ctx context.Context) storage.Iterator {
+	return &blobIterator{s: s, ctx: ctx, it: s.h.s.IteratePins(ctx), pref: s.prefix + blobPinPrefix}
+}
+
+type blobIterator struct {
+	s    *Storage
+	ctx  context.Context
+	it   storage.PinIterator
+	pref string
+	cur  types.SizedRef
+	err  error
+}
+
+func (it *blobIterator) Next() bool {
+	it.cur = types.SizedRef{}
+	if it.err != nil {
+		return false
+	}
+	for it.it.Next() {
+		p := it.it.Pin()
+		if !strings.HasPrefix(p.Name, it.pref) {
+			continue
+		}
+		sz, err := it.s.h.s.StatBlob(it.ctx, p.Ref)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.cur = types.SizedRef{Ref: p.Ref, Size: sz}
+		return true
+	}
+	it.err = it.it.Err()
+	return false
+}
+
+func (it *blobIterator) Err() error {
+	return it.err
+}
+
+func (it *blobIterator) Close() error {
+	return it.it.Close()
+}
+
+func (it *blobIterator) SizedRef() types.SizedRef {
+	return it.cur
+}
+
+// BeginBlob starts a new blob in the pool. The blob is added to the index of the tenant when it's committed,
+// and the tenant is recorded as the first writer if the pool didn't have the blob.
+func (s *Storage) BeginBlob(ctx context.Context) (storage.BlobWriter, error) {
+	w, err := s.h.s.BeginBlob(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &blobWriter{BlobWriter: w, s: s, ctx: ctx}, nil
+}
+
+type blobWriter struct {
+	storage.BlobWriter
+	s   *Storage
+	ctx context.Context
+}
+
+func (w *blobWriter) Commit() error {
+	sr, err := w.Complete()
+	if err != nil {
+		return err
+	}
+	_, err = w.s.h.s.StatBlob(w.ctx, sr.Ref)
+	first := err == storage.ErrNotFound
+	if err != nil && !first {
+		return err
+	}
+	if err = w.BlobWriter.Commit(); err != nil {
+		return err
+	}
+	if err = w.s.h.s.SetPin(w.ctx, w.s.blobPin(sr.Ref), sr.Ref); err != nil || !first {
+		return err
+	}
+	return w.s.h.s.SetPin(w.ctx, w.s.firstPin(sr.Ref), sr.Ref)
+}
+
+func (s *Storage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	return s.h.s.SetPin(ctx, s.userPin(name), ref)
+}
+
+func (s *Storage) DeletePin(ctx context.Context, name string) error {
+	return s.h.s.DeletePin(ctx, s.userPin(name))
+}
+
+func (s *Storage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	return s.h.s.GetPin(ctx, s.userPin(name))
+}
+
+// IteratePins lists pins of the tenant.
+func (s *Storage) IteratePins(ctx context.Context) storage.PinIterator {
+	return &pinIterator{PinIterator: s.h.s.IteratePins(ctx), pref: s.prefix + userPinPrefix}
+}
+
+type pinIterator struct {
+	storage.PinIterator
+	pref string
+	cur  types.Pin
+}
+
+func (it *pinIterator) Next() bool {
+	for it.PinIterator.Next() {
+		p := it.PinIterator.Pin()
+		if strings.HasPrefix(p.Name, it.pref) {
+			p.Name = strings.TrimPrefix(p.Name, it.pref)
+			it.cur = p
+			return true
+		}
+	}
+	return false
+}
+
+func (it *pinIterator) Pin() types.Pin {
+	return it.cur
+}
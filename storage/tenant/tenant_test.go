@@ -0,0 +1,194 @@
+package tenant
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/http"
+	"github.com/dennwc/cas/storage/test"
+	"github.com/dennwc/cas/types"
+)
+
+func TestTenant(t *testing.T) {
+	storagetest.RunTests(t, func(t testing.TB) (storage.Storage, func()) {
+		h := New(storage.NewInMemory())
+		// other tenants should not be visible
+		other, err := h.Tenant("other")
+		require.NoError(t, err)
+		_, err = storage.WriteBytes(context.Background(), other, []byte("data of other tenant"))
+		require.NoError(t, err)
+		s, err := h.Tenant("test")
+		require.NoError(t, err)
+		return s, func() {
+			h.Close()
+		}
+	})
+}
+
+func TestHostGC(t *testing.T) {
+	ctx := context.Background()
+	pool := storage.NewInMemory()
+	h := New(pool)
+
+	_, err := h.Tenant("../alice")
+	require.Equal(t, ErrInvalidName, err)
+	alice, err := h.Tenant("alice")
+	require.NoError(t, err)
+	bob, err := h.Tenant("bob")
+	require.NoError(t, err)
+
+	write := func(s storage.Storage, data string) types.SizedRef {
+		sr, err := storage.WriteBytes(ctx, s, []byte(data))
+		require.NoError(t, err)
+		return sr
+	}
+	writeSchema := func(s storage.Storage, obj schema.Object) types.SizedRef {
+		buf := new(bytes.Buffer)
+		require.NoError(t, schema.Encode(buf, obj))
+		return write(s, buf.String())
+	}
+	count := func() int {
+		n := 0
+		it := pool.IterateBlobs(ctx)
+		defer it.Close()
+		for it.Next() {
+			n++
+		}
+		require.NoError(t, it.Err())
+		return n
+	}
+	stat := func(s storage.Storage, sr types.SizedRef) error {
+		_, err := s.StatBlob(ctx, sr.Ref)
+		return err
+	}
+
+	// both tenants store the same file, only alice keeps it
+	shared := write(alice, "shared")
+	require.Equal(t, shared, write(bob, "shared"))
+	own := write(alice, "own")
+	garbage := write(alice, "garbage")
+	list := writeSchema(alice, &schema.List{List: []types.Ref{shared.Ref, own.Ref}})
+	require.NoError(t, alice.SetPin(ctx, "root", list.Ref))
+	// bob references a blob stored by alice, without storing it
+	blist := writeSchema(bob, &schema.List{List: []types.Ref{garbage.Ref}})
+	require.NoError(t, bob.SetPin(ctx, "root", blist.Ref))
+
+	// tenants are isolated, but blobs are stored once
+	require.Equal(t, storage.ErrNotFound, stat(bob, own))
+	_, err = bob.GetPin(ctx, "missing")
+	require.Equal(t, storage.ErrNotFound, err)
+	names, err := h.Tenants(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice", "bob"}, names)
+	require.Equal(t, 5, count())
+
+	// garbage of alice is reachable from pins of bob
+	require.NoError(t, alice.DeletePin(ctx, "root"))
+	rep, err := h.GC(ctx, "alice", nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), rep.Swept)
+	for _, sr := range []types.SizedRef{shared, own, garbage, list} {
+		require.Equal(t, storage.ErrNotFound, stat(alice, sr))
+	}
+	require.NoError(t, stat(bob, shared))
+	require.NoError(t, stat(pool, garbage))
+	for _, sr := range []types.SizedRef{own, list} {
+		require.Equal(t, storage.ErrNotFound, stat(pool, sr))
+	}
+
+	require.NoError(t, bob.DeletePin(ctx, "root"))
+	rep, err = h.GC(ctx, "bob", nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), rep.Swept)
+	require.Equal(t, 1, count(), "garbage is not indexed by any tenant")
+}
+
+func TestHandler(t *testing.T) {
+	ctx := context.Background()
+	h := New(storage.NewInMemory())
+	srv := httptest.NewServer(h.Handler(httpstor.ServerOptions{Writable: true}))
+	defer srv.Close()
+
+	alice := httpstor.NewClient(srv.URL + "/alice")
+	sr, err := storage.WriteBytes(ctx, alice, []byte("data"))
+	require.NoError(t, err)
+
+	s, err := h.Tenant("alice")
+	require.NoError(t, err)
+	_, err = s.StatBlob(ctx, sr.Ref)
+	require.NoError(t, err)
+	require.NoError(t, s.SetPin(ctx, "root", sr.Ref))
+	ref, err := alice.GetPin(ctx, "root")
+	require.NoError(t, err)
+	require.Equal(t, sr.Ref, ref)
+
+	bob := httpstor.NewClient(srv.URL + "/bob")
+	_, err = bob.StatBlob(ctx, sr.Ref)
+	require.Equal(t, storage.ErrNotFound, err)
+	_, err = bob.GetPin(ctx, "root")
+	require.Equal(t, storage.ErrNotFound, err)
+}
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+	h := New(storage.NewInMemory())
+	tenant := func(name string) *Storage {
+		s, err := h.Tenant(name)
+		require.NoError(t, err)
+		return s
+	}
+	write := func(s storage.Storage, data []byte) types.SizedRef {
+		sr, err := storage.WriteBytes(ctx, s, data)
+		require.NoError(t, err)
+		return sr
+	}
+	alice, bob, carol := tenant("alice"), tenant("bob"), tenant("carol")
+	shared := write(alice, bytes.Repeat([]byte{1}, 100))
+	write(bob, bytes.Repeat([]byte{1}, 100))
+	write(carol, bytes.Repeat([]byte{1}, 100))
+	write(bob, bytes.Repeat([]byte{2}, 10))
+
+	owners, err := h.Owners(ctx, shared.Ref)
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice", "bob", "carol"}, owners)
+
+	usage, err := h.Usage(ctx, Split)
+	require.NoError(t, err)
+	require.Equal(t, []Usage{
+		{Tenant: "alice", Blobs: 1, Size: 100, Exclusive: 0, Attributed: 34},
+		{Tenant: "bob", Blobs: 2, Size: 110, Exclusive: 10, Attributed: 43},
+		{Tenant: "carol", Blobs: 1, Size: 100, Exclusive: 0, Attributed: 33},
+	}, usage)
+
+	srv := httptest.NewServer(h.AdminHandler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/usage?attribution=first-writer")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	usage = nil
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&usage))
+	require.Equal(t, []Usage{
+		{Tenant: "alice", Blobs: 1, Size: 100, Exclusive: 0, Attributed: 100},
+		{Tenant: "bob", Blobs: 2, Size: 110, Exclusive: 10, Attributed: 10},
+		{Tenant: "carol", Blobs: 1, Size: 100, Exclusive: 0, Attributed: 0},
+	}, usage)
+
+	// the first writer removes the blob
+	_, err = h.GC(ctx, "alice", nil)
+	require.NoError(t, err)
+	usage, err = h.Usage(ctx, FirstWriter)
+	require.NoError(t, err)
+	require.Equal(t, []Usage{
+		{Tenant: "bob", Blobs: 2, Size: 110, Exclusive: 10, Attributed: 110},
+		{Tenant: "carol", Blobs: 1, Size: 100, Exclusive: 0, Attributed: 0},
+	}, usage)
+}
@@ -0,0 +1,176 @@
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+// Attribution controls how the size of blobs stored by many tenants is attributed to them.
+type Attribution int
+
+const (
+	// Split divides the size of a shared blob equally between all tenants that store it.
+	Split Attribution = iota
+	// FirstWriter attributes the whole size of a blob to the tenant that stored it first. If that tenant
+	// removed the blob, it's attributed to the first of the remaining tenants, in sorted order.
+	FirstWriter
+)
+
+func (a Attribution) String() string {
+	switch a {
+	case Split:
+		return "split"
+	case FirstWriter:
+		return "first-writer"
+	}
+	return fmt.Sprintf("Attribution(%d)", int(a))
+}
+
+// ParseAttribution parses the name of the attribution mode, as returned by Attribution.String.
+func ParseAttribution(s string) (Attribution, error) {
+	for _, a := range []Attribution{Split, FirstWriter} {
+		if a.String() == s {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown attribution mode: %q", s)
+}
+
+// Usage is the storage usage of a tenant.
+type Usage struct {
+	Tenant     string `json:"tenant"`
+	Blobs      uint64 `json:"blobs"`      // number of blobs stored by the tenant
+	Size       uint64 `json:"size"`       // total size of blobs stored by the tenant
+	Exclusive  uint64 `json:"exclusive"`  // size of blobs that are not stored by other tenants
+	Attributed uint64 `json:"attributed"` // size of blobs attributed to the tenant, see Attribution
+}
+
+// Owners returns names of tenants that store the blob, in sorted order.
+func (h *Host) Owners(ctx context.Context, ref types.Ref) ([]string, error) {
+	if ref.Zero() {
+		return nil, storage.ErrInvalidRef
+	}
+	names, err := h.Tenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, name := range names {
+		t, err := h.Tenant(name)
+		if err != nil {
+			return nil, err
+		}
+		if err = t.hasBlob(ctx, ref); err == nil {
+			out = append(out, name)
+		} else if err != storage.ErrNotFound {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// blobOwners lists tenants that store a blob.
+type blobOwners struct {
+	owners []string
+	first  string // first writer, if known
+}
+
+// Usage reports the storage usage of all tenants, sorted by name. The pool is read once, and the size of each
+// blob is only checked once, regardless of the number of tenants that store it.
+func (h *Host) Usage(ctx context.Context, attr Attribution) ([]Usage, error) {
+	blobs := make(map[types.Ref]*blobOwners)
+	get := func(ref types.Ref) *blobOwners {
+		b := blobs[ref]
+		if b == nil {
+			b = &blobOwners{}
+			blobs[ref] = b
+		}
+		return b
+	}
+	usage := make(map[string]*Usage)
+	it := h.s.IteratePins(ctx)
+	for it.Next() {
+		p := it.Pin()
+		if !strings.HasPrefix(p.Name, pinPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(p.Name, pinPrefix)
+		i := strings.IndexByte(name, '.')
+		if i <= 0 {
+			continue
+		}
+		name, kind := name[:i], name[i+1:]
+		if usage[name] == nil {
+			usage[name] = &Usage{Tenant: name}
+		}
+		switch {
+		case strings.HasPrefix(kind, blobPinPrefix):
+			b := get(p.Ref)
+			b.owners = append(b.owners, name)
+		case strings.HasPrefix(kind, firstPinPrefix):
+			get(p.Ref).first = name
+		}
+	}
+	err := it.Err()
+	it.Close()
+	if err != nil {
+		return nil, err
+	}
+	for ref, b := range blobs {
+		if len(b.owners) == 0 {
+			// only the first writer is recorded; the index entry was removed
+			continue
+		}
+		sz, err := h.s.StatBlob(ctx, ref)
+		if err == storage.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		sort.Strings(b.owners)
+		for _, name := range b.owners {
+			u := usage[name]
+			u.Blobs++
+			u.Size += sz
+			if len(b.owners) == 1 {
+				u.Exclusive += sz
+			}
+		}
+		switch attr {
+		case Split:
+			n := uint64(len(b.owners))
+			for i, name := range b.owners {
+				part := sz / n
+				if uint64(i) < sz%n {
+					// the remainder is attributed to the first tenants, thus the total matches the size
+					part++
+				}
+				usage[name].Attributed += part
+			}
+		case FirstWriter:
+			first := b.owners[0]
+			for _, name := range b.owners {
+				if name == b.first {
+					first = name
+					break
+				}
+			}
+			usage[first].Attributed += sz
+		default:
+			return nil, fmt.Errorf("unknown attribution mode: %v", attr)
+		}
+	}
+	out := make([]Usage, 0, len(usage))
+	for _, u := range usage {
+		out = append(out, *u)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Tenant < out[j].Tenant
+	})
+	return out, nil
+}
@@ -1,14 +1,22 @@
 package storagetest
 
 import (
+	"bytes"
 	"context"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/faulty"
 	"github.com/dennwc/cas/types"
 )
 
@@ -18,6 +26,191 @@ func RunTests(t *testing.T, fnc StorageFunc) {
 	t.Run("simple", func(t *testing.T) {
 		testSimple(t, fnc)
 	})
+	t.Run("delete", func(t *testing.T) {
+		testDelete(t, fnc)
+	})
+	t.Run("prefix", func(t *testing.T) {
+		testPrefix(t, fnc)
+	})
+	t.Run("pin cas", func(t *testing.T) {
+		testPinCAS(t, fnc)
+	})
+	t.Run("pin history", func(t *testing.T) {
+		testPinHistory(t, fnc)
+	})
+	t.Run("pin meta", func(t *testing.T) {
+		testPinMeta(t, fnc)
+	})
+	t.Run("stat blobs", func(t *testing.T) {
+		testStatBlobs(t, fnc)
+	})
+	t.Run("faults", func(t *testing.T) {
+		testFaults(t, fnc)
+	})
+	t.Run("open blob", func(t *testing.T) {
+		testOpenBlob(t, fnc)
+	})
+	t.Run("fetch range", func(t *testing.T) {
+		testFetchBlobRange(t, fnc)
+	})
+}
+
+func testFetchBlobRange(t *testing.T, fnc StorageFunc) {
+	s, closer := fnc(t)
+	defer closer()
+
+	ctx := context.Background()
+	data := []byte(strings.Repeat("0123456789", 100))
+	sr, err := storage.WriteBytes(ctx, s, data)
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		off, length uint64
+		exp         []byte
+	}{
+		{off: 0, length: 10, exp: data[:10]},
+		{off: 500, length: 100, exp: data[500:600]},
+		{off: 990, length: 0, exp: data[990:]},
+		{off: 995, length: 10, exp: data[995:]},
+		{off: 1000, length: 10, exp: []byte{}},
+		{off: 2000, length: 0, exp: []byte{}},
+	} {
+		rc, sz, err := storage.FetchBlobRange(ctx, s, sr.Ref, c.off, c.length)
+		require.NoError(t, err)
+		require.Equal(t, sr.Size, sz)
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		require.Equal(t, c.exp, got, "%d-%d", c.off, c.length)
+	}
+
+	_, _, err = storage.FetchBlobRange(ctx, s, types.BytesRef([]byte("missing")), 0, 10)
+	require.Equal(t, storage.ErrNotFound, err)
+}
+
+func testOpenBlob(t *testing.T, fnc StorageFunc) {
+	s, closer := fnc(t)
+	defer closer()
+
+	ctx := context.Background()
+	data := []byte(strings.Repeat("0123456789", 100))
+	sr, err := storage.WriteBytes(ctx, s, data)
+	require.NoError(t, err)
+
+	r, sz, err := storage.OpenBlob(ctx, s, sr.Ref)
+	require.NoError(t, err)
+	defer r.Close()
+	require.Equal(t, sr.Size, sz)
+
+	buf := make([]byte, 10)
+	for _, off := range []int{500, 100, 990, 0} {
+		n, err := r.ReadAt(buf, int64(off))
+		require.NoError(t, err)
+		require.Equal(t, data[off:off+10], buf[:n])
+	}
+	n, err := r.ReadAt(buf, 995)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, data[995:], buf[:n])
+
+	_, err = r.Seek(-20, io.SeekEnd)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data[980:], got)
+	require.NoError(t, r.Close())
+
+	_, _, err = storage.OpenBlob(ctx, s, types.BytesRef([]byte("missing")))
+	require.Equal(t, storage.ErrNotFound, err)
+}
+
+func testStatBlobs(t *testing.T, fnc StorageFunc) {
+	s, closer := fnc(t)
+	defer closer()
+
+	ctx := context.Background()
+	var (
+		refs []types.Ref
+		exp  []types.SizedRef
+	)
+	for i := 0; i < 20; i++ {
+		sr, err := storage.WriteBytes(ctx, s, []byte("blob "+strconv.Itoa(i)))
+		require.NoError(t, err)
+		refs = append(refs, sr.Ref)
+		exp = append(exp, sr)
+		if i%5 == 0 {
+			// missing blobs are skipped
+			refs = append(refs, types.StringRef("missing "+strconv.Itoa(i)))
+		}
+	}
+	got, err := storage.StatBlobs(ctx, s, refs)
+	require.NoError(t, err)
+	require.Equal(t, exp, got)
+
+	got, err = storage.StatBlobs(ctx, s, nil)
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	_, err = storage.StatBlobs(ctx, s, []types.Ref{exp[0].Ref, {}})
+	require.Equal(t, storage.ErrInvalidRef, err)
+}
+
+// testFaults checks that failed reads and writes are reported and never leave corrupted blobs in the storage.
+func testFaults(t *testing.T, fnc StorageFunc) {
+	s, closer := fnc(t)
+	defer closer()
+
+	ctx := context.Background()
+	fs := faulty.New(s, faulty.Config{ShortWrites: 1})
+
+	data := []byte("data with a short write")
+	_, err := storage.WriteBytes(ctx, fs, data)
+	require.Equal(t, faulty.ErrInjected, err)
+	_, err = s.StatBlob(ctx, types.BytesRef(data))
+	require.Equal(t, storage.ErrNotFound, err)
+
+	fs.SetConfig(faulty.Config{ReadErrors: 1})
+	sr, err := storage.WriteBytes(ctx, fs, data)
+	require.NoError(t, err)
+	rc, _, err := fs.FetchBlob(ctx, sr.Ref)
+	require.NoError(t, err)
+	_, err = types.Hash(rc)
+	rc.Close()
+	require.Equal(t, faulty.ErrInjected, err)
+
+	// packs are either stored completely, or only contain valid blobs
+	src := storage.NewInMemory()
+	var refs []types.Ref
+	for i := 0; i < 20; i++ {
+		sr, err := storage.WriteBytes(ctx, src, []byte(strings.Repeat("pack blob "+strconv.Itoa(i), 50)))
+		require.NoError(t, err)
+		refs = append(refs, sr.Ref)
+	}
+	pack := func() io.Reader {
+		buf := new(bytes.Buffer)
+		require.NoError(t, storage.WriteBlobPack(ctx, buf, src, refs))
+		return buf
+	}
+	fs.SetConfig(faulty.Config{Seed: 1, ShortWrites: 0.2})
+	_, err = storage.ReadPack(ctx, fs, pack())
+	require.Equal(t, faulty.ErrInjected, err)
+	for _, ref := range refs {
+		rc, _, err := s.FetchBlob(ctx, ref)
+		if err == storage.ErrNotFound {
+			continue
+		}
+		require.NoError(t, err)
+		got, err := types.Hash(rc)
+		rc.Close()
+		require.NoError(t, err)
+		require.Equal(t, ref, got.Ref)
+	}
+
+	fs.SetConfig(faulty.Config{})
+	_, err = storage.ReadPack(ctx, fs, pack())
+	require.NoError(t, err)
+	got, err := storage.StatBlobs(ctx, s, refs)
+	require.NoError(t, err)
+	require.Len(t, got, len(refs))
 }
 
 func testSimple(t *testing.T, fnc StorageFunc) {
@@ -74,3 +267,228 @@ func testSimple(t *testing.T, fnc StorageFunc) {
 	require.False(t, it.Next())
 	require.NoError(t, it.Err())
 }
+
+func testDelete(t *testing.T, fnc StorageFunc) {
+	s, closer := fnc(t)
+	defer closer()
+
+	del, ok := s.(storage.BlobDeleter)
+	if !ok {
+		t.SkipNow()
+	}
+
+	ctx := context.Background()
+	sr, err := storage.WriteBytes(ctx, s, []byte("useful data"))
+	require.NoError(t, err)
+
+	err = del.DeleteBlob(ctx, sr.Ref)
+	require.NoError(t, err)
+
+	_, err = s.StatBlob(ctx, sr.Ref)
+	require.Equal(t, storage.ErrNotFound, err)
+
+	err = del.DeleteBlob(ctx, sr.Ref)
+	require.Equal(t, storage.ErrNotFound, err)
+
+	it := s.IterateBlobs(ctx)
+	defer it.Close()
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+}
+
+func testPrefix(t *testing.T, fnc StorageFunc) {
+	s, closer := fnc(t)
+	defer closer()
+
+	ctx := context.Background()
+	var all []types.SizedRef
+	for i := 0; i < 32; i++ {
+		sr, err := storage.WriteBytes(ctx, s, []byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+		all = append(all, sr)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Ref.String() < all[j].Ref.String()
+	})
+
+	list := func(prefix string) []types.SizedRef {
+		it := storage.IterateBlobsPrefix(ctx, s, prefix)
+		defer it.Close()
+		var out []types.SizedRef
+		for it.Next() {
+			out = append(out, it.SizedRef())
+		}
+		require.NoError(t, it.Err())
+		sort.Slice(out, func(i, j int) bool {
+			return out[i].Ref.String() < out[j].Ref.String()
+		})
+		return out
+	}
+
+	name := all[0].Ref.String()
+	hash := name[strings.IndexByte(name, ':')+1:]
+	for _, prefix := range []string{
+		"", "sha", name[:len(name)-len(hash)],
+		name[:len(name)-len(hash)+1],
+		name[:len(name)-len(hash)+3],
+		name[:len(name)-len(hash)+5],
+		name, "sha256:x", "md5:",
+	} {
+		var exp []types.SizedRef
+		for _, sr := range all {
+			if strings.HasPrefix(sr.Ref.String(), prefix) {
+				exp = append(exp, sr)
+			}
+		}
+		require.Equal(t, exp, list(prefix), "prefix: %q", prefix)
+	}
+}
+
+func testPinCAS(t *testing.T, fnc StorageFunc) {
+	s, closer := fnc(t)
+	defer closer()
+
+	ps, ok := s.(storage.PinSwapper)
+	if !ok {
+		t.SkipNow()
+	}
+
+	ctx := context.Background()
+	r1 := types.BytesRef([]byte("v1"))
+	r2 := types.BytesRef([]byte("v2"))
+	const name = "shared"
+
+	// create
+	err := ps.SetPinCAS(ctx, name, types.Ref{}, r1)
+	require.NoError(t, err)
+	err = ps.SetPinCAS(ctx, name, types.Ref{}, r2)
+	require.Equal(t, storage.ErrPinConflict, err)
+
+	// update
+	err = ps.SetPinCAS(ctx, name, r2, r1)
+	require.Equal(t, storage.ErrPinConflict, err)
+	err = ps.SetPinCAS(ctx, name, r1, r2)
+	require.NoError(t, err)
+
+	ref, err := s.GetPin(ctx, name)
+	require.NoError(t, err)
+	require.Equal(t, r2, ref)
+
+	// delete
+	err = ps.SetPinCAS(ctx, name, r1, types.Ref{})
+	require.Equal(t, storage.ErrPinConflict, err)
+	err = ps.SetPinCAS(ctx, name, r2, types.Ref{})
+	require.NoError(t, err)
+
+	_, err = s.GetPin(ctx, name)
+	require.Equal(t, storage.ErrNotFound, err)
+
+	err = ps.SetPinCAS(ctx, name, types.Ref{}, types.Ref{})
+	require.NoError(t, err)
+}
+
+func testPinHistory(t *testing.T, fnc StorageFunc) {
+	s, closer := fnc(t)
+	defer closer()
+
+	ph, ok := s.(storage.PinHistorian)
+	if !ok {
+		t.SkipNow()
+	}
+
+	ctx := context.Background()
+	r1 := types.BytesRef([]byte("v1"))
+	r2 := types.BytesRef([]byte("v2"))
+	const name = "snap"
+
+	_, err := ph.PinHistory(ctx, name)
+	require.Equal(t, storage.ErrNotFound, err)
+
+	require.NoError(t, s.SetPin(ctx, name, r1))
+	require.NoError(t, s.SetPin(ctx, name, r2))
+	require.NoError(t, s.DeletePin(ctx, name))
+
+	hist, err := ph.PinHistory(ctx, name)
+	require.NoError(t, err)
+	var refs []types.Ref
+	for _, r := range hist {
+		require.False(t, r.Time.IsZero())
+		refs = append(refs, r.Ref)
+	}
+	require.Equal(t, []types.Ref{r1, r2, {}}, refs)
+
+	_, err = storage.RollbackPin(ctx, s, name, 3)
+	require.NotNil(t, err)
+
+	ref, err := storage.RollbackPin(ctx, s, name, 2)
+	require.NoError(t, err)
+	require.Equal(t, r1, ref)
+	ref, err = s.GetPin(ctx, name)
+	require.NoError(t, err)
+	require.Equal(t, r1, ref)
+
+	// rollback is recorded as well
+	ref, err = storage.RollbackPin(ctx, s, name, 1)
+	require.NoError(t, err)
+	require.True(t, ref.Zero())
+	_, err = s.GetPin(ctx, name)
+	require.Equal(t, storage.ErrNotFound, err)
+
+	hist, err = ph.PinHistory(ctx, name)
+	require.NoError(t, err)
+	require.Len(t, hist, 5)
+}
+
+func testPinMeta(t *testing.T, fnc StorageFunc) {
+	s, closer := fnc(t)
+	defer closer()
+
+	ms, ok := s.(storage.PinMetaStorage)
+	if !ok {
+		t.SkipNow()
+	}
+
+	ctx := context.Background()
+	const name = "release"
+	now := time.Unix(1500000000, 0).UTC()
+	meta := &types.PinMeta{
+		Created: now, Updated: now,
+		Author:      "alice",
+		Description: "first release",
+		Labels:      map[string]string{"env": "prod"},
+	}
+
+	err := ms.SetPinMeta(ctx, name, meta)
+	require.Equal(t, storage.ErrNotFound, err)
+	_, err = ms.GetPinMeta(ctx, name)
+	require.Equal(t, storage.ErrNotFound, err)
+
+	require.NoError(t, s.SetPin(ctx, name, types.BytesRef([]byte("v1"))))
+	got, err := ms.GetPinMeta(ctx, name)
+	require.NoError(t, err)
+	require.Nil(t, got)
+
+	require.NoError(t, ms.SetPinMeta(ctx, name, meta))
+	got, err = ms.GetPinMeta(ctx, name)
+	require.NoError(t, err)
+	require.Equal(t, meta, got)
+
+	// metadata is kept when the pin changes
+	require.NoError(t, s.SetPin(ctx, name, types.BytesRef([]byte("v2"))))
+	got, err = ms.GetPinMeta(ctx, name)
+	require.NoError(t, err)
+	require.Equal(t, meta, got)
+
+	// and is removed with the pin
+	require.NoError(t, s.DeletePin(ctx, name))
+	require.NoError(t, s.SetPin(ctx, name, types.BytesRef([]byte("v3"))))
+	got, err = ms.GetPinMeta(ctx, name)
+	require.NoError(t, err)
+	require.Nil(t, got)
+
+	require.NoError(t, ms.SetPinMeta(ctx, name, meta))
+	require.NoError(t, ms.SetPinMeta(ctx, name, nil))
+	got, err = ms.GetPinMeta(ctx, name)
+	require.NoError(t, err)
+	require.Nil(t, got)
+}
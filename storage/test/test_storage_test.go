@@ -1,13 +1,896 @@
 package storagetest
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas/sched"
+	"github.com/dennwc/cas/schema"
 	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/local"
+	"github.com/dennwc/cas/types"
 )
 
 func TestMemory(t *testing.T) {
 	RunTests(t, func(_ testing.TB) (storage.Storage, func()) {
 		return storage.NewInMemory(), func() {}
 	})
+	t.Run("bulk", func(t *testing.T) {
+		ctx := context.Background()
+		s := storage.NewInMemory()
+		a, err := storage.WriteBytes(ctx, s, []byte("a"))
+		require.NoError(t, err)
+		b, err := storage.WriteBytes(ctx, s, []byte("bb"))
+		require.NoError(t, err)
+
+		mr, err := storage.FetchBlobs(ctx, s, []types.Ref{b.Ref, types.StringRef("missing"), a.Ref})
+		require.NoError(t, err)
+		defer mr.Close()
+		var got []string
+		for mr.Next() {
+			data, err := ioutil.ReadAll(mr)
+			require.NoError(t, err)
+			require.Equal(t, uint64(len(data)), mr.SizedRef().Size)
+			got = append(got, string(data))
+		}
+		require.NoError(t, mr.Err())
+		require.Equal(t, []string{"bb", "a"}, got)
+	})
+}
+
+func TestUnion(t *testing.T) {
+	RunTests(t, func(_ testing.TB) (storage.Storage, func()) {
+		return storage.NewUnion(storage.NewInMemory(), storage.NewInMemory()), func() {}
+	})
+	t.Run("layers", func(t *testing.T) {
+		ctx := context.Background()
+		upper, lower := storage.NewInMemory(), storage.NewInMemory()
+
+		shared, err := storage.WriteBytes(ctx, lower, []byte("shared"))
+		require.NoError(t, err)
+		require.NoError(t, lower.SetPin(ctx, "root", shared.Ref))
+
+		s := storage.NewUnion(upper, lower)
+		sz, err := s.StatBlob(ctx, shared.Ref)
+		require.NoError(t, err)
+		require.Equal(t, shared.Size, sz)
+
+		ref, err := s.GetPin(ctx, "root")
+		require.NoError(t, err)
+		require.Equal(t, shared.Ref, ref)
+
+		local, err := storage.WriteBytes(ctx, s, []byte("local"))
+		require.NoError(t, err)
+		_, err = upper.StatBlob(ctx, local.Ref)
+		require.NoError(t, err)
+		_, err = lower.StatBlob(ctx, local.Ref)
+		require.Equal(t, storage.ErrNotFound, err)
+
+		require.NoError(t, s.SetPin(ctx, "root", local.Ref))
+		ref, err = s.GetPin(ctx, "root")
+		require.NoError(t, err)
+		require.Equal(t, local.Ref, ref)
+
+		var got []types.Pin
+		it := s.IteratePins(ctx)
+		for it.Next() {
+			got = append(got, it.Pin())
+		}
+		require.NoError(t, it.Err())
+		it.Close()
+		require.Equal(t, []types.Pin{{Name: "root", Ref: local.Ref}}, got)
+	})
+}
+
+func TestCache(t *testing.T) {
+	RunTests(t, func(t testing.TB) (storage.Storage, func()) {
+		s, err := storage.NewCache(storage.NewInMemory(), storage.NewInMemory(), 1024)
+		require.NoError(t, err)
+		return s, func() {}
+	})
+	t.Run("lru", func(t *testing.T) {
+		ctx := context.Background()
+		remote, cache := storage.NewInMemory(), storage.NewInMemory()
+
+		var refs []types.SizedRef
+		for _, data := range []string{"aaaa", "bbbb", "cccc"} {
+			sr, err := storage.WriteBytes(ctx, remote, []byte(data))
+			require.NoError(t, err)
+			refs = append(refs, sr)
+		}
+		s, err := storage.NewCache(remote, cache, 8)
+		require.NoError(t, err)
+
+		fetch := func(sr types.SizedRef) {
+			rc, _, err := s.FetchBlob(ctx, sr.Ref)
+			require.NoError(t, err)
+			got, err := types.Hash(rc)
+			rc.Close()
+			require.NoError(t, err)
+			require.Equal(t, sr, got)
+		}
+		fetch(refs[0])
+		fetch(refs[1])
+		fetch(refs[0])
+		require.Equal(t, storage.CacheStats{Hits: 1, Misses: 2, Count: 2, Size: 8}, s.Stats())
+
+		// the least recently used blob is evicted
+		fetch(refs[2])
+		require.Equal(t, storage.CacheStats{Hits: 1, Misses: 3, Evictions: 1, Count: 2, Size: 8}, s.Stats())
+		_, err = cache.StatBlob(ctx, refs[1].Ref)
+		require.Equal(t, storage.ErrNotFound, err)
+		_, err = cache.StatBlob(ctx, refs[0].Ref)
+		require.NoError(t, err)
+	})
+	t.Run("evict unlocked", func(t *testing.T) {
+		ctx := context.Background()
+		remote := storage.NewInMemory()
+		cache := &callbackDeleter{Storage: storage.NewInMemory()}
+
+		var refs []types.SizedRef
+		for _, data := range []string{"aaaa", "bbbb"} {
+			sr, err := storage.WriteBytes(ctx, remote, []byte(data))
+			require.NoError(t, err)
+			refs = append(refs, sr)
+		}
+		s, err := storage.NewCache(remote, cache, 4)
+		require.NoError(t, err)
+
+		// deletion must not block other operations of the cache
+		var stats []storage.CacheStats
+		cache.fnc = func() {
+			stats = append(stats, s.Stats())
+		}
+		for _, sr := range refs {
+			rc, _, err := s.FetchBlob(ctx, sr.Ref)
+			require.NoError(t, err)
+			_, err = ioutil.ReadAll(rc)
+			rc.Close()
+			require.NoError(t, err)
+		}
+		require.Equal(t, []storage.CacheStats{{Misses: 2, Evictions: 1, Count: 1, Size: 4}}, stats)
+	})
+}
+
+// callbackDeleter calls a function before deleting a blob.
+type callbackDeleter struct {
+	storage.Storage
+	fnc func()
+}
+
+func (s *callbackDeleter) DeleteBlob(ctx context.Context, ref types.Ref) error {
+	if s.fnc != nil {
+		s.fnc()
+	}
+	return s.Storage.(storage.BlobDeleter).DeleteBlob(ctx, ref)
+}
+
+func TestTiered(t *testing.T) {
+	RunTests(t, func(t testing.TB) (storage.Storage, func()) {
+		s, err := storage.NewTiered(storage.NewInMemory(), storage.NewInMemory(), storage.TierOptions{})
+		require.NoError(t, err)
+		return s, func() {}
+	})
+	t.Run("policy", func(t *testing.T) {
+		ctx := context.Background()
+		hot, cold := storage.NewInMemory(), storage.NewInMemory()
+
+		write := func(data string) types.Ref {
+			sr, err := storage.WriteBytes(ctx, hot, []byte(data))
+			require.NoError(t, err)
+			return sr.Ref
+		}
+		commit := func(root types.Ref, parent *types.Ref, age time.Duration) types.Ref {
+			buf := new(bytes.Buffer)
+			err := schema.Encode(buf, &schema.Commit{Root: root, Parent: parent, Time: time.Now().Add(-age)})
+			require.NoError(t, err)
+			return write(buf.String())
+		}
+		v1, v2, v3 := write("old"), write("recent"), write("current")
+		c1 := commit(v1, nil, 48*time.Hour)
+		c2 := commit(v2, &c1, time.Hour)
+		c3 := commit(v3, &c2, 0)
+		garbage, archived, small := write("garbage"), write("archived"), write("x")
+		require.NoError(t, hot.SetPin(ctx, "root", c3))
+		require.NoError(t, hot.SetPin(ctx, "old", archived))
+		require.NoError(t, hot.SetPin(ctx, "small", small))
+
+		s, err := storage.NewTiered(hot, cold, storage.TierOptions{
+			Policy: storage.TierPolicy{MaxAge: 24 * time.Hour, Archive: []string{"old"}, MinSize: 2},
+		})
+		require.NoError(t, err)
+		defer s.Close()
+		require.NoError(t, s.Migrate(ctx))
+		require.Equal(t, uint64(4), s.Stats().Migrated)
+
+		for _, ref := range []types.Ref{v2, v3, c2, c3, small} {
+			_, err = hot.StatBlob(ctx, ref)
+			require.NoError(t, err, "%v should be hot", ref)
+		}
+		for _, ref := range []types.Ref{v1, c1, garbage, archived} {
+			_, err = hot.StatBlob(ctx, ref)
+			require.Equal(t, storage.ErrNotFound, err, "%v should be cold", ref)
+			_, err = cold.StatBlob(ctx, ref)
+			require.NoError(t, err)
+		}
+
+		// cold blobs are still readable and are restored in background
+		rc, _, err := s.FetchBlob(ctx, v1)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		require.Equal(t, "old", string(data))
+		s.Wait()
+		st := s.Stats()
+		require.Equal(t, uint64(1), st.ColdHits)
+		require.Equal(t, uint64(1), st.Restored)
+		_, err = hot.StatBlob(ctx, v1)
+		require.NoError(t, err)
+	})
+}
+
+func TestEncoded(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	codecs := func(t testing.TB, key []byte) []storage.Codec {
+		enc, err := storage.AESGCM(key)
+		require.NoError(t, err)
+		return []storage.Codec{storage.Gzip(gzip.DefaultCompression), enc}
+	}
+	RunTests(t, func(t testing.TB) (storage.Storage, func()) {
+		s, err := storage.NewEncoded(context.Background(), storage.NewInMemory(), codecs(t, key)...)
+		require.NoError(t, err)
+		return s, func() {}
+	})
+	t.Run("order", func(t *testing.T) {
+		c := codecs(t, key)
+		_, err := storage.NewEncoded(context.Background(), storage.NewInMemory(), c[1], c[0])
+		require.IsType(t, storage.ErrCodecOrder{}, err)
+	})
+	t.Run("manifest", func(t *testing.T) {
+		ctx := context.Background()
+		back := storage.NewInMemory()
+		s, err := storage.NewEncoded(ctx, back, codecs(t, key)...)
+		require.NoError(t, err)
+
+		// large enough to span multiple encrypted chunks
+		data := bytes.Repeat([]byte("compressible data "), 10000)
+		sr, err := storage.WriteBytes(ctx, s, data)
+		require.NoError(t, err)
+		require.NoError(t, s.SetPin(ctx, "root", sr.Ref))
+
+		// blob is not stored in plain text
+		_, err = back.StatBlob(ctx, sr.Ref)
+		require.Equal(t, storage.ErrNotFound, err)
+		var size uint64
+		it := back.IterateBlobs(ctx)
+		for it.Next() {
+			size += it.SizedRef().Size
+		}
+		require.NoError(t, it.Err())
+		it.Close()
+		require.True(t, size < uint64(len(data))/10, "data is not compressed: %d", size)
+
+		// same config can read the data
+		s2, err := storage.NewEncoded(ctx, back, codecs(t, key)...)
+		require.NoError(t, err)
+		rc, sz, err := s2.FetchBlob(ctx, sr.Ref)
+		require.NoError(t, err)
+		require.Equal(t, uint64(len(data)), sz)
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(data, got))
+
+		// different key, missing codecs or plain access are refused
+		_, err = storage.NewEncoded(ctx, back, codecs(t, bytes.Repeat([]byte{2}, 32))...)
+		require.IsType(t, storage.ErrCodecMismatch{}, err)
+		_, err = storage.NewEncoded(ctx, back, storage.Gzip(gzip.DefaultCompression))
+		require.IsType(t, storage.ErrCodecMismatch{}, err)
+		require.IsType(t, storage.ErrCodecMismatch{}, storage.CheckCodecs(ctx, back))
+
+		// existing plain store cannot be encoded
+		plain := storage.NewInMemory()
+		_, err = storage.WriteBytes(ctx, plain, []byte("plain"))
+		require.NoError(t, err)
+		_, err = storage.NewEncoded(ctx, plain, codecs(t, key)...)
+		require.IsType(t, storage.ErrCodecMismatch{}, err)
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	RunTests(t, func(_ testing.TB) (storage.Storage, func()) {
+		return storage.WithPolicy(storage.NewInMemory(), storage.Policy{MaxSize: 1024, ValidateSchema: true}), func() {}
+	})
+	t.Run("rules", func(t *testing.T) {
+		ctx := context.Background()
+		mem := storage.NewInMemory()
+		s := storage.WithPolicy(mem, storage.Policy{
+			MaxSize:        16,
+			AllowTypes:     []string{schema.MustTypeOf(&types.Pin{})},
+			ValidateSchema: true,
+			Check: func(ctx context.Context, b *storage.BlobInfo) error {
+				if b.Type == "" && b.Size < 2 {
+					return errors.New("too small")
+				}
+				return nil
+			},
+		})
+		_, err := storage.WriteBytes(ctx, s, []byte("data"))
+		require.NoError(t, err)
+
+		_, err = storage.WriteBytes(ctx, s, []byte("data that is too large"))
+		require.Equal(t, storage.ErrPolicy{Reason: "blob is larger than 16 bytes"}, err)
+
+		_, err = storage.WriteBytes(ctx, s, []byte("x"))
+		require.Equal(t, storage.ErrPolicy{Ref: types.StringRef("x"), Reason: "too small"}, err)
+
+		writeSchema := func(o schema.Object) error {
+			buf := new(bytes.Buffer)
+			require.NoError(t, schema.Encode(buf, o))
+			s := storage.WithPolicy(mem, storage.Policy{
+				AllowTypes: []string{schema.MustTypeOf(&types.Pin{})}, ValidateSchema: true,
+			})
+			_, err := storage.WriteBytes(ctx, s, buf.Bytes())
+			return err
+		}
+		require.NoError(t, writeSchema(&types.Pin{Name: "a", Ref: types.StringRef("a")}))
+		err = writeSchema(&schema.Commit{Root: types.StringRef("a")})
+		require.IsType(t, storage.ErrPolicy{}, err)
+
+		// malformed schema blob
+		_, err = storage.WriteBytes(ctx, storage.WithPolicy(mem, storage.Policy{ValidateSchema: true}),
+			[]byte("{\n \"@type\": \"cas:Unknown\"}"))
+		require.IsType(t, storage.ErrPolicy{}, err)
+
+		it := mem.IterateBlobs(ctx)
+		n := 0
+		for it.Next() {
+			n++
+		}
+		require.NoError(t, it.Err())
+		it.Close()
+		require.Equal(t, 2, n)
+	})
+}
+
+func TestScheduled(t *testing.T) {
+	RunTests(t, func(_ testing.TB) (storage.Storage, func()) {
+		return storage.NewScheduled(storage.NewInMemory(), sched.New(sched.Options{Slots: 2})), func() {}
+	})
+	t.Run("release", func(t *testing.T) {
+		ctx := context.Background()
+		s := storage.NewScheduled(storage.NewInMemory(), sched.New(sched.Options{Slots: 1}))
+
+		sr, err := storage.WriteBytes(ctx, s, []byte("data"))
+		require.NoError(t, err)
+
+		rc, _, err := s.FetchBlob(ctx, sr.Ref)
+		require.NoError(t, err)
+
+		// the only slot is held by the reader
+		tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err = s.StatBlob(tctx, sr.Ref)
+		require.Equal(t, context.DeadlineExceeded, err)
+
+		require.NoError(t, rc.Close())
+		_, err = s.StatBlob(ctx, sr.Ref)
+		require.NoError(t, err)
+	})
+}
+
+func TestLimit(t *testing.T) {
+	RunTests(t, func(_ testing.TB) (storage.Storage, func()) {
+		return storage.Limit(storage.NewInMemory(), storage.LimitOptions{
+			Fetch: storage.Limits{Concurrency: 1},
+			Store: storage.Limits{Concurrency: 1},
+		}), func() {}
+	})
+	t.Run("concurrency", func(t *testing.T) {
+		ctx := context.Background()
+		s := storage.Limit(storage.NewInMemory(), storage.LimitOptions{
+			Fetch: storage.Limits{Concurrency: 1},
+		})
+
+		sr, err := storage.WriteBytes(ctx, s, []byte("data"))
+		require.NoError(t, err)
+
+		rc, _, err := s.FetchBlob(ctx, sr.Ref)
+		require.NoError(t, err)
+
+		// the only slot is held by the reader
+		tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, _, err = s.FetchBlob(tctx, sr.Ref)
+		require.Equal(t, context.DeadlineExceeded, err)
+
+		// other operations are not limited
+		_, err = s.StatBlob(tctx, sr.Ref)
+		require.NoError(t, err)
+
+		require.NoError(t, rc.Close())
+		rc, _, err = s.FetchBlob(ctx, sr.Ref)
+		require.NoError(t, err)
+		rc.Close()
+	})
+	t.Run("throughput", func(t *testing.T) {
+		ctx := context.Background()
+		s := storage.Limit(storage.NewInMemory(), storage.LimitOptions{
+			Store: storage.Limits{BytesPerSec: 1000, Burst: 100},
+		})
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			_, err := storage.WriteBytes(ctx, s, []byte{byte(i), 99: 0})
+			require.NoError(t, err)
+		}
+		// the first write used the burst, next ones should wait for 100ms each
+		require.True(t, time.Since(start) >= 150*time.Millisecond)
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	RunTests(t, func(_ testing.TB) (storage.Storage, func()) {
+		return storage.Instrument(storage.NewInMemory(), storage.NewMetrics()), func() {}
+	})
+	t.Run("prometheus", func(t *testing.T) {
+		ctx := context.Background()
+		m := storage.NewMetrics()
+		s := storage.Instrument(storage.NewInMemory(), m)
+
+		sr, err := storage.WriteBytes(ctx, s, []byte("data"))
+		require.NoError(t, err)
+		_, err = s.StatBlob(ctx, sr.Ref)
+		require.NoError(t, err)
+		_, err = s.GetPin(ctx, "missing")
+		require.Equal(t, storage.ErrNotFound, err)
+		w, err := s.BeginBlob(ctx)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		err = w.Commit()
+		require.NotNil(t, err)
+
+		rc, _, err := s.FetchBlob(ctx, sr.Ref)
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+
+		buf := new(bytes.Buffer)
+		err = m.WritePrometheus(buf)
+		require.NoError(t, err)
+		out := buf.String()
+		for _, line := range []string{
+			`cas_storage_operations_total{method="StatBlob"} 1`,
+			`cas_storage_operations_total{method="Commit"} 2`,
+			`cas_storage_operations_total{method="GetPin"} 1`,
+			`cas_storage_errors_total{method="GetPin"} 0`,
+			`cas_storage_errors_total{method="Commit"} 1`,
+			`cas_storage_operation_duration_seconds_bucket{method="StatBlob",le="+Inf"} 1`,
+			`cas_storage_operation_duration_seconds_count{method="FetchBlob"} 1`,
+			`cas_storage_read_bytes_total 4`,
+			`cas_storage_written_bytes_total 4`,
+		} {
+			require.Contains(t, out, line+"\n")
+		}
+	})
+}
+
+func TestWrappersForward(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_wrap_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	st, err := local.New(dir, true)
+	require.NoError(t, err)
+	defer st.Close()
+
+	sr, err := storage.WriteBytes(ctx, st, []byte("data"))
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		name string
+		s    storage.Storage
+		file bool
+	}{
+		{"scheduled", storage.NewScheduled(st, sched.New(sched.Options{Slots: 1})), true},
+		{"limit", storage.Limit(st, storage.LimitOptions{Fetch: storage.Limits{Concurrency: 1}}), true},
+		// reads from the file cannot be throttled
+		{"throttled", storage.Limit(st, storage.LimitOptions{Fetch: storage.Limits{BytesPerSec: 1 << 20}}), false},
+		{"metrics", storage.Instrument(st, storage.NewMetrics()), true},
+		{"policy", storage.WithPolicy(st, storage.Policy{MaxSize: 100}), true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			require.Implements(t, (*storage.BlobOpener)(nil), c.s)
+			require.Implements(t, (*storage.BulkFetcher)(nil), c.s)
+			require.Implements(t, (*storage.BulkStater)(nil), c.s)
+			require.Implements(t, (*storage.PrefixIterator)(nil), c.s)
+
+			rc, _, err := c.s.FetchBlob(ctx, sr.Ref)
+			require.NoError(t, err)
+			_, ok := storage.BlobFile(rc)
+			require.NoError(t, rc.Close())
+			require.Equal(t, c.file, ok)
+
+			br, sz, err := storage.OpenBlob(ctx, c.s, sr.Ref)
+			require.NoError(t, err)
+			require.Equal(t, sr.Size, sz)
+			buf := make([]byte, 2)
+			_, err = br.ReadAt(buf, 2)
+			require.NoError(t, err)
+			require.NoError(t, br.Close())
+			require.Equal(t, "ta", string(buf))
+
+			srs, err := storage.StatBlobs(ctx, c.s, []types.Ref{sr.Ref})
+			require.NoError(t, err)
+			require.Equal(t, []types.SizedRef{sr}, srs)
+
+			it := storage.IterateBlobsPrefix(ctx, c.s, sr.Ref.String()[:10])
+			require.True(t, it.Next())
+			require.Equal(t, sr, it.SizedRef())
+			require.NoError(t, it.Close())
+		})
+	}
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cas_spool_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", dir)
+
+	var (
+		got  []byte
+		tee  bytes.Buffer
+		fail bool
+	)
+	newWriter := func() storage.BlobWriter {
+		w, err := storage.Spool("cas_test_", &tee, func(sr types.SizedRef, f *os.File) error {
+			if fail {
+				return errors.New("commit failed")
+			}
+			var err error
+			got, err = ioutil.ReadAll(f)
+			return err
+		})
+		require.NoError(t, err)
+		_, err = w.Write([]byte("data"))
+		require.NoError(t, err)
+		return w
+	}
+	noFiles := func() {
+		names, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, names)
+	}
+
+	// committed
+	w := newWriter()
+	_, err = w.Complete()
+	require.NoError(t, err)
+	require.NoError(t, w.Commit())
+	w.Close()
+	require.Equal(t, "data", string(got))
+	require.Equal(t, "data", tee.String())
+	noFiles()
+
+	// completed, but not committed
+	w = newWriter()
+	_, err = w.Complete()
+	require.NoError(t, err)
+	w.Close()
+	noFiles()
+
+	// failed to store
+	fail = true
+	w = newWriter()
+	_, err = w.Complete()
+	require.NoError(t, err)
+	require.Error(t, w.Commit())
+	w.Close()
+	noFiles()
+}
+
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+func (sp *testSpan) SetAttributes(attrs ...storage.Attribute) {
+	for _, a := range attrs {
+		sp.attrs[a.Key] = a.Value
+	}
+}
+
+func (sp *testSpan) RecordError(err error) { sp.err = err }
+func (sp *testSpan) End()                  { sp.ended = true }
+
+type spanKey struct{}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, storage.Span) {
+	parent, _ := ctx.Value(spanKey{}).(*testSpan)
+	sp := &testSpan{name: name, parent: parent, attrs: make(map[string]interface{})}
+	t.mu.Lock()
+	t.spans = append(t.spans, sp)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+func TestTraced(t *testing.T) {
+	tr := &testTracer{}
+	storage.SetTracer(tr)
+	defer storage.SetTracer(nil)
+
+	RunTests(t, func(_ testing.TB) (storage.Storage, func()) {
+		return storage.Traced(storage.NewInMemory()), func() {}
+	})
+	t.Run("spans", func(t *testing.T) {
+		tr.mu.Lock()
+		tr.spans = nil
+		tr.mu.Unlock()
+
+		ctx, root := tr.Start(context.Background(), "root")
+		s := storage.Traced(storage.NewInMemory())
+		sr, err := storage.WriteBytes(ctx, s, []byte("data"))
+		require.NoError(t, err)
+		_, err = s.GetPin(ctx, "missing")
+		require.Equal(t, storage.ErrNotFound, err)
+		rc, _, err := s.FetchBlob(ctx, sr.Ref)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+
+		spans := tr.spans[1:]
+		require.Len(t, spans, 3)
+		for _, sp := range spans {
+			require.True(t, sp.ended, sp.name)
+			require.Nil(t, sp.err, sp.name)
+			require.Equal(t, root, sp.parent, sp.name)
+			require.Equal(t, "*storage.memStorage", sp.attrs[storage.AttrBackend])
+		}
+		require.Equal(t, "storage.StoreBlob", spans[0].name)
+		require.Equal(t, sr.Ref.String(), spans[0].attrs[storage.AttrRef])
+		require.Equal(t, uint64(4), spans[0].attrs[storage.AttrSize])
+		require.Equal(t, "storage.GetPin", spans[1].name)
+		require.Equal(t, "missing", spans[1].attrs[storage.AttrPin])
+		require.Equal(t, "storage.FetchBlob", spans[2].name)
+		require.Equal(t, uint64(4), spans[2].attrs[storage.AttrSize])
+	})
+}
+
+// brokenPins is a storage that fails all pin reads.
+type brokenPins struct {
+	storage.Storage
+}
+
+func (brokenPins) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	return types.Ref{}, errors.New("broken")
+}
+
+// packStorage accepts packs and blocks replicated pin writes until released.
+type packStorage struct {
+	storage.Storage
+	release chan struct{}
+	packs   int
+}
+
+func (s *packStorage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	<-s.release
+	return s.Storage.SetPin(ctx, name, ref)
+}
+
+func (s *packStorage) StorePack(ctx context.Context, r io.Reader) (types.SizedRef, error) {
+	s.packs++
+	return storage.ReadPack(ctx, s.Storage, r)
+}
+
+func TestMirror(t *testing.T) {
+	t.Run("sync", func(t *testing.T) {
+		RunTests(t, func(_ testing.TB) (storage.Storage, func()) {
+			return storage.NewMirror(storage.NewInMemory(), storage.NewInMemory()), func() {}
+		})
+	})
+	t.Run("async", func(t *testing.T) {
+		RunTests(t, func(_ testing.TB) (storage.Storage, func()) {
+			return storage.NewMirrorWithOptions(storage.MirrorOptions{Async: true},
+				storage.NewInMemory(), storage.NewInMemory()), func() {}
+		})
+	})
+	for _, async := range []bool{false, true} {
+		name := "replicate sync"
+		if async {
+			name = "replicate async"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			primary, replica := storage.NewInMemory(), storage.NewInMemory()
+			s := storage.NewMirrorWithOptions(storage.MirrorOptions{Async: async}, primary, replica)
+			defer s.Close()
+
+			sr, err := storage.WriteBytes(ctx, s, []byte("data"))
+			require.NoError(t, err)
+			err = s.SetPin(ctx, "root", sr.Ref)
+			require.NoError(t, err)
+			s.Wait()
+			require.Equal(t, storage.MirrorStats{}, s.Stats())
+
+			_, err = replica.StatBlob(ctx, sr.Ref)
+			require.NoError(t, err)
+			ref, err := replica.GetPin(ctx, "root")
+			require.NoError(t, err)
+			require.Equal(t, sr.Ref, ref)
+
+			err = s.DeletePin(ctx, "root")
+			require.NoError(t, err)
+			s.Wait()
+			_, err = replica.GetPin(ctx, "root")
+			require.Equal(t, storage.ErrNotFound, err)
+		})
+	}
+	t.Run("batch", func(t *testing.T) {
+		ctx := context.Background()
+		primary := storage.NewInMemory()
+		replica := &packStorage{Storage: storage.NewInMemory(), release: make(chan struct{})}
+		s := storage.NewMirrorWithOptions(storage.MirrorOptions{Async: true, BatchSize: 8}, primary, replica)
+		defer s.Close()
+
+		// block the replication until all blobs are queued
+		err := s.SetPin(ctx, "root", types.StringRef("root"))
+		require.NoError(t, err)
+		var refs []types.Ref
+		for i := 0; i < 10; i++ {
+			sr, err := storage.WriteBytes(ctx, s, []byte(fmt.Sprintf("blob %d", i)))
+			require.NoError(t, err)
+			refs = append(refs, sr.Ref)
+		}
+		close(replica.release)
+		s.Wait()
+		require.Equal(t, storage.MirrorStats{Batches: 2}, s.Stats())
+		require.Equal(t, 2, replica.packs)
+		for _, ref := range refs {
+			_, err = replica.StatBlob(ctx, ref)
+			require.NoError(t, err)
+		}
+	})
+	t.Run("failover", func(t *testing.T) {
+		ctx := context.Background()
+		primary, replica := storage.NewInMemory(), storage.NewInMemory()
+		s := storage.NewMirror(brokenPins{primary}, replica)
+		defer s.Close()
+
+		// blob is missing in the primary storage
+		sr, err := storage.WriteBytes(ctx, replica, []byte("data"))
+		require.NoError(t, err)
+		rc, _, err := s.FetchBlob(ctx, sr.Ref)
+		require.NoError(t, err)
+		rc.Close()
+
+		err = s.SetPin(ctx, "root", sr.Ref)
+		require.NoError(t, err)
+		ref, err := s.GetPin(ctx, "root")
+		require.NoError(t, err)
+		require.Equal(t, sr.Ref, ref)
+		require.Equal(t, uint64(2), s.Stats().Failover)
+	})
+}
+
+func TestSharded(t *testing.T) {
+	RunTests(t, func(t testing.TB) (storage.Storage, func()) {
+		s, err := storage.NewSharded(
+			storage.Shard{Name: "a", Storage: storage.NewInMemory()},
+			storage.Shard{Name: "b", Storage: storage.NewInMemory()},
+			storage.Shard{Name: "c", Storage: storage.NewInMemory()},
+		)
+		require.NoError(t, err)
+		return s, func() {}
+	})
+	t.Run("routing", func(t *testing.T) {
+		ctx := context.Background()
+		shards := map[string]storage.Storage{
+			"a": storage.NewInMemory(),
+			"b": storage.NewInMemory(),
+		}
+		s, err := storage.NewSharded(
+			storage.Shard{Name: "a", Storage: shards["a"]},
+			storage.Shard{Name: "b", Storage: shards["b"]},
+		)
+		require.NoError(t, err)
+
+		var refs []types.Ref
+		used := make(map[string]int)
+		for i := 0; i < 32; i++ {
+			sr, err := storage.WriteBytes(ctx, s, []byte(fmt.Sprint("data ", i)))
+			require.NoError(t, err)
+			refs = append(refs, sr.Ref)
+
+			name := s.Locate(sr.Ref)
+			used[name]++
+			_, err = shards[name].StatBlob(ctx, sr.Ref)
+			require.NoError(t, err)
+		}
+		require.Len(t, used, 2)
+
+		// adding a shard keeps existing blobs accessible
+		shards["c"] = storage.NewInMemory()
+		s2, err := storage.NewSharded(
+			storage.Shard{Name: "a", Storage: shards["a"]},
+			storage.Shard{Name: "b", Storage: shards["b"]},
+			storage.Shard{Name: "c", Storage: shards["c"]},
+		)
+		require.NoError(t, err)
+		moved := 0
+		for _, ref := range refs {
+			if s.Locate(ref) != s2.Locate(ref) {
+				require.Equal(t, "c", s2.Locate(ref))
+				moved++
+			}
+			_, err = s2.StatBlob(ctx, ref)
+			require.NoError(t, err)
+		}
+		require.True(t, moved < len(refs)/2, "moved: %d", moved)
+
+		_, err = storage.NewSharded(
+			storage.Shard{Name: "a", Storage: shards["a"]},
+			storage.Shard{Name: "a", Storage: shards["b"]},
+		)
+		require.NotNil(t, err)
+	})
+}
+
+func TestCombined(t *testing.T) {
+	RunTests(t, func(_ testing.TB) (storage.Storage, func()) {
+		s := storage.NewInMemory()
+		return storage.Combine(s, s), func() {}
+	})
+	t.Run("partial", func(t *testing.T) {
+		ctx := context.Background()
+		mem := storage.NewInMemory()
+		sr, err := storage.WriteBytes(ctx, mem, []byte("data"))
+		require.NoError(t, err)
+
+		// read-only mirror without pins
+		s := storage.Combine(struct{ storage.BlobSource }{mem}, nil)
+		defer s.Close()
+		sz, err := s.StatBlob(ctx, sr.Ref)
+		require.NoError(t, err)
+		require.Equal(t, sr.Size, sz)
+		_, err = s.BeginBlob(ctx)
+		require.Equal(t, storage.ErrReadOnly, err)
+
+		_, err = s.GetPin(ctx, "root")
+		require.Equal(t, storage.ErrNotFound, err)
+		require.Equal(t, storage.ErrReadOnly, s.SetPin(ctx, "root", sr.Ref))
+		it := s.IteratePins(ctx)
+		require.False(t, it.Next())
+		require.NoError(t, it.Close())
+
+		// read-only pins
+		require.NoError(t, mem.SetPin(ctx, "root", sr.Ref))
+		s = storage.Combine(mem, struct{ storage.PinSource }{mem})
+		ref, err := s.GetPin(ctx, "root")
+		require.NoError(t, err)
+		require.Equal(t, sr.Ref, ref)
+		require.Equal(t, storage.ErrReadOnly, s.DeletePin(ctx, "root"))
+		_, err = storage.WriteBytes(ctx, s, []byte("more"))
+		require.NoError(t, err)
+	})
 }
@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/types"
+)
+
+// TierPolicy decides which blobs are kept in the hot storage of a tiered storage.
+//
+// Blobs reachable from the current state of pins are always kept in the hot storage. If a pin points to
+// a commit, blobs of previous commits are kept as long as the commit is younger than MaxAge.
+type TierPolicy struct {
+	// MaxAge is the age of commits after which blobs referenced only by them are moved to the cold storage.
+	// If not set, only the latest commit of each pin is kept in the hot storage.
+	MaxAge time.Duration
+	// Archive is a list of pins that are moved to the cold storage entirely.
+	Archive []string
+	// MinSize is the minimal size of blobs that are moved to the cold storage. Cold storage usually charges
+	// per request, thus it's not worth to move small blobs.
+	MinSize uint64
+}
+
+// TierOptions configures a tiered storage.
+type TierOptions struct {
+	Policy TierPolicy
+	// RestoreQueue is the maximal number of pending restores of cold blobs.
+	// Cold hits are not restored if the queue is full.
+	RestoreQueue int
+	// OnError is called when a blob cannot be restored to the hot storage.
+	OnError func(ref types.Ref, err error)
+}
+
+// TierStats reports the state of a tiered storage.
+type TierStats struct {
+	ColdHits     uint64 // number of blob fetches served from the cold storage
+	Restored     uint64 // number of blobs restored to the hot storage
+	Pending      int    // number of queued restores
+	Migrated     uint64 // number of blobs moved to the cold storage
+	MigratedSize uint64 // total size of blobs moved to the cold storage
+}
+
+// NewTiered creates a storage that keeps recently used blobs in the hot storage and archives the rest in
+// the cold storage (for example, local disk and S3 Glacier).
+//
+// All writes go to the hot storage and blobs are moved to the cold storage by Migrate according to the policy.
+// Reads are served from the hot storage first and fall back to the cold storage. Blobs fetched from the cold
+// storage are restored to the hot storage in background. Pins are only stored in the hot storage.
+//
+// Hot storage must implement BlobDeleter. Closing the tiered storage waits for pending restores and closes both storages.
+func NewTiered(hot, cold Storage, opts TierOptions) (*TieredStorage, error) {
+	del, ok := hot.(BlobDeleter)
+	if !ok {
+		return nil, fmt.Errorf("hot storage doesn't support deletion: %T", hot)
+	}
+	if opts.RestoreQueue <= 0 {
+		opts.RestoreQueue = 1024
+	}
+	s := &TieredStorage{
+		hot: hot, cold: cold, del: del, opts: opts,
+		union:   &unionStorage{layers: []Storage{hot, cold}},
+		queue:   make(chan types.Ref, opts.RestoreQueue),
+		pending: make(map[types.Ref]struct{}),
+	}
+	s.done = sync.NewCond(&s.mu)
+	s.wg.Add(1)
+	go s.restoreLoop()
+	return s, nil
+}
+
+var (
+	_ Storage     = (*TieredStorage)(nil)
+	_ BlobDeleter = (*TieredStorage)(nil)
+)
+
+// TieredStorage moves blobs between hot and cold storages. See NewTiered for details.
+type TieredStorage struct {
+	hot, cold Storage
+	del       BlobDeleter
+	union     *unionStorage
+	opts      TierOptions
+
+	queue chan types.Ref
+	wg    sync.WaitGroup
+
+	mu      sync.Mutex
+	done    *sync.Cond // signaled when pending restores are done
+	pending map[types.Ref]struct{}
+	stats   TierStats
+	closed  bool
+}
+
+// Stats returns the state of the storage.
+func (s *TieredStorage) Stats() TierStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stats
+	st.Pending = len(s.pending)
+	return st
+}
+
+// Wait blocks until all pending restores are done.
+func (s *TieredStorage) Wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.pending) > 0 {
+		s.done.Wait()
+	}
+}
+
+func (s *TieredStorage) Close() error {
+	s.mu.Lock()
+	closed := s.closed
+	s.closed = true
+	s.mu.Unlock()
+	if !closed {
+		s.Wait()
+		close(s.queue)
+		s.wg.Wait()
+	}
+	err := s.hot.Close()
+	if err2 := s.cold.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// restore schedules a copy of a cold blob to the hot storage.
+func (s *TieredStorage) restore(ref types.Ref) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pending[ref]; ok || s.closed {
+		return
+	}
+	select {
+	case s.queue <- ref:
+		s.pending[ref] = struct{}{}
+	default:
+	}
+}
+
+func (s *TieredStorage) restoreLoop() {
+	defer s.wg.Done()
+	ctx := context.Background()
+	for ref := range s.queue {
+		err := copyBlob(ctx, s.hot, s.cold, ref)
+		if err != nil && s.opts.OnError != nil {
+			s.opts.OnError(ref, err)
+		}
+		s.mu.Lock()
+		delete(s.pending, ref)
+		if err == nil {
+			s.stats.Restored++
+		}
+		if len(s.pending) == 0 {
+			s.done.Broadcast()
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *TieredStorage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	return s.union.StatBlob(ctx, ref)
+}
+
+// FetchBlob serves the blob from the hot storage, if possible. Otherwise it reads the blob from the cold storage
+// and schedules a restore of the blob to the hot storage.
+func (s *TieredStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	rc, sz, err := s.hot.FetchBlob(ctx, ref)
+	if err != ErrNotFound {
+		return rc, sz, err
+	}
+	rc, sz, err = s.cold.FetchBlob(ctx, ref)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.mu.Lock()
+	s.stats.ColdHits++
+	s.mu.Unlock()
+	s.restore(ref)
+	return rc, sz, nil
+}
+
+// IterateBlobs lists blobs from both storages.
+func (s *TieredStorage) IterateBlobs(ctx context.Context) Iterator {
+	return s.union.IterateBlobs(ctx)
+}
+
+func (s *TieredStorage) BeginBlob(ctx context.Context) (BlobWriter, error) {
+	return s.hot.BeginBlob(ctx)
+}
+
+// DeleteBlob removes the blob from both storages.
+func (s *TieredStorage) DeleteBlob(ctx context.Context, ref types.Ref) error {
+	err := s.del.DeleteBlob(ctx, ref)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if del, ok := s.cold.(BlobDeleter); ok {
+		err2 := del.DeleteBlob(ctx, ref)
+		if err2 == nil {
+			return nil
+		} else if err2 != ErrNotFound {
+			return err2
+		}
+	}
+	return err
+}
+
+func (s *TieredStorage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	return s.hot.SetPin(ctx, name, ref)
+}
+
+func (s *TieredStorage) DeletePin(ctx context.Context, name string) error {
+	return s.hot.DeletePin(ctx, name)
+}
+
+func (s *TieredStorage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	return s.hot.GetPin(ctx, name)
+}
+
+func (s *TieredStorage) IteratePins(ctx context.Context) PinIterator {
+	return s.hot.IteratePins(ctx)
+}
+
+// Migrate moves blobs that should not be kept in the hot storage according to the policy to the cold storage.
+//
+// Blobs are copied to the cold storage first and are removed from the hot storage only after the copy succeeds.
+func (s *TieredStorage) Migrate(ctx context.Context) error {
+	keep, err := s.hotSet(ctx)
+	if err != nil {
+		return err
+	}
+	var move []types.SizedRef
+	it := s.hot.IterateBlobs(ctx)
+	defer it.Close()
+	for it.Next() {
+		sr := it.SizedRef()
+		if _, ok := keep[sr.Ref]; ok || sr.Size < s.opts.Policy.MinSize {
+			continue
+		}
+		move = append(move, sr)
+	}
+	if err = it.Err(); err != nil {
+		return err
+	}
+	it.Close()
+
+	for _, sr := range move {
+		if err = copyBlob(ctx, s.cold, s.hot, sr.Ref); err != nil {
+			return err
+		}
+		if sz, err := s.cold.StatBlob(ctx, sr.Ref); err != nil {
+			return err
+		} else if sz != sr.Size {
+			return ErrSizeMissmatch{Exp: sr.Size, Got: sz}
+		}
+		if err = s.del.DeleteBlob(ctx, sr.Ref); err != nil && err != ErrNotFound {
+			return err
+		}
+		s.mu.Lock()
+		s.stats.Migrated++
+		s.stats.MigratedSize += sr.Size
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// hotSet returns a set of blobs that should be kept in the hot storage.
+func (s *TieredStorage) hotSet(ctx context.Context) (map[types.Ref]struct{}, error) {
+	archive := make(map[string]struct{}, len(s.opts.Policy.Archive))
+	for _, name := range s.opts.Policy.Archive {
+		archive[name] = struct{}{}
+	}
+	var roots []types.Ref
+	it := s.hot.IteratePins(ctx)
+	defer it.Close()
+	for it.Next() {
+		p := it.Pin()
+		if _, ok := archive[p.Name]; !ok {
+			roots = append(roots, p.Ref)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	it.Close()
+
+	w := &tierWalker{
+		s: s, ctx: ctx,
+		cutoff: time.Now().Add(-s.opts.Policy.MaxAge),
+		seen:   make(map[types.Ref]struct{}),
+	}
+	for _, ref := range roots {
+		if err := w.mark(ref); err != nil {
+			return nil, err
+		}
+	}
+	return w.seen, nil
+}
+
+// tierWalker marks all blobs reachable from pins, including commits that are younger than the cutoff time.
+type tierWalker struct {
+	s      *TieredStorage
+	ctx    context.Context
+	cutoff time.Time
+	seen   map[types.Ref]struct{}
+}
+
+// decode reads a schema blob from any of the storages without restoring it.
+// It returns a nil object for data blobs and missing blobs.
+func (w *tierWalker) decode(ref types.Ref) (schema.Object, error) {
+	rc, _, err := w.s.union.FetchBlob(w.ctx, ref)
+	if err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	obj, err := schema.Decode(rc)
+	if err == schema.ErrNotSchema {
+		return nil, nil
+	}
+	return obj, err
+}
+
+func (w *tierWalker) mark(ref types.Ref) error {
+	if ref.Zero() {
+		return nil
+	} else if _, ok := w.seen[ref]; ok {
+		return nil
+	}
+	w.seen[ref] = struct{}{}
+	obj, err := w.decode(ref)
+	if err != nil || obj == nil {
+		return err
+	}
+	c, ok := obj.(*schema.Commit)
+	if !ok {
+		for _, r := range obj.References() {
+			if err = w.mark(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err = w.mark(c.Root); err != nil {
+		return err
+	}
+	if c.Parent == nil || c.Parent.Zero() {
+		return nil
+	}
+	pobj, err := w.decode(*c.Parent)
+	if err != nil {
+		return err
+	}
+	if pc, ok := pobj.(*schema.Commit); ok && !pc.Time.Before(w.cutoff) {
+		return w.mark(*c.Parent)
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/dennwc/cas/types"
+)
+
+// Span attributes recorded by the tracing wrapper.
+const (
+	AttrRef     = "cas.ref"
+	AttrSize    = "cas.size"
+	AttrPin     = "cas.pin"
+	AttrBackend = "cas.backend"
+)
+
+// Attribute is a key-value pair attached to a span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is a single traced operation. It mirrors a subset of OpenTelemetry span API,
+// thus an adapter for OpenTelemetry tracer is trivial.
+type Span interface {
+	// SetAttributes attaches attributes to the span.
+	SetAttributes(attrs ...Attribute)
+	// RecordError marks the span as failed.
+	RecordError(err error)
+	// End finishes the span.
+	End()
+}
+
+// Tracer creates spans for storage operations.
+type Tracer interface {
+	// Start creates a span and a context containing it. The span is a child of the span in a given context, if any.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+var tracer struct {
+	sync.RWMutex
+	t Tracer
+}
+
+// SetTracer sets a global tracer used by Traced storage and other helpers.
+// Passing nil disables tracing.
+func SetTracer(t Tracer) {
+	tracer.Lock()
+	tracer.t = t
+	tracer.Unlock()
+}
+
+func getTracer() Tracer {
+	tracer.RLock()
+	t := tracer.t
+	tracer.RUnlock()
+	return t
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(attrs ...Attribute) {}
+func (noopSpan) RecordError(err error)            {}
+func (noopSpan) End()                             {}
+
+// StartSpan starts a span using the global tracer. If tracer is not set, the span does nothing.
+func StartSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	t := getTracer()
+	if t == nil {
+		return ctx, noopSpan{}
+	}
+	ctx, sp := t.Start(ctx, name)
+	if len(attrs) != 0 {
+		sp.SetAttributes(attrs...)
+	}
+	return ctx, sp
+}
+
+// EndSpan records an error (if any) and finishes the span.
+// Not found errors are not recorded, since they are part of the normal operation.
+func EndSpan(sp Span, err error) {
+	if err != nil && err != ErrNotFound {
+		sp.RecordError(err)
+	}
+	sp.End()
+}
+
+// Traced wraps the storage and records a span for each operation using the global tracer (see SetTracer).
+//
+// Spans for blob readers, writers and iterators end when they are closed.
+func Traced(s Storage) Storage {
+	return &tracedStorage{s: s, backend: fmt.Sprintf("%T", s)}
+}
+
+type tracedStorage struct {
+	s       Storage
+	backend string
+}
+
+func (s *tracedStorage) start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return StartSpan(ctx, "storage."+name, append(attrs, Attribute{Key: AttrBackend, Value: s.backend})...)
+}
+
+func (s *tracedStorage) Close() error {
+	return s.s.Close()
+}
+
+func (s *tracedStorage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	ctx, sp := s.start(ctx, "StatBlob", Attribute{Key: AttrRef, Value: ref.String()})
+	sz, err := s.s.StatBlob(ctx, ref)
+	if err == nil {
+		sp.SetAttributes(Attribute{Key: AttrSize, Value: sz})
+	}
+	EndSpan(sp, err)
+	return sz, err
+}
+
+func (s *tracedStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	ctx, sp := s.start(ctx, "FetchBlob", Attribute{Key: AttrRef, Value: ref.String()})
+	rc, sz, err := s.s.FetchBlob(ctx, ref)
+	if err != nil {
+		EndSpan(sp, err)
+		return nil, 0, err
+	}
+	sp.SetAttributes(Attribute{Key: AttrSize, Value: sz})
+	return &tracedReader{ReadCloser: rc, sp: sp}, sz, nil
+}
+
+func (s *tracedStorage) IterateBlobs(ctx context.Context) Iterator {
+	ctx, sp := s.start(ctx, "IterateBlobs")
+	return &tracedIterator{Iterator: s.s.IterateBlobs(ctx), sp: sp}
+}
+
+func (s *tracedStorage) BeginBlob(ctx context.Context) (BlobWriter, error) {
+	ctx, sp := s.start(ctx, "StoreBlob")
+	w, err := s.s.BeginBlob(ctx)
+	if err != nil {
+		EndSpan(sp, err)
+		return nil, err
+	}
+	return &tracedWriter{BlobWriter: w, sp: sp}, nil
+}
+
+func (s *tracedStorage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	ctx, sp := s.start(ctx, "SetPin",
+		Attribute{Key: AttrPin, Value: name},
+		Attribute{Key: AttrRef, Value: ref.String()},
+	)
+	err := s.s.SetPin(ctx, name, ref)
+	EndSpan(sp, err)
+	return err
+}
+
+func (s *tracedStorage) DeletePin(ctx context.Context, name string) error {
+	ctx, sp := s.start(ctx, "DeletePin", Attribute{Key: AttrPin, Value: name})
+	err := s.s.DeletePin(ctx, name)
+	EndSpan(sp, err)
+	return err
+}
+
+func (s *tracedStorage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	ctx, sp := s.start(ctx, "GetPin", Attribute{Key: AttrPin, Value: name})
+	ref, err := s.s.GetPin(ctx, name)
+	if err == nil {
+		sp.SetAttributes(Attribute{Key: AttrRef, Value: ref.String()})
+	}
+	EndSpan(sp, err)
+	return ref, err
+}
+
+func (s *tracedStorage) IteratePins(ctx context.Context) PinIterator {
+	ctx, sp := s.start(ctx, "IteratePins")
+	return &tracedPinIterator{PinIterator: s.s.IteratePins(ctx), sp: sp}
+}
+
+type tracedReader struct {
+	io.ReadCloser
+	sp   Span
+	once sync.Once
+}
+
+func (r *tracedReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(func() {
+		EndSpan(r.sp, err)
+	})
+	return err
+}
+
+type tracedWriter struct {
+	BlobWriter
+	sp   Span
+	once sync.Once
+}
+
+func (w *tracedWriter) end(err error) {
+	w.once.Do(func() {
+		w.sp.SetAttributes(Attribute{Key: AttrSize, Value: w.BlobWriter.Size()})
+		EndSpan(w.sp, err)
+	})
+}
+
+func (w *tracedWriter) Complete() (types.SizedRef, error) {
+	sr, err := w.BlobWriter.Complete()
+	if err == nil {
+		w.sp.SetAttributes(Attribute{Key: AttrRef, Value: sr.Ref.String()})
+	}
+	return sr, err
+}
+
+func (w *tracedWriter) Commit() error {
+	err := w.BlobWriter.Commit()
+	w.end(err)
+	return err
+}
+
+func (w *tracedWriter) Close() error {
+	err := w.BlobWriter.Close()
+	w.end(err)
+	return err
+}
+
+type tracedIterator struct {
+	Iterator
+	sp   Span
+	once sync.Once
+}
+
+func (it *tracedIterator) Close() error {
+	err := it.Iterator.Close()
+	it.once.Do(func() {
+		EndSpan(it.sp, it.Iterator.Err())
+	})
+	return err
+}
+
+type tracedPinIterator struct {
+	PinIterator
+	sp   Span
+	once sync.Once
+}
+
+func (it *tracedPinIterator) Close() error {
+	err := it.PinIterator.Close()
+	it.once.Do(func() {
+		EndSpan(it.sp, it.PinIterator.Err())
+	})
+	return err
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"github.com/dennwc/cas/types"
+)
+
+// NewUnion creates a layered storage that reads blobs and pins from the upper layer first,
+// and falls back to lower layers in order. All writes go to the upper layer only,
+// thus lower layers can be read-only (a shared or network storage, for example).
+//
+// Deleting a pin only removes it from the upper layer, thus the pin from lower layers
+// may become visible after the deletion.
+//
+// Closing the union storage closes all layers.
+func NewUnion(upper Storage, lower ...Storage) Storage {
+	layers := make([]Storage, 0, len(lower)+1)
+	layers = append(layers, upper)
+	layers = append(layers, lower...)
+	return &unionStorage{layers: layers}
+}
+
+type unionStorage struct {
+	layers []Storage // upper layer is always first
+}
+
+func (s *unionStorage) upper() Storage {
+	return s.layers[0]
+}
+
+func (s *unionStorage) Close() error {
+	var last error
+	for _, l := range s.layers {
+		if err := l.Close(); err != nil {
+			last = err
+		}
+	}
+	return last
+}
+
+func (s *unionStorage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	for _, l := range s.layers {
+		sz, err := l.StatBlob(ctx, ref)
+		if err == ErrNotFound {
+			continue
+		}
+		return sz, err
+	}
+	return 0, ErrNotFound
+}
+
+func (s *unionStorage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	for _, l := range s.layers {
+		rc, sz, err := l.FetchBlob(ctx, ref)
+		if err == ErrNotFound {
+			continue
+		}
+		return rc, sz, err
+	}
+	return nil, 0, ErrNotFound
+}
+
+func (s *unionStorage) IterateBlobs(ctx context.Context) Iterator {
+	return &unionIterator{s: s, ctx: ctx, seen: make(map[types.Ref]struct{})}
+}
+
+// IterateBlobsPrefix implements PrefixIterator.
+func (s *unionStorage) IterateBlobsPrefix(ctx context.Context, prefix string) Iterator {
+	return &unionIterator{s: s, ctx: ctx, prefix: prefix, seen: make(map[types.Ref]struct{})}
+}
+
+func (s *unionStorage) BeginBlob(ctx context.Context) (BlobWriter, error) {
+	return s.upper().BeginBlob(ctx)
+}
+
+func (s *unionStorage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	return s.upper().SetPin(ctx, name, ref)
+}
+
+func (s *unionStorage) DeletePin(ctx context.Context, name string) error {
+	return s.upper().DeletePin(ctx, name)
+}
+
+func (s *unionStorage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	for _, l := range s.layers {
+		ref, err := l.GetPin(ctx, name)
+		if err == ErrNotFound {
+			continue
+		}
+		return ref, err
+	}
+	return types.Ref{}, ErrNotFound
+}
+
+func (s *unionStorage) IteratePins(ctx context.Context) PinIterator {
+	return &unionPinIterator{s: s, ctx: ctx, seen: make(map[string]struct{})}
+}
+
+// unionIterator lists blobs from all layers, skipping blobs that were already listed.
+type unionIterator struct {
+	s      *unionStorage
+	ctx    context.Context
+	prefix string
+	seen   map[types.Ref]struct{}
+
+	i   int
+	it  Iterator
+	cur types.SizedRef
+	err error
+}
+
+func (it *unionIterator) Next() bool {
+	for {
+		if it.err != nil {
+			return false
+		}
+		if it.it == nil {
+			if it.i >= len(it.s.layers) {
+				return false
+			}
+			it.it = IterateBlobsPrefix(it.ctx, it.s.layers[it.i], it.prefix)
+			it.i++
+		}
+		if !it.it.Next() {
+			it.err = it.it.Err()
+			it.it.Close()
+			it.it = nil
+			continue
+		}
+		sr := it.it.SizedRef()
+		if _, ok := it.seen[sr.Ref]; ok {
+			continue
+		}
+		it.seen[sr.Ref] = struct{}{}
+		it.cur = sr
+		return true
+	}
+}
+
+func (it *unionIterator) Err() error {
+	return it.err
+}
+
+func (it *unionIterator) Close() error {
+	if it.it != nil {
+		it.it.Close()
+		it.it = nil
+	}
+	it.i = len(it.s.layers)
+	return nil
+}
+
+func (it *unionIterator) SizedRef() types.SizedRef {
+	return it.cur
+}
+
+// unionPinIterator lists pins from all layers. Pins from upper layers shadow pins with the same name.
+type unionPinIterator struct {
+	s    *unionStorage
+	ctx  context.Context
+	seen map[string]struct{}
+
+	i   int
+	it  PinIterator
+	cur types.Pin
+	err error
+}
+
+func (it *unionPinIterator) Next() bool {
+	for {
+		if it.err != nil {
+			return false
+		}
+		if it.it == nil {
+			if it.i >= len(it.s.layers) {
+				return false
+			}
+			it.it = it.s.layers[it.i].IteratePins(it.ctx)
+			it.i++
+		}
+		if !it.it.Next() {
+			it.err = it.it.Err()
+			it.it.Close()
+			it.it = nil
+			continue
+		}
+		p := it.it.Pin()
+		if _, ok := it.seen[p.Name]; ok {
+			continue
+		}
+		it.seen[p.Name] = struct{}{}
+		it.cur = p
+		return true
+	}
+}
+
+func (it *unionPinIterator) Err() error {
+	return it.err
+}
+
+func (it *unionPinIterator) Close() error {
+	if it.it != nil {
+		it.it.Close()
+		it.it = nil
+	}
+	it.i = len(it.s.layers)
+	return nil
+}
+
+func (it *unionPinIterator) Pin() types.Pin {
+	return it.cur
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"hash"
 	"io"
+	"os"
 
 	"github.com/dennwc/cas/types"
 )
@@ -43,3 +44,12 @@ func (r *verifyReader) Read(p []byte) (int, error) {
 func (r *verifyReader) Close() error {
 	return r.rc.Close()
 }
+
+// File implements Filer. The content is not verified if it's read from the file directly,
+// thus it should only be used if the receiver verifies it, for example when serving blobs to CAS clients.
+func (r *verifyReader) File() *os.File {
+	if f, ok := BlobFile(r.rc); ok {
+		return f
+	}
+	return nil
+}
@@ -0,0 +1,569 @@
+// Package webdav implements CAS storage on top of a WebDAV server, for example Nextcloud, ownCloud
+// or "rclone serve webdav".
+//
+// Blobs and pins are uploaded to a temporary collection first and then moved to their final names,
+// thus partially uploaded files are never visible to other clients.
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+var (
+	_ storage.Storage     = (*Storage)(nil)
+	_ storage.BlobDeleter = (*Storage)(nil)
+
+	_ storage.BlobRangeFetcher = (*Storage)(nil)
+)
+
+const (
+	dirBlobs = "blobs/"
+	dirPins  = "pins/"
+	dirTmp   = "tmp/"
+
+	// maxPinSize is the max size of the pin file.
+	maxPinSize = 1024
+)
+
+const (
+	envUser     = "WEBDAV_USER"
+	envPassword = "WEBDAV_PASSWORD"
+)
+
+func init() {
+	storage.RegisterConfig("webdav:ClientConfig", &Config{})
+}
+
+type Config struct {
+	URL string `json:"url"`
+	// User and Password are used for basic authentication. The password can reference a secret
+	// stored outside of the config, see storage.Secret.
+	// If not set, WEBDAV_USER and WEBDAV_PASSWORD environment variables are used.
+	User     string          `json:"user,omitempty"`
+	Password *storage.Secret `json:"password,omitempty"`
+
+	storage.ConnConfig
+}
+
+func (c *Config) References() []types.Ref {
+	return nil
+}
+
+func (c *Config) OpenStorage(ctx context.Context) (storage.Storage, error) {
+	user, pass := c.User, ""
+	if user == "" && c.Password.IsZero() {
+		user, pass = os.Getenv(envUser), os.Getenv(envPassword)
+	} else {
+		var err error
+		if pass, err = c.Password.Resolve(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return NewWithOptions(ctx, c.URL, user, pass, &Options{Client: c.HTTPClient()})
+}
+
+// Options for WebDAV storage.
+type Options struct {
+	Client *http.Client // HTTP client; http.DefaultClient is used if not set
+}
+
+// New opens a storage in a given WebDAV collection. Collections for blobs and pins are created if necessary.
+// Authentication is not used if the user is empty.
+func New(ctx context.Context, addr, user, pass string) (*Storage, error) {
+	return NewWithOptions(ctx, addr, user, pass, nil)
+}
+
+// NewWithOptions is the same as New, but allows to set additional options.
+func NewWithOptions(ctx context.Context, addr, user, pass string, opts *Options) (*Storage, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("webdav: unsupported URL: %q", addr)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawPath = ""
+	s := &Storage{base: u, cli: opts.Client, user: user, pass: pass}
+	if s.cli == nil {
+		s.cli = http.DefaultClient
+	}
+	for _, dir := range []string{"", dirBlobs, dirPins, dirTmp} {
+		if err := s.mkcol(ctx, dir); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Storage is a CAS storage that keeps blobs and pins in a WebDAV collection.
+type Storage struct {
+	base *url.URL
+	cli  *http.Client
+	user string
+	pass string
+}
+
+func (s *Storage) Close() error {
+	return nil
+}
+
+// statusError is returned for unexpected responses of the server.
+type statusError struct {
+	Method string
+	Path   string
+	Status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("webdav: %s %s: %d %s", e.Method, e.Path, e.Status, http.StatusText(e.Status))
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*statusError)
+	return ok && e.Status == http.StatusNotFound
+}
+
+// url returns an absolute URL of the file relative to the base collection.
+func (s *Storage) url(name string) string {
+	u := *s.base
+	u.Path += name
+	return u.String()
+}
+
+func (s *Storage) newRequest(ctx context.Context, method, name string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, s.url(name), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.pass)
+	}
+	return req, nil
+}
+
+// send sends a request to the server. Responses with status codes other than 2xx are returned as statusError.
+func (s *Storage) send(req *http.Request, name string) (*http.Response, error) {
+	resp, err := s.cli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, &statusError{Method: req.Method, Path: name, Status: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// do is a shorthand for newRequest and send.
+func (s *Storage) do(ctx context.Context, method, name string, body io.Reader, hdr map[string]string) (*http.Response, error) {
+	req, err := s.newRequest(ctx, method, name, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	return s.send(req, name)
+}
+
+func (s *Storage) mkcol(ctx context.Context, dir string) error {
+	resp, err := s.do(ctx, "MKCOL", dir, nil, nil)
+	if e, ok := err.(*statusError); ok && e.Status == http.StatusMethodNotAllowed {
+		// already exists
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *Storage) delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, "DELETE", name, nil, nil)
+	if isNotFound(err) {
+		return storage.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// upload writes a file to a temporary location and moves it to the final name.
+func (s *Storage) upload(ctx context.Context, name string, r io.Reader, size int64) error {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	tmp := dirTmp + hex.EncodeToString(b[:])
+	// some servers reject chunked uploads, so the size is always set
+	req, err := s.newRequest(ctx, "PUT", tmp, ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.send(req, tmp)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	resp, err = s.do(ctx, "MOVE", tmp, nil, map[string]string{
+		"Destination": s.url(name),
+		"Overwrite":   "T",
+	})
+	if err != nil {
+		s.delete(ctx, tmp)
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *Storage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	if ref.Zero() {
+		return 0, storage.ErrInvalidRef
+	}
+	resp, err := s.do(ctx, "HEAD", dirBlobs+ref.String(), nil, nil)
+	if isNotFound(err) {
+		return 0, storage.ErrNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.ContentLength >= 0 {
+		return uint64(resp.ContentLength), nil
+	}
+	// some servers do not report the size on HEAD requests
+	files, err := s.propfind(ctx, dirBlobs+ref.String(), "0")
+	if isNotFound(err) {
+		return 0, storage.ErrNotFound
+	} else if err != nil {
+		return 0, err
+	} else if len(files) != 1 || files[0].Size < 0 {
+		return 0, fmt.Errorf("webdav: unknown blob size")
+	}
+	return uint64(files[0].Size), nil
+}
+
+func (s *Storage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	if ref.Zero() {
+		return nil, 0, storage.ErrInvalidRef
+	}
+	resp, err := s.do(ctx, "GET", dirBlobs+ref.String(), nil, nil)
+	if isNotFound(err) {
+		return nil, 0, storage.ErrNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if resp.ContentLength < 0 {
+		sz, err := s.StatBlob(ctx, ref)
+		if err != nil {
+			resp.Body.Close()
+			return nil, 0, err
+		}
+		return resp.Body, sz, nil
+	}
+	return resp.Body, uint64(resp.ContentLength), nil
+}
+
+// FetchBlobRange implements storage.BlobRangeFetcher. The range is requested with the Range header.
+func (s *Storage) FetchBlobRange(ctx context.Context, ref types.Ref, off, length uint64) (io.ReadCloser, uint64, error) {
+	if ref.Zero() {
+		return nil, 0, storage.ErrInvalidRef
+	}
+	resp, err := s.do(ctx, "GET", dirBlobs+ref.String(), nil, map[string]string{
+		"Range": storage.HTTPRange(off, length),
+	})
+	if e, ok := err.(*statusError); ok && e.Status == http.StatusRequestedRangeNotSatisfiable {
+		// the range starts past the end of the blob
+		sz, err := s.StatBlob(ctx, ref)
+		if err != nil {
+			return nil, 0, err
+		}
+		return ioutil.NopCloser(strings.NewReader("")), sz, nil
+	} else if isNotFound(err) {
+		return nil, 0, storage.ErrNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode == http.StatusOK && resp.ContentLength < 0 {
+		// the server ignored the range and didn't send the size
+		sz, err := s.StatBlob(ctx, ref)
+		if err != nil {
+			resp.Body.Close()
+			return nil, 0, err
+		}
+		resp.ContentLength = int64(sz)
+	}
+	return storage.HTTPRangeResponse(resp, off, length)
+}
+
+// DeleteBlob implements storage.BlobDeleter.
+func (s *Storage) DeleteBlob(ctx context.Context, ref types.Ref) error {
+	if ref.Zero() {
+		return storage.ErrInvalidRef
+	}
+	return s.delete(ctx, dirBlobs+ref.String())
+}
+
+// BeginBlob starts a new blob upload. The blob is uploaded on Commit, since the ref must be known before the upload.
+func (s *Storage) BeginBlob(ctx context.Context) (storage.BlobWriter, error) {
+	return storage.Spool("cas_webdav_", nil, func(sr types.SizedRef, f *os.File) error {
+		return s.putBlob(ctx, sr, f)
+	})
+}
+
+// putBlob uploads the blob content with a known ref and size, unless the blob is already stored.
+func (s *Storage) putBlob(ctx context.Context, sr types.SizedRef, r io.Reader) error {
+	if _, err := s.StatBlob(ctx, sr.Ref); err == nil {
+		// already stored
+		return nil
+	} else if err != storage.ErrNotFound {
+		return err
+	}
+	return s.upload(ctx, dirBlobs+sr.Ref.String(), r, int64(sr.Size))
+}
+
+func pinName(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "/?#%") {
+		return "", fmt.Errorf("invalid pin name: %q", name)
+	}
+	return dirPins + name, nil
+}
+
+// SetPin stores a pin as a small file that contains the ref.
+func (s *Storage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	path, err := pinName(name)
+	if err != nil {
+		return err
+	}
+	data := ref.String()
+	return s.upload(ctx, path, strings.NewReader(data), int64(len(data)))
+}
+
+func (s *Storage) DeletePin(ctx context.Context, name string) error {
+	path, err := pinName(name)
+	if err != nil {
+		return err
+	}
+	return s.delete(ctx, path)
+}
+
+func (s *Storage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	path, err := pinName(name)
+	if err != nil {
+		return types.Ref{}, err
+	}
+	return s.getPin(ctx, path)
+}
+
+func (s *Storage) getPin(ctx context.Context, path string) (types.Ref, error) {
+	resp, err := s.do(ctx, "GET", path, nil, nil)
+	if isNotFound(err) {
+		return types.Ref{}, storage.ErrNotFound
+	} else if err != nil {
+		return types.Ref{}, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPinSize))
+	if err != nil {
+		return types.Ref{}, err
+	}
+	return types.ParseRef(string(bytes.TrimSpace(data)))
+}
+
+// fileInfo is a file returned by PROPFIND.
+type fileInfo struct {
+	Name string
+	Size int64 // -1 if unknown
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/></D:prop></D:propfind>`
+
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				Type struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				Length string `xml:"DAV: getcontentlength"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// propfind lists files in the collection (depth 1) or returns the file itself (depth 0). Collections are skipped.
+func (s *Storage) propfind(ctx context.Context, name, depth string) ([]fileInfo, error) {
+	resp, err := s.do(ctx, "PROPFIND", name, strings.NewReader(propfindBody), map[string]string{
+		"Depth":        depth,
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var ms multistatus
+	if err = xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("webdav: cannot decode PROPFIND response: %v", err)
+	}
+	var out []fileInfo
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(href.Path, "/") {
+			continue
+		}
+		fi := fileInfo{Name: path.Base(href.Path), Size: -1}
+		dir := false
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			if ps.Prop.Type.Collection != nil {
+				dir = true
+			}
+			if ps.Prop.Length != "" {
+				if fi.Size, err = strconv.ParseInt(ps.Prop.Length, 10, 64); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if !dir {
+			out = append(out, fi)
+		}
+	}
+	return out, nil
+}
+
+func (s *Storage) IterateBlobs(ctx context.Context) storage.Iterator {
+	return &blobIterator{filesIterator: filesIterator{s: s, ctx: ctx, dir: dirBlobs}}
+}
+
+func (s *Storage) IteratePins(ctx context.Context) storage.PinIterator {
+	return &pinsIterator{filesIterator: filesIterator{s: s, ctx: ctx, dir: dirPins}}
+}
+
+// filesIterator lists files in a collection. All files are listed on the first call to Next.
+type filesIterator struct {
+	s   *Storage
+	ctx context.Context
+	dir string
+
+	listed bool
+	buf    []fileInfo
+
+	cur fileInfo
+	err error
+}
+
+func (it *filesIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.listed {
+		it.listed = true
+		it.buf, it.err = it.s.propfind(it.ctx, it.dir, "1")
+		if it.err != nil {
+			return false
+		}
+	}
+	if len(it.buf) == 0 {
+		return false
+	}
+	it.cur = it.buf[0]
+	it.buf = it.buf[1:]
+	return true
+}
+
+func (it *filesIterator) Err() error {
+	return it.err
+}
+
+func (it *filesIterator) Close() error {
+	it.buf, it.listed = nil, true
+	return nil
+}
+
+type blobIterator struct {
+	filesIterator
+	sr types.SizedRef
+}
+
+func (it *blobIterator) SizedRef() types.SizedRef {
+	return it.sr
+}
+
+func (it *blobIterator) Next() bool {
+	for it.filesIterator.Next() {
+		ref, err := types.ParseRef(it.cur.Name)
+		if err != nil {
+			// not a blob
+			continue
+		}
+		it.sr = types.SizedRef{Ref: ref}
+		if it.cur.Size >= 0 {
+			it.sr.Size = uint64(it.cur.Size)
+		} else {
+			it.sr.Size, it.err = it.s.StatBlob(it.ctx, ref)
+		}
+		return it.err == nil
+	}
+	return false
+}
+
+type pinsIterator struct {
+	filesIterator
+	pin types.Pin
+}
+
+func (it *pinsIterator) Pin() types.Pin {
+	return it.pin
+}
+
+func (it *pinsIterator) Next() bool {
+	for it.filesIterator.Next() {
+		ref, err := it.s.getPin(it.ctx, dirPins+it.cur.Name)
+		if err == storage.ErrNotFound {
+			// removed concurrently
+			continue
+		} else if err != nil {
+			it.err = err
+			return false
+		}
+		it.pin = types.Pin{Name: it.cur.Name, Ref: ref}
+		return true
+	}
+	return false
+}
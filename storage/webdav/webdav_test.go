@@ -0,0 +1,147 @@
+package webdav
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/test"
+	"github.com/dennwc/cas/types"
+)
+
+func newTestStorage(t testing.TB, user, pass string) (*Storage, func()) {
+	h := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, _ := r.BasicAuth(); u != user || p != pass {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	s, err := NewWithOptions(context.Background(), hs.URL+"/dav/cas", user, pass, &Options{Client: hs.Client()})
+	if err != nil {
+		hs.Close()
+	}
+	require.NoError(t, err)
+	return s, hs.Close
+}
+
+func TestWebDAV(t *testing.T) {
+	storagetest.RunTests(t, func(t testing.TB) (storage.Storage, func()) {
+		return newTestStorage(t, "", "")
+	})
+}
+
+func TestWebDAVPins(t *testing.T) {
+	s, closer := newTestStorage(t, "user", "pass")
+	defer closer()
+	ctx := context.Background()
+
+	sr, err := storage.WriteBytes(ctx, s, []byte("data"))
+	require.NoError(t, err)
+	// blob is not uploaded again
+	_, err = storage.WriteBytes(ctx, s, []byte("data"))
+	require.NoError(t, err)
+
+	_, err = s.GetPin(ctx, "root")
+	require.Equal(t, storage.ErrNotFound, err)
+
+	err = s.SetPin(ctx, "root", sr.Ref)
+	require.NoError(t, err)
+	err = s.SetPin(ctx, "other", types.BytesRef(nil))
+	require.NoError(t, err)
+	err = s.SetPin(ctx, "other", sr.Ref)
+	require.NoError(t, err)
+
+	ref, err := s.GetPin(ctx, "root")
+	require.NoError(t, err)
+	require.Equal(t, sr.Ref, ref)
+
+	pins := make(map[string]types.Ref)
+	it := s.IteratePins(ctx)
+	for it.Next() {
+		p := it.Pin()
+		pins[p.Name] = p.Ref
+	}
+	require.NoError(t, it.Err())
+	it.Close()
+	require.Equal(t, map[string]types.Ref{"root": sr.Ref, "other": sr.Ref}, pins)
+
+	err = s.DeletePin(ctx, "root")
+	require.NoError(t, err)
+	_, err = s.GetPin(ctx, "root")
+	require.Equal(t, storage.ErrNotFound, err)
+	err = s.DeletePin(ctx, "root")
+	require.Equal(t, storage.ErrNotFound, err)
+
+	// temporary files are removed
+	files, err := s.propfind(ctx, dirTmp, "1")
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+func TestWebDAVAuth(t *testing.T) {
+	h := &webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()}
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, _ := r.BasicAuth(); u != "user" || p != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+	_, err := New(context.Background(), hs.URL, "user", "wrong")
+	require.NotNil(t, err)
+}
+
+func TestWebDAVSecretRef(t *testing.T) {
+	h := &webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()}
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, _ := r.BasicAuth(); u != "user" || p != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	defer hs.Close()
+	ctx := context.Background()
+
+	const env = "CAS_TEST_WEBDAV_PASSWORD"
+	var conf Config
+	err := json.Unmarshal([]byte(`{"url":"`+hs.URL+`","user":"user","password":{"secret_ref":"env:`+env+`"}}`), &conf)
+	require.NoError(t, err)
+	require.Equal(t, &storage.Secret{Ref: "env:" + env}, conf.Password)
+
+	// the secret is not written to the config
+	data, err := json.Marshal(&conf)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"password":{"secret_ref":"env:`+env+`"}`)
+
+	_, err = conf.OpenStorage(ctx)
+	require.Error(t, err)
+
+	os.Setenv(env, "pass")
+	defer os.Unsetenv(env)
+	s, err := conf.OpenStorage(ctx)
+	require.NoError(t, err)
+	s.Close()
+
+	// plaintext passwords are still supported
+	err = json.Unmarshal([]byte(`{"url":"`+hs.URL+`","user":"user","password":"pass"}`), &conf)
+	require.NoError(t, err)
+	require.Equal(t, storage.PlainSecret("pass"), conf.Password)
+	s, err = conf.OpenStorage(ctx)
+	require.NoError(t, err)
+	s.Close()
+}
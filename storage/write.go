@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"io"
 
 	"github.com/dennwc/cas/types"
 )
@@ -28,3 +29,43 @@ func WriteBytes(ctx context.Context, s BlobStorage, data []byte) (types.SizedRef
 	}
 	return sr, nil
 }
+
+// StreamBlob stores the content of the reader as a blob. If the expected ref is set, the blob is only stored if
+// its content matches the ref. It uses BlobStreamer if the storage implements it, and BeginBlob otherwise.
+func StreamBlob(ctx context.Context, s BlobStorage, r io.Reader, exp types.Ref) (types.SizedRef, error) {
+	if bs, ok := s.(BlobStreamer); ok {
+		return bs.StreamBlob(ctx, r, exp)
+	}
+	w, err := s.BeginBlob(ctx)
+	if err != nil {
+		return types.SizedRef{}, err
+	}
+	defer w.Close()
+	if _, err = io.Copy(w, r); err != nil {
+		return types.SizedRef{}, err
+	}
+	sr, err := w.Complete()
+	if err != nil {
+		return types.SizedRef{}, err
+	} else if !exp.Zero() && sr.Ref != exp {
+		return types.SizedRef{}, ErrRefMissmatch{Exp: exp, Got: sr.Ref}
+	}
+	if err = w.Commit(); err != nil {
+		return types.SizedRef{}, err
+	}
+	return sr, nil
+}
+
+// copyBlob copies a blob from one storage to another, unless the destination already has it.
+func copyBlob(ctx context.Context, dst BlobStorage, src BlobSource, ref types.Ref) error {
+	if _, err := dst.StatBlob(ctx, ref); err == nil {
+		return nil
+	}
+	rc, _, err := src.FetchBlob(ctx, ref)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = StreamBlob(ctx, dst, rc, ref)
+	return err
+}
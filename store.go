@@ -1,9 +1,11 @@
 package cas
 
 import (
+	"bufio"
 	"context"
 	"io"
 
+	"github.com/dennwc/cas/chunker"
 	"github.com/dennwc/cas/schema"
 	"github.com/dennwc/cas/storage"
 	"github.com/dennwc/cas/types"
@@ -20,6 +22,18 @@ type StoreConfig struct {
 	Expect    types.SizedRef // expected size and ref; can be set separately
 	IndexOnly bool           // write metadata only
 	Split     *SplitConfig
+	Limits    *TreeLimits      // soft limits for trees; defaults are used if not set
+	OnWarning func(w *Warning) // called for patterns that exceed the limits, unless limits are strict
+	Changes   *ChangePolicy    // handling of files that change while being stored
+	Append    bool             // only store data appended to local files since they were stored last time
+	Checksums map[string]Ref   // known refs of local files by slash-separated path relative to the stored directory; see ReadChecksums
+	// FollowLinks stores files and directories that symbolic links point to, instead of the links.
+	// Links are always followed for the stored path itself.
+	FollowLinks bool
+	// Mode and Owner record POSIX modes and names of owners of files and directories in directory entries.
+	// Directories with different metadata have different refs, thus it's disabled by default.
+	// Owners are not recorded on Windows.
+	Mode, Owner bool
 }
 
 func (c *StoreConfig) checkRef(sr SizedRef) error {
@@ -34,9 +48,10 @@ func (c *StoreConfig) checkRef(sr SizedRef) error {
 type SplitFunc func(p []byte) int
 
 type SplitConfig struct {
-	Splitter SplitFunc // use this split function instead of size-based
-	Min, Max uint64    // in bytes
-	PerLevel uint      // chunks on each schema level
+	Splitter SplitFunc       // use this split function instead of size-based
+	Chunker  *chunker.Config // use this chunking algorithm instead of Splitter; Min is ignored
+	Min, Max uint64          // in bytes
+	PerLevel uint            // chunks on each schema level
 }
 
 func (s *Storage) BeginBlob(ctx context.Context) (storage.BlobWriter, error) {
@@ -45,6 +60,19 @@ func (s *Storage) BeginBlob(ctx context.Context) (storage.BlobWriter, error) {
 
 // StoreBlob writes the data from r according to a config.
 func (s *Storage) StoreBlob(ctx context.Context, r io.Reader, conf *StoreConfig) (SizedRef, error) {
+	ctx, sp := storage.StartSpan(ctx, "cas.StoreBlob")
+	sr, err := s.storeBlob(ctx, r, conf)
+	if err == nil {
+		sp.SetAttributes(
+			storage.Attribute{Key: storage.AttrRef, Value: sr.Ref.String()},
+			storage.Attribute{Key: storage.AttrSize, Value: sr.Size},
+		)
+	}
+	storage.EndSpan(sp, err)
+	return sr, err
+}
+
+func (s *Storage) storeBlob(ctx context.Context, r io.Reader, conf *StoreConfig) (SizedRef, error) {
 	conf = checkConfig(conf)
 
 	if conf.Split != nil {
@@ -70,6 +98,22 @@ func (s *Storage) StoreBlob(ctx context.Context, r io.Reader, conf *StoreConfig)
 		}
 	}
 
+	if bs, ok := s.st.(storage.BlobStreamer); ok && !conf.IndexOnly {
+		br := bufio.NewReader(r)
+		if _, err := br.Peek(1); err != io.EOF {
+			// backend stores the content directly
+			sr, err := bs.StreamBlob(ctx, br, conf.Expect.Ref)
+			if err != nil {
+				return SizedRef{}, err
+			} else if err = conf.checkRef(sr); err != nil {
+				return SizedRef{}, err
+			}
+			return sr, nil
+		}
+		// empty blobs are not stored; see completeBlob
+		r = br
+	}
+
 	// store content as a single blob
 	var (
 		w   storage.BlobWriter
@@ -89,7 +133,9 @@ func (s *Storage) StoreBlob(ctx context.Context, r io.Reader, conf *StoreConfig)
 		return SizedRef{}, err
 	}
 	sr, err := s.completeBlob(ctx, w, conf.Expect.Ref)
-	if err = conf.checkRef(sr); err != nil {
+	if err != nil {
+		return SizedRef{}, err
+	} else if err = conf.checkRef(sr); err != nil {
 		return SizedRef{}, err
 	}
 	return sr, nil
@@ -126,9 +172,17 @@ func (s *Storage) splitBlob(ctx context.Context, r io.Reader, conf *SplitConfig,
 	if conf.PerLevel == 0 {
 		conf.PerLevel = maxDirEntries
 	}
-	if conf.Splitter == nil && conf.Max == 0 {
+	if conf.Splitter == nil && conf.Chunker == nil && conf.Max == 0 {
 		conf.Max = 64 * 1024 * 1024
 	}
+	var ch chunker.Chunker
+	if conf.Chunker != nil {
+		var err error
+		ch, err = conf.Chunker.New()
+		if err != nil {
+			return types.SizedRef{}, types.SizedRef{}, err
+		}
+	}
 	// hash whole stream content in the background
 	h := types.NewRef().Hash()
 	r = io.TeeReader(r, h)
@@ -140,7 +194,8 @@ func (s *Storage) splitBlob(ctx context.Context, r io.Reader, conf *SplitConfig,
 	var (
 		isEOF = false
 		refs  []types.SizedRef
-		buf   = make([]byte, 0, bsize) // read buffer
+		rbuf  = make([]byte, bsize) // read buffer
+		buf   = rbuf[:0]            // unprocessed part of the read buffer
 	)
 	for !isEOF {
 		var (
@@ -160,7 +215,7 @@ func (s *Storage) splitBlob(ctx context.Context, r io.Reader, conf *SplitConfig,
 		for {
 			// if nothing to process from the previous chunk, read new data
 			if len(buf) == 0 {
-				buf = buf[:cap(buf)]
+				buf = rbuf
 				n, err := r.Read(buf)
 				buf = buf[:n]
 				if n != 0 && err == io.EOF {
@@ -180,8 +235,15 @@ func (s *Storage) splitBlob(ctx context.Context, r io.Reader, conf *SplitConfig,
 			// it will be smaller in case we want to split
 			wbuf := buf
 			splitted := false
-			// only run split function if we are above the min size threshold
-			if conf.Splitter != nil && (conf.Min == 0 || cur > conf.Min) {
+			if ch != nil {
+				if i := ch.Next(buf); i >= 0 {
+					// chunk ends in this buffer, the rest goes to the next chunk
+					wbuf = buf[:i]
+					buf = buf[i:]
+					splitted = true
+				}
+			} else if conf.Splitter != nil && (conf.Min == 0 || cur > conf.Min) {
+				// only run split function if we are above the min size threshold
 				if i := conf.Splitter(buf); i >= 0 && i < len(buf) {
 					// write chunk including the separator
 					wbuf = buf[:i+1]
@@ -0,0 +1,201 @@
+package cas_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/chunker"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+func TestStoreChunker(t *testing.T) {
+	ctx := context.Background()
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < 1024*1024; i++ {
+		fmt.Fprintf(&buf, "%d: log line number %d\n", i, i*i)
+	}
+	data := buf.Bytes()
+
+	conf := &chunker.Config{Algo: "lines", Min: 16 * 1024, Avg: 64 * 1024, Max: 256 * 1024}
+	sr, err := s.StoreBlob(ctx, bytes.NewReader(data), &cas.StoreConfig{
+		Split: &cas.SplitConfig{Chunker: conf},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(data)), sr.Size)
+
+	obj, err := s.DecodeSchema(ctx, sr.Ref)
+	require.NoError(t, err)
+	list, ok := obj.(*schema.InlineList)
+	require.True(t, ok, "%T", obj)
+	require.True(t, len(list.List) > 1)
+
+	var got []byte
+	for _, e := range list.List {
+		part := e.(*types.SizedRef)
+		require.True(t, part.Size <= conf.Max)
+		rc, _, err := s.FetchBlob(ctx, part.Ref)
+		require.NoError(t, err)
+		p, err := ioutil.ReadAll(rc)
+		rc.Close()
+		require.NoError(t, err)
+		// chunks must end on line boundaries
+		require.Equal(t, byte('\n'), p[len(p)-1])
+		got = append(got, p...)
+	}
+	require.Equal(t, data, got)
+
+	_, err = s.StoreBlob(ctx, bytes.NewReader(data), &cas.StoreConfig{
+		Split: &cas.SplitConfig{Chunker: &chunker.Config{Algo: "unknown"}},
+	})
+	require.Error(t, err)
+}
+
+func TestOpenFile(t *testing.T) {
+	ctx := context.Background()
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	read := func(ref cas.Ref) (string, uint64) {
+		rc, size, err := s.OpenFile(ctx, ref)
+		require.NoError(t, err)
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		require.NoError(t, err)
+		return string(data), size
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	split, err := s.StoreBlob(ctx, bytes.NewReader(data), &cas.StoreConfig{
+		Split: &cas.SplitConfig{Chunker: &chunker.Config{Algo: "fixed", Avg: 1024}},
+	})
+	require.NoError(t, err)
+	got, size := read(split.Ref)
+	require.Equal(t, string(data), got)
+	require.Equal(t, uint64(len(data)), size)
+
+	writeSchema := func(obj schema.Object) cas.Ref {
+		buf := new(bytes.Buffer)
+		require.NoError(t, schema.Encode(buf, obj))
+		sr, err := s.StoreBlob(ctx, buf, nil)
+		require.NoError(t, err)
+		return sr.Ref
+	}
+	a, err := s.StoreBlob(ctx, bytes.NewReader([]byte("abc")), nil)
+	require.NoError(t, err)
+	// nested parts are resolved as well
+	multi := writeSchema(&schema.Multipart{Parts: []types.SizedRef{a, {Ref: split.Ref, Size: split.Size}, a}})
+	got, size = read(multi)
+	require.Equal(t, "abc"+string(data)+"abc", got)
+	require.Equal(t, uint64(len(data)+6), size)
+
+	got, size = read(a.Ref)
+	require.Equal(t, "abc", got)
+	require.Equal(t, uint64(3), size)
+
+	dir := writeSchema(&schema.InlineList{Elem: schema.MustTypeOf(&schema.DirEntry{}), List: []schema.Object{
+		&schema.DirEntry{Ref: a.Ref, Name: "a", Stats: schema.Stats{schema.StatDataSize: 3}},
+	}})
+	_, _, err = s.OpenFile(ctx, dir)
+	require.Equal(t, cas.ErrIsDir, err)
+}
+
+func TestOpenFileSeek(t *testing.T) {
+	ctx := context.Background()
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer s.Close()
+
+	data := make([]byte, 100*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	sr, err := s.StoreBlob(ctx, bytes.NewReader(data), &cas.StoreConfig{
+		Split: &cas.SplitConfig{Chunker: &chunker.Config{Min: 1024, Avg: 4096, Max: 16 * 1024}},
+	})
+	require.NoError(t, err)
+
+	br, size, err := s.OpenFile(ctx, sr.Ref)
+	require.NoError(t, err)
+	defer br.Close()
+	require.Equal(t, uint64(len(data)), size)
+
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 100; i++ {
+		off := r.Intn(len(data))
+		buf := make([]byte, r.Intn(20*1024))
+		n, err := br.ReadAt(buf, int64(off))
+		exp := data[off:]
+		if len(exp) > len(buf) {
+			exp = exp[:len(buf)]
+			require.NoError(t, err)
+		} else {
+			require.Equal(t, io.EOF, err)
+		}
+		require.Equal(t, exp, buf[:n])
+	}
+
+	_, err = br.Seek(-1000, io.SeekEnd)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(br)
+	require.NoError(t, err)
+	require.Equal(t, data[len(data)-1000:], got)
+
+	_, err = br.Seek(500, io.SeekStart)
+	require.NoError(t, err)
+	got, err = ioutil.ReadAll(br)
+	require.NoError(t, err)
+	require.Equal(t, data[500:], got)
+}
+
+// streamStorage is a storage that stores blobs from readers and counts such writes.
+type streamStorage struct {
+	storage.Storage
+	streamed int
+}
+
+func (s *streamStorage) StreamBlob(ctx context.Context, r io.Reader, exp types.Ref) (types.SizedRef, error) {
+	s.streamed++
+	return storage.StreamBlob(ctx, s.Storage, r, exp)
+}
+
+func TestStoreStream(t *testing.T) {
+	ctx := context.Background()
+	st := &streamStorage{Storage: storage.NewInMemory()}
+	s, err := cas.New(st)
+	require.NoError(t, err)
+	defer s.Close()
+	ms, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	defer ms.Close()
+
+	data := []byte("data")
+	sr, err := s.StoreBlob(ctx, bytes.NewReader(data), nil)
+	require.NoError(t, err)
+	require.Equal(t, types.SizedRef{Ref: types.BytesRef(data), Size: uint64(len(data))}, sr)
+	require.Equal(t, 1, st.streamed)
+
+	// empty blobs are handled the same way as with other storages, and are not stored
+	for _, conf := range []*cas.StoreConfig{nil, {Expect: types.SizedRef{Ref: types.BytesRef(nil)}}} {
+		exp, err := ms.StoreBlob(ctx, bytes.NewReader(nil), conf)
+		require.NoError(t, err)
+		sr, err = s.StoreBlob(ctx, bytes.NewReader(nil), conf)
+		require.NoError(t, err)
+		require.Equal(t, exp, sr)
+	}
+	require.Equal(t, 1, st.streamed)
+	_, err = st.StatBlob(ctx, types.BytesRef(nil))
+	require.Equal(t, storage.ErrNotFound, err)
+}
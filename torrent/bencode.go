@@ -0,0 +1,189 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// bencode encodes a value. Supported types are string, []byte, int, int64, []interface{} and map[string]interface{}.
+func bencode(w *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		w.WriteString(strconv.Itoa(len(v)))
+		w.WriteByte(':')
+		w.WriteString(v)
+	case []byte:
+		w.WriteString(strconv.Itoa(len(v)))
+		w.WriteByte(':')
+		w.Write(v)
+	case int:
+		fmt.Fprintf(w, "i%de", v)
+	case int64:
+		fmt.Fprintf(w, "i%de", v)
+	case []interface{}:
+		w.WriteByte('l')
+		for _, e := range v {
+			if err := bencode(w, e); err != nil {
+				return err
+			}
+		}
+		w.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		// keys must be sorted as raw strings
+		sort.Strings(keys)
+		w.WriteByte('d')
+		for _, k := range keys {
+			bencode(w, k)
+			if err := bencode(w, v[k]); err != nil {
+				return err
+			}
+		}
+		w.WriteByte('e')
+	default:
+		return fmt.Errorf("bencode: unsupported type: %T", v)
+	}
+	return nil
+}
+
+var errInvalidBencode = errors.New("bencode: invalid data")
+
+// bdecoder decodes bencoded values. Strings are decoded as string, integers as int64,
+// lists as []interface{} and dictionaries as map[string]interface{}.
+type bdecoder struct {
+	r *bufio.Reader
+	// raw is set to the raw data of the dictionary value with a given key, if it's at the top level
+	rawKey string
+	raw    []byte
+	buf    *bytes.Buffer // records consumed bytes, if not nil
+}
+
+func bdecode(r io.Reader) (interface{}, error) {
+	d := &bdecoder{r: bufio.NewReader(r)}
+	return d.decode(0)
+}
+
+func (d *bdecoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && d.buf != nil {
+		d.buf.WriteByte(b)
+	}
+	return b, err
+}
+
+func (d *bdecoder) readUntil(delim byte) (string, error) {
+	var s []byte
+	for {
+		b, err := d.readByte()
+		if err != nil {
+			return "", err
+		} else if b == delim {
+			return string(s), nil
+		} else if len(s) > 20 {
+			return "", errInvalidBencode
+		}
+		s = append(s, b)
+	}
+}
+
+func (d *bdecoder) decode(depth int) (interface{}, error) {
+	if depth > 64 {
+		return nil, errInvalidBencode
+	}
+	b, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b == 'i':
+		s, err := d.readUntil('e')
+		if err != nil {
+			return nil, err
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, errInvalidBencode
+		}
+		return v, nil
+	case b >= '0' && b <= '9':
+		s, err := d.readUntil(':')
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(string(b) + s)
+		if err != nil || n < 0 {
+			return nil, errInvalidBencode
+		}
+		p := make([]byte, n)
+		if _, err = io.ReadFull(d.r, p); err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d.buf != nil {
+			d.buf.Write(p)
+		}
+		return string(p), nil
+	case b == 'l':
+		var list []interface{}
+		for {
+			if c, err := d.r.Peek(1); err != nil {
+				return nil, io.ErrUnexpectedEOF
+			} else if c[0] == 'e' {
+				d.readByte()
+				return list, nil
+			}
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	case b == 'd':
+		m := make(map[string]interface{})
+		for {
+			if c, err := d.r.Peek(1); err != nil {
+				return nil, io.ErrUnexpectedEOF
+			} else if c[0] == 'e' {
+				d.readByte()
+				return m, nil
+			}
+			k, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, errInvalidBencode
+			}
+			if depth == 0 && key == d.rawKey && d.buf == nil {
+				d.buf = new(bytes.Buffer)
+				v, err := d.decode(depth + 1)
+				d.raw, d.buf = d.buf.Bytes(), nil
+				if err != nil {
+					return nil, err
+				}
+				m[key] = v
+				continue
+			}
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		}
+	}
+	return nil, errInvalidBencode
+}
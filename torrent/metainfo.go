@@ -0,0 +1,359 @@
+// Package torrent distributes CAS trees over BitTorrent.
+//
+// A torrent is created from all blobs reachable from a root ref: files of the tree are stored under their
+// paths and all other blobs (schema blobs, parts of large files) are stored in the ".cas" directory.
+// Each file in the torrent records the CAS ref of its content, thus a fetched tree is verified against
+// CAS refs in addition to the piece checksums.
+//
+// Only the metainfo (.torrent) files are supported for fetching: magnet links can be generated for
+// other clients, but metadata exchange is not implemented.
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+const (
+	// DefaultPieceSize is the default size of torrent pieces.
+	DefaultPieceSize = 256 << 10
+
+	// casDir is the directory for blobs that are not files of the tree.
+	casDir = ".cas"
+
+	keyInfo = "info"
+	keyRef  = "cas.ref"  // CAS ref of a file
+	keyRoot = "cas.root" // CAS ref of the root
+)
+
+// File is a single file in the torrent.
+type File struct {
+	Path   []string
+	Length int64
+	Ref    types.Ref // CAS ref of the file content
+
+	offset int64 // offset in the torrent data
+}
+
+// MetaInfo describes a torrent of a CAS tree.
+type MetaInfo struct {
+	Announce    string // tracker URL; optional
+	Name        string
+	Root        types.Ref
+	PieceLength int64
+	Pieces      [][sha1.Size]byte
+	Files       []File
+	InfoHash    [sha1.Size]byte
+}
+
+// TotalLength returns the size of all files in the torrent.
+func (m *MetaInfo) TotalLength() int64 {
+	if len(m.Files) == 0 {
+		return 0
+	}
+	f := m.Files[len(m.Files)-1]
+	return f.offset + f.Length
+}
+
+// pieceSize returns the size of a given piece.
+func (m *MetaInfo) pieceSize(i int) int64 {
+	if i == len(m.Pieces)-1 {
+		return m.TotalLength() - int64(i)*m.PieceLength
+	}
+	return m.PieceLength
+}
+
+func (m *MetaInfo) setOffsets() {
+	var off int64
+	for i := range m.Files {
+		m.Files[i].offset = off
+		off += m.Files[i].Length
+	}
+}
+
+func (m *MetaInfo) info() map[string]interface{} {
+	files := make([]interface{}, 0, len(m.Files))
+	for _, f := range m.Files {
+		path := make([]interface{}, 0, len(f.Path))
+		for _, p := range f.Path {
+			path = append(path, p)
+		}
+		files = append(files, map[string]interface{}{
+			"length": f.Length,
+			"path":   path,
+			keyRef:   f.Ref.String(),
+		})
+	}
+	pieces := make([]byte, 0, len(m.Pieces)*sha1.Size)
+	for _, p := range m.Pieces {
+		pieces = append(pieces, p[:]...)
+	}
+	return map[string]interface{}{
+		"name":         m.Name,
+		"piece length": m.PieceLength,
+		"pieces":       pieces,
+		"files":        files,
+		keyRoot:        m.Root.String(),
+	}
+}
+
+func (m *MetaInfo) setInfoHash() error {
+	buf := new(bytes.Buffer)
+	if err := bencode(buf, m.info()); err != nil {
+		return err
+	}
+	m.InfoHash = sha1.Sum(buf.Bytes())
+	return nil
+}
+
+// WriteTo writes the metainfo file.
+func (m *MetaInfo) WriteTo(w io.Writer) (int64, error) {
+	d := map[string]interface{}{keyInfo: m.info()}
+	if m.Announce != "" {
+		d["announce"] = m.Announce
+	}
+	buf := new(bytes.Buffer)
+	if err := bencode(buf, d); err != nil {
+		return 0, err
+	}
+	return buf.WriteTo(w)
+}
+
+// Magnet returns a magnet link for the torrent.
+func (m *MetaInfo) Magnet() string {
+	v := url.Values{}
+	v.Set("dn", m.Name)
+	if m.Announce != "" {
+		v.Set("tr", m.Announce)
+	}
+	return "magnet:?xt=urn:btih:" + hex.EncodeToString(m.InfoHash[:]) + "&" + v.Encode()
+}
+
+var errInvalidTorrent = errors.New("torrent: invalid metainfo")
+
+// Parse reads a metainfo file. Only torrents created from CAS trees are supported.
+func Parse(r io.Reader) (*MetaInfo, error) {
+	d := &bdecoder{r: bufio.NewReader(r), rawKey: keyInfo}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	top, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errInvalidTorrent
+	}
+	info, ok := top[keyInfo].(map[string]interface{})
+	if !ok {
+		return nil, errInvalidTorrent
+	}
+	m := &MetaInfo{InfoHash: sha1.Sum(d.raw)}
+	m.Announce, _ = top["announce"].(string)
+	m.Name, _ = info["name"].(string)
+	m.PieceLength, _ = info["piece length"].(int64)
+	root, _ := info[keyRoot].(string)
+	if m.Root, err = types.ParseRef(root); err != nil {
+		return nil, fmt.Errorf("torrent: not a CAS torrent: %v", err)
+	}
+	pieces, _ := info["pieces"].(string)
+	if m.PieceLength <= 0 || len(pieces)%sha1.Size != 0 {
+		return nil, errInvalidTorrent
+	}
+	for i := 0; i < len(pieces); i += sha1.Size {
+		var p [sha1.Size]byte
+		copy(p[:], pieces[i:])
+		m.Pieces = append(m.Pieces, p)
+	}
+	files, _ := info["files"].([]interface{})
+	for _, fv := range files {
+		fd, ok := fv.(map[string]interface{})
+		if !ok {
+			return nil, errInvalidTorrent
+		}
+		var f File
+		f.Length, _ = fd["length"].(int64)
+		path, _ := fd["path"].([]interface{})
+		for _, p := range path {
+			s, ok := p.(string)
+			if !ok || s == "" || s == "." || s == ".." || strings.ContainsAny(s, "/\\") {
+				return nil, errInvalidTorrent
+			}
+			f.Path = append(f.Path, s)
+		}
+		ref, _ := fd[keyRef].(string)
+		if f.Ref, err = types.ParseRef(ref); err != nil {
+			return nil, fmt.Errorf("torrent: not a CAS torrent: %v", err)
+		}
+		if f.Length < 0 || len(f.Path) == 0 {
+			return nil, errInvalidTorrent
+		}
+		m.Files = append(m.Files, f)
+	}
+	m.setOffsets()
+	if exp := (m.TotalLength() + m.PieceLength - 1) / m.PieceLength; int64(len(m.Pieces)) != exp {
+		return nil, errInvalidTorrent
+	}
+	return m, nil
+}
+
+// CreateOptions are options for creating torrents.
+type CreateOptions struct {
+	Name        string // name of the torrent; the root ref is used if not set
+	Announce    string // tracker URL
+	PieceLength int64  // DefaultPieceSize is used if not set
+}
+
+// Create makes a torrent that contains all blobs reachable from the root.
+// Blobs that are not stored locally (for example, index-only files) are skipped.
+func Create(ctx context.Context, s *cas.Storage, root types.Ref, opts *CreateOptions) (*MetaInfo, error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	m := &MetaInfo{
+		Announce: opts.Announce, Name: opts.Name,
+		Root: root, PieceLength: opts.PieceLength,
+	}
+	if m.Name == "" {
+		m.Name = refFileName(root)
+	}
+	if m.PieceLength <= 0 {
+		m.PieceLength = DefaultPieceSize
+	}
+	paths := make(map[types.Ref][]string)
+	if err := treePaths(ctx, s, root, nil, paths); err != nil {
+		return nil, err
+	}
+	seen := make(map[types.Ref]struct{})
+	queue := []types.Ref{root}
+	for len(queue) != 0 {
+		ref := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[ref]; ok || ref.Zero() {
+			continue
+		}
+		seen[ref] = struct{}{}
+		size, err := s.StatBlob(ctx, ref)
+		if err == storage.ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		f := File{Length: int64(size), Ref: ref}
+		if ref.Empty() {
+			f.Path = paths[ref]
+		} else {
+			obj, err := s.DecodeSchema(ctx, ref)
+			if err == nil {
+				queue = append(queue, obj.References()...)
+			} else if err != schema.ErrNotSchema {
+				return nil, err
+			} else {
+				f.Path = paths[ref]
+			}
+		}
+		if len(f.Path) == 0 {
+			f.Path = []string{casDir, refFileName(ref)}
+		}
+		m.Files = append(m.Files, f)
+	}
+	m.setOffsets()
+
+	ph := &pieceHasher{size: m.PieceLength, h: sha1.New()}
+	for _, f := range m.Files {
+		rc, _, err := s.FetchBlob(ctx, f.Ref)
+		if err != nil {
+			return nil, err
+		}
+		n, err := io.Copy(ph, rc)
+		rc.Close()
+		if err == nil && n != f.Length {
+			err = storage.ErrSizeMissmatch{Exp: uint64(f.Length), Got: uint64(n)}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	m.Pieces = ph.finish()
+	if err := m.setInfoHash(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// refFileName returns a file name for a ref. Colons are not allowed in file names on some systems.
+func refFileName(ref types.Ref) string {
+	return strings.Replace(ref.String(), ":", "-", -1)
+}
+
+// treePaths finds paths of raw data blobs in the tree. Only the first path is recorded for each blob.
+func treePaths(ctx context.Context, s *cas.Storage, ref types.Ref, path []string, out map[types.Ref][]string) error {
+	ents, err := s.ReadDir(ctx, ref)
+	if err == cas.ErrNotDir {
+		if _, ok := out[ref]; !ok && len(path) != 0 && path[0] != casDir {
+			out[ref] = path
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		sub := append(path[:len(path):len(path)], e.Name)
+		if err = treePaths(ctx, s, e.Ref, sub, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pieceHasher calculates SHA-1 of each piece of data.
+type pieceHasher struct {
+	size int64
+	h    hash.Hash
+	n    int64
+	out  [][sha1.Size]byte
+}
+
+func (p *pieceHasher) sum() {
+	var s [sha1.Size]byte
+	p.h.Sum(s[:0])
+	p.out = append(p.out, s)
+	p.h.Reset()
+	p.n = 0
+}
+
+func (p *pieceHasher) Write(b []byte) (int, error) {
+	total := len(b)
+	for len(b) != 0 {
+		c := b
+		if rem := p.size - p.n; int64(len(c)) > rem {
+			c = c[:rem]
+		}
+		p.h.Write(c)
+		p.n += int64(len(c))
+		b = b[len(c):]
+		if p.n == p.size {
+			p.sum()
+		}
+	}
+	return total, nil
+}
+
+func (p *pieceHasher) finish() [][sha1.Size]byte {
+	if p.n != 0 {
+		p.sum()
+	}
+	return p.out
+}
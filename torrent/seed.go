@@ -0,0 +1,136 @@
+package torrent
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/dennwc/cas"
+)
+
+// idleTimeout is the time after which idle peer connections are closed.
+const idleTimeout = 2 * time.Minute
+
+// Seeder serves torrent pieces from a CAS storage.
+type Seeder struct {
+	s  *cas.Storage
+	m  *MetaInfo
+	id PeerID
+}
+
+// NewSeeder creates a seeder for a torrent. All blobs of the torrent must be available in the storage.
+func NewSeeder(s *cas.Storage, m *MetaInfo) *Seeder {
+	return &Seeder{s: s, m: m, id: NewPeerID()}
+}
+
+// Serve accepts peer connections on the listener until the context is cancelled.
+func (sd *Seeder) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go func() {
+			defer c.Close()
+			_ = sd.serveConn(ctx, c)
+		}()
+	}
+}
+
+func (sd *Seeder) serveConn(ctx context.Context, c net.Conn) error {
+	c.SetDeadline(time.Now().Add(idleTimeout))
+	r := bufio.NewReader(c)
+	hash, _, err := readHandshake(r)
+	if err != nil {
+		return err
+	} else if hash != sd.m.InfoHash {
+		return errProtocol
+	}
+	if err = writeHandshake(c, sd.m.InfoHash, sd.id); err != nil {
+		return err
+	}
+	bf := newBitfield(len(sd.m.Pieces))
+	for i := range sd.m.Pieces {
+		bf.set(i)
+	}
+	if err = writeMessage(c, msgBitfield, bf); err != nil {
+		return err
+	}
+	for {
+		c.SetDeadline(time.Now().Add(idleTimeout))
+		msg, err := readMessage(r)
+		if err != nil {
+			return err
+		}
+		switch msg.ID {
+		case msgInterested:
+			err = writeMessage(c, msgUnchoke)
+		case msgRequest:
+			if len(msg.Payload) != 12 {
+				return errProtocol
+			}
+			index := int(binary.BigEndian.Uint32(msg.Payload[0:]))
+			begin := int64(binary.BigEndian.Uint32(msg.Payload[4:]))
+			length := int64(binary.BigEndian.Uint32(msg.Payload[8:]))
+			if index >= len(sd.m.Pieces) || length > maxBlockSize || begin+length > sd.m.pieceSize(index) {
+				return errProtocol
+			}
+			buf := make([]byte, length)
+			if err = sd.readAt(ctx, buf, int64(index)*sd.m.PieceLength+begin); err != nil {
+				return err
+			}
+			err = writeMessage(c, msgPiece, msg.Payload[:8], buf)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readAt reads the torrent data at a given offset.
+func (sd *Seeder) readAt(ctx context.Context, p []byte, off int64) error {
+	files := sd.m.Files
+	i := sort.Search(len(files), func(i int) bool {
+		return files[i].offset+files[i].Length > off
+	})
+	for ; len(p) != 0 && i < len(files); i++ {
+		f := files[i]
+		if f.Length == 0 {
+			continue
+		}
+		foff := off - f.offset
+		n := f.Length - foff
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		rc, _, err := sd.s.FetchBlob(ctx, f.Ref)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(ioutil.Discard, rc, foff)
+		if err == nil {
+			_, err = io.ReadFull(rc, p[:n])
+		}
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		p, off = p[n:], off+n
+	}
+	if len(p) != 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
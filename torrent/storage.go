@@ -0,0 +1,489 @@
+package torrent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/types"
+)
+
+var _ storage.Storage = (*Storage)(nil)
+
+// dialTimeout is the timeout for connecting to peers.
+const dialTimeout = 10 * time.Second
+
+// Options for the torrent storage.
+type Options struct {
+	Peers  []string     // addresses of peers; used in addition to the tracker
+	Port   int          // port reported to the tracker
+	Client *http.Client // HTTP client for the tracker; http.DefaultClient is used if not set
+}
+
+// NewStorage creates a fetch-only storage that downloads blobs of a torrent from peers.
+//
+// Pieces are verified with the checksums from the metainfo and each blob is verified against its CAS ref.
+// The root of the torrent is available as a pin with the name of the torrent.
+func NewStorage(m *MetaInfo, opts *Options) *Storage {
+	if opts == nil {
+		opts = &Options{}
+	}
+	s := &Storage{
+		m: m, opts: *opts, id: NewPeerID(),
+		byRef: make(map[types.Ref]int, len(m.Files)),
+		conns: make(map[string]*peerConn),
+	}
+	for i, f := range m.Files {
+		if _, ok := s.byRef[f.Ref]; !ok {
+			s.byRef[f.Ref] = i
+		}
+	}
+	return s
+}
+
+// Storage is a fetch-only storage backed by a torrent swarm.
+type Storage struct {
+	m     *MetaInfo
+	opts  Options
+	id    PeerID
+	byRef map[types.Ref]int
+
+	mu        sync.Mutex
+	announced bool
+	peers     []string
+	conns     map[string]*peerConn
+}
+
+func (s *Storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, c := range s.conns {
+		c.Close()
+		delete(s.conns, addr)
+	}
+	return nil
+}
+
+func (s *Storage) file(ref types.Ref) (*File, error) {
+	if ref.Zero() {
+		return nil, storage.ErrInvalidRef
+	}
+	i, ok := s.byRef[ref]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return &s.m.Files[i], nil
+}
+
+func (s *Storage) StatBlob(ctx context.Context, ref types.Ref) (uint64, error) {
+	f, err := s.file(ref)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(f.Length), nil
+}
+
+// FetchBlob downloads and verifies all pieces of the blob. The content is spooled to a temporary file.
+func (s *Storage) FetchBlob(ctx context.Context, ref types.Ref) (io.ReadCloser, uint64, error) {
+	f, err := s.file(ref)
+	if err != nil {
+		return nil, 0, err
+	} else if f.Length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), 0, nil
+	}
+	tmp, err := ioutil.TempFile("", "cas_torrent_")
+	if err != nil {
+		return nil, 0, err
+	}
+	rc := &tempFile{tmp}
+	if err = s.download(ctx, f, tmp); err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		rc.Close()
+		return nil, 0, err
+	}
+	return rc, uint64(f.Length), nil
+}
+
+// download fetches all pieces of the file and writes its content to w.
+func (s *Storage) download(ctx context.Context, f *File, w io.Writer) error {
+	h := f.Ref.Hash()
+	first := int(f.offset / s.m.PieceLength)
+	last := int((f.offset + f.Length - 1) / s.m.PieceLength)
+	for i := first; i <= last; i++ {
+		data, err := s.fetchPiece(ctx, i)
+		if err != nil {
+			return err
+		}
+		// trim the piece to the file boundaries
+		start := int64(i) * s.m.PieceLength
+		if f.offset > start {
+			data = data[f.offset-start:]
+			start = f.offset
+		}
+		if end := f.offset + f.Length; start+int64(len(data)) > end {
+			data = data[:end-start]
+		}
+		h.Write(data)
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+	}
+	if got := f.Ref.WithHash(h); got != f.Ref {
+		return storage.ErrRefMissmatch{Exp: f.Ref, Got: got}
+	}
+	return nil
+}
+
+// peerList returns known peers. The tracker is contacted on the first call.
+func (s *Storage) peerList(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.announced {
+		peers, err := Announce(ctx, s.opts.Client, s.m, s.id, s.opts.Port, s.m.TotalLength())
+		if err != nil && len(s.opts.Peers) == 0 {
+			return nil, err
+		}
+		s.announced = true
+		s.peers = append(append([]string{}, s.opts.Peers...), peers...)
+	}
+	if len(s.peers) == 0 {
+		return nil, fmt.Errorf("torrent: no peers")
+	}
+	return s.peers, nil
+}
+
+// fetchPiece downloads a piece from the first peer that has it.
+func (s *Storage) fetchPiece(ctx context.Context, i int) ([]byte, error) {
+	peers, err := s.peerList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var last error
+	for _, addr := range peers {
+		c, err := s.conn(ctx, addr)
+		if err != nil {
+			last = err
+			continue
+		}
+		data, err := c.fetchPiece(ctx, i, s.m.pieceSize(i))
+		if err == nil && sha1.Sum(data) != s.m.Pieces[i] {
+			err = fmt.Errorf("torrent: invalid piece %d from %s", i, addr)
+		}
+		if err == nil {
+			c.release()
+			return data, nil
+		}
+		last = err
+		if err != errNoPiece {
+			s.dropConn(addr, c)
+		} else {
+			c.release()
+		}
+	}
+	return nil, last
+}
+
+// conn returns a connection to the peer, dialing it if necessary. The connection is locked and must be released.
+func (s *Storage) conn(ctx context.Context, addr string) (*peerConn, error) {
+	s.mu.Lock()
+	c, ok := s.conns[addr]
+	if !ok {
+		c = &peerConn{}
+		s.conns[addr] = c
+	}
+	s.mu.Unlock()
+	c.mu.Lock()
+	if c.c != nil {
+		return c, nil
+	}
+	if err := c.dial(ctx, addr, s.m, s.id); err != nil {
+		c.mu.Unlock()
+		s.dropConn(addr, nil)
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *Storage) dropConn(addr string, c *peerConn) {
+	if c != nil {
+		c.Close()
+		c.release()
+	}
+	s.mu.Lock()
+	delete(s.conns, addr)
+	s.mu.Unlock()
+}
+
+func (s *Storage) IterateBlobs(ctx context.Context) storage.Iterator {
+	return &blobIterator{s: s, i: -1}
+}
+
+func (s *Storage) BeginBlob(ctx context.Context) (storage.BlobWriter, error) {
+	return nil, storage.ErrReadOnly
+}
+
+// GetPin returns the root of the torrent for the pin with the name of the torrent.
+func (s *Storage) GetPin(ctx context.Context, name string) (types.Ref, error) {
+	if name != s.m.Name {
+		return types.Ref{}, storage.ErrNotFound
+	}
+	return s.m.Root, nil
+}
+
+func (s *Storage) SetPin(ctx context.Context, name string, ref types.Ref) error {
+	return storage.ErrReadOnly
+}
+
+func (s *Storage) DeletePin(ctx context.Context, name string) error {
+	return storage.ErrReadOnly
+}
+
+func (s *Storage) IteratePins(ctx context.Context) storage.PinIterator {
+	return &pinIterator{pin: types.Pin{Name: s.m.Name, Ref: s.m.Root}}
+}
+
+type blobIterator struct {
+	s *Storage
+	i int
+}
+
+func (it *blobIterator) Next() bool {
+	for it.i+1 < len(it.s.m.Files) {
+		it.i++
+		f := it.s.m.Files[it.i]
+		if it.s.byRef[f.Ref] == it.i {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *blobIterator) SizedRef() types.SizedRef {
+	f := it.s.m.Files[it.i]
+	return types.SizedRef{Ref: f.Ref, Size: uint64(f.Length)}
+}
+
+func (it *blobIterator) Err() error {
+	return nil
+}
+
+func (it *blobIterator) Close() error {
+	it.i = len(it.s.m.Files)
+	return nil
+}
+
+type pinIterator struct {
+	pin  types.Pin
+	done bool
+}
+
+func (it *pinIterator) Next() bool {
+	if it.done {
+		return false
+	}
+	it.done = true
+	return true
+}
+
+func (it *pinIterator) Pin() types.Pin {
+	return it.pin
+}
+
+func (it *pinIterator) Err() error {
+	return nil
+}
+
+func (it *pinIterator) Close() error {
+	it.done = true
+	return nil
+}
+
+// tempFile removes the file when closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// errNoPiece is returned if the peer doesn't have a requested piece.
+var errNoPiece = fmt.Errorf("torrent: peer doesn't have the piece")
+
+// peerConn is a connection to a single peer. Pieces are downloaded sequentially.
+type peerConn struct {
+	mu     sync.Mutex
+	c      net.Conn
+	r      *bufio.Reader
+	have   bitfield
+	choked bool
+}
+
+func (c *peerConn) release() {
+	c.mu.Unlock()
+}
+
+func (c *peerConn) Close() error {
+	if c.c == nil {
+		return nil
+	}
+	err := c.c.Close()
+	c.c = nil
+	return err
+}
+
+func (c *peerConn) deadline(ctx context.Context) {
+	t := time.Now().Add(idleTimeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(t) {
+		t = dl
+	}
+	c.c.SetDeadline(t)
+}
+
+func (c *peerConn) dial(ctx context.Context, addr string, m *MetaInfo, id PeerID) error {
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	c.c, c.r = conn, bufio.NewReader(conn)
+	c.have = newBitfield(len(m.Pieces))
+	c.choked = true
+	c.deadline(ctx)
+	err = writeHandshake(conn, m.InfoHash, id)
+	if err == nil {
+		var hash [sha1.Size]byte
+		hash, _, err = readHandshake(c.r)
+		if err == nil && hash != m.InfoHash {
+			err = fmt.Errorf("torrent: peer %s serves a different torrent", addr)
+		}
+	}
+	if err == nil {
+		err = writeMessage(conn, msgInterested)
+	}
+	if err != nil {
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+// handle processes state messages from the peer.
+func (c *peerConn) handle(msg *message) error {
+	switch msg.ID {
+	case msgChoke:
+		c.choked = true
+	case msgUnchoke:
+		c.choked = false
+	case msgBitfield:
+		if len(msg.Payload) != len(c.have) {
+			return errProtocol
+		}
+		copy(c.have, msg.Payload)
+	case msgHave:
+		if len(msg.Payload) != 4 {
+			return errProtocol
+		}
+		c.have.set(int(binary.BigEndian.Uint32(msg.Payload)))
+	}
+	return nil
+}
+
+func (c *peerConn) fetchPiece(ctx context.Context, index int, size int64) ([]byte, error) {
+	c.deadline(ctx)
+	for c.choked {
+		msg, err := readMessage(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if err = c.handle(msg); err != nil {
+			return nil, err
+		}
+	}
+	if !c.have.has(index) {
+		return nil, errNoPiece
+	}
+	// pipeline all requests for the piece
+	for off := int64(0); off < size; off += blockSize {
+		n := size - off
+		if n > blockSize {
+			n = blockSize
+		}
+		if err := writeMessage(c.c, msgRequest, uint32s(int64(index), off, n)); err != nil {
+			return nil, err
+		}
+	}
+	data := make([]byte, size)
+	got := int64(0)
+	for got < size {
+		msg, err := readMessage(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if msg.ID != msgPiece {
+			if err = c.handle(msg); err != nil {
+				return nil, err
+			} else if c.choked {
+				// pending requests are dropped by the peer
+				return nil, fmt.Errorf("torrent: choked by the peer")
+			}
+			continue
+		}
+		if len(msg.Payload) < 8 || int(binary.BigEndian.Uint32(msg.Payload)) != index {
+			return nil, errProtocol
+		}
+		off := int64(binary.BigEndian.Uint32(msg.Payload[4:]))
+		block := msg.Payload[8:]
+		if off+int64(len(block)) > size {
+			return nil, errProtocol
+		}
+		copy(data[off:], block)
+		got += int64(len(block))
+	}
+	return data, nil
+}
+
+// Fetch downloads all blobs of the torrent that are missing in the storage and returns the root ref.
+func Fetch(ctx context.Context, dst *cas.Storage, m *MetaInfo, opts *Options) (types.Ref, error) {
+	src := NewStorage(m, opts)
+	defer src.Close()
+	it := src.IterateBlobs(ctx)
+	defer it.Close()
+	for it.Next() {
+		sr := it.SizedRef()
+		if _, err := dst.StatBlob(ctx, sr.Ref); err == nil {
+			continue
+		} else if err != storage.ErrNotFound {
+			return types.Ref{}, err
+		}
+		rc, _, err := src.FetchBlob(ctx, sr.Ref)
+		if err != nil {
+			return types.Ref{}, err
+		}
+		_, err = dst.StoreBlob(ctx, rc, &cas.StoreConfig{Expect: sr})
+		rc.Close()
+		if err != nil {
+			return types.Ref{}, err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return types.Ref{}, err
+	}
+	return m.Root, nil
+}
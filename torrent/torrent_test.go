@@ -0,0 +1,128 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/storage"
+)
+
+func newTestStorage(t testing.TB) *cas.Storage {
+	s, err := cas.New(storage.NewInMemory())
+	require.NoError(t, err)
+	return s
+}
+
+func TestBencode(t *testing.T) {
+	v := map[string]interface{}{
+		"b": []interface{}{"x", int64(-3)},
+		"a": map[string]interface{}{"k": "v"},
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, bencode(buf, v))
+	require.Equal(t, "d1:ad1:k1:ve1:bl1:xi-3eee", buf.String())
+
+	got, err := bdecode(buf)
+	require.NoError(t, err)
+	require.Equal(t, v, got)
+
+	_, err = bdecode(strings.NewReader("l1:a"))
+	require.NotNil(t, err)
+}
+
+func TestTorrent(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_torrent_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.txt":     "file a",
+		"b/c.txt":   "file c",
+		"b/d/e.txt": strings.Repeat("e", 1000),
+	}
+	for name, data := range files {
+		fpath := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(fpath), 0755))
+		require.NoError(t, ioutil.WriteFile(fpath, []byte(data), 0644))
+	}
+
+	src := newTestStorage(t)
+	defer src.Close()
+	sr, err := src.StoreFilePath(ctx, dir, nil)
+	require.NoError(t, err)
+
+	m, err := Create(ctx, src, sr.Ref, &CreateOptions{Name: "test", PieceLength: 100})
+	require.NoError(t, err)
+	require.Equal(t, sr.Ref, m.Root)
+	var paths []string
+	for _, f := range m.Files {
+		if f.Path[0] != casDir {
+			paths = append(paths, strings.Join(f.Path, "/"))
+		}
+	}
+	require.ElementsMatch(t, []string{"a.txt", "b/c.txt", "b/d/e.txt"}, paths)
+
+	buf := new(bytes.Buffer)
+	_, err = m.WriteTo(buf)
+	require.NoError(t, err)
+	m2, err := Parse(buf)
+	require.NoError(t, err)
+	require.Equal(t, m, m2)
+	require.True(t, strings.HasPrefix(m.Magnet(), "magnet:?xt=urn:btih:"))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go NewSeeder(src, m).Serve(ctx, l)
+
+	// tracker that returns the seeder
+	peer := l.Addr().(*net.TCPAddr)
+	tr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, string(m.InfoHash[:]), r.URL.Query().Get("info_hash"))
+		var p [6]byte
+		copy(p[:], peer.IP.To4())
+		binary.BigEndian.PutUint16(p[4:], uint16(peer.Port))
+		resp := new(bytes.Buffer)
+		bencode(resp, map[string]interface{}{"interval": 60, "peers": string(p[:])})
+		w.Write(resp.Bytes())
+	}))
+	defer tr.Close()
+	m2.Announce = tr.URL
+
+	dst := newTestStorage(t)
+	defer dst.Close()
+	root, err := Fetch(ctx, dst, m2, nil)
+	require.NoError(t, err)
+	require.Equal(t, sr.Ref, root)
+
+	out := filepath.Join(dir, "out")
+	require.NoError(t, dst.Checkout(ctx, root, out))
+	for name, data := range files {
+		got, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+		require.NoError(t, err)
+		require.Equal(t, data, string(got))
+	}
+
+	// pins and read-only
+	ts := NewStorage(m, &Options{Peers: []string{l.Addr().String()}})
+	defer ts.Close()
+	ref, err := ts.GetPin(ctx, "test")
+	require.NoError(t, err)
+	require.Equal(t, sr.Ref, ref)
+	_, err = ts.BeginBlob(ctx)
+	require.Equal(t, storage.ErrReadOnly, err)
+}
@@ -0,0 +1,85 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Announce registers the peer on the tracker of the torrent and returns addresses of other peers.
+// Left is the number of bytes the peer still has to download.
+func Announce(ctx context.Context, cli *http.Client, m *MetaInfo, id PeerID, port int, left int64) ([]string, error) {
+	if m.Announce == "" {
+		return nil, nil
+	}
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+	q := url.Values{}
+	q.Set("info_hash", string(m.InfoHash[:]))
+	q.Set("peer_id", string(id[:]))
+	q.Set("port", strconv.Itoa(port))
+	q.Set("uploaded", "0")
+	q.Set("downloaded", "0")
+	q.Set("left", strconv.FormatInt(left, 10))
+	q.Set("compact", "1")
+	q.Set("event", "started")
+	addr := m.Announce
+	if strings.Contains(addr, "?") {
+		addr += "&"
+	} else {
+		addr += "?"
+	}
+	req, err := http.NewRequest("GET", addr+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cli.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("torrent: tracker: %s", resp.Status)
+	}
+	v, err := bdecode(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errProtocol
+	}
+	if msg, ok := d["failure reason"].(string); ok {
+		return nil, fmt.Errorf("torrent: tracker: %s", msg)
+	}
+	var peers []string
+	switch p := d["peers"].(type) {
+	case string:
+		// compact format: 4 bytes of IP and 2 bytes of port
+		if len(p)%6 != 0 {
+			return nil, errProtocol
+		}
+		for i := 0; i < len(p); i += 6 {
+			ip := net.IP([]byte(p[i : i+4]))
+			port := binary.BigEndian.Uint16([]byte(p[i+4 : i+6]))
+			peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+		}
+	case []interface{}:
+		for _, e := range p {
+			pd, ok := e.(map[string]interface{})
+			if !ok {
+				return nil, errProtocol
+			}
+			ip, _ := pd["ip"].(string)
+			port, _ := pd["port"].(int64)
+			peers = append(peers, net.JoinHostPort(ip, strconv.FormatInt(port, 10)))
+		}
+	}
+	return peers, nil
+}
@@ -0,0 +1,144 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const protocolName = "BitTorrent protocol"
+
+// Peer wire protocol messages.
+const (
+	msgChoke         = 0
+	msgUnchoke       = 1
+	msgInterested    = 2
+	msgNotInterested = 3
+	msgHave          = 4
+	msgBitfield      = 5
+	msgRequest       = 6
+	msgPiece         = 7
+	msgCancel        = 8
+)
+
+const (
+	// blockSize is the size of blocks requested from peers.
+	blockSize = 16 << 10
+	// maxBlockSize is the max size of a block served to peers.
+	maxBlockSize = 128 << 10
+	// maxMessage is the max size of a single message.
+	maxMessage = 4 << 20
+)
+
+var errProtocol = errors.New("torrent: protocol error")
+
+// PeerID is an identifier of a peer.
+type PeerID [20]byte
+
+// NewPeerID generates a random peer ID.
+func NewPeerID() PeerID {
+	var id PeerID
+	n := copy(id[:], "-CA0001-")
+	rand.Read(id[n:])
+	return id
+}
+
+func writeHandshake(w io.Writer, infoHash [sha1.Size]byte, id PeerID) error {
+	buf := make([]byte, 0, 1+len(protocolName)+8+2*sha1.Size)
+	buf = append(buf, byte(len(protocolName)))
+	buf = append(buf, protocolName...)
+	buf = append(buf, make([]byte, 8)...) // reserved
+	buf = append(buf, infoHash[:]...)
+	buf = append(buf, id[:]...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readHandshake(r io.Reader) (infoHash [sha1.Size]byte, id PeerID, _ error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return infoHash, id, err
+	}
+	buf := make([]byte, int(b[0])+8+2*sha1.Size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return infoHash, id, err
+	}
+	if string(buf[:b[0]]) != protocolName {
+		return infoHash, id, fmt.Errorf("torrent: unsupported protocol: %q", buf[:b[0]])
+	}
+	buf = buf[int(b[0])+8:]
+	copy(infoHash[:], buf)
+	copy(id[:], buf[sha1.Size:])
+	return infoHash, id, nil
+}
+
+// message is a single peer wire protocol message. Keep-alive messages are not returned by readMessage.
+type message struct {
+	ID      byte
+	Payload []byte
+}
+
+func readMessage(r io.Reader) (*message, error) {
+	var b [4]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(b[:])
+		if n == 0 {
+			// keep-alive
+			continue
+		} else if n > maxMessage {
+			return nil, errProtocol
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return &message{ID: buf[0], Payload: buf[1:]}, nil
+	}
+}
+
+func writeMessage(w io.Writer, id byte, payload ...[]byte) error {
+	n := 1
+	for _, p := range payload {
+		n += len(p)
+	}
+	buf := make([]byte, 5, 4+n)
+	binary.BigEndian.PutUint32(buf, uint32(n))
+	buf[4] = id
+	for _, p := range payload {
+		buf = append(buf, p...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// uint32s encodes integers for request, cancel and have messages.
+func uint32s(v ...int64) []byte {
+	buf := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.BigEndian.PutUint32(buf[4*i:], uint32(x))
+	}
+	return buf
+}
+
+// bitfield is a set of pieces available on a peer.
+type bitfield []byte
+
+func newBitfield(n int) bitfield {
+	return make(bitfield, (n+7)/8)
+}
+
+func (b bitfield) has(i int) bool {
+	return i/8 < len(b) && b[i/8]&(0x80>>uint(i%8)) != 0
+}
+
+func (b bitfield) set(i int) {
+	if i/8 < len(b) {
+		b[i/8] |= 0x80 >> uint(i%8)
+	}
+}
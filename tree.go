@@ -0,0 +1,143 @@
+package cas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/types"
+)
+
+// ErrNotDir is returned when a directory operation is called on a file.
+var ErrNotDir = errors.New("not a directory")
+
+// ReadDir returns all entries of a directory (or a commit of a directory), sorted by name.
+// It returns ErrNotDir if the ref points to a file.
+func (s *Storage) ReadDir(ctx context.Context, ref types.Ref) ([]*schema.DirEntry, error) {
+	if ref.Zero() || ref.Empty() {
+		return nil, ErrNotDir
+	}
+	obj, err := s.DecodeSchema(ctx, ref)
+	if err == schema.ErrNotSchema {
+		return nil, ErrNotDir
+	} else if err != nil {
+		return nil, err
+	}
+	if c, ok := obj.(*schema.Commit); ok {
+		return s.ReadDir(ctx, c.Root)
+	} else if !isDirObject(obj) {
+		return nil, ErrNotDir
+	}
+	var out []*schema.DirEntry
+	if err = s.readDir(ctx, obj, &out); err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+func isDirObject(obj schema.Object) bool {
+	switch obj := obj.(type) {
+	case *schema.InlineList:
+		return obj.Elem == typeDirEnt
+	case *schema.List:
+		return obj.Elem == typeDirEnt
+	}
+	return false
+}
+
+func (s *Storage) readDir(ctx context.Context, obj schema.Object, out *[]*schema.DirEntry) error {
+	switch obj := obj.(type) {
+	case *schema.InlineList:
+		for _, e := range obj.List {
+			ent, ok := e.(*schema.DirEntry)
+			if !ok {
+				return fmt.Errorf("expected dir entry, got: %T", e)
+			}
+			*out = append(*out, ent)
+		}
+		return nil
+	case *schema.List:
+		// list of pages
+		for _, ref := range obj.List {
+			sub, err := s.DecodeSchema(ctx, ref)
+			if err == schema.ErrNotSchema {
+				return fmt.Errorf("expected a schema blob in JoinDirectories")
+			} else if err != nil {
+				return err
+			}
+			if err = s.readDir(ctx, sub, out); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported dir object: %T", obj)
+}
+
+// ErrIsDir is returned when a file operation is called on a directory.
+var ErrIsDir = errors.New("is a directory")
+
+// openFile opens the content of a file. It supports raw blobs, files split into multiple parts and commits of files.
+func (s *Storage) openFile(ctx context.Context, ref types.Ref) (io.ReadCloser, SizedRef, error) {
+	if ref.Empty() {
+		rc, _, err := s.FetchBlob(ctx, ref)
+		return rc, SizedRef{Ref: ref}, err
+	}
+	obj, err := s.DecodeSchema(ctx, ref)
+	if err == schema.ErrNotSchema {
+		rc, sz, err := s.FetchBlob(ctx, ref)
+		return rc, SizedRef{Ref: ref, Size: sz}, err
+	} else if err != nil {
+		return nil, SizedRef{}, err
+	}
+	switch obj := obj.(type) {
+	case *schema.Commit:
+		return s.openFile(ctx, obj.Root)
+	case *schema.InlineList, *schema.List, *schema.Multipart:
+		if isDirObject(obj) {
+			return nil, SizedRef{}, ErrIsDir
+		}
+		return s.openMultipart(ctx, ref, obj)
+	case schema.BlobWrapper:
+		ref = obj.DataBlob()
+		rc, sz, err := s.FetchBlob(ctx, ref)
+		return rc, SizedRef{Ref: ref, Size: sz}, err
+	}
+	return nil, SizedRef{}, fmt.Errorf("unsupported file object: %T", obj)
+}
+
+// Lookup finds an entry with a given slash-separated path relative to the root (a directory or a commit).
+// It returns nil for an empty path and os.ErrNotExist if the path cannot be found.
+func (s *Storage) Lookup(ctx context.Context, root types.Ref, path string) (*schema.DirEntry, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil, nil
+	}
+	var ent *schema.DirEntry
+	ref := root
+	for _, elem := range strings.Split(path, "/") {
+		ents, err := s.ReadDir(ctx, ref)
+		if err == ErrNotDir {
+			return nil, os.ErrNotExist
+		} else if err != nil {
+			return nil, err
+		}
+		i := sort.Search(len(ents), func(i int) bool {
+			return ents[i].Name >= elem
+		})
+		if i >= len(ents) || ents[i].Name != elem {
+			return nil, os.ErrNotExist
+		}
+		ent = ents[i]
+		ref = ent.Ref
+	}
+	return ent, nil
+}
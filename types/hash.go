@@ -0,0 +1,73 @@
+package types
+
+import (
+	"crypto/sha256"
+	"hash"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/cpu"
+)
+
+// HashImpl describes an implementation of the hash function used for refs.
+type HashImpl struct {
+	// Name of the implementation, for example "crypto/sha256".
+	Name string
+	// Accel is a list of hardware extensions used by the implementation, for example "sha-ni", "avx2" or "sha2".
+	Accel []string
+}
+
+func (h HashImpl) String() string {
+	if len(h.Accel) == 0 {
+		return h.Name + " (generic)"
+	}
+	return h.Name + " (" + strings.Join(h.Accel, ", ") + ")"
+}
+
+var sha256Impl = struct {
+	sync.Once
+	impl HashImpl
+	new  func() hash.Hash
+}{
+	new: sha256.New,
+}
+
+// SetSHA256 replaces the implementation of SHA-256 used for refs.
+//
+// It allows binaries to use an alternative implementation, for example github.com/minio/sha256-simd:
+//
+//	types.SetSHA256(types.HashImpl{Name: "sha256-simd", Accel: []string{"avx512"}}, sha256simd.New)
+//
+// It must be called before any refs are computed, for example in the init function.
+func SetSHA256(impl HashImpl, fnc func() hash.Hash) {
+	sha256Impl.Do(func() {})
+	sha256Impl.impl = impl
+	sha256Impl.new = fnc
+}
+
+// HashImplementation returns the implementation of the default hash function.
+func HashImplementation() HashImpl {
+	sha256Impl.Do(func() {
+		sha256Impl.impl = HashImpl{Name: "crypto/sha256", Accel: sha256Accel()}
+	})
+	return sha256Impl.impl
+}
+
+// sha256Accel detects hardware extensions that are used by crypto/sha256.
+// Go standard library selects the implementation automatically, based on the same CPU features.
+func sha256Accel() []string {
+	var accel []string
+	if hasSHANI() {
+		accel = append(accel, "sha-ni")
+	}
+	if cpu.X86.HasAVX2 && cpu.X86.HasBMI2 {
+		accel = append(accel, "avx2")
+	}
+	if cpu.ARM64.HasSHA2 {
+		accel = append(accel, "sha2")
+	}
+	if cpu.S390X.HasSHA256 {
+		accel = append(accel, "cpacf")
+	}
+	return accel
+}
@@ -0,0 +1,38 @@
+package types
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// hasSHANI checks if the CPU supports Intel SHA extensions.
+func hasSHANI() bool {
+	if runtime.GOARCH != "amd64" && runtime.GOARCH != "386" {
+		return false
+	}
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "flags") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		for _, f := range strings.Fields(line[i+1:]) {
+			if f == "sha_ni" {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
@@ -0,0 +1,9 @@
+//+build !linux
+
+package types
+
+// hasSHANI checks if the CPU supports Intel SHA extensions.
+// The CPU flag is only read on Linux, thus it's reported as not available on other systems.
+func hasSHANI() bool {
+	return false
+}
@@ -10,6 +10,7 @@ import (
 	"hash"
 	"io"
 	"strings"
+	"time"
 )
 
 const (
@@ -250,12 +251,37 @@ func (r Ref) Hash() hash.Hash {
 	case "":
 		return nil
 	case hashSha256Name:
-		return sha256.New()
+		return sha256Impl.new()
 	default:
 		panic(fmt.Errorf("hash with unknown type: %q", r.name))
 	}
 }
 
+// Digest returns a raw hash value of the ref.
+func (r Ref) Digest() []byte {
+	if r.Zero() {
+		return nil
+	}
+	return append([]byte{}, r.data[:]...)
+}
+
+// RefFromDigest creates a ref from the name of the hash function and a raw hash value.
+func RefFromDigest(name string, digest []byte) (Ref, error) {
+	sz := 0
+	switch name {
+	case hashSha256Name:
+		sz = sha256.Size
+	default:
+		return Ref{}, fmt.Errorf("unsupported ref type: %q", name)
+	}
+	if len(digest) != sz {
+		return Ref{}, fmt.Errorf("wrong size for %s ref: expected %d, got %d", name, sz, len(digest))
+	}
+	ref := Ref{name: name}
+	copy(ref.data[:], digest)
+	return ref, nil
+}
+
 // WithHash returns a ref that is described by the specified hash.
 func (r Ref) WithHash(h hash.Hash) Ref {
 	_ = h.Sum(r.data[:0])
@@ -273,8 +299,24 @@ func Hash(r io.Reader) (SizedRef, error) {
 
 // Pin is a named reference to a blob.
 type Pin struct {
-	Name string `json:"name"`
-	Ref  Ref    `json:"ref"`
+	Name string   `json:"name"`
+	Ref  Ref      `json:"ref"`
+	Meta *PinMeta `json:"meta,omitempty"` // optional
+}
+
+// PinMeta is an optional metadata of a pin. It describes a snapshot the pin points to.
+type PinMeta struct {
+	Created     time.Time         `json:"created"`               // time the snapshot was created
+	Updated     time.Time         `json:"updated"`               // time of the last change of the metadata
+	Author      string            `json:"author,omitempty"`      // author of the snapshot
+	Description string            `json:"description,omitempty"` // free-form description
+	Labels      map[string]string `json:"labels,omitempty"`
+	Expires     *time.Time        `json:"expires,omitempty"` // the pin is ignored after this time
+}
+
+// Expired checks if the pin is expired at a given time. Pins without an expiration time never expire.
+func (m *PinMeta) Expired(now time.Time) bool {
+	return m != nil && m.Expires != nil && !now.Before(*m.Expires)
 }
 
 // References implements schema.Object interface.
@@ -2,6 +2,8 @@ package types
 
 import (
 	"crypto/sha256"
+	"hash"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -29,3 +31,20 @@ func TestRef(t *testing.T) {
 	require.Equal(t, b, r.data)
 	require.Equal(t, s, r.String())
 }
+
+func TestHashImpl(t *testing.T) {
+	impl := HashImplementation()
+	require.Equal(t, "crypto/sha256", impl.Name)
+	require.True(t, strings.HasPrefix(impl.String(), impl.Name+" ("))
+
+	exp := StringRef("data")
+	calls := 0
+	SetSHA256(HashImpl{Name: "test"}, func() hash.Hash {
+		calls++
+		return sha256.New()
+	})
+	defer SetSHA256(impl, sha256.New)
+	require.Equal(t, "test (generic)", HashImplementation().String())
+	require.Equal(t, exp, StringRef("data"))
+	require.Equal(t, 1, calls)
+}
@@ -0,0 +1,332 @@
+package cas
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/local"
+	"github.com/dennwc/cas/types"
+)
+
+// VerifyMode controls how thorough the verification is.
+type VerifyMode int
+
+const (
+	// VerifyFast only checks blob sizes, the schema index and sizes recorded in schema blobs.
+	// No data is re-hashed, thus it's cheap enough to run after every sync.
+	VerifyFast VerifyMode = iota
+	// VerifyDeep performs all the fast checks and re-hashes the content of all blobs.
+	// It's intended for scheduled scrubs.
+	VerifyDeep
+)
+
+func (m VerifyMode) String() string {
+	switch m {
+	case VerifyFast:
+		return "fast"
+	case VerifyDeep:
+		return "deep"
+	}
+	return fmt.Sprintf("VerifyMode(%d)", int(m))
+}
+
+// VerifyOptions controls the store verification.
+type VerifyOptions struct {
+	// Mode controls if the content of blobs is re-hashed. VerifyFast is used by default.
+	Mode VerifyMode
+	// Refs enables the check of references: all blobs referenced by schema blobs must exist, and blobs
+	// that are not reachable from pins are reported as orphaned. All schema blobs are kept in memory.
+	Refs bool
+}
+
+// VerifyProblem is a single problem found during verification.
+type VerifyProblem struct {
+	Ref types.Ref // blob with the problem
+	Pin string    // set if the problem is related to a pin
+	Err error
+}
+
+func (p VerifyProblem) String() string {
+	if p.Pin != "" {
+		return fmt.Sprintf("pin %q (%v): %v", p.Pin, p.Ref, p.Err)
+	}
+	return fmt.Sprintf("%v: %v", p.Ref, p.Err)
+}
+
+// VerifyReport is a result of the store verification.
+type VerifyReport struct {
+	Mode     VerifyMode
+	Blobs    uint64 // number of blobs checked
+	Size     uint64 // total size of checked blobs; in deep mode all of it is re-hashed
+	Schema   uint64 // number of schema blobs checked
+	Pins     uint64 // number of pins checked
+	Problems []VerifyProblem
+	// Corrupt is a sorted list of blobs with invalid content: either their hash or size doesn't match the name,
+	// or the schema blob cannot be decoded.
+	Corrupt []types.Ref
+	// Missing is a sorted list of blobs that are referenced by schema blobs, but don't exist in the storage.
+	// It's only set if the references were checked. Missing blobs are not considered an error, since some
+	// objects reference the content that is not stored (for example, files indexed without storing them).
+	Missing []types.Ref
+	// Orphaned is a sorted list of blobs that are not reachable from any of the pins.
+	// It's only set if the references were checked.
+	Orphaned []types.Ref
+	Time     time.Time     // time when the verification started
+	Duration time.Duration // time spent on verification
+}
+
+// OK checks if no problems were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) addProblem(ref types.Ref, err error) {
+	r.Problems = append(r.Problems, VerifyProblem{Ref: ref, Err: err})
+}
+
+func (r *VerifyReport) addCorrupt(ref types.Ref, err error) {
+	r.addProblem(ref, err)
+	r.Corrupt = append(r.Corrupt, ref)
+}
+
+func sortRefs(refs []types.Ref) {
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].String() < refs[j].String()
+	})
+}
+
+// uniqueRefs sorts refs and removes duplicates.
+func uniqueRefs(refs []types.Ref) []types.Ref {
+	sortRefs(refs)
+	out := refs[:0]
+	for i, ref := range refs {
+		if i == 0 || ref != refs[i-1] {
+			out = append(out, ref)
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// errIndex is reported for schema index entries that don't match blobs in the storage.
+type errIndex struct {
+	err error
+}
+
+func (e errIndex) Error() string {
+	return fmt.Sprintf("schema index: %v", e.err)
+}
+
+// Verify checks the consistency of the store and returns a report with all problems found.
+//
+// Problems with individual blobs and pins are recorded in the report, while the error is only
+// returned if the verification cannot proceed.
+func (s *Storage) Verify(ctx context.Context, opts *VerifyOptions) (*VerifyReport, error) {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+	mode := opts.Mode
+	start := time.Now()
+	rep := &VerifyReport{Mode: mode, Time: start}
+
+	// check that the list of blobs agrees with the storage
+	blobs := make(map[types.Ref]uint64)
+	it := s.st.IterateBlobs(ctx)
+	defer it.Close()
+	for it.Next() {
+		sr := it.SizedRef()
+		blobs[sr.Ref] = sr.Size
+		rep.Blobs++
+		rep.Size += sr.Size
+		if err := s.verifyBlob(ctx, sr, mode); err != nil {
+			p, ok := err.(problem)
+			if !ok {
+				return nil, err
+			} else if p.mode {
+				rep.addProblem(sr.Ref, p.err)
+			} else {
+				rep.addCorrupt(sr.Ref, p.err)
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	it.Close()
+
+	// check the schema index and sizes recorded in schema blobs
+	var (
+		graph   map[types.Ref][]types.Ref // references of schema blobs
+		missing map[types.Ref]struct{}
+	)
+	if opts.Refs {
+		graph = make(map[types.Ref][]types.Ref)
+		missing = make(map[types.Ref]struct{})
+	}
+	sit := s.index.IterateSchema(ctx)
+	defer sit.Close()
+	for sit.Next() {
+		sr := sit.SchemaRef()
+		rep.Schema++
+		if sz, ok := blobs[sr.Ref]; !ok {
+			rep.addProblem(sr.Ref, errIndex{err: storage.ErrNotFound})
+			continue
+		} else if sz != sr.Size {
+			rep.addProblem(sr.Ref, errIndex{err: storage.ErrSizeMissmatch{Exp: sz, Got: sr.Size}})
+			continue
+		}
+		obj, err := sit.Decode()
+		if err != nil {
+			rep.addCorrupt(sr.Ref, err)
+			continue
+		}
+		if opts.Refs {
+			refs := obj.References()
+			graph[sr.Ref] = refs
+			for _, ref := range refs {
+				if _, ok := blobs[ref]; !ok && !ref.Zero() {
+					missing[ref] = struct{}{}
+				}
+			}
+		}
+		for _, sr2 := range schemaSizes(obj) {
+			sz, ok := blobs[sr2.Ref]
+			if !ok {
+				// blobs referenced by schema are not necessarily stored (index-only files, for example)
+				continue
+			} else if sz != sr2.Size {
+				rep.addProblem(sr.Ref, fmt.Errorf("%v: %v", sr2.Ref, storage.ErrSizeMissmatch{Exp: sr2.Size, Got: sz}))
+			}
+		}
+	}
+	if err := sit.Err(); err != nil {
+		return nil, err
+	}
+	sit.Close()
+
+	// pins must point to existing blobs
+	var roots []types.Ref
+	pit := s.st.IteratePins(ctx)
+	defer pit.Close()
+	for pit.Next() {
+		p := pit.Pin()
+		rep.Pins++
+		roots = append(roots, p.Ref)
+		if _, ok := blobs[p.Ref]; !ok && !p.Ref.Empty() {
+			rep.Problems = append(rep.Problems, VerifyProblem{Ref: p.Ref, Pin: p.Name, Err: storage.ErrNotFound})
+		}
+	}
+	if err := pit.Err(); err != nil {
+		return nil, err
+	}
+	if opts.Refs {
+		for ref := range missing {
+			rep.Missing = append(rep.Missing, ref)
+		}
+		sortRefs(rep.Missing)
+		rep.Orphaned = orphaned(blobs, graph, roots)
+	}
+	rep.Corrupt = uniqueRefs(rep.Corrupt)
+	rep.Duration = time.Since(start)
+	return rep, nil
+}
+
+// orphaned returns a sorted list of blobs that are not reachable from roots.
+func orphaned(blobs map[types.Ref]uint64, graph map[types.Ref][]types.Ref, roots []types.Ref) []types.Ref {
+	reached := make(map[types.Ref]struct{}, len(blobs))
+	stack := roots
+	for len(stack) != 0 {
+		ref := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := reached[ref]; ok {
+			continue
+		}
+		reached[ref] = struct{}{}
+		stack = append(stack, graph[ref]...)
+	}
+	var out []types.Ref
+	for ref := range blobs {
+		if _, ok := reached[ref]; !ok {
+			out = append(out, ref)
+		}
+	}
+	sortRefs(out)
+	return out
+}
+
+// problem wraps errors that should be recorded in the report instead of stopping the verification.
+type problem struct {
+	err  error
+	mode bool // content is valid, but the file mode is not
+}
+
+// blobChecker is implemented by storages that can check the state of stored blobs beyond their content.
+// See local.Storage.CheckBlob.
+type blobChecker interface {
+	CheckBlob(ctx context.Context, ref types.Ref) error
+}
+
+func (p problem) Error() string {
+	return p.err.Error()
+}
+
+// verifyBlob checks a single blob listed by the storage.
+func (s *Storage) verifyBlob(ctx context.Context, sr types.SizedRef, mode VerifyMode) error {
+	sz, err := s.st.StatBlob(ctx, sr.Ref)
+	if err == storage.ErrNotFound {
+		return problem{err: err}
+	} else if err != nil {
+		return err
+	} else if sz != sr.Size {
+		return problem{err: storage.ErrSizeMissmatch{Exp: sr.Size, Got: sz}}
+	}
+	if bc, ok := s.st.(blobChecker); ok {
+		err = bc.CheckBlob(ctx, sr.Ref)
+		if err == storage.ErrNotFound {
+			return problem{err: err}
+		} else if _, ok := err.(local.ErrBlobMode); ok {
+			return problem{err: err, mode: true}
+		} else if err != nil {
+			return err
+		}
+	}
+	if mode != VerifyDeep {
+		return nil
+	}
+	rc, _, err := s.st.FetchBlob(ctx, sr.Ref)
+	if err == storage.ErrNotFound {
+		return problem{err: err}
+	} else if err != nil {
+		return err
+	}
+	defer rc.Close()
+	n, err := io.Copy(ioutil.Discard, storage.VerifyReader(rc, sr.Ref))
+	if err != nil {
+		if _, ok := err.(storage.ErrRefMissmatch); ok {
+			return problem{err: err}
+		}
+		return err
+	} else if uint64(n) != sr.Size {
+		return problem{err: storage.ErrSizeMissmatch{Exp: sr.Size, Got: uint64(n)}}
+	}
+	return nil
+}
+
+// schemaSizes returns sizes of blobs recorded in a schema object.
+func schemaSizes(obj schema.Object) []types.SizedRef {
+	switch obj := obj.(type) {
+	case *schema.Multipart:
+		return obj.Parts
+	case *schema.Compressed:
+		return []types.SizedRef{obj.Arch, obj.Ref}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package cas_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dennwc/cas"
+	"github.com/dennwc/cas/schema"
+	"github.com/dennwc/cas/storage"
+	"github.com/dennwc/cas/storage/local"
+	"github.com/dennwc/cas/types"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_verify_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	open := func() *cas.Storage {
+		ls, err := local.New(dir, true)
+		require.NoError(t, err)
+		s, err := cas.New(ls)
+		require.NoError(t, err)
+		return s
+	}
+	s := open()
+	defer func() {
+		s.Close()
+	}()
+
+	a, err := s.StoreBlob(ctx, strings.NewReader("hello world"), nil)
+	require.NoError(t, err)
+	b, err := s.StoreBlob(ctx, strings.NewReader("another blob"), nil)
+	require.NoError(t, err)
+	require.NoError(t, s.SetPin(ctx, "a", a.Ref))
+	require.NoError(t, s.SetPin(ctx, "b", b.Ref))
+
+	for _, mode := range []cas.VerifyMode{cas.VerifyFast, cas.VerifyDeep} {
+		rep, err := s.Verify(ctx, &cas.VerifyOptions{Mode: mode})
+		require.NoError(t, err)
+		require.True(t, rep.OK(), "%v", rep.Problems)
+		require.Equal(t, uint64(2), rep.Blobs)
+		require.Equal(t, uint64(2), rep.Pins)
+	}
+
+	// apply pending index updates, since they may change the mode of blobs
+	require.NoError(t, s.Close())
+	s = open()
+
+	// corrupt the content, but keep the size
+	path := filepath.Join(dir, "blobs", a.Ref.String())
+	require.NoError(t, os.Chmod(path, 0644))
+	require.NoError(t, ioutil.WriteFile(path, []byte("HELLO WORLD"), 0644))
+
+	// writable blobs are reported by the fast check
+	rep, err := s.Verify(ctx, nil)
+	require.NoError(t, err)
+	require.Len(t, rep.Problems, 1)
+	require.IsType(t, local.ErrBlobMode{}, rep.Problems[0].Err)
+	require.Empty(t, rep.Corrupt)
+	require.NoError(t, os.Chmod(path, 0444))
+
+	rep, err = s.Verify(ctx, nil)
+	require.NoError(t, err)
+	require.True(t, rep.OK(), "%v", rep.Problems)
+
+	rep, err = s.Verify(ctx, &cas.VerifyOptions{Mode: cas.VerifyDeep})
+	require.NoError(t, err)
+	require.Len(t, rep.Problems, 1)
+	require.Equal(t, a.Ref, rep.Problems[0].Ref)
+	require.IsType(t, storage.ErrRefMissmatch{}, rep.Problems[0].Err)
+	require.Equal(t, []types.Ref{a.Ref}, rep.Corrupt)
+
+	// pin pointing to a missing blob is detected by the fast check
+	require.NoError(t, os.Remove(filepath.Join(dir, "blobs", b.Ref.String())))
+	rep, err = s.Verify(ctx, nil)
+	require.NoError(t, err)
+	require.Equal(t, []cas.VerifyProblem{
+		{Ref: b.Ref, Pin: "b", Err: storage.ErrNotFound},
+	}, rep.Problems)
+}
+
+func TestVerifyRefs(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_verify_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ls, err := local.New(dir, true)
+	require.NoError(t, err)
+	s, err := cas.New(ls)
+	require.NoError(t, err)
+	defer s.Close()
+
+	writeSchema := func(obj schema.Object) types.Ref {
+		buf := new(bytes.Buffer)
+		require.NoError(t, schema.Encode(buf, obj))
+		sr, err := s.StoreBlob(ctx, buf, nil)
+		require.NoError(t, err)
+		return sr.Ref
+	}
+	data, err := s.StoreBlob(ctx, strings.NewReader("data"), nil)
+	require.NoError(t, err)
+	orphan, err := s.StoreBlob(ctx, strings.NewReader("orphan"), nil)
+	require.NoError(t, err)
+	lost := types.SizedRef{Ref: types.StringRef("lost"), Size: 4}
+	m := writeSchema(&schema.Multipart{Parts: []types.SizedRef{data, lost}})
+	require.NoError(t, s.SetPin(ctx, "root", m))
+
+	rep, err := s.Verify(ctx, &cas.VerifyOptions{Mode: cas.VerifyDeep, Refs: true})
+	require.NoError(t, err)
+	require.True(t, rep.OK(), "%v", rep.Problems)
+	require.Empty(t, rep.Corrupt)
+	require.Equal(t, []types.Ref{lost.Ref}, rep.Missing)
+	require.Equal(t, []types.Ref{orphan.Ref}, rep.Orphaned)
+
+	// references are not checked by default
+	rep, err = s.Verify(ctx, nil)
+	require.NoError(t, err)
+	require.Nil(t, rep.Missing)
+	require.Nil(t, rep.Orphaned)
+}
+
+func TestRepair(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "cas_verify_")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	open := func(name string) *cas.Storage {
+		ls, err := local.New(filepath.Join(dir, name), true)
+		require.NoError(t, err)
+		s, err := cas.New(ls)
+		require.NoError(t, err)
+		return s
+	}
+	s, replica := open("primary"), open("replica")
+	defer replica.Close()
+
+	var refs []types.SizedRef
+	for _, data := range []string{"hello world", "another blob", "lost"} {
+		sr, err := s.StoreBlob(ctx, strings.NewReader(data), nil)
+		require.NoError(t, err)
+		_, err = replica.StoreBlob(ctx, strings.NewReader(data), nil)
+		require.NoError(t, err)
+		refs = append(refs, sr)
+	}
+	a, lost := refs[0], refs[2]
+	require.NoError(t, s.SetPin(ctx, "a", a.Ref))
+	require.NoError(t, s.SetPin(ctx, "lost", lost.Ref))
+	// apply pending index updates, since they may change the mode of blobs
+	require.NoError(t, s.Close())
+	s = open("primary")
+	defer func() {
+		s.Close()
+	}()
+
+	path := filepath.Join(dir, "primary", "blobs", a.Ref.String())
+	require.NoError(t, os.Chmod(path, 0644))
+	require.NoError(t, ioutil.WriteFile(path, []byte("HELLO WORLD"), 0644))
+	require.NoError(t, os.Chmod(path, 0444))
+	require.NoError(t, os.Remove(filepath.Join(dir, "primary", "blobs", lost.Ref.String())))
+
+	opts := &cas.VerifyOptions{Mode: cas.VerifyDeep}
+	rep, err := s.Verify(ctx, opts)
+	require.NoError(t, err)
+	require.Len(t, rep.Problems, 2)
+
+	// the first replica doesn't have any blobs
+	empty := storage.NewInMemory()
+	rrep, err := s.Repair(ctx, rep, empty, replica)
+	require.NoError(t, err)
+	require.True(t, rrep.OK(), "%v", rrep.Failed)
+	require.ElementsMatch(t, []types.SizedRef{a, lost}, rrep.Healed)
+
+	rep, err = s.Verify(ctx, opts)
+	require.NoError(t, err)
+	require.True(t, rep.OK(), "%v", rep.Problems)
+	require.Equal(t, uint64(3), rep.Blobs)
+}
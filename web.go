@@ -59,6 +59,13 @@ func (s *Storage) storeWebContentSchema(ctx context.Context, sr SizedRef, req *h
 }
 
 func (s *Storage) StoreHTTPContent(ctx context.Context, req *http.Request, conf *StoreConfig) (SizedRef, error) {
+	ctx, sp := storage.StartSpan(ctx, "cas.StoreHTTPContent", storage.Attribute{Key: attrURL, Value: req.URL.String()})
+	sr, err := s.storeHTTPContent(ctx, req, conf)
+	storage.EndSpan(sp, err)
+	return sr, err
+}
+
+func (s *Storage) storeHTTPContent(ctx context.Context, req *http.Request, conf *StoreConfig) (SizedRef, error) {
 	conf = checkConfig(conf)
 
 	req = req.WithContext(ctx)
@@ -81,6 +88,13 @@ func (s *Storage) StoreHTTPContent(ctx context.Context, req *http.Request, conf
 }
 
 func (s *Storage) SyncBlob(ctx context.Context, ref Ref) (Ref, error) {
+	ctx, sp := storage.StartSpan(ctx, "cas.SyncBlob", storage.Attribute{Key: storage.AttrRef, Value: ref.String()})
+	ref, err := s.syncBlob(ctx, ref)
+	storage.EndSpan(sp, err)
+	return ref, err
+}
+
+func (s *Storage) syncBlob(ctx context.Context, ref Ref) (Ref, error) {
 	obj, err := s.DecodeSchema(ctx, ref)
 	if err == schema.ErrNotSchema {
 		return ref, nil
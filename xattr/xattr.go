@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"time"
 
@@ -14,24 +15,69 @@ const userNS = "user."
 
 var endian = binary.LittleEndian
 
-var ErrNotSet = errors.New("xattr not set")
+var (
+	// ErrNotSet is returned when the xattr is not set on the file.
+	ErrNotSet = errors.New("xattr not set")
+	// ErrNotSupported is returned when the OS or the file system doesn't support xattrs.
+	ErrNotSupported = errors.New("xattrs are not supported")
+)
+
+// convErr converts errors returned by the xattr library to ErrNotSet and ErrNotSupported.
+func convErr(err error) error {
+	e, ok := err.(*xattr.Error)
+	if !ok {
+		return err
+	}
+	switch {
+	case isNotSet(e.Err):
+		return ErrNotSet
+	case isNotSupported(e.Err):
+		return ErrNotSupported
+	}
+	return err
+}
+
+// Supported checks if the file system of a given directory supports xattrs.
+// It creates a temporary file in the directory to check it.
+func Supported(dir string) (bool, error) {
+	if !supported {
+		return false, nil
+	}
+	f, err := ioutil.TempFile(dir, ".xattr_")
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	err = SetStringF(f, "probe", "1")
+	if err == ErrNotSupported {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
 func Get(path, name string) ([]byte, error) {
+	if !supported {
+		return nil, ErrNotSupported
+	}
 	data, err := xattr.Get(path, userNS+name)
-	if e, ok := err.(*xattr.Error); ok && e.Err == xattr.ENOATTR {
-		return nil, ErrNotSet
-	} else if err != nil {
-		return nil, err
+	if err != nil {
+		return nil, convErr(err)
 	}
 	return data, nil
 }
 
 func GetF(f *os.File, name string) ([]byte, error) {
+	if !supported {
+		return nil, ErrNotSupported
+	}
 	data, err := xattr.FGet(f, userNS+name)
-	if e, ok := err.(*xattr.Error); ok && e.Err == xattr.ENOATTR {
-		return nil, ErrNotSet
-	} else if err != nil {
-		return nil, err
+	if err != nil {
+		return nil, convErr(err)
 	}
 	return data, nil
 }
@@ -89,11 +135,17 @@ func GetTimeF(f *os.File, name string) (time.Time, error) {
 }
 
 func Set(path, name string, data []byte) error {
-	return xattr.Set(path, userNS+name, data)
+	if !supported {
+		return ErrNotSupported
+	}
+	return convErr(xattr.Set(path, userNS+name, data))
 }
 
 func SetF(f *os.File, name string, data []byte) error {
-	return xattr.FSet(f, userNS+name, data)
+	if !supported {
+		return ErrNotSupported
+	}
+	return convErr(xattr.FSet(f, userNS+name, data))
 }
 
 func SetString(path, name string, data string) error {
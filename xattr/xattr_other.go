@@ -0,0 +1,15 @@
+//+build !linux,!freebsd,!netbsd,!darwin
+
+package xattr
+
+// supported is false on systems without xattrs. The xattr library silently ignores all calls on such systems,
+// thus all functions of the package return ErrNotSupported instead.
+const supported = false
+
+func isNotSet(err error) bool {
+	return false
+}
+
+func isNotSupported(err error) bool {
+	return false
+}
@@ -0,0 +1,19 @@
+//+build linux freebsd netbsd darwin
+
+package xattr
+
+import (
+	"syscall"
+
+	"github.com/pkg/xattr"
+)
+
+const supported = true
+
+func isNotSet(err error) bool {
+	return err == xattr.ENOATTR
+}
+
+func isNotSupported(err error) bool {
+	return err == syscall.ENOTSUP || err == syscall.EOPNOTSUPP
+}
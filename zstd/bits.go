@@ -0,0 +1,118 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// highBit returns the position of the highest set bit of a non-zero value.
+func highBit(v uint32) uint {
+	return uint(31 - bits.LeadingZeros32(v))
+}
+
+// forwardBits reads a little-endian bitstream from the start, as used in FSE table descriptions.
+type forwardBits struct {
+	b   []byte
+	pos uint // in bits
+}
+
+// peek returns the next n <= 32 bits without consuming them. Bits past the end are zero.
+func (r *forwardBits) peek(n uint) uint32 {
+	i := r.pos / 8
+	var v uint64
+	if i+8 <= uint(len(r.b)) {
+		v = binary.LittleEndian.Uint64(r.b[i:])
+	} else {
+		for j := uint(0); i+j < uint(len(r.b)); j++ {
+			v |= uint64(r.b[i+j]) << (8 * j)
+		}
+	}
+	return uint32(v>>(r.pos%8)) & (1<<n - 1)
+}
+
+func (r *forwardBits) skip(n uint) {
+	r.pos += n
+}
+
+// bytes returns the number of bytes consumed so far, including a partially consumed one.
+func (r *forwardBits) bytes() int {
+	return int((r.pos + 7) / 8)
+}
+
+// backwardBits reads a bitstream from its end, as used for Huffman and FSE encoded data.
+// The last byte of the stream contains a marker bit that precedes the data.
+type backwardBits struct {
+	b   []byte
+	pos int // number of unread bits; bits below zero are read as zeros
+}
+
+func (r *backwardBits) init(b []byte) error {
+	if len(b) == 0 || b[len(b)-1] == 0 {
+		return errCorrupted("bitstream has no end marker")
+	}
+	r.b = b
+	r.pos = 8*(len(b)-1) + int(highBit(uint32(b[len(b)-1])))
+	return nil
+}
+
+// peek returns the next n <= 56 bits without consuming them.
+func (r *backwardBits) peek(n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+	end := (r.pos + 7) / 8 // the byte after the one with the next bit
+	start := end - 8
+	var v uint64
+	if start >= 0 {
+		v = binary.LittleEndian.Uint64(r.b[start:])
+	} else {
+		for i := 0; i < end; i++ {
+			v |= uint64(r.b[i]) << (8 * uint(i-start))
+		}
+	}
+	return (v >> uint(r.pos-int(n)-8*start)) & (1<<n - 1)
+}
+
+func (r *backwardBits) read(n uint) uint64 {
+	v := r.peek(n)
+	r.pos -= int(n)
+	return v
+}
+
+// overflow reports if more bits were read than the stream contains.
+func (r *backwardBits) overflow() bool {
+	return r.pos < 0
+}
+
+// done reports if the stream was consumed exactly.
+func (r *backwardBits) done() bool {
+	return r.pos == 0
+}
+
+// bitWriter writes a bitstream that is read backward by backwardBits.
+type bitWriter struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+// add writes the n <= 32 low bits of v.
+func (w *bitWriter) add(v uint64, n uint) {
+	w.acc |= (v & (1<<n - 1)) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+// close adds the end marker and returns the stream.
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc, w.nbits = 0, 0
+	}
+	return w.out
+}
@@ -0,0 +1,552 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var errClosed = errors.New("zstd: reader is closed")
+
+var (
+	predefLLTable = mustFSETable(predefLL, predefLLLog)
+	predefMLTable = mustFSETable(predefML, predefMLLog)
+	predefOFTable = mustFSETable(predefOF, predefOFLog)
+)
+
+func mustFSETable(counts []int16, log uint) *fseTable {
+	t := new(fseTable)
+	if err := t.build(counts, log); err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Reader decompresses a Zstandard stream. Concatenated frames are read as a single stream,
+// and skippable frames are ignored.
+type Reader struct {
+	r   io.Reader
+	err error
+	buf [8]byte
+
+	// frame state
+	inFrame  bool
+	window   int
+	blockMax int
+	checksum bool
+	hash     xxhash
+	size     int64 // content size from the header, or -1
+	total    int64 // decoded bytes of the current frame
+
+	hist  []byte // decoded content; at least the window size is kept for matches
+	out   []byte // decoded, but not yet read
+	block []byte
+	lits  []byte
+
+	huff    huffTable
+	hasHuff bool
+	ll      fseTable
+	ml      fseTable
+	of      fseTable
+	llLast  *fseTable // tables used by the previous block, for the repeat mode
+	mlLast  *fseTable
+	ofLast  *fseTable
+	reps    [3]uint32
+}
+
+// NewReader creates a new Reader and reads the header of the first frame.
+// It returns io.EOF if r contains no data.
+func NewReader(r io.Reader) (*Reader, error) {
+	z := &Reader{r: r}
+	if err := z.readFrameHeader(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// Read implements io.Reader.
+func (z *Reader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		if !z.inFrame {
+			z.err = z.readFrameHeader()
+		} else {
+			z.err = z.readBlock()
+		}
+	}
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// Close releases the buffers. It does not close the underlying reader.
+func (z *Reader) Close() error {
+	z.hist, z.out, z.block, z.lits = nil, nil, nil, nil
+	z.err = errClosed
+	return nil
+}
+
+// readFull is like io.ReadFull, but it only returns io.EOF at the start of the frame.
+func (z *Reader) readFull(p []byte) error {
+	_, err := io.ReadFull(z.r, p)
+	if err == io.EOF && z.inFrame {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readFrameHeader reads the header of the next frame, skipping skippable frames.
+func (z *Reader) readFrameHeader() error {
+	var magic uint32
+	for {
+		if err := z.readFull(z.buf[:4]); err != nil {
+			return err
+		}
+		magic = binary.LittleEndian.Uint32(z.buf[:4])
+		if magic&skippableMask != skippableMagic {
+			break
+		}
+		if _, err := io.ReadFull(z.r, z.buf[:4]); err != nil {
+			return noEOF(err)
+		}
+		n := int64(binary.LittleEndian.Uint32(z.buf[:4]))
+		if _, err := io.CopyN(ioutil.Discard, z.r, n); err != nil {
+			return noEOF(err)
+		}
+	}
+	if magic != frameMagic {
+		return errCorrupted("invalid magic number")
+	}
+	if _, err := io.ReadFull(z.r, z.buf[:1]); err != nil {
+		return noEOF(err)
+	}
+	desc := z.buf[0]
+	fcsFlag := desc >> 6
+	single := desc&(1<<5) != 0
+	if desc&(1<<3) != 0 {
+		return errCorrupted("reserved bit is set in the frame header")
+	}
+	dictSize := [4]int{0, 1, 2, 4}[desc&3]
+	fcsSize := [4]int{0, 2, 4, 8}[fcsFlag]
+	if single && fcsFlag == 0 {
+		fcsSize = 1
+	}
+	n := dictSize + fcsSize
+	if !single {
+		n++
+	}
+	hdr := z.buf[:n]
+	if _, err := io.ReadFull(z.r, hdr); err != nil {
+		return noEOF(err)
+	}
+	var window uint64
+	if !single {
+		exp, mant := uint(hdr[0]>>3), uint64(hdr[0]&7)
+		base := uint64(1) << (10 + exp)
+		window = base + base/8*mant
+		hdr = hdr[1:]
+	}
+	var dict uint32
+	for i := 0; i < dictSize; i++ {
+		dict |= uint32(hdr[i]) << (8 * uint(i))
+	}
+	if dict != 0 {
+		return ErrDictionary
+	}
+	hdr = hdr[dictSize:]
+	z.size = -1
+	if fcsSize != 0 {
+		var v uint64
+		for i := 0; i < fcsSize; i++ {
+			v |= uint64(hdr[i]) << (8 * uint(i))
+		}
+		if fcsSize == 2 {
+			v += 256
+		}
+		if v > 1<<62 {
+			return errCorrupted("invalid content size")
+		}
+		z.size = int64(v)
+	}
+	if single {
+		window = uint64(z.size)
+	}
+	if window > maxWindowSize {
+		return ErrWindowTooLarge
+	}
+	z.window = int(window)
+	z.blockMax = maxBlockSize
+	if z.window < z.blockMax {
+		z.blockMax = z.window
+	}
+	z.checksum = desc&(1<<2) != 0
+	z.hash.reset()
+	z.total = 0
+	z.hist = z.hist[:0]
+	z.hasHuff = false
+	z.llLast, z.mlLast, z.ofLast = nil, nil, nil
+	z.reps = [3]uint32{rep0, rep1, rep2}
+	z.inFrame = true
+	return nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readBlock reads and decodes the next block of the frame.
+func (z *Reader) readBlock() error {
+	if err := z.readFull(z.buf[:3]); err != nil {
+		return err
+	}
+	h := uint32(z.buf[0]) | uint32(z.buf[1])<<8 | uint32(z.buf[2])<<16
+	last := h&1 != 0
+	size := int(h >> 3)
+	if size > z.blockMax {
+		return errCorrupted("block is too large")
+	}
+	// keep only the window, if there is no space for the next block
+	if len(z.hist)+z.blockMax > cap(z.hist) {
+		if keep := z.window; len(z.hist) > keep {
+			n := copy(z.hist, z.hist[len(z.hist)-keep:])
+			z.hist = z.hist[:n]
+		}
+		if len(z.hist)+z.blockMax > cap(z.hist) {
+			hist := make([]byte, len(z.hist), 2*len(z.hist)+z.blockMax)
+			copy(hist, z.hist)
+			z.hist = hist
+		}
+	}
+	start := len(z.hist)
+	switch (h >> 1) & 3 {
+	case blockRaw:
+		z.hist = z.hist[:start+size]
+		if err := z.readFull(z.hist[start:]); err != nil {
+			return err
+		}
+	case blockRLE:
+		if err := z.readFull(z.buf[:1]); err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			z.hist = append(z.hist, z.buf[0])
+		}
+	case blockCompressed:
+		if cap(z.block) < size {
+			z.block = make([]byte, size, z.blockMax)
+		}
+		z.block = z.block[:size]
+		if err := z.readFull(z.block); err != nil {
+			return err
+		}
+		if err := z.decodeBlock(z.block); err != nil {
+			return err
+		}
+	default:
+		return errCorrupted("reserved block type")
+	}
+	z.out = z.hist[start:]
+	z.total += int64(len(z.out))
+	if z.checksum {
+		z.hash.write(z.out)
+	}
+	if z.size >= 0 && z.total > z.size {
+		return errCorrupted("content is larger than declared")
+	}
+	if !last {
+		return nil
+	}
+	z.inFrame = false
+	if z.size >= 0 && z.total != z.size {
+		return errCorrupted("content is smaller than declared")
+	}
+	if z.checksum {
+		if _, err := io.ReadFull(z.r, z.buf[:4]); err != nil {
+			return noEOF(err)
+		}
+		if binary.LittleEndian.Uint32(z.buf[:4]) != uint32(z.hash.sum64()) {
+			return ErrChecksum
+		}
+	}
+	return nil
+}
+
+// decodeBlock decodes the compressed block, appending the content to the history.
+func (z *Reader) decodeBlock(b []byte) error {
+	n, err := z.decodeLiterals(b)
+	if err != nil {
+		return err
+	}
+	return z.decodeSequences(b[n:])
+}
+
+// decodeLiterals decodes the literals section into z.lits and returns its size.
+func (z *Reader) decodeLiterals(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, errCorrupted("empty block")
+	}
+	typ, sf := b[0]&3, (b[0]>>2)&3
+	if typ == litRaw || typ == litRLE {
+		var size, n int
+		switch sf {
+		case 0, 2:
+			size, n = int(b[0]>>3), 1
+		case 1:
+			if len(b) < 2 {
+				return 0, errCorrupted("truncated literals header")
+			}
+			size, n = int(b[0]>>4)|int(b[1])<<4, 2
+		case 3:
+			if len(b) < 3 {
+				return 0, errCorrupted("truncated literals header")
+			}
+			size, n = int(b[0]>>4)|int(b[1])<<4|int(b[2])<<12, 3
+		}
+		if size > z.blockMax {
+			return 0, errCorrupted("too many literals")
+		}
+		if typ == litRaw {
+			if n+size > len(b) {
+				return 0, errCorrupted("truncated literals")
+			}
+			z.lits = append(z.lits[:0], b[n:n+size]...)
+			return n + size, nil
+		}
+		if n >= len(b) {
+			return 0, errCorrupted("truncated literals")
+		}
+		z.lits = z.lits[:0]
+		for i := 0; i < size; i++ {
+			z.lits = append(z.lits, b[n])
+		}
+		return n + 1, nil
+	}
+	hsize, bits := 3, uint(10)
+	switch sf {
+	case 2:
+		hsize, bits = 4, 14
+	case 3:
+		hsize, bits = 5, 18
+	}
+	if len(b) < hsize {
+		return 0, errCorrupted("truncated literals header")
+	}
+	var v uint64
+	for i := 0; i < hsize; i++ {
+		v |= uint64(b[i]) << (8 * uint(i))
+	}
+	mask := uint64(1)<<bits - 1
+	size := int((v >> 4) & mask)
+	csize := int((v >> (4 + bits)) & mask)
+	if size > z.blockMax {
+		return 0, errCorrupted("too many literals")
+	}
+	if hsize+csize > len(b) {
+		return 0, errCorrupted("truncated literals")
+	}
+	data := b[hsize : hsize+csize]
+	if typ == litCompressed {
+		n, err := z.huff.read(data)
+		if err != nil {
+			return 0, err
+		}
+		data = data[n:]
+		z.hasHuff = true
+	} else if !z.hasHuff {
+		return 0, errCorrupted("no Huffman table to repeat")
+	}
+	if cap(z.lits) < size {
+		z.lits = make([]byte, size, z.blockMax)
+	}
+	z.lits = z.lits[:size]
+	var err error
+	if sf == 0 {
+		err = z.huff.decode(z.lits, data)
+	} else {
+		err = z.huff.decode4(z.lits, data)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return hsize + csize, nil
+}
+
+// readTable reads the table of sequence codes with a given mode and returns the number of bytes consumed.
+func readTable(mode byte, b []byte, t *fseTable, last **fseTable, predef *fseTable, maxSym int, maxLog uint) (int, error) {
+	switch mode {
+	case modePredefined:
+		*last = predef
+		return 0, nil
+	case modeRLE:
+		if len(b) == 0 {
+			return 0, errCorrupted("truncated sequences header")
+		} else if int(b[0]) > maxSym {
+			return 0, errCorrupted("invalid RLE code")
+		}
+		t.rle(b[0])
+		*last = t
+		return 1, nil
+	case modeFSE:
+		counts, log, n, err := readFSECounts(b, maxSym, maxLog)
+		if err != nil {
+			return 0, err
+		}
+		if err = t.build(counts, log); err != nil {
+			return 0, err
+		}
+		*last = t
+		return n, nil
+	default:
+		if *last == nil {
+			return 0, errCorrupted("no table to repeat")
+		}
+		return 0, nil
+	}
+}
+
+// decodeSequences decodes the sequences section and executes it.
+func (z *Reader) decodeSequences(b []byte) error {
+	if len(b) == 0 {
+		return errCorrupted("truncated sequences header")
+	}
+	nseq := int(b[0])
+	switch {
+	case nseq == 0:
+		if len(b) != 1 {
+			return errCorrupted("unexpected data after literals")
+		}
+		z.hist = append(z.hist, z.lits...)
+		return nil
+	case nseq < 128:
+		b = b[1:]
+	case nseq < 255:
+		if len(b) < 2 {
+			return errCorrupted("truncated sequences header")
+		}
+		nseq = (nseq-128)<<8 | int(b[1])
+		b = b[2:]
+	default:
+		if len(b) < 3 {
+			return errCorrupted("truncated sequences header")
+		}
+		nseq = int(b[1]) | int(b[2])<<8 + 0x7F00
+		b = b[3:]
+	}
+	if len(b) == 0 {
+		return errCorrupted("truncated sequences header")
+	}
+	modes := b[0]
+	if modes&3 != 0 {
+		return errCorrupted("reserved bits are set in sequences header")
+	}
+	b = b[1:]
+	n, err := readTable(modes>>6, b, &z.ll, &z.llLast, predefLLTable, maxLLCode, maxLLLog)
+	if err != nil {
+		return err
+	}
+	b = b[n:]
+	n, err = readTable((modes>>4)&3, b, &z.of, &z.ofLast, predefOFTable, maxOFCode, maxOFLog)
+	if err != nil {
+		return err
+	}
+	b = b[n:]
+	n, err = readTable((modes>>2)&3, b, &z.ml, &z.mlLast, predefMLTable, maxMLCode, maxMLLog)
+	if err != nil {
+		return err
+	}
+	b = b[n:]
+
+	var r backwardBits
+	if err = r.init(b); err != nil {
+		return err
+	}
+	var ll, of, ml fseState
+	ll.init(z.llLast, &r)
+	of.init(z.ofLast, &r)
+	ml.init(z.mlLast, &r)
+
+	start := len(z.hist)
+	lits := z.lits
+	for i := 0; i < nseq; i++ {
+		ofCode, mlCode, llCode := of.symbol(), ml.symbol(), ll.symbol()
+		if ofCode > maxOFCode || mlCode > maxMLCode || llCode > maxLLCode {
+			return errCorrupted("invalid sequence code")
+		}
+		ofv := uint32(1)<<ofCode + uint32(r.read(uint(ofCode)))
+		mlen := int(mlBase[mlCode] + uint32(r.read(uint(mlBits[mlCode]))))
+		llen := int(llBase[llCode] + uint32(r.read(uint(llBits[llCode]))))
+		if r.overflow() {
+			return errCorrupted("truncated sequences")
+		}
+		if i != nseq-1 {
+			ll.update(&r)
+			ml.update(&r)
+			of.update(&r)
+		}
+
+		// resolve repeated offsets
+		var off uint32
+		if ofv > 3 {
+			off = ofv - 3
+			z.reps = [3]uint32{off, z.reps[0], z.reps[1]}
+		} else {
+			idx := ofv - 1
+			if llen == 0 {
+				idx++
+			}
+			switch idx {
+			case 0:
+				off = z.reps[0]
+			case 1:
+				off = z.reps[1]
+				z.reps = [3]uint32{off, z.reps[0], z.reps[2]}
+			case 2:
+				off = z.reps[2]
+				z.reps = [3]uint32{off, z.reps[0], z.reps[1]}
+			default:
+				off = z.reps[0] - 1
+				if off == 0 {
+					return errCorrupted("invalid repeated offset")
+				}
+				z.reps = [3]uint32{off, z.reps[0], z.reps[1]}
+			}
+		}
+
+		if llen > len(lits) {
+			return errCorrupted("not enough literals")
+		}
+		z.hist = append(z.hist, lits[:llen]...)
+		lits = lits[llen:]
+		if len(z.hist)-start+mlen > z.blockMax {
+			return errCorrupted("block content is too large")
+		}
+		if int64(off) > int64(len(z.hist)) || int(off) > z.window {
+			return errCorrupted("match offset is out of the window")
+		}
+		// the match may overlap with its own output
+		from := len(z.hist) - int(off)
+		for mlen > 0 {
+			n := len(z.hist) - from
+			if n > mlen {
+				n = mlen
+			}
+			z.hist = append(z.hist, z.hist[from:from+n]...)
+			from += n
+			mlen -= n
+		}
+	}
+	if !r.done() {
+		return errCorrupted("invalid sequences size")
+	}
+	if len(z.hist)-start+len(lits) > z.blockMax {
+		return errCorrupted("block content is too large")
+	}
+	z.hist = append(z.hist, lits...)
+	return nil
+}
@@ -0,0 +1,443 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+const (
+	// encWindowLog is the log of the window size used by the writer.
+	encWindowLog  = 19
+	encWindowSize = 1 << encWindowLog
+
+	minMatch  = 4
+	hashLog   = 15
+	hashShift = 32 - hashLog
+	// chainLog is the log of the distance that hash chains cover; longer offsets are only found
+	// for the last position with the same hash.
+	chainLog  = 16
+	chainMask = 1<<chainLog - 1
+	// maxChain is the number of match candidates checked for each position.
+	maxChain = 8
+	// goodMatch is the length of the match that stops the search.
+	goodMatch = 32
+
+	// minHuffLiterals is the minimal number of literals that are Huffman compressed.
+	minHuffLiterals = 64
+)
+
+var (
+	predefLLEnc = newFSEEncTable(predefLL, predefLLLog)
+	predefMLEnc = newFSEEncTable(predefML, predefMLLog)
+	predefOFEnc = newFSEEncTable(predefOF, predefOFLog)
+)
+
+var errWriterClosed = errors.New("zstd: writer is closed")
+
+// sequence is a run of literals followed by a match.
+type sequence struct {
+	litLen   uint32
+	matchLen uint32
+	offset   uint32
+}
+
+// Writer compresses data written to it. The output is a single frame with a checksum.
+type Writer struct {
+	w       io.Writer
+	err     error
+	started bool
+
+	hist  []byte  // the window and the current block at the end
+	start int     // start of the current block in hist
+	table []int32 // hash of 4 bytes to the position in hist plus one
+	chain []int32 // previous position with the same hash, plus one
+	hash  xxhash
+
+	seqs []sequence
+	lits []byte
+	out  []byte
+	huff huffEncoder
+}
+
+// NewWriter creates a new Writer. Close must be called to write the end of the frame.
+func NewWriter(w io.Writer) *Writer {
+	z := &Writer{
+		w:     w,
+		hist:  make([]byte, 0, encWindowSize+maxBlockSize),
+		table: make([]int32, 1<<hashLog),
+		chain: make([]int32, 1<<chainLog),
+	}
+	z.hash.reset()
+	return z
+}
+
+// Write implements io.Writer. The data is compressed in blocks and is buffered until a block is full.
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := maxBlockSize - (len(z.hist) - z.start)
+		if n > len(p) {
+			n = len(p)
+		}
+		z.hist = append(z.hist, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(z.hist)-z.start == maxBlockSize {
+			if z.err = z.writeBlock(false); z.err != nil {
+				return written, z.err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close writes the last block and the checksum. It does not close the underlying writer.
+func (z *Writer) Close() error {
+	if z.err != nil {
+		if z.err == errWriterClosed {
+			return nil
+		}
+		return z.err
+	}
+	if z.err = z.writeBlock(true); z.err != nil {
+		return z.err
+	}
+	z.err = errWriterClosed
+	return nil
+}
+
+// writeBlock compresses the current block and writes it.
+func (z *Writer) writeBlock(last bool) error {
+	out := z.out[:0]
+	if !z.started {
+		z.started = true
+		var hdr [6]byte
+		binary.LittleEndian.PutUint32(hdr[:], frameMagic)
+		hdr[4] = 1 << 2 // checksum, no content size
+		hdr[5] = (encWindowLog - 10) << 3
+		out = append(out, hdr[:]...)
+	}
+	src := z.hist[z.start:]
+	z.hash.write(src)
+
+	hpos := len(out)
+	out = append(out, 0, 0, 0)
+	typ := blockRaw
+	if len(src) >= minMatch*2 {
+		out = z.compress(out)
+		typ = blockCompressed
+		if len(out)-hpos-3 >= len(src) {
+			out = out[:hpos+3]
+			typ = blockRaw
+		}
+	}
+	if typ == blockRaw {
+		out = append(out, src...)
+	}
+	h := uint32(typ)<<1 | uint32(len(out)-hpos-3)<<3
+	if last {
+		h |= 1
+	}
+	out[hpos], out[hpos+1], out[hpos+2] = byte(h), byte(h>>8), byte(h>>16)
+	if last {
+		var sum [4]byte
+		binary.LittleEndian.PutUint32(sum[:], uint32(z.hash.sum64()))
+		out = append(out, sum[:]...)
+	}
+	z.out = out
+	if _, err := z.w.Write(out); err != nil {
+		return err
+	}
+
+	// keep only the window for the next block
+	z.start = len(z.hist)
+	if len(z.hist)+maxBlockSize > cap(z.hist) {
+		shift := len(z.hist) - encWindowSize
+		copy(z.hist, z.hist[shift:])
+		z.hist = z.hist[:encWindowSize]
+		z.start = len(z.hist)
+		for _, t := range [][]int32{z.table, z.chain} {
+			for i, v := range t {
+				if v -= int32(shift); v < 0 {
+					v = 0
+				}
+				t[i] = v
+			}
+		}
+	}
+	return nil
+}
+
+func hash4(v uint32) uint32 {
+	return (v * 2654435761) >> hashShift
+}
+
+// insert adds the position to the hash table.
+func (z *Writer) insert(p int) {
+	h := hash4(binary.LittleEndian.Uint32(z.hist[p:]))
+	z.chain[p&chainMask] = z.table[h]
+	z.table[h] = int32(p + 1)
+}
+
+// matchLen returns the length of the common prefix of a and b, where b is not longer than a.
+func matchLen(a, b []byte) int {
+	n := 0
+	for ; len(b)-n >= 8; n += 8 {
+		if x := binary.LittleEndian.Uint64(a[n:]) ^ binary.LittleEndian.Uint64(b[n:]); x != 0 {
+			return n + bits.TrailingZeros64(x)/8
+		}
+	}
+	for n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// findMatch returns the longest match for the position, or zero length if there is none.
+// Matches end at the end of the block.
+func (z *Writer) findMatch(p int) (cand, n int) {
+	hist := z.hist
+	cur := binary.LittleEndian.Uint32(hist[p:])
+	c := int(z.table[hash4(cur)]) - 1
+	for i := 0; i < maxChain && c >= 0 && p-c <= encWindowSize; i++ {
+		if p+n < len(hist) && hist[c+n] == hist[p+n] && binary.LittleEndian.Uint32(hist[c:]) == cur {
+			if m := minMatch + matchLen(hist[c+minMatch:], hist[p+minMatch:]); m > n {
+				cand, n = c, m
+				if n >= goodMatch {
+					break
+				}
+			}
+		}
+		if p-c > chainMask {
+			// the chain entry was overwritten by a later position
+			break
+		}
+		next := int(z.chain[c&chainMask]) - 1
+		if next >= c {
+			break
+		}
+		c = next
+	}
+	return cand, n
+}
+
+// compress appends the content of the compressed block for the current block.
+func (z *Writer) compress(out []byte) []byte {
+	hist, start := z.hist, z.start
+	z.seqs = z.seqs[:0]
+	z.lits = z.lits[:0]
+	lit := start
+	end := len(hist) - minMatch
+	for p := start; p < end; {
+		cand, n := z.findMatch(p)
+		z.insert(p)
+		if n == 0 {
+			// skip faster through incompressible data
+			p += 1 + (p-lit)>>6
+			continue
+		}
+		// prefer a longer match at the next position
+		if n < goodMatch && p+1 < end {
+			if cand2, n2 := z.findMatch(p + 1); n2 > n+1 {
+				p++
+				cand, n = cand2, n2
+				z.insert(p)
+			}
+		}
+		// extend the match backward
+		for p > lit && cand > 0 && hist[p-1] == hist[cand-1] {
+			p, cand, n = p-1, cand-1, n+1
+		}
+		z.seqs = append(z.seqs, sequence{
+			litLen:   uint32(p - lit),
+			matchLen: uint32(n),
+			offset:   uint32(p - cand),
+		})
+		z.lits = append(z.lits, hist[lit:p]...)
+		for i := p + 1; i < p+n && i < end; i++ {
+			z.insert(i)
+		}
+		p += n
+		lit = p
+	}
+	z.lits = append(z.lits, hist[lit:]...)
+	out = z.writeLiterals(out, z.lits)
+	return z.writeSequences(out, z.seqs)
+}
+
+// writeLiterals appends the literals section.
+func (z *Writer) writeLiterals(out, lits []byte) []byte {
+	var counts [maxHuffSymbols]uint32
+	for _, b := range lits {
+		counts[b]++
+	}
+	if len(lits) > 0 && counts[lits[0]] == uint32(len(lits)) {
+		out = appendLitHeader(out, litRLE, len(lits))
+		return append(out, lits[0])
+	}
+	if len(lits) < minHuffLiterals || !z.huff.build(&counts) {
+		out = appendLitHeader(out, litRaw, len(lits))
+		return append(out, lits...)
+	}
+	// reserve the largest header and move the data if a smaller one is used
+	hpos := len(out)
+	out = append(out, 0, 0, 0, 0, 0)
+	out, ok := z.huff.writeTable(out)
+	if !ok {
+		out = appendLitHeader(out[:hpos], litRaw, len(lits))
+		return append(out, lits...)
+	}
+	single := len(lits) <= 1023
+	if single {
+		out = z.huff.encode(out, lits)
+	} else {
+		out = z.huff.encode4(out, lits)
+	}
+	csize := len(out) - hpos - 5
+	if csize >= len(lits) {
+		out = appendLitHeader(out[:hpos], litRaw, len(lits))
+		return append(out, lits...)
+	}
+	var hsize, bits uint
+	var sf uint64
+	switch {
+	case single:
+		hsize, bits, sf = 3, 10, 0
+	case len(lits) < 1<<14 && csize < 1<<14:
+		hsize, bits, sf = 4, 14, 2
+	default:
+		hsize, bits, sf = 5, 18, 3
+	}
+	v := litCompressed | sf<<2 | uint64(len(lits))<<4 | uint64(csize)<<(4+bits)
+	for i := uint(0); i < hsize; i++ {
+		out[hpos+int(i)] = byte(v >> (8 * i))
+	}
+	copy(out[hpos+int(hsize):], out[hpos+5:])
+	return out[:len(out)-int(5-hsize)]
+}
+
+// appendLitHeader appends the header of raw or RLE literals.
+func appendLitHeader(out []byte, typ byte, size int) []byte {
+	switch {
+	case size < 1<<5:
+		return append(out, typ|byte(size)<<3)
+	case size < 1<<12:
+		return append(out, typ|1<<2|byte(size)<<4, byte(size>>4))
+	default:
+		return append(out, typ|3<<2|byte(size)<<4, byte(size>>4), byte(size>>12))
+	}
+}
+
+// llCode returns the literal length code.
+func llCode(v uint32) uint8 {
+	if v >= 64 {
+		return uint8(highBit(v) + 19)
+	}
+	c := uint8(0)
+	for c < maxLLCode && llBase[c+1] <= v {
+		c++
+	}
+	return c
+}
+
+// mlCode returns the match length code.
+func mlCode(v uint32) uint8 {
+	if v-3 >= 128 {
+		return uint8(highBit(v-3) + 36)
+	}
+	c := uint8(0)
+	for c < maxMLCode && mlBase[c+1] <= v {
+		c++
+	}
+	return c
+}
+
+// chooseTable selects the encoding of sequence codes with given counts and appends the table description.
+// It returns the compression mode and the encoding table.
+func chooseTable(out []byte, counts []uint32, predef []int16, predefLog uint, predefEnc *fseEncTable, maxLog uint) ([]byte, byte, *fseEncTable) {
+	used, sym := 0, 0
+	for s, c := range counts {
+		if c != 0 {
+			used++
+			sym = s
+		}
+	}
+	if used == 1 {
+		norm := make([]int16, sym+1)
+		norm[sym] = 1
+		return append(out, byte(sym)), modeRLE, newFSEEncTable(norm, 0)
+	}
+	norm, log := normalizeCounts(counts, maxLog)
+	desc := appendFSECounts(nil, norm, log)
+	if c := fseCost(counts, predef, predefLog); c >= 0 && c <= fseCost(counts, norm, log)+float64(8*len(desc)) {
+		return out, modePredefined, predefEnc
+	}
+	return append(out, desc...), modeFSE, newFSEEncTable(norm, log)
+}
+
+// writeSequences appends the sequences section.
+func (z *Writer) writeSequences(out []byte, seqs []sequence) []byte {
+	n := len(seqs)
+	switch {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7F00:
+		out = append(out, byte(n>>8)+128, byte(n))
+	default:
+		out = append(out, 255, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	if n == 0 {
+		return out
+	}
+
+	type codes struct {
+		ll, ml, of uint8
+	}
+	cs := make([]codes, n)
+	var llCounts [maxLLCode + 1]uint32
+	var mlCounts [maxMLCode + 1]uint32
+	var ofCounts [maxOFCode + 1]uint32
+	for i, s := range seqs {
+		ofv := s.offset + 3 // repeated offsets are not used
+		c := codes{ll: llCode(s.litLen), ml: mlCode(s.matchLen), of: uint8(highBit(ofv))}
+		cs[i] = c
+		llCounts[c.ll]++
+		mlCounts[c.ml]++
+		ofCounts[c.of]++
+	}
+	mpos := len(out)
+	out = append(out, 0)
+	out, llMode, llEnc := chooseTable(out, llCounts[:], predefLL, predefLLLog, predefLLEnc, maxLLLog)
+	out, ofMode, ofEnc := chooseTable(out, ofCounts[:], predefOF, predefOFLog, predefOFEnc, maxOFLog)
+	out, mlMode, mlEnc := chooseTable(out, mlCounts[:], predefML, predefMLLog, predefMLEnc, maxMLLog)
+	out[mpos] = llMode<<6 | ofMode<<4 | mlMode<<2
+
+	w := bitWriter{out: out}
+	addExtra := func(i int) {
+		s, c := seqs[i], cs[i]
+		w.add(uint64(s.litLen-llBase[c.ll]), uint(llBits[c.ll]))
+		w.add(uint64(s.matchLen-mlBase[c.ml]), uint(mlBits[c.ml]))
+		w.add(uint64(s.offset+3), uint(c.of))
+	}
+	// the decoder reads sequences backward
+	var ll, ml, of fseEncoder
+	ml.init(mlEnc, cs[n-1].ml)
+	of.init(ofEnc, cs[n-1].of)
+	ll.init(llEnc, cs[n-1].ll)
+	addExtra(n - 1)
+	for i := n - 2; i >= 0; i-- {
+		of.encode(&w, cs[i].of)
+		ml.encode(&w, cs[i].ml)
+		ll.encode(&w, cs[i].ll)
+		addExtra(i)
+	}
+	ml.flush(&w)
+	of.flush(&w)
+	ll.flush(&w)
+	return w.close()
+}
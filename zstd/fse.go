@@ -0,0 +1,387 @@
+package zstd
+
+import "math"
+
+// fseEntry is a state of the FSE decoding table.
+type fseEntry struct {
+	symbol uint8
+	nbits  uint8  // bits to read for the next state
+	base   uint16 // the next state is base plus the bits read
+}
+
+// fseTable is an FSE decoding table.
+type fseTable struct {
+	log   uint
+	table []fseEntry
+}
+
+// readFSECounts reads normalized symbol counts of the FSE table description.
+// It returns the counts, the accuracy log and the number of bytes consumed.
+func readFSECounts(b []byte, maxSymbol int, maxLog uint) ([]int16, uint, int, error) {
+	if len(b) == 0 {
+		return nil, 0, 0, errCorrupted("empty FSE table description")
+	}
+	r := forwardBits{b: b}
+	log := uint(r.peek(4)) + 5
+	r.skip(4)
+	if log > maxLog {
+		return nil, 0, 0, errCorrupted("FSE accuracy log is too large")
+	}
+	counts := make([]int16, 0, maxSymbol+1)
+	remaining := int32(1<<log) + 1
+	threshold := int32(1 << log)
+	nbits := log + 1
+	for remaining > 1 {
+		if len(counts) > maxSymbol {
+			return nil, 0, 0, errCorrupted("too many symbols in FSE table")
+		}
+		max := 2*threshold - 1 - remaining
+		var v int32
+		if low := int32(r.peek(nbits - 1)); low < max {
+			v = low
+			r.skip(nbits - 1)
+		} else {
+			v = int32(r.peek(nbits))
+			if v >= threshold {
+				v -= max
+			}
+			r.skip(nbits)
+		}
+		count := v - 1
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+		counts = append(counts, int16(count))
+		if count == 0 {
+			// the number of following zero counts
+			for {
+				rep := r.peek(2)
+				r.skip(2)
+				for i := uint32(0); i < rep; i++ {
+					counts = append(counts, 0)
+				}
+				if rep != 3 {
+					break
+				}
+			}
+		}
+		for remaining < threshold && nbits > 1 {
+			nbits--
+			threshold >>= 1
+		}
+		if r.bytes() > len(b) {
+			return nil, 0, 0, errCorrupted("truncated FSE table description")
+		}
+	}
+	if remaining != 1 || len(counts) > maxSymbol+1 {
+		return nil, 0, 0, errCorrupted("invalid FSE table description")
+	}
+	return counts, log, r.bytes(), nil
+}
+
+// spreadSymbols assigns symbols to the states of the table, as described in the spec.
+// Symbols with the "less than one" probability are placed at the end of the table.
+func spreadSymbols(counts []int16, log uint) ([]uint8, error) {
+	size := 1 << log
+	symbols := make([]uint8, size)
+	high := size - 1
+	for s, c := range counts {
+		if c == -1 {
+			if high < 0 {
+				return nil, errCorrupted("FSE table is overflowed")
+			}
+			symbols[high] = uint8(s)
+			high--
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	mask := size - 1
+	pos, n := 0, 0
+	for s, c := range counts {
+		for i := 0; i < int(c); i++ {
+			if n > high {
+				return nil, errCorrupted("FSE table is overflowed")
+			}
+			n++
+			symbols[pos] = uint8(s)
+			pos = (pos + step) & mask
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	if pos != 0 || n != high+1 {
+		return nil, errCorrupted("invalid FSE symbol counts")
+	}
+	return symbols, nil
+}
+
+// build fills the decoding table from normalized counts.
+func (t *fseTable) build(counts []int16, log uint) error {
+	symbols, err := spreadSymbols(counts, log)
+	if err != nil {
+		return err
+	}
+	size := 1 << log
+	next := make([]uint32, len(counts))
+	for s, c := range counts {
+		if c == -1 {
+			next[s] = 1
+		} else {
+			next[s] = uint32(c)
+		}
+	}
+	t.log = log
+	if cap(t.table) >= size {
+		t.table = t.table[:size]
+	} else {
+		t.table = make([]fseEntry, size)
+	}
+	for i, s := range symbols {
+		n := next[s]
+		next[s]++
+		nbits := log - highBit(n)
+		t.table[i] = fseEntry{
+			symbol: s,
+			nbits:  uint8(nbits),
+			base:   uint16((n << nbits) - uint32(size)),
+		}
+	}
+	return nil
+}
+
+// rle sets the table to always return the same symbol.
+func (t *fseTable) rle(sym uint8) {
+	t.log = 0
+	t.table = append(t.table[:0], fseEntry{symbol: sym})
+}
+
+// fseState is a state of the FSE decoder.
+type fseState struct {
+	t     *fseTable
+	state uint32
+}
+
+func (s *fseState) init(t *fseTable, r *backwardBits) {
+	s.t = t
+	s.state = uint32(r.read(t.log))
+}
+
+func (s *fseState) symbol() uint8 {
+	return s.t.table[s.state].symbol
+}
+
+func (s *fseState) update(r *backwardBits) {
+	e := s.t.table[s.state]
+	s.state = uint32(e.base) + uint32(r.read(uint(e.nbits)))
+}
+
+// fseSymbolTransform describes the encoding of a single symbol.
+type fseSymbolTransform struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+// fseEncTable is an FSE encoding table.
+type fseEncTable struct {
+	log     uint
+	states  []uint16
+	symbols []fseSymbolTransform
+}
+
+// newFSEEncTable builds an encoding table for normalized counts.
+func newFSEEncTable(counts []int16, log uint) *fseEncTable {
+	symbols, err := spreadSymbols(counts, log)
+	if err != nil {
+		panic(err) // counts are always normalized by the encoder
+	}
+	size := 1 << log
+	t := &fseEncTable{
+		log:     log,
+		states:  make([]uint16, size),
+		symbols: make([]fseSymbolTransform, len(counts)),
+	}
+	cumul := make([]int, len(counts)+1)
+	for s, c := range counts {
+		if c == -1 {
+			c = 1
+		}
+		cumul[s+1] = cumul[s] + int(c)
+	}
+	for u, s := range symbols {
+		t.states[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+	total := int32(0)
+	for s, c := range counts {
+		switch c {
+		case 0:
+			t.symbols[s].deltaNbBits = uint32((log+1)<<16 - uint(size))
+		case -1, 1:
+			t.symbols[s] = fseSymbolTransform{
+				deltaNbBits:    uint32(log<<16 - uint(size)),
+				deltaFindState: total - 1,
+			}
+			total++
+		default:
+			maxBitsOut := log - highBit(uint32(c-1))
+			minStatePlus := uint32(c) << maxBitsOut
+			t.symbols[s] = fseSymbolTransform{
+				deltaNbBits:    uint32(maxBitsOut<<16) - minStatePlus,
+				deltaFindState: total - int32(c),
+			}
+			total += int32(c)
+		}
+	}
+	return t
+}
+
+// fseEncoder is a state of the FSE encoder.
+type fseEncoder struct {
+	t     *fseEncTable
+	state uint32
+}
+
+// init sets the initial state for the first encoded symbol (the last one decoded).
+func (e *fseEncoder) init(t *fseEncTable, sym uint8) {
+	e.t = t
+	tr := t.symbols[sym]
+	nbits := (tr.deltaNbBits + 1<<15) >> 16
+	v := nbits<<16 - tr.deltaNbBits
+	e.state = uint32(t.states[int32(v>>nbits)+tr.deltaFindState])
+}
+
+func (e *fseEncoder) encode(w *bitWriter, sym uint8) {
+	tr := e.t.symbols[sym]
+	nbits := (e.state + tr.deltaNbBits) >> 16
+	w.add(uint64(e.state), uint(nbits))
+	e.state = uint32(e.t.states[int32(e.state>>nbits)+tr.deltaFindState])
+}
+
+// flush writes the final state, which the decoder reads first.
+func (e *fseEncoder) flush(w *bitWriter) {
+	w.add(uint64(e.state), e.t.log)
+}
+
+// normalizeCounts scales symbol counts to the sum of 1<<log, keeping all used symbols.
+// The log is chosen from the number of symbols, but it's never larger than maxLog.
+func normalizeCounts(counts []uint32, maxLog uint) ([]int16, uint) {
+	var total uint32
+	used, last := 0, 0
+	for s, c := range counts {
+		if c != 0 {
+			total += c
+			used++
+			last = s
+		}
+	}
+	log := highBit(total) + 1
+	if min := highBit(uint32(used)) + 2; log < min {
+		log = min
+	}
+	if log < 5 {
+		log = 5
+	} else if log > maxLog {
+		log = maxLog
+	}
+	size := int64(1) << log
+	norm := make([]int16, last+1)
+	sum := int64(0)
+	largest := 0
+	for s, c := range counts[:last+1] {
+		if c == 0 {
+			continue
+		}
+		n := (int64(c)*size + int64(total)/2) / int64(total)
+		if n < 1 {
+			n = 1
+		}
+		norm[s] = int16(n)
+		sum += n
+		if c > counts[largest] {
+			largest = s
+		}
+	}
+	// give the rounding error to the largest symbols
+	for sum > size {
+		best := -1
+		for s, n := range norm {
+			if n > 1 && (best < 0 || n > norm[best]) {
+				best = s
+			}
+		}
+		norm[best]--
+		sum--
+	}
+	norm[largest] += int16(size - sum)
+	return norm, log
+}
+
+// appendFSECounts appends the FSE table description for normalized counts.
+func appendFSECounts(out []byte, norm []int16, log uint) []byte {
+	w := bitWriter{out: out}
+	w.add(uint64(log-5), 4)
+	remaining := int32(1<<log) + 1
+	threshold := int32(1 << log)
+	nbits := log + 1
+	for s := 0; remaining > 1 && s < len(norm); {
+		count := int32(norm[s])
+		s++
+		max := 2*threshold - 1 - remaining
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		count++
+		if count >= threshold {
+			count += max
+		}
+		if count < max {
+			w.add(uint64(count), nbits-1)
+		} else {
+			w.add(uint64(count), nbits)
+		}
+		if count == 1 {
+			// the number of following zero counts
+			start := s
+			for s < len(norm) && norm[s] == 0 {
+				s++
+			}
+			for ; s-start >= 3; start += 3 {
+				w.add(3, 2)
+			}
+			w.add(uint64(s-start), 2)
+		}
+		for remaining < threshold {
+			nbits--
+			threshold >>= 1
+		}
+	}
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
+
+// fseCost estimates the number of bits needed to encode symbols with given counts and normalized counts.
+// It returns -1 if some symbols cannot be encoded.
+func fseCost(counts []uint32, norm []int16, log uint) float64 {
+	var bits float64
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if s >= len(norm) || norm[s] == 0 {
+			return -1
+		}
+		n := float64(norm[s])
+		if n < 0 {
+			n = 1
+		}
+		bits += float64(c) * (float64(log) - math.Log2(n))
+	}
+	return bits
+}
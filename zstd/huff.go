@@ -0,0 +1,435 @@
+package zstd
+
+import (
+	"container/heap"
+	"sort"
+)
+
+const (
+	maxHuffLog     = 11
+	maxHuffSymbols = 256
+	// maxDirectWeights is the maximal number of weights in the direct (4 bit per weight) representation.
+	maxDirectWeights = 128
+)
+
+// huffEntry is an entry of the Huffman decoding table.
+type huffEntry struct {
+	symbol uint8
+	nbits  uint8
+}
+
+// huffTable is a Huffman decoding table indexed by the next maxBits bits of the stream.
+type huffTable struct {
+	maxBits uint
+	table   []huffEntry
+}
+
+// read reads the Huffman tree description and returns the number of bytes consumed.
+func (t *huffTable) read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, errCorrupted("empty Huffman tree description")
+	}
+	var weights []uint8
+	n := 1
+	if hb := int(b[0]); hb >= 128 {
+		// direct representation
+		num := hb - 127
+		n += (num + 1) / 2
+		if n > len(b) {
+			return 0, errCorrupted("truncated Huffman tree description")
+		}
+		weights = make([]uint8, num, num+1)
+		for i := range weights {
+			v := b[1+i/2]
+			if i%2 == 0 {
+				v >>= 4
+			}
+			weights[i] = v & 0xf
+		}
+	} else {
+		n += hb
+		if n > len(b) {
+			return 0, errCorrupted("truncated Huffman tree description")
+		}
+		var err error
+		weights, err = readHuffWeights(b[1:n])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, t.build(weights)
+}
+
+// readHuffWeights decodes FSE compressed Huffman weights.
+func readHuffWeights(b []byte) ([]uint8, error) {
+	counts, log, n, err := readFSECounts(b, maxHuffLog, 6)
+	if err != nil {
+		return nil, err
+	}
+	var t fseTable
+	if err = t.build(counts, log); err != nil {
+		return nil, err
+	}
+	var r backwardBits
+	if err = r.init(b[n:]); err != nil {
+		return nil, err
+	}
+	var s1, s2 fseState
+	s1.init(&t, &r)
+	s2.init(&t, &r)
+	weights := make([]uint8, 0, maxHuffSymbols)
+	// two interleaved states, until the stream is overflowed
+	for {
+		if len(weights) >= maxHuffSymbols-1 {
+			return nil, errCorrupted("too many Huffman weights")
+		}
+		weights = append(weights, s1.symbol())
+		s1.update(&r)
+		if r.overflow() {
+			weights = append(weights, s2.symbol())
+			break
+		}
+		weights = append(weights, s2.symbol())
+		s2.update(&r)
+		if r.overflow() {
+			weights = append(weights, s1.symbol())
+			break
+		}
+	}
+	return weights, nil
+}
+
+// build fills the decoding table from the weights of all symbols except the last one.
+func (t *huffTable) build(weights []uint8) error {
+	var sum uint32
+	for _, w := range weights {
+		if w > maxHuffLog {
+			return errCorrupted("invalid Huffman weight")
+		} else if w > 0 {
+			sum += 1 << (w - 1)
+		}
+	}
+	if sum == 0 {
+		return errCorrupted("empty Huffman tree")
+	}
+	maxBits := highBit(sum) + 1
+	left := uint32(1)<<maxBits - sum
+	if maxBits > maxHuffLog || left&(left-1) != 0 {
+		return errCorrupted("incomplete Huffman tree")
+	}
+	weights = append(weights, uint8(highBit(left)+1))
+	if len(weights) > maxHuffSymbols {
+		return errCorrupted("too many Huffman symbols")
+	}
+
+	var rank [maxHuffLog + 2]uint32
+	for _, w := range weights {
+		if w > 0 {
+			rank[maxBits+1-uint(w)]++
+		}
+	}
+	// the start index in the table for codes of each length; longer codes go first
+	var start [maxHuffLog + 2]uint32
+	for nb := maxBits; nb >= 1; nb-- {
+		start[nb-1] = start[nb] + rank[nb]<<(maxBits-nb)
+	}
+	t.maxBits = maxBits
+	size := 1 << maxBits
+	if cap(t.table) >= size {
+		t.table = t.table[:size]
+	} else {
+		t.table = make([]huffEntry, size)
+	}
+	for s, w := range weights {
+		if w == 0 {
+			continue
+		}
+		nb := maxBits + 1 - uint(w)
+		n := uint32(1) << (maxBits - nb)
+		e := huffEntry{symbol: uint8(s), nbits: uint8(nb)}
+		for i := start[nb]; i < start[nb]+n; i++ {
+			t.table[i] = e
+		}
+		start[nb] += n
+	}
+	return nil
+}
+
+// decode decodes a single Huffman stream into dst, which must have the exact size of the output.
+func (t *huffTable) decode(dst, src []byte) error {
+	var r backwardBits
+	if err := r.init(src); err != nil {
+		return err
+	}
+	for i := range dst {
+		e := t.table[r.peek(t.maxBits)]
+		dst[i] = e.symbol
+		r.pos -= int(e.nbits)
+	}
+	if !r.done() {
+		return errCorrupted("invalid Huffman stream size")
+	}
+	return nil
+}
+
+// decode4 decodes four Huffman streams prefixed with a jump table.
+func (t *huffTable) decode4(dst, src []byte) error {
+	if len(src) < 6 {
+		return errCorrupted("truncated Huffman jump table")
+	}
+	var sizes [4]int
+	total := 6
+	for i := 0; i < 3; i++ {
+		sizes[i] = int(src[2*i]) | int(src[2*i+1])<<8
+		total += sizes[i]
+	}
+	if total > len(src) {
+		return errCorrupted("invalid Huffman jump table")
+	}
+	sizes[3] = len(src) - total
+	src = src[6:]
+	seg := (len(dst) + 3) / 4
+	if 3*seg > len(dst) {
+		return errCorrupted("too few literals for 4 streams")
+	}
+	for i := 0; i < 4; i++ {
+		out := dst
+		if i < 3 {
+			out = dst[:seg]
+		}
+		if err := t.decode(out, src[:sizes[i]]); err != nil {
+			return err
+		}
+		dst, src = dst[len(out):], src[sizes[i]:]
+	}
+	return nil
+}
+
+// huffEncoder is a Huffman code for literals.
+type huffEncoder struct {
+	nbits [maxHuffSymbols]uint8
+	codes [maxHuffSymbols]uint16
+	last  int // the last used symbol
+}
+
+// huffNode is a node of the Huffman tree used to calculate code lengths.
+type huffNode struct {
+	count uint32
+	sym   int // -1 for internal nodes
+	left  *huffNode
+	right *huffNode
+}
+
+type huffHeap []*huffNode
+
+func (h huffHeap) Len() int            { return len(h) }
+func (h huffHeap) Less(i, j int) bool  { return h[i].count < h[j].count }
+func (h huffHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *huffHeap) Push(x interface{}) { *h = append(*h, x.(*huffNode)) }
+func (h *huffHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// build calculates the code for given symbol counts. It returns false if there are less than two symbols.
+func (e *huffEncoder) build(counts *[maxHuffSymbols]uint32) bool {
+	e.last = -1
+	used := 0
+	for s, c := range counts {
+		if c != 0 {
+			e.last = s
+			used++
+		}
+	}
+	if used < 2 {
+		return false
+	}
+	var cnt [maxHuffSymbols]uint32
+	copy(cnt[:], counts[:])
+	for {
+		e.nbits = [maxHuffSymbols]uint8{}
+		if e.lengths(&cnt) <= maxHuffLog {
+			break
+		}
+		// flatten the distribution until the code fits
+		for s, c := range cnt {
+			if c != 0 {
+				cnt[s] = (c + 1) / 2
+			}
+		}
+	}
+	maxBits := uint8(0)
+	for _, nb := range e.nbits {
+		if nb > maxBits {
+			maxBits = nb
+		}
+	}
+	// canonical codes, the same way the decoder builds its table
+	var rank [maxHuffLog + 2]uint32
+	for _, nb := range e.nbits {
+		if nb > 0 {
+			rank[nb]++
+		}
+	}
+	var start [maxHuffLog + 2]uint32
+	for nb := maxBits; nb >= 1; nb-- {
+		start[nb-1] = start[nb] + rank[nb]<<(maxBits-nb)
+	}
+	for s, nb := range e.nbits {
+		if nb == 0 {
+			continue
+		}
+		e.codes[s] = uint16(start[nb] >> (maxBits - nb))
+		start[nb] += 1 << (maxBits - nb)
+	}
+	return true
+}
+
+// lengths sets code lengths with the Huffman algorithm and returns the maximal length.
+func (e *huffEncoder) lengths(counts *[maxHuffSymbols]uint32) uint8 {
+	h := make(huffHeap, 0, maxHuffSymbols)
+	for s, c := range counts {
+		if c != 0 {
+			h = append(h, &huffNode{count: c, sym: s})
+		}
+	}
+	// stable order for equal counts, so the output is deterministic
+	sort.SliceStable(h, func(i, j int) bool { return h[i].count < h[j].count })
+	heap.Init(&h)
+	for h.Len() > 1 {
+		a := heap.Pop(&h).(*huffNode)
+		b := heap.Pop(&h).(*huffNode)
+		heap.Push(&h, &huffNode{count: a.count + b.count, sym: -1, left: a, right: b})
+	}
+	var max uint8
+	var walk func(n *huffNode, depth uint8)
+	walk = func(n *huffNode, depth uint8) {
+		if n.sym >= 0 {
+			e.nbits[n.sym] = depth
+			if depth > max {
+				max = depth
+			}
+			return
+		}
+		walk(n.left, depth+1)
+		walk(n.right, depth+1)
+	}
+	walk(h[0], 0)
+	return max
+}
+
+// writeTable appends the tree description. It returns false if the weights cannot be written.
+func (e *huffEncoder) writeTable(out []byte) ([]byte, bool) {
+	maxBits := uint8(0)
+	for _, nb := range e.nbits {
+		if nb > maxBits {
+			maxBits = nb
+		}
+	}
+	// the weight of the last symbol is implied
+	weights := make([]uint8, e.last)
+	for s := range weights {
+		if nb := e.nbits[s]; nb != 0 {
+			weights[s] = maxBits + 1 - nb
+		}
+	}
+	direct := len(weights) <= maxDirectWeights
+	if fse := compressWeights(weights); fse != nil && (!direct || len(fse) < (len(weights)+1)/2) {
+		out = append(out, byte(len(fse)))
+		return append(out, fse...), true
+	} else if !direct {
+		return out, false
+	}
+	out = append(out, byte(127+len(weights)))
+	for i := 0; i < len(weights); i += 2 {
+		b := weights[i] << 4
+		if i+1 < len(weights) {
+			b |= weights[i+1]
+		}
+		out = append(out, b)
+	}
+	return out, true
+}
+
+// compressWeights returns FSE compressed Huffman weights, or nil if they cannot be compressed.
+func compressWeights(weights []uint8) []byte {
+	var counts [maxHuffLog + 1]uint32
+	used := 0
+	for _, w := range weights {
+		if counts[w] == 0 {
+			used++
+		}
+		counts[w]++
+	}
+	if used < 2 || len(weights) < 3 {
+		return nil
+	}
+	norm, log := normalizeCounts(counts[:], 6)
+	out := appendFSECounts(nil, norm, log)
+	t := newFSEEncTable(norm, log)
+
+	// two interleaved states, the same way as the reference implementation does
+	w := bitWriter{out: out}
+	var s1, s2 fseEncoder
+	i := len(weights)
+	if i%2 == 1 {
+		s1.init(t, weights[i-1])
+		s2.init(t, weights[i-2])
+		s1.encode(&w, weights[i-3])
+		i -= 3
+	} else {
+		s2.init(t, weights[i-1])
+		s1.init(t, weights[i-2])
+		i -= 2
+	}
+	for ; i > 0; i -= 2 {
+		s2.encode(&w, weights[i-1])
+		s1.encode(&w, weights[i-2])
+	}
+	s2.flush(&w)
+	s1.flush(&w)
+	out = w.close()
+	if len(out) >= 128 {
+		return nil
+	}
+	// the decoder stops when the stream is exhausted, which is not the case for some distributions
+	if got, err := readHuffWeights(out); err != nil || string(got) != string(weights) {
+		return nil
+	}
+	return out
+}
+
+// encode appends a single Huffman stream with the literals.
+func (e *huffEncoder) encode(out, lits []byte) []byte {
+	w := bitWriter{out: out}
+	// the decoder reads the stream backward
+	for i := len(lits) - 1; i >= 0; i-- {
+		s := lits[i]
+		w.add(uint64(e.codes[s]), uint(e.nbits[s]))
+	}
+	return w.close()
+}
+
+// encode4 appends four Huffman streams with a jump table.
+func (e *huffEncoder) encode4(out, lits []byte) []byte {
+	start := len(out)
+	out = append(out, 0, 0, 0, 0, 0, 0)
+	seg := (len(lits) + 3) / 4
+	for i := 0; i < 4; i++ {
+		part := lits
+		if i < 3 {
+			part = lits[:seg]
+		}
+		lits = lits[len(part):]
+		n := len(out)
+		out = e.encode(out, part)
+		if i < 3 {
+			sz := len(out) - n
+			out[start+2*i] = byte(sz)
+			out[start+2*i+1] = byte(sz >> 8)
+		}
+	}
+	return out
+}
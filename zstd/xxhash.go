@@ -0,0 +1,101 @@
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// XXH64 primes.
+const (
+	prime1 uint64 = 11400714785074694791
+	prime2 uint64 = 14029467366897019727
+	prime3 uint64 = 1609587929392839161
+	prime4 uint64 = 9650029242287828579
+	prime5 uint64 = 2870177450012600261
+)
+
+// xxhash is a streaming XXH64 digest with a zero seed, used for frame checksums.
+type xxhash struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int // bytes in buf
+}
+
+func (d *xxhash) reset() {
+	p1 := prime1 // wraps around, unlike constants
+	d.v = [4]uint64{p1 + prime2, prime2, 0, -p1}
+	d.total = 0
+	d.n = 0
+}
+
+func xxRound(acc, in uint64) uint64 {
+	acc += in * prime2
+	return bits.RotateLeft64(acc, 31) * prime1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+	acc ^= xxRound(0, v)
+	return acc*prime1 + prime4
+}
+
+func (d *xxhash) stripes(p []byte) {
+	for ; len(p) >= 32; p = p[32:] {
+		d.v[0] = xxRound(d.v[0], binary.LittleEndian.Uint64(p[0:]))
+		d.v[1] = xxRound(d.v[1], binary.LittleEndian.Uint64(p[8:]))
+		d.v[2] = xxRound(d.v[2], binary.LittleEndian.Uint64(p[16:]))
+		d.v[3] = xxRound(d.v[3], binary.LittleEndian.Uint64(p[24:]))
+	}
+}
+
+func (d *xxhash) write(p []byte) {
+	d.total += uint64(len(p))
+	if d.n > 0 {
+		c := copy(d.buf[d.n:], p)
+		d.n += c
+		p = p[c:]
+		if d.n < 32 {
+			return
+		}
+		d.stripes(d.buf[:])
+		d.n = 0
+	}
+	n := len(p) &^ 31
+	d.stripes(p[:n])
+	d.n = copy(d.buf[:], p[n:])
+}
+
+func (d *xxhash) sum64() uint64 {
+	var h uint64
+	if d.total >= 32 {
+		v := d.v
+		h = bits.RotateLeft64(v[0], 1) + bits.RotateLeft64(v[1], 7) +
+			bits.RotateLeft64(v[2], 12) + bits.RotateLeft64(v[3], 18)
+		for _, x := range v {
+			h = xxMerge(h, x)
+		}
+	} else {
+		h = prime5
+	}
+	h += d.total
+	p := d.buf[:d.n]
+	for ; len(p) >= 8; p = p[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		h = bits.RotateLeft64(h, 27)*prime1 + prime4
+	}
+	if len(p) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(p)) * prime1
+		h = bits.RotateLeft64(h, 23)*prime2 + prime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		h ^= uint64(b) * prime5
+		h = bits.RotateLeft64(h, 11) * prime1
+	}
+	h ^= h >> 33
+	h *= prime2
+	h ^= h >> 29
+	h *= prime3
+	h ^= h >> 32
+	return h
+}
@@ -0,0 +1,134 @@
+// Package zstd implements reading and writing of Zstandard compressed data (RFC 8878).
+//
+// The reader supports all frames produced by other implementations, except the ones that need a dictionary.
+// The writer favors speed and simplicity over ratio: it uses hash chains with lazy matching, FSE tables
+// for sequences and Huffman compression for literals. Its output can be read by any Zstandard decoder.
+package zstd
+
+import (
+	"errors"
+)
+
+const (
+	frameMagic     = 0xFD2FB528
+	skippableMagic = 0x184D2A50 // the low 4 bits are user-defined
+	skippableMask  = 0xFFFFFFF0
+
+	// maxBlockSize is the maximal size of the decompressed block content.
+	maxBlockSize = 128 << 10
+	// maxWindowSize is the largest window the reader will allocate. It matches the default limit of the
+	// reference implementation.
+	maxWindowSize = 1 << 27
+
+	// repeat offsets at the start of the frame
+	rep0, rep1, rep2 = 1, 4, 8
+)
+
+var (
+	// ErrDictionary is returned for frames that require a dictionary.
+	ErrDictionary = errors.New("zstd: dictionaries are not supported")
+	// ErrWindowTooLarge is returned for frames that require more memory than the reader allows.
+	ErrWindowTooLarge = errors.New("zstd: window size is too large")
+	// ErrChecksum is returned when the content does not match the frame checksum.
+	ErrChecksum = errors.New("zstd: invalid checksum")
+)
+
+// CorruptError is returned when the input is not a valid Zstandard stream.
+type CorruptError string
+
+func (e CorruptError) Error() string {
+	return "zstd: corrupted input: " + string(e)
+}
+
+func errCorrupted(msg string) error {
+	return CorruptError(msg)
+}
+
+// Block types.
+const (
+	blockRaw = iota
+	blockRLE
+	blockCompressed
+	blockReserved
+)
+
+// Literals block types.
+const (
+	litRaw = iota
+	litRLE
+	litCompressed
+	litTreeless
+)
+
+// Symbol compression modes of sequences.
+const (
+	modePredefined = iota
+	modeRLE
+	modeFSE
+	modeRepeat
+)
+
+// Literal length codes: base value and the number of additional bits.
+var (
+	llBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	llBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+)
+
+// Match length codes: base value and the number of additional bits.
+var (
+	mlBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	mlBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+const (
+	maxLLCode = 35
+	maxMLCode = 52
+	maxOFCode = 31
+
+	maxLLLog = 9
+	maxMLLog = 9
+	maxOFLog = 8
+)
+
+// Predefined distributions of sequence codes.
+var (
+	predefLL = []int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}
+	predefML = []int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}
+	predefOF = []int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}
+)
+
+const (
+	predefLLLog = 6
+	predefMLLog = 6
+	predefOFLog = 5
+)
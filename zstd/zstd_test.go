@@ -0,0 +1,222 @@
+package zstd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testInputs returns data with different properties for round trip tests.
+func testInputs() map[string][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 300<<10)
+	rnd.Read(random)
+
+	var text bytes.Buffer
+	words := strings.Fields("the quick brown fox jumps over lazy dog content addressable storage blob ref")
+	for text.Len() < 1<<20 {
+		fmt.Fprintf(&text, "%s %d, ", words[rnd.Intn(len(words))], rnd.Intn(1000))
+		if rnd.Intn(10) == 0 {
+			text.WriteString("\n")
+		}
+	}
+
+	binary := make([]byte, 2<<20)
+	for i := range binary {
+		// some bytes above 127, so literals are not Huffman compressed
+		binary[i] = byte(rnd.Intn(4) * 60)
+	}
+	// long repeats far apart, beyond the writer window
+	copy(binary[1<<20:], random)
+
+	return map[string][]byte{
+		"empty":  nil,
+		"byte":   {'a'},
+		"short":  []byte("hello, hello, hello!"),
+		"zeros":  make([]byte, 1<<20),
+		"random": random,
+		"text":   text.Bytes(),
+		"binary": binary,
+	}
+}
+
+func compress(t testing.TB, data []byte) []byte {
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	// odd write sizes to check buffering
+	for p := data; len(p) > 0; {
+		n := 7777
+		if n > len(p) {
+			n = len(p)
+		}
+		_, err := w.Write(p[:n])
+		require.NoError(t, err)
+		p = p[n:]
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func decompress(data []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, data := range testInputs() {
+		t.Run(name, func(t *testing.T) {
+			z := compress(t, data)
+			if name == "text" || name == "zeros" {
+				require.True(t, len(z) < len(data)/2, "compressed to %d of %d", len(z), len(data))
+			}
+			got, err := decompress(z)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(data, got))
+		})
+	}
+}
+
+func TestReaderFrames(t *testing.T) {
+	a, b := []byte("first frame"), bytes.Repeat([]byte("second frame "), 100)
+	var buf bytes.Buffer
+	buf.Write(compress(t, a))
+	// skippable frame
+	buf.Write([]byte{0x5a, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 'x', 'y', 'z'})
+	buf.Write(compress(t, b))
+	got, err := decompress(buf.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, string(a)+string(b), string(got))
+
+	_, err = NewReader(bytes.NewReader(nil))
+	require.Equal(t, io.EOF, err)
+
+	z := compress(t, b)
+	_, err = decompress(z[:len(z)-1])
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+
+	z[len(z)-1] ^= 1
+	_, err = decompress(z)
+	require.Equal(t, ErrChecksum, err)
+}
+
+// refFrames are produced by the reference implementation.
+var refFrames = []struct {
+	name string
+	data string
+	exp  string
+}{
+	// printf "hello, hello, hello, hello!" > h.txt && zstd -19 h.txt
+	{"single segment", "28b52ffd241b7500004068656c6c6f2c202101004a8a1116586eba", "hello, hello, hello, hello!"},
+}
+
+func TestReaderReference(t *testing.T) {
+	for _, c := range refFrames {
+		data, err := hex.DecodeString(c.data)
+		require.NoError(t, err)
+		got, err := decompress(data)
+		require.NoError(t, err, c.name)
+		require.Equal(t, c.exp, string(got), c.name)
+	}
+}
+
+func TestReaderCorrupted(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	data := testInputs()["text"][:200<<10]
+	z := compress(t, data)
+	for i := 0; i < 2000; i++ {
+		c := append([]byte{}, z...)
+		for j := rnd.Intn(3) + 1; j > 0; j-- {
+			c[rnd.Intn(len(c))] ^= byte(1 + rnd.Intn(255))
+		}
+		// must not panic or hang
+		_, _ = decompress(c)
+	}
+}
+
+func zstdCLI(t *testing.T) string {
+	path, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd is not installed")
+	}
+	return path
+}
+
+func TestReferenceDecode(t *testing.T) {
+	cli := zstdCLI(t)
+	for name, data := range testInputs() {
+		t.Run(name, func(t *testing.T) {
+			cmd := exec.Command(cli, "-d", "-c", "-q")
+			cmd.Stdin = bytes.NewReader(compress(t, data))
+			got, err := cmd.Output()
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(data, got))
+		})
+	}
+}
+
+func TestReferenceEncode(t *testing.T) {
+	cli := zstdCLI(t)
+	for name, data := range testInputs() {
+		for _, level := range []string{"-1", "-3", "-9", "-19", "--fast=5"} {
+			t.Run(name+level, func(t *testing.T) {
+				cmd := exec.Command(cli, level, "-c", "-q", "--no-check")
+				if level == "-3" {
+					cmd = exec.Command(cli, level, "-c", "-q", "--check")
+				}
+				cmd.Stdin = bytes.NewReader(data)
+				z, err := cmd.Output()
+				require.NoError(t, err)
+				got, err := decompress(z)
+				require.NoError(t, err)
+				require.True(t, bytes.Equal(data, got))
+			})
+		}
+	}
+}
+
+func TestXXHash(t *testing.T) {
+	for _, c := range []struct {
+		data string
+		sum  uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+	} {
+		var d xxhash
+		d.reset()
+		d.write([]byte(c.data))
+		require.Equal(t, c.sum, d.sum64(), c.data)
+	}
+
+	// streaming writes must match a single one
+	data := testInputs()["text"][:1000]
+	var exp xxhash
+	exp.reset()
+	exp.write(data)
+	for _, n := range []int{1, 7, 31, 32, 33, 100} {
+		var d xxhash
+		d.reset()
+		for p := data; len(p) > 0; {
+			m := n
+			if m > len(p) {
+				m = len(p)
+			}
+			d.write(p[:m])
+			p = p[m:]
+		}
+		require.Equal(t, exp.sum64(), d.sum64(), "%d", n)
+	}
+}